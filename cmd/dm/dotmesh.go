@@ -38,6 +38,6 @@ func main() {
 
 	// Execute the command
 	if err := commands.MainCmd.Execute(); err != nil {
-		os.Exit(-1)
+		commands.ExitWithUsageError(err)
 	}
 }
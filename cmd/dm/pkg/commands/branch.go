@@ -3,7 +3,6 @@ package commands
 import (
 	"fmt"
 	"io"
-	"os"
 
 	"github.com/dotmesh-oss/dotmesh/pkg/client"
 	"github.com/spf13/cobra"
@@ -32,6 +31,13 @@ func NewCmdBranch(out io.Writer) *cobra.Command {
 				if err != nil {
 					return err
 				}
+				if structuredOutput() {
+					entries := []branchEntry{}
+					for _, branch := range bs {
+						entries = append(entries, branchEntry{Name: branch, Current: branch == b})
+					}
+					return printStructured(out, entries)
+				}
 				for _, branch := range bs {
 					if branch == b {
 						branch = "* " + branch
@@ -43,10 +49,15 @@ func NewCmdBranch(out io.Writer) *cobra.Command {
 				return nil
 			}()
 			if err != nil {
-				fmt.Fprintln(os.Stderr, err.Error())
-				os.Exit(1)
+				exitWithError(err, exitFailure)
 			}
 		},
 	}
 	return cmd
 }
+
+// branchEntry is how 'dm branch' describes each branch with --output
+type branchEntry struct {
+	Name    string
+	Current bool
+}
@@ -0,0 +1,112 @@
+package commands
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/dotmesh-oss/dotmesh/pkg/client"
+	"github.com/spf13/cobra"
+)
+
+func NewCmdExport(out io.Writer) *cobra.Command {
+	var branch, since, file string
+	cmd := &cobra.Command{
+		Use:   "export <dot> [--branch <branch>] [--since <commit>] > <bundle>",
+		Short: "Write a dot's commits to a bundle that 'dm import' can read",
+		Long: `Write the commits on a branch of a dot, and on the branches it was made
+from, to a single file, for copying to a cluster that can't be reached with
+'dm push'. Uncommitted changes aren't included.
+
+With --since, only the commits after the given one are written, to bring a
+copy made with an earlier bundle up to date. The bundle goes to standard
+output unless --file is given.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			runHandlingError(func() error {
+				if len(args) != 1 {
+					return fmt.Errorf("Please specify the dot to export")
+				}
+				dm, err := client.NewDotmeshAPI(configPath, verboseOutput)
+				if err != nil {
+					return err
+				}
+				dot := args[0]
+				if branch == "" {
+					branch = "master"
+				}
+
+				w := out
+				if file != "" {
+					f, err := os.Create(file)
+					if err != nil {
+						return err
+					}
+					defer f.Close()
+					w = f
+				}
+				err = dm.Export(dot, branch, since, w)
+				if err != nil {
+					if file != "" {
+						// don't leave half a bundle behind
+						os.Remove(file)
+					}
+					return err
+				}
+				return nil
+			})
+		},
+	}
+	cmd.Flags().StringVarP(&branch, "branch", "b", "", "Branch to export (defaults to master)")
+	cmd.Flags().StringVarP(&since, "since", "", "", "Only export the commits after this one")
+	cmd.Flags().StringVarP(&file, "file", "f", "", "Write the bundle to this file instead of standard output")
+	return cmd
+}
+
+func NewCmdImport(out io.Writer) *cobra.Command {
+	var file string
+	cmd := &cobra.Command{
+		Use:   "import [<dot>] < <bundle>",
+		Short: "Apply a bundle written by 'dm export'",
+		Long: `Read a bundle written by 'dm export', creating the dot and branches in it
+if they don't exist, or adding its commits to them if they do. Give <dot> to
+import it under a different name to the one it was exported with.
+
+The bundle is read from standard input unless --file is given.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			runHandlingError(func() error {
+				if len(args) > 1 {
+					return fmt.Errorf("Please specify at most one dot to import as")
+				}
+				dm, err := client.NewDotmeshAPI(configPath, verboseOutput)
+				if err != nil {
+					return err
+				}
+				asDot := ""
+				if len(args) == 1 {
+					asDot = args[0]
+				}
+
+				var r io.Reader = os.Stdin
+				if file != "" {
+					f, err := os.Open(file)
+					if err != nil {
+						return err
+					}
+					defer f.Close()
+					r = f
+				}
+				result, err := dm.Import(r, asDot)
+				if err != nil {
+					return err
+				}
+				if structuredOutput() {
+					return printStructured(out, result)
+				}
+				fmt.Fprintf(out, "Imported %d commits to %s, branch %s\n", result.Commits, result.Dot.String(), result.Branch)
+				return nil
+			})
+		},
+	}
+	cmd.Flags().StringVarP(&file, "file", "f", "", "Read the bundle from this file instead of standard input")
+	return cmd
+}
@@ -3,7 +3,6 @@ package commands
 import (
 	"fmt"
 	"io"
-	"os"
 
 	"github.com/dotmesh-oss/dotmesh/pkg/client"
 	"github.com/spf13/cobra"
@@ -36,11 +35,13 @@ func NewCmdCheckout(out io.Writer) *cobra.Command {
 				if err := dm.CheckoutBranch(v, b, branch, makeBranch); err != nil {
 					return err
 				}
+				if structuredOutput() {
+					return printStructured(out, dotResult{Dot: v, Branch: branch})
+				}
 				return nil
 			}()
 			if err != nil {
-				fmt.Fprintln(os.Stderr, err.Error())
-				os.Exit(1)
+				exitWithError(err, exitFailure)
 			}
 		},
 	}
@@ -10,6 +10,9 @@ import (
 var cloneLocalVolume string
 var stash bool
 
+// transfers with a higher priority start first when the cluster queues them
+var transferPriority int
+
 func NewCmdClone(out io.Writer) *cobra.Command {
 	cmd := &cobra.Command{
 		Use:   "clone <remote> [<dot> [<branch>]] [--local-name=<dot>] [--stash-on-divergence]",
@@ -45,12 +48,13 @@ Online help: https://docs.dotmesh.com/references/cli/#clone-dm-clone-local-name-
 					filesystemName, branchName,
 					nil,
 					stash,
+					transferPriority,
 					// TODO also switch to the remote?
 				)
 				if err != nil {
 					return err
 				}
-				err = dm.PollTransfer(transferId, out, dm.UpdateBar)
+				err = pollTransfer(dm, transferId, out)
 				if err != nil {
 					return err
 				}
@@ -63,5 +67,7 @@ Online help: https://docs.dotmesh.com/references/cli/#clone-dm-clone-local-name-
 	cmd.PersistentFlags().StringVarP(&cloneLocalVolume, "local-name", "", "",
 		"Local dot name to create")
 	cmd.PersistentFlags().BoolVarP(&stash, "stash-on-divergence", "", false, "stash any divergence on a branch and continue")
+	cmd.PersistentFlags().IntVarP(&transferPriority, "priority", "", 0,
+		"start before queued transfers with a lower priority, if the cluster is busy")
 	return cmd
 }
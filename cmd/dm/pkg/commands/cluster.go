@@ -15,6 +15,7 @@ import (
 	"path/filepath"
 	"strings"
 	"syscall"
+	"text/tabwriter"
 	"time"
 
 	"golang.org/x/sys/unix"
@@ -71,6 +72,8 @@ var (
 	externalUserManagerUrl string
 	port                   int
 	kernelZFSVersion       string
+	filesystemBackend      string
+	filesystemDir          string
 )
 
 // names of environment variables we pass from the content of `dm cluster {init,join}`
@@ -130,6 +133,8 @@ another.`,
 
 	cmd.AddCommand(NewCmdClusterBackupEtcd(os.Stdout))
 	cmd.AddCommand(NewCmdClusterRestoreEtcd(os.Stdout, os.Stdin))
+	cmd.AddCommand(NewCmdClusterListBackups(os.Stdout))
+	cmd.AddCommand(NewCmdClusterRecoverRegistry(os.Stdout))
 
 	cmd.PersistentFlags().StringVar(
 		&traceAddr, "trace", "",
@@ -174,6 +179,15 @@ another.`,
 		&poolSize, "pool-size",
 		"", "size of pool to create",
 	)
+	cmd.PersistentFlags().StringVar(
+		&filesystemBackend, "filesystem-backend",
+		types.FilesystemBackendZFS, "what to keep dots on: zfs, btrfs (needs --filesystem-dir "+
+			"on a btrfs filesystem) or directory (plain directories, for testing)",
+	)
+	cmd.PersistentFlags().StringVar(
+		&filesystemDir, "filesystem-dir",
+		"", "directory in which the btrfs and directory backends keep dots",
+	)
 	cmd.PersistentFlags().StringVar(
 		&discoveryUrl, "discovery-url",
 		"https://discovery.dotmesh.io", "URL of discovery service. "+
@@ -201,13 +215,11 @@ func NewCmdClusterBackupEtcd(out io.Writer) *cobra.Command {
 
 			dm, err := client.NewDotmeshAPI(configPath, verboseOutput)
 			if err != nil {
-				fmt.Fprintln(os.Stderr, err.Error())
-				os.Exit(1)
+				exitWithError(err, exitFailure)
 			}
 			dump, err := dm.BackupEtcd()
 			if err != nil {
-				fmt.Fprintln(os.Stderr, err.Error())
-				os.Exit(1)
+				exitWithError(err, exitFailure)
 			}
 			out.Write([]byte(dump))
 
@@ -217,31 +229,170 @@ func NewCmdClusterBackupEtcd(out io.Writer) *cobra.Command {
 }
 
 func NewCmdClusterRestoreEtcd(out io.Writer, in io.Reader) *cobra.Command {
+	var backupName, at string
+	var dryRun bool
 	cmd := &cobra.Command{
 		Use:   "restore-etcd",
-		Short: "Restore users (except admin) and registry from an etcd backup on stdin",
-		Long:  "Online help: FIXME",
+		Short: "Restore users (except admin) and registry from an etcd backup on stdin, or a scheduled backup",
+		Long: `Restore users (except admin) and the registry from a backup made by
+'dm cluster backup-etcd', read from stdin, or from one of the backups the
+cluster keeps when DOTMESH_BACKUP_DIR or DOTMESH_BACKUP_S3_BUCKET is set: the
+one named with --backup, or the latest made at or before --at. Use --dry-run to
+see what would change first.`,
 		Run: func(cmd *cobra.Command, args []string) {
+			restore := types.RestoreBackupArgs{Backup: backupName, DryRun: dryRun}
+			if at != "" {
+				t, err := time.Parse(time.RFC3339, at)
+				if err != nil {
+					exitWithError(fmt.Errorf("--at must be a time like 2006-01-02T15:04:05Z: %s", err), exitFailure)
+				}
+				restore.At = t
+			}
+			if backupName == "" && at == "" {
+				bs, err := ioutil.ReadAll(in)
+				if err != nil {
+					exitWithError(err, exitFailure)
+				}
+				restore.Dump = string(bs)
+			}
 
-			bs, err := ioutil.ReadAll(in)
+			dm, err := client.NewDotmeshAPI(configPath, verboseOutput)
+			if err != nil {
+				exitWithError(err, exitFailure)
+			}
+			report, err := dm.RestoreBackup(restore)
 			if err != nil {
-				fmt.Fprintln(os.Stderr, err.Error())
-				os.Exit(1)
+				exitWithError(err, exitFailure)
 			}
+			printRestoreReport(out, report, dryRun)
+		},
+	}
+	cmd.Flags().StringVar(
+		&backupName, "backup", "",
+		"Restore this scheduled backup, as listed by 'dm cluster list-backups'",
+	)
+	cmd.Flags().StringVar(
+		&at, "at", "",
+		"Restore the latest scheduled backup made at or before this time (RFC 3339)",
+	)
+	cmd.Flags().BoolVar(
+		&dryRun, "dry-run", false,
+		"Show what restoring would change without changing anything",
+	)
+	return cmd
+}
+
+func printRestoreReport(out io.Writer, report types.RestoreReport, dryRun bool) {
+	if report.Backup != "" {
+		fmt.Fprintf(out, "Backup %s\n", report.Backup)
+	}
+	fmt.Fprintf(out, "Made at %s", report.Created.Format(time.RFC3339))
+	if report.ServerVersion != "" {
+		fmt.Fprintf(out, " by dotmesh-server %s", report.ServerVersion)
+	}
+	fmt.Fprintf(out, "\n")
+
+	verbs := []string{"Added", "Removed", "Changed"}
+	if dryRun {
+		verbs = []string{"Would add", "Would remove", "Would change"}
+	}
+	for _, kind := range []struct {
+		name    string
+		changes types.BackupChanges
+	}{
+		{"user", report.Users},
+		{"master", report.FilesystemMasters},
+		{"dot", report.RegistryFilesystems},
+		{"branch", report.RegistryClones},
+		{"organization", report.Organizations},
+	} {
+		for i, keys := range [][]string{kind.changes.Added, kind.changes.Removed, kind.changes.Changed} {
+			for _, key := range keys {
+				fmt.Fprintf(out, "%s %s %s\n", verbs[i], kind.name, key)
+			}
+		}
+	}
+}
 
+func NewCmdClusterListBackups(out io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "list-backups",
+		Short: "List the scheduled backups of etcd kept by the cluster (the current remote)",
+		Run: func(cmd *cobra.Command, args []string) {
 			dm, err := client.NewDotmeshAPI(configPath, verboseOutput)
 			if err != nil {
-				fmt.Fprintln(os.Stderr, err.Error())
-				os.Exit(1)
+				exitWithError(err, exitFailure)
 			}
-			err = dm.RestoreEtcd(string(bs))
+			backups, err := dm.ListBackups()
 			if err != nil {
-				fmt.Fprintln(os.Stderr, err.Error())
-				os.Exit(1)
+				exitWithError(err, exitFailure)
+			}
+			w := tabwriter.NewWriter(out, 3, 8, 2, ' ', 0)
+			fmt.Fprintf(w, "NAME\tCREATED\tSIZE\n")
+			for _, b := range backups {
+				fmt.Fprintf(w, "%s\t%s\t%s\n", b.Name, b.Created.Format(time.RFC3339), prettyPrintSize(b.Size))
+			}
+			w.Flush()
+		},
+	}
+	return cmd
+}
+
+func NewCmdClusterRecoverRegistry(out io.Writer) *cobra.Command {
+	var dryRun bool
+	cmd := &cobra.Command{
+		Use:   "recover-registry",
+		Short: "Rebuild the registry from the dots on the current remote's disk, after losing etcd without a backup",
+		Long: `Rebuild dot names, branches and masters from what's kept with each dot on
+the current remote's disk, after the KV store has been lost without a backup.
+Records that still exist are left alone. Run it against each node with dots
+on it, once they're all up: each branch's master is the node with its latest
+commits. Users and organizations aren't recovered, so recreate them, or the
+dots they own won't be listed.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			dm, err := client.NewDotmeshAPI(configPath, verboseOutput)
+			if err != nil {
+				exitWithError(err, exitFailure)
+			}
+			recovery, err := dm.RecoverRegistry(dryRun)
+			if err != nil {
+				exitWithError(err, exitFailure)
 			}
 
+			verb := "Recovered"
+			if dryRun {
+				verb = "Would recover"
+			}
+			for _, rf := range recovery.Filesystems {
+				fmt.Fprintf(out, "%s dot %s/%s (%s)\n", verb, rf.OwnerId, rf.Name, rf.Id)
+			}
+			for _, c := range recovery.Clones {
+				fmt.Fprintf(out, "%s branch %s of %s (%s)\n", verb, c.Name, c.TopLevelFilesystemId, c.FilesystemId)
+			}
+			for _, fm := range recovery.Masters {
+				fmt.Fprintf(out, "%s %s as master of %s\n", verb, fm.NodeID, fm.FilesystemID)
+			}
+			for _, id := range recovery.Unrecorded {
+				fmt.Fprintf(out, "Can't recover %s, it has no registry properties\n", id)
+			}
+			for _, id := range recovery.Diverged {
+				fmt.Fprintf(out, "Can't pick a master for %s, its copies on different nodes have diverged; choose one with 'dm dot smash-branch-master'\n", id)
+			}
+			for _, owner := range recovery.MissingUsers {
+				fmt.Fprintf(out, "User %s doesn't exist, recreate them to see their dots\n", owner)
+			}
+			for _, owner := range recovery.MissingOrganizations {
+				fmt.Fprintf(out, "Organization %s doesn't exist, recreate it with 'dm org create' and add its members to see its dots\n", owner)
+			}
+			if len(recovery.Filesystems)+len(recovery.Clones)+len(recovery.Masters) == 0 {
+				fmt.Fprintf(out, "Nothing to recover\n")
+			}
 		},
 	}
+	cmd.Flags().BoolVar(
+		&dryRun, "dry-run", false,
+		"Show what would be recovered without changing anything",
+	)
 	return cmd
 }
 
@@ -253,8 +404,7 @@ func NewCmdClusterInit(out io.Writer) *cobra.Command {
 		Run: func(cmd *cobra.Command, args []string) {
 			err := clusterInit(cmd, args, out)
 			if err != nil {
-				fmt.Fprintln(os.Stderr, err.Error())
-				os.Exit(1)
+				exitWithError(err, exitFailure)
 			}
 		},
 	}
@@ -282,8 +432,7 @@ func NewCmdClusterJoin(out io.Writer) *cobra.Command {
 		Run: func(cmd *cobra.Command, args []string) {
 			err := clusterJoin(cmd, args, out)
 			if err != nil {
-				fmt.Fprintln(os.Stderr, err.Error())
-				os.Exit(1)
+				exitWithError(err, exitFailure)
 			}
 		},
 	}
@@ -311,8 +460,7 @@ func NewCmdClusterUpgrade(out io.Writer) *cobra.Command {
 		Run: func(cmd *cobra.Command, args []string) {
 			err := clusterUpgrade(cmd, args, out)
 			if err != nil {
-				fmt.Fprintln(os.Stderr, err.Error())
-				os.Exit(1)
+				exitWithError(err, exitFailure)
 			}
 		},
 	}
@@ -341,8 +489,7 @@ Online help: https://docs.dotmesh.com/references/cli/#remove-dotmesh-from-your-n
 		Run: func(cmd *cobra.Command, args []string) {
 			err := clusterReset(cmd, args, out)
 			if err != nil {
-				fmt.Fprintln(os.Stderr, err.Error())
-				os.Exit(1)
+				exitWithError(err, exitFailure)
 			}
 		},
 	}
@@ -407,6 +554,19 @@ func clusterUpgrade(cmd *cobra.Command, args []string, out io.Writer) error {
 }
 
 func clusterCommonPreflight() error {
+	switch filesystemBackend {
+	case types.FilesystemBackendZFS:
+	case types.FilesystemBackendBtrfs, types.FilesystemBackendDirectory:
+		if filesystemDir == "" {
+			return fmt.Errorf("--filesystem-dir is required for the %s backend", filesystemBackend)
+		}
+		if !filepath.IsAbs(filesystemDir) {
+			return fmt.Errorf("--filesystem-dir must be an absolute path, got %s", filesystemDir)
+		}
+	default:
+		return fmt.Errorf("unknown --filesystem-backend %s, expected zfs, btrfs or directory", filesystemBackend)
+	}
+
 	// - Pre-flight check, can I exec docker? Is it new enough (v1.10.0+)?
 	startTiming()
 	fmt.Printf("Checking suitable Docker is installed... ")
@@ -629,6 +789,7 @@ func startDotmeshContainer(pkiPath, adminKey, adminPassword string, storage *dot
 		"-e", fmt.Sprintf("USE_POOL_NAME=%s", usePoolName),
 		"-e", fmt.Sprintf("USE_POOL_DIR=%s", usePoolDir),
 		"-e", fmt.Sprintf("POOL_SIZE=%s", poolSize),
+		"-e", fmt.Sprintf("%s=%s", types.EnvFilesystemBackend, filesystemBackend),
 		// In case the docker daemon is older than the bundled docker client in
 		// the dotmesh-server image, at least allow the user to instruct it to
 		// fall back to an older API version.
@@ -677,6 +838,10 @@ func startDotmeshContainer(pkiPath, adminKey, adminPassword string, storage *dot
 	if usePoolDir != "" {
 		args = append(args, []string{"-v", fmt.Sprintf("%s:%s", usePoolDir, usePoolDir)}...)
 	}
+	if filesystemDir != "" {
+		args = append(args, "-e", fmt.Sprintf("%s=%s", types.EnvFilesystemDir, filesystemDir))
+		args = append(args, []string{"-v", fmt.Sprintf("%s:%s", filesystemDir, filesystemDir)}...)
+	}
 	args = append(args, []string{
 		dotmeshDockerImage,
 		// This attempts to download ZFS modules (if necc.) and modprobe them
@@ -3,7 +3,6 @@ package commands
 import (
 	"fmt"
 	"io"
-	"os"
 	"strings"
 
 	"github.com/dotmesh-oss/dotmesh/pkg/client"
@@ -11,7 +10,7 @@ import (
 )
 
 func NewCmdCommit(out io.Writer) *cobra.Command {
-
+	var sign bool
 	cmd := &cobra.Command{
 		Use:   "commit",
 		Short: "Record changes to a dot",
@@ -46,16 +45,27 @@ func NewCmdCommit(out io.Writer) *cobra.Command {
 					return err
 				}
 
-				id, err := dm.Commit(v, b, commitMsg, metadataPairs)
+				var id string
+				if sign {
+					key, keyErr := dm.Configuration.LoadSigningKey()
+					if keyErr != nil {
+						return keyErr
+					}
+					id, err = dm.CommitSigned(v, b, commitMsg, metadataPairs, key)
+				} else {
+					id, err = dm.Commit(v, b, commitMsg, metadataPairs)
+				}
 				if err != nil {
 					return err
 				}
+				if structuredOutput() {
+					return printStructured(out, dotResult{Dot: v, Branch: b, Commit: id})
+				}
 				fmt.Printf("%s\n", id)
 				return nil
 			}()
 			if err != nil {
-				fmt.Fprintln(os.Stderr, err.Error())
-				os.Exit(1)
+				exitWithError(err, exitFailure)
 			}
 		},
 	}
@@ -65,5 +75,8 @@ func NewCmdCommit(out io.Writer) *cobra.Command {
 	commitMetadata = cmd.Flags().StringSliceP("metadata", "d", []string{},
 		"Add custom metadata to the commit (e.g. --metadata name=value).")
 
+	cmd.Flags().BoolVarP(&sign, "sign", "S", false,
+		"Sign the commit with the key made by 'dm key generate', so 'dm log --verify' can show who made it.")
+
 	return cmd
 }
@@ -5,7 +5,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
-	"os"
 
 	"github.com/dotmesh-oss/dotmesh/pkg/client"
 	"github.com/spf13/cobra"
@@ -28,8 +27,7 @@ func NewCmdDebug(out io.Writer) *cobra.Command {
 						var params map[string]interface{}
 						err = json.Unmarshal([]byte(args[1]), &params)
 						if err != nil {
-							fmt.Fprintln(os.Stderr, err.Error())
-							os.Exit(1)
+							exitWithError(err, exitFailure)
 						}
 						err = dm.CallRemote(context.Background(), method, params, &response)
 					} else {
@@ -38,6 +36,12 @@ func NewCmdDebug(out io.Writer) *cobra.Command {
 				} else {
 					err = dm.CallRemote(context.Background(), method, nil, &response)
 				}
+				if err != nil {
+					return err
+				}
+				if structuredOutput() {
+					return printStructured(out, response)
+				}
 				r, err := json.Marshal(response)
 				if err != nil {
 					return err
@@ -46,8 +50,7 @@ func NewCmdDebug(out io.Writer) *cobra.Command {
 				return err
 			}()
 			if err != nil {
-				fmt.Fprintln(os.Stderr, err.Error())
-				os.Exit(1)
+				exitWithError(err, exitFailure)
 			}
 		},
 	}
@@ -0,0 +1,132 @@
+package commands
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/dotmesh-oss/dotmesh/pkg/client"
+	"github.com/dotmesh-oss/dotmesh/pkg/types"
+	"github.com/spf13/cobra"
+)
+
+func NewCmdDiff(out io.Writer) *cobra.Command {
+	var nameOnly bool
+	cmd := &cobra.Command{
+		Use:   "diff [<from>] [<to>] [-- <path>]",
+		Short: "Show changes between commits, or a commit and the working copy",
+		Long: `Compare two commits of the current dot, which can be on different
+branches. With one commit, compare it with the working copy of the current
+branch; with none, compare the latest commit with the working copy.
+
+Text files are shown as unified diffs, other files with how their size and
+modification time changed. Give a path after -- to only compare files
+under it.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			err := func() error {
+				commits := args
+				var path string
+				if dash := cmd.ArgsLenAtDash(); dash >= 0 {
+					commits = args[:dash]
+					if len(args)-dash > 1 {
+						return fmt.Errorf("Please specify at most one path after --")
+					}
+					if len(args) > dash {
+						path = args[dash]
+					}
+				}
+				if len(commits) > 2 {
+					return fmt.Errorf("Please specify at most two commits")
+				}
+				var from, to string
+				if len(commits) > 0 {
+					from = commits[0]
+				}
+				if len(commits) > 1 {
+					to = commits[1]
+				}
+
+				dm, err := client.NewDotmeshAPI(configPath, verboseOutput)
+				if err != nil {
+					return err
+				}
+				activeVolume, err := dm.StrictCurrentVolume()
+				if err != nil {
+					return err
+				}
+				if activeVolume == "" {
+					return fmt.Errorf(
+						"No current dot. Try 'dm list' and " +
+							"'dm switch' to switch to a dot.",
+					)
+				}
+				activeBranch, err := dm.CurrentBranch(activeVolume)
+				if err != nil {
+					return err
+				}
+
+				if structuredOutput() {
+					diffs := []*types.CommitFileDiff{}
+					err = dm.DiffCommits(activeVolume, activeBranch, from, to, path, !nameOnly, func(d *types.CommitFileDiff) error {
+						diffs = append(diffs, d)
+						return nil
+					})
+					if err != nil {
+						return err
+					}
+					return printStructured(out, diffs)
+				}
+
+				return dm.DiffCommits(activeVolume, activeBranch, from, to, path, !nameOnly, func(d *types.CommitFileDiff) error {
+					printFileDiff(out, d, nameOnly)
+					return nil
+				})
+			}()
+			if err != nil {
+				exitWithError(err, exitFailure)
+			}
+		},
+	}
+	cmd.Flags().BoolVar(&nameOnly, "name-only", false,
+		"only list the files that changed, without their contents")
+	return cmd
+}
+
+func printFileDiff(out io.Writer, d *types.CommitFileDiff, nameOnly bool) {
+	if nameOnly {
+		fmt.Fprintf(out, "%s %s\n", d.Change, d.Filename)
+		return
+	}
+	if d.Unified != "" {
+		fmt.Fprint(out, d.Unified)
+		return
+	}
+
+	var detail string
+	switch d.Change {
+	case types.FileChangeAdded:
+		detail = prettyPrintSize(d.ToSize)
+	case types.FileChangeRemoved:
+		detail = prettyPrintSize(d.FromSize)
+	default:
+		delta := d.SizeDelta()
+		sign := "+"
+		if delta < 0 {
+			sign = "-"
+			delta = -delta
+		}
+		detail = fmt.Sprintf("%s -> %s (%s%s), modified %s -> %s",
+			prettyPrintSize(d.FromSize), prettyPrintSize(d.ToSize),
+			sign, prettyPrintSize(delta),
+			d.FromModified.Format("2006-01-02 15:04:05"),
+			d.ToModified.Format("2006-01-02 15:04:05"),
+		)
+	}
+	kind := ""
+	switch {
+	case d.Binary:
+		kind = "binary "
+	case d.TooLarge:
+		kind = "large "
+	}
+	fmt.Fprintf(out, "%s %s%s: %s\n", d.Change, kind, d.Filename, detail)
+}
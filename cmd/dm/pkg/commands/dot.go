@@ -2,14 +2,19 @@ package commands
 
 import (
 	"bufio"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"sort"
 	"strings"
+	"time"
 
 	"github.com/dotmesh-oss/dotmesh/pkg/client"
 	"github.com/dotmesh-oss/dotmesh/pkg/types"
+	"github.com/howeyc/gopass"
 	"github.com/spf13/cobra"
 )
 
@@ -22,8 +27,7 @@ func NewCmdDotForceBranchMaster(out io.Writer) *cobra.Command {
 		Run: func(cmd *cobra.Command, args []string) {
 			err := branchSetMaster(cmd, args, out)
 			if err != nil {
-				fmt.Fprintln(os.Stderr, err.Error())
-				os.Exit(1)
+				exitWithError(err, exitFailure)
 			}
 		},
 	}
@@ -39,8 +43,7 @@ func NewCmdDotSetUpstream(out io.Writer) *cobra.Command {
 		Run: func(cmd *cobra.Command, args []string) {
 			err := dotSetUpstream(cmd, args, out)
 			if err != nil {
-				fmt.Fprintln(os.Stderr, err.Error())
-				os.Exit(1)
+				exitWithError(err, exitFailure)
 			}
 		},
 	}
@@ -56,8 +59,7 @@ func NewCmdDotShow(out io.Writer) *cobra.Command {
 		Run: func(cmd *cobra.Command, args []string) {
 			err := dotShow(cmd, args, out)
 			if err != nil {
-				fmt.Fprintln(os.Stderr, err.Error())
-				os.Exit(1)
+				exitWithError(err, exitFailure)
 			}
 		},
 	}
@@ -69,6 +71,254 @@ func NewCmdDotShow(out io.Writer) *cobra.Command {
 	return cmd
 }
 
+func NewCmdDotSetReplication(out io.Writer) *cobra.Command {
+	var minReplicas int
+	var timeout time.Duration
+	cmd := &cobra.Command{
+		Use:   "set-replication [<dot>]",
+		Short: "Set how many nodes must hold a new commit before 'dm commit' returns",
+		Long: `Set how many nodes, including the master, must hold each new commit on a dot
+before 'dm commit' returns. A commit that does not reach enough nodes within
+the timeout fails with an error, but carries on replicating in the background.
+
+Run 'dm dot set-replication [<dot>] --min-replicas 1' to go back to
+asynchronous replication.`,
+
+		Run: func(cmd *cobra.Command, args []string) {
+			err := dotSetReplication(cmd, args, out, minReplicas, timeout)
+			if err != nil {
+				exitWithError(err, exitFailure)
+			}
+		},
+	}
+	cmd.Flags().IntVar(
+		&minReplicas, "min-replicas", 1,
+		"number of nodes, including the master, that must hold a commit.",
+	)
+	cmd.Flags().DurationVar(
+		&timeout, "timeout", types.DefaultReplicationTimeoutSeconds*time.Second,
+		"how long a commit waits for replicas before failing.",
+	)
+	return cmd
+}
+
+func NewCmdDotSetPlacement(out io.Writer) *cobra.Command {
+	var policy types.PlacementPolicy
+	var selector []string
+	var namespaceWide, clear bool
+	cmd := &cobra.Command{
+		Use:   "set-placement [<dot>]",
+		Short: "Choose which nodes hold replicas of a dot",
+		Long: `Choose which nodes hold replicas of a dot. Nodes are labelled with the
+DOTMESH_NODE_LABELS environment variable of the server, e.g. zone=eu-1,disk=ssd.
+
+Run 'dm dot set-placement [<dot>] --replicas 3 --selector disk=ssd --anti-affinity zone'
+to keep three copies of the dot, on nodes with SSDs, in three different zones.
+
+Run 'dm dot set-placement [<dot>] --namespace-wide ...' to set the default
+policy for every dot in the dot's namespace.
+
+Run 'dm dot set-placement [<dot>] --clear' to replicate it to every node again.`,
+
+		Run: func(cmd *cobra.Command, args []string) {
+			err := dotSetPlacement(cmd, args, out, policy, selector, namespaceWide, clear)
+			if err != nil {
+				exitWithError(err, exitFailure)
+			}
+		},
+	}
+	cmd.Flags().IntVar(
+		&policy.Replicas, "replicas", 0,
+		"number of nodes, including the master, to hold the dot. 0 means every matching node.",
+	)
+	cmd.Flags().StringSliceVar(
+		&selector, "selector", nil,
+		"node labels a node must have to hold the dot, e.g. disk=ssd,zone=eu-1",
+	)
+	cmd.Flags().StringVar(
+		&policy.AntiAffinityLabel, "anti-affinity", "",
+		"node label whose value must differ between replicas, e.g. zone",
+	)
+	cmd.Flags().BoolVar(
+		&namespaceWide, "namespace-wide", false,
+		"apply the policy to every dot in the namespace without a policy of its own.",
+	)
+	cmd.Flags().BoolVar(
+		&clear, "clear", false,
+		"remove the policy.",
+	)
+	return cmd
+}
+
+func NewCmdDotSetSigning(out io.Writer) *cobra.Command {
+	var required bool
+	cmd := &cobra.Command{
+		Use:   "set-signing [<dot>]",
+		Short: "Choose whether commits to dots in a namespace must be signed",
+		Long: `Choose whether commits to every dot in <dot>'s namespace must be signed
+with a key their author has registered, see 'dm key'.
+
+Run 'dm dot set-signing [<dot>] --required' to refuse unsigned commits, and
+'dm dot set-signing [<dot>] --required=false' to accept them again.`,
+
+		Run: func(cmd *cobra.Command, args []string) {
+			runHandlingError(func() error {
+				dm, err := client.NewDotmeshAPI(configPath, verboseOutput)
+				if err != nil {
+					return err
+				}
+				var dot string
+				switch len(args) {
+				case 0:
+					dot, err = dm.CurrentVolume()
+					if err != nil {
+						return err
+					}
+				case 1:
+					dot = args[0]
+				default:
+					return fmt.Errorf("Please specify [<dot>] as the only argument.")
+				}
+				namespace, _, err := client.ParseNamespacedVolume(dot)
+				if err != nil {
+					return err
+				}
+
+				policy := types.SigningPolicy{Namespace: namespace, Required: required}
+				err = dm.SetSigningPolicy(policy)
+				if err != nil {
+					return err
+				}
+				if structuredOutput() {
+					return printStructured(out, policy)
+				}
+				return nil
+			})
+		},
+	}
+	cmd.Flags().BoolVar(
+		&required, "required", false,
+		"refuse commits that aren't signed.",
+	)
+	return cmd
+}
+
+func NewCmdDotSetKey(out io.Writer) *cobra.Command {
+	var keyFile string
+	var namespaceWide, generate, clear bool
+	cmd := &cobra.Command{
+		Use:   "set-key [<dot>]",
+		Short: "Give the cluster the key of an encrypted dot",
+		Long: `Give every node of the cluster the key that an encrypted dot, made with
+'dm init --encrypt', is encrypted with: 64 hex digits, read from --key-file,
+$DOTMESH_ENCRYPTION_KEY or the terminal. Keys are only held in memory, so
+set them again after nodes restart, or keep them in the nodes'
+DOTMESH_ENCRYPTION_KEY_DIR instead. Keys can be set by whoever administers
+the dot's namespace. The cluster's nodes pass keys to each other over their
+HTTP API, unencrypted unless the network between them is, so keep them in
+DOTMESH_ENCRYPTION_KEY_DIR if it isn't trusted.
+
+A fork of an encrypted dot is encrypted with the key of the dot it was
+forked from, and that dot's key is what it's opened with.
+
+Run 'dm dot set-key [<dot>] --generate' to make a new random key, which is
+printed once; keep it somewhere safe, as the dot can't be read without it.
+
+Run 'dm dot set-key [<dot>] --namespace-wide ...' to set the key for every
+dot in the dot's namespace without a key of its own.
+
+Run 'dm dot set-key [<dot>] --clear' to have the cluster forget the key.`,
+
+		Run: func(cmd *cobra.Command, args []string) {
+			runHandlingError(func() error {
+				dm, err := client.NewDotmeshAPI(configPath, verboseOutput)
+				if err != nil {
+					return err
+				}
+				var dot string
+				switch len(args) {
+				case 0:
+					dot, err = dm.CurrentVolume()
+					if err != nil {
+						return err
+					}
+				case 1:
+					dot = args[0]
+				default:
+					return fmt.Errorf("Please specify [<dot>] as the only argument.")
+				}
+				namespace, name, err := client.ParseNamespacedVolume(dot)
+				if err != nil {
+					return err
+				}
+				if namespaceWide {
+					name = ""
+				}
+
+				key := types.EncryptionKey{Namespace: namespace, Name: name}
+				switch {
+				case clear:
+				case generate:
+					raw := make([]byte, 32)
+					_, err = rand.Read(raw)
+					if err != nil {
+						return err
+					}
+					key.Key = hex.EncodeToString(raw)
+				case keyFile != "":
+					data, err := ioutil.ReadFile(keyFile)
+					if err != nil {
+						return err
+					}
+					key.Key = strings.TrimSpace(string(data))
+				case os.Getenv("DOTMESH_ENCRYPTION_KEY") != "":
+					key.Key = os.Getenv("DOTMESH_ENCRYPTION_KEY")
+				default:
+					fmt.Printf("Encryption key: ")
+					entered, err := gopass.GetPasswd()
+					fmt.Printf("\n")
+					if err != nil {
+						return err
+					}
+					key.Key = string(entered)
+				}
+
+				err = dm.SetEncryptionKey(key)
+				if err != nil {
+					return err
+				}
+				if !generate {
+					key.Key = ""
+				}
+				if structuredOutput() {
+					return printStructured(out, key)
+				}
+				if generate {
+					fmt.Fprintln(out, key.Key)
+				}
+				return nil
+			})
+		},
+	}
+	cmd.Flags().StringVar(
+		&keyFile, "key-file", "",
+		"file holding the key, as 64 hex digits.",
+	)
+	cmd.Flags().BoolVar(
+		&generate, "generate", false,
+		"make a new random key and print it.",
+	)
+	cmd.Flags().BoolVar(
+		&namespaceWide, "namespace-wide", false,
+		"set the key for every dot in the namespace without a key of its own.",
+	)
+	cmd.Flags().BoolVar(
+		&clear, "clear", false,
+		"forget the key.",
+	)
+	return cmd
+}
+
 func NewCmdDotDelete(out io.Writer) *cobra.Command {
 	cmd := &cobra.Command{
 		Use:   "delete",
@@ -78,8 +328,7 @@ func NewCmdDotDelete(out io.Writer) *cobra.Command {
 		Run: func(cmd *cobra.Command, args []string) {
 			err := dotDelete(cmd, args, out)
 			if err != nil {
-				fmt.Fprintln(os.Stderr, err.Error())
-				os.Exit(1)
+				exitWithError(err, exitFailure)
 			}
 		},
 	}
@@ -101,12 +350,27 @@ change the default remote dot for <dot> on <remote>.
 
 Run 'dm dot show [<dot>]' to show information about the dot.
 
+Run 'dm dot set-replication [<dot>] --min-replicas <n>' to make commits
+wait until <n> nodes hold them.
+
+Run 'dm dot set-placement [<dot>] --replicas <n>' to only keep <n> copies
+of the dot in the cluster.
+
+Run 'dm dot set-signing [<dot>] --required' to only accept signed commits to
+dots in the dot's namespace.
+
+Run 'dm dot set-key [<dot>]' to give the cluster the key of an encrypted dot.
+
 Where '[<dot>]' is omitted, the current dot (selected by 'dm switch')
 is used.`,
 	}
 
 	cmd.AddCommand(NewCmdDotSetUpstream(os.Stdout))
 	cmd.AddCommand(NewCmdDotShow(os.Stdout))
+	cmd.AddCommand(NewCmdDotSetReplication(os.Stdout))
+	cmd.AddCommand(NewCmdDotSetPlacement(os.Stdout))
+	cmd.AddCommand(NewCmdDotSetSigning(os.Stdout))
+	cmd.AddCommand(NewCmdDotSetKey(os.Stdout))
 	cmd.AddCommand(NewCmdDotDelete(os.Stdout))
 	cmd.AddCommand(NewCmdDotForceBranchMaster(os.Stdout))
 
@@ -153,6 +417,103 @@ func dotSetUpstream(cmd *cobra.Command, args []string, out io.Writer) error {
 	}
 
 	dm.Configuration.SetDefaultRemoteVolumeFor(peer, localNamespace, localDot, remoteNamespace, remoteDot)
+	if structuredOutput() {
+		return printStructured(out, dotUpstream{
+			Remote: peer,
+			Dot:    types.VolumeName{Namespace: remoteNamespace, Name: remoteDot},
+		})
+	}
+	return nil
+}
+
+func dotSetReplication(cmd *cobra.Command, args []string, out io.Writer, minReplicas int, timeout time.Duration) error {
+	dm, err := client.NewDotmeshAPI(configPath, verboseOutput)
+	if err != nil {
+		return err
+	}
+
+	var dot string
+	switch len(args) {
+	case 0:
+		dot, err = dm.CurrentVolume()
+		if err != nil {
+			return err
+		}
+	case 1:
+		dot = args[0]
+	default:
+		return fmt.Errorf("Please specify [<dot>] as the only argument.")
+	}
+
+	if minReplicas < 1 {
+		return fmt.Errorf("--min-replicas must be at least 1.")
+	}
+
+	err = dm.SetReplicationPolicy(dot, minReplicas, int64(timeout.Seconds()))
+	if err != nil {
+		return err
+	}
+	if structuredOutput() {
+		return printStructured(out, dotResult{Dot: dot})
+	}
+	return nil
+}
+
+func dotSetPlacement(cmd *cobra.Command, args []string, out io.Writer, policy types.PlacementPolicy, selector []string, namespaceWide, clear bool) error {
+	dm, err := client.NewDotmeshAPI(configPath, verboseOutput)
+	if err != nil {
+		return err
+	}
+
+	var dot string
+	switch len(args) {
+	case 0:
+		dot, err = dm.CurrentVolume()
+		if err != nil {
+			return err
+		}
+	case 1:
+		dot = args[0]
+	default:
+		return fmt.Errorf("Please specify [<dot>] as the only argument.")
+	}
+
+	namespace, name, err := client.ParseNamespacedVolume(dot)
+	if err != nil {
+		return err
+	}
+	if namespaceWide {
+		name = ""
+	}
+
+	if clear {
+		err = dm.DeletePlacementPolicy(namespace, name)
+		if err != nil {
+			return err
+		}
+		if structuredOutput() {
+			return printStructured(out, dotResult{Dot: dot})
+		}
+		return nil
+	}
+
+	policy.NodeSelector = map[string]string{}
+	for _, label := range selector {
+		parts := strings.SplitN(label, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return fmt.Errorf("Invalid selector %q, expected <label>=<value>.", label)
+		}
+		policy.NodeSelector[parts[0]] = parts[1]
+	}
+	policy.Namespace = namespace
+	policy.Name = name
+	err = dm.SetPlacementPolicy(policy)
+	if err != nil {
+		return err
+	}
+	if structuredOutput() {
+		return printStructured(out, policy)
+	}
 	return nil
 }
 
@@ -196,8 +557,17 @@ func branchSetMaster(cmd *cobra.Command, args []string, out io.Writer) error {
 	}
 
 	err = dm.ForceBranchMaster(namespace, name, branch, newMaster)
+	if err != nil {
+		return err
+	}
 
-	return err
+	if structuredOutput() {
+		if branch == "" {
+			branch = "master"
+		}
+		return printStructured(out, dotResult{Dot: dot, Branch: branch})
+	}
+	return nil
 }
 
 func dotDelete(cmd *cobra.Command, args []string, out io.Writer) error {
@@ -214,6 +584,9 @@ func dotDelete(cmd *cobra.Command, args []string, out io.Writer) error {
 		return fmt.Errorf("Please specify the dot to delete (the default dot is ignored for deletion, to avoid mistakes).")
 	}
 
+	if !forceMode && structuredOutput() {
+		return fmt.Errorf("Please use --force to delete a dot with --output, there's no way to confirm it.")
+	}
 	if !forceMode {
 		fmt.Printf("Please confirm that you really want to delete the dot %s, including all branches and commits? (enter Y to continue): ", dot)
 		reader := bufio.NewReader(os.Stdin)
@@ -229,6 +602,9 @@ func dotDelete(cmd *cobra.Command, args []string, out io.Writer) error {
 		return err
 	}
 
+	if structuredOutput() {
+		return printStructured(out, dotResult{Dot: dot})
+	}
 	return nil
 }
 
@@ -252,6 +628,9 @@ func dotShow(cmd *cobra.Command, args []string, out io.Writer) error {
 	if err != nil {
 		return err
 	}
+	if structuredOutput() {
+		return dotShowStructured(out, dm, qualifiedDotName, namespace, dot)
+	}
 	if scriptingMode {
 		fmt.Fprintf(out, "namespace\t%s\n", namespace)
 		fmt.Fprintf(out, "name\t%s\n", dot)
@@ -307,6 +686,71 @@ func dotShow(cmd *cobra.Command, args []string, out io.Writer) error {
 		}
 	}
 
+	policy, err := dm.GetReplicationPolicy(qualifiedDotName)
+	if err != nil {
+		return err
+	}
+	if scriptingMode {
+		fmt.Fprintf(out, "minReplicas\t%d\nreplicationTimeout\t%d\n",
+			policy.MinReplicas,
+			int64(policy.Timeout().Seconds()))
+	} else if policy.Synchronous() {
+		fmt.Fprintf(out, "Replication: synchronous, commits wait for %d nodes (timeout %s)\n",
+			policy.MinReplicas, policy.Timeout())
+	} else {
+		fmt.Fprintf(out, "Replication: asynchronous\n")
+	}
+
+	placementPolicy, err := dm.GetPlacementPolicy(qualifiedDotName)
+	if err != nil {
+		return err
+	}
+	if placementPolicy.Namespace != "" {
+		selector := []string{}
+		for k, v := range placementPolicy.NodeSelector {
+			selector = append(selector, k+"="+v)
+		}
+		sort.Strings(selector)
+		if scriptingMode {
+			fmt.Fprintf(out, "placement\t%d\t%s\t%s\n",
+				placementPolicy.Replicas,
+				strings.Join(selector, ","),
+				placementPolicy.AntiAffinityLabel)
+		} else {
+			replicas := "all matching nodes"
+			if placementPolicy.Replicas > 0 {
+				replicas = fmt.Sprintf("%d nodes", placementPolicy.Replicas)
+			}
+			fmt.Fprintf(out, "Placement: %s", replicas)
+			if len(selector) > 0 {
+				fmt.Fprintf(out, " matching %s", strings.Join(selector, ","))
+			}
+			if placementPolicy.AntiAffinityLabel != "" {
+				fmt.Fprintf(out, ", spread by %s", placementPolicy.AntiAffinityLabel)
+			}
+			if placementPolicy.Name == "" {
+				fmt.Fprintf(out, " (from namespace %s)", placementPolicy.Namespace)
+			}
+			fmt.Fprintf(out, "\n")
+		}
+	}
+
+	signingPolicy, err := dm.GetSigningPolicy(namespace)
+	if err != nil {
+		return err
+	}
+	if scriptingMode {
+		fmt.Fprintf(out, "signingRequired\t%t\n", signingPolicy.Required)
+	} else if signingPolicy.Required {
+		fmt.Fprintf(out, "Signing: commits must be signed (namespace %s)\n", namespace)
+	}
+
+	if scriptingMode {
+		fmt.Fprintf(out, "encrypted\t%t\t%s\n", masterDot.Encrypted, masterDot.KeyStatus)
+	} else if masterDot.Encrypted {
+		fmt.Fprintf(out, "Encryption: on, key %s on the master\n", masterDot.KeyStatus)
+	}
+
 	currentBranch, err := dm.CurrentBranch(qualifiedDotName)
 	if err != nil {
 		return err
@@ -363,7 +807,10 @@ func dotShow(cmd *cobra.Command, args []string, out io.Writer) error {
 		}
 
 		if dm.IsUserPriveledged() {
-			if !scriptingMode {
+			if scriptingMode {
+				fmt.Fprintf(out, "replicas\t%s\t%s\n", branch, strings.Join(branchDot.DesignatedReplicas, "\t"))
+			} else {
+				fmt.Fprintf(out, "   Designated replicas: %s\n", strings.Join(branchDot.DesignatedReplicas, ", "))
 				fmt.Fprintf(out, "   Replication Status:\n")
 			}
 
@@ -430,3 +877,127 @@ func dotShow(cmd *cobra.Command, args []string, out io.Writer) error {
 	}
 	return nil
 }
+
+// dotShowResult is what 'dm dot show' prints with --output
+type dotShowResult struct {
+	Namespace         string
+	Name              string
+	Selected          bool
+	CurrentBranch     string
+	ReplicationPolicy *types.FilesystemReplicationPolicy
+	// nil if neither the dot nor its namespace has one
+	PlacementPolicy *types.PlacementPolicy
+	// whether commits to dots in the namespace must be signed
+	SigningRequired bool
+	Branches        []dotShowBranch
+	Upstreams       []dotUpstream
+}
+
+type dotShowBranch struct {
+	Name    string
+	Current bool
+	Volume  types.DotmeshVolume
+	// only filled in for the current branch
+	Containers []string `json:",omitempty"`
+	// server id => commits it's missing, only for admin users
+	ReplicationLatency map[string][]string `json:",omitempty"`
+}
+
+type dotUpstream struct {
+	Remote string
+	Dot    types.VolumeName
+}
+
+func dotShowStructured(out io.Writer, dm *client.DotmeshAPI, qualifiedDotName, namespace, dot string) error {
+	result := dotShowResult{
+		Namespace: namespace,
+		Name:      dot,
+		Branches:  []dotShowBranch{},
+		Upstreams: []dotUpstream{},
+	}
+
+	activeQualified, err := dm.CurrentVolume()
+	if err != nil {
+		return err
+	}
+	activeNamespace, activeDot, err := client.ParseNamespacedVolume(activeQualified)
+	if err != nil {
+		return err
+	}
+	result.Selected = namespace == activeNamespace && dot == activeDot
+
+	result.ReplicationPolicy, err = dm.GetReplicationPolicy(qualifiedDotName)
+	if err != nil {
+		return err
+	}
+	placementPolicy, err := dm.GetPlacementPolicy(qualifiedDotName)
+	if err != nil {
+		return err
+	}
+	if placementPolicy.Namespace != "" {
+		result.PlacementPolicy = placementPolicy
+	}
+	signingPolicy, err := dm.GetSigningPolicy(namespace)
+	if err != nil {
+		return err
+	}
+	result.SigningRequired = signingPolicy.Required
+
+	result.CurrentBranch, err = dm.CurrentBranch(qualifiedDotName)
+	if err != nil {
+		return err
+	}
+	bs, err := dm.AllBranches(qualifiedDotName)
+	if err != nil {
+		return err
+	}
+	for _, branch := range bs {
+		branchInternalName := branch
+		if branchInternalName == "master" {
+			branchInternalName = ""
+		}
+		branchDot, err := dm.BranchInfo(namespace, dot, branchInternalName)
+		if err != nil {
+			return err
+		}
+		b := dotShowBranch{
+			Name:    branch,
+			Current: branch == result.CurrentBranch,
+			Volume:  branchDot,
+		}
+		if b.Current {
+			containerInfo, err := dm.RelatedContainers(branchDot.Name, branch)
+			if err != nil {
+				return err
+			}
+			for _, container := range containerInfo {
+				b.Containers = append(b.Containers, container.Name)
+			}
+		}
+		if dm.IsUserPriveledged() {
+			b.ReplicationLatency, err = dm.GetReplicationLatencyForBranch(qualifiedDotName, branchInternalName)
+			if err != nil {
+				return err
+			}
+		}
+		result.Branches = append(result.Branches, b)
+	}
+
+	remotes := dm.Configuration.GetRemotes()
+	keys := []string{}
+	for k := range remotes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		remoteNamespace, remoteDot, ok := dm.Configuration.DefaultRemoteVolumeFor(k, namespace, dot)
+		if ok {
+			result.Upstreams = append(result.Upstreams, dotUpstream{
+				Remote: k,
+				Dot:    types.VolumeName{Namespace: remoteNamespace, Name: remoteDot},
+			})
+		}
+	}
+
+	return printStructured(out, result)
+}
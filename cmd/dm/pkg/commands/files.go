@@ -0,0 +1,349 @@
+package commands
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/dotmesh-oss/dotmesh/pkg/archiver"
+	"github.com/dotmesh-oss/dotmesh/pkg/client"
+	"github.com/spf13/cobra"
+)
+
+const commitPathHelp = `A <ref> is a commit id or HEAD, HEAD^ and so on, on the current branch. Leave
+it out (as in ':data/file.csv') to mean the latest commit.`
+
+// parseCommitPath splits "<ref>:<path>" as dm ls, cat and cp take it. Like
+// scp, anything with a / before the first : is a local path, so that
+// ./a:b can still name a file.
+func parseCommitPath(arg string) (ref, path string, inDot bool) {
+	colon := strings.Index(arg, ":")
+	if colon < 0 || strings.Contains(arg[:colon], "/") {
+		return "", arg, false
+	}
+	return arg[:colon], strings.Trim(arg[colon+1:], "/"), true
+}
+
+// currentDotAndBranch is the dot and branch that file commands work on
+func currentDotAndBranch(dm *client.DotmeshAPI) (string, string, error) {
+	activeVolume, err := dm.StrictCurrentVolume()
+	if err != nil {
+		return "", "", err
+	}
+	if activeVolume == "" {
+		return "", "", fmt.Errorf(
+			"No current dot. Try 'dm list' and " +
+				"'dm switch' to switch to a dot.",
+		)
+	}
+	activeBranch, err := dm.CurrentBranch(activeVolume)
+	if err != nil {
+		return "", "", err
+	}
+	return activeVolume, activeBranch, nil
+}
+
+func NewCmdLs(out io.Writer) *cobra.Command {
+	var recursive bool
+	cmd := &cobra.Command{
+		Use:   "ls [<ref>][:<path>]",
+		Short: "List the files in a commit of the current branch",
+		Long: `List the files and directories at <path> in a commit, or at the top of the
+dot if no path is given.
+
+` + commitPathHelp,
+		Run: func(cmd *cobra.Command, args []string) {
+			runHandlingError(func() error {
+				if len(args) > 1 {
+					return fmt.Errorf("Please specify at most one <ref>:<path>")
+				}
+				var ref, path string
+				if len(args) == 1 {
+					var inDot bool
+					ref, path, inDot = parseCommitPath(args[0])
+					if !inDot {
+						// a bare ref, with no path
+						ref, path = args[0], ""
+					}
+				}
+
+				dm, err := client.NewDotmeshAPI(configPath, verboseOutput)
+				if err != nil {
+					return err
+				}
+				activeVolume, activeBranch, err := currentDotAndBranch(dm)
+				if err != nil {
+					return err
+				}
+				items, err := dm.ListFiles(activeVolume, activeBranch, ref, path, recursive)
+				if err != nil {
+					return err
+				}
+				if structuredOutput() {
+					return printStructured(out, items)
+				}
+
+				if scriptingMode {
+					for _, item := range items {
+						fmt.Fprintf(out, "%s\t%d\t%d\t%t\n", item.Key, item.Size, item.LastModified.Unix(), item.Directory)
+					}
+					return nil
+				}
+				w := tabwriter.NewWriter(out, 3, 8, 2, ' ', 0)
+				for _, item := range items {
+					key := item.Key
+					size := prettyPrintSize(item.Size)
+					if item.Directory {
+						key += "/"
+						size = "-"
+					}
+					fmt.Fprintf(w, "%s\t%s\t%s\n", size, item.LastModified.Format("2006-01-02 15:04"), key)
+				}
+				return w.Flush()
+			})
+		},
+	}
+	cmd.Flags().BoolVarP(&recursive, "recursive", "r", false,
+		"list everything under the path, not just what is directly in it")
+	cmd.Flags().BoolVarP(
+		&scriptingMode, "scripting", "H", false,
+		"scripting mode. Do not print headers, separate fields by "+
+			"a single tab instead of arbitrary whitespace.",
+	)
+	return cmd
+}
+
+func NewCmdCat(out io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "cat <ref>:<path>",
+		Short: "Print a file from a commit of the current branch",
+		Long: `Print the contents of a file as it was in a commit. The contents are
+printed as they are, whatever --output is set to.
+
+` + commitPathHelp,
+		Run: func(cmd *cobra.Command, args []string) {
+			runHandlingError(func() error {
+				if len(args) != 1 {
+					return fmt.Errorf("Please specify one <ref>:<path>")
+				}
+				ref, path, inDot := parseCommitPath(args[0])
+				if !inDot {
+					return fmt.Errorf("Please specify a file in the dot as <ref>:<path>")
+				}
+
+				dm, err := client.NewDotmeshAPI(configPath, verboseOutput)
+				if err != nil {
+					return err
+				}
+				activeVolume, activeBranch, err := currentDotAndBranch(dm)
+				if err != nil {
+					return err
+				}
+				contents, isDir, err := dm.ReadFile(activeVolume, activeBranch, ref, path)
+				if err != nil {
+					return err
+				}
+				defer contents.Close()
+				if isDir {
+					return fmt.Errorf("%s is a directory, try 'dm ls' or 'dm cp'", path)
+				}
+				_, err = io.Copy(out, contents)
+				return err
+			})
+		},
+	}
+	return cmd
+}
+
+// cpResult is what 'dm cp' prints with --output
+type cpResult struct {
+	Source      string
+	Destination string
+	// the commit made by copying into the dot
+	Commit string `json:",omitempty"`
+}
+
+func NewCmdCp(out io.Writer) *cobra.Command {
+	var asTar bool
+	cmd := &cobra.Command{
+		Use:   "cp <ref>:<path> <local path> | <local path> :<path>",
+		Short: "Copy files or directories out of a commit, or into the current branch",
+		Long: `Copy a file or directory from a commit to the local filesystem, or from the
+local filesystem into the current branch. Use - as the local path to write
+to stdout or read from stdin.
+
+Directories are copied with everything under them. When copying out of a
+commit, --tar writes a directory as a tar archive rather than unpacking it.
+When copying into the dot, whatever was at <path> is replaced, and the
+result is committed straight away; a <ref> can't be given, as only the
+working copy can be changed.
+
+` + commitPathHelp,
+		Run: func(cmd *cobra.Command, args []string) {
+			runHandlingError(func() error {
+				if len(args) != 2 {
+					return fmt.Errorf("Please specify a source and a destination")
+				}
+				srcRef, srcPath, srcInDot := parseCommitPath(args[0])
+				dstRef, dstPath, dstInDot := parseCommitPath(args[1])
+				if srcInDot == dstInDot {
+					return fmt.Errorf("Please copy either from <ref>:<path> to a local path, or from a local path to :<path>")
+				}
+
+				dm, err := client.NewDotmeshAPI(configPath, verboseOutput)
+				if err != nil {
+					return err
+				}
+				activeVolume, activeBranch, err := currentDotAndBranch(dm)
+				if err != nil {
+					return err
+				}
+
+				result := cpResult{Source: args[0], Destination: args[1]}
+				if srcInDot {
+					// with --output, stdout is for the result
+					if dstPath == "-" && structuredOutput() {
+						return fmt.Errorf("Can't copy to stdout with --output set")
+					}
+					err = copyFromCommit(dm, out, activeVolume, activeBranch, srcRef, srcPath, dstPath, asTar)
+				} else {
+					if dstRef != "" {
+						return fmt.Errorf("Can only copy into the working copy, please leave out '%s' before the ':'", dstRef)
+					}
+					result.Commit, err = copyIntoDot(dm, activeVolume, activeBranch, srcPath, dstPath)
+				}
+				if err != nil {
+					return err
+				}
+				if structuredOutput() {
+					return printStructured(out, result)
+				}
+				if result.Commit != "" {
+					fmt.Fprintf(out, "Copied %s into %s, commit %s\n", srcPath, dstPath, result.Commit)
+				}
+				return nil
+			})
+		},
+	}
+	cmd.Flags().BoolVar(&asTar, "tar", false,
+		"write a directory copied out of a commit as a tar archive")
+	return cmd
+}
+
+func copyFromCommit(dm *client.DotmeshAPI, out io.Writer, volume, branch, ref, path, localPath string, asTar bool) error {
+	contents, isDir, err := dm.ReadFile(volume, branch, ref, path)
+	if err != nil {
+		return err
+	}
+	defer contents.Close()
+
+	if localPath == "-" {
+		if isDir && !asTar {
+			return fmt.Errorf("%s is a directory, use --tar to write it to stdout", path)
+		}
+		_, err = io.Copy(out, contents)
+		return err
+	}
+
+	// copying into an existing directory puts the copy inside it, as cp does
+	info, err := os.Stat(localPath)
+	intoDir := err == nil && info.IsDir()
+	if intoDir {
+		name := filepath.Base(path)
+		if isDir && asTar {
+			name += ".tar"
+		}
+		localPath = filepath.Join(localPath, name)
+	}
+
+	if !isDir || asTar {
+		f, err := os.Create(localPath)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(f, contents)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		return err
+	}
+	return extractDirectory(contents, filepath.Base(path), localPath)
+}
+
+// extractDirectory unpacks the tar of a directory the server sends, whose
+// top level is the directory's name, into a new directory at localPath
+func extractDirectory(contents io.Reader, name, localPath string) error {
+	if _, err := os.Lstat(localPath); err == nil {
+		return fmt.Errorf("%s already exists", localPath)
+	}
+	// unpack next to where it's going, so it can be renamed into place
+	tmpDir, err := ioutil.TempDir(filepath.Dir(localPath), ".dm-cp-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	archivePath := filepath.Join(tmpDir, "archive.tar")
+	f, err := os.Create(archivePath)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, contents)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	unpacked := filepath.Join(tmpDir, "unpacked")
+	// the archiver refuses entries that would land outside unpacked
+	err = archiver.NewTar().Unarchive(archivePath, unpacked)
+	if err != nil {
+		return err
+	}
+	return os.Rename(filepath.Join(unpacked, name), localPath)
+}
+
+func copyIntoDot(dm *client.DotmeshAPI, volume, branch, localPath, path string) (string, error) {
+	if path == "" {
+		return "", fmt.Errorf("Please specify where in the dot to copy to, as :<path>")
+	}
+	if localPath == "-" {
+		return dm.WriteFile(volume, branch, path, os.Stdin, false)
+	}
+
+	info, err := os.Stat(localPath)
+	if err != nil {
+		return "", err
+	}
+	if !info.IsDir() {
+		f, err := os.Open(localPath)
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+		return dm.WriteFile(volume, branch, path, f, false)
+	}
+
+	// archive what's in the directory rather than the directory itself, as
+	// the server unpacks it at path
+	entries, err := ioutil.ReadDir(localPath)
+	if err != nil {
+		return "", err
+	}
+	sources := []string{}
+	for _, entry := range entries {
+		sources = append(sources, filepath.Join(localPath, entry.Name()))
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(archiver.NewTar().ArchiveToStream(pw, sources))
+	}()
+	defer pr.Close()
+	return dm.WriteFile(volume, branch, path, pr, true)
+}
@@ -0,0 +1,28 @@
+package commands
+
+import "testing"
+
+func Test_parseCommitPath(t *testing.T) {
+	tests := []struct {
+		arg   string
+		ref   string
+		path  string
+		inDot bool
+	}{
+		{arg: "HEAD^:data/file.csv", ref: "HEAD^", path: "data/file.csv", inDot: true},
+		{arg: ":/data/", ref: "", path: "data", inDot: true},
+		{arg: "abc123:", ref: "abc123", path: "", inDot: true},
+		{arg: "local/file", path: "local/file"},
+		{arg: "./a:b", path: "./a:b"},
+		{arg: "-", path: "-"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.arg, func(t *testing.T) {
+			ref, path, inDot := parseCommitPath(tt.arg)
+			if ref != tt.ref || path != tt.path || inDot != tt.inDot {
+				t.Errorf("parseCommitPath(%q) = %q, %q, %t, want %q, %q, %t",
+					tt.arg, ref, path, inDot, tt.ref, tt.path, tt.inDot)
+			}
+		})
+	}
+}
@@ -0,0 +1,119 @@
+package commands
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/dotmesh-oss/dotmesh/pkg/client"
+	"github.com/spf13/cobra"
+)
+
+func NewCmdFindCommit(out io.Writer) *cobra.Command {
+	filter := &commitFilter{}
+	var dot, branch string
+	var limit int
+	cmd := &cobra.Command{
+		Use:   "find-commit",
+		Short: "Search the commits of every dot you can see by their metadata",
+		Long: `Find commits across all the dots you can see, newest first, that match all
+of --where, --author, --grep, --since and --until.
+
+--where takes a selector over commit metadata, as in Kubernetes: key=value,
+key!=value, key in (a,b), key notin (a,b), key to require the key is set
+and !key to require it isn't, separated by commas. Values can be anything but
+commas and parentheses, e.g. image=registry.example.com/app:v1.2.
+
+Examples:
+
+    dm find-commit --where pipeline=42
+    dm find-commit --where 'env in (prod,staging)' --since 168h
+    dm find-commit --dot admin/results --author alice --grep nightly`,
+		Run: func(cmd *cobra.Command, args []string) {
+			runHandlingError(func() error {
+				if len(args) > 0 {
+					return fmt.Errorf("Please give what to search for as flags, see 'dm find-commit --help'")
+				}
+				query, err := filter.query(time.Now())
+				if err != nil {
+					return err
+				}
+				if dot != "" {
+					query.Namespace, query.Name, err = client.ParseNamespacedVolume(dot)
+					if err != nil {
+						return err
+					}
+				}
+				if branch != "" {
+					if dot == "" {
+						return fmt.Errorf("Please give the dot the branch is on with --dot")
+					}
+					query.Branch = branch
+				}
+				query.Limit = limit
+
+				dm, err := client.NewDotmeshAPI(configPath, verboseOutput)
+				if err != nil {
+					return err
+				}
+				matches, err := dm.FindCommits(query)
+				if err != nil {
+					return err
+				}
+				if structuredOutput() {
+					return printStructured(out, matches)
+				}
+
+				if scriptingMode {
+					for _, m := range matches {
+						fmt.Fprintf(out, "%s/%s\t%s\t%s\t%s\t%s\t%s\n",
+							m.Namespace, m.Name, m.Branch, m.Commit.Id,
+							m.Commit.Metadata["timestamp"], m.Commit.Metadata["author"],
+							m.Commit.Metadata["message"],
+						)
+					}
+					return nil
+				}
+				w := tabwriter.NewWriter(out, 3, 8, 2, ' ', 0)
+				fmt.Fprintf(w, "DOT\tBRANCH\tCOMMIT\tDATE\tAUTHOR\tMESSAGE\n")
+				for _, m := range matches {
+					fmt.Fprintf(w, "%s/%s\t%s\t%s\t%s\t%s\t%s\n",
+						m.Namespace, m.Name, m.Branch, m.Commit.Id,
+						commitDate(m.Commit.Metadata["timestamp"]), m.Commit.Metadata["author"],
+						firstLine(m.Commit.Metadata["message"]),
+					)
+				}
+				return w.Flush()
+			})
+		},
+	}
+	filter.addFlags(cmd)
+	cmd.Flags().StringVar(&dot, "dot", "", "only search this dot, as [namespace/]name")
+	cmd.Flags().StringVar(&branch, "branch", "", "only search this branch of --dot")
+	cmd.Flags().IntVar(&limit, "limit", 0, "show at most this many commits, 0 for all of them")
+	cmd.Flags().BoolVarP(
+		&scriptingMode, "scripting", "H", false,
+		"scripting mode. Do not print headers, separate fields by "+
+			"a single tab instead of arbitrary whitespace.",
+	)
+	return cmd
+}
+
+// commitDate formats a commit's timestamp, which is in unix nanoseconds
+func commitDate(timestamp string) string {
+	nanos, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return "-"
+	}
+	return time.Unix(0, nanos).Format("2006-01-02 15:04")
+}
+
+func firstLine(s string) string {
+	if i := strings.Index(s, "\n"); i >= 0 {
+		return s[:i]
+	}
+	return s
+}
@@ -3,13 +3,13 @@ package commands
 import (
 	"fmt"
 	"io"
-	"os"
 
 	"github.com/dotmesh-oss/dotmesh/pkg/client"
 	"github.com/spf13/cobra"
 )
 
 func NewCmdInit(out io.Writer) *cobra.Command {
+	var encrypt bool
 	cmd := &cobra.Command{
 		Use:   "init <dot>",
 		Short: "Create an empty dot",
@@ -37,17 +37,27 @@ func NewCmdInit(out io.Writer) *cobra.Command {
 				if exists {
 					return fmt.Errorf("Error: %v exists already", v)
 				}
-				err = dm.NewVolume(v)
+				if encrypt {
+					err = dm.NewEncryptedVolume(v)
+				} else {
+					err = dm.NewVolume(v)
+				}
 				if err != nil {
 					return fmt.Errorf("Error: %v", err)
 				}
+				if structuredOutput() {
+					return printStructured(out, dotResult{Dot: v, Branch: client.DefaultBranch})
+				}
 				return nil
 			}()
 			if err != nil {
-				fmt.Fprintln(os.Stderr, err.Error())
-				os.Exit(1)
+				exitWithError(err, exitFailure)
 			}
 		},
 	}
+	cmd.Flags().BoolVar(
+		&encrypt, "encrypt", false,
+		"encrypt the dot at rest, with the key given to the cluster by 'dm dot set-key'.",
+	)
 	return cmd
 }
@@ -0,0 +1,199 @@
+package commands
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+
+	"github.com/dotmesh-oss/dotmesh/pkg/client"
+	"github.com/dotmesh-oss/dotmesh/pkg/signing"
+	"github.com/spf13/cobra"
+)
+
+func NewCmdKey(out io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "key",
+		Short: "Manage the keys commits are signed with",
+		Long: `Manage the keys commits are signed with.
+
+Run 'dm key generate' to make a key and register it with the current remote,
+then 'dm commit --sign' to sign commits with it. Run 'dm key register' to
+register the same key with another remote.
+
+Run 'dm key ls [<user>]' to list the keys you, or someone else, sign
+commits with, and 'dm key rm <name>' to stop trusting one of yours.`,
+	}
+	cmd.AddCommand(NewCmdKeyGenerate(out))
+	cmd.AddCommand(NewCmdKeyRegister(out))
+	cmd.AddCommand(NewCmdKeyList(out))
+	cmd.AddCommand(NewCmdKeyRemove(out))
+	return cmd
+}
+
+// defaultKeyName is what a key is registered as if it isn't given a name,
+// so that keys made on different machines can be told apart
+func defaultKeyName() string {
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		return "default"
+	}
+	return hostname
+}
+
+func keyName(args []string) (string, error) {
+	switch len(args) {
+	case 0:
+		return defaultKeyName(), nil
+	case 1:
+		return args[0], nil
+	default:
+		return "", fmt.Errorf("Please specify at most one key name")
+	}
+}
+
+func registerSigningKey(out io.Writer, dm *client.DotmeshAPI, name string, key ed25519.PrivateKey) error {
+	registered, err := dm.AddSigningKey(name, signing.EncodePublicKey(key.Public().(ed25519.PublicKey)))
+	if err != nil {
+		return err
+	}
+	if structuredOutput() {
+		return printStructured(out, registered)
+	}
+	fmt.Fprintf(out, "Registered key %s as %s\n", signing.Fingerprint(registered.PublicKey), registered.Name)
+	return nil
+}
+
+func NewCmdKeyGenerate(out io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "generate [<name>]",
+		Short: "Make a key to sign commits with, and register it with the current remote",
+		Long: `Make a key to sign commits with, kept next to dm's configuration, and
+register it with the current remote as <name>, or this machine's hostname.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			runHandlingError(func() error {
+				name, err := keyName(args)
+				if err != nil {
+					return err
+				}
+				dm, err := client.NewDotmeshAPI(configPath, verboseOutput)
+				if err != nil {
+					return err
+				}
+				if _, err := os.Stat(dm.Configuration.SigningKeyPath()); err == nil {
+					return fmt.Errorf(
+						"There is already a signing key at %s, try 'dm key register' to register it",
+						dm.Configuration.SigningKeyPath(),
+					)
+				}
+				key, err := signing.GenerateKey()
+				if err != nil {
+					return err
+				}
+				err = dm.Configuration.SaveSigningKey(key)
+				if err != nil {
+					return err
+				}
+				return registerSigningKey(out, dm, name, key)
+			})
+		},
+	}
+	return cmd
+}
+
+func NewCmdKeyRegister(out io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "register [<name>]",
+		Short: "Register the key made by 'dm key generate' with the current remote",
+		Run: func(cmd *cobra.Command, args []string) {
+			runHandlingError(func() error {
+				name, err := keyName(args)
+				if err != nil {
+					return err
+				}
+				dm, err := client.NewDotmeshAPI(configPath, verboseOutput)
+				if err != nil {
+					return err
+				}
+				key, err := dm.Configuration.LoadSigningKey()
+				if err != nil {
+					return err
+				}
+				return registerSigningKey(out, dm, name, key)
+			})
+		},
+	}
+	return cmd
+}
+
+func NewCmdKeyList(out io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "ls [<user>]",
+		Short: "List the keys a user signs commits with",
+		Run: func(cmd *cobra.Command, args []string) {
+			runHandlingError(func() error {
+				if len(args) > 1 {
+					return fmt.Errorf("Please specify at most one user")
+				}
+				user := ""
+				if len(args) == 1 {
+					user = args[0]
+				}
+				dm, err := client.NewDotmeshAPI(configPath, verboseOutput)
+				if err != nil {
+					return err
+				}
+				keys, err := dm.SigningKeys(user)
+				if err != nil {
+					return err
+				}
+				if structuredOutput() {
+					return printStructured(out, keys)
+				}
+
+				if scriptingMode {
+					for _, key := range keys {
+						fmt.Fprintf(out, "%s\t%s\t%d\n", key.Name, signing.Fingerprint(key.PublicKey), key.Created.Unix())
+					}
+					return nil
+				}
+				w := tabwriter.NewWriter(out, 3, 8, 2, ' ', 0)
+				fmt.Fprintf(w, "NAME\tFINGERPRINT\tCREATED\n")
+				for _, key := range keys {
+					fmt.Fprintf(w, "%s\t%s\t%s\n", key.Name, signing.Fingerprint(key.PublicKey), key.Created.Format("2006-01-02 15:04"))
+				}
+				return w.Flush()
+			})
+		},
+	}
+	cmd.Flags().BoolVarP(
+		&scriptingMode, "scripting", "H", false,
+		"scripting mode. Do not print headers, separate fields by "+
+			"a single tab instead of arbitrary whitespace.",
+	)
+	return cmd
+}
+
+func NewCmdKeyRemove(out io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "rm <name>",
+		Short: "Stop trusting one of your signing keys",
+		Long: `Stop trusting one of your signing keys on the current remote. Commits signed
+with it will no longer verify as yours there. The key itself is left where
+it is.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			runHandlingError(func() error {
+				if len(args) != 1 {
+					return fmt.Errorf("Please specify the name of the key")
+				}
+				dm, err := client.NewDotmeshAPI(configPath, verboseOutput)
+				if err != nil {
+					return err
+				}
+				return dm.RemoveSigningKey(args[0])
+			})
+		},
+	}
+	return cmd
+}
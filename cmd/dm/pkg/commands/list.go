@@ -3,7 +3,6 @@ package commands
 import (
 	"fmt"
 	"io"
-	"os"
 	"strings"
 
 	"github.com/dotmesh-oss/dotmesh/pkg/client"
@@ -28,6 +27,10 @@ func NewCmdList(out io.Writer) *cobra.Command {
 					return fmt.Errorf("Please specify no arguments.")
 				}
 
+				if structuredOutput() {
+					return listStructured(out, dm)
+				}
+
 				if !scriptingMode {
 					fmt.Fprintf(
 						out,
@@ -114,8 +117,7 @@ func NewCmdList(out io.Writer) *cobra.Command {
 				return nil
 			}()
 			if err != nil {
-				fmt.Fprintln(os.Stderr, err.Error())
-				os.Exit(1)
+				exitWithError(err, exitFailure)
 			}
 		},
 	}
@@ -126,3 +128,48 @@ func NewCmdList(out io.Writer) *cobra.Command {
 	)
 	return cmd
 }
+
+// listEntry is how 'dm list' describes each dot with --output
+type listEntry struct {
+	Name       string
+	Current    bool
+	Branch     string
+	Volume     types.DotmeshVolume
+	Containers []client.Container
+}
+
+func listStructured(out io.Writer, dm *client.DotmeshAPI) error {
+	vcs, err := dm.AllVolumesWithContainers()
+	if err != nil {
+		return err
+	}
+	activeQualified, err := dm.CurrentVolume()
+	if err != nil {
+		return err
+	}
+	activeNamespace, activeVolume, err := client.ParseNamespacedVolume(activeQualified)
+	if err != nil {
+		return err
+	}
+	active := types.VolumeName{Namespace: activeNamespace, Name: activeVolume}
+
+	entries := []listEntry{}
+	for _, vc := range vcs {
+		b, err := dm.CurrentBranch(vc.Volume.Name.String())
+		if err != nil {
+			return err
+		}
+		containers := vc.Containers
+		if containers == nil {
+			containers = []client.Container{}
+		}
+		entries = append(entries, listEntry{
+			Name:       vc.Volume.Name.StringWithoutAdmin(),
+			Current:    vc.Volume.Name == active,
+			Branch:     b,
+			Volume:     vc.Volume,
+			Containers: containers,
+		})
+	}
+	return printStructured(out, entries)
+}
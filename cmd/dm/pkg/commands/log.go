@@ -3,18 +3,94 @@ package commands
 import (
 	"fmt"
 	"io"
-	"os"
 	"sort"
+	"time"
 
 	"github.com/dotmesh-oss/dotmesh/pkg/client"
+	"github.com/dotmesh-oss/dotmesh/pkg/types"
 	"github.com/spf13/cobra"
 )
 
+// commitFilter holds the flags dm log and dm find-commit narrow commits down
+// with
+type commitFilter struct {
+	where, author, grep, since, until string
+}
+
+func (f *commitFilter) addFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&f.where, "where", "",
+		"only commits whose metadata matches this selector, e.g. 'pipeline=42,env in (prod,staging),!draft'")
+	cmd.Flags().StringVar(&f.author, "author", "", "only commits by this user")
+	cmd.Flags().StringVar(&f.grep, "grep", "",
+		"only commits whose message contains this, ignoring case")
+	cmd.Flags().StringVar(&f.since, "since", "",
+		"only commits made at or after this time, as RFC3339 or a date, or a duration ago such as 36h")
+	cmd.Flags().StringVar(&f.until, "until", "",
+		"only commits made at or before this time, in the same forms as --since")
+}
+
+func (f *commitFilter) isSet() bool {
+	return f.where != "" || f.author != "" || f.grep != "" || f.since != "" || f.until != ""
+}
+
+func (f *commitFilter) query(now time.Time) (types.CommitQuery, error) {
+	since, err := parseCommitTime(f.since, now)
+	if err != nil {
+		return types.CommitQuery{}, fmt.Errorf("Invalid --since: %s", err)
+	}
+	until, err := parseCommitTime(f.until, now)
+	if err != nil {
+		return types.CommitQuery{}, fmt.Errorf("Invalid --until: %s", err)
+	}
+	return types.CommitQuery{
+		Selector:        f.where,
+		Author:          f.author,
+		MessageContains: f.grep,
+		Since:           since,
+		Until:           until,
+	}, nil
+}
+
+// parseCommitTime reads a time as --since and --until take it, in unix
+// nanoseconds as commit timestamps are. Empty means no limit.
+func parseCommitTime(s string, now time.Time) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t.UnixNano(), nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", s, now.Location()); err == nil {
+		return t.UnixNano(), nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d).UnixNano(), nil
+	}
+	return 0, fmt.Errorf("'%s' is not a time, a date or a duration", s)
+}
+
+// verifiedCommit is a commit as 'dm log --verify' prints it with --output
+type verifiedCommit struct {
+	types.Snapshot
+	Signature client.CommitSignature
+}
+
 func NewCmdLog(out io.Writer) *cobra.Command {
+	filter := &commitFilter{}
+	var verify bool
 	cmd := &cobra.Command{
 		Use:   "log",
 		Short: "Show commit logs",
-		Long:  "Online help: https://docs.dotmesh.com/references/cli/#list-commits-dm-log",
+		Long: `Show the commits on the current branch, oldest first.
+
+With --where, --author, --grep, --since or --until, only the commits that
+match all of them are shown.
+
+With --verify, each commit's signature is checked against the keys its
+author has registered with the cluster, and dm log fails if any signature
+doesn't match its commit.
+
+Online help: https://docs.dotmesh.com/references/cli/#list-commits-dm-log`,
 		Run: func(cmd *cobra.Command, args []string) {
 			err := func() error {
 				dm, err := client.NewDotmeshAPI(configPath, verboseOutput)
@@ -37,38 +113,137 @@ func NewCmdLog(out io.Writer) *cobra.Command {
 					return err
 				}
 
-				commits, err := dm.ListCommits(activeVolume, activeBranch)
+				var commits []types.Snapshot
+				if filter.isSet() {
+					commits, err = findBranchCommits(dm, filter, activeVolume, activeBranch)
+				} else {
+					commits, err = dm.ListCommits(activeVolume, activeBranch)
+				}
 				if err != nil {
 					return err
 				}
-				for _, commit := range commits {
-					fmt.Fprintf(out, "commit %s\n", commit.Id)
-					fmt.Fprintf(out, "author: %s\n", commit.Metadata["author"])
-					fmt.Fprintf(out, "date: %s\n", commit.Metadata["timestamp"])
 
-					sortedNames := []string{}
-					for name, _ := range commit.Metadata {
-						sortedNames = append(sortedNames, name)
+				var signatures map[string]client.CommitSignature
+				if verify {
+					signatures, err = dm.VerifyCommits(activeVolume, activeBranch)
+					if err != nil {
+						return err
 					}
-					sort.Strings(sortedNames)
+				}
+				bad := 0
+				for _, signature := range signatures {
+					if signature.Status == client.SignatureBad {
+						bad++
+					}
+				}
+				var badErr error
+				if bad > 0 {
+					badErr = fmt.Errorf("%d commits have bad signatures", bad)
+				}
 
-					for _, name := range sortedNames {
-						value := commit.Metadata[name]
-						if name != "author" && name != "message" && name != "timestamp" {
-							fmt.Fprintf(out, "%s: %s\n", name, value)
-						}
+				if structuredOutput() {
+					if !verify {
+						return printStructured(out, commits)
+					}
+					verified := []verifiedCommit{}
+					for _, commit := range commits {
+						verified = append(verified, verifiedCommit{commit, signatures[commit.Id]})
 					}
+					if err := printStructured(out, verified); err != nil {
+						return err
+					}
+					return badErr
+				}
 
-					fmt.Fprintf(out, "\n")
-					fmt.Fprintf(out, "    %s\n\n", commit.Metadata["message"])
+				// Only admins can see which nodes hold which commits
+				var replicas map[string]int
+				var servers int
+				if dm.IsUserPriveledged() {
+					branchInternalName := activeBranch
+					if branchInternalName == "master" {
+						branchInternalName = ""
+					}
+					replicas, servers, err = dm.ReplicaCountsForBranch(activeVolume, branchInternalName, commits)
+					if err != nil {
+						return err
+					}
 				}
-				return nil
+
+				for _, commit := range commits {
+					var signature *client.CommitSignature
+					if verify {
+						s := signatures[commit.Id]
+						signature = &s
+					}
+					printCommit(out, commit, replicas, servers, signature)
+				}
+				return badErr
 			}()
 			if err != nil {
-				fmt.Fprintln(os.Stderr, err.Error())
-				os.Exit(1)
+				exitWithError(err, exitFailure)
 			}
 		},
 	}
+	filter.addFlags(cmd)
+	cmd.Flags().BoolVar(&verify, "verify", false,
+		"check each commit's signature, and who made it")
 	return cmd
 }
+
+// findBranchCommits is the commits on a branch that match filter, oldest
+// first as dm log shows them
+func findBranchCommits(dm *client.DotmeshAPI, filter *commitFilter, volume, branch string) ([]types.Snapshot, error) {
+	query, err := filter.query(time.Now())
+	if err != nil {
+		return nil, err
+	}
+	query.Namespace, query.Name, err = client.ParseNamespacedVolume(volume)
+	if err != nil {
+		return nil, err
+	}
+	query.Branch = branch
+	matches, err := dm.FindCommits(query)
+	if err != nil {
+		return nil, err
+	}
+	commits := make([]types.Snapshot, len(matches))
+	for i, m := range matches {
+		commits[len(matches)-1-i] = m.Commit
+	}
+	return commits, nil
+}
+
+func printCommit(out io.Writer, commit types.Snapshot, replicas map[string]int, servers int, signature *client.CommitSignature) {
+	fmt.Fprintf(out, "commit %s\n", commit.Id)
+	fmt.Fprintf(out, "author: %s\n", commit.Metadata["author"])
+	fmt.Fprintf(out, "date: %s\n", commit.Metadata["timestamp"])
+	if replicas != nil {
+		fmt.Fprintf(out, "replicas: %d/%d\n", replicas[commit.Id], servers)
+	}
+	if signature != nil {
+		fmt.Fprintf(out, "verified: %s", signature.Status)
+		if signature.Key != "" {
+			fmt.Fprintf(out, " %s", signature.Key)
+		}
+		if signature.Reason != "" {
+			fmt.Fprintf(out, " (%s)", signature.Reason)
+		}
+		fmt.Fprintf(out, "\n")
+	}
+
+	sortedNames := []string{}
+	for name, _ := range commit.Metadata {
+		sortedNames = append(sortedNames, name)
+	}
+	sort.Strings(sortedNames)
+
+	for _, name := range sortedNames {
+		value := commit.Metadata[name]
+		if name != "author" && name != "message" && name != "timestamp" {
+			fmt.Fprintf(out, "%s: %s\n", name, value)
+		}
+	}
+
+	fmt.Fprintf(out, "\n")
+	fmt.Fprintf(out, "    %s\n\n", commit.Metadata["message"])
+}
@@ -0,0 +1,137 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/dotmesh-oss/dotmesh/pkg/client"
+	"github.com/dotmesh-oss/dotmesh/pkg/idp"
+	"github.com/dotmesh-oss/dotmesh/pkg/types"
+	"github.com/spf13/cobra"
+)
+
+func NewCmdLogin(out io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "login <remote-name> [<cluster-hostname>[:<port-number>]]",
+		Short: "Log in to a remote with its identity provider",
+		Long: `Log in to a cluster with the OpenID Connect identity provider it trusts,
+by visiting a web page on any device and entering the code shown, then add it
+as <remote-name> with a new API key. Your account is made on your first login.
+
+Give the cluster's hostname to add a new remote, or leave it out to log in to
+an existing remote again. Logging in again replaces your previous API key.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			runHandlingError(func() error {
+				return login(out, args)
+			})
+		},
+	}
+	return cmd
+}
+
+func login(out io.Writer, args []string) error {
+	if len(args) != 1 && len(args) != 2 {
+		return fmt.Errorf("Please specify <remote-name> [<cluster-hostname>[:<port-number>]]")
+	}
+	remote := args[0]
+	dm, err := client.NewDotmeshAPI(configPath, verboseOutput)
+	if err != nil {
+		return err
+	}
+
+	var hostname string
+	var port int
+	if len(args) == 2 {
+		if dm.Configuration.RemoteExists(remote) {
+			return fmt.Errorf("Remote exists '%s', run 'dm login %s' to log in to it again", remote, remote)
+		}
+		hostname = args[1]
+		if strings.Contains(hostname, ":") {
+			shrapnel := strings.SplitN(hostname, ":", 2)
+			hostname = shrapnel[0]
+			port, err = strconv.Atoi(shrapnel[1])
+			if err != nil {
+				return fmt.Errorf(
+					"Please specify a port as an integer, e.g cluster-hostname:port, got %s", shrapnel[1],
+				)
+			}
+		}
+	} else {
+		existing, ok := dm.Configuration.GetRemotes()[remote]
+		if !ok {
+			return fmt.Errorf("No such dotmesh remote '%s', please specify the cluster's hostname", remote)
+		}
+		hostname = existing.Hostname
+		port = existing.Port
+	}
+
+	ctx := context.Background()
+	authConfig, err := client.GetAuthConfig(ctx, hostname, port)
+	if err != nil {
+		return err
+	}
+	if authConfig.OIDCIssuer == "" {
+		return fmt.Errorf(
+			"%s doesn't trust an identity provider, please add it with 'dm remote add' and an API key", hostname,
+		)
+	}
+
+	deviceLogin, err := idp.StartDeviceLogin(ctx, nil, authConfig.OIDCIssuer, authConfig.OIDCClientID)
+	if err != nil {
+		return err
+	}
+	// the instructions go to stderr, so they're seen with structured output
+	fmt.Fprintf(os.Stderr, "To log in, visit %s and enter the code %s\n", deviceLogin.VerificationURI, deviceLogin.UserCode)
+	if deviceLogin.VerificationURIComplete != deviceLogin.VerificationURI {
+		fmt.Fprintf(os.Stderr, "or visit %s\n", deviceLogin.VerificationURIComplete)
+	}
+	token, err := deviceLogin.Wait(ctx)
+	if err != nil {
+		return err
+	}
+
+	// the ID token authenticates us without a username, and is as good as a
+	// password for getting an API key to keep
+	withToken := &client.JsonRpcClient{Hostname: hostname, Port: port, ApiKey: token}
+	rpcCtx, cancel := context.WithTimeout(ctx, client.RPCTimeout)
+	defer cancel()
+	var user types.SafeUser
+	err = withToken.CallRemote(rpcCtx, "DotmeshRPC.CurrentUser", struct{}{}, &user)
+	if err != nil {
+		return err
+	}
+	var apiKey struct{ ApiKey string }
+	err = withToken.CallRemote(rpcCtx, "DotmeshRPC.ResetApiKey", struct{}{}, &apiKey)
+	if err != nil {
+		return err
+	}
+
+	if len(args) == 2 {
+		err = dm.Configuration.AddRemote(remote, user.Name, hostname, port, apiKey.ApiKey)
+	} else {
+		err = dm.Configuration.SetRemoteCredentials(remote, user.Name, apiKey.ApiKey)
+	}
+	if err != nil {
+		return err
+	}
+	if !structuredOutput() {
+		fmt.Fprintf(out, "Logged in to %s as %s.\n", remote, user.Name)
+	}
+	if dm.Configuration.GetCurrentRemote() == "" {
+		err = dm.Configuration.SetCurrentRemote(remote)
+		if err != nil {
+			return err
+		}
+		if !structuredOutput() {
+			fmt.Fprintln(out, "Automatically switched to first remote.")
+		}
+	}
+	if structuredOutput() {
+		return printStructured(out, remoteEntries(dm.Configuration, []string{remote})[0])
+	}
+	return nil
+}
@@ -25,19 +25,33 @@ var MainCmd = &cobra.Command{
 	Long: `dotmesh (dm) is like git for your data in Docker.
 
 This is the client. Configure it to talk to a dotmesh cluster with 'dm remote
-add'. Create a dotmesh cluster with 'dm cluster init'.`,
+add'. Create a dotmesh cluster with 'dm cluster init'.
+
+With --output json or --output yaml, commands print a document describing
+their result instead of text (except for the 'dm cluster' commands, which
+set up servers and always print text), and errors are printed to stderr as a document
+with "error" and "exitCode" fields. dm exits with 0 on success, 1 if the
+command failed and 2 if the command line was invalid, whatever the output
+format.`,
+	// we report these ourselves, in the format asked for
+	SilenceErrors: true,
+	SilenceUsage:  true,
 	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		err := validateOutputFormat()
+		if err != nil {
+			return err
+		}
 		configPathInner, err := homedir.Expand(configPath)
 		configPath = configPathInner
 		if err != nil {
-			return err
+			exitWithError(err, exitFailure)
 		}
 		dirPath := filepath.Dir(configPath)
 		if _, err := os.Stat(dirPath); err != nil {
 			if err := os.MkdirAll(dirPath, 0700); err != nil {
-				return fmt.Errorf(
+				exitWithError(fmt.Errorf(
 					"Could not create config directory %s: %v", configPath, err,
-				)
+				), exitFailure)
 			}
 		}
 		return nil
@@ -48,15 +62,29 @@ func Initialise() {
 
 	MainCmd.AddCommand(NewCmdCluster(os.Stdout))
 	MainCmd.AddCommand(NewCmdRemote(os.Stdout))
+	MainCmd.AddCommand(NewCmdLogin(os.Stdout))
+	MainCmd.AddCommand(NewCmdKey(os.Stdout))
+	MainCmd.AddCommand(NewCmdOrg(os.Stdout))
 	MainCmd.AddCommand(NewCmdS3(os.Stdout))
 	MainCmd.AddCommand(NewCmdList(os.Stdout))
 	MainCmd.AddCommand(NewCmdInit(os.Stdout))
 	MainCmd.AddCommand(NewCmdSwitch(os.Stdout))
 	MainCmd.AddCommand(NewCmdCommit(os.Stdout))
 	MainCmd.AddCommand(NewCmdLog(os.Stdout))
+	MainCmd.AddCommand(NewCmdFindCommit(os.Stdout))
+	MainCmd.AddCommand(NewCmdVerify(os.Stdout))
+	MainCmd.AddCommand(NewCmdExport(os.Stdout))
+	MainCmd.AddCommand(NewCmdImport(os.Stdout))
+	MainCmd.AddCommand(NewCmdTransfers(os.Stdout))
+	MainCmd.AddCommand(NewCmdStatus(os.Stdout))
+	MainCmd.AddCommand(NewCmdDiff(os.Stdout))
+	MainCmd.AddCommand(NewCmdLs(os.Stdout))
+	MainCmd.AddCommand(NewCmdCat(os.Stdout))
+	MainCmd.AddCommand(NewCmdCp(os.Stdout))
 	MainCmd.AddCommand(NewCmdBranch(os.Stdout))
 	MainCmd.AddCommand(NewCmdCheckout(os.Stdout))
 	MainCmd.AddCommand(NewCmdReset(os.Stdout))
+	MainCmd.AddCommand(NewCmdRestore(os.Stdout))
 	MainCmd.AddCommand(NewCmdClone(os.Stdout))
 	MainCmd.AddCommand(NewCmdPull(os.Stdout))
 	MainCmd.AddCommand(NewCmdPush(os.Stdout))
@@ -64,6 +92,8 @@ func Initialise() {
 	MainCmd.AddCommand(NewCmdDot(os.Stdout))
 	MainCmd.AddCommand(NewCmdVersion(os.Stdout))
 	MainCmd.AddCommand(NewCmdMount(os.Stdout))
+	MainCmd.AddCommand(NewCmdWatch(os.Stdout))
+	MainCmd.AddCommand(NewCmdSubscription(os.Stdout))
 
 	MainCmd.PersistentFlags().StringVarP(
 		&configPath, "config", "c",
@@ -71,6 +101,11 @@ func Initialise() {
 		"Config file to use",
 	)
 
+	MainCmd.PersistentFlags().StringVarP(
+		&outputFormat, "output", "o", outputText,
+		"Print results as json or yaml instead of text",
+	)
+
 	MainCmd.PersistentFlags().BoolVarP(
 		&verboseOutput, "verbose", "",
 		false,
@@ -24,8 +24,7 @@ NOTE: this currently only works for Linux.`,
 		Run: func(cmd *cobra.Command, args []string) {
 			err := mountDot(cmd, args, out)
 			if err != nil {
-				fmt.Fprintln(os.Stderr, err.Error())
-				os.Exit(1)
+				exitWithError(err, exitFailure)
 			}
 		},
 	}
@@ -71,14 +70,31 @@ If you want to create it - use the '--create' flag`, localDot)
 		return err
 	}
 
-	fmt.Fprintf(out, "procured dot: %s/%s into %s\n", namespace, dot, localDotPath)
+	if !structuredOutput() {
+		fmt.Fprintf(out, "procured dot: %s/%s into %s\n", namespace, dot, localDotPath)
+	}
 
 	err = os.Symlink(localDotPath, mountpoint)
 	if err != nil {
 		return err
 	}
 
+	if structuredOutput() {
+		return printStructured(out, mountResult{
+			Dot:        namespace + "/" + dot,
+			Path:       localDotPath,
+			Mountpoint: mountpoint,
+		})
+	}
+
 	fmt.Fprintf(out, "symlinked dot: %s/%s from %s to %s\n", namespace, dot, localDotPath, mountpoint)
 
 	return nil
 }
+
+// mountResult is what 'dm mount' prints with --output
+type mountResult struct {
+	Dot        string
+	Path       string
+	Mountpoint string
+}
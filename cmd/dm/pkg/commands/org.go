@@ -0,0 +1,185 @@
+package commands
+
+import (
+	"fmt"
+	"io"
+	"text/tabwriter"
+
+	"github.com/dotmesh-oss/dotmesh/pkg/client"
+	"github.com/dotmesh-oss/dotmesh/pkg/types"
+	"github.com/spf13/cobra"
+)
+
+var organizationRole string
+
+func NewCmdOrg(out io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "org",
+		Short: "Manage organizations, teams who share a namespace",
+		Long: `Manage organizations on the current remote: teams of users who share a
+namespace named after the organization.
+
+Members of an organization can make dots in its namespace, with
+'dm init <org>/<dot>', and collaborate on all of its dots. Its owners also own
+its dots, and manage its members.
+
+Run 'dm org create <org>' to make one you own, 'dm org add-member <org> <user>'
+and 'dm org remove-member <org> <user>' to change who's in it, and 'dm org ls'
+to list the organizations you're in, or 'dm org ls <org>' its members.`,
+	}
+	cmd.AddCommand(NewCmdOrgCreate(out))
+	cmd.AddCommand(NewCmdOrgAddMember(out))
+	cmd.AddCommand(NewCmdOrgRemoveMember(out))
+	cmd.AddCommand(NewCmdOrgList(out))
+	return cmd
+}
+
+func NewCmdOrgCreate(out io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "create <org>",
+		Short: "Make an organization and its namespace, owned by you",
+		Run: func(cmd *cobra.Command, args []string) {
+			runHandlingError(func() error {
+				if len(args) != 1 {
+					return fmt.Errorf("Please specify the name of the organization")
+				}
+				dm, err := client.NewDotmeshAPI(configPath, verboseOutput)
+				if err != nil {
+					return err
+				}
+				org, err := dm.CreateOrganization(args[0])
+				if err != nil {
+					return err
+				}
+				if structuredOutput() {
+					return printStructured(out, org)
+				}
+				fmt.Fprintf(out, "Created organization %s\n", org.Name)
+				return nil
+			})
+		},
+	}
+	return cmd
+}
+
+func NewCmdOrgAddMember(out io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "add-member <org> <user>",
+		Short: "Add a user to an organization, or change their role in it",
+		Run: func(cmd *cobra.Command, args []string) {
+			runHandlingError(func() error {
+				if len(args) != 2 {
+					return fmt.Errorf("Please specify <org> <user>")
+				}
+				dm, err := client.NewDotmeshAPI(configPath, verboseOutput)
+				if err != nil {
+					return err
+				}
+				org, err := dm.AddOrganizationMember(args[0], args[1], types.OrganizationRole(organizationRole))
+				if err != nil {
+					return err
+				}
+				return printOrganizationMembers(out, org)
+			})
+		},
+	}
+	cmd.Flags().StringVar(
+		&organizationRole, "role", string(types.OrganizationRoleMember),
+		"member, who can make dots in the organization's namespace and "+
+			"collaborate on them, or owner, who also owns its dots and manages its members",
+	)
+	return cmd
+}
+
+func NewCmdOrgRemoveMember(out io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "remove-member <org> <user>",
+		Short: "Remove a user from an organization",
+		Run: func(cmd *cobra.Command, args []string) {
+			runHandlingError(func() error {
+				if len(args) != 2 {
+					return fmt.Errorf("Please specify <org> <user>")
+				}
+				dm, err := client.NewDotmeshAPI(configPath, verboseOutput)
+				if err != nil {
+					return err
+				}
+				org, err := dm.RemoveOrganizationMember(args[0], args[1])
+				if err != nil {
+					return err
+				}
+				return printOrganizationMembers(out, org)
+			})
+		},
+	}
+	return cmd
+}
+
+func NewCmdOrgList(out io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "ls [<org>]",
+		Short: "List the organizations you're in, or an organization's members",
+		Run: func(cmd *cobra.Command, args []string) {
+			runHandlingError(func() error {
+				if len(args) > 1 {
+					return fmt.Errorf("Please specify at most one organization")
+				}
+				dm, err := client.NewDotmeshAPI(configPath, verboseOutput)
+				if err != nil {
+					return err
+				}
+				if len(args) == 1 {
+					org, err := dm.Organization(args[0])
+					if err != nil {
+						return err
+					}
+					return printOrganizationMembers(out, org)
+				}
+
+				orgs, err := dm.Organizations()
+				if err != nil {
+					return err
+				}
+				if structuredOutput() {
+					return printStructured(out, orgs)
+				}
+				if scriptingMode {
+					for _, org := range orgs {
+						fmt.Fprintf(out, "%s\t%d\t%d\n", org.Name, len(org.Members), org.Created.Unix())
+					}
+					return nil
+				}
+				w := tabwriter.NewWriter(out, 3, 8, 2, ' ', 0)
+				fmt.Fprintf(w, "NAME\tMEMBERS\tCREATED\n")
+				for _, org := range orgs {
+					fmt.Fprintf(w, "%s\t%d\t%s\n", org.Name, len(org.Members), org.Created.Format("2006-01-02 15:04"))
+				}
+				return w.Flush()
+			})
+		},
+	}
+	cmd.Flags().BoolVarP(
+		&scriptingMode, "scripting", "H", false,
+		"scripting mode. Do not print headers, separate fields by "+
+			"a single tab instead of arbitrary whitespace.",
+	)
+	return cmd
+}
+
+func printOrganizationMembers(out io.Writer, org *types.Organization) error {
+	if structuredOutput() {
+		return printStructured(out, org)
+	}
+	if scriptingMode {
+		for _, member := range org.Members {
+			fmt.Fprintf(out, "%s\t%s\n", member.Name, member.Role)
+		}
+		return nil
+	}
+	w := tabwriter.NewWriter(out, 3, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "MEMBER\tROLE\n")
+	for _, member := range org.Members {
+		fmt.Fprintf(w, "%s\t%s\n", member.Name, member.Role)
+	}
+	return w.Flush()
+}
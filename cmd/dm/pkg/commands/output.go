@@ -0,0 +1,134 @@
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/dotmesh-oss/dotmesh/pkg/client"
+	"github.com/dotmesh-oss/dotmesh/pkg/types"
+
+	"github.com/ghodss/yaml"
+)
+
+// Values of the global --output flag. The default, "", is the human readable
+// (or, with -H, tab separated) text each command has always printed.
+const (
+	outputText = ""
+	outputJSON = "json"
+	outputYAML = "yaml"
+)
+
+// Exit codes, the same whatever --output is set to
+const (
+	// the command ran and failed
+	exitFailure = 1
+	// the command line didn't make sense: an unknown command or flag, or a
+	// bad --output
+	exitUsage = 2
+)
+
+var outputFormat string
+
+// commandError is what a failing command prints to stderr with --output set
+type commandError struct {
+	Error    string `json:"error"`
+	ExitCode int    `json:"exitCode"`
+}
+
+// structuredOutput says whether commands should print documents rather than
+// text
+func structuredOutput() bool {
+	return outputFormat != outputText
+}
+
+func validateOutputFormat() error {
+	switch outputFormat {
+	case outputText, outputJSON, outputYAML:
+		return nil
+	default:
+		return fmt.Errorf("Unknown output format '%s', please use json or yaml", outputFormat)
+	}
+}
+
+// printStructured writes v as a single JSON or YAML document, according to
+// --output
+func printStructured(out io.Writer, v interface{}) error {
+	if outputFormat == outputYAML {
+		// ghodss/yaml goes via JSON, so the json tags of our types apply
+		// to both formats
+		bs, err := yaml.Marshal(v)
+		if err != nil {
+			return err
+		}
+		_, err = out.Write(bs)
+		return err
+	}
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// printStreamed writes one of a series of documents, for commands that keep
+// printing until they're interrupted: a line of JSON each, or YAML documents
+// separated by ---
+func printStreamed(out io.Writer, v interface{}) error {
+	if outputFormat == outputYAML {
+		_, err := fmt.Fprintln(out, "---")
+		if err != nil {
+			return err
+		}
+		return printStructured(out, v)
+	}
+	return json.NewEncoder(out).Encode(v)
+}
+
+// dotResult is what commands that change a dot print with --output
+type dotResult struct {
+	Dot    string
+	Branch string `json:",omitempty"`
+	Commit string `json:",omitempty"`
+}
+
+// exitWithError reports err in the requested format and exits with code
+func exitWithError(err error, code int) {
+	if structuredOutput() {
+		printErr := printStructured(os.Stderr, commandError{Error: err.Error(), ExitCode: code})
+		if printErr == nil {
+			os.Exit(code)
+		}
+	}
+	fmt.Fprintln(os.Stderr, err.Error())
+	os.Exit(code)
+}
+
+// ExitWithUsageError is for errors cobra returns from parsing the command
+// line, which it hasn't printed because MainCmd silences them
+func ExitWithUsageError(err error) {
+	if !structuredOutput() {
+		err = fmt.Errorf("Error: %s\nRun 'dm --help' for usage.", err)
+	}
+	exitWithError(err, exitUsage)
+}
+
+// pollTransfer follows a push, pull or clone to the end, showing a progress
+// bar, or with --output the final state of the transfer
+func pollTransfer(dm *client.DotmeshAPI, transferId string, out io.Writer) error {
+	if !structuredOutput() {
+		return dm.PollTransfer(transferId, out, dm.UpdateBar)
+	}
+	var last types.TransferPollResult
+	err := dm.PollTransfer(transferId, ioutil.Discard, func(result types.TransferPollResult, err error, started bool) bool {
+		if err == nil {
+			last = result
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	last.ApiKey = ""
+	return printStructured(out, last)
+}
@@ -0,0 +1,52 @@
+package commands
+
+import (
+	"bytes"
+	"testing"
+)
+
+func Test_printStructured(t *testing.T) {
+	defer func() { outputFormat = outputText }()
+
+	v := dotResult{Dot: "apples", Branch: "master"}
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{
+			format: outputJSON,
+			want:   "{\n  \"Dot\": \"apples\",\n  \"Branch\": \"master\"\n}\n",
+		},
+		{
+			format: outputYAML,
+			want:   "Branch: master\nDot: apples\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			outputFormat = tt.format
+			var out bytes.Buffer
+			if err := printStructured(&out, v); err != nil {
+				t.Fatalf("printStructured() error = %v", err)
+			}
+			if got := out.String(); got != tt.want {
+				t.Errorf("printStructured() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_validateOutputFormat(t *testing.T) {
+	defer func() { outputFormat = outputText }()
+
+	for _, format := range []string{outputText, outputJSON, outputYAML} {
+		outputFormat = format
+		if err := validateOutputFormat(); err != nil {
+			t.Errorf("validateOutputFormat() with %q error = %v", format, err)
+		}
+	}
+	outputFormat = "xml"
+	if err := validateOutputFormat(); err == nil {
+		t.Errorf("validateOutputFormat() with xml, want an error")
+	}
+}
@@ -1,9 +1,7 @@
 package commands
 
 import (
-	"fmt"
 	"io"
-	"os"
 
 	"github.com/dotmesh-oss/dotmesh/pkg/client"
 	"github.com/spf13/cobra"
@@ -50,19 +48,19 @@ Online help: https://docs.dotmesh.com/references/cli/#pull-dm-pull-remote-dot-br
 					pullRemoteVolume, branchName,
 					nil,
 					stash,
+					transferPriority,
 				)
 				if err != nil {
 					return err
 				}
-				err = dm.PollTransfer(transferId, out, dm.UpdateBar)
+				err = pollTransfer(dm, transferId, out)
 				if err != nil {
 					return err
 				}
 				return nil
 			}()
 			if err != nil {
-				fmt.Fprintln(os.Stderr, err.Error())
-				os.Exit(1)
+				exitWithError(err, exitFailure)
 			}
 		},
 	}
@@ -70,5 +68,7 @@ Online help: https://docs.dotmesh.com/references/cli/#pull-dm-pull-remote-dot-br
 	cmd.PersistentFlags().StringVarP(&pullRemoteVolume, "remote-name", "", "",
 		"Remote dot name to pull from")
 	cmd.PersistentFlags().BoolVarP(&stash, "stash-on-divergence", "", false, "stash any divergence on a branch and continue")
+	cmd.PersistentFlags().IntVarP(&transferPriority, "priority", "", 0,
+		"start before queued transfers with a lower priority, if the cluster is busy")
 	return cmd
 }
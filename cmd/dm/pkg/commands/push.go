@@ -1,9 +1,7 @@
 package commands
 
 import (
-	"fmt"
 	"io"
-	"os"
 
 	"github.com/dotmesh-oss/dotmesh/pkg/client"
 	"github.com/spf13/cobra"
@@ -44,25 +42,26 @@ Online help: https://docs.dotmesh.com/references/cli/#push-dm-push-remote-remote
 					return err
 				}
 				transferId, err := dm.RequestTransfer(
-					"push", peer, filesystemName, branchName, pushRemoteVolume, "", nil, stash,
+					"push", peer, filesystemName, branchName, pushRemoteVolume, "", nil, stash, transferPriority,
 				)
 				if err != nil {
 					return err
 				}
-				err = dm.PollTransfer(transferId, out, dm.UpdateBar)
+				err = pollTransfer(dm, transferId, out)
 				if err != nil {
 					return err
 				}
 				return nil
 			}()
 			if err != nil {
-				fmt.Fprintln(os.Stderr, err.Error())
-				os.Exit(1)
+				exitWithError(err, exitFailure)
 			}
 		},
 	}
 	cmd.PersistentFlags().StringVarP(&pushRemoteVolume, "remote-name", "", "",
 		"Remote dot name to push to, including remote namespace e.g. alice/apples")
 	cmd.PersistentFlags().BoolVarP(&stash, "stash-on-divergence", "", false, "stash any divergence on a branch and continue")
+	cmd.PersistentFlags().IntVarP(&transferPriority, "priority", "", 0,
+		"start before queued transfers with a lower priority, if the cluster is busy")
 	return cmd
 }
@@ -39,6 +39,9 @@ func NewCmdRemote(out io.Writer) *cobra.Command {
 					keys = append(keys, k)
 				}
 				sort.Strings(keys)
+				if structuredOutput() {
+					return printStructured(out, remoteEntries(dm.Configuration, keys))
+				}
 				if verbose {
 					currentRemote := dm.Configuration.GetCurrentRemote()
 					for _, k := range keys {
@@ -139,14 +142,21 @@ func NewCmdRemote(out io.Writer) *cobra.Command {
 				if err != nil {
 					return err
 				}
-				fmt.Fprintln(out, "Remote added.")
+				if !structuredOutput() {
+					fmt.Fprintln(out, "Remote added.")
+				}
 				currentRemote := dm.Configuration.GetCurrentRemote()
 				if currentRemote == "" {
 					err = dm.Configuration.SetCurrentRemote(remote)
 					if err != nil {
 						return err
 					}
-					fmt.Fprintln(out, "Automatically switched to first remote.")
+					if !structuredOutput() {
+						fmt.Fprintln(out, "Automatically switched to first remote.")
+					}
+				}
+				if structuredOutput() {
+					return printStructured(out, remoteEntries(dm.Configuration, []string{remote})[0])
 				}
 				return nil
 			})
@@ -168,7 +178,14 @@ func NewCmdRemote(out io.Writer) *cobra.Command {
 						"Please specify <remote-name>",
 					)
 				}
-				return dm.Configuration.RemoveRemote(args[0])
+				err = dm.Configuration.RemoveRemote(args[0])
+				if err != nil {
+					return err
+				}
+				if structuredOutput() {
+					return printStructured(out, struct{ Name string }{args[0]})
+				}
+				return nil
 			})
 		},
 	})
@@ -187,10 +204,81 @@ func NewCmdRemote(out io.Writer) *cobra.Command {
 						"Please specify <remote-name>",
 					)
 				}
-				return dm.Configuration.SetCurrentRemote(args[0])
+				err = dm.Configuration.SetCurrentRemote(args[0])
+				if err != nil {
+					return err
+				}
+				if structuredOutput() {
+					return printStructured(out, remoteEntries(dm.Configuration, []string{args[0]})[0])
+				}
+				return nil
+			})
+		},
+	})
+	cmd.AddCommand(&cobra.Command{
+		Use:   "secrets [plain|keyring|file]",
+		Short: "Show or change where remotes' API keys and secret keys are kept",
+		Long: "Remotes' API keys and S3 secret keys are kept in the configuration file ('plain'), " +
+			"in the OS keyring ('keyring'), or in a file next to the configuration, " +
+			"encrypted with the passphrase in $" + client.ConfigPassphraseEnv + " ('file').",
+		Run: func(cmd *cobra.Command, args []string) {
+			runHandlingError(func() error {
+				if len(args) > 1 {
+					return fmt.Errorf("Please specify one of plain, keyring or file")
+				}
+				dm, err := client.NewDotmeshAPI(configPath, verboseOutput)
+				if err != nil {
+					return err
+				}
+				if len(args) == 1 {
+					err = dm.Configuration.SetSecretStore(args[0])
+					if err != nil {
+						return err
+					}
+				}
+				if structuredOutput() {
+					return printStructured(out, struct{ SecretStore string }{dm.Configuration.GetSecretStore()})
+				}
+				fmt.Fprintln(out, dm.Configuration.GetSecretStore())
+				return nil
 			})
 		},
 	})
 	cmd.Flags().BoolVarP(&verbose, "verbose", "v", false, "verbose list of remotes")
 	return cmd
 }
+
+// remoteEntry is how 'dm remote' describes each remote with --output. It
+// leaves out credentials.
+type remoteEntry struct {
+	Name     string
+	Current  bool
+	Type     string
+	User     string `json:",omitempty"`
+	Hostname string `json:",omitempty"`
+	Port     int    `json:",omitempty"`
+	KeyID    string `json:",omitempty"`
+	Endpoint string `json:",omitempty"`
+}
+
+func remoteEntries(c *client.Configuration, keys []string) []remoteEntry {
+	remotes := c.GetRemotes()
+	s3Remotes := c.GetS3Remotes()
+	currentRemote := c.GetCurrentRemote()
+	entries := []remoteEntry{}
+	for _, k := range keys {
+		entry := remoteEntry{Name: k, Current: k == currentRemote}
+		if remote, ok := remotes[k]; ok {
+			entry.Type = "dotmesh"
+			entry.User = remote.User
+			entry.Hostname = remote.Hostname
+			entry.Port = remote.Port
+		} else {
+			entry.Type = "s3"
+			entry.KeyID = s3Remotes[k].KeyID
+			entry.Endpoint = s3Remotes[k].Endpoint
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
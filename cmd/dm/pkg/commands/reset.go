@@ -3,7 +3,6 @@ package commands
 import (
 	"fmt"
 	"io"
-	"os"
 
 	"github.com/dotmesh-oss/dotmesh/pkg/client"
 	"github.com/spf13/cobra"
@@ -27,11 +26,30 @@ func NewCmdReset(out io.Writer) *cobra.Command {
 				if err := dm.ResetCurrentVolume(commit); err != nil {
 					return err
 				}
+				if structuredOutput() {
+					// report where the ref led rather than the ref itself
+					v, err := dm.CurrentVolume()
+					if err != nil {
+						return err
+					}
+					b, err := dm.CurrentBranch(v)
+					if err != nil {
+						return err
+					}
+					commits, err := dm.ListCommits(v, b)
+					if err != nil {
+						return err
+					}
+					result := dotResult{Dot: v, Branch: b}
+					if len(commits) > 0 {
+						result.Commit = commits[len(commits)-1].Id
+					}
+					return printStructured(out, result)
+				}
 				return nil
 			}()
 			if err != nil {
-				fmt.Fprintln(os.Stderr, err.Error())
-				os.Exit(1)
+				exitWithError(err, exitFailure)
 			}
 		},
 	}
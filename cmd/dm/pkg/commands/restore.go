@@ -0,0 +1,88 @@
+package commands
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/dotmesh-oss/dotmesh/pkg/client"
+	"github.com/spf13/cobra"
+)
+
+// restoreResult is what 'dm restore' prints with --output
+type restoreResult struct {
+	Dot    string
+	Branch string
+	Paths  []string
+	Files  int
+	Commit string `json:",omitempty"`
+}
+
+func NewCmdRestore(out io.Writer) *cobra.Command {
+	var commitAfter bool
+	var message string
+	cmd := &cobra.Command{
+		Use:   "restore <ref> -- <path>...",
+		Short: "Restore files or directories from a commit into the working copy",
+		Long: `Copy the given paths, as they were in <ref>, into the working copy of the
+current branch, replacing what is there now. Directories are restored with
+everything under them; permissions and symlinks are kept. Unlike
+'dm reset --hard', the rest of the working copy is left alone.
+
+With --commit, the working copy is committed once the paths are restored.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			runHandlingError(func() error {
+				dash := cmd.ArgsLenAtDash()
+				if dash != 1 {
+					return fmt.Errorf("Please specify one ref, then -- and the paths to restore.")
+				}
+				paths := args[dash:]
+				if len(paths) == 0 {
+					return fmt.Errorf("Please specify at least one path to restore after --")
+				}
+
+				dm, err := client.NewDotmeshAPI(configPath, verboseOutput)
+				if err != nil {
+					return err
+				}
+				activeVolume, err := dm.StrictCurrentVolume()
+				if err != nil {
+					return err
+				}
+				if activeVolume == "" {
+					return fmt.Errorf(
+						"No current dot. Try 'dm list' and " +
+							"'dm switch' to switch to a dot.",
+					)
+				}
+				activeBranch, err := dm.CurrentBranch(activeVolume)
+				if err != nil {
+					return err
+				}
+
+				result, err := dm.Restore(activeVolume, activeBranch, args[0], paths, commitAfter, message)
+				if err != nil {
+					return err
+				}
+				if structuredOutput() {
+					return printStructured(out, restoreResult{
+						Dot:    activeVolume,
+						Branch: activeBranch,
+						Paths:  paths,
+						Files:  result.Files,
+						Commit: result.CommitId,
+					})
+				}
+				fmt.Fprintf(out, "Restored %d files from %s\n", result.Files, args[0])
+				if result.CommitId != "" {
+					fmt.Fprintf(out, "Committed as %s\n", result.CommitId)
+				}
+				return nil
+			})
+		},
+	}
+	cmd.Flags().BoolVar(&commitAfter, "commit", false,
+		"commit the working copy once the paths are restored")
+	cmd.Flags().StringVarP(&message, "message", "m", "",
+		"message for the commit made with --commit")
+	return cmd
+}
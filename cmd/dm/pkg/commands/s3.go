@@ -67,6 +67,9 @@ func NewCmdS3(out io.Writer) *cobra.Command {
 				if err != nil {
 					return err
 				}
+				if structuredOutput() {
+					return printStructured(out, remoteEntries(dm.Configuration, []string{remote})[0])
+				}
 				fmt.Fprintln(out, "s3 remote added.")
 				return nil
 			})
@@ -94,12 +97,13 @@ func NewCmdS3(out io.Writer) *cobra.Command {
 					filesystemName, branchName,
 					prefixes,
 					false,
+					0,
 					// TODO also switch to the remote?
 				)
 				if err != nil {
 					return err
 				}
-				err = dm.PollTransfer(transferId, out, dm.UpdateBar)
+				err = pollTransfer(dm, transferId, out)
 				if err != nil {
 					return err
 				}
@@ -0,0 +1,327 @@
+package commands
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/dotmesh-oss/dotmesh/pkg/client"
+	"github.com/dotmesh-oss/dotmesh/pkg/types"
+	"github.com/spf13/cobra"
+)
+
+func NewCmdStatus(out io.Writer) *cobra.Command {
+	var remoteName string
+	cmd := &cobra.Command{
+		Use:   "status",
+		Short: "Show the state of the current branch's working copy",
+		Long: `Show the current dot and branch, which node is its master, the
+containers using it, how many commits it is ahead of or behind the dot it
+tracks on a remote, and which files have changed since the last commit.
+
+The remote compared against is the one given with --remote, or otherwise the
+first remote (other than the current one) that 'dm push' or 'dm pull' has
+remembered a default dot for.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			runHandlingError(func() error {
+				if len(args) > 0 {
+					return fmt.Errorf("Too many arguments specified.")
+				}
+				dm, err := client.NewDotmeshAPI(configPath, verboseOutput)
+				if err != nil {
+					return err
+				}
+				activeVolume, err := dm.StrictCurrentVolume()
+				if err != nil {
+					return err
+				}
+				if activeVolume == "" {
+					return fmt.Errorf(
+						"No current dot. Try 'dm list' and " +
+							"'dm switch' to switch to a dot.",
+					)
+				}
+				activeBranch, err := dm.CurrentBranch(activeVolume)
+				if err != nil {
+					return err
+				}
+				return showStatus(out, dm, activeVolume, activeBranch, remoteName)
+			})
+		},
+	}
+	cmd.Flags().StringVar(&remoteName, "remote", "",
+		"remote to compare commits with (default the one the dot tracks)")
+	cmd.Flags().BoolVarP(
+		&scriptingMode, "scripting", "H", false,
+		"scripting mode. Do not print headers, separate fields by "+
+			"a single tab instead of arbitrary whitespace.",
+	)
+	return cmd
+}
+
+// statusResult is everything 'dm status' reports, and what it prints with
+// --output
+type statusResult struct {
+	Dot        string
+	Branch     string
+	Master     string
+	DirtyBytes int64
+	Containers []string
+	// nil if the dot doesn't track a dot on any remote
+	Tracking *statusTracking
+	// nil if there are no commits to compare the working copy with
+	Files []types.ZFSFileDiff
+}
+
+type statusTracking struct {
+	Remote string
+	Dot    types.VolumeName
+	// Ahead and Behind are only meaningful if Error is empty
+	Ahead  int
+	Behind int
+	// why the commits couldn't be compared, e.g. the remote is down
+	Error string `json:",omitempty"`
+}
+
+func showStatus(out io.Writer, dm *client.DotmeshAPI, activeVolume, activeBranch, remoteName string) error {
+	result, err := getStatus(dm, activeVolume, activeBranch, remoteName)
+	if err != nil {
+		return err
+	}
+	if structuredOutput() {
+		return printStructured(out, result)
+	}
+
+	if scriptingMode {
+		fmt.Fprintf(out, "dot\t%s\n", result.Dot)
+		fmt.Fprintf(out, "branch\t%s\n", result.Branch)
+		fmt.Fprintf(out, "master\t%s\n", result.Master)
+		fmt.Fprintf(out, "dirtyBytes\t%d\n", result.DirtyBytes)
+		for _, c := range result.Containers {
+			fmt.Fprintf(out, "container\t%s\n", c)
+		}
+		if t := result.Tracking; t != nil {
+			if t.Error != "" {
+				fmt.Fprintf(out, "tracking\t%s\t%s\t%s\n", t.Remote, t.Dot, "unknown")
+			} else {
+				fmt.Fprintf(out, "tracking\t%s\t%s\t%d\t%d\n", t.Remote, t.Dot, t.Ahead, t.Behind)
+			}
+		}
+		for _, f := range result.Files {
+			fmt.Fprintf(out, "file\t%s\t%s\n", f.Change, f.Filename)
+		}
+		return nil
+	}
+
+	fmt.Fprintf(out, "On dot %s, branch %s\n", result.Dot, result.Branch)
+	fmt.Fprintf(out, "Master node: %s\n", result.Master)
+	if len(result.Containers) == 0 {
+		fmt.Fprintf(out, "Containers: none\n")
+	} else {
+		fmt.Fprintf(out, "Containers: %s\n", strings.Join(result.Containers, ", "))
+	}
+
+	if t := result.Tracking; t == nil {
+		fmt.Fprintf(out, "Not tracking a dot on any remote\n")
+	} else if t.Error != "" {
+		fmt.Fprintf(out, "Tracking %s on remote %s, unable to compare: %s\n", t.Dot, t.Remote, t.Error)
+	} else {
+		fmt.Fprintf(out, "Tracking %s on remote %s: ", t.Dot, t.Remote)
+		switch {
+		case t.Ahead == 0 && t.Behind == 0:
+			fmt.Fprintf(out, "up to date\n")
+		case t.Behind == 0:
+			fmt.Fprintf(out, "%d commits ahead, 'dm push' to publish them\n", t.Ahead)
+		case t.Ahead == 0:
+			fmt.Fprintf(out, "%d commits behind, 'dm pull' to fetch them\n", t.Behind)
+		default:
+			fmt.Fprintf(out, "diverged, %d commits ahead and %d behind\n", t.Ahead, t.Behind)
+		}
+	}
+
+	switch {
+	case result.Files == nil:
+		fmt.Fprintf(out, "\nNo commits yet (%s uncommitted)\n", prettyPrintSize(result.DirtyBytes))
+	case len(result.Files) == 0:
+		fmt.Fprintf(out, "\nNothing to commit, working copy clean\n")
+	default:
+		fmt.Fprintf(out, "\nChanges since the last commit (%s):\n", prettyPrintSize(result.DirtyBytes))
+		for _, f := range result.Files {
+			fmt.Fprintf(out, "  %-9s %s\n", describeChange(f.Change)+":", f.Filename)
+		}
+	}
+	return nil
+}
+
+func getStatus(dm *client.DotmeshAPI, activeVolume, activeBranch, remoteName string) (*statusResult, error) {
+	namespace, dot, err := client.ParseNamespacedVolume(activeVolume)
+	if err != nil {
+		return nil, err
+	}
+	internalBranch := activeBranch
+	if internalBranch == "master" {
+		internalBranch = ""
+	}
+
+	branchDot, err := dm.BranchInfo(namespace, dot, internalBranch)
+	if err != nil {
+		return nil, err
+	}
+	result := &statusResult{
+		Dot:        activeVolume,
+		Branch:     activeBranch,
+		Master:     branchDot.Master,
+		DirtyBytes: branchDot.DirtyBytes,
+		Containers: []string{},
+	}
+
+	containers, err := dm.RelatedContainers(branchDot.Name, activeBranch)
+	if err != nil {
+		return nil, err
+	}
+	for _, container := range containers {
+		result.Containers = append(result.Containers, container.Name)
+	}
+
+	commits, err := dm.ListCommits(activeVolume, activeBranch)
+	if err != nil {
+		return nil, err
+	}
+
+	result.Tracking, err = getTracking(dm, namespace, dot, activeBranch, remoteName, commits)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(commits) == 0 {
+		return result, nil
+	}
+
+	result.Files = []types.ZFSFileDiff{}
+	if internalBranch == "" {
+		files, err := dm.Diff(namespace, dot)
+		if err != nil {
+			return nil, err
+		}
+		result.Files = append(result.Files, files...)
+	} else {
+		// the file level diff only knows about master, so compare other
+		// branches' working copies with their latest commit by hand
+		err = dm.DiffCommits(activeVolume, activeBranch, "", "", "", false, func(d *types.CommitFileDiff) error {
+			result.Files = append(result.Files, types.ZFSFileDiff{Change: d.Change, Filename: d.Filename})
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	sort.Slice(result.Files, func(i, j int) bool {
+		return result.Files[i].Filename < result.Files[j].Filename
+	})
+	return result, nil
+}
+
+func describeChange(c types.FileChange) string {
+	switch c {
+	case types.FileChangeAdded:
+		return "added"
+	case types.FileChangeModified:
+		return "modified"
+	case types.FileChangeRemoved:
+		return "removed"
+	case types.FileChangeRenamed:
+		return "renamed"
+	default:
+		return "changed"
+	}
+}
+
+// trackedRemote picks the remote whose default dot status compares with:
+// remoteName if given, otherwise the first other remote that has one
+// remembered for namespace/dot.
+func trackedRemote(dm *client.DotmeshAPI, namespace, dot, remoteName string) (string, string, string, bool) {
+	if remoteName != "" {
+		remoteNamespace, remoteDot, ok := dm.Configuration.DefaultRemoteVolumeFor(remoteName, namespace, dot)
+		if !ok {
+			remote, err := dm.Configuration.GetRemote(remoteName)
+			if err != nil {
+				return "", "", "", false
+			}
+			remoteNamespace, remoteDot = remote.DefaultNamespace(), dot
+		}
+		return remoteName, remoteNamespace, remoteDot, true
+	}
+
+	remotes := dm.Configuration.GetRemotes()
+	keys := []string{}
+	for k := range remotes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if k == dm.Configuration.CurrentRemote {
+			continue
+		}
+		remoteNamespace, remoteDot, ok := dm.Configuration.DefaultRemoteVolumeFor(k, namespace, dot)
+		if ok {
+			return k, remoteNamespace, remoteDot, true
+		}
+	}
+	return "", "", "", false
+}
+
+func getTracking(dm *client.DotmeshAPI, namespace, dot, branch, remoteName string, commits []types.Snapshot) (*statusTracking, error) {
+	peer, remoteNamespace, remoteDot, ok := trackedRemote(dm, namespace, dot, remoteName)
+	if !ok {
+		if remoteName != "" {
+			return nil, fmt.Errorf("No such remote '%s'", remoteName)
+		}
+		return nil, nil
+	}
+	if _, ok := dm.Configuration.GetRemotes()[peer]; !ok {
+		return nil, fmt.Errorf("Remote '%s' is not a dotmesh cluster", peer)
+	}
+
+	tracking := &statusTracking{
+		Remote: peer,
+		Dot:    types.VolumeName{Namespace: remoteNamespace, Name: remoteDot},
+	}
+	rpc, err := dm.Configuration.ClusterFromRemote(peer, verboseOutput)
+	if err != nil {
+		return nil, err
+	}
+	remoteCommits, err := client.NewDotmeshAPIFromClient(rpc, verboseOutput).ListCommits(tracking.Dot.String(), branch)
+	if err != nil {
+		// the remote may be down, or not have the branch yet; that's worth
+		// saying but not worth failing over
+		tracking.Error = err.Error()
+		return tracking, nil
+	}
+	tracking.Ahead, tracking.Behind = aheadBehind(commits, remoteCommits)
+	return tracking, nil
+}
+
+// aheadBehind counts the commits only in local and only in remote
+func aheadBehind(local, remote []types.Snapshot) (int, int) {
+	inLocal := map[string]bool{}
+	for _, c := range local {
+		inLocal[c.Id] = true
+	}
+	inRemote := map[string]bool{}
+	for _, c := range remote {
+		inRemote[c.Id] = true
+	}
+	ahead, behind := 0, 0
+	for _, c := range local {
+		if !inRemote[c.Id] {
+			ahead++
+		}
+	}
+	for _, c := range remote {
+		if !inLocal[c.Id] {
+			behind++
+		}
+	}
+	return ahead, behind
+}
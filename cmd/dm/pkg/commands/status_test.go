@@ -0,0 +1,99 @@
+package commands
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dotmesh-oss/dotmesh/pkg/client"
+	"github.com/dotmesh-oss/dotmesh/pkg/types"
+)
+
+func commits(ids ...string) []types.Snapshot {
+	result := []types.Snapshot{}
+	for _, id := range ids {
+		result = append(result, types.Snapshot{Id: id})
+	}
+	return result
+}
+
+func Test_aheadBehind(t *testing.T) {
+	tests := []struct {
+		name   string
+		local  []types.Snapshot
+		remote []types.Snapshot
+		ahead  int
+		behind int
+	}{
+		{name: "in sync", local: commits("a", "b"), remote: commits("a", "b")},
+		{name: "ahead", local: commits("a", "b", "c"), remote: commits("a"), ahead: 2},
+		{name: "behind", local: commits("a"), remote: commits("a", "b"), behind: 1},
+		{name: "diverged", local: commits("a", "b", "c"), remote: commits("a", "d"), ahead: 2, behind: 1},
+		{name: "nothing pushed yet", local: commits("a", "b"), remote: commits(), ahead: 2},
+		{name: "nothing pulled yet", local: commits(), remote: commits("a"), behind: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ahead, behind := aheadBehind(tt.local, tt.remote)
+			if ahead != tt.ahead || behind != tt.behind {
+				t.Errorf("aheadBehind() = %d, %d, want %d, %d", ahead, behind, tt.ahead, tt.behind)
+			}
+		})
+	}
+}
+
+func Test_trackedRemote(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dm-status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config, err := client.NewConfiguration(filepath.Join(dir, "config"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, remote := range []string{"local", "hub", "backup"} {
+		err = config.AddRemote(remote, "alice", remote+".example.com", 0, "apikey")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = config.SetCurrentRemote("local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// pushed to both, and to the current remote itself, which never counts
+	for _, remote := range []string{"local", "hub", "backup"} {
+		err = config.SetDefaultRemoteVolumeFor(remote, "alice", "data", "team", remote+"-data")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	dm := &client.DotmeshAPI{Configuration: config}
+
+	tests := []struct {
+		name          string
+		dot           string
+		remoteName    string
+		wantOk        bool
+		wantRemote    string
+		wantNamespace string
+		wantDot       string
+	}{
+		{name: "first remote pushed to", dot: "data", wantOk: true, wantRemote: "backup", wantNamespace: "team", wantDot: "backup-data"},
+		{name: "given remote", dot: "data", remoteName: "hub", wantOk: true, wantRemote: "hub", wantNamespace: "team", wantDot: "hub-data"},
+		{name: "given remote never pushed to", dot: "other", remoteName: "hub", wantOk: true, wantRemote: "hub", wantNamespace: "alice", wantDot: "other"},
+		{name: "unknown remote", dot: "data", remoteName: "nowhere"},
+		{name: "no upstream", dot: "other"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			remote, namespace, dot, ok := trackedRemote(dm, "alice", tt.dot, tt.remoteName)
+			if ok != tt.wantOk || remote != tt.wantRemote || namespace != tt.wantNamespace || dot != tt.wantDot {
+				t.Errorf("trackedRemote() = %q, %q, %q, %t, want %q, %q, %q, %t",
+					remote, namespace, dot, ok, tt.wantRemote, tt.wantNamespace, tt.wantDot, tt.wantOk)
+			}
+		})
+	}
+}
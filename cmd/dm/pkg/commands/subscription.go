@@ -0,0 +1,210 @@
+package commands
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+
+	"github.com/dotmesh-oss/dotmesh/pkg/client"
+	"github.com/dotmesh-oss/dotmesh/pkg/types"
+	"github.com/howeyc/gopass"
+	"github.com/spf13/cobra"
+)
+
+func NewCmdSubscription(out io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "subscription",
+		Short: "List subscriptions to commits on other clusters",
+		Long: `List the branches the current remote pulls automatically from other
+clusters whenever they announce a new commit, and what happened last.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			runHandlingError(func() error {
+				if len(args) > 0 {
+					return fmt.Errorf("Too many arguments specified.")
+				}
+				dm, err := client.NewDotmeshAPI(configPath, verboseOutput)
+				if err != nil {
+					return err
+				}
+				infos, err := dm.ListCommitSubscriptions()
+				if err != nil {
+					return err
+				}
+				if structuredOutput() {
+					return printStructured(out, infos)
+				}
+
+				var w io.Writer
+				if scriptingMode {
+					w = out
+				} else {
+					w = tabwriter.NewWriter(out, 3, 8, 2, ' ', 0)
+					fmt.Fprintf(w, "ID\tLOCAL\tREMOTE\tCONNECTED\tLAST COMMIT\tLAST TRANSFER\tERROR\n")
+				}
+				for _, info := range infos {
+					sub := info.Subscription
+					status := info.Status
+					if status == nil {
+						status = &types.CommitSubscriptionStatus{}
+					}
+					fmt.Fprintf(w, "%s\t%s/%s@%s\t%s:%s/%s@%s\t%t\t%s\t%s\t%s\n",
+						sub.Id,
+						sub.LocalNamespace, sub.LocalName, branchOrMaster(sub.LocalBranchName),
+						sub.Peer, sub.RemoteNamespace, sub.RemoteName, branchOrMaster(sub.RemoteBranchName),
+						status.Connected, status.LastCommitId, status.LastTransferId, status.LastError,
+					)
+				}
+				if tw, ok := w.(*tabwriter.Writer); ok {
+					return tw.Flush()
+				}
+				return nil
+			})
+		},
+	}
+	cmd.Flags().BoolVarP(
+		&scriptingMode, "scripting", "H", false,
+		"scripting mode. Do not print headers, separate fields by "+
+			"a single tab instead of arbitrary whitespace.",
+	)
+	cmd.AddCommand(NewCmdSubscriptionAdd(out))
+	cmd.AddCommand(NewCmdSubscriptionRm(out))
+	return cmd
+}
+
+// subscriptionResult is what adding or removing a subscription prints with
+// --output
+type subscriptionResult struct {
+	Id string
+}
+
+func branchOrMaster(branch string) string {
+	if branch == "" {
+		return "master"
+	}
+	return branch
+}
+
+func NewCmdSubscriptionAdd(out io.Writer) *cobra.Command {
+	var localBranch, remoteBranch, natsURL, natsUser, subject string
+	cmd := &cobra.Command{
+		Use:   "add <remote> <local-dot> [<remote-dot>] --nats-url <url>",
+		Short: "Pull from a remote every time it announces a new commit",
+		Long: `Make the current remote pull a branch from <remote> whenever <remote>
+publishes a commit notification for it on NATS (see NATS_URL and
+NATS_SUBJECT_PREFIX on the remote cluster).
+
+<remote-dot> defaults to <local-dot> in your namespace on <remote>. If
+NATS_PASSWORD is set in the environment it is used for --nats-user,
+otherwise you are prompted for it.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			runHandlingError(func() error {
+				if len(args) < 2 || len(args) > 3 {
+					return fmt.Errorf("Please specify <remote> <local-dot> [<remote-dot>]")
+				}
+				if natsURL == "" {
+					return fmt.Errorf("Please specify --nats-url")
+				}
+				dm, err := client.NewDotmeshAPI(configPath, verboseOutput)
+				if err != nil {
+					return err
+				}
+
+				peer := args[0]
+				remote, err := dm.Configuration.GetRemote(peer)
+				if err != nil {
+					return err
+				}
+
+				localNamespace, localName, err := client.ParseNamespacedVolume(args[1])
+				if err != nil {
+					return err
+				}
+				remoteDot := localName
+				if len(args) == 3 {
+					remoteDot = args[2]
+				}
+				remoteNamespace, remoteName, err := client.ParseNamespacedVolumeWithDefault(remoteDot, remote.DefaultNamespace())
+				if err != nil {
+					return err
+				}
+				if remoteBranch == "" {
+					remoteBranch = localBranch
+				}
+
+				var natsPassword string
+				if natsUser != "" {
+					natsPassword = os.Getenv("NATS_PASSWORD")
+					if natsPassword == "" {
+						fmt.Printf("NATS password: ")
+						entered, err := gopass.GetPasswd()
+						fmt.Printf("\n")
+						if err != nil {
+							return err
+						}
+						natsPassword = string(entered)
+					}
+				}
+
+				id, err := dm.SubscribeToCommits(peer, types.CommitSubscription{
+					NatsURL:          natsURL,
+					NatsUsername:     natsUser,
+					NatsPassword:     natsPassword,
+					Subject:          subject,
+					RemoteNamespace:  remoteNamespace,
+					RemoteName:       remoteName,
+					RemoteBranchName: remoteBranch,
+					LocalNamespace:   localNamespace,
+					LocalName:        localName,
+					LocalBranchName:  localBranch,
+				})
+				if err != nil {
+					return err
+				}
+				if structuredOutput() {
+					return printStructured(out, subscriptionResult{Id: id})
+				}
+				fmt.Fprintln(out, id)
+				return nil
+			})
+		},
+	}
+	cmd.Flags().StringVar(&natsURL, "nats-url", "",
+		"NATS server the remote publishes commit notifications to")
+	cmd.Flags().StringVar(&natsUser, "nats-user", "",
+		"user to connect to the NATS server as")
+	cmd.Flags().StringVar(&subject, "subject", "",
+		"NATS subject the remote publishes on, if it has a NATS_SUBJECT_PREFIX "+
+			"(default "+types.NATSPublishCommitsSubject+")")
+	cmd.Flags().StringVarP(&localBranch, "branch", "b", "",
+		"local branch to pull into (default master)")
+	cmd.Flags().StringVar(&remoteBranch, "remote-branch", "",
+		"remote branch to follow (default same as --branch)")
+	return cmd
+}
+
+func NewCmdSubscriptionRm(out io.Writer) *cobra.Command {
+	return &cobra.Command{
+		Use:   "rm <id>",
+		Short: "Stop pulling automatically for a subscription",
+		Run: func(cmd *cobra.Command, args []string) {
+			runHandlingError(func() error {
+				if len(args) != 1 {
+					return fmt.Errorf("Please specify the subscription id")
+				}
+				dm, err := client.NewDotmeshAPI(configPath, verboseOutput)
+				if err != nil {
+					return err
+				}
+				err = dm.UnsubscribeFromCommits(args[0])
+				if err != nil {
+					return err
+				}
+				if structuredOutput() {
+					return printStructured(out, subscriptionResult{Id: args[0]})
+				}
+				return nil
+			})
+		},
+	}
+}
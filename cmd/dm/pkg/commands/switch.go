@@ -3,7 +3,6 @@ package commands
 import (
 	"fmt"
 	"io"
-	"os"
 
 	"github.com/dotmesh-oss/dotmesh/pkg/client"
 	"github.com/spf13/cobra"
@@ -38,11 +37,17 @@ func NewCmdSwitch(out io.Writer) *cobra.Command {
 				if err != nil {
 					return fmt.Errorf("Error: %v", err)
 				}
+				if structuredOutput() {
+					b, err := dm.CurrentBranch(volumeName)
+					if err != nil {
+						return err
+					}
+					return printStructured(out, dotResult{Dot: volumeName, Branch: b})
+				}
 				return nil
 			}()
 			if err != nil {
-				fmt.Fprintln(os.Stderr, err.Error())
-				os.Exit(1)
+				exitWithError(err, exitFailure)
 			}
 		},
 	}
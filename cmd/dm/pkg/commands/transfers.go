@@ -0,0 +1,136 @@
+package commands
+
+import (
+	"fmt"
+	"io"
+	"text/tabwriter"
+
+	"github.com/dotmesh-oss/dotmesh/pkg/client"
+	"github.com/dotmesh-oss/dotmesh/pkg/types"
+	"github.com/spf13/cobra"
+)
+
+func NewCmdTransfers(out io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "transfers",
+		Short: "List and control pushes and pulls in progress",
+		Long: `List the pushes and pulls (to and from other clusters and S3) that the
+current remote is running, and cancel, pause or resume them.`,
+	}
+	cmd.AddCommand(NewCmdTransfersLs(out))
+	cmd.AddCommand(newCmdTransferControl(out, "cancel", "Stop a transfer",
+		`Stop a transfer in progress. Commits already transferred are kept, and the
+dot is left as it was before the transfer started, except that an S3 pull
+leaves the files it downloaded as uncommitted changes ('dm reset' discards
+them).`,
+		func(dm *client.DotmeshAPI, id string) error { return dm.CancelTransfer(id) },
+	))
+	cmd.AddCommand(newCmdTransferControl(out, "pause", "Pause a transfer",
+		`Stop a transfer in progress from sending or receiving any more data until
+it's resumed with 'dm transfers resume'. Its connections are kept open, so
+don't leave it paused for longer than the network between the clusters will
+keep an idle connection.`,
+		func(dm *client.DotmeshAPI, id string) error { return dm.PauseTransfer(id) },
+	))
+	cmd.AddCommand(newCmdTransferControl(out, "resume", "Resume a paused transfer",
+		"Carry on with a transfer paused with 'dm transfers pause'.",
+		func(dm *client.DotmeshAPI, id string) error { return dm.ResumeTransfer(id) },
+	))
+	return cmd
+}
+
+func NewCmdTransfersLs(out io.Writer) *cobra.Command {
+	var all bool
+	cmd := &cobra.Command{
+		Use:   "ls [--all]",
+		Short: "List transfers in progress",
+		Long: `List the transfers in progress on the current remote, or with --all, the
+finished, failed and cancelled ones it remembers too. Transfers waiting for
+their turn to start, because the cluster is running as many as it's allowed
+to at once, are shown as queued, with how many are ahead of them.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			runHandlingError(func() error {
+				if len(args) > 0 {
+					return fmt.Errorf("Too many arguments specified.")
+				}
+				dm, err := client.NewDotmeshAPI(configPath, verboseOutput)
+				if err != nil {
+					return err
+				}
+				transfers, err := dm.ListTransfers(all)
+				if err != nil {
+					return err
+				}
+				if structuredOutput() {
+					return printStructured(out, transfers)
+				}
+
+				var w io.Writer
+				if scriptingMode {
+					w = out
+				} else {
+					w = tabwriter.NewWriter(out, 3, 8, 2, ' ', 0)
+					fmt.Fprintf(w, "ID\tDIRECTION\tDOT\tREMOTE\tSTATUS\tSTEP\tPROGRESS\n")
+				}
+				for _, t := range transfers {
+					fmt.Fprintf(w, "%s\t%s\t%s/%s@%s\t%s\t%s\t%d/%d\t%s\n",
+						t.TransferRequestId, t.Direction,
+						t.LocalNamespace, t.LocalName, branchOrMaster(t.LocalBranchName),
+						transferRemote(t), client.TransferStatus(t), t.Index, t.Total, transferProgress(t),
+					)
+				}
+				if tw, ok := w.(*tabwriter.Writer); ok {
+					return tw.Flush()
+				}
+				return nil
+			})
+		},
+	}
+	cmd.Flags().BoolVarP(&all, "all", "a", false, "Include finished, failed and cancelled transfers")
+	cmd.Flags().BoolVarP(
+		&scriptingMode, "scripting", "H", false,
+		"scripting mode. Do not print headers, separate fields by "+
+			"a single tab instead of arbitrary whitespace.",
+	)
+	return cmd
+}
+
+// transferRemote describes the other end of a transfer: a dot on another
+// cluster, or an S3 bucket
+func transferRemote(t types.TransferPollResult) string {
+	if t.Peer == "" {
+		return "s3:" + t.RemoteName
+	}
+	return fmt.Sprintf("%s:%s/%s@%s", t.Peer, t.RemoteNamespace, t.RemoteName, branchOrMaster(t.RemoteBranchName))
+}
+
+func transferProgress(t types.TransferPollResult) string {
+	if t.Size == 0 {
+		return prettyPrintSize(t.Sent)
+	}
+	return fmt.Sprintf(
+		"%s of %s (%d%%)", prettyPrintSize(t.Sent), prettyPrintSize(t.Size), t.Sent*100/t.Size,
+	)
+}
+
+func newCmdTransferControl(
+	out io.Writer, action, short, long string, control func(*client.DotmeshAPI, string) error,
+) *cobra.Command {
+	return &cobra.Command{
+		Use:   action + " <transfer-id>",
+		Short: short,
+		Long:  long,
+		Run: func(cmd *cobra.Command, args []string) {
+			runHandlingError(func() error {
+				if len(args) != 1 {
+					return fmt.Errorf("Please specify the id of the transfer, from 'dm transfers ls'")
+				}
+				dm, err := client.NewDotmeshAPI(configPath, verboseOutput)
+				if err != nil {
+					return err
+				}
+				return control(dm, args[0])
+			})
+		},
+	}
+}
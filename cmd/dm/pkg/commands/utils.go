@@ -4,7 +4,6 @@ import (
 	"crypto/rand"
 	"encoding/base32"
 	"fmt"
-	"os"
 
 	"github.com/dotmesh-oss/dotmesh/pkg/client"
 )
@@ -87,7 +86,6 @@ func RandToken(length int) (string, error) {
 
 func runHandlingError(f func() error) {
 	if err := f(); err != nil {
-		fmt.Fprintln(os.Stderr, err.Error())
-		os.Exit(1)
+		exitWithError(err, exitFailure)
 	}
 }
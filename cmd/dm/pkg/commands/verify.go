@@ -0,0 +1,193 @@
+package commands
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/dotmesh-oss/dotmesh/pkg/client"
+	"github.com/dotmesh-oss/dotmesh/pkg/types"
+	"github.com/spf13/cobra"
+)
+
+// verifyResult is what 'dm verify' prints with --output
+type verifyResult struct {
+	Dot    string
+	Branch string
+	types.VerifyResult
+	Remote *remoteVerification `json:",omitempty"`
+}
+
+// remoteVerification is how the copies of a commit on another cluster
+// compare with the digest recorded here
+type remoteVerification struct {
+	Remote string
+	Dot    string
+	Nodes  []types.NodeVerification
+	Error  string `json:",omitempty"`
+}
+
+func NewCmdVerify(out io.Writer) *cobra.Command {
+	var remote string
+	cmd := &cobra.Command{
+		Use:   "verify [<dot>[@<commit>]]",
+		Short: "Check every copy of a commit against the digest it was made with",
+		Long: `Have every node holding a copy of a commit work out a digest of its
+contents again, and compare it with the digest recorded when the commit was
+made. Leave out <dot> to mean the current dot, and <commit> to mean the
+latest commit on the dot's current branch.
+
+With --remote, the copies on another cluster are checked against the digest
+recorded here too.
+
+Each node also reports how the last 'zpool scrub' of its pool went; run one
+to have ZFS check the rest of the pool's data. Exits with an error if any
+copy doesn't match.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			runHandlingError(func() error {
+				if len(args) > 1 {
+					return fmt.Errorf("Please specify at most one dot and commit")
+				}
+				dm, err := client.NewDotmeshAPI(configPath, verboseOutput)
+				if err != nil {
+					return err
+				}
+				dot, commitId := "", ""
+				if len(args) == 1 {
+					parts := strings.SplitN(args[0], "@", 2)
+					dot = parts[0]
+					if len(parts) == 2 {
+						commitId = parts[1]
+					}
+				}
+				if dot == "" {
+					dot, err = dm.StrictCurrentVolume()
+					if err != nil {
+						return err
+					}
+					if dot == "" {
+						return fmt.Errorf(
+							"No current dot. Try 'dm list' and " +
+								"'dm switch' to switch to a dot.",
+						)
+					}
+				}
+				branch, err := dm.CurrentBranch(dot)
+				if err != nil {
+					return err
+				}
+
+				verified, err := dm.Verify(dot, branch, commitId)
+				if err != nil {
+					return err
+				}
+				result := verifyResult{Dot: dot, Branch: branch, VerifyResult: *verified}
+				if remote != "" {
+					remoteResult, err := verifyOnRemote(dm, remote, dot, branch, verified)
+					if err != nil {
+						return err
+					}
+					result.addRemote(remoteResult)
+				}
+
+				if structuredOutput() {
+					err = printStructured(out, result)
+				} else {
+					err = printVerification(out, result)
+				}
+				if err != nil {
+					return err
+				}
+				if result.Mismatches > 0 {
+					return fmt.Errorf("%d copies of commit %s don't match", result.Mismatches, result.SnapshotId)
+				}
+				return nil
+			})
+		},
+	}
+	cmd.Flags().StringVarP(&remote, "remote", "", "", "Also check the copies on this remote")
+	return cmd
+}
+
+// verifyOnRemote has remote check its copies of the commit local verified,
+// against the digest recorded here
+func verifyOnRemote(dm *client.DotmeshAPI, remote, dot, branch string, local *types.VerifyResult) (*remoteVerification, error) {
+	if _, ok := dm.Configuration.GetRemotes()[remote]; !ok {
+		return nil, fmt.Errorf("Remote '%s' is not a dotmesh cluster", remote)
+	}
+	namespace, name, err := client.ParseNamespacedVolume(dot)
+	if err != nil {
+		return nil, err
+	}
+	remoteDot := types.VolumeName{Namespace: namespace, Name: name}
+	if remoteNamespace, remoteName, ok := dm.Configuration.DefaultRemoteVolumeFor(remote, namespace, name); ok {
+		remoteDot = types.VolumeName{Namespace: remoteNamespace, Name: remoteName}
+	}
+
+	result := &remoteVerification{Remote: remote, Dot: remoteDot.String()}
+	rpc, err := dm.Configuration.ClusterFromRemote(remote, verboseOutput)
+	if err != nil {
+		return nil, err
+	}
+	verified, err := client.NewDotmeshAPIFromClient(rpc, verboseOutput).Verify(result.Dot, branch, local.SnapshotId)
+	if err != nil {
+		// most likely the commit hasn't been pushed there
+		result.Error = err.Error()
+		return result, nil
+	}
+	for _, v := range verified.Nodes {
+		v.Match = v.Error == "" && v.Digest == local.Expected
+		result.Nodes = append(result.Nodes, v)
+	}
+	return result, nil
+}
+
+// addRemote counts the copies on another cluster that don't match, or all
+// of them as one if they couldn't be checked, as mismatches too
+func (r *verifyResult) addRemote(remote *remoteVerification) {
+	r.Remote = remote
+	for _, v := range remote.Nodes {
+		if !v.Match {
+			r.Mismatches++
+		}
+	}
+	if remote.Error != "" {
+		r.Mismatches++
+	}
+}
+
+func printVerification(out io.Writer, result verifyResult) error {
+	if result.Recorded {
+		fmt.Fprintf(out, "commit %s: %s\n\n", result.SnapshotId, result.Expected)
+	} else {
+		fmt.Fprintf(out, "commit %s has no recorded digest, comparing with the master's copy\n\n", result.SnapshotId)
+	}
+	w := tabwriter.NewWriter(out, 3, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "NODE\tDIGEST\tMATCH\tSCRUB\n")
+	printNodes := func(prefix string, nodes []types.NodeVerification) {
+		for _, v := range nodes {
+			d := v.Digest
+			if v.Error != "" {
+				d = "error: " + v.Error
+			}
+			match := "yes"
+			if !v.Match {
+				match = "NO"
+			}
+			fmt.Fprintf(w, "%s%s\t%s\t%s\t%s\n", prefix, v.Node, d, match, v.Scrub)
+		}
+	}
+	printNodes("", result.Nodes)
+	if result.Remote != nil {
+		printNodes(result.Remote.Remote+":", result.Remote.Nodes)
+	}
+	err := w.Flush()
+	if err != nil {
+		return err
+	}
+	if result.Remote != nil && result.Remote.Error != "" {
+		fmt.Fprintf(out, "\nCouldn't verify %s on %s: %s\n", result.Remote.Dot, result.Remote.Remote, result.Remote.Error)
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package commands
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/dotmesh-oss/dotmesh/pkg/types"
+)
+
+func testVerifyResult(recorded bool) verifyResult {
+	return verifyResult{
+		Dot:    "admin/data",
+		Branch: "master",
+		VerifyResult: types.VerifyResult{
+			SnapshotId: "c1",
+			Expected:   "sha256:good",
+			Recorded:   recorded,
+			Nodes: []types.NodeVerification{
+				{Node: "node-a", Digest: "sha256:good", Match: true, Scrub: "none requested"},
+				{Node: "node-b", Error: "couldn't mount", Scrub: "unknown"},
+			},
+			Mismatches: 1,
+		},
+	}
+}
+
+func Test_verifyResult_addRemote(t *testing.T) {
+	tests := []struct {
+		name       string
+		remote     *remoteVerification
+		mismatches int
+	}{
+		{
+			name: "remote copies match",
+			remote: &remoteVerification{Remote: "hub", Nodes: []types.NodeVerification{
+				{Node: "hub-a", Digest: "sha256:good", Match: true},
+			}},
+			mismatches: 1,
+		},
+		{
+			name: "a remote copy doesn't match",
+			remote: &remoteVerification{Remote: "hub", Nodes: []types.NodeVerification{
+				{Node: "hub-a", Digest: "sha256:good", Match: true},
+				{Node: "hub-b", Digest: "sha256:bad"},
+			}},
+			mismatches: 2,
+		},
+		{
+			name:       "the remote couldn't check",
+			remote:     &remoteVerification{Remote: "hub", Error: "No commit c1 on that branch"},
+			mismatches: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := testVerifyResult(true)
+			result.addRemote(tt.remote)
+			if result.Mismatches != tt.mismatches {
+				t.Errorf("expected %d mismatches, got %d", tt.mismatches, result.Mismatches)
+			}
+		})
+	}
+}
+
+func Test_printVerification(t *testing.T) {
+	tests := []struct {
+		name     string
+		result   verifyResult
+		expected []string
+	}{
+		{
+			name:   "recorded",
+			result: testVerifyResult(true),
+			expected: []string{
+				"commit c1: sha256:good",
+				"node-a  sha256:good            yes",
+				"node-b  error: couldn't mount  NO",
+			},
+		},
+		{
+			name:     "unrecorded",
+			result:   testVerifyResult(false),
+			expected: []string{"commit c1 has no recorded digest, comparing with the master's copy"},
+		},
+		{
+			name: "remote",
+			result: func() verifyResult {
+				r := testVerifyResult(true)
+				r.addRemote(&remoteVerification{Remote: "hub", Dot: "admin/data", Error: "not found"})
+				return r
+			}(),
+			expected: []string{"Couldn't verify admin/data on hub: not found"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			err := printVerification(&out, tt.result)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, line := range tt.expected {
+				if !strings.Contains(out.String(), line) {
+					t.Errorf("expected %q in:\n%s", line, out.String())
+				}
+			}
+		})
+	}
+}
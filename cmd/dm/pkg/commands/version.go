@@ -5,7 +5,6 @@ import (
 	"github.com/dotmesh-oss/dotmesh/pkg/client"
 	"github.com/spf13/cobra"
 	"io"
-	"os"
 )
 
 var clientVersion string
@@ -24,6 +23,20 @@ func NewCmdVersion(out io.Writer) *cobra.Command {
 		Run: func(cmd *cobra.Command, args []string) {
 			err := func() error {
 				dm, err := client.NewDotmeshAPI(configPath, verboseOutput)
+				if structuredOutput() {
+					if err != nil {
+						return err
+					}
+					serverVersion, err := dm.GetVersion()
+					if err != nil {
+						return err
+					}
+					return printStructured(out, versionResult{
+						Remote: dm.Configuration.CurrentRemote,
+						Client: clientVersion,
+						Server: serverVersion,
+					})
+				}
 				if !scriptingMode {
 					fmt.Fprintf(
 						out,
@@ -47,10 +60,16 @@ func NewCmdVersion(out io.Writer) *cobra.Command {
 				return err
 			}()
 			if err != nil {
-				fmt.Fprintln(os.Stderr, err.Error())
-				os.Exit(1)
+				exitWithError(err, exitFailure)
 			}
 		},
 	}
 	return cmd
 }
+
+// versionResult is what 'dm version' prints with --output
+type versionResult struct {
+	Remote string
+	Client string
+	Server client.VersionInfo
+}
@@ -0,0 +1,147 @@
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/dotmesh-oss/dotmesh/pkg/client"
+	"github.com/dotmesh-oss/dotmesh/pkg/types"
+	"github.com/spf13/cobra"
+)
+
+func NewCmdWatch(out io.Writer) *cobra.Command {
+	var branch string
+	var all bool
+	cmd := &cobra.Command{
+		Use:   "watch [<dot>]",
+		Short: "Stream activity on a dot, or on every dot you can see with --all",
+		Long: `Print state transitions, new commits, transfer progress and changes in
+uncommitted data as they happen, until interrupted.
+
+With no arguments, watches the current dot. With --all, watches every dot
+on the current remote that you have access to.
+
+In scripting mode (-H) or with --output json, each event is printed as a
+line of JSON. With --output yaml, each is a YAML document.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			err := func() error {
+				dm, err := client.NewDotmeshAPI(configPath, verboseOutput)
+				if err != nil {
+					return err
+				}
+
+				var namespace, name string
+				if !all {
+					if len(args) > 1 {
+						return fmt.Errorf("Please specify at most one dot.")
+					}
+					var dot string
+					if len(args) == 1 {
+						dot = args[0]
+					} else {
+						dot, err = dm.StrictCurrentVolume()
+						if err != nil {
+							return err
+						}
+						if dot == "" {
+							return fmt.Errorf(
+								"No current dot. Try 'dm list' and " +
+									"'dm switch' to switch to a dot, or use --all.",
+							)
+						}
+					}
+					namespace, name, err = client.ParseNamespacedVolume(dot)
+					if err != nil {
+						return err
+					}
+				} else if len(args) > 0 {
+					return fmt.Errorf("Can't specify a dot along with --all.")
+				}
+
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+				signals := make(chan os.Signal, 1)
+				signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+				go func() {
+					<-signals
+					cancel()
+				}()
+
+				return dm.WatchActivity(ctx, namespace, name, branch, func(e *types.ActivityEvent) error {
+					return printActivity(out, e)
+				})
+			}()
+			if err != nil {
+				exitWithError(err, exitFailure)
+			}
+		},
+	}
+	cmd.Flags().StringVarP(&branch, "branch", "b", "",
+		"only show activity on this branch")
+	cmd.Flags().BoolVarP(&all, "all", "a", false,
+		"watch every dot you have access to")
+	cmd.Flags().BoolVarP(
+		&scriptingMode, "scripting", "H", false,
+		"scripting mode. Print each event as a line of JSON.",
+	)
+	return cmd
+}
+
+func printActivity(out io.Writer, e *types.ActivityEvent) error {
+	if structuredOutput() {
+		return printStreamed(out, e)
+	}
+	if scriptingMode {
+		encoded, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(out, string(encoded))
+		return nil
+	}
+
+	when := time.Unix(0, e.Timestamp).Format("15:04:05")
+	dot := e.Name
+	if e.Namespace != "" && e.Namespace != "admin" {
+		dot = e.Namespace + "/" + e.Name
+	}
+	where := fmt.Sprintf("%s@%s", dot, e.Branch)
+
+	var detail string
+	switch e.Type {
+	case types.ActivityTransition:
+		detail = fmt.Sprintf("%s on %s", e.State, e.Server)
+		if e.Status != "" {
+			detail += ": " + e.Status
+		}
+	case types.ActivityCommit:
+		detail = e.CommitId
+		if message := e.Metadata["message"]; message != "" {
+			detail += " " + strings.SplitN(message, "\n", 2)[0]
+		}
+	case types.ActivityTransfer:
+		t := e.Transfer
+		if t == nil {
+			break
+		}
+		detail = fmt.Sprintf("%s %s %d/%d %s/%s",
+			t.Direction, t.Status, t.Index, t.Total,
+			prettyPrintSize(t.Sent), prettyPrintSize(t.Size))
+		if t.Message != "" {
+			detail += " " + t.Message
+		}
+	case types.ActivityDirty:
+		detail = fmt.Sprintf("%s dirty of %s",
+			prettyPrintSize(e.DirtyBytes), prettyPrintSize(e.SizeBytes))
+	}
+
+	fmt.Fprintf(out, "%s %-10s %s %s\n", when, e.Type, where, detail)
+	return nil
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"net/http"
+	"strings"
 
 	"github.com/dotmesh-oss/dotmesh/pkg/auth"
 	"github.com/dotmesh-oss/dotmesh/pkg/user"
@@ -27,8 +28,13 @@ type AuthHandler struct {
 func (a *AuthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	username, password, ok := r.BasicAuth()
 	if !ok {
-		http.Error(w, "Unauthorized.", http.StatusUnauthorized)
-		return
+		// an ID token from an identity provider says who it's for
+		header := r.Header.Get("Authorization")
+		if !strings.HasPrefix(header, "Bearer ") {
+			http.Error(w, "Unauthorized.", http.StatusUnauthorized)
+			return
+		}
+		password = strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
 	}
 
 	u, authenticationType, err := a.userManager.Authenticate(username, password)
@@ -0,0 +1,541 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	uuid "github.com/nu7hatch/gouuid"
+
+	"github.com/dotmesh-oss/dotmesh/pkg/config"
+	"github.com/dotmesh-oss/dotmesh/pkg/store"
+	"github.com/dotmesh-oss/dotmesh/pkg/types"
+	"github.com/dotmesh-oss/dotmesh/pkg/user"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// backupStore keeps scheduled backups of the KV store
+type backupStore interface {
+	Put(name string, data []byte) error
+	Get(name string) ([]byte, error)
+	// List returns the backups kept, oldest first
+	List() ([]types.BackupInfo, error)
+	Delete(name string) error
+}
+
+const backupNamePrefix = "dotmesh-backup-"
+const backupTimeFormat = "20060102T150405Z"
+
+// backupName names a backup made by nodeId at created, so that each node's
+// backups can be told apart and listed in order
+func backupName(created time.Time, nodeId string) string {
+	return backupNamePrefix + created.UTC().Format(backupTimeFormat) + "-" + nodeId + ".json"
+}
+
+// parseBackupName is the inverse of backupName, ok is false for anything
+// that isn't a backup
+func parseBackupName(name string) (created time.Time, nodeId string, ok bool) {
+	if !strings.HasPrefix(name, backupNamePrefix) || !strings.HasSuffix(name, ".json") {
+		return time.Time{}, "", false
+	}
+	rest := strings.TrimSuffix(strings.TrimPrefix(name, backupNamePrefix), ".json")
+	shrapnel := strings.SplitN(rest, "-", 2)
+	if len(shrapnel) != 2 || shrapnel[1] == "" {
+		return time.Time{}, "", false
+	}
+	created, err := time.Parse(backupTimeFormat, shrapnel[0])
+	if err != nil {
+		return time.Time{}, "", false
+	}
+	return created, shrapnel[1], true
+}
+
+func sortBackups(backups []types.BackupInfo) {
+	sort.Slice(backups, func(i, j int) bool {
+		if backups[i].Created.Equal(backups[j].Created) {
+			return backups[i].Name < backups[j].Name
+		}
+		return backups[i].Created.Before(backups[j].Created)
+	})
+}
+
+// newBackupStore returns where the config says to keep backups, or nil if
+// it doesn't say
+func newBackupStore(cfg config.Config) (backupStore, error) {
+	switch {
+	case cfg.Backups.Dir != "":
+		err := os.MkdirAll(cfg.Backups.Dir, 0700)
+		if err != nil {
+			return nil, err
+		}
+		return &dirBackupStore{dir: cfg.Backups.Dir}, nil
+	case cfg.Backups.S3Bucket != "":
+		awsConfig := &aws.Config{
+			Credentials: credentials.NewStaticCredentials(cfg.Backups.S3KeyID, cfg.Backups.S3SecretKey, ""),
+			MaxRetries:  aws.Int(5),
+		}
+		if cfg.Backups.S3Endpoint != "" {
+			awsConfig.Endpoint = &cfg.Backups.S3Endpoint
+		}
+		sess, err := session.NewSession(awsConfig)
+		if err != nil {
+			return nil, err
+		}
+		return &s3BackupStore{
+			sess:   sess,
+			bucket: cfg.Backups.S3Bucket,
+			prefix: cfg.Backups.S3Prefix,
+		}, nil
+	}
+	return nil, nil
+}
+
+// dirBackupStore keeps backups as files in a directory
+type dirBackupStore struct {
+	dir string
+}
+
+func (d *dirBackupStore) Put(name string, data []byte) error {
+	path := filepath.Join(d.dir, name)
+	err := ioutil.WriteFile(path+".tmp", data, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+func (d *dirBackupStore) Get(name string) ([]byte, error) {
+	if _, _, ok := parseBackupName(name); !ok {
+		return nil, fmt.Errorf("%s isn't a backup", name)
+	}
+	return ioutil.ReadFile(filepath.Join(d.dir, name))
+}
+
+func (d *dirBackupStore) List() ([]types.BackupInfo, error) {
+	files, err := ioutil.ReadDir(d.dir)
+	if err != nil {
+		return nil, err
+	}
+	backups := []types.BackupInfo{}
+	for _, f := range files {
+		created, _, ok := parseBackupName(f.Name())
+		if ok && f.Mode().IsRegular() {
+			backups = append(backups, types.BackupInfo{Name: f.Name(), Created: created, Size: f.Size()})
+		}
+	}
+	sortBackups(backups)
+	return backups, nil
+}
+
+func (d *dirBackupStore) Delete(name string) error {
+	return os.Remove(filepath.Join(d.dir, name))
+}
+
+// s3BackupStore keeps backups as objects in an S3 bucket, under prefix. The
+// bucket's region is looked up on first use rather than at startup, so that
+// S3 being unreachable then doesn't stop the server from starting.
+type s3BackupStore struct {
+	sess   *session.Session
+	bucket string
+	prefix string
+
+	lock sync.Mutex
+	svc  *s3.S3
+}
+
+// client returns a client for the bucket's region, looking it up if that
+// hasn't been done yet
+func (b *s3BackupStore) client() (*s3.S3, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.svc != nil {
+		return b.svc, nil
+	}
+	region, err := s3manager.GetBucketRegion(context.Background(), b.sess, b.bucket, "us-west-1")
+	if err != nil {
+		return nil, fmt.Errorf("Could not get region of backup bucket %s: %s", b.bucket, err)
+	}
+	b.svc = s3.New(b.sess, aws.NewConfig().WithRegion(region))
+	return b.svc, nil
+}
+
+func (b *s3BackupStore) Put(name string, data []byte) error {
+	svc, err := b.client()
+	if err != nil {
+		return err
+	}
+	_, err = svc.PutObject(&s3.PutObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(b.prefix + name),
+		Body:   bytes.NewReader(data),
+	})
+	return err
+}
+
+func (b *s3BackupStore) Get(name string) ([]byte, error) {
+	if _, _, ok := parseBackupName(name); !ok {
+		return nil, fmt.Errorf("%s isn't a backup", name)
+	}
+	svc, err := b.client()
+	if err != nil {
+		return nil, err
+	}
+	output, err := svc.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(b.prefix + name),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer output.Body.Close()
+	return ioutil.ReadAll(output.Body)
+}
+
+func (b *s3BackupStore) List() ([]types.BackupInfo, error) {
+	svc, err := b.client()
+	if err != nil {
+		return nil, err
+	}
+	backups := []types.BackupInfo{}
+	err = svc.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(b.bucket),
+		Prefix: aws.String(b.prefix + backupNamePrefix),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, object := range page.Contents {
+			name := strings.TrimPrefix(*object.Key, b.prefix)
+			created, _, ok := parseBackupName(name)
+			if ok {
+				backups = append(backups, types.BackupInfo{Name: name, Created: created, Size: *object.Size})
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	sortBackups(backups)
+	return backups, nil
+}
+
+func (b *s3BackupStore) Delete(name string) error {
+	svc, err := b.client()
+	if err != nil {
+		return err
+	}
+	_, err = svc.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(b.prefix + name),
+	})
+	return err
+}
+
+// dumpKV makes a backup of the users, organizations and registry in the KV
+// store. If partial is set, whatever can't be listed is logged and left out
+// rather than failing the whole dump.
+func (s *InMemoryState) dumpKV(partial bool) (*types.BackupV1, error) {
+	backup := &types.BackupV1{
+		Version:       types.BackupVersion,
+		ServerVersion: serverVersion,
+		Created:       time.Now(),
+	}
+	failed := func(what string, err error) error {
+		if err == nil {
+			return nil
+		}
+		if !partial {
+			return fmt.Errorf("failed to list %s: %s", what, err)
+		}
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Errorf("failed to list %s", what)
+		return nil
+	}
+	var err error
+
+	backup.Users, err = s.storedUsers()
+	if err = failed("users", err); err != nil {
+		return nil, err
+	}
+	backup.FilesystemMasters, err = s.filesystemStore.ListMaster()
+	if err = failed("filesystem masters", err); err != nil {
+		return nil, err
+	}
+	backup.RegistryFilesystems, err = s.registryStore.ListFilesystems()
+	if err = failed("registry filesystems", err); err != nil {
+		return nil, err
+	}
+	backup.RegistryClones, err = s.registryStore.ListClones()
+	if err = failed("registry clones", err); err != nil {
+		return nil, err
+	}
+	if om, ok := s.userManager.(user.OrganizationManager); ok {
+		backup.Organizations, err = om.ListOrganizations(&user.User{Id: user.ADMIN_USER_UUID})
+		if err = failed("organizations", err); err != nil {
+			return nil, err
+		}
+	}
+
+	backup.Checksum, err = backup.ComputeChecksum()
+	if err != nil {
+		return nil, err
+	}
+	return backup, nil
+}
+
+// storedUsers lists users as the user manager stores them, so that backups
+// don't hold the admin user's API key in the clear. An external user manager
+// keeps its users' secrets itself.
+func (s *InMemoryState) storedUsers() ([]*types.User, error) {
+	if stored, ok := s.userManager.(interface {
+		ListStored() ([]*types.User, error)
+	}); ok {
+		return stored.ListStored()
+	}
+	return s.userManager.List("")
+}
+
+// backupKV is run every Backups.IntervalSeconds to keep a backup of the KV
+// store, deleting this node's oldest beyond Backups.Retain
+func (s *InMemoryState) backupKV() error {
+	backup, err := s.dumpKV(false)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(backup)
+	if err != nil {
+		return err
+	}
+	name := backupName(backup.Created, s.NodeID())
+	err = s.backups.Put(name, data)
+	if err != nil {
+		return fmt.Errorf("failed to write backup %s: %s", name, err)
+	}
+	log.WithFields(log.Fields{
+		"backup": name,
+		"size":   len(data),
+	}).Info("[backupKV] backed up the KV store")
+
+	backups, err := s.backups.List()
+	if err != nil {
+		return err
+	}
+	ours := []types.BackupInfo{}
+	for _, b := range backups {
+		_, nodeId, _ := parseBackupName(b.Name)
+		if nodeId == s.NodeID() {
+			ours = append(ours, b)
+		}
+	}
+	for len(ours) > s.serverConfig.Backups.Retain.Value() {
+		err = s.backups.Delete(ours[0].Name)
+		if err != nil {
+			return fmt.Errorf("failed to delete old backup %s: %s", ours[0].Name, err)
+		}
+		ours = ours[1:]
+	}
+	return nil
+}
+
+// findBackup picks the kept backup called name, or if name is "" the latest
+// made at or before at
+func findBackup(backups []types.BackupInfo, name string, at time.Time) (string, error) {
+	if name != "" {
+		for _, b := range backups {
+			if b.Name == name {
+				return name, nil
+			}
+		}
+		return "", fmt.Errorf("no backup called %s", name)
+	}
+	found := ""
+	for _, b := range backups {
+		if !b.Created.After(at) {
+			found = b.Name
+		}
+	}
+	if found == "" {
+		return "", fmt.Errorf("no backups made at or before %s", at.Format(time.RFC3339))
+	}
+	return found, nil
+}
+
+// parseBackup decodes a backup, checking it's one we can restore
+func parseBackup(data []byte) (*types.BackupV1, error) {
+	var backup types.BackupV1
+
+	err := json.Unmarshal(data, &backup)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal into a backup structure: %s", err)
+	}
+
+	supported := false
+	for _, v := range types.BackupSupportedVersions {
+		if backup.Version == v {
+			supported = true
+		}
+	}
+	if !supported {
+		return nil, fmt.Errorf("unsupported backup version '%s', supported version: %s", backup.Version, strings.Join(types.BackupSupportedVersions, ", "))
+	}
+
+	err = backup.VerifyChecksum()
+	if err != nil {
+		return nil, err
+	}
+	return &backup, nil
+}
+
+// restoreBackup replaces the users, organizations and registry in the KV
+// store with a backup's, resetting every node's registry first
+func (s *InMemoryState) restoreBackup(backup *types.BackupV1) error {
+	// resetting registry in the cluster
+
+	eventID, _ := uuid.NewV4()
+	resetEvent := types.NewEvent(types.EventNameResetRegistry)
+	resetEvent.ID = eventID.String()
+
+	clusterResetComplete := make(chan struct{})
+	counter := 0
+
+	// servers
+	servers, err := s.serverStore.ListAddresses()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Error("[restoreBackup] failed to list server addresses")
+	}
+	if len(servers) == 1 {
+		// only us, don't bother with cluster reset
+		s.resetRegistry()
+	} else {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		ch, err := s.messenger.Subscribe(ctx, &types.SubscribeQuery{
+			Type:      types.EventTypeClusterResponse,
+			RequestID: resetEvent.ID,
+		})
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+			}).Error("[restoreBackup] failed to subscribe to cluster events")
+		} else {
+			go func() {
+				defer close(clusterResetComplete)
+
+				// creating new ctx to wait for the acks
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+				for {
+					select {
+					case <-ctx.Done():
+						// timeout
+						log.WithFields(log.Fields{
+							"servers":  len(servers),
+							"received": counter,
+						}).Info("[restoreBackup] some registry reset acks were missed, continuing with restore...")
+						return
+					case event, ok := <-ch:
+						if !ok {
+							log.WithFields(log.Fields{
+								"servers":  len(servers),
+								"received": counter,
+							}).Info("[restoreBackup] registry reset ack listener closed")
+							return
+						}
+						if event.ID == resetEvent.ID && event.Name == types.EventNameResetRegistryComplete {
+							counter++
+						}
+						if counter >= len(servers) {
+
+							log.WithFields(log.Fields{
+								"servers": len(servers),
+							}).Info("[restoreBackup] all registry reset acks received")
+							return
+						}
+					}
+				}
+			}()
+		}
+
+		err = s.messenger.Publish(resetEvent)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+			}).Error("[restoreBackup] failed to dispatch reset registry event")
+		} else {
+			log.Info("[restoreBackup] cluster registry reset event dispatched, waiting for responses...")
+			<-clusterResetComplete
+		}
+	}
+
+	// importing objects
+
+	var errs []error
+
+	for _, u := range backup.Users {
+		err = s.userManager.Import(u)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+				"user":  u.Name,
+			}).Error("failed to import user")
+			errs = append(errs, err)
+		}
+	}
+
+	if om, ok := s.userManager.(user.OrganizationManager); ok {
+		for _, org := range backup.Organizations {
+			err = om.ImportOrganization(org)
+			if err != nil {
+				log.WithFields(log.Fields{
+					"error":        err,
+					"organization": org.Name,
+				}).Error("failed to import organization")
+				errs = append(errs, err)
+			}
+		}
+	} else if len(backup.Organizations) > 0 {
+		errs = append(errs, fmt.Errorf("this cluster's user manager doesn't keep organizations, %d weren't restored", len(backup.Organizations)))
+	}
+
+	err = s.filesystemStore.ImportMasters(backup.FilesystemMasters, &store.ImportOptions{
+		DeleteExisting: true,
+	})
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	err = s.registryStore.ImportFilesystems(backup.RegistryFilesystems, &store.ImportOptions{
+		DeleteExisting: true,
+	})
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	err = s.registryStore.ImportClones(backup.RegistryClones, &store.ImportOptions{
+		DeleteExisting: true,
+	})
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("got error while importing backup: %v", errs)
+	}
+
+	return nil
+}
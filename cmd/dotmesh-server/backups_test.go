@@ -0,0 +1,246 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/dotmesh-oss/dotmesh/pkg/idp"
+	"github.com/dotmesh-oss/dotmesh/pkg/idp/idptest"
+	"github.com/dotmesh-oss/dotmesh/pkg/registry"
+	"github.com/dotmesh-oss/dotmesh/pkg/store"
+	"github.com/dotmesh-oss/dotmesh/pkg/types"
+	"github.com/dotmesh-oss/dotmesh/pkg/user"
+)
+
+func Test_parseBackupName(t *testing.T) {
+	created := time.Date(2020, 3, 4, 5, 6, 7, 0, time.UTC)
+	name := backupName(created, "node-1")
+	if name != "dotmesh-backup-20200304T050607Z-node-1.json" {
+		t.Errorf("unexpected backup name %s", name)
+	}
+
+	gotCreated, gotNode, ok := parseBackupName(name)
+	if !ok || !gotCreated.Equal(created) || gotNode != "node-1" {
+		t.Errorf("parseBackupName(%s) = %s, %s, %v", name, gotCreated, gotNode, ok)
+	}
+
+	for _, notBackup := range []string{
+		"dotmesh-backup-20200304T050607Z-node-1.json.tmp",
+		"dotmesh-backup-20200304T050607Z.json",
+		"dotmesh-backup-yesterday-node-1.json",
+		"something-else.json",
+	} {
+		if _, _, ok := parseBackupName(notBackup); ok {
+			t.Errorf("%s shouldn't be a backup", notBackup)
+		}
+	}
+}
+
+func Test_findBackup(t *testing.T) {
+	t0 := time.Date(2020, 3, 4, 5, 0, 0, 0, time.UTC)
+	backups := []types.BackupInfo{
+		{Name: backupName(t0, "a"), Created: t0},
+		{Name: backupName(t0.Add(time.Hour), "b"), Created: t0.Add(time.Hour)},
+		{Name: backupName(t0.Add(2*time.Hour), "a"), Created: t0.Add(2 * time.Hour)},
+	}
+
+	tests := []struct {
+		name    string
+		byName  string
+		at      time.Time
+		want    string
+		wantErr bool
+	}{
+		{name: "by name", byName: backups[0].Name, at: t0.Add(3 * time.Hour), want: backups[0].Name},
+		{name: "unknown name", byName: "dotmesh-backup-nope", wantErr: true},
+		{name: "exactly at", at: t0.Add(time.Hour), want: backups[1].Name},
+		{name: "between", at: t0.Add(90 * time.Minute), want: backups[1].Name},
+		{name: "after all", at: t0.Add(3 * time.Hour), want: backups[2].Name},
+		{name: "before all", at: t0.Add(-time.Minute), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := findBackup(backups, tt.byName, tt.at)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("findBackup() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("findBackup() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_dirBackupStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dotmesh-backups")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := &dirBackupStore{dir: dir}
+	t0 := time.Date(2020, 3, 4, 5, 0, 0, 0, time.UTC)
+	later := backupName(t0.Add(time.Hour), "a")
+	earlier := backupName(t0, "a")
+	for _, name := range []string{later, earlier} {
+		err = store.Put(name, []byte(name))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = ioutil.WriteFile(dir+"/unrelated", []byte("hello"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backups, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 2 || backups[0].Name != earlier || backups[1].Name != later {
+		t.Fatalf("unexpected backups %+v", backups)
+	}
+	if backups[0].Size != int64(len(earlier)) {
+		t.Errorf("unexpected size %d", backups[0].Size)
+	}
+
+	data, err := store.Get(later)
+	if err != nil || string(data) != later {
+		t.Errorf("Get(%s) = %s, %v", later, data, err)
+	}
+	if _, err = store.Get("unrelated"); err == nil {
+		t.Errorf("Get should only read backups")
+	}
+
+	err = store.Delete(earlier)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backups, err = store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 1 || backups[0].Name != later {
+		t.Errorf("unexpected backups after delete %+v", backups)
+	}
+}
+
+// newBackupTestState is a node on its own, keeping everything in a fresh KV
+// store, so that it can be backed up and restored into
+func newBackupTestState(t *testing.T) (*InMemoryState, *user.InternalManager) {
+	client, err := store.NewKVDBClient(&store.KVDBConfig{Type: store.KVTypeMem})
+	if err != nil {
+		t.Fatalf("failed to init kv store: %s", err)
+	}
+	fsStore := store.NewKVDBFilesystemStore(client)
+	serverStore := store.NewKVServerStore(client)
+	err = serverStore.SetAddresses(&types.Server{Id: "node", Addresses: []string{"127.0.0.1"}}, &store.SetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	um := user.NewInternal(store.NewKVDBStoreWithIndex(client, user.UsersPrefix))
+	return &InMemoryState{
+		opts:            Opts{UserManager: um, RegistryStore: fsStore, FilesystemStore: fsStore, ServerStore: serverStore},
+		registryStore:   fsStore,
+		filesystemStore: fsStore,
+		serverStore:     serverStore,
+		userManager:     um,
+		registry:        registry.NewRegistry(um, fsStore),
+	}, um
+}
+
+func TestBackupRestoresUsersAndOrganizations(t *testing.T) {
+	s, um := newBackupTestState(t)
+	directory, err := idptest.NewLDAP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer directory.Close()
+	directory.AddUser("uid=carol,ou=people,dc=example,dc=com", "wonderland", nil)
+	um.SetIdentityProviders([]idp.Provider{
+		&idp.LDAP{URL: directory.URL, UserDN: "uid=%s,ou=people,dc=example,dc=com"},
+	}, nil)
+
+	alice, err := um.New("alice", "alice@example.com", "alicepassword")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// carol is made on first login, with no password of ours
+	carol, _, err := um.Authenticate("carol", "wonderland")
+	if err != nil {
+		t.Fatal(err)
+	}
+	org, err := um.NewOrganization("datateam", alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	org, err = um.AddOrganizationMember("datateam", "carol", types.OrganizationRoleMember)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, dot := range []*types.RegistryFilesystem{
+		{Id: "carol-fs", OwnerId: carol.Id, Name: "data"},
+		{Id: "datateam-fs", OwnerId: org.Id, Name: "data"},
+	} {
+		err = s.registryStore.SetFilesystem(dot, &store.SetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	backup := mustDumpKV(t, s)
+	restored, restoredUM := newBackupTestState(t)
+	err = restored.restoreBackup(backup)
+	if err != nil {
+		t.Fatalf("failed to restore: %s", err)
+	}
+
+	namespace, err := um.Get(&user.Query{Ref: "datateam"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, u := range []*user.User{alice, carol, namespace} {
+		got, err := restoredUM.Get(&user.Query{Ref: u.Id})
+		if err != nil {
+			t.Errorf("%s wasn't restored: %s", u.Name, err)
+			continue
+		}
+		if got.Name != u.Name || got.Metadata[user.IdentityProviderLabel] != u.Metadata[user.IdentityProviderLabel] {
+			t.Errorf("expected %s to be restored as %s, got %s", u.Name, u, got)
+		}
+	}
+	_, _, err = restoredUM.Authenticate("alice", "alicepassword")
+	if err != nil {
+		t.Errorf("alice can't log in after the restore: %s", err)
+	}
+	filesystems, err := restored.registryStore.ListFilesystems()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(filesystems) != 2 {
+		t.Errorf("expected carol's and datateam's dots to be restored, got %v", filesystems)
+	}
+
+	restoredOrg, err := restoredUM.GetOrganization("datateam")
+	if err != nil {
+		t.Fatalf("datateam wasn't restored: %s", err)
+	}
+	if !reflect.DeepEqual(restoredOrg.Members, org.Members) {
+		t.Errorf("expected datateam's members %v, got %v", org.Members, restoredOrg.Members)
+	}
+	report := types.CompareBackups(backup, mustDumpKV(t, restored))
+	if len(report.Users.Added)+len(report.Users.Removed)+len(report.Organizations.Added)+len(report.Organizations.Removed) != 0 {
+		t.Errorf("expected the restored KV store to match the backup, got %+v", report)
+	}
+}
+
+func mustDumpKV(t *testing.T, s *InMemoryState) *types.BackupV1 {
+	backup, err := s.dumpKV(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return backup
+}
@@ -0,0 +1,632 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/dotmesh-oss/dotmesh/pkg/auth"
+	"github.com/dotmesh-oss/dotmesh/pkg/bundle"
+	"github.com/dotmesh-oss/dotmesh/pkg/fsm"
+	"github.com/dotmesh-oss/dotmesh/pkg/types"
+	"github.com/dotmesh-oss/dotmesh/pkg/uuid"
+	"github.com/dotmesh-oss/dotmesh/pkg/validator"
+
+	"github.com/gorilla/mux"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// BundleExportHandler writes a bundle of a dot's commits, as read by
+// BundleImportHandler, so that the dot can be copied to a cluster that
+// can't be reached over the network. The branch query parameter picks the
+// branch, which is bundled along with the branches it was made from, and
+// since leaves out every commit up to and including the given one, for
+// bringing a dot that's been imported before up to date.
+//
+// Only commits are bundled, not uncommitted changes. The bundle is made on
+// the dot's master, which must also be the master of the branches bundled.
+type BundleExportHandler struct {
+	state *InMemoryState
+	httputil.ReverseProxy
+}
+
+func NewBundleExportHandler(state *InMemoryState) http.Handler {
+	h := &BundleExportHandler{
+		state: state,
+	}
+	h.ReverseProxy.Director = proxyToAddressInContext
+	// a bundle is big, pass it through as it's made
+	h.ReverseProxy.FlushInterval = 100 * time.Millisecond
+	return h
+}
+
+// BundleImportHandler receives a bundle written by BundleExportHandler,
+// creating the dot and branches it holds if they don't exist and applying
+// its commits on top of the ones they have if they do. The namespace and
+// name query parameters import the dot under another name.
+type BundleImportHandler struct {
+	state *InMemoryState
+	httputil.ReverseProxy
+}
+
+func NewBundleImportHandler(state *InMemoryState) http.Handler {
+	h := &BundleImportHandler{
+		state: state,
+	}
+	h.ReverseProxy.Director = proxyToAddressInContext
+	return h
+}
+
+// bundleStreams works out the streams that bundle the commits of each
+// filesystem in path, leaving out those up to and including since. It
+// returns an error if any of them isn't mastered on this node.
+func (s *InMemoryState) bundleStreams(path types.PathToTopLevelFilesystem, since string) ([]bundle.Stream, error) {
+	filesystems := []string{path.TopLevelFilesystemId}
+	for _, c := range path.Clones {
+		filesystems = append(filesystems, c.Clone.FilesystemId)
+	}
+
+	streams := []bundle.Stream{}
+	for i, filesystemId := range filesystems {
+		master, err := s.registry.CurrentMasterNode(filesystemId)
+		if err != nil {
+			return nil, err
+		}
+		if master != s.NodeID() {
+			return nil, fmt.Errorf(
+				"The dot's branches are on different nodes (%s is on %s, not %s), so can't be bundled together",
+				filesystemId, master, s.NodeID(),
+			)
+		}
+		snapshots, err := s.SnapshotsFor(s.NodeID(), filesystemId)
+		if err != nil {
+			return nil, err
+		}
+
+		stream := bundle.Stream{FilesystemId: filesystemId, From: "START"}
+		if i > 0 {
+			origin := path.Clones[i-1].Clone.Origin
+			stream.From = fmt.Sprintf("%s@%s", origin.FilesystemId, origin.SnapshotId)
+		}
+		// a branch further down the path only needs its parent's commits
+		// up to where it was made
+		if i < len(path.Clones) {
+			stream.To = path.Clones[i].Clone.Origin.SnapshotId
+		} else if len(snapshots) > 0 {
+			stream.To = snapshots[len(snapshots)-1].Id
+		} else {
+			return nil, fmt.Errorf("There are no commits on the branch to export")
+		}
+		for j := range snapshots {
+			stream.Snapshots = append(stream.Snapshots, &snapshots[j])
+			if snapshots[j].Id == stream.To {
+				break
+			}
+		}
+		streams = append(streams, stream)
+	}
+
+	if since == "" {
+		return streams, nil
+	}
+	for i := len(streams) - 1; i >= 0; i-- {
+		for _, snapshot := range streams[i].Snapshots {
+			if snapshot.Id != since {
+				continue
+			}
+			streams = streams[i:]
+			if since == streams[0].To {
+				streams = streams[1:]
+			} else {
+				streams[0].From = since
+			}
+			if len(streams) == 0 {
+				return nil, fmt.Errorf("There are no commits after %s to export", since)
+			}
+			return streams, nil
+		}
+	}
+	return nil, fmt.Errorf("No commit %s on the branch or the branches it was made from", since)
+}
+
+func (h *BundleExportHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	if !validator.EnsureValidOrRespond(vars["namespace"], validator.IsValidVolumeNamespace, resp) {
+		return
+	}
+	if !validator.EnsureValidOrRespond(vars["name"], validator.IsValidVolumeName, resp) {
+		return
+	}
+	volName := VolumeName{
+		Namespace: vars["namespace"],
+		Name:      vars["name"],
+	}
+	query := req.URL.Query()
+	branch := query.Get("branch")
+	if branch == DEFAULT_BRANCH {
+		branch = ""
+	}
+	if !validator.EnsureValidOrRespond(branch, validator.IsValidBranchName, resp) {
+		return
+	}
+	since := query.Get("since")
+	if since != "" && !validator.EnsureValidOrRespond(since, validator.IsValidSnapshotName, resp) {
+		return
+	}
+
+	tlf, err := h.state.registry.LookupFilesystem(volName)
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusNotFound)
+		return
+	}
+	authorized, err := h.state.userManager.Authorize(auth.GetUser(req), true, &tlf)
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !authorized {
+		http.Error(resp, fmt.Sprintf("You are not allowed to see %s/%s", volName.Namespace, volName.Name), http.StatusForbidden)
+		return
+	}
+	path, err := h.state.registry.DeducePathToTopLevelFilesystem(volName, branch)
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	master, err := h.state.registry.CurrentMasterNode(path.TopLevelFilesystemId)
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if master != h.state.NodeID() {
+		target, err := h.state.nodeUrl(master)
+		if err != nil {
+			http.Error(resp, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Infof("[BundleExportHandler.ServeHTTP] proxying export to node: %s", target)
+		h.ReverseProxy.ServeHTTP(resp, req.WithContext(ctxSetAddress(req.Context(), target)))
+		return
+	}
+
+	streams, err := h.state.bundleStreams(path, since)
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusConflict)
+		return
+	}
+	registryFilesystem, err := h.state.registryStore.GetFilesystem(volName.Namespace, volName.Name)
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if branch == "" {
+		branch = DEFAULT_BRANCH
+	}
+	manifest := &bundle.Manifest{
+		Dot:        volName,
+		Branch:     branch,
+		Filesystem: *registryFilesystem,
+		Path:       path,
+		Streams:    streams,
+	}
+
+	resp.Header().Set("Content-Type", "application/octet-stream")
+	resp.WriteHeader(http.StatusOK)
+	w := bundle.NewWriter(resp)
+	err = w.WriteManifest(manifest)
+	if err != nil {
+		log.WithError(err).Error("[BundleExportHandler.ServeHTTP] Error writing bundle manifest")
+		return
+	}
+	for _, stream := range streams {
+		err = h.state.writeBundleStream(req.Context(), w, stream)
+		if err != nil {
+			// the bundle is left without the end of this stream, which is
+			// how whoever reads it will know
+			log.WithError(err).WithField("filesystem_id", stream.FilesystemId).Error("[BundleExportHandler.ServeHTTP] Error writing bundle stream")
+			return
+		}
+	}
+}
+
+// writeBundleStream adds a stream to a bundle, prelude and all, just as a
+// push would send it
+func (s *InMemoryState) writeBundleStream(ctx context.Context, w *bundle.Writer, stream bundle.Stream) error {
+	snapshots := []Snapshot{}
+	for _, snapshot := range stream.Snapshots {
+		snapshots = append(snapshots, *snapshot)
+	}
+	prelude, err := fsm.CalculatePrelude(snapshots, stream.To)
+	if err != nil {
+		return err
+	}
+	preludeEncoded, err := fsm.EncodePrelude(prelude)
+	if err != nil {
+		return err
+	}
+
+	pipeReader, errch := s.zfs.Send(ctx, "", stream.From, stream.FilesystemId, stream.To, preludeEncoded)
+	n, err := w.WriteStream(pipeReader)
+	if err != nil {
+		pipeReader.Close()
+		go func() {
+			// zfs send will fail now no one's reading it, and the result
+			// needs collecting
+			<-errch
+		}()
+		return err
+	}
+	err = <-errch
+	if err != nil {
+		return fmt.Errorf("zfs send failed, check zfs-send-errors.log: %s", err)
+	}
+	log.Infof(
+		"[writeBundleStream] Bundled %d bytes of %s from %s to %s",
+		n, stream.FilesystemId, stream.From, stream.To,
+	)
+	return nil
+}
+
+// checkBundleStreams makes sure a bundle only brings commits of the
+// filesystems on the path it has, to the branch it's of, so that it can't be
+// used to write to any other filesystem.
+func checkBundleStreams(path types.PathToTopLevelFilesystem, streams []bundle.Stream) error {
+	filesystems := map[string]bool{path.TopLevelFilesystemId: true}
+	for _, c := range path.Clones {
+		filesystems[c.Clone.FilesystemId] = true
+	}
+	for id := range filesystems {
+		if !validator.IsUUID(id) {
+			return fmt.Errorf("The bundle has an invalid filesystem id %q", id)
+		}
+	}
+	for _, stream := range streams {
+		if !filesystems[stream.FilesystemId] {
+			return fmt.Errorf("The bundle has commits of %s, which isn't on the branch it's of", stream.FilesystemId)
+		}
+	}
+	return nil
+}
+
+// checkBundleFilesystems makes sure that none of the filesystems on a
+// bundle's path is already here as part of another dot, or as another
+// branch of the dot it's being imported as.
+func (s *InMemoryState) checkBundleFilesystems(path types.PathToTopLevelFilesystem) error {
+	branches := map[string]string{path.TopLevelFilesystemId: ""}
+	for _, c := range path.Clones {
+		branches[c.Clone.FilesystemId] = c.Name
+	}
+	for id, branch := range branches {
+		tlf, clone, err := s.registry.LookupFilesystemById(id)
+		if err != nil {
+			if _, _, err := s.registry.LookupCloneByIdWithName(id); err == nil {
+				return fmt.Errorf("Filesystem %s in the bundle is already part of another dot", id)
+			}
+			continue
+		}
+		if tlf.MasterBranch.Name != path.TopLevelFilesystemName || clone != branch {
+			return fmt.Errorf("Filesystem %s in the bundle is already part of another dot or branch", id)
+		}
+	}
+	return nil
+}
+
+// importPlan works out which of a bundle's streams need receiving, and how
+// many commits they'll bring, making sure each can be applied on top of the
+// commits already here, as a pull would.
+func (s *InMemoryState) importPlan(streams []bundle.Stream) ([]bool, int, error) {
+	apply := make([]bool, len(streams))
+	commits := 0
+	for i, stream := range streams {
+		local := []*types.Snapshot{}
+		snapshots, err := s.SnapshotsFor(s.NodeID(), stream.FilesystemId)
+		if err == nil {
+			for j := range snapshots {
+				local = append(local, &snapshots[j])
+			}
+		}
+		common, err := fsm.CanApply(stream.Snapshots, local)
+		switch err.(type) {
+		case nil:
+		case *fsm.ToSnapsUpToDate, *fsm.ToSnapsAhead:
+			// there's nothing in it we don't have
+			continue
+		default:
+			return nil, 0, fmt.Errorf("Can't apply the bundle's commits of %s: %s", stream.FilesystemId, err)
+		}
+
+		incremental := stream.From != "START" && !strings.Contains(stream.From, "@")
+		if common == nil && incremental {
+			return nil, 0, fmt.Errorf(
+				"The bundle only has the commits after %s, which hasn't been imported here. "+
+					"Import a bundle made without --since, or with an earlier one, first.",
+				stream.From,
+			)
+		}
+		if common != nil && common.Id != stream.From {
+			if incremental {
+				return nil, 0, fmt.Errorf(
+					"The bundle's commits follow %s, but the latest commit here is %s. "+
+						"Export them again with --since %s.",
+					stream.From, common.Id, common.Id,
+				)
+			}
+			return nil, 0, fmt.Errorf(
+				"The bundle has every commit, but some are here already. Export it again with --since %s.",
+				common.Id,
+			)
+		}
+
+		apply[i] = true
+		found := common == nil
+		for _, snapshot := range stream.Snapshots {
+			if found {
+				commits++
+			}
+			if common != nil && snapshot.Id == common.Id {
+				found = true
+			}
+		}
+	}
+	return apply, commits, nil
+}
+
+// receiveBundleStream receives one stream of a bundle into its filesystem,
+// which must be mastered here. Its fsMachine is told to expect a push, as
+// if the stream came from another cluster.
+func (s *InMemoryState) receiveBundleStream(ctx context.Context, importId string, volName VolumeName, branch string, stream bundle.Stream, data io.Reader) error {
+	responseChan, err := s.globalFsRequest(stream.FilesystemId, &Event{
+		Name: "peer-transfer",
+		Args: &EventArgs{
+			"Transfer": types.TransferPollResult{
+				TransferRequestId: importId,
+				Direction:         "push",
+				LocalNamespace:    volName.Namespace,
+				LocalName:         volName.Name,
+				LocalBranchName:   branch,
+				RemoteNamespace:   volName.Namespace,
+				RemoteName:        volName.Name,
+				RemoteBranchName:  branch,
+				FilesystemId:      stream.FilesystemId,
+				StartingCommit:    stream.From,
+				TargetCommit:      stream.To,
+				Status:            "importing",
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	e := <-responseChan
+	if e.Name == "receiving-push-complete" {
+		// it already had them
+		return nil
+	}
+	if e.Name != "awaiting-transfer" {
+		return fmt.Errorf("Error preparing %s to receive the bundle: %+v", stream.FilesystemId, e)
+	}
+
+	pipeReader, pipeWriter := io.Pipe()
+	copied := make(chan struct{})
+	go func() {
+		defer close(copied)
+		_, err := io.Copy(pipeWriter, data)
+		pipeWriter.CloseWithError(err)
+	}()
+	err = func() error {
+		defer func() {
+			pipeReader.Close()
+			<-copied
+		}()
+		prelude, err := fsm.ConsumePrelude(pipeReader)
+		if err != nil {
+			return fmt.Errorf("Unable to parse prelude for %s: %s", stream.FilesystemId, err)
+		}
+		errBuffer := bytes.Buffer{}
+		err = s.zfs.Recv(ctx, pipeReader, stream.FilesystemId, &errBuffer)
+		if err != nil {
+			return fmt.Errorf("Unable to receive %s: %s, stderr: %s", stream.FilesystemId, err, errBuffer.String())
+		}
+		return s.zfs.ApplyPrelude(prelude, stream.FilesystemId)
+	}()
+	go s.notifyPushCompleted(stream.FilesystemId, err == nil)
+	if err != nil {
+		return err
+	}
+
+	// wait for the commits to be noticed, so that they're there to see once
+	// the import's done
+	return tryUntilSucceedsN(func() error {
+		snapshots, err := s.SnapshotsFor(s.NodeID(), stream.FilesystemId)
+		if err != nil {
+			return err
+		}
+		for _, snapshot := range snapshots {
+			if snapshot.Id == stream.To {
+				return nil
+			}
+		}
+		return fmt.Errorf("commit %s hasn't appeared yet", stream.To)
+	}, fmt.Sprintf("waiting for imported commits of %s", stream.FilesystemId), 10)
+}
+
+// peekWriter keeps what's written to it until it's stopped
+type peekWriter struct {
+	bytes.Buffer
+	stopped bool
+}
+
+func (p *peekWriter) Write(data []byte) (int, error) {
+	if p.stopped {
+		return len(data), nil
+	}
+	return p.Buffer.Write(data)
+}
+
+func (h *BundleImportHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	// keep what's read of the bundle up to the end of its manifest, in case
+	// it's to be passed on to another node. Only the node that imports the
+	// bundle reads its streams.
+	peeked := &peekWriter{}
+	reader, manifest, err := bundle.NewReader(io.TeeReader(req.Body, peeked))
+	peeked.stopped = true
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(manifest.Streams) == 0 {
+		http.Error(resp, "The bundle has no commits in it", http.StatusBadRequest)
+		return
+	}
+
+	volName := manifest.Path.TopLevelFilesystemName
+	query := req.URL.Query()
+	if query.Get("name") != "" {
+		volName = VolumeName{Namespace: query.Get("namespace"), Name: query.Get("name")}
+	}
+	err = validator.IsValidVolume(volName.Namespace, volName.Name)
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusBadRequest)
+		return
+	}
+	branch := manifest.Branch
+	if branch == DEFAULT_BRANCH {
+		branch = ""
+	}
+	err = validator.IsValidBranchName(branch)
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// the dot is laid out just as it was, under the name it's imported as
+	path := manifest.Path
+	path.TopLevelFilesystemName = volName
+
+	err = checkBundleStreams(path, manifest.Streams)
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = h.state.checkBundleFilesystems(path)
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusConflict)
+		return
+	}
+
+	tlf, err := h.state.registry.LookupFilesystem(volName)
+	exists := err == nil
+	if exists {
+		if tlf.MasterBranch.Id != path.TopLevelFilesystemId {
+			http.Error(resp, fmt.Sprintf(
+				"%s/%s is a different dot to the one in the bundle, try importing it under another name",
+				volName.Namespace, volName.Name,
+			), http.StatusConflict)
+			return
+		}
+		authorized, err := h.state.userManager.Authorize(auth.GetUser(req), true, &tlf)
+		if err != nil {
+			http.Error(resp, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !authorized {
+			http.Error(resp, fmt.Sprintf("You are not allowed to change %s/%s", volName.Namespace, volName.Name), http.StatusForbidden)
+			return
+		}
+
+		master, err := h.state.registry.CurrentMasterNode(path.TopLevelFilesystemId)
+		if err != nil {
+			http.Error(resp, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if master != h.state.NodeID() {
+			target, err := h.state.nodeUrl(master)
+			if err != nil {
+				http.Error(resp, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			log.Infof("[BundleImportHandler.ServeHTTP] proxying import to node: %s", target)
+			req.Body = ioutil.NopCloser(io.MultiReader(&peeked.Buffer, req.Body))
+			req.ContentLength = -1
+			h.ReverseProxy.ServeHTTP(resp, req.WithContext(ctxSetAddress(req.Context(), target)))
+			return
+		}
+	} else {
+		isAdmin, err := AuthenticatedUserIsNamespaceAdministrator(req.Context(), volName.Namespace, h.state.userManager)
+		if err != nil {
+			http.Error(resp, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !isAdmin {
+			http.Error(resp, fmt.Sprintf("You are not allowed to create dots in namespace %s", volName.Namespace), http.StatusForbidden)
+			return
+		}
+	}
+	peeked.Reset()
+
+	apply, commits, err := h.state.importPlan(manifest.Streams)
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusConflict)
+		return
+	}
+
+	branchId := manifest.Streams[len(manifest.Streams)-1].FilesystemId
+	if h.state.registry.Exists(volName, branch) == "" {
+		err = NewDotmeshRPC(h.state, h.state.userManager).registerFilesystemBecomeMaster(
+			req.Context(), volName.Namespace, volName.Name, branch, branchId, path,
+		)
+		if err != nil {
+			http.Error(resp, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	importId := uuid.New().String()
+	for i, stream := range manifest.Streams {
+		data, err := reader.NextStream()
+		if err != nil {
+			http.Error(resp, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !apply[i] {
+			continue
+		}
+		master, err := h.state.registry.CurrentMasterNode(stream.FilesystemId)
+		if err != nil {
+			http.Error(resp, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if master != h.state.NodeID() {
+			http.Error(resp, fmt.Sprintf(
+				"The dot's branches are on different nodes (%s is on %s, not %s), so can't be imported together",
+				stream.FilesystemId, master, h.state.NodeID(),
+			), http.StatusConflict)
+			return
+		}
+		log.Infof("[BundleImportHandler.ServeHTTP] importing %s from %s to %s", stream.FilesystemId, stream.From, stream.To)
+		err = h.state.receiveBundleStream(req.Context(), importId, volName, branch, stream, data)
+		if err != nil {
+			http.Error(resp, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if branch == "" {
+		branch = DEFAULT_BRANCH
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(resp).Encode(types.BundleImport{
+		Dot:     volName,
+		Branch:  branch,
+		Commits: commits,
+	})
+}
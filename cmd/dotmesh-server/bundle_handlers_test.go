@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/dotmesh-oss/dotmesh/pkg/bundle"
+	"github.com/dotmesh-oss/dotmesh/pkg/types"
+)
+
+const (
+	bundleDotId   = "7d0c4b4a-0a6e-4c1f-9f8e-2a7c1e6d9b01"
+	bundleCloneId = "7d0c4b4a-0a6e-4c1f-9f8e-2a7c1e6d9b02"
+	bundleOtherId = "7d0c4b4a-0a6e-4c1f-9f8e-2a7c1e6d9b03"
+)
+
+// bundlePath is a dot with a branch made from its second commit
+func bundlePath() types.PathToTopLevelFilesystem {
+	return types.PathToTopLevelFilesystem{
+		TopLevelFilesystemId:   bundleDotId,
+		TopLevelFilesystemName: types.VolumeName{Namespace: "alice", Name: "imported"},
+		Clones: types.ClonesList{{
+			Name: "feature",
+			Clone: types.Clone{
+				TopLevelFilesystemId: bundleDotId,
+				FilesystemId:         bundleCloneId,
+				Name:                 "feature",
+				Origin:               types.Origin{FilesystemId: bundleDotId, SnapshotId: "b"},
+			},
+		}},
+	}
+}
+
+func Test_bundleStreams(t *testing.T) {
+	s := newTestDirectoryState(t, map[string][]*types.Snapshot{
+		bundleDotId:   snapshots("a", "b", "c"),
+		bundleCloneId: snapshots("d", "e"),
+	})
+
+	type stream struct {
+		filesystemId, from, to string
+		snapshots              []string
+	}
+	dot := stream{bundleDotId, "START", "b", []string{"a", "b"}}
+	clone := stream{bundleCloneId, bundleDotId + "@b", "e", []string{"d", "e"}}
+
+	tests := []struct {
+		name     string
+		since    string
+		expected []stream
+		err      string
+	}{
+		{name: "everything", expected: []stream{dot, clone}},
+		{
+			name:     "since a commit before the branch",
+			since:    "a",
+			expected: []stream{{bundleDotId, "a", "b", []string{"a", "b"}}, clone},
+		},
+		{name: "since the branch's origin", since: "b", expected: []stream{clone}},
+		{
+			name:     "since a commit on the branch",
+			since:    "d",
+			expected: []stream{{bundleCloneId, "d", "e", []string{"d", "e"}}},
+		},
+		{name: "since the latest commit", since: "e", err: "no commits after e"},
+		{name: "since a commit after the branch was made", since: "c", err: "No commit c"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			streams, err := s.bundleStreams(bundlePath(), tt.since)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("expected an error about %q, got %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := []stream{}
+			for _, st := range streams {
+				got = append(got, stream{st.FilesystemId, st.From, st.To, snapshotIds(st.Snapshots)})
+			}
+			if !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("expected %+v, got %+v", tt.expected, got)
+			}
+		})
+	}
+
+	s.registry.SetMasterNode(bundleCloneId, "elsewhere")
+	_, err := s.bundleStreams(bundlePath(), "")
+	if err == nil || !strings.Contains(err.Error(), "different nodes") {
+		t.Errorf("expected branches on other nodes not to be bundled, got %v", err)
+	}
+}
+
+func Test_importPlan(t *testing.T) {
+	s := newTestDirectoryState(t, map[string][]*types.Snapshot{
+		bundleDotId: snapshots("a", "b"),
+	})
+
+	tests := []struct {
+		name    string
+		stream  bundle.Stream
+		apply   bool
+		commits int
+		err     string
+	}{
+		{
+			name:    "a filesystem that isn't here",
+			stream:  bundle.Stream{FilesystemId: bundleOtherId, From: "START", To: "y", Snapshots: snapshots("x", "y")},
+			apply:   true,
+			commits: 2,
+		},
+		{
+			name:    "commits following the latest here",
+			stream:  bundle.Stream{FilesystemId: bundleDotId, From: "b", To: "d", Snapshots: snapshots("a", "b", "c", "d")},
+			apply:   true,
+			commits: 2,
+		},
+		{
+			name:   "nothing new",
+			stream: bundle.Stream{FilesystemId: bundleDotId, From: "START", To: "b", Snapshots: snapshots("a", "b")},
+		},
+		{
+			name:   "every commit, some of which are here",
+			stream: bundle.Stream{FilesystemId: bundleDotId, From: "START", To: "c", Snapshots: snapshots("a", "b", "c")},
+			err:    "--since b",
+		},
+		{
+			name:   "commits following an earlier commit",
+			stream: bundle.Stream{FilesystemId: bundleDotId, From: "a", To: "c", Snapshots: snapshots("a", "b", "c")},
+			err:    "Export them again with --since b",
+		},
+		{
+			name:   "commits following one that isn't here",
+			stream: bundle.Stream{FilesystemId: bundleOtherId, From: "x", To: "y", Snapshots: snapshots("x", "y")},
+			err:    "hasn't been imported here",
+		},
+		{
+			name:   "diverged",
+			stream: bundle.Stream{FilesystemId: bundleDotId, From: "START", To: "z", Snapshots: snapshots("a", "z")},
+			err:    "Can't apply",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			apply, commits, err := s.importPlan([]bundle.Stream{tt.stream})
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("expected an error about %q, got %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if apply[0] != tt.apply || commits != tt.commits {
+				t.Errorf("expected apply=%t with %d commits, got apply=%t with %d", tt.apply, tt.commits, apply[0], commits)
+			}
+		})
+	}
+}
+
+func Test_checkBundleStreams(t *testing.T) {
+	tests := []struct {
+		name    string
+		path    func(*types.PathToTopLevelFilesystem)
+		streams []string
+		valid   bool
+	}{
+		{name: "streams on the path", streams: []string{bundleDotId, bundleCloneId}, valid: true},
+		{name: "a stream of another filesystem", streams: []string{bundleDotId, bundleOtherId}},
+		{
+			name:    "an invalid filesystem id",
+			path:    func(p *types.PathToTopLevelFilesystem) { p.TopLevelFilesystemId = "../alice-fs" },
+			streams: []string{"../alice-fs"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := bundlePath()
+			if tt.path != nil {
+				tt.path(&path)
+			}
+			streams := []bundle.Stream{}
+			for _, id := range tt.streams {
+				streams = append(streams, bundle.Stream{FilesystemId: id})
+			}
+			err := checkBundleStreams(path, streams)
+			if tt.valid && err != nil {
+				t.Errorf("expected the streams to be accepted, got %s", err)
+			}
+			if !tt.valid && err == nil {
+				t.Errorf("expected the streams to be rejected")
+			}
+		})
+	}
+}
+
+func Test_checkBundleFilesystems(t *testing.T) {
+	s, _, _ := newTestStateWithDots(t)
+	alice := types.VolumeName{Namespace: "alice", Name: "data"}
+
+	tests := []struct {
+		name string
+		path types.PathToTopLevelFilesystem
+		free bool
+	}{
+		{name: "a new dot", path: bundlePath(), free: true},
+		{
+			name: "the dot it's imported over",
+			path: types.PathToTopLevelFilesystem{TopLevelFilesystemId: "alice-fs", TopLevelFilesystemName: alice},
+			free: true,
+		},
+		{
+			name: "another user's dot",
+			path: types.PathToTopLevelFilesystem{TopLevelFilesystemId: "bob-fs", TopLevelFilesystemName: alice},
+		},
+		{
+			name: "another dot as a branch",
+			path: func() types.PathToTopLevelFilesystem {
+				p := bundlePath()
+				p.Clones[0].Clone.FilesystemId = "bob-fs"
+				return p
+			}(),
+		},
+		{
+			name: "a dot as a branch of itself",
+			path: types.PathToTopLevelFilesystem{
+				TopLevelFilesystemId:   bundleDotId,
+				TopLevelFilesystemName: alice,
+				Clones:                 types.ClonesList{{Name: "feature", Clone: types.Clone{FilesystemId: "alice-fs"}}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := s.checkBundleFilesystems(tt.path)
+			if tt.free && err != nil {
+				t.Errorf("expected the filesystems to be free, got %s", err)
+			}
+			if !tt.free && err == nil {
+				t.Errorf("expected the filesystems to be taken")
+			}
+		})
+	}
+}
+
+func Test_peekWriter(t *testing.T) {
+	var data bytes.Buffer
+	w := bundle.NewWriter(&data)
+	err := w.WriteManifest(&bundle.Manifest{Streams: []bundle.Stream{{FilesystemId: bundleDotId, From: "START", To: "a"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream := bytes.Repeat([]byte("x"), 1024*1024)
+	_, err = w.WriteStream(bytes.NewReader(stream))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := data.Bytes()
+
+	peeked := &peekWriter{}
+	reader, _, err := bundle.NewReader(io.TeeReader(bytes.NewReader(body), peeked))
+	peeked.stopped = true
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept := peeked.Len()
+	if !bytes.HasPrefix(body, peeked.Bytes()) {
+		t.Errorf("expected to keep the start of the bundle")
+	}
+
+	s, err := reader.NextStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	read, err := ioutil.ReadAll(s)
+	if err != nil || !bytes.Equal(read, stream) {
+		t.Fatalf("failed to read the stream: %v", err)
+	}
+	if peeked.Len() != kept || kept > len(body)/2 {
+		t.Errorf("expected only what was read with the manifest to be kept, kept %d of %d bytes", peeked.Len(), len(body))
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/dotmesh-oss/dotmesh/pkg/auth"
+	dmclient "github.com/dotmesh-oss/dotmesh/pkg/client"
+	"github.com/dotmesh-oss/dotmesh/pkg/diff"
+	"github.com/dotmesh-oss/dotmesh/pkg/types"
+	"github.com/dotmesh-oss/dotmesh/pkg/user"
+	"github.com/dotmesh-oss/dotmesh/pkg/utils"
+	"github.com/dotmesh-oss/dotmesh/pkg/validator"
+	"github.com/dotmesh-oss/dotmesh/pkg/zfs"
+
+	"github.com/gorilla/mux"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// CommitDiffHandler compares two commits of a dot, or a commit and a branch's
+// working copy, streaming one JSON encoded types.CommitFileDiff per line.
+// The from query parameter defaults to the latest commit on branch (itself
+// defaulting to master) and to defaults to branch's working copy. path limits
+// the comparison to files under it, and content asks for unified diffs of
+// text files.
+//
+// The commits can be on different branches. The comparison runs on a node
+// that has both of them, which for the working copy means the branch's
+// master.
+type CommitDiffHandler struct {
+	state *InMemoryState
+	httputil.ReverseProxy
+}
+
+func NewCommitDiffHandler(state *InMemoryState) http.Handler {
+	h := &CommitDiffHandler{
+		state: state,
+	}
+
+	h.ReverseProxy.Director = proxyToAddressInContext
+	// pass results through as they're found
+	h.ReverseProxy.FlushInterval = 100 * time.Millisecond
+
+	return h
+}
+
+// commitHolders returns the nodes that have commitId of any branch in tlf,
+// along with which filesystem it's a snapshot of there
+func (s *InMemoryState) commitHolders(tlf types.TopLevelFilesystem, commitId string) map[string]string {
+	holders := map[string]string{}
+	filesystems := []string{tlf.MasterBranch.Id}
+	for _, branch := range tlf.OtherBranches {
+		filesystems = append(filesystems, branch.Id)
+	}
+	for _, server := range s.knownServers() {
+		for _, fs := range filesystems {
+			snapshots, err := s.SnapshotsFor(server.Id, fs)
+			if err != nil {
+				continue
+			}
+			for _, snapshot := range snapshots {
+				if snapshot.Id == commitId {
+					holders[server.Id] = fs
+				}
+			}
+		}
+	}
+	return holders
+}
+
+// mountCommit mounts a commit read-only on this node at a path of its own,
+// out of the way of the filesystem's state machine. Call unmount once done
+// with it.
+func (s *InMemoryState) mountCommit(filesystemId, commitId string) (mountPath string, unmount func(), err error) {
+	_, err = zfs.EnsureKeyLoaded(s.zfs, filesystemId, func() (string, error) {
+		return s.EncryptionKey(filesystemId)
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	mountPath, unmountPrivate, err := zfs.MountPrivately(s.zfs, filesystemId, commitId)
+	if err != nil {
+		return "", nil, err
+	}
+	return mountPath, func() {
+		err := unmountPrivate()
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error":         err,
+				"filesystem_id": filesystemId,
+				"commit":        commitId,
+			}).Warn("[mountCommit] failed to unmount commit")
+		}
+	}, nil
+}
+
+func (h *CommitDiffHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	if !validator.EnsureValidOrRespond(vars["namespace"], validator.IsValidVolumeNamespace, resp) {
+		return
+	}
+	if !validator.EnsureValidOrRespond(vars["name"], validator.IsValidVolumeName, resp) {
+		return
+	}
+	volName := VolumeName{
+		Name:      vars["name"],
+		Namespace: vars["namespace"],
+	}
+
+	query := req.URL.Query()
+	from := query.Get("from")
+	to := query.Get("to")
+	branch := query.Get("branch")
+	if branch == DEFAULT_BRANCH {
+		branch = ""
+	}
+	if !validator.EnsureValidOrRespond(branch, validator.IsValidBranchName, resp) {
+		return
+	}
+	for _, commit := range []string{from, to} {
+		if commit != "" && !validator.EnsureValidOrRespond(commit, validator.IsValidSnapshotName, resp) {
+			return
+		}
+	}
+	opts := diff.Options{
+		Path:    query.Get("path"),
+		Content: query.Get("content") != "",
+	}
+
+	tlf, err := h.state.registry.LookupFilesystem(volName)
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusNotFound)
+		return
+	}
+	authorized, err := h.state.userManager.Authorize(auth.GetUser(req), true, &tlf)
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !authorized {
+		http.Error(resp, fmt.Sprintf("You are not allowed to see %s/%s", volName.Namespace, volName.Name), http.StatusForbidden)
+		return
+	}
+
+	branchId := h.state.registry.Exists(volName, branch)
+	if branchId == "" && (from == "" || to == "") {
+		http.Error(resp, fmt.Sprintf("No such branch %s", branch), http.StatusNotFound)
+		return
+	}
+	if from == "" {
+		snapshots, err := h.state.SnapshotsForCurrentMaster(branchId)
+		if err != nil {
+			http.Error(resp, fmt.Sprintf("failed to retrieve snapshots: %s", err), http.StatusInternalServerError)
+			return
+		}
+		if len(snapshots) == 0 {
+			http.Error(resp, "no commits to compare from", http.StatusBadRequest)
+			return
+		}
+		from = snapshots[len(snapshots)-1].Id
+	}
+
+	fromHolders := h.state.commitHolders(tlf, from)
+	if len(fromHolders) == 0 {
+		http.Error(resp, fmt.Sprintf("No such commit %s", from), http.StatusNotFound)
+		return
+	}
+	var toHolders map[string]string
+	if to == "" {
+		// only the master has an up to date working copy
+		master, err := h.state.registry.CurrentMasterNode(branchId)
+		if err != nil {
+			http.Error(resp, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		toHolders = map[string]string{master: branchId}
+	} else {
+		toHolders = h.state.commitHolders(tlf, to)
+		if len(toHolders) == 0 {
+			http.Error(resp, fmt.Sprintf("No such commit %s", to), http.StatusNotFound)
+			return
+		}
+	}
+
+	node := ""
+	if _, ok := fromHolders[h.state.NodeID()]; ok {
+		if _, ok := toHolders[h.state.NodeID()]; ok {
+			node = h.state.NodeID()
+		}
+	}
+	if node == "" {
+		for server := range fromHolders {
+			if _, ok := toHolders[server]; ok {
+				node = server
+				break
+			}
+		}
+	}
+	if node == "" {
+		http.Error(resp, fmt.Sprintf("No node has both %s and %s yet, try again once they've replicated", from, to), http.StatusConflict)
+		return
+	}
+
+	if node != h.state.NodeID() {
+		admin, err := h.state.userManager.Get(&user.Query{Ref: "admin"})
+		if err != nil {
+			http.Error(resp, fmt.Sprintf("Can't get API key to proxy diff request: %+v.\n", err), 500)
+			return
+		}
+		target, err := dmclient.DeduceUrl(context.Background(), h.state.AddressesForServer(node), "internal", "admin", admin.ApiKey)
+		if err != nil {
+			http.Error(resp, err.Error(), 500)
+			return
+		}
+		log.Infof("[CommitDiffHandler.ServeHTTP] proxying diff request to node: %s", target)
+		// don't resolve the defaults differently over there
+		query.Set("from", from)
+		query.Set("to", to)
+		req.URL.RawQuery = query.Encode()
+		h.ReverseProxy.ServeHTTP(resp, req.WithContext(ctxSetAddress(req.Context(), target)))
+		return
+	}
+
+	fromMount, unmountFrom, err := h.state.mountCommit(fromHolders[node], from)
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer unmountFrom()
+	toMount := utils.Mnt(branchId)
+	if to != "" {
+		var unmountTo func()
+		toMount, unmountTo, err = h.state.mountCommit(toHolders[node], to)
+		if err != nil {
+			http.Error(resp, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer unmountTo()
+	}
+
+	resp.Header().Set("Content-Type", "application/x-ndjson")
+	resp.WriteHeader(http.StatusOK)
+	flusher, _ := resp.(http.Flusher)
+	encoder := json.NewEncoder(resp)
+
+	err = diff.Trees(
+		filepath.Join(fromMount, "__default__"),
+		filepath.Join(toMount, "__default__"),
+		opts,
+		func(d *types.CommitFileDiff) error {
+			err := encoder.Encode(d)
+			if err != nil {
+				return err
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+			return nil
+		},
+	)
+	if err != nil {
+		// too late for an error status, the client sees a truncated stream
+		log.WithFields(log.Fields{
+			"error": err,
+			"from":  from,
+			"to":    to,
+		}).Error("[CommitDiffHandler.ServeHTTP] diff failed")
+	}
+}
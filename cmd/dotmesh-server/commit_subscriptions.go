@@ -0,0 +1,332 @@
+package main
+
+import (
+	"sort"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/dotmesh-oss/dotmesh/pkg/pubsub"
+	"github.com/dotmesh-oss/dotmesh/pkg/store"
+	"github.com/dotmesh-oss/dotmesh/pkg/types"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// how often every node re-reads the subscriptions from the KV store to pick
+// up new ones and hand over ones it's no longer responsible for
+const commitSubscriptionInterval = 10 * time.Second
+
+// how long we give a remote cluster to agree to a pull
+const commitSubscriptionPullTimeout = 60 * time.Second
+
+// activeCommitSubscription is a CommitSubscription this node is listening
+// on. Its fields are protected by InMemoryState.commitSubscriptionsLock.
+type activeCommitSubscription struct {
+	subscription types.CommitSubscription
+	// to notice when the subscription is edited
+	modifiedIndex uint64
+	status        types.CommitSubscriptionStatus
+	// a commit we've heard about but not started pulling yet, because a
+	// previous pull was still running
+	pendingCommit string
+	// pull once even without a notification, because commits may have
+	// come and gone while nobody was listening
+	catchUp bool
+	pulling bool
+}
+
+func sameBranch(a, b string) bool {
+	if a == "" {
+		a = DEFAULT_BRANCH
+	}
+	if b == "" {
+		b = DEFAULT_BRANCH
+	}
+	return a == b
+}
+
+func (s *InMemoryState) runCommitSubscriptions() {
+	for {
+		err := s.reconcileCommitSubscriptions()
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+			}).Error("[runCommitSubscriptions] failed to reconcile commit subscriptions")
+		}
+		time.Sleep(commitSubscriptionInterval)
+	}
+}
+
+// handlesCommitSubscription decides whether this node should act on a
+// subscription: the master of the local branch if it exists and is up,
+// otherwise the node with the lowest id that's up, so that exactly one node
+// pulls.
+func (s *InMemoryState) handlesCommitSubscription(cs *types.CommitSubscription) bool {
+	ids := []string{}
+	for _, server := range s.knownServers() {
+		ids = append(ids, server.Id)
+	}
+	if len(ids) == 0 {
+		return false
+	}
+	sort.Strings(ids)
+
+	localBranch := cs.LocalBranchName
+	if localBranch == DEFAULT_BRANCH {
+		localBranch = ""
+	}
+	fsId := s.registry.Exists(VolumeName{Namespace: cs.LocalNamespace, Name: cs.LocalName}, localBranch)
+	if fsId != "" {
+		master, err := s.registry.CurrentMasterNode(fsId)
+		if err == nil {
+			for _, id := range ids {
+				if id == master {
+					return master == s.NodeID()
+				}
+			}
+		}
+	}
+	return ids[0] == s.NodeID()
+}
+
+func (s *InMemoryState) reconcileCommitSubscriptions() error {
+	subscriptions, err := s.filesystemStore.ListCommitSubscriptions()
+	if err != nil {
+		return err
+	}
+
+	wanted := map[string]*types.CommitSubscription{}
+	for _, cs := range subscriptions {
+		if s.handlesCommitSubscription(cs) {
+			wanted[cs.Id] = cs
+		}
+	}
+
+	s.commitSubscriptionsLock.Lock()
+	stale := []string{}
+	for id, active := range s.commitSubscriptions {
+		cs, ok := wanted[id]
+		if ok && cs.Meta.ModifiedIndex == active.modifiedIndex {
+			continue
+		}
+		stale = append(stale, id)
+		delete(s.commitSubscriptions, id)
+	}
+	added := []*types.CommitSubscription{}
+	for id, cs := range wanted {
+		if _, ok := s.commitSubscriptions[id]; !ok {
+			added = append(added, cs)
+		}
+	}
+	s.commitSubscriptionsLock.Unlock()
+
+	// NATS servers can be slow to answer or not answer at all, so talk to
+	// them without holding up commits on the other subscriptions
+	for _, id := range stale {
+		log.WithFields(log.Fields{
+			"subscription": id,
+		}).Info("[reconcileCommitSubscriptions] no longer listening")
+		err := s.pubSub.StopListeningForCommits(id)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error":        err,
+				"subscription": id,
+			}).Warn("[reconcileCommitSubscriptions] failed to stop listening")
+		}
+	}
+	for _, cs := range added {
+		active := s.listenForCommits(cs)
+		if active == nil {
+			continue
+		}
+		s.commitSubscriptionsLock.Lock()
+		s.commitSubscriptions[cs.Id] = active
+		s.commitSubscriptionsLock.Unlock()
+	}
+
+	s.commitSubscriptionsLock.Lock()
+	defer s.commitSubscriptionsLock.Unlock()
+
+	for id := range wanted {
+		active, ok := s.commitSubscriptions[id]
+		if !ok {
+			continue
+		}
+		_, connected := s.pubSub.ListeningForCommits(id)
+		if connected != active.status.Connected {
+			active.status.Connected = connected
+			s.saveCommitSubscriptionStatus(active)
+		}
+		s.maybePullForSubscription(active)
+	}
+	return nil
+}
+
+// listenForCommits starts listening for the commits cs is for, returning nil
+// if we couldn't reach the remote cluster's NATS server. It may take a while,
+// so call it without commitSubscriptionsLock held, and add what it returns to
+// commitSubscriptions.
+func (s *InMemoryState) listenForCommits(cs *types.CommitSubscription) *activeCommitSubscription {
+	active := &activeCommitSubscription{
+		subscription:  *cs,
+		modifiedIndex: cs.Meta.ModifiedIndex,
+		status: types.CommitSubscriptionStatus{
+			Id:     cs.Id,
+			NodeID: s.NodeID(),
+		},
+	}
+
+	// carry on from where the previous handler got to. Whatever it was
+	// (another node, or this one before the subscription was edited), it
+	// has stopped listening, so check for commits published in between.
+	previous, err := s.filesystemStore.GetCommitSubscriptionStatus(cs.Id)
+	if err == nil {
+		active.catchUp = true
+		active.status.LastCommitId = previous.LastCommitId
+		active.status.LastNotified = previous.LastNotified
+		active.status.LastTransferId = previous.LastTransferId
+	} else if !store.IsKeyNotFound(err) {
+		log.WithFields(log.Fields{
+			"error":        err,
+			"subscription": cs.Id,
+		}).Warn("[listenForCommits] failed to load previous status")
+	}
+
+	subject := cs.Subject
+	if subject == "" {
+		subject = types.NATSPublishCommitsSubject
+	}
+
+	id := cs.Id
+	err = s.pubSub.ListenForCommits(id, cs.NatsURL, cs.NatsUsername, cs.NatsPassword, subject, func(cn *pubsub.CommitNotification) {
+		s.handleSubscribedCommit(id, cn)
+	})
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error":        err,
+			"subscription": id,
+			"url":          cs.NatsURL,
+		}).Error("[listenForCommits] failed to listen for commits")
+		active.status.Connected = false
+		active.status.LastError = err.Error()
+		s.saveCommitSubscriptionStatus(active)
+		return nil
+	}
+
+	log.WithFields(log.Fields{
+		"subscription": id,
+		"url":          cs.NatsURL,
+		"subject":      subject,
+	}).Info("[listenForCommits] listening for commits")
+	active.status.Connected = true
+	active.status.LastError = ""
+	s.saveCommitSubscriptionStatus(active)
+	return active
+}
+
+func (s *InMemoryState) handleSubscribedCommit(id string, cn *pubsub.CommitNotification) {
+	s.commitSubscriptionsLock.Lock()
+	defer s.commitSubscriptionsLock.Unlock()
+
+	active, ok := s.commitSubscriptions[id]
+	if !ok {
+		return
+	}
+	cs := active.subscription
+	if cn.Namespace != cs.RemoteNamespace || cn.Name != cs.RemoteName || !sameBranch(cn.Branch, cs.RemoteBranchName) {
+		return
+	}
+	if cn.CommitId == active.status.LastCommitId {
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"subscription": id,
+		"commit":       cn.CommitId,
+	}).Info("[handleSubscribedCommit] new commit on subscribed branch")
+	active.status.LastCommitId = cn.CommitId
+	active.status.LastNotified = time.Now()
+	active.pendingCommit = cn.CommitId
+	s.saveCommitSubscriptionStatus(active)
+
+	s.maybePullForSubscription(active)
+}
+
+// maybePullForSubscription starts a pull if there's a pending commit or a
+// catch-up to do, and the last pull has finished. Call with
+// commitSubscriptionsLock held.
+func (s *InMemoryState) maybePullForSubscription(active *activeCommitSubscription) {
+	if (active.pendingCommit == "" && !active.catchUp) || active.pulling {
+		return
+	}
+	if active.status.LastTransferId != "" {
+		s.interclusterTransfersLock.RLock()
+		last, ok := s.interclusterTransfers[active.status.LastTransferId]
+		s.interclusterTransfersLock.RUnlock()
+		if ok && last.Status != "finished" && last.Status != "error" {
+			return
+		}
+	}
+
+	commit := active.pendingCommit
+	catchUp := active.catchUp
+	active.pendingCommit = ""
+	active.catchUp = false
+	active.pulling = true
+	cs := active.subscription
+
+	// the pull talks to the remote cluster, so don't hold everyone up
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), commitSubscriptionPullTimeout)
+		defer cancel()
+
+		d := NewDotmeshRPC(s, s.userManager)
+		transferId, err := d.startTransfer(ctx, cs.User, &types.TransferRequest{
+			Peer:             cs.Peer,
+			User:             cs.User,
+			Port:             cs.Port,
+			ApiKey:           cs.ApiKey,
+			Direction:        "pull",
+			LocalNamespace:   cs.LocalNamespace,
+			LocalName:        cs.LocalName,
+			LocalBranchName:  cs.LocalBranchName,
+			RemoteNamespace:  cs.RemoteNamespace,
+			RemoteName:       cs.RemoteName,
+			RemoteBranchName: cs.RemoteBranchName,
+		})
+
+		s.commitSubscriptionsLock.Lock()
+		defer s.commitSubscriptionsLock.Unlock()
+
+		active.pulling = false
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error":        err,
+				"subscription": cs.Id,
+			}).Error("[maybePullForSubscription] failed to start pull")
+			active.status.LastError = err.Error()
+			// try again on the next reconcile, unless something newer
+			// turned up in the meantime
+			if active.pendingCommit == "" {
+				active.pendingCommit = commit
+				active.catchUp = catchUp
+			}
+		} else {
+			active.status.LastTransferId = transferId
+			active.status.LastError = ""
+		}
+		s.saveCommitSubscriptionStatus(active)
+	}()
+}
+
+func (s *InMemoryState) saveCommitSubscriptionStatus(active *activeCommitSubscription) {
+	status := active.status
+	err := s.filesystemStore.SetCommitSubscriptionStatus(&status, &store.SetOptions{})
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error":        err,
+			"subscription": status.Id,
+		}).Error("[saveCommitSubscriptionStatus] failed to save status")
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/dotmesh-oss/dotmesh/pkg/pubsub"
+	"github.com/dotmesh-oss/dotmesh/pkg/store"
+	"github.com/dotmesh-oss/dotmesh/pkg/types"
+	"github.com/dotmesh-oss/dotmesh/pkg/zfs"
+	"github.com/nats-io/gnatsd/server"
+	"github.com/nats-io/gnatsd/test"
+)
+
+func Test_handlesCommitSubscription(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dotmesh-subscriptions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	backend, err := zfs.NewBackend("directory", filepath.Join(dir, "pool"), "", "", "pool", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, _, _ := newTestStateWithDots(t)
+	s.zfs = backend
+	s.serverAddressesCache = map[string][]string{}
+	s.serverAddressesCacheLock = &sync.RWMutex{}
+	s.serverLabelsCache = map[string]map[string]string{}
+	me := s.NodeID()
+	// sorts before any pool ID, so is the lowest
+	other := "0-other"
+	for _, id := range []string{me, other} {
+		s.processServerAddress(&types.Server{Id: id, Addresses: []string{"10.0.0.1"}, Meta: &types.KVMeta{Action: types.KVSet}})
+	}
+
+	existing := &types.CommitSubscription{LocalNamespace: "alice", LocalName: "data"}
+	missing := &types.CommitSubscription{LocalNamespace: "alice", LocalName: "new"}
+
+	// a branch that doesn't exist yet goes to the lowest ID
+	if s.handlesCommitSubscription(missing) {
+		t.Errorf("expected %s to handle a subscription to a new dot", other)
+	}
+
+	// one that does to its master
+	s.registry.SetMasterNode("alice-fs", me)
+	if !s.handlesCommitSubscription(existing) {
+		t.Errorf("expected the master to handle the subscription")
+	}
+	s.registry.SetMasterNode("alice-fs", other)
+	if s.handlesCommitSubscription(existing) {
+		t.Errorf("expected only the master to handle the subscription")
+	}
+
+	// unless the master has gone
+	s.registry.SetMasterNode("alice-fs", "gone")
+	if s.handlesCommitSubscription(existing) {
+		t.Errorf("expected %s to handle the subscription of a dot whose master has gone", other)
+	}
+	s.processServerAddress(&types.Server{Id: other, Meta: &types.KVMeta{Action: types.KVExpire}})
+	if !s.handlesCommitSubscription(existing) || !s.handlesCommitSubscription(missing) {
+		t.Errorf("expected the only node left to handle every subscription")
+	}
+}
+
+func Test_listenForCommitsCatchesUp(t *testing.T) {
+	nats := test.RunServer(&server.Options{
+		Host:   "127.0.0.1",
+		Port:   server.RANDOM_PORT,
+		NoLog:  true,
+		NoSigs: true,
+	})
+	defer nats.Shutdown()
+
+	dir, err := ioutil.TempDir("", "dotmesh-subscriptions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	backend, err := zfs.NewBackend("directory", filepath.Join(dir, "pool"), "", "", "pool", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := store.NewKVDBClient(&store.KVDBConfig{Type: store.KVTypeMem})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, _, _ := newTestStateWithDots(t)
+	s.zfs = backend
+	s.filesystemStore = store.NewKVDBFilesystemStore(client)
+	s.pubSub = pubsub.NewPubSubManager()
+
+	url := fmt.Sprintf("nats://%s", nats.Addr())
+	fresh := &types.CommitSubscription{Id: "fresh", NatsURL: url, Meta: &types.KVMeta{ModifiedIndex: 1}}
+	resumed := &types.CommitSubscription{Id: "resumed", NatsURL: url, Meta: &types.KVMeta{ModifiedIndex: 2}}
+	err = s.filesystemStore.SetCommitSubscriptionStatus(&types.CommitSubscriptionStatus{
+		Id:           "resumed",
+		LastCommitId: "commit-1",
+	}, &store.SetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// nobody listened before, so there's nothing we could have missed
+	active := s.listenForCommits(fresh)
+	if active == nil {
+		t.Fatal("failed to listen for commits")
+	}
+	if active.catchUp {
+		t.Errorf("expected no catch-up for a new subscription")
+	}
+
+	// but commits may have been published between the previous listener
+	// stopping and this one starting
+	active = s.listenForCommits(resumed)
+	if active == nil {
+		t.Fatal("failed to listen for commits")
+	}
+	if !active.catchUp {
+		t.Errorf("expected a catch-up after taking over a subscription")
+	}
+	if active.status.LastCommitId != "commit-1" {
+		t.Errorf("expected to carry on from commit-1, got %q", active.status.LastCommitId)
+	}
+
+	// a pull that's already running will pick up anything missed
+	active.pulling = true
+	s.maybePullForSubscription(active)
+	if !active.catchUp {
+		t.Errorf("expected the catch-up to wait for the running pull")
+	}
+}
@@ -17,11 +17,14 @@ import (
 	// "github.com/nu7hatch/gouuid"
 	"golang.org/x/net/context"
 
+	"github.com/dotmesh-oss/dotmesh/pkg/commitindex"
 	"github.com/dotmesh-oss/dotmesh/pkg/container"
 	"github.com/dotmesh-oss/dotmesh/pkg/fsm"
 	"github.com/dotmesh-oss/dotmesh/pkg/messaging"
 	"github.com/dotmesh-oss/dotmesh/pkg/notification"
 	"github.com/dotmesh-oss/dotmesh/pkg/observer"
+	"github.com/dotmesh-oss/dotmesh/pkg/placement"
+	"github.com/dotmesh-oss/dotmesh/pkg/pubsub"
 	"github.com/dotmesh-oss/dotmesh/pkg/registry"
 	"github.com/dotmesh-oss/dotmesh/pkg/store"
 	"github.com/dotmesh-oss/dotmesh/pkg/types"
@@ -41,6 +44,8 @@ type InMemoryState struct {
 
 	serverAddressesCache     map[string][]string
 	serverAddressesCacheLock *sync.RWMutex
+	// node labels by server ID, guarded by serverAddressesCacheLock
+	serverLabelsCache map[string]map[string]string
 
 	globalContainerCache     map[string]containerInfo
 	globalContainerCacheLock *sync.RWMutex
@@ -58,16 +63,28 @@ type InMemoryState struct {
 	localReceiveProgress       observer.Observer
 	newSnapsOnMaster           observer.Observer
 	deathObserver              observer.Observer
+	activityObserver           observer.Observer
 	registry                   registry.Registry
 	containers                 container.Client
 	containersLock             *sync.RWMutex
 	fetchRelatedContainersChan chan bool
 	interclusterTransfers      map[string]TransferPollResult
 	interclusterTransfersLock  *sync.RWMutex
+	queuedTransfers            map[string]func()
+	queuedTransfersLock        *sync.Mutex
 	globalDirtyCacheLock       *sync.RWMutex
 	globalDirtyCache           map[string]dirtyInfo
 	userManager                user.UserManager
 	publisher                  notification.Publisher
+	pubSub                     *pubsub.PubSubManager
+	commitSubscriptions        map[string]*activeCommitSubscription
+	commitSubscriptionsLock    *sync.Mutex
+	commitIndex                *commitindex.Index
+	// where scheduled backups of the KV store are kept, nil if nowhere
+	backups backupStore
+	// keys of encrypted dots given to this node, see encryptionKeyName
+	encryptionKeys     map[string]string
+	encryptionKeysLock *sync.RWMutex
 
 	debugPartialFailCreateFilesystem bool
 	debugPartialFailDelete           bool
@@ -90,7 +107,7 @@ func NewInMemoryState(config Opts) *InMemoryState {
 		os.Exit(1)
 	}
 
-	zfsInterface, err := zfs.NewZFS(config.ZFSExecPath, config.ZPoolPath, POOL, config.PoolName)
+	zfsInterface, err := zfs.NewBackend(config.Config.Filesystem.Backend, config.Config.Filesystem.Dir, config.ZFSExecPath, config.ZPoolPath, config.PoolName, MOUNT_ZFS)
 	if err != nil {
 		// CG added this one but not a fan of panicing rather than returning
 		panic(err)
@@ -103,6 +120,7 @@ func NewInMemoryState(config Opts) *InMemoryState {
 		filesystemsLock:          &sync.RWMutex{},
 		serverAddressesCache:     make(map[string][]string),
 		serverAddressesCacheLock: &sync.RWMutex{},
+		serverLabelsCache:        make(map[string]map[string]string),
 		// global container state (what containers are running where), filesystemId -> containerInfo
 		globalContainerCache:     make(map[string]containerInfo),
 		globalContainerCacheLock: &sync.RWMutex{},
@@ -120,19 +138,36 @@ func NewInMemoryState(config Opts) *InMemoryState {
 		newSnapsOnMaster:     observer.NewObserver("newSnapsOnMaster"),
 		localReceiveProgress: observer.NewObserver("localReceiveProgress"),
 		deathObserver:        observer.NewObserver("deathObserver"),
+		// everything that happens to every dot, for /events subscribers
+		activityObserver: observer.NewObserver("activityObserver"),
 		// containers that are running with dotmesh volumes by filesystem id
 		containers:     dockerClient,
 		containersLock: &sync.RWMutex{},
 		// channel to send on to hint that a new container is using a dotmesh
 		// volume
 		fetchRelatedContainersChan: make(chan bool),
-		// inter-cluster transfers are recorded here
+		// inter-cluster transfers are recorded here, and the ones started on
+		// this node that are waiting their turn are queued with what starts
+		// each one
 		interclusterTransfers:     make(map[string]TransferPollResult),
 		interclusterTransfersLock: &sync.RWMutex{},
+		queuedTransfers:           make(map[string]func()),
+		queuedTransfersLock:       &sync.Mutex{},
 		globalDirtyCacheLock:      &sync.RWMutex{},
 		globalDirtyCache:          make(map[string]dirtyInfo),
 		userManager:               config.UserManager,
 		// publisher:                 ,
+		// remote clusters' commit notifications we're acting on, by
+		// subscription id
+		pubSub:                  pubsub.NewPubSubManager(),
+		commitSubscriptions:     make(map[string]*activeCommitSubscription),
+		commitSubscriptionsLock: &sync.Mutex{},
+		// commits on every filesystem's master, for searching
+		commitIndex: commitindex.New(),
+		// keys of encrypted dots, only ever held in memory
+		encryptionKeys:     make(map[string]string),
+		encryptionKeysLock: &sync.RWMutex{},
+
 		versionInfo: &VersionInfo{InstalledVersion: serverVersion},
 		zfs:         zfsInterface,
 	}
@@ -263,6 +298,14 @@ func (s *InMemoryState) getOne(ctx context.Context, fs string) (DotmeshVolume, e
 			ForkParentId:         tlf.ForkParentId,
 			ForkParentSnapshotId: tlf.ForkParentSnapshotId,
 		}
+		d.DesignatedReplicas, err = s.DesignatedReplicas(fs)
+		if err != nil {
+			return DotmeshVolume{}, err
+		}
+		// the master says whether it has the key, when it next transitions
+		d.KeyStatus = fsm.GetMetadata(master)["keystatus"]
+		d.Encrypted = d.KeyStatus != ""
+
 		s.serverAddressesCacheLock.Lock()
 		defer s.serverAddressesCacheLock.Unlock()
 
@@ -587,7 +630,7 @@ func (state *InMemoryState) reallyProcureFilesystem(ctx context.Context, name Vo
 			}
 		}
 	} else {
-		fsMachine, ch, err := state.CreateFilesystem(ctx, &name)
+		fsMachine, ch, err := state.CreateFilesystem(ctx, &name, false)
 		if err != nil {
 			return "", err
 		}
@@ -615,7 +658,7 @@ func (state *InMemoryState) procureFilesystem(ctx context.Context, name VolumeNa
 	return s, err
 }
 
-func (s *InMemoryState) CreateFilesystem(ctx context.Context, filesystemName *VolumeName) (fsm.FSM, chan *Event, error) {
+func (s *InMemoryState) CreateFilesystem(ctx context.Context, filesystemName *VolumeName, encrypted bool) (fsm.FSM, chan *Event, error) {
 
 	// Check to see if it already partially exists, eg. in the registry but without a master
 	var filesystemId string
@@ -680,7 +723,9 @@ func (s *InMemoryState) CreateFilesystem(ctx context.Context, filesystemName *Vo
 		return nil, nil, err
 	}
 
-	ch, err := s.dispatchEvent(filesystemId, &Event{Name: "create"}, "")
+	ch, err := s.dispatchEvent(filesystemId, &Event{
+		Name: "create", Args: &EventArgs{"encrypted": encrypted},
+	}, "")
 	if err != nil {
 		log.WithFields(log.Fields{
 			"error":         err,
@@ -730,6 +775,166 @@ func (s *InMemoryState) GetReplicationLatency(fs string) map[string][]string {
 	return result
 }
 
+// notify publishes a notification about a dot in the background, filling in
+// the dot's name and who is allowed to see it.
+func (s *InMemoryState) notify(tlf types.TopLevelFilesystem, n *types.Notification) {
+	n.Namespace = tlf.MasterBranch.Name.Namespace
+	n.Name = tlf.MasterBranch.Name.Name
+	n.OwnerID = tlf.Owner.Id
+	n.CollaboratorIDs = make([]string, len(tlf.Collaborators))
+	for idx, u := range tlf.Collaborators {
+		n.CollaboratorIDs[idx] = u.Id
+	}
+
+	go func() {
+		err := s.publisher.Publish(n)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error":         err,
+				"type":          n.Type,
+				"filesystem_id": n.FilesystemId,
+			}).Error("[notify] failed to publish")
+		}
+	}()
+}
+
+// Placement policy for a dot, falling back to the one for its namespace. Nil
+// means the dot is replicated to every node.
+func (s *InMemoryState) placementPolicyFor(name VolumeName) (*types.PlacementPolicy, error) {
+	for _, dotName := range []string{name.Name, ""} {
+		policy, err := s.registryStore.GetPlacementPolicy(name.Namespace, dotName)
+		if err == nil {
+			return policy, nil
+		}
+		if !store.IsKeyNotFound(err) {
+			return nil, err
+		}
+	}
+	return nil, nil
+}
+
+// knownServers returns the servers which are up, i.e. whose addresses are
+// in the KV store.
+func (s *InMemoryState) knownServers() []*types.Server {
+	s.serverAddressesCacheLock.RLock()
+	defer s.serverAddressesCacheLock.RUnlock()
+
+	servers := []*types.Server{}
+	for id, addresses := range s.serverAddressesCache {
+		if len(addresses) == 0 {
+			continue
+		}
+		servers = append(servers, &types.Server{
+			Id:        id,
+			Addresses: addresses,
+			Labels:    s.serverLabelsCache[id],
+		})
+	}
+	return servers
+}
+
+// DesignatedReplicas returns the servers which should hold a copy of
+// filesystem fs according to its dot's placement policy.
+func (s *InMemoryState) DesignatedReplicas(fs string) ([]string, error) {
+	tlf, _, err := s.registry.LookupFilesystemById(fs)
+	if err != nil {
+		return nil, err
+	}
+	policy, err := s.placementPolicyFor(tlf.MasterBranch.Name)
+	if err != nil {
+		return nil, err
+	}
+	master, err := s.registry.CurrentMasterNode(fs)
+	if err != nil {
+		// no master yet, so nobody holds the data
+		master = ""
+	}
+	// Branches are placed alongside their dot, so hash on the dot's ID
+	return placement.Replicas(policy, tlf.MasterBranch.Id, master, s.knownServers()), nil
+}
+
+// IsDesignatedReplica is consulted by filesystem machines before they pull
+// a copy of a filesystem onto this node.
+func (s *InMemoryState) IsDesignatedReplica(fs string) bool {
+	replicas, err := s.DesignatedReplicas(fs)
+	if err != nil {
+		// When in doubt, replicate, as we always did before placement
+		// policies existed.
+		log.WithFields(log.Fields{
+			"error":         err,
+			"filesystem_id": fs,
+		}).Warn("[IsDesignatedReplica] unable to evaluate placement policy, assuming this node is a replica")
+		return true
+	}
+	for _, id := range replicas {
+		if id == s.NodeID() {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns a map from commit ID to the number of servers holding it
+func (s *InMemoryState) GetReplicaCounts(fs string) map[string]int {
+	result := map[string]int{}
+
+	fsm, err := s.GetFilesystemMachine(fs)
+	if err != nil {
+		log.Errorf("[GetReplicaCounts] failed to get filesystem: %s", err)
+		return result
+	}
+
+	for _, snapshots := range fsm.ListSnapshots() {
+		for _, snapshot := range snapshots {
+			result[snapshot.Id]++
+		}
+	}
+	return result
+}
+
+// replicationPolicyFor returns the replication policy of the dot that
+// filesystem fs belongs to, or nil if it replicates asynchronously.
+func (s *InMemoryState) replicationPolicyFor(fs string) (*types.FilesystemReplicationPolicy, error) {
+	tlf, _, err := s.registry.LookupFilesystemById(fs)
+	if err != nil {
+		return nil, err
+	}
+	policy, err := s.filesystemStore.GetReplicationPolicy(tlf.MasterBranch.Id)
+	if err != nil {
+		if store.IsKeyNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return policy, nil
+}
+
+// Block until snapshotId of filesystem fs is known to be held by at least
+// policy.MinReplicas servers, or the policy's timeout expires.
+func (s *InMemoryState) waitForReplicas(fs, snapshotId string, policy *types.FilesystemReplicationPolicy) error {
+	timeout := policy.Timeout()
+	deadline := time.After(timeout)
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		replicas := s.GetReplicaCounts(fs)[snapshotId]
+		if replicas >= policy.MinReplicas {
+			return nil
+		}
+		select {
+		case <-deadline:
+			return ReplicationTimeout{
+				SnapshotId:  snapshotId,
+				Replicas:    replicas,
+				MinReplicas: policy.MinReplicas,
+				Timeout:     timeout,
+			}
+		case <-ticker.C:
+		}
+	}
+}
+
 // Volumes might be dots or branches, we get 'em all in one big list
 func (s *InMemoryState) GetListOfVolumes(ctx context.Context) ([]DotmeshVolume, error) {
 	result := []DotmeshVolume{}
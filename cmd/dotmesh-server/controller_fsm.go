@@ -1,12 +1,17 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"net/url"
+	"strconv"
 
+	dmclient "github.com/dotmesh-oss/dotmesh/pkg/client"
 	"github.com/dotmesh-oss/dotmesh/pkg/fsm"
 	"github.com/dotmesh-oss/dotmesh/pkg/store"
 	"github.com/dotmesh-oss/dotmesh/pkg/types"
+	"github.com/dotmesh-oss/dotmesh/pkg/user"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -73,10 +78,7 @@ func (s *InMemoryState) InitFilesystemMachine(filesystemId string) (fsm.FSM, err
 			NewSnapsOnMaster:          s.newSnapsOnMaster,
 			DeathObserver:             s.deathObserver,
 			FilesystemMetadataTimeout: s.opts.FilesystemMetadataTimeout,
-			ZFSPath:                   ZFS,
-			ZPoolPath:                 ZPOOL,
-			MountZFS:                  MOUNT_ZFS,
-			PoolName:                  POOL,
+			ZFS:                       s.zfs,
 		})
 
 		go s.filesystems[filesystemId].Run() // concurrently run state machine
@@ -99,7 +101,44 @@ func (s *InMemoryState) InitFilesystemMachine(filesystemId string) (fsm.FSM, err
 func (s *InMemoryState) UpdateInterclusterTransfer(transferRequestId string, pollResult types.TransferPollResult) {
 	s.interclusterTransfersLock.Lock()
 	defer s.interclusterTransfersLock.Unlock()
+	previous := s.interclusterTransfers[transferRequestId]
 	s.interclusterTransfers[transferRequestId] = pollResult
+
+	if pollResult.Status == previous.Status {
+		return
+	}
+	var notificationType types.NotificationType
+	switch pollResult.Status {
+	case "finished":
+		notificationType = types.NotificationTransferFinished
+	case "error":
+		notificationType = types.NotificationTransferFailed
+	default:
+		return
+	}
+	tlf, branch, err := s.registry.LookupFilesystemById(pollResult.FilesystemId)
+	if err != nil {
+		// e.g. a pull of a dot which isn't registered here yet
+		tlf = types.TopLevelFilesystem{
+			MasterBranch: types.DotmeshVolume{
+				Id: pollResult.FilesystemId,
+				Name: VolumeName{
+					Namespace: pollResult.LocalNamespace,
+					Name:      pollResult.LocalName,
+				},
+			},
+		}
+		branch = pollResult.LocalBranchName
+	}
+	s.notify(tlf, &types.Notification{
+		Type:         notificationType,
+		FilesystemId: pollResult.FilesystemId,
+		Branch:       branch,
+		TransferId:   transferRequestId,
+		Direction:    pollResult.Direction,
+		Peer:         pollResult.Peer,
+		Message:      pollResult.Message,
+	})
 }
 
 func (s *InMemoryState) NodeID() string {
@@ -119,6 +158,7 @@ func (s *InMemoryState) DeleteFilesystem(filesystemId string) error {
 
 	// Remove the FS from all our myriad caches
 	s.DeleteFilesystemFromMap(filesystemId)
+	s.commitIndex.Remove(filesystemId)
 
 	// Don't delete from mastersCache, because we want to be consistent wrt
 	// etcd. We can wait for etcd to tell us when filesystems/masters gets
@@ -289,6 +329,38 @@ func (s *InMemoryState) AddressesForServer(server string) []string {
 	return addresses
 }
 
+// nodeUrl is where to reach another node of the cluster, to proxy a request
+// to it
+func (s *InMemoryState) nodeUrl(node string) (string, error) {
+	admin, err := s.userManager.Get(&user.Query{Ref: "admin"})
+	if err != nil {
+		return "", fmt.Errorf("Can't get API key to call node %s: %+v", node, err)
+	}
+	return dmclient.DeduceUrl(context.Background(), s.AddressesForServer(node), "internal", "admin", admin.ApiKey)
+}
+
+// nodeClient returns a client for calling RPCs on another node of the
+// cluster as admin
+func (s *InMemoryState) nodeClient(node string) (*dmclient.JsonRpcClient, error) {
+	target, err := s.nodeUrl(node)
+	if err != nil {
+		return nil, err
+	}
+	admin, err := s.userManager.Get(&user.Query{Ref: "admin"})
+	if err != nil {
+		return nil, fmt.Errorf("Can't get API key to call node %s: %+v", node, err)
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(u.Port())
+	if err != nil {
+		return nil, fmt.Errorf("Can't tell which port node %s is on from %s", node, target)
+	}
+	return dmclient.NewJsonRpcClient("admin", u.Hostname(), admin.ApiKey, port), nil
+}
+
 func (s *InMemoryState) RegisterNewFork(originFilesystemId, originSnapshotId, forkNamespace, forkName, forkFilesystemId string) error {
 	_, err := s.registryStore.GetFilesystem(forkNamespace, forkName)
 	switch {
@@ -300,7 +372,11 @@ func (s *InMemoryState) RegisterNewFork(originFilesystemId, originSnapshotId, fo
 		return fmt.Errorf("The name %s/%s is already in use", forkNamespace, forkName)
 	}
 
-	err = s.registry.RegisterFork(originFilesystemId, originSnapshotId, VolumeName{Namespace: forkNamespace, Name: forkName}, forkFilesystemId)
+	keyOf, err := s.forkEncryptionKeyOf(originFilesystemId)
+	if err != nil {
+		return err
+	}
+	err = s.registry.RegisterFork(originFilesystemId, originSnapshotId, VolumeName{Namespace: forkNamespace, Name: forkName}, forkFilesystemId, keyOf)
 	if err != nil {
 		return err
 	}
@@ -318,3 +394,27 @@ func (s *InMemoryState) RegisterNewFork(originFilesystemId, originSnapshotId, fo
 
 	return nil
 }
+
+// controlLocalTransfer finds the state machine running a transfer on this
+// node, and has it cancel, pause or resume it
+func (s *InMemoryState) controlLocalTransfer(transferId, action string) error {
+	queued, err := s.controlQueuedTransfer(transferId, action)
+	if queued {
+		return err
+	}
+
+	s.filesystemsLock.RLock()
+	machines := []fsm.FSM{}
+	for _, machine := range s.filesystems {
+		machines = append(machines, machine)
+	}
+	s.filesystemsLock.RUnlock()
+
+	for _, machine := range machines {
+		err := machine.ControlTransfer(transferId, action)
+		if err != fsm.ErrNoSuchTransfer {
+			return err
+		}
+	}
+	return fmt.Errorf("Transfer %s isn't running on this node (%s)", transferId, s.NodeID())
+}
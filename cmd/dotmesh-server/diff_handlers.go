@@ -37,6 +37,12 @@ func NewDiffHandler(state *InMemoryState) http.Handler {
 }
 
 func (h *DiffHandler) Director(req *http.Request) {
+	proxyToAddressInContext(req)
+}
+
+// proxyToAddressInContext points a request being reverse proxied at the
+// address set with ctxSetAddress
+func proxyToAddressInContext(req *http.Request) {
 	target, ok := ctxGetAddress(req.Context())
 	if !ok || target == "" {
 		log.WithFields(log.Fields{
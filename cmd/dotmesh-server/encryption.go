@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/dotmesh-oss/dotmesh/pkg/types"
+	"github.com/dotmesh-oss/dotmesh/pkg/zfs"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// encryptionKeyName is what the key of a dot is known as, "namespace/name",
+// or of a namespace if name is "", "namespace". It's also where the key is
+// found in the key directory, with ".key" on the end.
+func encryptionKeyName(namespace, name string) string {
+	if name == "" {
+		return namespace
+	}
+	return namespace + "/" + name
+}
+
+// holdEncryptionKey keeps a key in memory on this node, or forgets it if key
+// is ""
+func (s *InMemoryState) holdEncryptionKey(namespace, name, key string) {
+	s.encryptionKeysLock.Lock()
+	defer s.encryptionKeysLock.Unlock()
+	if key == "" {
+		delete(s.encryptionKeys, encryptionKeyName(namespace, name))
+		return
+	}
+	s.encryptionKeys[encryptionKeyName(namespace, name)] = key
+}
+
+// encryptionKeyFor finds the key of a dot: its own, given to this node or in
+// the key directory, and failing that its namespace's.
+func (s *InMemoryState) encryptionKeyFor(name VolumeName) (string, error) {
+	for _, keyName := range []string{
+		encryptionKeyName(name.Namespace, name.Name),
+		encryptionKeyName(name.Namespace, ""),
+	} {
+		s.encryptionKeysLock.RLock()
+		key, ok := s.encryptionKeys[keyName]
+		s.encryptionKeysLock.RUnlock()
+		if ok {
+			return key, nil
+		}
+
+		keyDir := s.serverConfig.Encryption.KeyDir
+		if keyDir == "" {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(keyDir, keyName+".key"))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		key, err = zfs.NormalizeEncryptionKey(string(data))
+		if err != nil {
+			return "", fmt.Errorf("Bad encryption key for %s in %s: %s", keyName, keyDir, err)
+		}
+		return key, nil
+	}
+	return "", fmt.Errorf(
+		"No encryption key for %s on node %s, set one with 'dm dot set-key'",
+		name, s.NodeID(),
+	)
+}
+
+// EncryptionKey is consulted by filesystem machines for the key of an
+// encrypted filesystem, which is its dot's, as branches share it, or for a
+// fork the key of the dot it was forked from.
+func (s *InMemoryState) EncryptionKey(filesystemId string) (string, error) {
+	tlf, _, err := s.registry.LookupFilesystemById(filesystemId)
+	if err != nil {
+		return "", err
+	}
+	if tlf.EncryptionKeyOf != nil {
+		return s.encryptionKeyFor(*tlf.EncryptionKeyOf)
+	}
+	return s.encryptionKeyFor(tlf.MasterBranch.Name)
+}
+
+// forkEncryptionKeyOf says which dot's key a fork of originFilesystemId will
+// be encrypted with, or nil if it isn't encrypted. Forks are raw sends, which
+// keep the key they're sent with rather than taking their new namespace's.
+func (s *InMemoryState) forkEncryptionKeyOf(originFilesystemId string) (*VolumeName, error) {
+	status, err := s.zfs.KeyStatus(originFilesystemId)
+	if err != nil {
+		return nil, err
+	}
+	if status == "" {
+		return nil, nil
+	}
+	tlf, _, err := s.registry.LookupFilesystemById(originFilesystemId)
+	if err != nil {
+		return nil, err
+	}
+	if tlf.EncryptionKeyOf != nil {
+		// a fork of a fork
+		return tlf.EncryptionKeyOf, nil
+	}
+	name := tlf.MasterBranch.Name
+	return &name, nil
+}
+
+// setEncryptionKey holds a key on this node and every other node of the
+// cluster, so that whichever becomes a dot's master can load it.
+func (s *InMemoryState) setEncryptionKey(ctx context.Context, key types.EncryptionKey) error {
+	s.holdEncryptionKey(key.Namespace, key.Name, key.Key)
+
+	failed := []string{}
+	for _, server := range s.knownServers() {
+		if server.Id == s.NodeID() {
+			continue
+		}
+		err := func() error {
+			client, err := s.nodeClient(server.Id)
+			if err != nil {
+				return err
+			}
+			var result bool
+			return client.CallRemote(ctx, "DotmeshRPC.HoldEncryptionKey", key, &result)
+		}()
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error":  err,
+				"server": server.Id,
+			}).Error("[setEncryptionKey] unable to give the key to node")
+			failed = append(failed, server.Id)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf(
+			"The key is held on %s, but couldn't be given to %s; try again",
+			s.NodeID(), strings.Join(failed, ", "),
+		)
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/dotmesh-oss/dotmesh/pkg/auth"
+	"github.com/dotmesh-oss/dotmesh/pkg/types"
+	"github.com/dotmesh-oss/dotmesh/pkg/user"
+	"github.com/dotmesh-oss/dotmesh/pkg/zfs"
+)
+
+func Test_encryptionKeyFor(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dotmesh-keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	backend, err := zfs.NewBackend("directory", filepath.Join(dir, "pool"), "", "", "pool", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &InMemoryState{
+		zfs:                backend,
+		encryptionKeys:     map[string]string{},
+		encryptionKeysLock: &sync.RWMutex{},
+	}
+	s.serverConfig.Encryption.KeyDir = filepath.Join(dir, "keys")
+
+	fileKey := strings.Repeat("ab", 32)
+	memoryKey := strings.Repeat("cd", 32)
+	err = os.MkdirAll(filepath.Join(dir, "keys", "alice"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, "keys", "alice.key"), []byte(fileKey+"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(name types.VolumeName, expected string) {
+		t.Helper()
+		key, err := s.encryptionKeyFor(name)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if key != expected {
+			t.Errorf("%s: expected key %s, got %s", name, expected, key)
+		}
+	}
+	dot := types.VolumeName{Namespace: "alice", Name: "dot"}
+
+	// the namespace's key, from the key directory
+	check(dot, fileKey)
+
+	// the dot's own key wins
+	s.holdEncryptionKey("alice", "dot", memoryKey)
+	check(dot, memoryKey)
+	check(types.VolumeName{Namespace: "alice", Name: "other"}, fileKey)
+
+	s.holdEncryptionKey("alice", "dot", "")
+	check(dot, fileKey)
+
+	_, err = s.encryptionKeyFor(types.VolumeName{Namespace: "bob", Name: "dot"})
+	if err == nil {
+		t.Errorf("expected no key for bob/dot")
+	}
+
+	err = ioutil.WriteFile(filepath.Join(dir, "keys", "alice", "dot.key"), []byte("not a key"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.encryptionKeyFor(dot)
+	if err == nil {
+		t.Errorf("expected a bad key file to be an error")
+	}
+}
+
+func TestSetEncryptionKeyByNamespace(t *testing.T) {
+	s, alice, bob := newTestStateWithDots(t)
+	s.encryptionKeys = map[string]string{}
+	s.encryptionKeysLock = &sync.RWMutex{}
+	s.serverAddressesCacheLock = &sync.RWMutex{}
+	d := NewDotmeshRPC(s, s.userManager)
+	key := strings.Repeat("ab", 32)
+
+	set := func(u *user.User, namespace string) error {
+		r := auth.SetAuthenticationDetails(httptest.NewRequest("POST", "/rpc", nil), u, user.AuthenticationTypeAPIKey)
+		var result bool
+		return d.SetEncryptionKey(r, &types.EncryptionKey{Namespace: namespace, Name: "data", Key: key}, &result)
+	}
+	if err := set(alice, "alice"); err != nil {
+		t.Errorf("expected alice to set keys in her namespace, got %s", err)
+	}
+	if err := set(bob, "alice"); err == nil {
+		t.Error("expected bob not to set keys in alice's namespace")
+	}
+	if err := set(&user.User{Id: user.ADMIN_USER_UUID, Name: "admin"}, "bob"); err != nil {
+		t.Errorf("expected the admin user to set keys anywhere, got %s", err)
+	}
+
+	// only nodes hold keys for each other
+	r := auth.SetAuthenticationDetails(httptest.NewRequest("POST", "/rpc", nil), alice, user.AuthenticationTypeAPIKey)
+	var result bool
+	err := d.HoldEncryptionKey(r, &types.EncryptionKey{Namespace: "alice", Name: "data", Key: key}, &result)
+	if err == nil {
+		t.Error("expected alice not to hold keys on nodes directly")
+	}
+}
+
+func TestEncryptionKeyOfFork(t *testing.T) {
+	s, _, bob := newTestStateWithDots(t)
+	s.encryptionKeys = map[string]string{}
+	s.encryptionKeysLock = &sync.RWMutex{}
+	aliceKey := strings.Repeat("ab", 32)
+	bobKey := strings.Repeat("cd", 32)
+	s.holdEncryptionKey("alice", "data", aliceKey)
+	s.holdEncryptionKey("bob", "", bobKey)
+
+	// forked from alice/data into bob's namespace, which has a key of its own
+	err := s.registry.UpdateFilesystemFromEtcd(
+		types.VolumeName{Namespace: "bob", Name: "fork"},
+		types.RegistryFilesystem{
+			Id: "fork-fs", OwnerId: bob.Id, ForkParentId: "alice-fs",
+			EncryptionKeyOf: &types.VolumeName{Namespace: "alice", Name: "data"},
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id, expected := range map[string]string{"fork-fs": aliceKey, "bob-fs": bobKey} {
+		key, err := s.EncryptionKey(id)
+		if err != nil {
+			t.Fatalf("%s: %s", id, err)
+		}
+		if key != expected {
+			t.Errorf("%s: expected key %s, got %s", id, expected, key)
+		}
+	}
+}
@@ -18,6 +18,7 @@ import (
 	"github.com/portworx/kvdb/bolt"
 	"golang.org/x/net/context"
 
+	"github.com/dotmesh-oss/dotmesh/pkg/crypto"
 	"github.com/dotmesh-oss/dotmesh/pkg/store"
 	"github.com/dotmesh-oss/dotmesh/pkg/types"
 	"github.com/dotmesh-oss/dotmesh/pkg/user"
@@ -83,7 +84,7 @@ func getKVDBCfg() *store.KVDBConfig {
 	return cfg
 }
 
-func getKVDBStores() (store.FilesystemStore, store.RegistryStore, store.ServerStore, store.KVStoreWithIndex) {
+func getKVDBStores(keyring *crypto.Keyring) (store.FilesystemStore, store.RegistryStore, store.ServerStore, store.KVStoreWithIndex) {
 
 	cfg := getKVDBCfg()
 	client, err := store.NewKVDBClient(cfg)
@@ -96,6 +97,7 @@ func getKVDBStores() (store.FilesystemStore, store.RegistryStore, store.ServerSt
 	}
 
 	kvdbStore := store.NewKVDBFilesystemStore(client)
+	kvdbStore.SetKeyring(keyring)
 	kvdbIndexStore := store.NewKVDBStoreWithIndex(client, user.UsersPrefix)
 	serverStore := store.NewKVServerStore(client)
 
@@ -173,6 +175,7 @@ func (s *InMemoryState) updateAddressesInEtcd() error {
 	return s.serverStore.SetAddresses(&types.Server{
 		Addresses: addresses,
 		Id:        s.NodeID(),
+		Labels:    s.serverConfig.NodeLabels,
 	}, &store.SetOptions{
 		TTL: 60,
 	})
@@ -270,6 +273,13 @@ func (s *InMemoryState) cleanupDeletedFilesystems() error {
 				"filesystem_id": fsId,
 			}).Error("[cleanupDeletedFilesystems] failed to delete filesystem dirty info during cleanup")
 		}
+		err = s.filesystemStore.DeleteReplicationPolicy(fsId)
+		if err != nil && !store.IsKeyNotFound(err) {
+			log.WithFields(log.Fields{
+				"error":         err,
+				"filesystem_id": fsId,
+			}).Error("[cleanupDeletedFilesystems] failed to delete filesystem replication policy during cleanup")
+		}
 
 		if deletionAudit.Name.Namespace != "" && deletionAudit.Name.Name != "" {
 			// The name might be blank in the audit trail - this is used
@@ -305,6 +315,13 @@ func (s *InMemoryState) cleanupDeletedFilesystems() error {
 					if err != nil && !store.IsKeyNotFound(err) {
 						errors = append(errors, err)
 					}
+					err = s.registryStore.DeletePlacementPolicy(
+						deletionAudit.Name.Namespace,
+						deletionAudit.Name.Name,
+					)
+					if err != nil && !store.IsKeyNotFound(err) {
+						errors = append(errors, err)
+					}
 				}
 			}
 		}
@@ -420,9 +437,17 @@ func (s *InMemoryState) handleFilesystemDeletion(fda *types.FilesystemDeletionAu
 
 // make a global request, returning its id
 func (s *InMemoryState) globalFsRequestId(fs string, event *types.Event) (chan *types.Event, string, error) {
-
 	requestID := uuid.New().String()
+	responseChan, err := s.globalFsRequestWithId(fs, requestID, event)
+	if err != nil {
+		return nil, "", err
+	}
+	return responseChan, requestID, nil
+}
 
+// globalFsRequestWithId is globalFsRequestId for a request whose id has
+// already been handed out, e.g. a queued transfer's
+func (s *InMemoryState) globalFsRequestWithId(fs, requestID string, event *types.Event) (chan *types.Event, error) {
 	event.ID = requestID
 	event.FilesystemID = fs
 
@@ -462,10 +487,10 @@ func (s *InMemoryState) globalFsRequestId(fs string, event *types.Event) (chan *
 			"filesystem_id": fs,
 			"request_id":    requestID,
 		}).Errorf("[globalFsRequest] error dispatching event %s: %s", event, err)
-		return nil, "", err
+		return nil, err
 	}
 
-	return responseChan, requestID, nil
+	return responseChan, nil
 }
 
 // attempt to register an event in etcd upon which the current master for that
@@ -533,6 +558,7 @@ func (s *InMemoryState) UpdateSnapshotsFromKnownState(server, filesystem string,
 	}
 
 	if masterNode == server {
+		s.commitIndex.Update(filesystem, snapshots)
 		if len(snapshots) > 0 {
 			// notify any interested parties that there are some new snapshots on
 			// the master
@@ -548,6 +574,17 @@ func (s *InMemoryState) UpdateSnapshotsFromKnownState(server, filesystem string,
 
 				namespace := tlf.MasterBranch.Name.Namespace
 				name := tlf.MasterBranch.Name.Name
+
+				for _, ss := range snapshots[len(oldSnapshots):] {
+					s.publishActivity(&types.ActivityEvent{
+						Type:         types.ActivityCommit,
+						FilesystemId: filesystem,
+						Server:       server,
+						CommitId:     ss.Id,
+						Metadata:     ss.Metadata,
+					})
+				}
+
 				go func() {
 					for _, ss := range snapshots[len(oldSnapshots):] {
 						collaborators := make([]string, len(tlf.Collaborators))
@@ -754,6 +791,13 @@ func (s *InMemoryState) fetchAndWatchEtcd() error {
 		}).Error("failed to create initial admin")
 	}
 
+	err = s.protectSecrets()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Error("failed to protect secrets in the KV store")
+	}
+
 	// now that our state is initialized, maybe we're in a good place to
 	// interrogate docker for running containers as part of initial
 	// bootstrap, and also start the docker plugin
@@ -764,9 +808,12 @@ func (s *InMemoryState) fetchAndWatchEtcd() error {
 	// before we're fully up.
 	log.Info("starting RPC endpoints")
 	onceAgain.Do(func() {
+		// before the RPC server can queue anything
+		go s.runTransferQueue()
 		go s.runServer()
 		go s.runUnixDomainServer()
 		go s.runPlugin()
+		go s.runCommitSubscriptions()
 	})
 	log.Info("RPC endpoints started")
 
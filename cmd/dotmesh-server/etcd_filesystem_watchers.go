@@ -55,6 +55,25 @@ func (s *InMemoryState) processFilesystemMaster(fm *types.FilesystemMaster) erro
 			}).Info("[processFilesystemMaster] updating registry master record")
 			s.registry.SetMasterNode(fm.FilesystemID, fm.NodeID)
 
+			// the commits worth searching are the new master's
+			if fsm, err := s.GetFilesystemMachine(fm.FilesystemID); err == nil {
+				s.commitIndex.Update(fm.FilesystemID, fsm.GetSnapshots(fm.NodeID))
+			}
+
+			// Only the new master announces the change, so that it is
+			// announced once rather than by every node
+			if ok && fm.NodeID != "" && fm.NodeID == s.NodeID() && fm.Meta.Action != types.KVGet {
+				tlf, branch, err := s.registry.LookupFilesystemById(fm.FilesystemID)
+				if err == nil {
+					s.notify(tlf, &types.Notification{
+						Type:         types.NotificationMasterChanged,
+						FilesystemId: fm.FilesystemID,
+						Branch:       branch,
+						Server:       fm.NodeID,
+					})
+				}
+			}
+
 			err := s.handleFilesystemMaster(fm)
 			if err != nil {
 				log.WithFields(log.Fields{
@@ -145,11 +164,21 @@ func (s *InMemoryState) processDirtyFilesystems(fd *types.FilesystemDirty) error
 	case types.KVDelete:
 		delete(s.globalDirtyCache, fd.FilesystemID)
 	case types.KVGet, types.KVCreate, types.KVSet:
+		previous, ok := s.globalDirtyCache[fd.FilesystemID]
 		s.globalDirtyCache[fd.FilesystemID] = dirtyInfo{
 			Server:     fd.NodeID,
 			DirtyBytes: fd.DirtyBytes,
 			SizeBytes:  fd.SizeBytes,
 		}
+		if !ok || previous.DirtyBytes != fd.DirtyBytes || previous.SizeBytes != fd.SizeBytes {
+			s.publishActivity(&types.ActivityEvent{
+				Type:         types.ActivityDirty,
+				FilesystemId: fd.FilesystemID,
+				Server:       fd.NodeID,
+				DirtyBytes:   fd.DirtyBytes,
+				SizeBytes:    fd.SizeBytes,
+			})
+		}
 	}
 	return nil
 }
@@ -220,6 +249,15 @@ func (s *InMemoryState) processTransferPollResults(t *types.TransferPollResult)
 		delete(s.interclusterTransfers, t.TransferRequestId)
 	case types.KVGet, types.KVCreate, types.KVSet:
 		s.interclusterTransfers[t.TransferRequestId] = *t
+
+		transfer := *t
+		s.publishActivity(&types.ActivityEvent{
+			Type:         types.ActivityTransfer,
+			FilesystemId: t.FilesystemId,
+			Server:       t.InitiatorNodeId,
+			Status:       t.Status,
+			Transfer:     &transfer,
+		})
 	}
 	return
 }
@@ -44,7 +44,12 @@ func (s *InMemoryState) processRegistryFilesystem(rf *types.RegistryFilesystem)
 		s.registry.DeleteFilesystemFromEtcd(vn)
 		return nil
 	case types.KVGet, types.KVCreate, types.KVSet:
-		return s.registry.UpdateFilesystemFromEtcd(vn, *rf)
+		err := s.registry.UpdateFilesystemFromEtcd(vn, *rf)
+		if err != nil {
+			return err
+		}
+		s.recordRegistryProperties(rf.Id)
+		return nil
 	default:
 		return nil
 	}
@@ -76,6 +81,7 @@ func (s *InMemoryState) processRegistryClone(c *types.Clone) error {
 		s.registry.DeleteCloneFromEtcd(c.Name, c.FilesystemId)
 	case types.KVGet, types.KVCreate, types.KVSet:
 		s.registry.UpdateCloneFromEtcd(c.Name, c.FilesystemId, *c)
+		s.recordRegistryProperties(c.FilesystemId)
 	}
 	return nil
 }
@@ -31,8 +31,15 @@ func (s *InMemoryState) watchServerAddresses() error {
 
 func (s *InMemoryState) processServerAddress(srv *types.Server) {
 	s.serverAddressesCacheLock.Lock()
+	defer s.serverAddressesCacheLock.Unlock()
+	if srv.Meta != nil && (srv.Meta.Action == types.KVDelete || srv.Meta.Action == types.KVExpire) {
+		// the server has gone, or stopped refreshing its addresses
+		delete(s.serverAddressesCache, srv.Id)
+		delete(s.serverLabelsCache, srv.Id)
+		return
+	}
 	s.serverAddressesCache[srv.Id] = srv.Addresses
-	s.serverAddressesCacheLock.Unlock()
+	s.serverLabelsCache[srv.Id] = srv.Labels
 }
 
 func (s *InMemoryState) watchServerStates() error {
@@ -89,6 +96,16 @@ func (s *InMemoryState) processServerState(ss *types.ServerState) error {
 		ss.State["version"] = fmt.Sprintf("%d", ss.Meta.ModifiedIndex)
 		fsm.SetMetadata(ss.ID, ss.State)
 
+		// Every machine's transitions are echoed here via the KV store, so
+		// this covers the whole cluster rather than just this node
+		s.publishActivity(&types.ActivityEvent{
+			Type:         types.ActivityTransition,
+			FilesystemId: ss.FilesystemID,
+			Server:       ss.ID,
+			State:        ss.State["state"],
+			Status:       ss.State["status"],
+		})
+
 		return nil
 	default:
 		// not interested
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/dotmesh-oss/dotmesh/pkg/types"
+)
+
+func Test_processServerAddress(t *testing.T) {
+	s := &InMemoryState{
+		serverAddressesCache:     map[string][]string{},
+		serverAddressesCacheLock: &sync.RWMutex{},
+		serverLabelsCache:        map[string]map[string]string{},
+	}
+	up := func(id string) *types.Server {
+		return &types.Server{
+			Id:        id,
+			Addresses: []string{"10.0.0.1"},
+			Labels:    map[string]string{"zone": id},
+			Meta:      &types.KVMeta{Action: types.KVSet},
+		}
+	}
+	s.processServerAddress(up("a"))
+	s.processServerAddress(up("b"))
+	s.processServerAddress(up("c"))
+	s.processServerAddress(&types.Server{Id: "d", Meta: &types.KVMeta{Action: types.KVSet}})
+
+	s.processServerAddress(&types.Server{Id: "b", Meta: &types.KVMeta{Action: types.KVDelete}})
+	s.processServerAddress(&types.Server{Id: "c", Meta: &types.KVMeta{Action: types.KVExpire}})
+
+	known := s.knownServers()
+	if len(known) != 1 || known[0].Id != "a" || known[0].Labels["zone"] != "a" {
+		t.Errorf("expected only server a to be known, got %+v", known)
+	}
+	if _, ok := s.serverLabelsCache["b"]; ok {
+		t.Errorf("expected the labels of a deleted server to be forgotten")
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/dotmesh-oss/dotmesh/pkg/auth"
+	"github.com/dotmesh-oss/dotmesh/pkg/timeutil"
+	"github.com/dotmesh-oss/dotmesh/pkg/types"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const activityEvent = "activity"
+
+// how often to write a comment to idle streams, so that proxies don't time
+// them out
+const eventsKeepaliveInterval = 15 * time.Second
+
+// publishActivity tells /events subscribers about something that happened to
+// a filesystem, filling in the dot and branch it belongs to.
+func (s *InMemoryState) publishActivity(e *types.ActivityEvent) {
+	if e.Timestamp == 0 {
+		e.Timestamp = timeutil.Now().UnixNano()
+	}
+	tlf, branch, err := s.registry.LookupFilesystemById(e.FilesystemId)
+	if err == nil {
+		e.Namespace = tlf.MasterBranch.Name.Namespace
+		e.Name = tlf.MasterBranch.Name.Name
+		e.Branch = branch
+	}
+	if e.Branch == "" {
+		e.Branch = DEFAULT_BRANCH
+	}
+	err = s.activityObserver.Publish(activityEvent, e)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error":         err,
+			"filesystem_id": e.FilesystemId,
+		}).Error("[publishActivity] failed to publish")
+	}
+}
+
+// EventsHandler streams dot activity to clients as server-sent events,
+// optionally filtered by the namespace, name and branch query parameters,
+// and by the comma separated types parameter.
+type EventsHandler struct {
+	state *InMemoryState
+}
+
+func NewEventsHandler(state *InMemoryState) http.Handler {
+	return &EventsHandler{
+		state: state,
+	}
+}
+
+type eventsFilter struct {
+	namespace string
+	name      string
+	branch    string
+	types     map[types.ActivityType]bool
+}
+
+func (f *eventsFilter) matches(e *types.ActivityEvent) bool {
+	if f.namespace != "" && f.namespace != e.Namespace {
+		return false
+	}
+	if f.name != "" && f.name != e.Name {
+		return false
+	}
+	if f.branch != "" && f.branch != e.Branch {
+		return false
+	}
+	if len(f.types) > 0 && !f.types[e.Type] {
+		return false
+	}
+	return true
+}
+
+func (h *EventsHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	flusher, ok := resp.(http.Flusher)
+	if !ok {
+		http.Error(resp, "Streaming unsupported.", http.StatusInternalServerError)
+		return
+	}
+
+	user := auth.GetUser(req)
+	if user == nil {
+		http.Error(resp, "Unauthorized.", http.StatusUnauthorized)
+		return
+	}
+
+	query := req.URL.Query()
+	filter := &eventsFilter{
+		namespace: query.Get("namespace"),
+		name:      query.Get("name"),
+		branch:    query.Get("branch"),
+		types:     map[types.ActivityType]bool{},
+	}
+	for _, t := range strings.Split(query.Get("types"), ",") {
+		if t != "" {
+			filter.types[types.ActivityType(t)] = true
+		}
+	}
+
+	// decisions are cached for the life of the stream, a collaborator
+	// removed from a dot needs to reconnect to notice
+	authorized := map[string]bool{}
+	isAuthorized := func(filesystemId string) bool {
+		allowed, ok := authorized[filesystemId]
+		if ok {
+			return allowed
+		}
+		tlf, _, err := h.state.registry.LookupFilesystemById(filesystemId)
+		if err == nil {
+			allowed, err = h.state.userManager.Authorize(user, true, &tlf)
+		}
+		if err != nil {
+			// maybe not registered yet, so don't cache the answer
+			return false
+		}
+		authorized[filesystemId] = allowed
+		return allowed
+	}
+
+	events := make(chan interface{}, 64)
+	h.state.activityObserver.Subscribe(activityEvent, events)
+	defer h.state.activityObserver.Unsubscribe(activityEvent, events)
+
+	keepalive := time.NewTicker(eventsKeepaliveInterval)
+	defer keepalive.Stop()
+
+	resp.Header().Set("Content-Type", "text/event-stream")
+	resp.Header().Set("Cache-Control", "no-cache")
+	resp.Header().Set("Connection", "keep-alive")
+	resp.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+		case <-keepalive.C:
+			_, err := fmt.Fprintf(resp, ": keepalive\n\n")
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+		case data := <-events:
+			e, ok := data.(*types.ActivityEvent)
+			if !ok || !filter.matches(e) || !isAuthorized(e.FilesystemId) {
+				continue
+			}
+			if e.Transfer != nil && e.Transfer.ApiKey != "" {
+				// never hand out the credentials a transfer was started with
+				transfer := *e.Transfer
+				transfer.ApiKey = ""
+				copied := *e
+				copied.Transfer = &transfer
+				e = &copied
+			}
+			encoded, err := json.Marshal(e)
+			if err != nil {
+				log.WithFields(log.Fields{
+					"error": err,
+				}).Error("[EventsHandler] failed to encode event")
+				continue
+			}
+			_, err = fmt.Fprintf(resp, "event: %s\ndata: %s\n\n", e.Type, encoded)
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
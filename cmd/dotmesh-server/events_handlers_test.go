@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dotmesh-oss/dotmesh/pkg/auth"
+	"github.com/dotmesh-oss/dotmesh/pkg/observer"
+	"github.com/dotmesh-oss/dotmesh/pkg/registry"
+	"github.com/dotmesh-oss/dotmesh/pkg/store"
+	"github.com/dotmesh-oss/dotmesh/pkg/types"
+	"github.com/dotmesh-oss/dotmesh/pkg/user"
+)
+
+// newTestStateWithDots makes a state with users alice and bob, who each own a
+// dot called data, with filesystem IDs alice-fs and bob-fs
+func newTestStateWithDots(t *testing.T) (*InMemoryState, *user.User, *user.User) {
+	client, err := store.NewKVDBClient(&store.KVDBConfig{Type: store.KVTypeMem})
+	if err != nil {
+		t.Fatalf("failed to init kv store: %s", err)
+	}
+	um := user.NewInternal(store.NewKVDBStoreWithIndex(client, user.UsersPrefix))
+	alice, err := um.New("alice", "alice@example.com", "alicepassword")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := um.New("bob", "bob@example.com", "bobpassword")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := registry.NewRegistry(um, nil)
+	for _, dot := range []struct {
+		id    string
+		owner *user.User
+	}{{"alice-fs", alice}, {"bob-fs", bob}} {
+		err = r.UpdateFilesystemFromEtcd(
+			types.VolumeName{Namespace: dot.owner.Name, Name: "data"},
+			types.RegistryFilesystem{Id: dot.id, OwnerId: dot.owner.Id},
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return &InMemoryState{
+		registry:         r,
+		userManager:      um,
+		activityObserver: observer.NewObserver("activityObserver"),
+	}, alice, bob
+}
+
+// watchEvents connects to the events stream as u, and returns the events it
+// sends
+func watchEvents(t *testing.T, s *InMemoryState, u *user.User, query string) (<-chan *types.ActivityEvent, func()) {
+	handler := NewEventsHandler(s)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler.ServeHTTP(w, auth.SetAuthenticationDetails(r, u, user.AuthenticationTypeAPIKey))
+	}))
+	resp, err := http.Get(server.URL + "/events?" + query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status %d", resp.StatusCode)
+	}
+
+	events := make(chan *types.ActivityEvent, 16)
+	go func() {
+		defer close(events)
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if !strings.HasPrefix(line, "data: ") {
+				continue
+			}
+			var e types.ActivityEvent
+			err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &e)
+			if err != nil {
+				t.Errorf("failed to decode %s: %s", line, err)
+				return
+			}
+			events <- &e
+		}
+	}()
+	return events, func() {
+		resp.Body.Close()
+		server.Close()
+	}
+}
+
+// receiveEvents waits for n events, and then a little longer to catch any
+// more that shouldn't have been sent. The observer doesn't keep events in
+// order, so they're keyed by type and commit.
+func receiveEvents(t *testing.T, events <-chan *types.ActivityEvent, n int) map[string]*types.ActivityEvent {
+	t.Helper()
+	received := map[string]*types.ActivityEvent{}
+	timeout := time.After(10 * time.Second)
+	for len(received) < n {
+		select {
+		case e := <-events:
+			if e == nil {
+				t.Fatalf("stream ended")
+			}
+			received[string(e.Type)+":"+e.CommitId] = e
+		case <-timeout:
+			t.Fatalf("timed out waiting for events, got %v", received)
+		}
+	}
+	select {
+	case e := <-events:
+		t.Errorf("unexpected event %+v", e)
+	case <-time.After(200 * time.Millisecond):
+	}
+	return received
+}
+
+func TestEventsOnlyShowDotsTheUserCanSee(t *testing.T) {
+	s, alice, bob := newTestStateWithDots(t)
+
+	aliceEvents, stopAlice := watchEvents(t, s, alice, "")
+	defer stopAlice()
+	bobEvents, stopBob := watchEvents(t, s, bob, "")
+	defer stopBob()
+
+	s.publishActivity(&types.ActivityEvent{Type: types.ActivityCommit, FilesystemId: "bob-fs", CommitId: "bobs"})
+	s.publishActivity(&types.ActivityEvent{Type: types.ActivityCommit, FilesystemId: "alice-fs", CommitId: "alices"})
+	s.publishActivity(&types.ActivityEvent{Type: types.ActivityDirty, FilesystemId: "alice-fs", DirtyBytes: 42})
+
+	received := receiveEvents(t, aliceEvents, 2)
+	if received["commit:alices"] == nil || received["dirty:"] == nil {
+		t.Errorf("expected alice to see her commit and dirty data, got %v", received)
+	}
+	received = receiveEvents(t, bobEvents, 1)
+	e := received["commit:bobs"]
+	if e == nil {
+		t.Fatalf("expected bob to see his commit, got %v", received)
+	}
+	if e.Namespace != "bob" || e.Name != "data" || e.Branch != DEFAULT_BRANCH {
+		t.Errorf("expected the commit to be on bob/data, got %+v", e)
+	}
+}
+
+func TestEventsFilter(t *testing.T) {
+	s, alice, _ := newTestStateWithDots(t)
+	admin := &user.User{Id: user.ADMIN_USER_UUID, Name: "admin"}
+
+	events, stop := watchEvents(t, s, admin, "namespace=alice&types=transfer,dirty")
+	defer stop()
+
+	s.publishActivity(&types.ActivityEvent{Type: types.ActivityDirty, FilesystemId: "bob-fs", DirtyBytes: 1})
+	s.publishActivity(&types.ActivityEvent{Type: types.ActivityCommit, FilesystemId: "alice-fs", CommitId: "alices"})
+	s.publishActivity(&types.ActivityEvent{
+		Type:         types.ActivityTransfer,
+		FilesystemId: "alice-fs",
+		Transfer:     &types.TransferPollResult{ApiKey: "secret"},
+	})
+	s.publishActivity(&types.ActivityEvent{Type: types.ActivityDirty, FilesystemId: "alice-fs", DirtyBytes: 42})
+
+	received := receiveEvents(t, events, 2)
+	if e := received["transfer:"]; e == nil || e.Namespace != alice.Name {
+		t.Errorf("expected alice's transfer, got %v", received)
+	} else if e.Transfer.ApiKey != "" {
+		t.Errorf("expected the transfer's API key to be hidden")
+	}
+	if e := received["dirty:"]; e == nil || e.Namespace != alice.Name || e.DirtyBytes != 42 {
+		t.Errorf("expected alice's dirty event, got %v", received)
+	}
+}
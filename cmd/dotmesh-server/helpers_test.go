@@ -0,0 +1,74 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/dotmesh-oss/dotmesh/pkg/fsm"
+	"github.com/dotmesh-oss/dotmesh/pkg/types"
+	"github.com/dotmesh-oss/dotmesh/pkg/zfs"
+)
+
+// snapshotsFSM is an fsMachine that only knows which snapshots each node
+// has of its filesystem
+type snapshotsFSM struct {
+	fsm.FSM
+	snapshots map[string][]*types.Snapshot
+}
+
+func (f *snapshotsFSM) GetSnapshots(node string) []*types.Snapshot {
+	return f.snapshots[node]
+}
+
+func snapshots(ids ...string) []*types.Snapshot {
+	result := []*types.Snapshot{}
+	for _, id := range ids {
+		result = append(result, &types.Snapshot{Id: id})
+	}
+	return result
+}
+
+func snapshotIds(snapshots []*types.Snapshot) []string {
+	result := []string{}
+	for _, s := range snapshots {
+		result = append(result, s.Id)
+	}
+	return result
+}
+
+// newTestDirectoryState is newTestStateWithDots on the directory backend,
+// with this node the master of each filesystem given, holding the snapshots
+// given of it. Dots are mounted under a temporary MOUNT_PREFIX.
+func newTestDirectoryState(t *testing.T, local map[string][]*types.Snapshot) *InMemoryState {
+	dir, err := ioutil.TempDir("", "dotmesh-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	previous, set := os.LookupEnv("MOUNT_PREFIX")
+	os.Setenv("MOUNT_PREFIX", filepath.Join(dir, "mnt"))
+	t.Cleanup(func() {
+		if set {
+			os.Setenv("MOUNT_PREFIX", previous)
+		} else {
+			os.Unsetenv("MOUNT_PREFIX")
+		}
+	})
+	backend, err := zfs.NewBackend("directory", filepath.Join(dir, "pool"), "", "", "pool", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, _, _ := newTestStateWithDots(t)
+	s.zfs = backend
+	s.filesystems = map[string]fsm.FSM{}
+	s.filesystemsLock = &sync.RWMutex{}
+	for id, snaps := range local {
+		s.filesystems[id] = &snapshotsFSM{snapshots: map[string][]*types.Snapshot{s.NodeID(): snaps}}
+		s.registry.SetMasterNode(id, s.NodeID())
+	}
+	return s
+}
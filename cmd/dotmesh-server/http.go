@@ -78,6 +78,11 @@ func (state *InMemoryState) runServer() {
 	// display diff since the last commit
 	router.Handle("/diff/{namespace}:{name}", Instrument(state)(NewAuthHandler(NewDiffHandler(state), state.userManager))).Methods("GET")
 	router.Handle("/diff/{namespace}:{name}/{snapshotID}", Instrument(state)(NewAuthHandler(NewDiffHandler(state), state.userManager))).Methods("GET")
+	// diff between any two commits, or a commit and a branch's working copy
+	router.Handle("/commit-diff/{namespace}:{name}", Instrument(state)(NewAuthHandler(NewCommitDiffHandler(state), state.userManager))).Methods("GET")
+
+	router.Handle("/export/{namespace}:{name}", Instrument(state)(NewAuthHandler(NewBundleExportHandler(state), state.userManager))).Methods("GET")
+	router.Handle("/import", Instrument(state)(NewAuthHandler(NewBundleImportHandler(state), state.userManager))).Methods("POST")
 
 	// list files in the latest snapshot
 	router.Handle("/s3/{namespace}:{name}", Instrument(state)(NewAuthHandler(NewS3Handler(state), state.userManager))).Methods("GET")
@@ -95,6 +100,13 @@ func (state *InMemoryState) runServer() {
 	// delete file on another branch
 	router.Handle("/s3/{namespace}:{name}@{branch}/{key:.*}", Instrument(state)(NewAuthHandler(NewS3Handler(state), state.userManager))).Methods("DELETE")
 
+	// stream of activity on every dot the user can see
+	router.Handle("/events", Instrument(state)(NewAuthHandler(NewEventsHandler(state), state.userManager))).Methods("GET")
+
+	// how to get an ID token to log in with, before there's any way to
+	// authenticate
+	router.HandleFunc("/auth/config", state.serveAuthConfig).Methods("GET")
+
 	router.HandleFunc("/check",
 		func(w http.ResponseWriter, r *http.Request) {
 			fmt.Fprintf(w, "OK")
@@ -194,6 +206,14 @@ func (irw *instrResponseWriter) WriteHeader(code int) {
 	irw.ResponseWriter.WriteHeader(code)
 }
 
+// Flush passes flushes through, so that streaming handlers work when
+// instrumented
+func (irw *instrResponseWriter) Flush() {
+	if flusher, ok := irw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
 func Instrument(state *InMemoryState) MetricsMiddleware {
 	return func(h http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/dotmesh-oss/dotmesh/pkg/config"
+	"github.com/dotmesh-oss/dotmesh/pkg/idp"
+	"github.com/dotmesh-oss/dotmesh/pkg/types"
+)
+
+// identityProviders are the identity providers the config sets up, LDAP
+// before OpenID Connect
+func identityProviders(c config.Config) ([]idp.Provider, error) {
+	providers := []idp.Provider{}
+	if c.Identity.LDAPURL != "" {
+		if strings.Count(c.Identity.LDAPUserDN, "%s") != 1 {
+			return nil, fmt.Errorf("DOTMESH_LDAP_USER_DN must have %%s where the username goes, got %q", c.Identity.LDAPUserDN)
+		}
+		providers = append(providers, &idp.LDAP{
+			URL:            c.Identity.LDAPURL,
+			UserDN:         c.Identity.LDAPUserDN,
+			GroupAttribute: c.Identity.LDAPGroupAttribute,
+		})
+	}
+	if c.Identity.OIDCIssuer != "" {
+		if c.Identity.OIDCClientID == "" {
+			return nil, fmt.Errorf("DOTMESH_OIDC_CLIENT_ID must be set with DOTMESH_OIDC_ISSUER")
+		}
+		providers = append(providers, &idp.OIDC{
+			Issuer:        c.Identity.OIDCIssuer,
+			ClientID:      c.Identity.OIDCClientID,
+			UsernameClaim: c.Identity.OIDCUsernameClaim,
+			GroupsClaim:   c.Identity.OIDCGroupsClaim,
+		})
+	}
+	return providers, nil
+}
+
+// serveAuthConfig tells clients which issuer to get an ID token from, for
+// `dm login`
+func (s *InMemoryState) serveAuthConfig(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(types.AuthConfig{
+		OIDCIssuer:   s.serverConfig.Identity.OIDCIssuer,
+		OIDCClientID: s.serverConfig.Identity.OIDCClientID,
+	})
+}
@@ -19,6 +19,7 @@ import (
 
 	"github.com/dotmesh-oss/dotmesh/pkg/client"
 	"github.com/dotmesh-oss/dotmesh/pkg/config"
+	"github.com/dotmesh-oss/dotmesh/pkg/crypto"
 	"github.com/dotmesh-oss/dotmesh/pkg/messaging/nats"
 	"github.com/dotmesh-oss/dotmesh/pkg/types"
 	"github.com/dotmesh-oss/dotmesh/pkg/user"
@@ -28,6 +29,7 @@ import (
 
 	// notification provider
 	_ "github.com/dotmesh-oss/dotmesh/pkg/notification/nats"
+	_ "github.com/dotmesh-oss/dotmesh/pkg/notification/webhook"
 
 	"github.com/opentracing/opentracing-go"
 	zipkin "github.com/openzipkin/zipkin-go-opentracing"
@@ -150,7 +152,8 @@ func main() {
 	}
 
 	zRoot := os.Getenv("ZFS_USERLAND_ROOT")
-	if zRoot == "" {
+	// only the zfs backend needs zfs
+	if zRoot == "" && serverConfig.Filesystem.Backend == types.FilesystemBackendZFS {
 		fmt.Println("Must specify ZFS_USERLAND_ROOT, e.g. /opt/zfs-0.7")
 		os.Exit(1)
 	}
@@ -160,7 +163,18 @@ func main() {
 	ips, _ := guessIPv4Addresses()
 	log.Printf("Detected my node IPs as %s", ips)
 
-	fsStore, regStore, serverStore, usersIdxStore := getKVDBStores()
+	// secrets in the KV store are encrypted with these, if there are any
+	keyring, err := crypto.LoadKeyring(serverConfig.Secrets.Key, serverConfig.Secrets.KeyFile)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Fatal("failed to load secrets keys")
+	}
+	if keyring == nil {
+		log.Warn("DOTMESH_SECRETS_KEY and DOTMESH_SECRETS_KEY_FILE aren't set, secrets will be kept in the KV store in the clear")
+	}
+
+	fsStore, regStore, serverStore, usersIdxStore := getKVDBStores(keyring)
 	inMemoryStateOpts.FilesystemStore = fsStore
 	inMemoryStateOpts.RegistryStore = regStore
 	inMemoryStateOpts.ServerStore = serverStore
@@ -181,7 +195,16 @@ func main() {
 	if inMemoryStateOpts.ExternalUserManagerURL != "" {
 		inMemoryStateOpts.UserManager = user.NewExternal(inMemoryStateOpts.ExternalUserManagerURL, nil)
 	} else {
-		inMemoryStateOpts.UserManager = user.NewInternal(usersIdxStore)
+		internalUserManager := user.NewInternal(usersIdxStore)
+		internalUserManager.SetKeyring(keyring)
+		providers, err := identityProviders(serverConfig)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+			}).Fatal("failed to set up identity providers")
+		}
+		internalUserManager.SetIdentityProviders(providers, serverConfig.Identity.GroupNamespaces)
+		inMemoryStateOpts.UserManager = internalUserManager
 	}
 
 	s := NewInMemoryState(inMemoryStateOpts)
@@ -198,6 +221,19 @@ func main() {
 		)
 	}
 
+	// keep backups of the KV store, if there's somewhere to keep them
+	backups, err := newBackupStore(serverConfig)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Fatal("failed to set up scheduled backups")
+	}
+	if backups != nil {
+		s.backups = backups
+		backupInterval := time.Duration(serverConfig.Backups.IntervalSeconds.Value()) * time.Second
+		go runForever(s.backupKV, "backupKV", 1*time.Minute, backupInterval)
+	}
+
 	go runForever(
 		s.updateAddressesInEtcd, "updateAddressesInEtcd",
 		// ttl on address keys will be 60 seconds, so update them every 30
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"sort"
+
+	"github.com/dotmesh-oss/dotmesh/pkg/store"
+	"github.com/dotmesh-oss/dotmesh/pkg/types"
+	"github.com/dotmesh-oss/dotmesh/pkg/user"
+	log "github.com/sirupsen/logrus"
+)
+
+// recordRegistryProperties has the filesystem's state machine, if it has one
+// on this node, keep its registry record with it on disk after the registry
+// changed
+func (s *InMemoryState) recordRegistryProperties(filesystemId string) {
+	s.filesystemsLock.RLock()
+	fs, ok := s.filesystems[filesystemId]
+	s.filesystemsLock.RUnlock()
+	if ok {
+		go fs.RecordRegistryProperties()
+	}
+}
+
+// recoverRegistry rebuilds the registry records and masters of the
+// filesystems in our pool from the registry properties kept with them, for
+// when the KV store has been lost. Records that still exist are left alone.
+// Filesystems without a master get the node with their latest commits, as
+// far as this node knows, so it should be run once every node holding dots
+// is up.
+func (s *InMemoryState) recoverRegistry(dryRun bool) (*types.RegistryRecovery, error) {
+	result := &types.RegistryRecovery{
+		Filesystems:          []*types.RegistryFilesystem{},
+		Clones:               []*types.Clone{},
+		Masters:              []*types.FilesystemMaster{},
+		Unrecorded:           []string{},
+		Diverged:             []string{},
+		MissingUsers:         []string{},
+		MissingOrganizations: []string{},
+	}
+
+	clones, err := s.registryStore.ListClones()
+	if err != nil {
+		return nil, err
+	}
+	existingClones := map[string]bool{}
+	for _, c := range clones {
+		existingClones[c.TopLevelFilesystemId+"/"+c.Name] = true
+	}
+	missingUsers := map[string]bool{}
+	missingOrganizations := map[string]bool{}
+
+	for _, filesystemId := range s.zfs.FindFilesystemIdsOnSystem() {
+		properties, err := s.zfs.GetRegistryProperties(filesystemId)
+		if err != nil {
+			return nil, err
+		}
+		if properties == nil || (properties.Filesystem == nil && properties.Clone == nil) {
+			result.Unrecorded = append(result.Unrecorded, filesystemId)
+			continue
+		}
+
+		if rf := properties.Filesystem; rf != nil {
+			_, err := s.registryStore.GetFilesystem(rf.OwnerId, rf.Name)
+			if err != nil && !store.IsKeyNotFound(err) {
+				return nil, err
+			}
+			if store.IsKeyNotFound(err) {
+				if !dryRun {
+					err = s.registryStore.SetFilesystem(rf, &store.SetOptions{})
+					if err != nil && !store.IsKeyAlreadyExist(err) {
+						return nil, err
+					}
+				}
+				result.Filesystems = append(result.Filesystems, rf)
+				_, err = s.userManager.Get(&user.Query{Ref: rf.OwnerId})
+				if err != nil && properties.Organization {
+					missingOrganizations[rf.OwnerId] = true
+				} else if err != nil {
+					missingUsers[rf.OwnerId] = true
+				}
+			}
+		}
+
+		if c := properties.Clone; c != nil && !existingClones[c.TopLevelFilesystemId+"/"+c.Name] {
+			if !dryRun {
+				err = s.registryStore.SetClone(c, &store.SetOptions{})
+				if err != nil && !store.IsKeyAlreadyExist(err) {
+					return nil, err
+				}
+			}
+			result.Clones = append(result.Clones, c)
+		}
+
+		_, err = s.filesystemStore.GetMaster(filesystemId)
+		if err != nil && !store.IsKeyNotFound(err) {
+			return nil, err
+		}
+		if store.IsKeyNotFound(err) {
+			master, err := s.recoveredMaster(filesystemId)
+			if err != nil {
+				return nil, err
+			}
+			if master == "" {
+				result.Diverged = append(result.Diverged, filesystemId)
+				continue
+			}
+			fm := &types.FilesystemMaster{
+				FilesystemID: filesystemId,
+				NodeID:       master,
+			}
+			if !dryRun {
+				err = s.filesystemStore.SetMaster(fm, &store.SetOptions{})
+				if err != nil && !store.IsKeyAlreadyExist(err) {
+					return nil, err
+				}
+			}
+			result.Masters = append(result.Masters, fm)
+		}
+	}
+
+	for owner := range missingUsers {
+		result.MissingUsers = append(result.MissingUsers, owner)
+	}
+	sort.Strings(result.MissingUsers)
+	for owner := range missingOrganizations {
+		result.MissingOrganizations = append(result.MissingOrganizations, owner)
+	}
+	sort.Strings(result.MissingOrganizations)
+
+	log.WithFields(log.Fields{
+		"dry_run":     dryRun,
+		"filesystems": len(result.Filesystems),
+		"clones":      len(result.Clones),
+		"masters":     len(result.Masters),
+		"unrecorded":  len(result.Unrecorded),
+		"diverged":    len(result.Diverged),
+	}).Info("[recoverRegistry] recovered registry from the pool")
+	return result, nil
+}
+
+// recoveredMaster picks the master of a filesystem in our pool that has
+// none, from the commits each node is known to have of it, or "" if their
+// copies have diverged
+func (s *InMemoryState) recoveredMaster(filesystemId string) (string, error) {
+	filesystem, err := s.zfs.DiscoverSystem(filesystemId)
+	if err != nil {
+		return "", err
+	}
+	local := []string{}
+	for _, snapshot := range filesystem.Snapshots {
+		local = append(local, snapshot.Id)
+	}
+	commits := map[string][]string{s.NodeID(): local}
+	for _, server := range s.knownServers() {
+		if server.Id == s.NodeID() {
+			continue
+		}
+		snapshots, err := s.SnapshotsFor(server.Id, filesystemId)
+		if err != nil || len(snapshots) == 0 {
+			continue
+		}
+		ids := []string{}
+		for _, snapshot := range snapshots {
+			ids = append(ids, snapshot.Id)
+		}
+		commits[server.Id] = ids
+	}
+	return electMaster(s.NodeID(), commits), nil
+}
+
+// electMaster picks the node whose commits every other node's are the start
+// of, so that the rest can catch up with it, preferring self when several
+// nodes have the same commits. It's "" if no node's commits include all the
+// others', so that which to keep is left to an administrator.
+func electMaster(self string, commits map[string][]string) string {
+	nodes := []string{}
+	for node := range commits {
+		nodes = append(nodes, node)
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		a, b := nodes[i], nodes[j]
+		if len(commits[a]) != len(commits[b]) {
+			return len(commits[a]) > len(commits[b])
+		}
+		if (a == self) != (b == self) {
+			return a == self
+		}
+		return a < b
+	})
+	if len(nodes) == 0 {
+		return ""
+	}
+	latest := commits[nodes[0]]
+	for _, node := range nodes[1:] {
+		for i, id := range commits[node] {
+			if latest[i] != id {
+				return ""
+			}
+		}
+	}
+	return nodes[0]
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/dotmesh-oss/dotmesh/pkg/store"
+	"github.com/dotmesh-oss/dotmesh/pkg/types"
+)
+
+func Test_electMaster(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		commits  map[string][]string
+		expected string
+	}{
+		{name: "only here", commits: map[string][]string{"self": {"a"}}, expected: "self"},
+		{
+			name:     "another node is ahead",
+			commits:  map[string][]string{"self": {"a", "b"}, "other": {"a", "b", "c"}},
+			expected: "other",
+		},
+		{
+			name:     "this node is ahead",
+			commits:  map[string][]string{"self": {"a", "b"}, "other": {"a"}},
+			expected: "self",
+		},
+		{
+			name:     "the same commits everywhere",
+			commits:  map[string][]string{"b-node": {"a"}, "self": {"a"}, "a-node": {"a"}},
+			expected: "self",
+		},
+		{
+			name:     "the same commits elsewhere",
+			commits:  map[string][]string{"self": {}, "b-node": {"a"}, "a-node": {"a"}},
+			expected: "a-node",
+		},
+		{
+			name:    "diverged",
+			commits: map[string][]string{"self": {"a", "b"}, "other": {"a", "x"}},
+		},
+		{
+			name:    "diverged behind",
+			commits: map[string][]string{"self": {"a", "b", "c"}, "other": {"x"}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := electMaster("self", tc.commits); got != tc.expected {
+				t.Errorf("expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestRecoverRegistry(t *testing.T) {
+	const (
+		dotId      = "7d0c4b4a-0a6e-4c1f-9f8e-2a7c1e6d9b11"
+		branchId   = "7d0c4b4a-0a6e-4c1f-9f8e-2a7c1e6d9b12"
+		carolsId   = "7d0c4b4a-0a6e-4c1f-9f8e-2a7c1e6d9b13"
+		orgsId     = "7d0c4b4a-0a6e-4c1f-9f8e-2a7c1e6d9b14"
+		unrecorded = "7d0c4b4a-0a6e-4c1f-9f8e-2a7c1e6d9b15"
+	)
+	s := newTestDirectoryState(t, nil)
+	client, err := store.NewKVDBClient(&store.KVDBConfig{Type: store.KVTypeMem})
+	if err != nil {
+		t.Fatalf("failed to init kv store: %s", err)
+	}
+	kv := store.NewKVDBFilesystemStore(client)
+	s.registryStore = kv
+	s.filesystemStore = kv
+	s.serverAddressesCache = map[string][]string{s.NodeID(): {"10.0.0.1"}, "other": {"10.0.0.2"}}
+	s.serverAddressesCacheLock = &sync.RWMutex{}
+
+	dot := &types.RegistryFilesystem{Id: dotId, OwnerId: "alice", Name: "lost"}
+	carols := &types.RegistryFilesystem{Id: carolsId, OwnerId: "carol", Name: "data"}
+	orgs := &types.RegistryFilesystem{Id: orgsId, OwnerId: "acme", Name: "data"}
+	branch := &types.Clone{
+		TopLevelFilesystemId: dotId,
+		FilesystemId:         branchId,
+		Name:                 "feature",
+		Origin:               types.Origin{FilesystemId: dotId, SnapshotId: "a"},
+	}
+	for _, fs := range []struct {
+		id         string
+		properties *types.RegistryProperties
+		here       []string
+		there      []string
+	}{
+		// the other node has a later commit
+		{dotId, &types.RegistryProperties{Filesystem: dot}, []string{"a", "b"}, []string{"a", "b", "c"}},
+		{branchId, &types.RegistryProperties{Clone: branch}, []string{"d"}, nil},
+		{carolsId, &types.RegistryProperties{Filesystem: carols}, []string{"e"}, nil},
+		// the copies have diverged
+		{orgsId, &types.RegistryProperties{Filesystem: orgs, Organization: true}, []string{"f", "g"}, []string{"f", "x"}},
+		{unrecorded, nil, nil, nil},
+	} {
+		_, err := s.zfs.Create(fs.id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, id := range fs.here {
+			_, err = s.zfs.Snapshot(fs.id, id, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if fs.properties != nil {
+			err = s.zfs.SetRegistryProperties(fs.id, *fs.properties)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		s.filesystems[fs.id] = &snapshotsFSM{snapshots: map[string][]*types.Snapshot{"other": snapshots(fs.there...)}}
+	}
+	// the branch's master survived
+	err = kv.SetMaster(&types.FilesystemMaster{FilesystemID: branchId, NodeID: "other"}, &store.SetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := &types.RegistryRecovery{
+		Clones:               []*types.Clone{branch},
+		Unrecorded:           []string{unrecorded},
+		Diverged:             []string{orgsId},
+		MissingUsers:         []string{"carol"},
+		MissingOrganizations: []string{"acme"},
+	}
+	check := func(recovery *types.RegistryRecovery) {
+		t.Helper()
+		byId := func(ids []string) map[string]bool {
+			m := map[string]bool{}
+			for _, id := range ids {
+				m[id] = true
+			}
+			return m
+		}
+		filesystems := []string{}
+		for _, rf := range recovery.Filesystems {
+			filesystems = append(filesystems, rf.Id)
+		}
+		masters := map[string]string{}
+		for _, fm := range recovery.Masters {
+			masters[fm.FilesystemID] = fm.NodeID
+		}
+		if !reflect.DeepEqual(byId(filesystems), byId([]string{carolsId, dotId, orgsId})) {
+			t.Errorf("expected to recover %s, %s and %s, got %v", carolsId, dotId, orgsId, filesystems)
+		}
+		if !reflect.DeepEqual(recovery.Clones, expected.Clones) {
+			t.Errorf("expected to recover branch %+v, got %+v", branch, recovery.Clones)
+		}
+		if !reflect.DeepEqual(masters, map[string]string{dotId: "other", carolsId: s.NodeID()}) {
+			t.Errorf("expected masters of %s on other and %s here, got %v", dotId, carolsId, masters)
+		}
+		if !reflect.DeepEqual(recovery.Unrecorded, expected.Unrecorded) ||
+			!reflect.DeepEqual(recovery.Diverged, expected.Diverged) ||
+			!reflect.DeepEqual(recovery.MissingUsers, expected.MissingUsers) ||
+			!reflect.DeepEqual(recovery.MissingOrganizations, expected.MissingOrganizations) {
+			t.Errorf("expected %+v, got %+v", expected, recovery)
+		}
+	}
+
+	recovery, err := s.recoverRegistry(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(recovery)
+	filesystems, err := kv.ListFilesystems()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(filesystems) != 0 {
+		t.Errorf("expected a dry run not to change anything, got %+v", filesystems)
+	}
+
+	recovery, err = s.recoverRegistry(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(recovery)
+	rf, err := kv.GetFilesystem("alice", "lost")
+	if err != nil || rf.Id != dotId {
+		t.Errorf("expected alice/lost to be recorded, got %+v: %v", rf, err)
+	}
+	fm, err := kv.GetMaster(dotId)
+	if err != nil || fm.NodeID != "other" {
+		t.Errorf("expected the other node to be recorded as master, got %+v: %v", fm, err)
+	}
+	_, err = kv.GetMaster(orgsId)
+	if !store.IsKeyNotFound(err) {
+		t.Errorf("expected no master to be recorded for the diverged dot, got %v", err)
+	}
+
+	recovery, err = s.recoverRegistry(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recovery.Filesystems)+len(recovery.Clones)+len(recovery.Masters) != 0 {
+		t.Errorf("expected nothing left to recover, got %+v", recovery)
+	}
+}
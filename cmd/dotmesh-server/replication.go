@@ -7,12 +7,9 @@ import (
 	"io"
 	"io/ioutil"
 	"net/http"
-	"os/exec"
-	"strings"
 
 	dmclient "github.com/dotmesh-oss/dotmesh/pkg/client"
 	"github.com/dotmesh-oss/dotmesh/pkg/user"
-	"github.com/dotmesh-oss/dotmesh/pkg/zfs"
 	"github.com/gorilla/mux"
 
 	"github.com/dotmesh-oss/dotmesh/pkg/fsm"
@@ -120,9 +117,6 @@ func (z *ZFSSender) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		z.filesystem, z.fromSnap, z.toSnap,
 	)
 
-	// command writes into pipe
-	var cmd *exec.Cmd
-
 	snaps, err := z.state.SnapshotsFor(masterNodeID, z.filesystem)
 	if err != nil {
 		log.Printf(
@@ -145,36 +139,6 @@ func (z *ZFSSender) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if z.fromSnap == "START" {
-		zfs.LogZFSCommand(z.filesystem, fmt.Sprintf("%s send -p -R %s@%s", z.state.opts.ZFSExecPath, zfs.FQ(z.state.opts.PoolName, z.filesystem), z.toSnap))
-		cmd = exec.Command(
-			// -R sends interim snapshots as well
-			ZFS, "send", "-p", "-R", zfs.FQ(z.state.opts.PoolName, z.filesystem)+"@"+z.toSnap,
-		)
-	} else {
-		var fromSnap string
-		// in clone case, z.fromSnap must be fully qualified
-		if strings.Contains(z.fromSnap, "@") {
-			// send a clone, so make it fully qualified
-			fromSnap = zfs.FQ(z.state.opts.PoolName, z.fromSnap)
-		} else {
-			// presume it refers to a snapshot
-			fromSnap = z.fromSnap
-		}
-		zfs.LogZFSCommand(z.filesystem, fmt.Sprintf("%s send -p -I %s %s@%s", z.state.opts.ZFSExecPath, fromSnap, zfs.FQ(z.state.opts.PoolName, z.filesystem), z.toSnap))
-		cmd = exec.Command(
-			z.state.opts.ZFSExecPath, "send", "-p",
-			"-I", fromSnap, zfs.FQ(z.state.opts.PoolName, z.filesystem)+"@"+z.toSnap,
-		)
-	}
-
-	// How to set HTTP response code based on return code of process?
-	// (we can't - it's too late by the time we know the return code)
-	pipeReader, pipeWriter := io.Pipe()
-
-	defer pipeWriter.Close()
-	defer pipeReader.Close()
-
 	preludeEncoded, err := fsm.EncodePrelude(prelude)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
@@ -183,8 +147,23 @@ func (z *ZFSSender) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	cmd.Stdout = pipeWriter
-	cmd.Stderr = getLogfile("zfs-send-errors")
+	// "START" asks for everything up to toSnap; a fromSnap with an "@" in
+	// it is the origin of a clone
+	fromSnap := z.fromSnap
+	if fromSnap == "START" {
+		fromSnap = ""
+	}
+
+	log.Printf(
+		"[ZFSSender:%s] About to send %s => %s",
+		z.filesystem, z.fromSnap, z.toSnap,
+	)
+	// How to set HTTP response code based on the result of the send?
+	// (we can't - it's too late by the time we know it)
+	pipeReader, errch := z.state.zfs.Send(
+		r.Context(), "", fromSnap, z.filesystem, z.toSnap, preludeEncoded,
+	)
+	defer pipeReader.Close()
 
 	finished := make(chan bool)
 	go utils.Pipe(
@@ -197,19 +176,9 @@ func (z *ZFSSender) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		"compress",
 	)
 
-	// log.Printf(
-	// 	"[ZFSSender:%s] Writing prelude of %d bytes (encoded): %s",
-	// 	z.filesystem, len(preludeEncoded), preludeEncoded,
-	// )
-	pipeWriter.Write(preludeEncoded)
-
+	err = <-errch
 	log.Printf(
-		"[ZFSSender:%s] About to Run() for %s => %s",
-		z.filesystem, z.fromSnap, z.toSnap,
-	)
-	err = cmd.Run()
-	log.Printf(
-		"[ZFSSender:%s] Finished Run() for %s => %s: %s",
+		"[ZFSSender:%s] Finished sending %s => %s: %s",
 		z.filesystem, z.fromSnap, z.toSnap, err,
 	)
 	if err != nil {
@@ -221,7 +190,6 @@ func (z *ZFSSender) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// XXX Adding the log messages below seemed to stop a deadlock, not sure
 	// why. For now, let's just leave them in...
 	log.Printf("[ZFSSender:%s] Closing pipes...", z.filesystem)
-	pipeWriter.Close()
 	pipeReader.Close()
 
 	log.Printf("[ZFSSender:%s] Waiting for finish signal...", z.filesystem)
@@ -340,18 +308,11 @@ func (z *ZFSReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// and is therefore blocking on us to tell it we've finished, one way or another, via
 	// z.state.notifyPushCompleted(z.filesystem, true/false) so we'd better do that in every path.
 
-	zfs.LogZFSCommand(z.filesystem, fmt.Sprintf("%s recv %s", ZFS, zfs.FQ(z.state.opts.PoolName, z.filesystem)))
-
-	cmd := exec.Command(ZFS, "recv", zfs.FQ(z.state.opts.PoolName, z.filesystem))
 	pipeReader, pipeWriter := io.Pipe()
 	defer pipeReader.Close()
 	defer pipeWriter.Close()
-	cmd.Stdin = pipeReader
-	cmd.Stdout = w
 
 	errBuffer := bytes.Buffer{}
-
-	cmd.Stderr = &errBuffer
 	finished := make(chan bool)
 
 	go utils.Pipe(
@@ -388,7 +349,7 @@ func (z *ZFSReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 	log.Printf("[ZFSReceiver:%s] Got prelude %v", z.filesystem, prelude)
 
-	err = cmd.Run()
+	err = z.state.zfs.Recv(r.Context(), pipeReader, z.filesystem, &errBuffer)
 	if err != nil {
 		log.Printf(
 			"[ZFSReceiver:%s] Got error %s when running zfs recv, check the logs for output that looks like it's from zfs",
@@ -428,7 +389,7 @@ func (z *ZFSReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	pipeWriter.Close()
 	_ = <-finished
 
-	err = applyPrelude(prelude, zfs.FQ(z.state.opts.PoolName, z.filesystem))
+	err = z.state.zfs.ApplyPrelude(prelude, z.filesystem)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte(fmt.Sprintf("Unable to apply prelude for %s: %s\n", z.filesystem, err)))
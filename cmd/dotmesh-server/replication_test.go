@@ -0,0 +1,97 @@
+package main
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dotmesh-oss/dotmesh/pkg/fsm"
+	"github.com/dotmesh-oss/dotmesh/pkg/types"
+)
+
+// replicasFSM is a state machine that only knows which nodes hold which
+// snapshots, which can change while it's being watched
+type replicasFSM struct {
+	fsm.FSM
+	lock      sync.Mutex
+	snapshots map[string][]*types.Snapshot
+}
+
+func (f *replicasFSM) ListSnapshots() map[string][]*types.Snapshot {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	result := map[string][]*types.Snapshot{}
+	for node, snapshots := range f.snapshots {
+		result[node] = append([]*types.Snapshot{}, snapshots...)
+	}
+	return result
+}
+
+func (f *replicasFSM) hold(node, snapshotId string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.snapshots[node] = append(f.snapshots[node], &types.Snapshot{Id: snapshotId})
+}
+
+func Test_waitForReplicas(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		// nodes holding the snapshot when the wait starts, and after
+		// replicating it during the wait
+		holding, replicating []string
+		policy               types.FilesystemReplicationPolicy
+		expected             error
+	}{
+		{
+			name:    "already replicated",
+			holding: []string{"node-1", "node-2"},
+			policy:  types.FilesystemReplicationPolicy{MinReplicas: 2, TimeoutSeconds: 5},
+		},
+		{
+			name:        "replicated while waiting",
+			holding:     []string{"node-1"},
+			replicating: []string{"node-2", "node-3"},
+			policy:      types.FilesystemReplicationPolicy{MinReplicas: 3, TimeoutSeconds: 5},
+		},
+		{
+			name:     "timed out",
+			holding:  []string{"node-1"},
+			policy:   types.FilesystemReplicationPolicy{MinReplicas: 2, TimeoutSeconds: 1},
+			expected: ReplicationTimeout{SnapshotId: "commit", Replicas: 1, MinReplicas: 2, Timeout: time.Second},
+		},
+		{
+			name:        "fewer nodes than required",
+			holding:     []string{"node-1"},
+			replicating: []string{"node-2"},
+			policy:      types.FilesystemReplicationPolicy{MinReplicas: 3, TimeoutSeconds: 1},
+			expected:    ReplicationTimeout{SnapshotId: "commit", Replicas: 2, MinReplicas: 3, Timeout: time.Second},
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			f := &replicasFSM{snapshots: map[string][]*types.Snapshot{}}
+			for _, node := range tc.holding {
+				f.hold(node, "commit")
+			}
+			// another commit isn't counted
+			f.hold("node-4", "other")
+			s := &InMemoryState{
+				filesystems:     map[string]fsm.FSM{"fs": f},
+				filesystemsLock: &sync.RWMutex{},
+			}
+			go func() {
+				for _, node := range tc.replicating {
+					time.Sleep(200 * time.Millisecond)
+					f.hold(node, "commit")
+				}
+			}()
+
+			err := s.waitForReplicas("fs", "commit", &tc.policy)
+			if !reflect.DeepEqual(err, tc.expected) {
+				t.Errorf("expected %v, got %v", tc.expected, err)
+			}
+		})
+	}
+}
@@ -47,7 +47,7 @@ POOL=${USE_POOL_NAME:-pool}
 POOL=$(echo $POOL |sed s/\#HOSTNAME\#/$HOSTNAME/)
 DOTMESH_INNER_SERVER_NAME=${DOTMESH_INNER_SERVER_NAME:-dotmesh-server-inner}
 FLEXVOLUME_DRIVER_DIR=${FLEXVOLUME_DRIVER_DIR:-/usr/libexec/kubernetes/kubelet-plugins/volume/exec}
-INHERIT_ENVIRONMENT_NAMES=( "DOTMESH_SERVER_PORT" "FILESYSTEM_METADATA_TIMEOUT" "DOTMESH_UPGRADES_URL" "DOTMESH_UPGRADES_INTERVAL_SECONDS" "NATS_URL" "NATS_USERNAME" "NATS_PASSWORD" "NATS_SUBJECT_PREFIX" "DOTMESH_STORAGE" "DOTMESH_BOLTDB_PATH" "EXTERNAL_USER_MANAGER_URL" "DISABLE_DIRTY_POLLING" "POLL_DIRTY_SUCCESS_TIMEOUT" "POLL_DIRTY_ERROR_TIMEOUT")
+INHERIT_ENVIRONMENT_NAMES=( "DOTMESH_SERVER_PORT" "FILESYSTEM_METADATA_TIMEOUT" "DOTMESH_UPGRADES_URL" "DOTMESH_UPGRADES_INTERVAL_SECONDS" "NATS_URL" "NATS_USERNAME" "NATS_PASSWORD" "NATS_SUBJECT_PREFIX" "DOTMESH_STORAGE" "DOTMESH_BOLTDB_PATH" "EXTERNAL_USER_MANAGER_URL" "DISABLE_DIRTY_POLLING" "POLL_DIRTY_SUCCESS_TIMEOUT" "POLL_DIRTY_ERROR_TIMEOUT" "DOTMESH_NODE_LABELS" "DOTMESH_WEBHOOK_URLS" "DOTMESH_WEBHOOK_SECRET" "DOTMESH_WEBHOOK_NAMESPACES" "DOTMESH_WEBHOOK_ATTEMPTS" "DOTMESH_WEBHOOK_DEAD_LETTER_PATH" "DOTMESH_MAX_CONCURRENT_TRANSFERS" "DOTMESH_MAX_CONCURRENT_TRANSFERS_PER_PEER" "DOTMESH_FILESYSTEM_BACKEND" "DOTMESH_FILESYSTEM_DIR" "DOTMESH_BACKUP_DIR" "DOTMESH_BACKUP_S3_BUCKET" "DOTMESH_BACKUP_S3_PREFIX" "DOTMESH_BACKUP_S3_ENDPOINT" "DOTMESH_BACKUP_S3_KEY_ID" "DOTMESH_BACKUP_S3_SECRET_KEY" "DOTMESH_BACKUP_INTERVAL_SECONDS" "DOTMESH_BACKUP_RETAIN" "DOTMESH_SECRETS_KEY" "DOTMESH_ENCRYPTION_KEY_DIR" "DOTMESH_LDAP_URL" "DOTMESH_LDAP_USER_DN" "DOTMESH_LDAP_GROUP_ATTRIBUTE" "DOTMESH_OIDC_ISSUER" "DOTMESH_OIDC_CLIENT_ID" "DOTMESH_OIDC_USERNAME_CLAIM" "DOTMESH_OIDC_GROUPS_CLAIM" "DOTMESH_GROUP_NAMESPACES")
 
 if [ $POOL_SIZE = AUTO ]
 then
@@ -107,6 +107,11 @@ else
     echo "Using $OUTER_DIR as a mount workspace."
 fi
 
+# What dots are kept on: zfs, or btrfs or directory, which don't need ZFS and
+# keep their data in DOTMESH_FILESYSTEM_DIR
+export DOTMESH_FILESYSTEM_BACKEND=${DOTMESH_FILESYSTEM_BACKEND:-zfs}
+export DOTMESH_FILESYSTEM_DIR=${DOTMESH_FILESYSTEM_DIR:-$OUTER_DIR/dotmesh_directory}
+
 # Set the shared flag on the working directory on the host. This is
 # essential; it, combined with the presence of the shared flag on the
 # bind-mount of this into the container namespace when we run the
@@ -153,47 +158,51 @@ fi
 # and find the version, as the user is asserting they've handled all
 # of that.
 
-if [ -z "$KERNEL_ZFS_VERSION" ]; then
-    if [ -n "`lsmod|grep zfs`" ]; then
-        echo "ZFS already loaded :)"
-    else
-        depmod -b /system-lib || true
-        if ! modprobe -d /system-lib zfs; then
-            fetch_zfs
+if [ "$DOTMESH_FILESYSTEM_BACKEND" != "zfs" ]; then
+    echo "Using the $DOTMESH_FILESYSTEM_BACKEND backend, not loading ZFS"
+else
+    if [ -z "$KERNEL_ZFS_VERSION" ]; then
+        if [ -n "`lsmod|grep zfs`" ]; then
+            echo "ZFS already loaded :)"
+        else
+            depmod -b /system-lib || true
+            if ! modprobe -d /system-lib zfs; then
+                fetch_zfs
+            else
+                echo "Successfully loaded system ZFS :)"
+            fi
+        fi
+
+        # System takes precedence over bundled version - if there is a
+        # system version, we'll use it
+        KERNEL_ZFS_VERSION=$(modinfo -F version -b /system-lib zfs ||true)
+        if [ -z "$KERNEL_ZFS_VERSION" ]; then
+            KERNEL_ZFS_VERSION=$(modinfo -F version -b /bundled-lib zfs ||true)
+            echo "Using bundled ZFS kernel version $KERNEL_ZFS_VERSION"
         else
-            echo "Successfully loaded system ZFS :)"
+            echo "Using system ZFS kernel version $KERNEL_ZFS_VERSION"
         fi
     fi
 
-    # System takes precedence over bundled version - if there is a
-    # system version, we'll use it
-    KERNEL_ZFS_VERSION=$(modinfo -F version -b /system-lib zfs ||true)
-    if [ -z "$KERNEL_ZFS_VERSION" ]; then
-        KERNEL_ZFS_VERSION=$(modinfo -F version -b /bundled-lib zfs ||true)
-        echo "Using bundled ZFS kernel version $KERNEL_ZFS_VERSION"
+    if [[ "$KERNEL_ZFS_VERSION" == "0.6"* ]]; then
+        echo "Detected ZFS 0.6 kernel modules ($KERNEL_ZFS_VERSION), using matching userland"
+        export ZFS_USERLAND_ROOT=/opt/zfs-0.6
+    elif [[ "$KERNEL_ZFS_VERSION" == "0.7"* ]]; then
+        echo "Detected ZFS 0.7 kernel modules ($KERNEL_ZFS_VERSION), using matching userland"
+        export ZFS_USERLAND_ROOT=/opt/zfs-0.7
+    elif [[ "$KERNEL_ZFS_VERSION" == "0.8"* ]]; then
+        echo "Detected ZFS 0.8 kernel modules ($KERNEL_ZFS_VERSION), using matching userland"
+        export ZFS_USERLAND_ROOT=/opt/zfs-0.8
     else
-        echo "Using system ZFS kernel version $KERNEL_ZFS_VERSION"
+        echo "Kernel ZFS version ($KERNEL_ZFS_VERSION) doesn't match 0.6, 0.7 or 0.8, not supported"
+        echo
+        echo "Trying to download kernel modules again and then restarting in case we're hitting"
+        echo "https://github.com/dotmesh-oss/dotmesh/issues/542"
+        fetch_zfs
+        exit 1
     fi
 fi
 
-if [[ "$KERNEL_ZFS_VERSION" == "0.6"* ]]; then
-    echo "Detected ZFS 0.6 kernel modules ($KERNEL_ZFS_VERSION), using matching userland"
-    export ZFS_USERLAND_ROOT=/opt/zfs-0.6
-elif [[ "$KERNEL_ZFS_VERSION" == "0.7"* ]]; then
-    echo "Detected ZFS 0.7 kernel modules ($KERNEL_ZFS_VERSION), using matching userland"
-    export ZFS_USERLAND_ROOT=/opt/zfs-0.7
-elif [[ "$KERNEL_ZFS_VERSION" == "0.8"* ]]; then
-    echo "Detected ZFS 0.8 kernel modules ($KERNEL_ZFS_VERSION), using matching userland"
-    export ZFS_USERLAND_ROOT=/opt/zfs-0.8
-else
-    echo "Kernel ZFS version ($KERNEL_ZFS_VERSION) doesn't match 0.6, 0.7 or 0.8, not supported"
-    echo
-    echo "Trying to download kernel modules again and then restarting in case we're hitting"
-    echo "https://github.com/dotmesh-oss/dotmesh/issues/542"
-    fetch_zfs
-    exit 1
-fi
-
 POOL_LOGFILE=$DIR/dotmesh_pool_log
 
 run_in_zfs_container() {
@@ -209,31 +218,43 @@ run_in_zfs_container() {
 
 set -ex
 
-if [ ! -e /dev/zfs ]; then
+if [ "$DOTMESH_FILESYSTEM_BACKEND" == "zfs" ] && [ ! -e /dev/zfs ]; then
     mknod -m 660 /dev/zfs c $(cat /sys/class/misc/zfs/dev |sed 's/:/ /g')
 fi
 
 echo "`date`: On host '$HOSTNAME', working directory = '$OUTER_DIR', device = '$BLOCK_DEVICE', zfs mountpoint = '$MOUNTPOINT', pool = '$POOL', Dotmesh image = '$DOTMESH_DOCKER_IMAGE'"
 
-if ! run_in_zfs_container zpool-status zpool status $POOL; then
-
-    # TODO: make case where truncate previously succeeded but zpool create
-    # failed or never run recoverable.
-    if [ ! -f $FILE ]; then
-        truncate -s $POOL_SIZE $FILE
-        run_in_zfs_container zpool-create zpool create -m none $POOL "$OUTER_DIR/dotmesh_data"
-        echo "This directory contains dotmesh data files, please leave them alone unless you know what you're doing. See github.com/dotmesh-oss/dotmesh for more information." > $DIR/README
-        run_in_zfs_container zpool-get zpool get -H guid $POOL |cut -f 3 > $DIR/dotmesh_pool_id
-        if [ -n "$CONTAINER_POOL_PVC_NAME" ]; then
-            echo "$CONTAINER_POOL_PVC_NAME" > $DIR/dotmesh_pvc_name
+if [ "$DOTMESH_FILESYSTEM_BACKEND" != "zfs" ]; then
+    # these backends keep their own pool id alongside their data
+    mkdir -p $DOTMESH_FILESYSTEM_DIR
+    if [ "$DOTMESH_FILESYSTEM_BACKEND" == "btrfs" ] && [ "`stat -f -c %T $DOTMESH_FILESYSTEM_DIR`" != "btrfs" ]; then
+        echo "`date`: $DOTMESH_FILESYSTEM_DIR must be on a btrfs filesystem for the btrfs backend" | tee -a $POOL_LOGFILE
+        exit 1
+    fi
+    echo "`date`: Using the $DOTMESH_FILESYSTEM_BACKEND backend in $DOTMESH_FILESYSTEM_DIR" >> $POOL_LOGFILE
+    # it may be outside $OUTER_DIR, e.g. with dm cluster init --filesystem-dir
+    EXTRA_VOLUMES="$EXTRA_VOLUMES -v $DOTMESH_FILESYSTEM_DIR:$DOTMESH_FILESYSTEM_DIR:rshared"
+else
+    if ! run_in_zfs_container zpool-status zpool status $POOL; then
+
+        # TODO: make case where truncate previously succeeded but zpool create
+        # failed or never run recoverable.
+        if [ ! -f $FILE ]; then
+            truncate -s $POOL_SIZE $FILE
+            run_in_zfs_container zpool-create zpool create -m none $POOL "$OUTER_DIR/dotmesh_data"
+            echo "This directory contains dotmesh data files, please leave them alone unless you know what you're doing. See github.com/dotmesh-oss/dotmesh for more information." > $DIR/README
+            run_in_zfs_container zpool-get zpool get -H guid $POOL |cut -f 3 > $DIR/dotmesh_pool_id
+            if [ -n "$CONTAINER_POOL_PVC_NAME" ]; then
+                echo "$CONTAINER_POOL_PVC_NAME" > $DIR/dotmesh_pvc_name
+            fi
+            echo "`date`: Pool created" >> $POOL_LOGFILE
+        else
+            run_in_zfs_container zpool-import zpool import -f -d $OUTER_DIR $POOL
+            echo "`date`: Pool imported" >> $POOL_LOGFILE
         fi
-        echo "`date`: Pool created" >> $POOL_LOGFILE
     else
-        run_in_zfs_container zpool-import zpool import -f -d $OUTER_DIR $POOL
-        echo "`date`: Pool imported" >> $POOL_LOGFILE
+        echo "`date`: Pool already exists" >> $POOL_LOGFILE
     fi
-else
-    echo "`date`: Pool already exists" >> $POOL_LOGFILE
 fi
 
 # Clear away stale socket if existing
@@ -349,6 +370,12 @@ else
     fi
 fi
 
+# the secrets key file is read here, like the admin secrets, because its path
+# is in this container rather than the host's
+if [ -z "$DOTMESH_SECRETS_KEY" ] && [ -n "$DOTMESH_SECRETS_KEY_FILE" ] && [ -e "$DOTMESH_SECRETS_KEY_FILE" ]; then
+    secret="$secret -e DOTMESH_SECRETS_KEY=$(cat $DOTMESH_SECRETS_KEY_FILE |tr '\n' ',')"
+fi
+
 INHERIT_ENVIRONMENT_ARGS=""
 
 for name in "${INHERIT_ENVIRONMENT_NAMES[@]}"
@@ -361,6 +388,17 @@ done
 # a pod but a container run from /var/run/docker.sock
 (while true; do docker logs -f dotmesh-server-inner || true; sleep 1; done) &
 
+# Scheduled backups of the KV store can be kept anywhere on the host
+if [ -n "$DOTMESH_BACKUP_DIR" ]; then
+    mkdir -p $DOTMESH_BACKUP_DIR
+    EXTRA_VOLUMES="$EXTRA_VOLUMES -v $DOTMESH_BACKUP_DIR:$DOTMESH_BACKUP_DIR"
+fi
+
+# Keys for encrypted dots, read-only as the server never writes them
+if [ -n "$DOTMESH_ENCRYPTION_KEY_DIR" ]; then
+    EXTRA_VOLUMES="$EXTRA_VOLUMES -v $DOTMESH_ENCRYPTION_KEY_DIR:$DOTMESH_ENCRYPTION_KEY_DIR:ro"
+fi
+
 set +e
 
 # In order of the -v options below:
@@ -9,10 +9,15 @@ import (
 	"strings"
 	"time"
 
+	"github.com/dotmesh-oss/dotmesh/pkg/commitindex"
 	"github.com/dotmesh-oss/dotmesh/pkg/container"
+	"github.com/dotmesh-oss/dotmesh/pkg/fsm"
 	"github.com/dotmesh-oss/dotmesh/pkg/registry"
+	"github.com/dotmesh-oss/dotmesh/pkg/signing"
 	"github.com/dotmesh-oss/dotmesh/pkg/store"
+	"github.com/dotmesh-oss/dotmesh/pkg/transferqueue"
 	"github.com/dotmesh-oss/dotmesh/pkg/validator"
+	"github.com/dotmesh-oss/dotmesh/pkg/zfs"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
@@ -139,17 +144,16 @@ func (d *DotmeshRPC) Config(
 
 func requirePassword(r *http.Request) error {
 	// Reject the request with an error if the request was
-	// authenticated with an API key rather than a password. Use this
-	// to protect RPC methods that require a password.
+	// authenticated with an API key rather than a password, or an ID
+	// token that's as good as one. Use this to protect RPC methods that
+	// require a password.
 
 	at := auth.GetAuthenticationType(r)
 
-	switch at {
-	case user.AuthenticationTypePassword:
+	if at.Privileged() {
 		return nil
-	default:
-		return fmt.Errorf("Password authentication is required for this method.")
 	}
+	return fmt.Errorf("Password authentication is required for this method.")
 }
 
 func (d *DotmeshRPC) CurrentUser(r *http.Request, args *struct{}, result *SafeUser) error {
@@ -197,6 +201,11 @@ func (d *DotmeshRPC) ResetApiKey(r *http.Request, args *struct{}, result *struct
 
 func (d *DotmeshRPC) GetApiKey(r *http.Request, args *struct{}, result *struct{ ApiKey string }) error {
 	user := auth.GetUser(r)
+	if user.ApiKey == "" {
+		// only hashes of API keys are kept, so it can only be told to
+		// whoever authenticated with it
+		return fmt.Errorf("API keys are only shown when they're made, reset yours to get a new one")
+	}
 	result.ApiKey = user.ApiKey
 	return nil
 }
@@ -516,13 +525,44 @@ func (d *DotmeshRPC) ListWithContainers(
 
 func (d *DotmeshRPC) Create(
 	r *http.Request, filesystemName *VolumeName, result *bool) error {
+	return d.create(r, filesystemName, false, result)
+}
+
+// Create a dot encrypted with ZFS native encryption, keyed with the key for
+// it or its namespace, which must have been set with SetEncryptionKey or be
+// in the master's key directory.
+func (d *DotmeshRPC) CreateEncrypted(
+	r *http.Request, filesystemName *VolumeName, result *bool) error {
+	return d.create(r, filesystemName, true, result)
+}
+
+func (d *DotmeshRPC) create(
+	r *http.Request, filesystemName *VolumeName, encrypted bool, result *bool) error {
 
 	err := validator.IsValidVolume(filesystemName.Namespace, filesystemName.Name)
 	if err != nil {
 		return err
 	}
 
-	_, ch, err := d.state.CreateFilesystem(r.Context(), filesystemName)
+	// dots can be made in your own namespace, or an organization's you're a
+	// member of
+	isAdmin, err := AuthenticatedUserIsNamespaceAdministrator(r.Context(), filesystemName.Namespace, d.usersManager)
+	if err != nil {
+		return err
+	}
+	if !isAdmin {
+		return fmt.Errorf("You are not allowed to create dots in namespace %s", filesystemName.Namespace)
+	}
+
+	if encrypted {
+		// fail before anything's registered if there's no key
+		_, err = d.state.encryptionKeyFor(*filesystemName)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, ch, err := d.state.CreateFilesystem(r.Context(), filesystemName, encrypted)
 	if err != nil {
 		return err
 	}
@@ -766,6 +806,81 @@ func (d *DotmeshRPC) CommitsById(
 	return nil
 }
 
+// Search the commits of every dot the caller can see, or of one dot or
+// branch, by their metadata. Newest commits come first.
+func (d *DotmeshRPC) FindCommits(
+	r *http.Request,
+	args *types.CommitQuery,
+	result *[]types.CommitMatch,
+) error {
+	if args.Namespace != "" || args.Name != "" {
+		err := validator.IsValidVolume(args.Namespace, args.Name)
+		if err != nil {
+			return err
+		}
+	}
+	if args.Branch != "" {
+		if args.Name == "" {
+			return fmt.Errorf("Can only search a branch of a named dot")
+		}
+		err := validator.IsValidBranchName(args.Branch)
+		if err != nil {
+			return err
+		}
+	}
+
+	user := auth.GetUser(r)
+	names := map[string]types.CommitMatch{}
+	include := func(filesystemId string) bool {
+		tlf, clone, err := d.state.registry.LookupFilesystemById(filesystemId)
+		if err != nil {
+			// deleted, or not registered yet
+			return false
+		}
+		if clone == "" {
+			clone = DEFAULT_BRANCH
+		}
+		if args.Name != "" && (tlf.MasterBranch.Name != VolumeName{Namespace: args.Namespace, Name: args.Name}) {
+			return false
+		}
+		if args.Branch != "" && clone != args.Branch {
+			return false
+		}
+		authorized, err := d.state.userManager.Authorize(user, true, &tlf)
+		if err != nil || !authorized {
+			return false
+		}
+		names[filesystemId] = types.CommitMatch{
+			Namespace: tlf.MasterBranch.Name.Namespace,
+			Name:      tlf.MasterBranch.Name.Name,
+			Branch:    clone,
+		}
+		return true
+	}
+
+	matches, err := d.state.commitIndex.Search(commitindex.Query{
+		Selector:        args.Selector,
+		Author:          args.Author,
+		MessageContains: args.MessageContains,
+		Since:           args.Since,
+		Until:           args.Until,
+		Include:         include,
+		Limit:           args.Limit,
+	})
+	if err != nil {
+		return fmt.Errorf("Invalid selector '%s': %s", args.Selector, err)
+	}
+
+	found := make([]types.CommitMatch, 0, len(matches))
+	for _, m := range matches {
+		match := names[m.FilesystemId]
+		match.Commit = m.Commit
+		found = append(found, match)
+	}
+	*result = found
+	return nil
+}
+
 func (d *DotmeshRPC) StashAfter(
 	r *http.Request,
 	args *types.StashRequest,
@@ -869,6 +984,17 @@ func (d *DotmeshRPC) Commit(
 		}
 		meta[name] = value
 	}
+
+	parentId, contentDigest, err := d.state.checkCommitSignature(
+		auth.GetUser(r), args.Namespace, filesystemId, meta,
+	)
+	if err != nil {
+		return err
+	}
+	if contentDigest != "" {
+		eventArgs["parentId"] = parentId
+		eventArgs["contentDigest"] = contentDigest
+	}
 	eventArgs["metadata"] = meta
 
 	responseChan, err := d.state.globalFsRequest(
@@ -881,15 +1007,819 @@ func (d *DotmeshRPC) Commit(
 		return err
 	}
 
-	// TODO this may never succeed, if the master for it never shows up. maybe
-	// this response should have a timeout associated with it.
-	e := <-responseChan
-	if e.Name == "snapshotted" {
-		log.Printf("Snapshotted %s", filesystemId)
-		*result = (*e.Args)["SnapshotId"].(string)
-	} else {
-		return maybeError(e, "snapshotted")
+	// TODO this may never succeed, if the master for it never shows up. maybe
+	// this response should have a timeout associated with it.
+	e := <-responseChan
+	if e.Name == "snapshotted" {
+		log.Printf("Snapshotted %s", filesystemId)
+		*result = (*e.Args)["SnapshotId"].(string)
+	} else {
+		return maybeError(e, "snapshotted")
+	}
+
+	// Dots with a synchronous replication policy only report success once
+	// enough nodes hold the new commit.
+	policy, err := d.state.replicationPolicyFor(filesystemId)
+	if err != nil {
+		return err
+	}
+	if policy.Synchronous() {
+		return d.state.waitForReplicas(filesystemId, *result, policy)
+	}
+	return nil
+}
+
+type ReplicationPolicyArgs struct {
+	Namespace      string
+	Name           string
+	MinReplicas    int
+	TimeoutSeconds int64
+}
+
+// Set how many nodes must hold each new commit on a dot before Commit returns.
+func (d *DotmeshRPC) SetReplicationPolicy(
+	r *http.Request,
+	args *ReplicationPolicyArgs,
+	result *bool,
+) error {
+	err := ensureAdminUser(r)
+	if err != nil {
+		return err
+	}
+
+	err = validator.IsValidVolume(args.Namespace, args.Name)
+	if err != nil {
+		return err
+	}
+
+	if args.MinReplicas < 0 || args.TimeoutSeconds < 0 {
+		return fmt.Errorf("MinReplicas and TimeoutSeconds must not be negative")
+	}
+
+	tlf, err := d.state.registry.LookupFilesystem(
+		VolumeName{Namespace: args.Namespace, Name: args.Name},
+	)
+	if err != nil {
+		return err
+	}
+
+	// Setting an asynchronous policy is the same as having none at all
+	if args.MinReplicas <= 1 {
+		err = d.state.filesystemStore.DeleteReplicationPolicy(tlf.MasterBranch.Id)
+		if err != nil && !store.IsKeyNotFound(err) {
+			return err
+		}
+		*result = true
+		return nil
+	}
+
+	err = d.state.filesystemStore.SetReplicationPolicy(&types.FilesystemReplicationPolicy{
+		FilesystemID:   tlf.MasterBranch.Id,
+		MinReplicas:    args.MinReplicas,
+		TimeoutSeconds: args.TimeoutSeconds,
+	}, &store.SetOptions{})
+	if err != nil {
+		return err
+	}
+	*result = true
+	return nil
+}
+
+func (d *DotmeshRPC) GetReplicationPolicy(
+	r *http.Request,
+	args *VolumeName,
+	result *types.FilesystemReplicationPolicy,
+) error {
+	err := validator.IsValidVolume(args.Namespace, args.Name)
+	if err != nil {
+		return err
+	}
+
+	tlf, err := d.state.registry.LookupFilesystem(*args)
+	if err != nil {
+		return err
+	}
+
+	policy, err := d.state.filesystemStore.GetReplicationPolicy(tlf.MasterBranch.Id)
+	if err != nil {
+		if store.IsKeyNotFound(err) {
+			*result = types.FilesystemReplicationPolicy{FilesystemID: tlf.MasterBranch.Id}
+			return nil
+		}
+		return err
+	}
+	*result = *policy
+	return nil
+}
+
+// Set the placement policy for a dot, or for a whole namespace if Name is
+// empty.
+func (d *DotmeshRPC) SetPlacementPolicy(
+	r *http.Request,
+	args *types.PlacementPolicy,
+	result *bool,
+) error {
+	err := ensureAdminUser(r)
+	if err != nil {
+		return err
+	}
+
+	err = validator.IsValidVolumeNamespace(args.Namespace)
+	if err != nil {
+		return err
+	}
+	if args.Name != "" {
+		err = validator.IsValidVolume(args.Namespace, args.Name)
+		if err != nil {
+			return err
+		}
+		_, err = d.state.registry.LookupFilesystem(
+			VolumeName{Namespace: args.Namespace, Name: args.Name},
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	if args.Replicas < 0 {
+		return fmt.Errorf("Replicas must not be negative")
+	}
+
+	err = d.state.registryStore.SetPlacementPolicy(args, &store.SetOptions{})
+	if err != nil {
+		return err
+	}
+	*result = true
+	return nil
+}
+
+// Remove the placement policy of a dot (or namespace), going back to
+// replicating it everywhere.
+func (d *DotmeshRPC) DeletePlacementPolicy(
+	r *http.Request,
+	args *VolumeName,
+	result *bool,
+) error {
+	err := ensureAdminUser(r)
+	if err != nil {
+		return err
+	}
+
+	err = validator.IsValidVolumeNamespace(args.Namespace)
+	if err != nil {
+		return err
+	}
+	if args.Name != "" {
+		err = validator.IsValidVolume(args.Namespace, args.Name)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = d.state.registryStore.DeletePlacementPolicy(args.Namespace, args.Name)
+	if err != nil && !store.IsKeyNotFound(err) {
+		return err
+	}
+	*result = true
+	return nil
+}
+
+// Get the placement policy in force for a dot, which may be the one for its
+// namespace. An empty policy means the dot is replicated everywhere.
+func (d *DotmeshRPC) GetPlacementPolicy(
+	r *http.Request,
+	args *VolumeName,
+	result *types.PlacementPolicy,
+) error {
+	err := validator.IsValidVolume(args.Namespace, args.Name)
+	if err != nil {
+		return err
+	}
+
+	policy, err := d.state.placementPolicyFor(*args)
+	if err != nil {
+		return err
+	}
+	if policy == nil {
+		*result = types.PlacementPolicy{}
+		return nil
+	}
+	*result = *policy
+	return nil
+}
+
+// Set the key of an encrypted dot, or of every encrypted dot in a namespace
+// if Name is empty, on every node of the cluster. Keys are only held in
+// memory, so they must be set again after nodes restart, unless they're in
+// the nodes' key directories. They're given to the other nodes over the same
+// HTTP API as everything else, so like the admin API key that nodes call
+// each other with, they're only as private as the network between nodes.
+func (d *DotmeshRPC) SetEncryptionKey(
+	r *http.Request,
+	args *types.EncryptionKey,
+	result *bool,
+) error {
+	err := d.checkEncryptionKey(args)
+	if err != nil {
+		return err
+	}
+	isAdmin, err := AuthenticatedUserIsNamespaceAdministrator(r.Context(), args.Namespace, d.usersManager)
+	if err != nil {
+		return err
+	}
+	if !isAdmin {
+		return fmt.Errorf("You are not allowed to set encryption keys in namespace %s", args.Namespace)
+	}
+	err = d.state.setEncryptionKey(r.Context(), *args)
+	if err != nil {
+		return err
+	}
+	*result = true
+	return nil
+}
+
+// HoldEncryptionKey is how SetEncryptionKey gives a key to the rest of the
+// cluster: it only holds it on this node.
+func (d *DotmeshRPC) HoldEncryptionKey(
+	r *http.Request,
+	args *types.EncryptionKey,
+	result *bool,
+) error {
+	err := ensureAdminUser(r)
+	if err != nil {
+		return err
+	}
+	err = d.checkEncryptionKey(args)
+	if err != nil {
+		return err
+	}
+	d.state.holdEncryptionKey(args.Namespace, args.Name, args.Key)
+	*result = true
+	return nil
+}
+
+func (d *DotmeshRPC) checkEncryptionKey(args *types.EncryptionKey) error {
+	err := validator.IsValidVolumeNamespace(args.Namespace)
+	if err != nil {
+		return err
+	}
+	if args.Name != "" {
+		err = validator.IsValidVolume(args.Namespace, args.Name)
+		if err != nil {
+			return err
+		}
+	}
+	if args.Key != "" {
+		args.Key, err = zfs.NormalizeEncryptionKey(args.Key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Require, or stop requiring, commits to dots in a namespace to be signed.
+func (d *DotmeshRPC) SetSigningPolicy(
+	r *http.Request,
+	args *types.SigningPolicy,
+	result *bool,
+) error {
+	err := ensureAdminUser(r)
+	if err != nil {
+		return err
+	}
+
+	err = validator.IsValidVolumeNamespace(args.Namespace)
+	if err != nil {
+		return err
+	}
+
+	err = d.state.registryStore.SetSigningPolicy(args, &store.SetOptions{})
+	if err != nil {
+		return err
+	}
+	*result = true
+	return nil
+}
+
+// Get whether commits to dots in a namespace must be signed.
+func (d *DotmeshRPC) GetSigningPolicy(
+	r *http.Request,
+	args *struct{ Namespace string },
+	result *types.SigningPolicy,
+) error {
+	err := validator.IsValidVolumeNamespace(args.Namespace)
+	if err != nil {
+		return err
+	}
+
+	policy, err := d.state.signingPolicyFor(args.Namespace)
+	if err != nil {
+		return err
+	}
+	if policy == nil {
+		*result = types.SigningPolicy{Namespace: args.Namespace}
+		return nil
+	}
+	*result = *policy
+	return nil
+}
+
+// Get what a client needs to sign a commit it's about to make on a branch,
+// including a digest of the branch's working copy, which the master has to
+// read all of to work out.
+func (d *DotmeshRPC) CommitSigningInfo(
+	r *http.Request,
+	args *struct{ Namespace, Name, Branch string },
+	result *types.CommitSigningInfo,
+) error {
+	err := validator.IsValidVolume(args.Namespace, args.Name)
+	if err != nil {
+		return err
+	}
+
+	err = validator.IsValidBranchName(args.Branch)
+	if err != nil {
+		return err
+	}
+
+	filesystemId, err := d.state.registry.MaybeCloneFilesystemId(
+		VolumeName{Namespace: args.Namespace, Name: args.Name},
+		args.Branch,
+	)
+	if err != nil {
+		return err
+	}
+	parentId, err := d.state.latestCommitId(filesystemId)
+	if err != nil {
+		return err
+	}
+
+	contentDigest, err := d.state.workingCopyDigest(filesystemId)
+	if err != nil {
+		return err
+	}
+
+	*result = types.CommitSigningInfo{
+		DotId:         filesystemId,
+		ParentId:      parentId,
+		ContentDigest: contentDigest,
+	}
+	return nil
+}
+
+// Work out the content digest of a working copy this node is master of, for
+// CommitSigningInfo on another node.
+func (d *DotmeshRPC) DigestWorkingCopy(
+	r *http.Request,
+	args *struct{ FilesystemId string },
+	result *string,
+) error {
+	err := ensureAdminUser(r)
+	if err != nil {
+		return err
+	}
+	_, _, err = d.state.registry.LookupFilesystemById(args.FilesystemId)
+	if err != nil {
+		return err
+	}
+	*result, err = d.state.localWorkingCopyDigest(args.FilesystemId)
+	return err
+}
+
+// Register a public key for the current user to sign commits with.
+func (d *DotmeshRPC) AddSigningKey(
+	r *http.Request,
+	args *struct{ Name, PublicKey string },
+	result *types.SigningKey,
+) error {
+	if args.Name == "" {
+		return fmt.Errorf("Please name the key")
+	}
+	_, err := signing.DecodePublicKey(args.PublicKey)
+	if err != nil {
+		return err
+	}
+
+	u, err := d.usersManager.Get(&user.Query{Ref: auth.GetUserID(r)})
+	if err != nil {
+		return err
+	}
+	for _, key := range u.SigningKeys {
+		if key.Name == args.Name {
+			return fmt.Errorf("You already have a key called %s", args.Name)
+		}
+		if key.PublicKey == args.PublicKey {
+			return fmt.Errorf("That key is already registered as %s", key.Name)
+		}
+	}
+
+	key := types.SigningKey{
+		Name:      args.Name,
+		PublicKey: args.PublicKey,
+		Created:   time.Now().UTC(),
+	}
+	u.SigningKeys = append(u.SigningKeys, key)
+	_, err = d.usersManager.Update(u)
+	if err != nil {
+		return err
+	}
+	*result = key
+	return nil
+}
+
+// Stop trusting one of the current user's signing keys. Commits it signed
+// no longer verify as the user's.
+func (d *DotmeshRPC) RemoveSigningKey(
+	r *http.Request,
+	args *struct{ Name string },
+	result *bool,
+) error {
+	u, err := d.usersManager.Get(&user.Query{Ref: auth.GetUserID(r)})
+	if err != nil {
+		return err
+	}
+	keys := []types.SigningKey{}
+	for _, key := range u.SigningKeys {
+		if key.Name != args.Name {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == len(u.SigningKeys) {
+		return fmt.Errorf("You have no key called %s", args.Name)
+	}
+	u.SigningKeys = keys
+	_, err = d.usersManager.Update(u)
+	if err != nil {
+		return err
+	}
+	*result = true
+	return nil
+}
+
+// organizations is the user manager, if it keeps organizations
+func (d *DotmeshRPC) organizations() (user.OrganizationManager, error) {
+	om, ok := d.usersManager.(user.OrganizationManager)
+	if !ok {
+		return nil, fmt.Errorf("This cluster's user manager doesn't support organizations")
+	}
+	return om, nil
+}
+
+// Make an organization, with its own namespace, owned by the current user
+func (d *DotmeshRPC) CreateOrganization(
+	r *http.Request,
+	args *struct{ Name string },
+	result *types.Organization,
+) error {
+	om, err := d.organizations()
+	if err != nil {
+		return err
+	}
+	u, err := d.usersManager.Get(&user.Query{Ref: auth.GetUserID(r)})
+	if err != nil {
+		return err
+	}
+	org, err := om.NewOrganization(args.Name, u)
+	if err != nil {
+		return err
+	}
+	*result = *org
+	return nil
+}
+
+// List the organizations the current user is a member of
+func (d *DotmeshRPC) Organizations(
+	r *http.Request,
+	args *struct{},
+	result *[]types.Organization,
+) error {
+	om, err := d.organizations()
+	if err != nil {
+		return err
+	}
+	orgs, err := om.ListOrganizations(auth.GetUser(r))
+	if err != nil {
+		return err
+	}
+	*result = []types.Organization{}
+	for _, org := range orgs {
+		*result = append(*result, *org)
+	}
+	return nil
+}
+
+// Get an organization the current user is a member of, with its members
+func (d *DotmeshRPC) Organization(
+	r *http.Request,
+	args *struct{ Name string },
+	result *types.Organization,
+) error {
+	om, err := d.organizations()
+	if err != nil {
+		return err
+	}
+	org, err := om.GetOrganization(args.Name)
+	if err != nil {
+		return err
+	}
+	_, member := org.Role(auth.GetUserID(r))
+	if !member && auth.GetUserID(r) != ADMIN_USER_UUID {
+		return fmt.Errorf("You are not a member of %s", args.Name)
+	}
+	*result = *org
+	return nil
+}
+
+// checkOrganizationOwner returns an error unless the current user owns an
+// organization, or is the admin user
+func checkOrganizationOwner(r *http.Request, org *types.Organization) error {
+	if auth.GetUserID(r) == ADMIN_USER_UUID {
+		return nil
+	}
+	role, _ := org.Role(auth.GetUserID(r))
+	if role != types.OrganizationRoleOwner {
+		return fmt.Errorf("Only owners of %s can change its members", org.Name)
+	}
+	return nil
+}
+
+// Add a user to an organization, or change their role in it: "owner" or
+// "member". Only its owners can.
+func (d *DotmeshRPC) AddOrganizationMember(
+	r *http.Request,
+	args *struct {
+		Organization, Member string
+		Role                 types.OrganizationRole
+	},
+	result *types.Organization,
+) error {
+	om, err := d.organizations()
+	if err != nil {
+		return err
+	}
+	org, err := om.GetOrganization(args.Organization)
+	if err != nil {
+		return err
+	}
+	err = checkOrganizationOwner(r, org)
+	if err != nil {
+		return err
+	}
+	if args.Role == "" {
+		args.Role = types.OrganizationRoleMember
+	}
+	org, err = om.AddOrganizationMember(args.Organization, args.Member, args.Role)
+	if err != nil {
+		return err
+	}
+	*result = *org
+	return nil
+}
+
+// Remove a user from an organization. Only its owners can, but anyone can
+// leave.
+func (d *DotmeshRPC) RemoveOrganizationMember(
+	r *http.Request,
+	args *struct{ Organization, Member string },
+	result *types.Organization,
+) error {
+	om, err := d.organizations()
+	if err != nil {
+		return err
+	}
+	org, err := om.GetOrganization(args.Organization)
+	if err != nil {
+		return err
+	}
+	current := auth.GetUser(r)
+	if args.Member != current.Name && args.Member != current.Id {
+		err = checkOrganizationOwner(r, org)
+		if err != nil {
+			return err
+		}
+	}
+	org, err = om.RemoveOrganizationMember(args.Organization, args.Member)
+	if err != nil {
+		return err
+	}
+	*result = *org
+	return nil
+}
+
+// List the keys a user signs commits with, to check their commits'
+// signatures. Public keys are no secret, so anyone can ask about anyone.
+// An empty Name means the current user.
+func (d *DotmeshRPC) SigningKeys(
+	r *http.Request,
+	args *struct{ Name string },
+	result *[]types.SigningKey,
+) error {
+	ref := args.Name
+	if ref == "" {
+		ref = auth.GetUserID(r)
+	}
+	u, err := d.usersManager.Get(&user.Query{Ref: ref})
+	if err != nil {
+		return err
+	}
+	*result = append([]types.SigningKey{}, u.SigningKeys...)
+	return nil
+}
+
+// Work out a commit's content digest again on every node holding a copy of
+// it, and compare them with the digest recorded when it was made. An empty
+// SnapshotId means the branch's latest commit.
+func (d *DotmeshRPC) Verify(
+	r *http.Request,
+	args *struct{ Namespace, Name, Branch, SnapshotId string },
+	result *types.VerifyResult,
+) error {
+	err := validator.IsValidVolume(args.Namespace, args.Name)
+	if err != nil {
+		return err
+	}
+
+	err = validator.IsValidBranchName(args.Branch)
+	if err != nil {
+		return err
+	}
+
+	if args.SnapshotId != "" {
+		err = validator.IsValidSnapshotName(args.SnapshotId)
+		if err != nil {
+			return err
+		}
+	}
+
+	filesystemId, err := d.state.registry.MaybeCloneFilesystemId(
+		VolumeName{Namespace: args.Namespace, Name: args.Name},
+		args.Branch,
+	)
+	if err != nil {
+		return err
+	}
+	tlf, _, err := d.state.registry.LookupFilesystemById(filesystemId)
+	if err != nil {
+		return err
+	}
+	snapshots, err := d.state.SnapshotsForCurrentMaster(filesystemId)
+	if err != nil {
+		return err
+	}
+	if len(snapshots) == 0 {
+		return fmt.Errorf("There are no commits to verify")
+	}
+	commit := &snapshots[len(snapshots)-1]
+	if args.SnapshotId != "" {
+		commit = nil
+		for i := range snapshots {
+			if snapshots[i].Id == args.SnapshotId {
+				commit = &snapshots[i]
+			}
+		}
+		if commit == nil {
+			return fmt.Errorf("No commit %s on that branch", args.SnapshotId)
+		}
+	}
+
+	verified, err := d.state.verifyCommit(tlf, filesystemId, commit)
+	if err != nil {
+		return err
+	}
+	*result = *verified
+	return nil
+}
+
+// Work out the content digest of this node's copy of a commit, for Verify
+// on another node.
+func (d *DotmeshRPC) DigestCommit(
+	r *http.Request,
+	args *struct{ FilesystemId, SnapshotId string },
+	result *types.NodeVerification,
+) error {
+	err := ensureAdminUser(r)
+	if err != nil {
+		return err
+	}
+	_, _, err = d.state.registry.LookupFilesystemById(args.FilesystemId)
+	if err != nil {
+		return err
+	}
+	err = validator.IsValidSnapshotName(args.SnapshotId)
+	if err != nil {
+		return err
+	}
+	*result = d.state.digestCommit(args.FilesystemId, args.SnapshotId)
+	return nil
+}
+
+// Pull a branch from another cluster every time it announces a new commit on
+// it over NATS. Returns the new subscription's id.
+func (d *DotmeshRPC) SubscribeToCommits(
+	r *http.Request,
+	args *types.CommitSubscription,
+	result *string,
+) error {
+	err := ensureAdminUser(r)
+	if err != nil {
+		return err
+	}
+
+	err = validator.IsValidVolume(args.LocalNamespace, args.LocalName)
+	if err != nil {
+		return err
+	}
+	err = validator.IsValidBranchName(args.LocalBranchName)
+	if err != nil {
+		return err
+	}
+	if args.NatsURL == "" {
+		return fmt.Errorf("NatsURL is required")
+	}
+	if args.Peer == "" {
+		return fmt.Errorf("Peer is required")
+	}
+
+	id, err := uuid.NewV4()
+	if err != nil {
+		return err
+	}
+	subscription := *args
+	subscription.Meta = nil
+	subscription.Id = id.String()
+
+	err = d.state.filesystemStore.SetCommitSubscription(&subscription, &store.SetOptions{})
+	if err != nil {
+		return err
+	}
+	*result = subscription.Id
+	return nil
+}
+
+func (d *DotmeshRPC) UnsubscribeFromCommits(
+	r *http.Request,
+	args *string,
+	result *bool,
+) error {
+	err := ensureAdminUser(r)
+	if err != nil {
+		return err
+	}
+
+	_, err = d.state.filesystemStore.GetCommitSubscription(*args)
+	if err != nil {
+		if store.IsKeyNotFound(err) {
+			return fmt.Errorf("No such commit subscription: %s", *args)
+		}
+		return err
+	}
+
+	err = d.state.filesystemStore.DeleteCommitSubscription(*args)
+	if err != nil {
+		return err
+	}
+	err = d.state.filesystemStore.DeleteCommitSubscriptionStatus(*args)
+	if err != nil && !store.IsKeyNotFound(err) {
+		return err
+	}
+	*result = true
+	return nil
+}
+
+// List commit subscriptions, without their credentials, along with what the
+// node handling each one last reported.
+func (d *DotmeshRPC) ListCommitSubscriptions(
+	r *http.Request,
+	args *struct{},
+	result *[]types.CommitSubscriptionInfo,
+) error {
+	err := ensureAdminUser(r)
+	if err != nil {
+		return err
+	}
+
+	subscriptions, err := d.state.filesystemStore.ListCommitSubscriptions()
+	if err != nil {
+		return err
+	}
+
+	infos := []types.CommitSubscriptionInfo{}
+	for _, cs := range subscriptions {
+		info := types.CommitSubscriptionInfo{Subscription: cs.Safe()}
+		status, err := d.state.filesystemStore.GetCommitSubscriptionStatus(cs.Id)
+		if err == nil {
+			status.Meta = nil
+			info.Status = status
+		} else if !store.IsKeyNotFound(err) {
+			return err
+		}
+		infos = append(infos, info)
 	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Subscription.Id < infos[j].Subscription.Id
+	})
+	*result = infos
 	return nil
 }
 
@@ -1005,6 +1935,91 @@ func (d *DotmeshRPC) Rollback(
 	return nil
 }
 
+// Copy files or directories out of a commit into the working copy of a
+// branch, leaving everything else in it alone, and optionally commit the
+// result.
+func (d *DotmeshRPC) Restore(
+	r *http.Request,
+	args *types.RestoreArgs,
+	result *types.RestoreResult,
+) error {
+	err := ensureAdminUser(r)
+	if err != nil {
+		return err
+	}
+
+	err = validator.IsValidVolume(args.Namespace, args.Name)
+	if err != nil {
+		return err
+	}
+
+	err = validator.IsValidBranchName(args.Branch)
+	if err != nil {
+		return err
+	}
+
+	err = validator.IsValidSnapshotName(args.SnapshotId)
+	if err != nil {
+		return err
+	}
+
+	if len(args.Paths) == 0 {
+		return fmt.Errorf("No paths to restore")
+	}
+
+	filesystemId, err := d.state.registry.MaybeCloneFilesystemId(
+		VolumeName{Namespace: args.Namespace, Name: args.Name},
+		args.Branch,
+	)
+	if err != nil {
+		return err
+	}
+	responseChan, err := d.state.globalFsRequest(
+		filesystemId,
+		&Event{Name: "restore",
+			Args: &EventArgs{"snapshotId": args.SnapshotId, "paths": args.Paths}},
+	)
+	if err != nil {
+		return err
+	}
+
+	e := <-responseChan
+	if e.Name != "restored" {
+		return maybeError(e, "restored")
+	}
+	log.Printf(
+		"Restored %v in %s/%s@%s from %s",
+		args.Paths,
+		args.Namespace,
+		args.Name,
+		args.Branch,
+		args.SnapshotId,
+	)
+	// a number, once it has been through JSON
+	if files, ok := (*e.Args)["files"].(float64); ok {
+		result.Files = int(files)
+	}
+
+	if !args.Commit {
+		return nil
+	}
+	message := args.Message
+	if message == "" {
+		message = fmt.Sprintf("Restore %s from %s", strings.Join(args.Paths, ", "), args.SnapshotId)
+	}
+	return d.Commit(r, &types.CommitArgs{
+		Namespace: args.Namespace,
+		Name:      args.Name,
+		Branch:    args.Branch,
+		Message:   message,
+		Metadata: map[string]string{
+			"type":           "restore",
+			"restore.commit": args.SnapshotId,
+			"restore.paths":  strings.Join(args.Paths, ","),
+		},
+	}, &result.CommitId)
+}
+
 func maybeError(e *Event, expected string) error {
 	if e.Error() != nil {
 		log.Errorf("unexpected response '%s' (expected: '%s') - %#v", e.Name, expected, e.Args)
@@ -1111,6 +2126,12 @@ func (d *DotmeshRPC) Branch(
 			"Cloned %s:%s@%s (%s) to %s", args.Name,
 			args.SourceBranch, args.SourceCommitId, originFilesystemId, (*e.Args)["newFilesystemId"].(string),
 		)
+		d.state.notify(tlf, &types.Notification{
+			Type:         types.NotificationBranchCreated,
+			FilesystemId: (*e.Args)["newFilesystemId"].(string),
+			Branch:       args.NewBranchName,
+			CommitId:     args.SourceCommitId,
+		})
 		*result = true
 	} else {
 		return maybeError(e, "cloned")
@@ -1299,6 +2320,133 @@ func (d *DotmeshRPC) GetTransfer(r *http.Request, args *string, result *Transfer
 	return nil
 }
 
+// transferInFlight says whether a transfer is still going, or could be
+// resumed
+func transferInFlight(t TransferPollResult) bool {
+	switch t.Status {
+	case "finished", "error", "cancelled":
+		return false
+	}
+	return true
+}
+
+// canControlTransfer says whether the user making a request may see and
+// control a transfer: the admin user can, as can anyone who can see the dot
+// it's a transfer of.
+func (d *DotmeshRPC) canControlTransfer(r *http.Request, t TransferPollResult) (bool, error) {
+	if auth.GetUserID(r) == ADMIN_USER_UUID {
+		return true, nil
+	}
+	tlf, _, err := d.state.registry.LookupFilesystemById(t.FilesystemId)
+	if err != nil {
+		// e.g. a pull of a dot that isn't registered yet
+		return false, nil
+	}
+	return d.state.userManager.Authorize(auth.GetUser(r), true, &tlf)
+}
+
+// ListTransfers returns the transfers in progress that the user can see,
+// without the credentials they were started with. With All, finished,
+// failed and cancelled transfers are included too.
+func (d *DotmeshRPC) ListTransfers(r *http.Request, args *struct{ All bool }, result *[]TransferPollResult) error {
+	d.state.interclusterTransfersLock.RLock()
+	transfers := []TransferPollResult{}
+	for _, t := range d.state.interclusterTransfers {
+		if args.All || transferInFlight(t) {
+			transfers = append(transfers, t)
+		}
+	}
+	d.state.interclusterTransfersLock.RUnlock()
+
+	*result = []TransferPollResult{}
+	for _, t := range transfers {
+		allowed, err := d.canControlTransfer(r, t)
+		if err != nil {
+			return err
+		}
+		if !allowed {
+			continue
+		}
+		t.ApiKey = ""
+		*result = append(*result, t)
+	}
+	sort.Slice(*result, func(i, j int) bool {
+		a, b := (*result)[i], (*result)[j]
+		if a.LocalNamespace+"/"+a.LocalName != b.LocalNamespace+"/"+b.LocalName {
+			return a.LocalNamespace+"/"+a.LocalName < b.LocalNamespace+"/"+b.LocalName
+		}
+		return a.TransferRequestId < b.TransferRequestId
+	})
+	return nil
+}
+
+// CancelTransfer stops a push or pull in progress. Commits already
+// transferred are kept, and the dot goes back to how it was before the
+// transfer started; an S3 pull leaves the files it downloaded as uncommitted
+// changes.
+func (d *DotmeshRPC) CancelTransfer(r *http.Request, args *string, result *bool) error {
+	err := d.controlTransfer(r, *args, fsm.TransferActionCancel)
+	*result = err == nil
+	return err
+}
+
+// PauseTransfer stops a push or pull in progress from reading any more data
+// until ResumeTransfer is called, keeping its connections open.
+func (d *DotmeshRPC) PauseTransfer(r *http.Request, args *string, result *bool) error {
+	err := d.controlTransfer(r, *args, fsm.TransferActionPause)
+	*result = err == nil
+	return err
+}
+
+func (d *DotmeshRPC) ResumeTransfer(r *http.Request, args *string, result *bool) error {
+	err := d.controlTransfer(r, *args, fsm.TransferActionResume)
+	*result = err == nil
+	return err
+}
+
+// controlTransfer has the node running a transfer cancel, pause or resume it
+func (d *DotmeshRPC) controlTransfer(r *http.Request, transferId, action string) error {
+	d.state.interclusterTransfersLock.RLock()
+	t, ok := d.state.interclusterTransfers[transferId]
+	d.state.interclusterTransfersLock.RUnlock()
+	if !ok {
+		return fmt.Errorf("No such intercluster transfer %s", transferId)
+	}
+	allowed, err := d.canControlTransfer(r, t)
+	if err != nil {
+		return err
+	}
+	if !allowed {
+		return fmt.Errorf("You are not allowed to control transfer %s", transferId)
+	}
+	if !transferInFlight(t) {
+		return fmt.Errorf("Transfer %s has already %s", transferId, t.Status)
+	}
+
+	node := t.InitiatorNodeId
+	if node == d.state.NodeID() {
+		return d.state.controlLocalTransfer(transferId, action)
+	}
+	if len(d.state.AddressesForServer(node)) == 0 {
+		// the record of a transfer started by another cluster, which is the
+		// one to control it
+		return fmt.Errorf(
+			"Transfer %s was started by another cluster, %s it there", transferId, action,
+		)
+	}
+	client, err := d.state.nodeClient(node)
+	if err != nil {
+		return err
+	}
+	methods := map[string]string{
+		fsm.TransferActionCancel: "DotmeshRPC.CancelTransfer",
+		fsm.TransferActionPause:  "DotmeshRPC.PauseTransfer",
+		fsm.TransferActionResume: "DotmeshRPC.ResumeTransfer",
+	}
+	var done bool
+	return client.CallRemote(r.Context(), methods[action], transferId, &done)
+}
+
 func (d *DotmeshRPC) S3Transfer(r *http.Request, args *types.S3TransferRequest, result *string) error {
 	localVolumeName := VolumeName{
 		Namespace: args.LocalNamespace,
@@ -1402,28 +2550,45 @@ func (d *DotmeshRPC) S3Transfer(r *http.Request, args *types.S3TransferRequest,
 	}
 	// TODO: do divergence based on extra commits
 
-	// Now run globalFsRequest, returning the request id, to make the master of
-	// a (possibly nonexisting) filesystem start pulling or pushing it, and
-	// make it update status as it goes in a new pollable "transfers" object in
-	// etcd.
-
-	responseChan, requestId, err := d.state.globalFsRequestId(
-		localFilesystemId,
-		&Event{Name: "s3-transfer",
-			Args: &EventArgs{
-				"Transfer": args,
-			},
-		},
-	)
+	// Queue the transfer, returning its id, to have the master of a
+	// (possibly nonexisting) filesystem start pulling or pushing it when its
+	// turn comes, and make it update status as it goes in a new pollable
+	// "transfers" object in etcd.
+	id, err := uuid.NewV4()
 	if err != nil {
 		return err
 	}
-	go func() {
-		// asynchronously throw away the response, transfers can be polled via
-		// their own entries in etcd
+	requestId := id.String()
+	err = d.state.queueTransfer(TransferPollResult{
+		TransferRequestId: requestId,
+		Direction:         args.Direction,
+		LocalNamespace:    args.LocalNamespace,
+		LocalName:         args.LocalName,
+		LocalBranchName:   args.LocalBranchName,
+		RemoteName:        args.RemoteName,
+		FilesystemId:      localFilesystemId,
+		Priority:          args.Priority,
+	}, func() {
+		responseChan, err := d.state.globalFsRequestWithId(
+			localFilesystemId, requestId,
+			&Event{Name: "s3-transfer",
+				Args: &EventArgs{
+					"Transfer": args,
+				},
+			},
+		)
+		if err != nil {
+			d.state.transferFailedToStart(requestId, err)
+			return
+		}
+		// throw away the response, transfers can be polled via their own
+		// entries in etcd
 		e := <-responseChan
 		log.Printf("finished transfer of %+v, %+v", args, e)
-	}()
+	})
+	if err != nil {
+		return err
+	}
 
 	*result = requestId
 	return nil
@@ -1512,6 +2677,19 @@ func (d *DotmeshRPC) Transfer(
 	args *types.TransferRequest,
 	result *string,
 ) error {
+	user, _, _ := r.BasicAuth()
+	requestId, err := d.startTransfer(r.Context(), user, args)
+	if err != nil {
+		return err
+	}
+	*result = requestId
+	return nil
+}
+
+// startTransfer kicks off a push or pull with a peer on behalf of author
+// (who is credited with any commit made when stashing divergence), returning
+// the id of the transfer to poll.
+func (d *DotmeshRPC) startTransfer(ctx context.Context, author string, args *types.TransferRequest) (string, error) {
 	client := dmclient.NewJsonRpcClient(args.User, args.Peer, args.ApiKey, args.Port)
 
 	log.Infof("[Transfer] starting with %+v", safeArgs(*args))
@@ -1519,22 +2697,22 @@ func (d *DotmeshRPC) Transfer(
 	// Remote name is welcome to be invalid, that's the far end's problem
 	err := validator.IsValidVolume(args.LocalNamespace, args.LocalName)
 	if err != nil {
-		return err
+		return "", err
 	}
 	err = validator.IsValidBranchName(args.LocalBranchName)
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	var remoteFilesystemId string
-	err = client.CallRemote(r.Context(),
+	err = client.CallRemote(ctx,
 		"DotmeshRPC.Exists", map[string]string{
 			"Namespace": args.RemoteNamespace,
 			"Name":      args.RemoteName,
 			"Branch":    args.RemoteBranchName,
 		}, &remoteFilesystemId)
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	localFilesystemId := d.state.registry.Exists(
@@ -1545,13 +2723,13 @@ func (d *DotmeshRPC) Transfer(
 	localExists := localFilesystemId != ""
 
 	if !remoteExists && !localExists {
-		return fmt.Errorf("Both local and remote filesystems don't exist.")
+		return "", fmt.Errorf("Both local and remote filesystems don't exist.")
 	}
 	if args.Direction == "push" && !localExists {
-		return fmt.Errorf("Can't push when local doesn't exist")
+		return "", fmt.Errorf("Can't push when local doesn't exist")
 	}
 	if args.Direction == "pull" && !remoteExists {
-		return fmt.Errorf("Can't pull when remote doesn't exist")
+		return "", fmt.Errorf("Can't pull when remote doesn't exist")
 	}
 
 	var localPath, remotePath PathToTopLevelFilesystem
@@ -1560,7 +2738,7 @@ func (d *DotmeshRPC) Transfer(
 			VolumeName{Namespace: args.LocalNamespace, Name: args.LocalName}, args.LocalBranchName,
 		)
 		if err != nil {
-			return fmt.Errorf(
+			return "", fmt.Errorf(
 				"Can't deduce path to top level filesystem for %s/%s,%s: %s",
 				args.LocalNamespace, args.LocalName, args.LocalBranchName, err,
 			)
@@ -1573,7 +2751,7 @@ func (d *DotmeshRPC) Transfer(
 			Name:      args.RemoteName,
 		}
 	} else if args.Direction == "pull" {
-		err := client.CallRemote(r.Context(),
+		err := client.CallRemote(ctx,
 			"DotmeshRPC.DeducePathToTopLevelFilesystem", map[string]interface{}{
 				"RemoteNamespace":      args.RemoteNamespace,
 				"RemoteFilesystemName": args.RemoteName,
@@ -1582,7 +2760,7 @@ func (d *DotmeshRPC) Transfer(
 			&remotePath,
 		)
 		if err != nil {
-			return fmt.Errorf(
+			return "", fmt.Errorf(
 				"Can't deduce path to top level filesystem for %s/%s,%s: %s",
 				args.RemoteNamespace, args.RemoteName, args.RemoteBranchName, err,
 			)
@@ -1603,7 +2781,7 @@ func (d *DotmeshRPC) Transfer(
 		// land on on the remote
 		var result bool
 
-		err := client.CallRemote(r.Context(),
+		err := client.CallRemote(ctx,
 			"DotmeshRPC.RegisterFilesystem", map[string]interface{}{
 				"Namespace":              args.RemoteNamespace,
 				"TopLevelFilesystemName": args.RemoteName,
@@ -1617,14 +2795,14 @@ func (d *DotmeshRPC) Transfer(
 				"PathToTopLevelFilesystem": remotePath,
 			}, &result)
 		if err != nil {
-			return err
+			return "", err
 		}
 		filesystemId = localFilesystemId
 	} else if args.Direction == "pull" && !localExists {
 		// pre-create the local registry entry and pick a master for it to land
 		// on locally (me!)
 		err = d.registerFilesystemBecomeMaster(
-			r.Context(),
+			ctx,
 			args.LocalNamespace,
 			args.LocalName,
 			args.LocalBranchName,
@@ -1632,11 +2810,11 @@ func (d *DotmeshRPC) Transfer(
 			localPath,
 		)
 		if err != nil {
-			return err
+			return "", err
 		}
 		filesystemId = remoteFilesystemId
 	} else if remoteExists && localExists && remoteFilesystemId != localFilesystemId {
-		return fmt.Errorf(
+		return "", fmt.Errorf(
 			"Cannot reconcile filesystems with different ids, remote=%s, local=%s, args=%+v",
 			remoteFilesystemId, localFilesystemId, safeArgs(*args),
 		)
@@ -1657,7 +2835,7 @@ func (d *DotmeshRPC) Transfer(
 			if args.Direction == "push" {
 				// Ask the remote
 				var v DotmeshVolume
-				err := client.CallRemote(r.Context(), "DotmeshRPC.Get", filesystemId, &v)
+				err := client.CallRemote(ctx, "DotmeshRPC.Get", filesystemId, &v)
 				if err != nil {
 					return err
 				}
@@ -1665,7 +2843,7 @@ func (d *DotmeshRPC) Transfer(
 				dirtyBytes = v.DirtyBytes
 				log.Infof("[TransferIt] got %d dirty bytes for %s from peer", dirtyBytes, filesystemId)
 
-				err = client.CallRemote(r.Context(), "DotmeshRPC.ContainersById", filesystemId, &cs)
+				err = client.CallRemote(ctx, "DotmeshRPC.ContainersById", filesystemId, &cs)
 				if err != nil {
 					return err
 				}
@@ -1676,13 +2854,12 @@ func (d *DotmeshRPC) Transfer(
 
 			} else if args.Direction == "pull" {
 				// Consult ourselves
-				dirtyBytes, containersRunning, err = d.dirtyDataAndRunningContainers(r.Context(), filesystemId)
+				dirtyBytes, containersRunning, err = d.dirtyDataAndRunningContainers(ctx, filesystemId)
 			}
 
 			if dirtyBytes > 0 {
 				if args.StashDivergence {
-					user, _, _ := r.BasicAuth()
-					meta := map[string]string{"message": "committing dirty data ready for stashing", "author": user}
+					meta := map[string]string{"message": "committing dirty data ready for stashing", "author": author}
 					responseChan, err := d.state.globalFsRequest(
 						filesystemId,
 						&Event{Name: "snapshot",
@@ -1722,11 +2899,11 @@ func (d *DotmeshRPC) Transfer(
 			return nil
 		}, "checking for dirty data and running containers", 5)
 		if err != nil {
-			return err
+			return "", err
 		}
 
 	} else {
-		return fmt.Errorf(
+		return "", fmt.Errorf(
 			"Unexpected combination of factors: "+
 				"remoteExists: %t, localExists: %t, "+
 				"remoteFilesystemId: %s, localFilesystemId: %s",
@@ -1734,50 +2911,38 @@ func (d *DotmeshRPC) Transfer(
 		)
 	}
 
-	// Now run globalFsRequest, returning the request id, to make the master of
-	// a (possibly nonexisting) filesystem start pulling or pushing it, and
-	// make it update status as it goes in a new pollable "transfers" object in
-	// etcd.
-
-	responseChan, requestId, err := d.state.globalFsRequestId(
-		filesystemId,
-		&Event{Name: "transfer",
-			Args: &EventArgs{
-				"Transfer": args,
-			},
-		},
-	)
-	if err != nil {
-		return err
-	}
-
-	startingPollResult := TransferPollResult{
-		TransferRequestId: requestId,
-		Status:            "starting",
-	}
-
-	logFields := log.Fields{
-		"startingPollResult": fmt.Sprintf("%#v", startingPollResult),
-	}
-	log.WithFields(logFields).Info("transfer started, updating poll result in-memory and in-kv")
-
-	// Immediately store the fact in our local state as well, to avoid
-	// issues where we miss the "echo" from kv store when the update
-	// happens locally.
-	d.state.UpdateInterclusterTransfer(requestId, startingPollResult)
-
-	// And persist it to the kv store.
-	err = d.state.filesystemStore.SetTransfer(&startingPollResult, &store.SetOptions{})
+	// Queue the transfer, returning its id, to have the master of a
+	// (possibly nonexisting) filesystem start pulling or pushing it when its
+	// turn comes, and make it update status as it goes in a new pollable
+	// "transfers" object in etcd.
+	id, err := uuid.NewV4()
 	if err != nil {
-		log.WithFields(logFields).WithError(err).Error("Failed setting transfer state for starting poll result")
+		return "", err
 	}
-
-	go func() {
-		// asynchronously consume the response, and update any in-progress
-		// transfer in error cases
+	requestId := id.String()
+	queuedPollResult := fsm.TransferPollResultFromTransferRequest(
+		requestId, *args, d.state.NodeID(), 0, 0, transferqueue.Queued,
+	)
+	queuedPollResult.FilesystemId = filesystemId
+
+	err = d.state.queueTransfer(queuedPollResult, func() {
+		responseChan, err := d.state.globalFsRequestWithId(
+			filesystemId, requestId,
+			&Event{Name: "transfer",
+				Args: &EventArgs{
+					"Transfer": args,
+				},
+			},
+		)
+		if err != nil {
+			d.state.transferFailedToStart(requestId, err)
+			return
+		}
+		// consume the response, and update any in-progress transfer in error
+		// cases
 		e := <-responseChan
 		// detect success cases, ignore them - we assume that the pollResult will be updated in those cases
-		if !(e.Name == "finished-push" || e.Name == "finished-pull" || e.Name == "peer-up-to-date") {
+		if !(e.Name == "finished-push" || e.Name == "finished-pull" || e.Name == "peer-up-to-date" || e.Name == "transfer-cancelled") {
 
 			errorPollResult := TransferPollResult{
 				TransferRequestId: requestId,
@@ -1804,10 +2969,11 @@ func (d *DotmeshRPC) Transfer(
 
 		}
 		log.Infof("finished transfer of %+v, %+v", args, e)
-	}()
-
-	*result = requestId
-	return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return requestId, nil
 }
 
 func safeS3(t types.S3TransferRequest) types.S3TransferRequest {
@@ -2331,6 +3497,11 @@ func (d *DotmeshRPC) Delete(r *http.Request, args *VolumeName, result *bool) err
 		}
 	}
 
+	d.state.notify(filesystem, &types.Notification{
+		Type:         types.NotificationDotDeleted,
+		FilesystemId: rootId,
+	})
+
 	*result = true
 	return nil
 }
@@ -2810,49 +3981,29 @@ func (d *DotmeshRPC) DumpEtcd(
 		return err
 	}
 
-	var backup types.BackupV1
-
-	backup.Version = types.BackupVersion
-	backup.Created = time.Now()
-
-	users, err := d.usersManager.List("")
+	backup, err := d.state.dumpKV(true)
 	if err != nil {
-		log.WithFields(log.Fields{
-			"error": err,
-		}).Error("failed to list users")
-	} else {
-		backup.Users = users
+		return err
 	}
+	*result = *backup
 
-	filesystemMasters, err := d.state.filesystemStore.ListMaster()
-	if err != nil {
-		log.WithFields(log.Fields{
-			"error": err,
-		}).Error("failed to list filesystem masters")
-	} else {
-		backup.FilesystemMasters = filesystemMasters
-	}
+	return nil
+}
 
-	registryFilesystems, err := d.state.registryStore.ListFilesystems()
+// RecoverRegistry rebuilds what's missing from the registry from the
+// registry properties of the filesystems in this node's pool, for when the KV
+// store has been lost without a backup
+func (d *DotmeshRPC) RecoverRegistry(r *http.Request, args *types.RecoverRegistryArgs, result *types.RegistryRecovery) error {
+	err := ensureAdminUser(r)
 	if err != nil {
-		log.WithFields(log.Fields{
-			"error": err,
-		}).Error("failed to list registry filesystems")
-	} else {
-		backup.RegistryFilesystems = registryFilesystems
+		return err
 	}
 
-	registryClones, err := d.state.registryStore.ListClones()
+	recovery, err := d.state.recoverRegistry(args.DryRun)
 	if err != nil {
-		log.WithFields(log.Fields{
-			"error": err,
-		}).Error("failed to list registry clones")
-	} else {
-		backup.RegistryClones = registryClones
+		return err
 	}
-
-	*result = backup
-
+	*result = *recovery
 	return nil
 }
 
@@ -2867,143 +4018,87 @@ func (d *DotmeshRPC) RestoreEtcd(r *http.Request, args *struct {
 		return err
 	}
 
-	var backup types.BackupV1
-
-	err = json.Unmarshal([]byte(args.Dump), &backup)
+	backup, err := parseBackup([]byte(args.Dump))
 	if err != nil {
-		return fmt.Errorf("failed to unmarshal into a backup structure: %s", err)
+		return err
+	}
+	err = d.state.restoreBackup(backup)
+	if err != nil {
+		return err
 	}
+	*result = true
+	return nil
+}
 
-	supported := false
-	for _, v := range types.BackupSupportedVersions {
-		if backup.Version == v {
-			supported = true
-		}
+// ListBackups lists the KV store backups kept by scheduled backups, oldest
+// first
+func (d *DotmeshRPC) ListBackups(r *http.Request, args *struct{}, result *[]types.BackupInfo) error {
+	err := ensureAdminUser(r)
+	if err != nil {
+		return err
 	}
-	if !supported {
-		return fmt.Errorf("unsupported backup version '%s', supported version: %s", backup.Version, strings.Join(types.BackupSupportedVersions, ", "))
+	if d.state.backups == nil {
+		return fmt.Errorf("scheduled backups aren't configured, set DOTMESH_BACKUP_DIR or DOTMESH_BACKUP_S3_BUCKET")
 	}
+	backups, err := d.state.backups.List()
+	if err != nil {
+		return err
+	}
+	*result = backups
+	return nil
+}
 
-	// resetting registry in the cluster
-
-	eventID, _ := uuid.NewV4()
-	resetEvent := types.NewEvent(types.EventNameResetRegistry)
-	resetEvent.ID = eventID.String()
-
-	clusterResetComplete := make(chan struct{})
-	counter := 0
-
-	// servers
-	servers, err := d.state.serverStore.ListAddresses()
+// RestoreBackup restores the KV store from a backup, either given or one
+// kept by scheduled backups, reporting what it changes. With DryRun it only
+// reports.
+func (d *DotmeshRPC) RestoreBackup(r *http.Request, args *types.RestoreBackupArgs, result *types.RestoreReport) error {
+	err := ensureAdminUser(r)
 	if err != nil {
-		log.WithFields(log.Fields{
-			"error": err,
-		}).Error("[RestoreEtcd] failed to list server addresses")
+		return err
 	}
-	if len(servers) == 1 {
-		// only us, don't bother with cluster reset
-		d.state.resetRegistry()
-	} else {
-		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-		defer cancel()
-		ch, err := d.state.messenger.Subscribe(ctx, &types.SubscribeQuery{
-			Type:      types.EventTypeClusterResponse,
-			RequestID: resetEvent.ID,
-		})
+
+	data := []byte(args.Dump)
+	name := ""
+	if args.Dump == "" {
+		if d.state.backups == nil {
+			return fmt.Errorf("scheduled backups aren't configured, set DOTMESH_BACKUP_DIR or DOTMESH_BACKUP_S3_BUCKET")
+		}
+		backups, err := d.state.backups.List()
 		if err != nil {
-			log.WithFields(log.Fields{
-				"error": err,
-			}).Error("[RestoreEtcd] failed to subscribe to cluster events")
-		} else {
-			go func() {
-				defer close(clusterResetComplete)
-
-				// creating new ctx to wait for the acks
-				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-				defer cancel()
-				for {
-					select {
-					case <-ctx.Done():
-						// timeout
-						log.WithFields(log.Fields{
-							"servers":  len(servers),
-							"received": counter,
-						}).Info("[RestoreEtcd] some registry reset acks were missed, continuing with restore...")
-						return
-					case event, ok := <-ch:
-						if !ok {
-							log.WithFields(log.Fields{
-								"servers":  len(servers),
-								"received": counter,
-							}).Info("[RestoreEtcd] registry reset ack listener closed")
-							return
-						}
-						if event.ID == resetEvent.ID && event.Name == types.EventNameResetRegistryComplete {
-							counter++
-						}
-						if counter >= len(servers) {
-
-							log.WithFields(log.Fields{
-								"servers": len(servers),
-							}).Info("[RestoreEtcd] all registry reset acks received")
-							return
-						}
-					}
-				}
-			}()
+			return err
 		}
-
-		err = d.state.messenger.Publish(resetEvent)
+		at := args.At
+		if at.IsZero() {
+			at = time.Now()
+		}
+		name, err = findBackup(backups, args.Backup, at)
 		if err != nil {
-			log.WithFields(log.Fields{
-				"error": err,
-			}).Error("[RestoreEtcd] failed to dispatch reset registry event")
-		} else {
-			log.Info("[RestoreEtcd] cluster registry reset event dispatched, waiting for responses...")
-			<-clusterResetComplete
+			return err
 		}
-	}
-
-	// importing objects
-
-	var errs []error
-
-	for _, u := range backup.Users {
-		err = d.usersManager.Import(u)
+		data, err = d.state.backups.Get(name)
 		if err != nil {
-			log.WithFields(log.Fields{
-				"error": err,
-				"user":  u.Name,
-			}).Error("failed to import user")
-			errs = append(errs, err)
+			return fmt.Errorf("failed to read backup %s: %s", name, err)
 		}
 	}
 
-	err = d.state.filesystemStore.ImportMasters(backup.FilesystemMasters, &store.ImportOptions{
-		DeleteExisting: true,
-	})
-	if err != nil {
-		errs = append(errs, err)
-	}
-
-	err = d.state.registryStore.ImportFilesystems(backup.RegistryFilesystems, &store.ImportOptions{
-		DeleteExisting: true,
-	})
+	backup, err := parseBackup(data)
 	if err != nil {
-		errs = append(errs, err)
+		return err
 	}
-
-	err = d.state.registryStore.ImportClones(backup.RegistryClones, &store.ImportOptions{
-		DeleteExisting: true,
-	})
+	current, err := d.state.dumpKV(false)
 	if err != nil {
-		errs = append(errs, err)
+		return err
 	}
+	report := types.CompareBackups(current, backup)
+	report.Backup = name
 
-	if len(errs) > 0 {
-		return fmt.Errorf("got error while importing backup: %v", errs)
+	if !args.DryRun {
+		err = d.state.restoreBackup(backup)
+		if err != nil {
+			return err
+		}
 	}
-
+	*result = report
 	return nil
 }
 
@@ -10,10 +10,12 @@ import (
 	"net/http/httputil"
 	"net/url"
 	"os"
+	"path"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/dotmesh-oss/dotmesh/pkg/archiver"
 	"github.com/dotmesh-oss/dotmesh/pkg/auth"
 	dmclient "github.com/dotmesh-oss/dotmesh/pkg/client"
 	"github.com/dotmesh-oss/dotmesh/pkg/fsm"
@@ -119,6 +121,12 @@ func (s *S3Handler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
 		return
 	}
 	branch, ok := vars["branch"]
+	if !ok {
+		// the @branch form of the route is shadowed by the plain one, so
+		// the branch can also be given as a query parameter
+		branch = req.URL.Query().Get("branch")
+		ok = branch != ""
+	}
 	bucketName := fmt.Sprintf("%s-%s", vars["namespace"], vars["name"])
 	if !ok || branch == "master" {
 		branch = ""
@@ -234,6 +242,11 @@ func (s *S3Handler) mountFilesystemSnapshot(filesystemId string, snapshotId stri
 
 func (s *S3Handler) headFile(l *log.Entry, resp http.ResponseWriter, req *http.Request, filesystemId, snapshotId, filename string) {
 	user := auth.GetUserFromCtx(req.Context())
+	format, err := directoryFormat(req)
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusBadRequest)
+		return
+	}
 	fsm, err := s.state.InitFilesystemMachine(filesystemId)
 	if err != nil {
 		http.Error(resp, "failed to initialize filesystem", http.StatusInternalServerError)
@@ -300,6 +313,8 @@ func (s *S3Handler) headFile(l *log.Entry, resp http.ResponseWriter, req *http.R
 				if ok {
 					resp.Header().Set("Content-Length", fmt.Sprintf("%d", size.(int64)))
 				}
+			} else if ok && mode.(os.FileMode).IsDir() {
+				setDirectoryHeaders(resp, filename, format)
 			}
 			resp.WriteHeader(200)
 		}
@@ -308,6 +323,11 @@ func (s *S3Handler) headFile(l *log.Entry, resp http.ResponseWriter, req *http.R
 
 func (s *S3Handler) readFile(l *log.Entry, resp http.ResponseWriter, req *http.Request, filesystemId, snapshotId, filename string) {
 	user := auth.GetUserFromCtx(req.Context())
+	format, err := directoryFormat(req)
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusBadRequest)
+		return
+	}
 	fsm, err := s.state.InitFilesystemMachine(filesystemId)
 	if err != nil {
 		http.Error(resp, "failed to initialize filesystem", http.StatusInternalServerError)
@@ -334,15 +354,32 @@ func (s *S3Handler) readFile(l *log.Entry, resp http.ResponseWriter, req *http.R
 
 		defer req.Body.Close()
 		respCh := make(chan *Event)
+
+		// directories come back as an archive, which clients need to be
+		// told about before it starts
+		fsm.StatFile(&types.OutputFile{
+			Filename:          filename,
+			User:              user.Name,
+			Response:          respCh,
+			SnapshotMountPath: (*e.Args)["mount-path"].(string),
+		})
+		result := <-respCh
+		if result.Name == types.EventNameReadSuccess {
+			if mode, ok := (*result.Args)["mode"].(os.FileMode); ok && mode.IsDir() {
+				setDirectoryHeaders(resp, filename, format)
+			}
+		}
+
 		fsm.ReadFile(&types.OutputFile{
 			Filename:          filename,
 			Contents:          resp,
 			User:              user.Name,
 			Response:          respCh,
 			SnapshotMountPath: (*e.Args)["mount-path"].(string),
+			ArchiveFormat:     string(format),
 		})
 
-		result := <-respCh
+		result = <-respCh
 
 		switch result.Name {
 		case types.EventNameReadFailed:
@@ -375,6 +412,42 @@ func (s *S3Handler) readFile(l *log.Entry, resp http.ResponseWriter, req *http.R
 	}
 }
 
+// directoryFormat is the archive format a directory should be downloaded in:
+// the one given by ?format=, or else the first one the Accept header names,
+// or else plain tar.
+func directoryFormat(req *http.Request) (archiver.Format, error) {
+	if f := req.URL.Query().Get("format"); f != "" {
+		return archiver.ParseFormat(f)
+	}
+	if format, ok := archiver.FormatFromAccept(req.Header.Get("Accept")); ok {
+		return format, nil
+	}
+	return archiver.FormatTar, nil
+}
+
+// uploadFormat is the archive format an upload to be extracted is in: the
+// one given by ?format=, or by its Content-Type, or by the extension of the
+// key. Otherwise it's left empty, for the archiver to tell from the contents.
+func uploadFormat(req *http.Request, filename string) (archiver.Format, error) {
+	if f := req.URL.Query().Get("format"); f != "" {
+		return archiver.ParseFormat(f)
+	}
+	if format, ok := archiver.FormatFromContentType(req.Header.Get("Content-Type")); ok {
+		return format, nil
+	}
+	if format, ok := archiver.FormatFromFilename(filename); ok {
+		return format, nil
+	}
+	return "", nil
+}
+
+// setDirectoryHeaders marks a response as the archive readFile sends for a
+// directory
+func setDirectoryHeaders(resp http.ResponseWriter, filename string, format archiver.Format) {
+	resp.Header().Set("Content-Type", format.ContentType())
+	resp.Header().Set("Content-Disposition", "attachment; filename=\""+path.Base(filename)+format.Extension()+"\"")
+}
+
 func (s *S3Handler) putObject(l *log.Entry, resp http.ResponseWriter, req *http.Request, filesystemId, filename string) {
 	user := auth.GetUserFromCtx(req.Context())
 	fsm, err := s.state.InitFilesystemMachine(filesystemId)
@@ -394,12 +467,23 @@ func (s *S3Handler) putObject(l *log.Entry, resp http.ResponseWriter, req *http.
 	defer req.Body.Close()
 	respCh := make(chan *Event)
 
+	extract := req.Header.Get("Extract") == "true"
+	var format archiver.Format
+	if extract {
+		format, err = uploadFormat(req, filename)
+		if err != nil {
+			http.Error(resp, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
 	fsm.WriteFile(&types.InputFile{
-		Filename: filename,
-		Contents: req.Body,
-		User:     user.Name,
-		Response: respCh,
-		Extract:  req.Header.Get("Extract") == "true",
+		Filename:      filename,
+		Contents:      req.Body,
+		User:          user.Name,
+		Response:      respCh,
+		Extract:       extract,
+		ArchiveFormat: string(format),
 	})
 
 	result := <-respCh
@@ -527,6 +611,8 @@ func (s *S3Handler) listBucket(l *log.Entry, resp http.ResponseWriter, req *http
 
 		// what path are we starting at
 		prefix := req.URL.Query().Get("Prefix")
+		// keep the listing inside the dot
+		prefix = strings.Trim(path.Clean("/"+prefix), "/")
 		base := mountPath + "/__default__"
 
 		// setting default limit to 100 files
@@ -0,0 +1,40 @@
+package main
+
+import (
+	log "github.com/sirupsen/logrus"
+)
+
+// secretsRewrapper is implemented by the stores that keep secrets, see
+// store.KVDBFilesystemStore.RewrapSecrets
+type secretsRewrapper interface {
+	RewrapSecrets() (int, error)
+}
+
+// protectSecrets rewrites the secrets in the KV store that are in the clear,
+// from before there was a secrets key or API keys were hashed, or encrypted
+// with a key that's since been rotated out of first place in the keyring
+func (s *InMemoryState) protectSecrets() error {
+	for _, kept := range []struct {
+		name  string
+		store interface{}
+	}{
+		{"filesystems", s.filesystemStore},
+		{"users", s.userManager},
+	} {
+		rewrapper, ok := kept.store.(secretsRewrapper)
+		if !ok {
+			continue
+		}
+		rewrapped, err := rewrapper.RewrapSecrets()
+		if err != nil {
+			return err
+		}
+		if rewrapped > 0 {
+			log.WithFields(log.Fields{
+				"store":     kept.name,
+				"rewrapped": rewrapped,
+			}).Info("[protectSecrets] protected secrets kept in the clear or with an old key")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+
+	dmclient "github.com/dotmesh-oss/dotmesh/pkg/client"
+	"github.com/dotmesh-oss/dotmesh/pkg/digest"
+	"github.com/dotmesh-oss/dotmesh/pkg/signing"
+	"github.com/dotmesh-oss/dotmesh/pkg/store"
+	"github.com/dotmesh-oss/dotmesh/pkg/types"
+	"github.com/dotmesh-oss/dotmesh/pkg/user"
+	"github.com/dotmesh-oss/dotmesh/pkg/utils"
+)
+
+// Signing policy for a namespace. Nil if commits to it needn't be signed.
+func (s *InMemoryState) signingPolicyFor(namespace string) (*types.SigningPolicy, error) {
+	policy, err := s.registryStore.GetSigningPolicy(namespace)
+	if err != nil {
+		if store.IsKeyNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return policy, nil
+}
+
+// latestCommitId is the commit a new commit on a branch will follow, "" if
+// it will be the first
+func (s *InMemoryState) latestCommitId(filesystemId string) (string, error) {
+	snapshots, err := s.SnapshotsForCurrentMaster(filesystemId)
+	if err != nil {
+		return "", err
+	}
+	if len(snapshots) == 0 {
+		return "", nil
+	}
+	return snapshots[len(snapshots)-1].Id, nil
+}
+
+// workingCopyDigest works out the content digest of a branch's working copy
+// on its master, for a client that's about to sign a commit of it. It reads
+// the working copy without going through the dot's state machine, which
+// would otherwise hold up every other request for the dot until it's done.
+func (s *InMemoryState) workingCopyDigest(filesystemId string) (string, error) {
+	master, err := s.registry.CurrentMasterNode(filesystemId)
+	if err != nil {
+		return "", err
+	}
+	if master == s.NodeID() {
+		return s.localWorkingCopyDigest(filesystemId)
+	}
+
+	client, err := s.nodeClient(master)
+	if err != nil {
+		return "", err
+	}
+	// the master has to read all of the working copy
+	ctx, cancel := context.WithTimeout(context.Background(), 10*dmclient.RPCTimeout)
+	defer cancel()
+	var result string
+	err = client.CallRemote(
+		ctx, "DotmeshRPC.DigestWorkingCopy", struct{ FilesystemId string }{filesystemId}, &result,
+	)
+	return result, err
+}
+
+// localWorkingCopyDigest is the content digest of a working copy mounted on
+// this node
+func (s *InMemoryState) localWorkingCopyDigest(filesystemId string) (string, error) {
+	mounted, err := utils.IsFilesystemMounted(filesystemId)
+	if err != nil {
+		return "", err
+	}
+	if !mounted {
+		return "", fmt.Errorf("The working copy of %s isn't mounted on this node, please try again", filesystemId)
+	}
+	return digest.Tree(filepath.Join(utils.Mnt(filesystemId), "__default__"))
+}
+
+// checkCommitSignature makes sure that meta, the metadata of a commit about
+// to be made on filesystemId by u, is signed with one of u's keys if it's
+// signed at all, and is signed if namespace requires it. For a signed
+// commit, it returns the parent and contents the commit was signed with,
+// which the master checks again when it makes the snapshot.
+func (s *InMemoryState) checkCommitSignature(
+	u *user.User, namespace, filesystemId string, meta map[string]string,
+) (parentId, contentDigest string, err error) {
+	if _, signed := meta[signing.SignatureKey]; !signed {
+		policy, err := s.signingPolicyFor(namespace)
+		if err != nil {
+			return "", "", err
+		}
+		if policy != nil && policy.Required {
+			return "", "", fmt.Errorf(
+				"Commits to dots in namespace %s must be signed, try 'dm key generate' and 'dm commit --sign'",
+				namespace,
+			)
+		}
+		return "", "", nil
+	}
+
+	if u == nil {
+		return "", "", fmt.Errorf("Can't check a signature without knowing who made it")
+	}
+	if meta[signing.ContentDigestKey] == "" {
+		return "", "", fmt.Errorf("Signed commits must say what their contents are signed as")
+	}
+	parentId, err = s.latestCommitId(filesystemId)
+	if err != nil {
+		return "", "", err
+	}
+	publicKey, err := signing.Verify(signing.FromMetadata(filesystemId, parentId, meta), meta)
+	if err != nil {
+		return "", "", fmt.Errorf(
+			"Invalid commit signature: %s. If someone else committed to the branch while you were signing, please try again.",
+			err,
+		)
+	}
+	for _, key := range u.SigningKeys {
+		if key.PublicKey == publicKey {
+			return parentId, meta[signing.ContentDigestKey], nil
+		}
+	}
+	return "", "", fmt.Errorf(
+		"The commit is signed with key %s, which %s hasn't registered, try 'dm key ls'",
+		signing.Fingerprint(publicKey), u.Name,
+	)
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/dotmesh-oss/dotmesh/pkg/fsm"
+	"github.com/dotmesh-oss/dotmesh/pkg/store"
+	"github.com/dotmesh-oss/dotmesh/pkg/transferqueue"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const transferQueueInterval = time.Second
+
+// queueTransfer records a transfer as queued, for start to be called once
+// the cluster's transfer limits allow it. The node that queues a transfer is
+// the one that starts it, so it's recorded as the transfer's initiator until
+// the state machine running it takes over.
+func (s *InMemoryState) queueTransfer(pollResult TransferPollResult, start func()) error {
+	pollResult.Status = transferqueue.Queued
+	pollResult.QueuedAt = time.Now()
+	pollResult.InitiatorNodeId = s.NodeID()
+
+	s.queuedTransfersLock.Lock()
+	defer s.queuedTransfersLock.Unlock()
+
+	err := s.filesystemStore.SetTransfer(&pollResult, &store.SetOptions{})
+	if err != nil {
+		return err
+	}
+	// Immediately store the fact in our local state as well, so that the
+	// next look at the queue sees it
+	s.UpdateInterclusterTransfer(pollResult.TransferRequestId, pollResult)
+	s.queuedTransfers[pollResult.TransferRequestId] = start
+	return nil
+}
+
+// runTransferQueue starts queued transfers as they get their turn, once
+// the ones this node was running or had queued before it restarted are out
+// of the way
+func (s *InMemoryState) runTransferQueue() {
+	s.failInterruptedTransfers()
+	for {
+		s.startQueuedTransfers()
+		time.Sleep(transferQueueInterval)
+	}
+}
+
+// failInterruptedTransfers marks the transfers this node had queued or was
+// running when the server last stopped as failed, as nothing will start or
+// finish them now, and otherwise they'd count towards the limits forever. It
+// has to run before this node can start any transfers of its own.
+func (s *InMemoryState) failInterruptedTransfers() {
+	transfers, err := s.filesystemStore.ListTransfers()
+	if err != nil {
+		log.WithError(err).Error("[failInterruptedTransfers] failed to list transfers")
+		return
+	}
+	for _, t := range transfers {
+		if t.InitiatorNodeId != s.NodeID() || !(t.Status == transferqueue.Queued || transferqueue.Running(*t)) {
+			continue
+		}
+		log.WithFields(log.Fields{
+			"transfer_id": t.TransferRequestId,
+			"status":      t.Status,
+		}).Info("[failInterruptedTransfers] failing transfer interrupted by a restart")
+		t.Message = fmt.Sprintf("The transfer was %s when dotmesh-server restarted, please start it again", t.Status)
+		t.Status = "error"
+		s.setQueuedTransfer(*t)
+	}
+}
+
+func (s *InMemoryState) transferLimits() transferqueue.Limits {
+	return transferqueue.Limits{
+		MaxConcurrent:        s.serverConfig.Transfers.MaxConcurrent.Value(),
+		MaxConcurrentPerPeer: s.serverConfig.Transfers.MaxConcurrentPerPeer.Value(),
+	}
+}
+
+// startQueuedTransfers starts the transfers queued on this node whose turn it
+// is, and updates the queue positions of the rest. Every node works out the
+// same order from the transfers recorded in the KV store, so the limits hold
+// across the cluster, give or take transfers queued on two nodes at the same
+// moment.
+func (s *InMemoryState) startQueuedTransfers() {
+	s.queuedTransfersLock.Lock()
+	defer s.queuedTransfersLock.Unlock()
+
+	s.interclusterTransfersLock.RLock()
+	transfers := []TransferPollResult{}
+	for _, t := range s.interclusterTransfers {
+		// the records of transfers other clusters started with us are
+		// theirs to limit
+		if len(s.AddressesForServer(t.InitiatorNodeId)) > 0 {
+			transfers = append(transfers, t)
+		}
+	}
+	s.interclusterTransfersLock.RUnlock()
+
+	positions := transferqueue.Positions(transfers, s.transferLimits())
+	for _, t := range transfers {
+		position, ok := positions[t.TransferRequestId]
+		if !ok || t.InitiatorNodeId != s.NodeID() {
+			continue
+		}
+		start, queued := s.queuedTransfers[t.TransferRequestId]
+		if !queued {
+			continue
+		}
+		if position.Start {
+			log.WithFields(log.Fields{
+				"transfer_id": t.TransferRequestId,
+				"priority":    t.Priority,
+				"waited":      time.Since(t.QueuedAt).String(),
+			}).Info("[startQueuedTransfers] starting transfer")
+			delete(s.queuedTransfers, t.TransferRequestId)
+			t.Status = "starting"
+			t.QueuePosition = 0
+			s.setQueuedTransfer(t)
+			go start()
+			continue
+		}
+		if position.Ahead != t.QueuePosition {
+			t.QueuePosition = position.Ahead
+			s.setQueuedTransfer(t)
+		}
+	}
+}
+
+// setQueuedTransfer records a change to a transfer that's waiting its turn,
+// or has just got it
+func (s *InMemoryState) setQueuedTransfer(t TransferPollResult) {
+	s.UpdateInterclusterTransfer(t.TransferRequestId, t)
+	err := s.filesystemStore.SetTransfer(&t, &store.SetOptions{})
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error":       err,
+			"transfer_id": t.TransferRequestId,
+		}).Error("[setQueuedTransfer] failed to record queued transfer")
+	}
+}
+
+// transferFailedToStart records that a transfer whose turn came couldn't be
+// handed to the state machine to run
+func (s *InMemoryState) transferFailedToStart(transferId string, err error) {
+	s.interclusterTransfersLock.RLock()
+	t := s.interclusterTransfers[transferId]
+	s.interclusterTransfersLock.RUnlock()
+	t.Status = "error"
+	t.Message = fmt.Sprintf("Couldn't start transfer: %s", err)
+	s.setQueuedTransfer(t)
+}
+
+// controlQueuedTransfer cancels a transfer that's queued on this node,
+// returning false if it isn't. Transfers can't be paused or resumed until
+// they start.
+func (s *InMemoryState) controlQueuedTransfer(transferId, action string) (bool, error) {
+	s.queuedTransfersLock.Lock()
+	defer s.queuedTransfersLock.Unlock()
+
+	if _, ok := s.queuedTransfers[transferId]; !ok {
+		return false, nil
+	}
+	if action != fsm.TransferActionCancel {
+		return true, fmt.Errorf("Transfer %s is queued, it can't be %sd until it starts", transferId, action)
+	}
+	delete(s.queuedTransfers, transferId)
+
+	s.interclusterTransfersLock.RLock()
+	t := s.interclusterTransfers[transferId]
+	s.interclusterTransfersLock.RUnlock()
+	t.Status = "cancelled"
+	t.Message = "Cancelled by request"
+	s.setQueuedTransfer(t)
+	return true, nil
+}
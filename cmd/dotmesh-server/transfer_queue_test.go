@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/dotmesh-oss/dotmesh/pkg/notification"
+	"github.com/dotmesh-oss/dotmesh/pkg/store"
+	"github.com/dotmesh-oss/dotmesh/pkg/transferqueue"
+	"github.com/dotmesh-oss/dotmesh/pkg/types"
+)
+
+func TestFailInterruptedTransfers(t *testing.T) {
+	s := newTestDirectoryState(t, nil)
+	client, err := store.NewKVDBClient(&store.KVDBConfig{Type: store.KVTypeMem})
+	if err != nil {
+		t.Fatalf("failed to init kv store: %s", err)
+	}
+	s.filesystemStore = store.NewKVDBFilesystemStore(client)
+	s.interclusterTransfers = map[string]TransferPollResult{}
+	s.interclusterTransfersLock = &sync.RWMutex{}
+	s.publisher = notification.New(context.Background())
+
+	for id, tr := range map[string]types.TransferPollResult{
+		"queued":    {Status: transferqueue.Queued, InitiatorNodeId: s.NodeID()},
+		"pushing":   {Status: "pushing", InitiatorNodeId: s.NodeID()},
+		"retrying":  {Status: "retry 2", InitiatorNodeId: s.NodeID()},
+		"finished":  {Status: "finished", InitiatorNodeId: s.NodeID()},
+		"elsewhere": {Status: "pushing", InitiatorNodeId: "another-node"},
+	} {
+		tr.TransferRequestId = id
+		err := s.filesystemStore.SetTransfer(&tr, &store.SetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s.failInterruptedTransfers()
+
+	transfers, err := s.filesystemStore.ListTransfers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		"queued":    "error",
+		"pushing":   "error",
+		"retrying":  "error",
+		"finished":  "finished",
+		"elsewhere": "pushing",
+	}
+	for _, tr := range transfers {
+		if tr.Status != expected[tr.TransferRequestId] {
+			t.Errorf("expected %s to be %s, got %s", tr.TransferRequestId, expected[tr.TransferRequestId], tr.Status)
+		}
+		if s.interclusterTransfers[tr.TransferRequestId].Status == "" && tr.Status == "error" {
+			t.Errorf("expected %s to be failed in this node's state too", tr.TransferRequestId)
+		}
+	}
+	if len(transfers) != len(expected) {
+		t.Errorf("expected %d transfers, got %d", len(expected), len(transfers))
+	}
+}
@@ -1,6 +1,9 @@
 package main
 
 import (
+	"fmt"
+	"time"
+
 	"github.com/dotmesh-oss/dotmesh/pkg/config"
 	"github.com/dotmesh-oss/dotmesh/pkg/container"
 	"github.com/dotmesh-oss/dotmesh/pkg/messaging/nats"
@@ -25,6 +28,22 @@ func (e PermissionDenied) Error() string {
 	return "Permission denied."
 }
 
+// ReplicationTimeout - the commit exists on the master, but not enough nodes
+// received it within the timeout set by the dot's replication policy.
+type ReplicationTimeout struct {
+	SnapshotId  string
+	Replicas    int
+	MinReplicas int
+	Timeout     time.Duration
+}
+
+func (e ReplicationTimeout) Error() string {
+	return fmt.Sprintf(
+		"Commit %s was created but only reached %d of %d required nodes within %s, it will keep replicating asynchronously.",
+		e.SnapshotId, e.Replicas, e.MinReplicas, e.Timeout,
+	)
+}
+
 // Aliases
 type User = user.User
 type SafeUser = user.SafeUser
@@ -98,7 +117,7 @@ type Opts struct {
 	FilesystemStore store.FilesystemStore
 	ServerStore     store.ServerStore
 
-	// variables used to create fsm.FsMachine
+	// variables used to create the storage backend
 	ZFSExecPath string
 	ZPoolPath   string
 	PoolName    string
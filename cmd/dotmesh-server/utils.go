@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"io"
 	"os"
-	"os/exec"
 	"runtime"
 	"strings"
 	"sync"
@@ -21,35 +20,6 @@ import (
 // the base64 alphabet. https://en.wikipedia.org/wiki/Base64
 var END_DOTMESH_PRELUDE = types.EndDotmeshPrelude
 
-// apply the instructions encoded in the prelude to the system
-func applyPrelude(prelude types.Prelude, fqfs string) error {
-	// iterate over it setting zfs user properties accordingly.
-	log.Printf("[applyPrelude] Got prelude: %+v", prelude)
-	for _, j := range prelude.SnapshotProperties {
-		metadataEncoded, err := utils.EncodeMetadata(j.Metadata)
-		if err != nil {
-			return err
-		}
-		for _, k := range metadataEncoded {
-			// eh, would be better to refactor encodeMetadata
-			if k != "-o" {
-				args := []string{"set"}
-				args = append(args, k)
-				args = append(args, fqfs+"@"+j.Id)
-				out, err := exec.Command(ZFS, args...).CombinedOutput()
-				if err != nil {
-					log.Errorf(
-						"[applyPrelude] Error applying prelude: %s, %s, %s", args, err, out,
-					)
-					return fmt.Errorf("Error applying prelude: %s -> %v: %s", args, err, out)
-				}
-				// log.Debugf("[applyPrelude] Applied snapshot props for: %s", j.Id)
-			}
-		}
-	}
-	return nil
-}
-
 func toJsonString(value interface{}) string {
 	bytes, err := json.Marshal(value)
 	if err != nil {
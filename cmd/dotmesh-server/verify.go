@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/dotmesh-oss/dotmesh/pkg/digest"
+	"github.com/dotmesh-oss/dotmesh/pkg/types"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// digestCommit works out the content digest of this node's copy of a
+// commit, and how the last scrub of its pool went
+func (s *InMemoryState) digestCommit(filesystemId, commitId string) types.NodeVerification {
+	result := types.NodeVerification{Node: s.NodeID()}
+	scrub, err := s.zfs.ScrubStatus()
+	if err != nil {
+		log.WithError(err).Warn("[digestCommit] Couldn't get the pool's scrub status")
+		scrub = "unknown"
+	}
+	result.Scrub = scrub
+
+	mountPath, unmount, err := s.mountCommit(filesystemId, commitId)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	defer unmount()
+	d, err := digest.Tree(filepath.Join(mountPath, "__default__"))
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	result.Digest = d
+	return result
+}
+
+// digestCommitOn has another node of the cluster work out the content digest
+// of its copy of a commit
+func (s *InMemoryState) digestCommitOn(node, filesystemId, commitId string) types.NodeVerification {
+	result := types.NodeVerification{Node: node}
+	err := func() error {
+		client, err := s.nodeClient(node)
+		if err != nil {
+			return err
+		}
+		return client.CallRemote(
+			context.Background(), "DotmeshRPC.DigestCommit",
+			struct{ FilesystemId, SnapshotId string }{filesystemId, commitId}, &result,
+		)
+	}()
+	if err != nil {
+		result.Error = err.Error()
+	}
+	return result
+}
+
+// verifyCommit has every node holding a copy of a commit on filesystemId work
+// out its content digest again, and compares them with the one recorded when
+// it was made.
+func (s *InMemoryState) verifyCommit(
+	tlf types.TopLevelFilesystem, filesystemId string, commit *types.Snapshot,
+) (*types.VerifyResult, error) {
+	holders := s.commitHolders(tlf, commit.Id)
+	if len(holders) == 0 {
+		return nil, fmt.Errorf("No node holds commit %s", commit.Id)
+	}
+
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	nodes := []types.NodeVerification{}
+	for node, filesystemId := range holders {
+		wg.Add(1)
+		go func(node, filesystemId string) {
+			defer wg.Done()
+			var v types.NodeVerification
+			if node == s.NodeID() {
+				v = s.digestCommit(filesystemId, commit.Id)
+			} else {
+				v = s.digestCommitOn(node, filesystemId, commit.Id)
+			}
+			lock.Lock()
+			defer lock.Unlock()
+			nodes = append(nodes, v)
+		}(node, filesystemId)
+	}
+	wg.Wait()
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Node < nodes[j].Node })
+
+	master := ""
+	if _, recorded := commit.Metadata[digest.MetadataKey]; !recorded {
+		var err error
+		master, err = s.registry.CurrentMasterNode(filesystemId)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return compareDigests(commit, master, nodes), nil
+}
+
+// compareDigests checks each node's digest of a commit against the one
+// recorded when it was made. Commits made before they had digests can only
+// be checked against the copy on master.
+func compareDigests(commit *types.Snapshot, master string, nodes []types.NodeVerification) *types.VerifyResult {
+	result := &types.VerifyResult{SnapshotId: commit.Id}
+	result.Expected, result.Recorded = commit.Metadata[digest.MetadataKey]
+	if !result.Recorded {
+		for _, v := range nodes {
+			if v.Node == master && v.Error == "" {
+				result.Expected = v.Digest
+			}
+		}
+	}
+	for _, v := range nodes {
+		v.Match = v.Error == "" && result.Expected != "" && v.Digest == result.Expected
+		if !v.Match {
+			result.Mismatches++
+		}
+		result.Nodes = append(result.Nodes, v)
+	}
+	return result
+}
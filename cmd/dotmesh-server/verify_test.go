@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/dotmesh-oss/dotmesh/pkg/auth"
+	"github.com/dotmesh-oss/dotmesh/pkg/digest"
+	"github.com/dotmesh-oss/dotmesh/pkg/types"
+	"github.com/dotmesh-oss/dotmesh/pkg/user"
+)
+
+func Test_compareDigests(t *testing.T) {
+	recorded := &types.Snapshot{Id: "c", Metadata: map[string]string{digest.MetadataKey: "good"}}
+	unrecorded := &types.Snapshot{Id: "c", Metadata: map[string]string{}}
+
+	for _, tc := range []struct {
+		name       string
+		commit     *types.Snapshot
+		master     string
+		nodes      []types.NodeVerification
+		expected   string
+		matches    []bool
+		mismatches int
+	}{
+		{
+			name:   "all match",
+			commit: recorded,
+			nodes: []types.NodeVerification{
+				{Node: "a", Digest: "good"},
+				{Node: "b", Digest: "good"},
+			},
+			expected: "good",
+			matches:  []bool{true, true},
+		},
+		{
+			name:   "a bad copy and an error",
+			commit: recorded,
+			nodes: []types.NodeVerification{
+				{Node: "a", Digest: "good"},
+				{Node: "b", Digest: "bad"},
+				{Node: "c", Error: "couldn't mount"},
+			},
+			expected:   "good",
+			matches:    []bool{true, false, false},
+			mismatches: 2,
+		},
+		{
+			name:   "unrecorded is compared with the master",
+			commit: unrecorded,
+			master: "b",
+			nodes: []types.NodeVerification{
+				{Node: "a", Digest: "other"},
+				{Node: "b", Digest: "master"},
+			},
+			expected:   "master",
+			matches:    []bool{false, true},
+			mismatches: 1,
+		},
+		{
+			name:   "unrecorded and the master failed",
+			commit: unrecorded,
+			master: "b",
+			nodes: []types.NodeVerification{
+				{Node: "a", Digest: "other"},
+				{Node: "b", Error: "couldn't mount"},
+			},
+			matches:    []bool{false, false},
+			mismatches: 2,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			result := compareDigests(tc.commit, tc.master, tc.nodes)
+			if result.Expected != tc.expected {
+				t.Errorf("expected %q to be expected, got %q", tc.expected, result.Expected)
+			}
+			if result.Recorded != (tc.commit == recorded) {
+				t.Errorf("expected Recorded to be %t", tc.commit == recorded)
+			}
+			matches := []bool{}
+			for _, v := range result.Nodes {
+				matches = append(matches, v.Match)
+			}
+			if !reflect.DeepEqual(matches, tc.matches) {
+				t.Errorf("expected matches %v, got %v", tc.matches, matches)
+			}
+			if result.Mismatches != tc.mismatches {
+				t.Errorf("expected %d mismatches, got %d", tc.mismatches, result.Mismatches)
+			}
+		})
+	}
+}
+
+func TestDigestCommitRejectsUnknownFilesystems(t *testing.T) {
+	s, _, _ := newTestStateWithDots(t)
+	d := NewDotmeshRPC(s, s.userManager)
+	admin := &user.User{Id: user.ADMIN_USER_UUID, Name: "admin"}
+	r := auth.SetAuthenticationDetails(httptest.NewRequest("POST", "/rpc", nil), admin, user.AuthenticationTypeAPIKey)
+
+	var result types.NodeVerification
+	err := d.DigestCommit(r, &struct{ FilesystemId, SnapshotId string }{"../../etc", "snap"}, &result)
+	if err == nil {
+		t.Error("expected digesting an unknown filesystem to fail")
+	}
+}
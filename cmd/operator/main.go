@@ -884,6 +884,8 @@ nodeLoop:
 			{Name: "ALLOW_PUBLIC_REGISTRATION", Value: "1"},
 			{Name: "INITIAL_ADMIN_PASSWORD_FILE", Value: "/secret/dotmesh-admin-password.txt"},
 			{Name: "INITIAL_ADMIN_API_KEY_FILE", Value: "/secret/dotmesh-api-key.txt"},
+			// optional, secrets in the KV store are kept in the clear without it
+			{Name: "DOTMESH_SECRETS_KEY_FILE", Value: "/secret/dotmesh-secrets-key.txt"},
 			{Name: "LOG_ADDR", Value: c.config.Data[CONFIG_LOG_ADDRESS]},
 			{Name: "DOTMESH_UPGRADES_URL", Value: c.config.Data[CONFIG_UPGRADES_URL]},
 			{Name: "DOTMESH_UPGRADES_INTERVAL_SECONDS", Value: c.config.Data[CONFIG_UPGRADES_INTERVAL_SECONDS]},
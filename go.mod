@@ -20,7 +20,7 @@ require (
 	github.com/coreos/go-systemd v0.0.0-20180511133405-39ca1b05acc7 // indirect
 	github.com/coreos/pkg v0.0.0-20180108230652-97fdf19511ea // indirect
 	github.com/cyphar/filepath-securejoin v0.2.2
-	github.com/dgrijalva/jwt-go v3.2.0+incompatible // indirect
+	github.com/dgrijalva/jwt-go v3.2.0+incompatible
 	github.com/docker/distribution v2.6.2+incompatible // indirect
 	github.com/dotmesh-oss/citools v0.0.0-20200414134058-7aa7221e95a0
 	github.com/dotmesh-oss/go-checkpoint v0.0.0-20180205120253-edad9decbae8
@@ -33,8 +33,10 @@ require (
 	github.com/fatih/color v1.9.0 // indirect
 	github.com/frankban/quicktest v1.9.0 // indirect
 	github.com/fsouza/go-dockerclient v0.0.0-20160310013113-b87634a9d98e
-	github.com/ghodss/yaml v1.0.0 // indirect
+	github.com/ghodss/yaml v1.0.0
+	github.com/go-asn1-ber/asn1-ber v1.5.1
 	github.com/go-ini/ini v1.37.0 // indirect
+	github.com/go-ldap/ldap/v3 v3.3.0
 	github.com/go-openapi/analysis v0.0.0-20180629165206-ecce8cb68f3d // indirect
 	github.com/go-openapi/errors v0.0.0-20180515155515-b2b2befaf267 // indirect
 	github.com/go-openapi/jsonpointer v0.0.0-20180322222829-3a0015ad55fa // indirect
@@ -68,7 +70,7 @@ require (
 	github.com/json-iterator/go v0.0.0-20180701071628-ab8a2e0c74be // indirect
 	github.com/juju/ratelimit v1.0.1 // indirect
 	github.com/kelseyhightower/envconfig v1.4.0
-	github.com/klauspost/compress v1.10.5 // indirect
+	github.com/klauspost/compress v1.10.5
 	github.com/klauspost/pgzip v1.2.3 // indirect
 	github.com/konsorten/go-windows-terminal-sequences v1.0.2 // indirect
 	github.com/kubernetes-incubator/external-storage v2.1.0+incompatible
@@ -114,8 +116,8 @@ require (
 	github.com/ugorji/go v1.1.1 // indirect
 	github.com/ulikunitz/xz v0.5.7 // indirect
 	github.com/xiang90/probing v0.0.0-20160813154853-07dd2e8dfe18 // indirect
-	golang.org/x/crypto v0.0.0-20190308221718-c2843e01d9a2
-	golang.org/x/net v0.0.0-20190311183353-d8887717615a
+	golang.org/x/crypto v0.0.0-20200604202706-70a84ac30bf9
+	golang.org/x/net v0.0.0-20190404232315-eb5bcb51f2a3
 	golang.org/x/sys v0.0.0-20200223170610-d5e6a3e2c0ae
 	golang.org/x/time v0.0.0-20180412165947-fbb02b2291d2 // indirect
 	google.golang.org/genproto v0.0.0-20180627194029-ff3583edef7d // indirect
@@ -0,0 +1,250 @@
+package archiver
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"mime"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Format is a kind of archive that directories can be uploaded and
+// downloaded as
+type Format string
+
+const (
+	FormatTar     Format = "tar"
+	FormatTarGz   Format = "tar.gz"
+	FormatTarZstd Format = "tar.zst"
+	FormatZip     Format = "zip"
+)
+
+// Formats lists every Format, in the order they're preferred in when a client
+// doesn't mind
+var Formats = []Format{FormatTar, FormatTarGz, FormatTarZstd, FormatZip}
+
+// ParseFormat reads a format as given in a ?format= query parameter
+func ParseFormat(s string) (Format, error) {
+	switch strings.ToLower(s) {
+	case "tar":
+		return FormatTar, nil
+	case "tar.gz", "tgz":
+		return FormatTarGz, nil
+	case "tar.zst", "tzst":
+		return FormatTarZstd, nil
+	case "zip":
+		return FormatZip, nil
+	default:
+		return "", fmt.Errorf("unsupported archive format '%s', please use tar, tar.gz, tar.zst or zip", s)
+	}
+}
+
+// ContentType is the media type archives in f are sent with
+func (f Format) ContentType() string {
+	switch f {
+	case FormatTarGz:
+		return "application/gzip"
+	case FormatTarZstd:
+		return "application/zstd"
+	case FormatZip:
+		return "application/zip"
+	default:
+		return "application/x-tar"
+	}
+}
+
+// Extension is what archives in f are named with, including the dot
+func (f Format) Extension() string {
+	return "." + string(f)
+}
+
+// FormatFromContentType recognises the media types archives are commonly
+// uploaded with. Anything else, such as application/octet-stream, isn't an
+// answer either way.
+func FormatFromContentType(contentType string) (Format, bool) {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", false
+	}
+	switch mediaType {
+	case "application/x-tar":
+		return FormatTar, true
+	case "application/gzip", "application/x-gzip", "application/x-gtar", "application/x-compressed-tar":
+		return FormatTarGz, true
+	case "application/zstd", "application/x-zstd":
+		return FormatTarZstd, true
+	case "application/zip", "application/x-zip-compressed":
+		return FormatZip, true
+	default:
+		return "", false
+	}
+}
+
+// FormatFromFilename recognises archives by their extension
+func FormatFromFilename(filename string) (Format, bool) {
+	lower := strings.ToLower(filename)
+	switch {
+	case strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		return FormatTarGz, true
+	case strings.HasSuffix(lower, ".tar.zst"), strings.HasSuffix(lower, ".tzst"):
+		return FormatTarZstd, true
+	case strings.HasSuffix(lower, ".zip"):
+		return FormatZip, true
+	case strings.HasSuffix(lower, ".tar"):
+		return FormatTar, true
+	default:
+		return "", false
+	}
+}
+
+// FormatFromAccept picks the format an Accept header prefers, if it asks for
+// any of them: the one with the highest quality value, or the first given of
+// those with the same. Formats with a quality of 0 are refused.
+func FormatFromAccept(accept string) (Format, bool) {
+	var best Format
+	bestQuality := 0.0
+	for _, part := range strings.Split(accept, ",") {
+		format, ok := FormatFromContentType(strings.TrimSpace(part))
+		if !ok {
+			continue
+		}
+		quality := 1.0
+		_, params, _ := mime.ParseMediaType(part)
+		if q, ok := params["q"]; ok {
+			parsed, err := strconv.ParseFloat(q, 64)
+			if err != nil {
+				continue
+			}
+			quality = parsed
+		}
+		if quality > bestQuality {
+			best = format
+			bestQuality = quality
+		}
+	}
+	return best, best != ""
+}
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	zipMagic  = []byte("PK\x03\x04")
+)
+
+// sniffFormat looks at the first few bytes of in to tell compressed archives
+// apart, taking anything else to be a plain tar
+func sniffFormat(in *bufio.Reader) Format {
+	// a short read just means a short archive, which Peek reports as an
+	// error alongside whatever it did get
+	head, _ := in.Peek(4)
+	switch {
+	case bytes.HasPrefix(head, gzipMagic):
+		return FormatTarGz
+	case bytes.HasPrefix(head, zstdMagic):
+		return FormatTarZstd
+	case bytes.HasPrefix(head, zipMagic):
+		return FormatZip
+	default:
+		return FormatTar
+	}
+}
+
+// ArchiveToStream writes sources to out as an archive in format, without
+// buffering it anywhere. A directory is archived with its own name at the top
+// level, as Tar.ArchiveToStream does.
+func ArchiveToStream(format Format, out io.Writer, sources []string) error {
+	switch format {
+	case FormatTar:
+		return NewTar().ArchiveToStream(out, sources)
+	case FormatTarGz:
+		return NewTarGz().ArchiveToStream(out, sources)
+	case FormatTarZstd:
+		return NewTarZstd().ArchiveToStream(out, sources)
+	case FormatZip:
+		return NewZip().ArchiveToStream(out, sources)
+	default:
+		return fmt.Errorf("unsupported archive format '%s'", format)
+	}
+}
+
+// ExtractFromStream unpacks an archive in format from in into destination,
+// refusing any entry that would land outside it. An empty format is worked
+// out from the archive's first few bytes.
+func ExtractFromStream(format Format, in io.Reader, destination string) error {
+	if format == "" {
+		buffered := bufio.NewReader(in)
+		format = sniffFormat(buffered)
+		in = buffered
+	}
+	switch format {
+	case FormatTar:
+		return NewTar().ExtractFromStream(in, destination)
+	case FormatTarGz:
+		return NewTarGz().ExtractFromStream(in, destination)
+	case FormatTarZstd:
+		return NewTarZstd().ExtractFromStream(in, destination)
+	case FormatZip:
+		return NewZip().ExtractFromStream(in, destination)
+	default:
+		return fmt.Errorf("unsupported archive format '%s'", format)
+	}
+}
+
+// NewTarGz returns a Tar that reads and writes gzipped tarballs
+func NewTarGz() *Tar {
+	t := NewTar()
+	var gzw *gzip.Writer
+	var gzr *gzip.Reader
+	t.writerWrapFn = func(w io.Writer) (io.Writer, error) {
+		gzw = gzip.NewWriter(w)
+		return gzw, nil
+	}
+	t.readerWrapFn = func(r io.Reader) (io.Reader, error) {
+		var err error
+		gzr, err = gzip.NewReader(r)
+		return gzr, err
+	}
+	t.cleanupWrapFn = func() error {
+		if gzw != nil {
+			return gzw.Close()
+		}
+		if gzr != nil {
+			return gzr.Close()
+		}
+		return nil
+	}
+	return t
+}
+
+// NewTarZstd returns a Tar that reads and writes zstandard compressed
+// tarballs
+func NewTarZstd() *Tar {
+	t := NewTar()
+	var zw *zstd.Encoder
+	var zr *zstd.Decoder
+	t.writerWrapFn = func(w io.Writer) (io.Writer, error) {
+		var err error
+		zw, err = zstd.NewWriter(w)
+		return zw, err
+	}
+	t.readerWrapFn = func(r io.Reader) (io.Reader, error) {
+		var err error
+		zr, err = zstd.NewReader(r)
+		return zr, err
+	}
+	t.cleanupWrapFn = func() error {
+		if zw != nil {
+			return zw.Close()
+		}
+		if zr != nil {
+			zr.Close()
+		}
+		return nil
+	}
+	return t
+}
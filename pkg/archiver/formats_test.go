@@ -0,0 +1,155 @@
+package archiver
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"testing"
+)
+
+func TestFormatsRoundTrip(t *testing.T) {
+	inputDir, err := ioutil.TempDir("", "inputFolder")
+	if err != nil {
+		t.Fatalf("Making temporary directory: %v", err)
+	}
+	defer os.RemoveAll(inputDir)
+
+	for _, filePath := range []string{"data/file1", "data/subpath/file2"} {
+		if err := createTestFile(inputDir, filePath, createRandomBytes(t)); err != nil {
+			t.Fatalf("Making temporary file %s: %v", filePath, err)
+		}
+	}
+	if err := os.Symlink("file1", path.Join(inputDir, "data", "link")); err != nil {
+		t.Fatalf("Making symlink: %v", err)
+	}
+
+	for _, format := range Formats {
+		t.Run(string(format), func(t *testing.T) {
+			archive := &bytes.Buffer{}
+			if err := ArchiveToStream(format, archive, []string{path.Join(inputDir, "data")}); err != nil {
+				t.Fatalf("Failed to create %s archive: %s", format, err)
+			}
+
+			for _, given := range []Format{format, ""} {
+				outputDir, err := ioutil.TempDir("", "outputFolder")
+				if err != nil {
+					t.Fatalf("Making temporary directory: %v", err)
+				}
+				defer os.RemoveAll(outputDir)
+
+				// an empty format has to be sniffed from the contents
+				if err := ExtractFromStream(given, bytes.NewReader(archive.Bytes()), outputDir); err != nil {
+					t.Fatalf("Failed to extract %s archive given format %q: %s", format, given, err)
+				}
+				if output, err := exec.Command("diff", "-rq", inputDir, outputDir).Output(); err != nil {
+					t.Fatalf("Folders are different! \n%s", string(output))
+				}
+				if link, err := os.Readlink(path.Join(outputDir, "data", "link")); err != nil || link != "file1" {
+					t.Errorf("Symlink not preserved, got %q, %v", link, err)
+				}
+			}
+		})
+	}
+}
+
+func TestZipTraversal(t *testing.T) {
+	archive := &bytes.Buffer{}
+	zw := zip.NewWriter(archive)
+	w, err := zw.Create("../../escaped")
+	if err != nil {
+		t.Fatalf("Failed to create zip entry: %s", err)
+	}
+	w.Write([]byte("oops"))
+	if err := zw.Close(); err != nil {
+		t.Fatalf("Failed to close zip: %s", err)
+	}
+
+	parentDir, err := ioutil.TempDir("", "parentFolder")
+	if err != nil {
+		t.Fatalf("Making temporary directory: %v", err)
+	}
+	defer os.RemoveAll(parentDir)
+	outputDir := filepath.Join(parentDir, "a", "b")
+
+	if err := ExtractFromStream(FormatZip, archive, outputDir); err != nil {
+		t.Fatalf("Failed to extract zip archive: %s", err)
+	}
+	if _, err := os.Stat(filepath.Join(outputDir, "escaped")); err != nil {
+		t.Errorf("Entry wasn't kept inside the destination: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(parentDir, "escaped")); err == nil {
+		t.Errorf("Entry escaped the destination")
+	}
+}
+
+func TestFormatNegotiation(t *testing.T) {
+	if f, ok := FormatFromAccept("text/html, application/zip;q=0.9, */*"); !ok || f != FormatZip {
+		t.Errorf("FormatFromAccept() = %q, %t, want zip", f, ok)
+	}
+	if _, ok := FormatFromAccept("*/*"); ok {
+		t.Errorf("FormatFromAccept(*/*) picked a format")
+	}
+	for accept, expected := range map[string]Format{
+		"application/zip;q=0.5, application/zstd":           FormatTarZstd,
+		"application/gzip;q=0.8, application/zip;q=0.9":     FormatZip,
+		"application/x-tar, application/zip":                FormatTar,
+		"application/zip;q=0, application/gzip;q=0.1":       FormatTarGz,
+		"application/zip ; q=0.7 , application/gzip;q=0.70": FormatZip,
+	} {
+		if f, ok := FormatFromAccept(accept); !ok || f != expected {
+			t.Errorf("FormatFromAccept(%q) = %q, %t, want %s", accept, f, ok, expected)
+		}
+	}
+	if _, ok := FormatFromAccept("application/zip;q=0"); ok {
+		t.Errorf("FormatFromAccept() picked a format that was refused")
+	}
+	if f, ok := FormatFromFilename("backup.TGZ"); !ok || f != FormatTarGz {
+		t.Errorf("FormatFromFilename() = %q, %t, want tar.gz", f, ok)
+	}
+	if _, err := ParseFormat("rar"); err == nil {
+		t.Errorf("ParseFormat(rar) didn't fail")
+	}
+}
+
+func TestZipSpooledBesideDestination(t *testing.T) {
+	inputDir, err := ioutil.TempDir("", "inputFolder")
+	if err != nil {
+		t.Fatalf("Making temporary directory: %v", err)
+	}
+	defer os.RemoveAll(inputDir)
+	if err := createTestFile(inputDir, "data/file1", createRandomBytes(t)); err != nil {
+		t.Fatalf("Making temporary file: %v", err)
+	}
+	archive := &bytes.Buffer{}
+	if err := ArchiveToStream(FormatZip, archive, []string{path.Join(inputDir, "data")}); err != nil {
+		t.Fatalf("Failed to create zip archive: %s", err)
+	}
+
+	parentDir, err := ioutil.TempDir("", "parentFolder")
+	if err != nil {
+		t.Fatalf("Making temporary directory: %v", err)
+	}
+	defer os.RemoveAll(parentDir)
+
+	z := NewZip()
+	z.MaxSize = int64(archive.Len()) - 1
+	if err := z.ExtractFromStream(bytes.NewReader(archive.Bytes()), filepath.Join(parentDir, "small")); err == nil {
+		t.Errorf("Extracted a zip archive larger than the limit")
+	}
+
+	z.MaxSize = int64(archive.Len())
+	if err := z.ExtractFromStream(bytes.NewReader(archive.Bytes()), filepath.Join(parentDir, "out")); err != nil {
+		t.Fatalf("Failed to extract zip archive: %s", err)
+	}
+	entries, err := ioutil.ReadDir(parentDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "out" {
+		t.Errorf("Expected only the destination to be left beside it, got %v", entries)
+	}
+}
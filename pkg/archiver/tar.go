@@ -52,7 +52,7 @@ type Tar struct {
 
 	readerWrapFn  func(io.Reader) (io.Reader, error)
 	writerWrapFn  func(io.Writer) (io.Writer, error)
-	cleanupWrapFn func()
+	cleanupWrapFn func() error
 
 	destination string
 }
@@ -62,9 +62,44 @@ func (t *Tar) ArchiveToStream(output io.Writer, sources []string) error {
 	if err != nil {
 		return fmt.Errorf("creating tar: %v", err)
 	}
+
+	err = t.archive(sources)
+	// closing writes the end of the archive, so it can fail too
+	if closeErr := t.Close(); err == nil && closeErr != nil {
+		err = fmt.Errorf("closing tar: %v", closeErr)
+	}
+	return err
+}
+
+// ExtractFromStream unpacks the archive read from input into destination,
+// as Unarchive does for a file.
+func (t *Tar) ExtractFromStream(input io.Reader, destination string) error {
+	if !fileExists(destination) && t.MkdirAll {
+		err := mkdir(destination, 0755)
+		if err != nil {
+			return fmt.Errorf("preparing destination: %v", err)
+		}
+	}
+
+	err := t.Open(input, 0)
+	if err != nil {
+		return fmt.Errorf("opening tar archive for reading: %v", err)
+	}
 	defer t.Close()
 
-	return t.archive(sources)
+	for {
+		err := t.untarNext(destination)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			if t.ContinueOnError {
+				log.Printf("[ERROR] Reading file in tar archive: %v", err)
+				continue
+			}
+			return fmt.Errorf("reading file in tar archive: %v", err)
+		}
+	}
 }
 
 func (t *Tar) archive(sources []string) error {
@@ -328,12 +363,18 @@ func (t *Tar) writeWalk(source, topLevelFolder, destination string) error {
 		}
 
 		var file io.ReadCloser
+		var linkTarget string
 		if info.Mode().IsRegular() {
 			file, err = os.Open(fpath)
 			if err != nil {
 				return handleErr(fmt.Errorf("%s: opening: %v", fpath, err))
 			}
 			defer file.Close()
+		} else if isSymlink(info) {
+			linkTarget, err = os.Readlink(fpath)
+			if err != nil {
+				return handleErr(fmt.Errorf("%s: readlink: %v", fpath, err))
+			}
 		}
 		err = t.Write(File{
 			FileInfo: FileInfo{
@@ -341,6 +382,7 @@ func (t *Tar) writeWalk(source, topLevelFolder, destination string) error {
 				CustomName: nameInArchive,
 			},
 			ReadCloser: file,
+			LinkTarget: linkTarget,
 		})
 		if err != nil {
 			return handleErr(fmt.Errorf("%s: writing: %s", fpath, err))
@@ -382,8 +424,8 @@ func (t *Tar) Write(f File) error {
 		return fmt.Errorf("missing file name")
 	}
 
-	var linkTarget string
-	if isSymlink(f) {
+	linkTarget := f.LinkTarget
+	if isSymlink(f) && linkTarget == "" {
 		var err error
 		linkTarget, err = os.Readlink(f.Name())
 		if err != nil {
@@ -474,7 +516,9 @@ func (t *Tar) Close() error {
 	// (say that ten times fast) happens AFTER the
 	// underlying stream is closed
 	if t.cleanupWrapFn != nil {
-		t.cleanupWrapFn()
+		if cleanupErr := t.cleanupWrapFn(); err == nil {
+			err = cleanupErr
+		}
 	}
 	return err
 }
@@ -70,6 +70,10 @@ type File struct {
 
 	// Allow the file contents to be read (and closed)
 	io.ReadCloser
+
+	// What a symlink points at; if empty, it's read from the link at the
+	// file's name, which only works if that's also where it is on disk
+	LinkTarget string
 }
 
 type FileInfo struct {
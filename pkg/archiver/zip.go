@@ -0,0 +1,205 @@
+package archiver
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	securejoin "github.com/cyphar/filepath-securejoin"
+)
+
+// DefaultMaxZipSize is the largest zip archive that's extracted by default
+const DefaultMaxZipSize = 16 << 30
+
+// Zip reads and writes zip archives, with the same layout and protections as
+// Tar.
+type Zip struct {
+	// Whether to make all the directories necessary
+	// to extract into the desired path.
+	MkdirAll bool
+
+	// Where archives are spooled to while they're extracted, the directory
+	// the destination is in if empty, so that they take space from the
+	// filesystem they're extracted into rather than the host's.
+	SpoolDir string
+
+	// The largest archive that will be extracted, in bytes; 0 means any size
+	MaxSize int64
+}
+
+// NewZip returns a new, default instance ready to be customized and used.
+func NewZip() *Zip {
+	return &Zip{
+		MkdirAll: true,
+		MaxSize:  DefaultMaxZipSize,
+	}
+}
+
+// ArchiveToStream writes sources to output as a zip archive. Zip archives
+// can be written in one pass, so nothing is buffered.
+func (z *Zip) ArchiveToStream(output io.Writer, sources []string) error {
+	zw := zip.NewWriter(output)
+	for _, source := range sources {
+		err := z.writeWalk(zw, source)
+		if err != nil {
+			zw.Close()
+			return fmt.Errorf("walking %s: %v", source, err)
+		}
+	}
+	// closing writes the central directory, so it can fail too
+	if err := zw.Close(); err != nil {
+		return fmt.Errorf("closing zip: %v", err)
+	}
+	return nil
+}
+
+func (z *Zip) writeWalk(zw *zip.Writer, source string) error {
+	sourceInfo, err := os.Stat(source)
+	if err != nil {
+		return fmt.Errorf("%s: stat: %v", source, err)
+	}
+
+	return filepath.Walk(source, func(fpath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return fmt.Errorf("traversing %s: %v", fpath, err)
+		}
+		nameInArchive, err := makeNameInArchive(sourceInfo, source, "", fpath)
+		if err != nil {
+			return err
+		}
+
+		hdr, err := zip.FileInfoHeader(info)
+		if err != nil {
+			return fmt.Errorf("%s: making header: %v", fpath, err)
+		}
+		hdr.Name = nameInArchive
+		switch {
+		case info.IsDir():
+			hdr.Name += "/"
+			hdr.Method = zip.Store
+			_, err = zw.CreateHeader(hdr)
+			return err
+		case isSymlink(info):
+			// by convention, a symlink's target is stored as its contents
+			target, err := os.Readlink(fpath)
+			if err != nil {
+				return fmt.Errorf("%s: readlink: %v", fpath, err)
+			}
+			hdr.Method = zip.Store
+			w, err := zw.CreateHeader(hdr)
+			if err != nil {
+				return fmt.Errorf("%s: writing header: %v", fpath, err)
+			}
+			_, err = io.WriteString(w, filepath.ToSlash(target))
+			return err
+		case info.Mode().IsRegular():
+			hdr.Method = zip.Deflate
+			w, err := zw.CreateHeader(hdr)
+			if err != nil {
+				return fmt.Errorf("%s: writing header: %v", fpath, err)
+			}
+			file, err := os.Open(fpath)
+			if err != nil {
+				return fmt.Errorf("%s: opening: %v", fpath, err)
+			}
+			defer file.Close()
+			_, err = io.Copy(w, file)
+			if err != nil {
+				return fmt.Errorf("%s: copying contents: %v", fpath, err)
+			}
+			return nil
+		default:
+			// devices, sockets and pipes have no place in a zip
+			return nil
+		}
+	})
+}
+
+// ExtractFromStream unpacks the zip archive read from input into
+// destination. A zip's table of contents is at its end, so unlike a tar it
+// has to be spooled to a temporary file in SpoolDir before anything can be
+// extracted.
+func (z *Zip) ExtractFromStream(input io.Reader, destination string) error {
+	spoolDir := z.SpoolDir
+	if spoolDir == "" {
+		spoolDir = filepath.Dir(destination)
+		if !fileExists(spoolDir) && z.MkdirAll {
+			err := mkdir(spoolDir, 0755)
+			if err != nil {
+				return fmt.Errorf("preparing destination: %v", err)
+			}
+		}
+	}
+	spool, err := ioutil.TempFile(spoolDir, ".zip-extract")
+	if err != nil {
+		return fmt.Errorf("creating temporary file: %v", err)
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	if z.MaxSize > 0 {
+		input = io.LimitReader(input, z.MaxSize+1)
+	}
+	size, err := io.Copy(spool, input)
+	if err != nil {
+		return fmt.Errorf("reading zip archive: %v", err)
+	}
+	if z.MaxSize > 0 && size > z.MaxSize {
+		return fmt.Errorf("zip archive is larger than %d bytes, please upload a tarball instead", z.MaxSize)
+	}
+	zr, err := zip.NewReader(spool, size)
+	if err != nil {
+		return fmt.Errorf("opening zip archive for reading: %v", err)
+	}
+
+	if !fileExists(destination) && z.MkdirAll {
+		err := mkdir(destination, 0755)
+		if err != nil {
+			return fmt.Errorf("preparing destination: %v", err)
+		}
+	}
+	for _, f := range zr.File {
+		err := z.unzipFile(f, destination)
+		if err != nil {
+			return fmt.Errorf("reading file in zip archive: %v", err)
+		}
+	}
+	return nil
+}
+
+func (z *Zip) unzipFile(f *zip.File, destination string) error {
+	to, err := securejoin.SecureJoin(destination, f.Name)
+	if err != nil {
+		return fmt.Errorf("Insecure path error: %s", err)
+	}
+
+	mode := f.Mode()
+	switch {
+	case mode.IsDir() || strings.HasSuffix(f.Name, "/"):
+		return mkdir(to, mode.Perm()|0700)
+	case mode&os.ModeSymlink != 0:
+		rc, err := f.Open()
+		if err != nil {
+			return fmt.Errorf("%s: opening: %v", f.Name, err)
+		}
+		defer rc.Close()
+		target, err := ioutil.ReadAll(rc)
+		if err != nil {
+			return fmt.Errorf("%s: reading link: %v", f.Name, err)
+		}
+		return writeNewSymbolicLink(to, filepath.Clean(string(target)))
+	case mode.IsRegular():
+		rc, err := f.Open()
+		if err != nil {
+			return fmt.Errorf("%s: opening: %v", f.Name, err)
+		}
+		defer rc.Close()
+		return writeNewFile(to, rc, mode)
+	default:
+		return fmt.Errorf("%s: unsupported file type %s", f.Name, mode.Type())
+	}
+}
@@ -0,0 +1,156 @@
+// Package bundle reads and writes dot bundles: single files holding what a
+// cluster needs to recreate a dot, or bring one up to date, without a
+// connection to the cluster it came from.
+//
+// A bundle starts with a header line, then a JSON encoded Manifest, then the
+// data of each of the manifest's streams in turn. The manifest and each
+// stream are framed by package chunked, so that a stream can be written as
+// it's produced without knowing its length up front.
+package bundle
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/dotmesh-oss/dotmesh/pkg/chunked"
+	"github.com/dotmesh-oss/dotmesh/pkg/types"
+)
+
+// Version of the bundle format written by Writer
+const Version = 1
+
+const header = "DOTMESH-BUNDLE 1\n"
+
+// MaxManifestBytes - a manifest bigger than this is refused rather than read
+// into memory
+const MaxManifestBytes = 32 * 1024 * 1024
+
+// Manifest describes what's in a bundle
+type Manifest struct {
+	Version int
+	// the dot and branch as they were named where the bundle was made
+	Dot    types.VolumeName
+	Branch string
+	// the registry entries of the dot and the branches leading to Branch
+	Filesystem types.RegistryFilesystem
+	Path       types.PathToTopLevelFilesystem
+	// what follows the manifest, in order
+	Streams []Stream
+}
+
+// Stream is a replication stream of commits of one filesystem of the dot,
+// as ZFS.Send produces it, with its prelude
+type Stream struct {
+	FilesystemId string
+	// the commit the stream starts after, as in TransferPollResult's
+	// StartingCommit: "START" if it holds every commit up to To, or
+	// "<filesystem id>@<commit id>" if it starts at a branch's origin
+	From string
+	To   string
+	// every commit on the filesystem up to and including To, to check that
+	// the stream can be applied to a copy of it
+	Snapshots []*types.Snapshot
+}
+
+// Writer writes a bundle
+type Writer struct {
+	w       io.Writer
+	started bool
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+// WriteManifest starts the bundle. It must be called once, before any
+// streams are written.
+func (b *Writer) WriteManifest(m *Manifest) error {
+	if b.started {
+		return fmt.Errorf("the manifest has already been written")
+	}
+	b.started = true
+	m.Version = Version
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(b.w, header)
+	if err != nil {
+		return err
+	}
+	_, err = chunked.Copy(b.w, bytes.NewReader(data))
+	return err
+}
+
+// WriteStream copies r into the bundle as the next stream, returning how
+// many bytes it held.
+func (b *Writer) WriteStream(r io.Reader) (int64, error) {
+	if !b.started {
+		return 0, fmt.Errorf("the manifest must be written first")
+	}
+	return chunked.Copy(b.w, r)
+}
+
+// Reader reads a bundle
+type Reader struct {
+	r       *bufio.Reader
+	current *chunked.Reader
+}
+
+// NewReader checks that r holds a bundle, and reads its manifest. It reads
+// no more of r than the manifest, and what bufio buffers after it.
+func NewReader(r io.Reader) (*Reader, *Manifest, error) {
+	b := &Reader{r: bufio.NewReader(r)}
+	// not ReadString, which would read all of something that isn't a bundle
+	line, err := b.r.ReadSlice('\n')
+	if err != nil || string(line) != header {
+		return nil, nil, fmt.Errorf("not a dot bundle, or one made by a newer version of dotmesh")
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(streamReader{chunked.NewReader(b.r)}, MaxManifestBytes+1))
+	if err != nil {
+		return nil, nil, fmt.Errorf("couldn't read the bundle's manifest: %s", err)
+	}
+	if len(data) > MaxManifestBytes {
+		return nil, nil, fmt.Errorf("the bundle's manifest is bigger than %d bytes", MaxManifestBytes)
+	}
+	var m Manifest
+	err = json.Unmarshal(data, &m)
+	if err != nil {
+		return nil, nil, fmt.Errorf("couldn't read the bundle's manifest: %s", err)
+	}
+	if m.Version != Version {
+		return nil, nil, fmt.Errorf("unsupported bundle version %d", m.Version)
+	}
+	return b, &m, nil
+}
+
+// NextStream returns a reader of the next stream in the bundle. Whatever
+// hasn't been read of the previous one is skipped.
+func (b *Reader) NextStream() (io.Reader, error) {
+	if b.current != nil && !b.current.Done() {
+		_, err := io.Copy(ioutil.Discard, streamReader{b.current})
+		if err != nil {
+			return nil, err
+		}
+	}
+	b.current = chunked.NewReader(b.r)
+	return streamReader{b.current}, nil
+}
+
+// streamReader reads a stream of the bundle, saying what a stream that ends
+// early most likely means
+type streamReader struct {
+	r *chunked.Reader
+}
+
+func (s streamReader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	if err == io.ErrUnexpectedEOF {
+		err = fmt.Errorf("the bundle ends early, it may have been truncated")
+	}
+	return n, err
+}
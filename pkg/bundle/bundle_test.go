@@ -0,0 +1,149 @@
+package bundle
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/dotmesh-oss/dotmesh/pkg/chunked"
+	"github.com/dotmesh-oss/dotmesh/pkg/types"
+)
+
+func writeBundle(t *testing.T, streams ...[]byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	m := &Manifest{
+		Dot:    types.VolumeName{Namespace: "admin", Name: "results"},
+		Branch: "master",
+	}
+	for i := range streams {
+		m.Streams = append(m.Streams, Stream{FilesystemId: "fs", From: "START", To: string(rune('a' + i))})
+	}
+	err := w.WriteManifest(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range streams {
+		n, err := w.WriteStream(bytes.NewReader(s))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != int64(len(s)) {
+			t.Errorf("expected %d bytes written, got %d", len(s), n)
+		}
+	}
+	return buf.Bytes()
+}
+
+func TestRoundTrip(t *testing.T) {
+	big := bytes.Repeat([]byte("0123456789"), chunked.MaxChunk/5)
+	data := writeBundle(t, []byte("first"), []byte{}, big)
+
+	r, m, err := NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Version != Version || m.Dot.Name != "results" || len(m.Streams) != 3 {
+		t.Errorf("unexpected manifest %+v", m)
+	}
+	for i, expected := range [][]byte{[]byte("first"), {}, big} {
+		s, err := r.NextStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadAll(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, expected) {
+			t.Errorf("stream %d: expected %d bytes back, got %d", i, len(expected), len(got))
+		}
+	}
+}
+
+func TestSkipStream(t *testing.T) {
+	data := writeBundle(t, []byte("skipped"), []byte("read"))
+	r, _, err := NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := r.NextStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// read part of the first, leave the rest
+	s.Read(make([]byte, 2))
+	s, err = r.NextStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "read" {
+		t.Errorf("expected the second stream, got %q", got)
+	}
+}
+
+func TestTruncated(t *testing.T) {
+	data := writeBundle(t, []byte("some zfs stream"))
+	r, _, err := NewReader(bytes.NewReader(data[:len(data)-8]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := r.NextStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ioutil.ReadAll(s)
+	if err == nil || !strings.Contains(err.Error(), "truncated") {
+		t.Errorf("expected a truncated bundle error, got %v", err)
+	}
+}
+
+func TestNotABundle(t *testing.T) {
+	_, _, err := NewReader(strings.NewReader("hello\n"))
+	if err == nil {
+		t.Errorf("expected an error reading something that isn't a bundle")
+	}
+}
+
+// countingReader counts what's read of r
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += n
+	return n, err
+}
+
+func TestNotABundleIsntReadToTheEnd(t *testing.T) {
+	r := &countingReader{r: bytes.NewReader(bytes.Repeat([]byte("x"), 1024*1024))}
+	_, _, err := NewReader(r)
+	if err == nil {
+		t.Errorf("expected an error reading something that isn't a bundle")
+	}
+	if r.n > 64*1024 {
+		t.Errorf("expected to give up early, read %d bytes", r.n)
+	}
+}
+
+func TestManifestTooBig(t *testing.T) {
+	var buf bytes.Buffer
+	buf.WriteString(header)
+	_, err := chunked.Copy(&buf, bytes.NewReader(bytes.Repeat([]byte(" "), MaxManifestBytes+1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = NewReader(&buf)
+	if err == nil || !strings.Contains(err.Error(), "bigger than") {
+		t.Errorf("expected an error about the manifest's size, got %v", err)
+	}
+}
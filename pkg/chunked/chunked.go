@@ -0,0 +1,119 @@
+// Package chunked frames streams so that several can be carried one after
+// another in a single stream, each written as it's produced without knowing
+// its length up front. A framed stream is a series of chunks, each preceded
+// by its length as a four byte big endian number, ended by an empty chunk.
+//
+// Dot bundles frame their manifest and each replication stream this way, and
+// the btrfs backend its send streams and the headers between them.
+package chunked
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// MaxChunk is the most a chunk holds
+const MaxChunk = 1 << 20
+
+// Writer frames what's written to it as chunks. Close must be called to end
+// the framed stream.
+type Writer struct {
+	w io.Writer
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+func (c *Writer) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := len(p)
+		if n > MaxChunk {
+			n = MaxChunk
+		}
+		var length [4]byte
+		binary.BigEndian.PutUint32(length[:], uint32(n))
+		_, err := c.w.Write(length[:])
+		if err != nil {
+			return written, err
+		}
+		_, err = c.w.Write(p[:n])
+		if err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Close writes the empty chunk that ends a framed stream. It doesn't close
+// the underlying writer.
+func (c *Writer) Close() error {
+	_, err := c.w.Write([]byte{0, 0, 0, 0})
+	return err
+}
+
+// Copy writes everything read from r to w as one framed stream, returning
+// how many bytes it held
+func Copy(w io.Writer, r io.Reader) (int64, error) {
+	cw := NewWriter(w)
+	n, err := io.CopyBuffer(cw, r, make([]byte, MaxChunk))
+	if err != nil {
+		return n, err
+	}
+	return n, cw.Close()
+}
+
+// Reader reads one framed stream, reading no further than its end. An
+// underlying stream that stops before the empty chunk is read as
+// io.ErrUnexpectedEOF.
+type Reader struct {
+	r         io.Reader
+	remaining uint32
+	done      bool
+}
+
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: r}
+}
+
+func (c *Reader) Read(p []byte) (int, error) {
+	if c.done {
+		return 0, io.EOF
+	}
+	if c.remaining == 0 {
+		var length [4]byte
+		_, err := io.ReadFull(c.r, length[:])
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return 0, err
+		}
+		c.remaining = binary.BigEndian.Uint32(length[:])
+		if c.remaining == 0 {
+			c.done = true
+			return 0, io.EOF
+		}
+		if c.remaining > MaxChunk {
+			return 0, fmt.Errorf("chunk of %d bytes is too big", c.remaining)
+		}
+	}
+	if uint32(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err := c.r.Read(p)
+	c.remaining -= uint32(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// Done says whether the whole framed stream has been read
+func (c *Reader) Done() bool {
+	return c.done
+}
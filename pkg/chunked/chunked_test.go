@@ -0,0 +1,59 @@
+package chunked
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	big := bytes.Repeat([]byte("0123456789"), MaxChunk/5)
+	stream := bytes.Buffer{}
+	for _, message := range [][]byte{[]byte("header"), big, nil} {
+		n, err := Copy(&stream, bytes.NewReader(message))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != int64(len(message)) {
+			t.Errorf("expected %d bytes written, got %d", len(message), n)
+		}
+	}
+	stream.WriteString("after")
+
+	for _, expected := range [][]byte{[]byte("header"), big, {}} {
+		r := NewReader(&stream)
+		got, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, expected) {
+			t.Errorf("expected a stream of %d bytes, got %d", len(expected), len(got))
+		}
+		if !r.Done() {
+			t.Errorf("expected the stream to be done once it's all read")
+		}
+	}
+	if stream.String() != "after" {
+		t.Errorf("expected reading framed streams not to read past them, left %q", stream.String())
+	}
+}
+
+func TestTruncated(t *testing.T) {
+	for _, cut := range []int{2, 4} {
+		truncated := bytes.Buffer{}
+		Copy(&truncated, bytes.NewReader([]byte("header")))
+		truncated.Truncate(truncated.Len() - cut)
+		_, err := ioutil.ReadAll(NewReader(&truncated))
+		if err != io.ErrUnexpectedEOF {
+			t.Errorf("expected a stream cut %d bytes short to be an error, got %v", cut, err)
+		}
+	}
+}
+
+func TestChunkTooBig(t *testing.T) {
+	_, err := ioutil.ReadAll(NewReader(bytes.NewReader([]byte{0xff, 0xff, 0xff, 0xff})))
+	if err == nil {
+		t.Errorf("expected a chunk bigger than MaxChunk to be an error")
+	}
+}
@@ -1,11 +1,14 @@
 package client
 
 import (
+	"bufio"
+	"crypto/ed25519"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
 	"regexp"
 	"sort"
@@ -13,6 +16,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/dotmesh-oss/dotmesh/pkg/signing"
 	"github.com/dotmesh-oss/dotmesh/pkg/types"
 	"golang.org/x/net/context"
 	pb "gopkg.in/cheggaaa/pb.v1"
@@ -198,6 +202,27 @@ func (dm *DotmeshAPI) RestoreEtcd(dump string) error {
 	return nil
 }
 
+func (dm *DotmeshAPI) ListBackups() ([]types.BackupInfo, error) {
+	var response []types.BackupInfo
+	err := dm.CallRemote(context.Background(), "DotmeshRPC.ListBackups", struct{}{}, &response)
+	return response, err
+}
+
+func (dm *DotmeshAPI) RestoreBackup(args types.RestoreBackupArgs) (types.RestoreReport, error) {
+	var response types.RestoreReport
+	err := dm.CallRemote(context.Background(), "DotmeshRPC.RestoreBackup", args, &response)
+	return response, err
+}
+
+func (dm *DotmeshAPI) RecoverRegistry(dryRun bool) (types.RegistryRecovery, error) {
+	var response types.RegistryRecovery
+	err := dm.CallRemote(context.Background(), "DotmeshRPC.RecoverRegistry",
+		types.RecoverRegistryArgs{DryRun: dryRun},
+		&response,
+	)
+	return response, err
+}
+
 func (dm *DotmeshAPI) GetVersion() (VersionInfo, error) {
 	var response VersionInfo
 	err := dm.CallRemote(context.Background(), "DotmeshRPC.Version", struct{}{}, &response)
@@ -241,6 +266,24 @@ func (dm *DotmeshAPI) NewVolumeFromStruct(name types.VolumeName) (bool, error) {
 	return response, nil
 }
 
+// NewEncryptedVolume creates a dot encrypted with the key set for it or its
+// namespace with SetEncryptionKey
+func (dm *DotmeshAPI) NewEncryptedVolume(volumeName string) error {
+	namespace, name, err := ParseNamespacedVolume(volumeName)
+	if err != nil {
+		return err
+	}
+	var response bool
+	err = dm.CallRemote(
+		context.Background(), "DotmeshRPC.CreateEncrypted",
+		types.VolumeName{Namespace: namespace, Name: name}, &response,
+	)
+	if err != nil {
+		return err
+	}
+	return dm.setCurrentVolume(volumeName)
+}
+
 func (dm *DotmeshAPI) ProcureVolume(volumeName string) (string, error) {
 	namespace, name, err := ParseNamespacedVolume(volumeName)
 	if err != nil {
@@ -512,6 +555,266 @@ func (dm *DotmeshAPI) GetReplicationLatencyForBranch(volumeName string, branch s
 	return result, err
 }
 
+// ReplicaCountsForBranch returns how many servers hold each of the given
+// commits on the branch, along with the total number of servers replicating it.
+func (dm *DotmeshAPI) ReplicaCountsForBranch(volumeName string, branch string, commits []types.Snapshot) (map[string]int, int, error) {
+	latency, err := dm.GetReplicationLatencyForBranch(volumeName, branch)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	missing := map[string]int{}
+	for _, missingCommits := range latency {
+		for _, commit := range missingCommits {
+			missing[commit]++
+		}
+	}
+
+	result := map[string]int{}
+	for _, commit := range commits {
+		result[commit.Id] = len(latency) - missing[commit.Id]
+	}
+	return result, len(latency), nil
+}
+
+func (dm *DotmeshAPI) SetReplicationPolicy(volumeName string, minReplicas int, timeoutSeconds int64) error {
+	namespace, name, err := ParseNamespacedVolume(volumeName)
+	if err != nil {
+		return err
+	}
+
+	var result bool
+	return dm.CallRemote(
+		context.Background(), "DotmeshRPC.SetReplicationPolicy",
+		struct {
+			Namespace, Name string
+			MinReplicas     int
+			TimeoutSeconds  int64
+		}{
+			Namespace:      namespace,
+			Name:           name,
+			MinReplicas:    minReplicas,
+			TimeoutSeconds: timeoutSeconds,
+		},
+		&result,
+	)
+}
+
+func (dm *DotmeshAPI) GetReplicationPolicy(volumeName string) (*types.FilesystemReplicationPolicy, error) {
+	namespace, name, err := ParseNamespacedVolume(volumeName)
+	if err != nil {
+		return nil, err
+	}
+
+	var result types.FilesystemReplicationPolicy
+	err = dm.CallRemote(
+		context.Background(), "DotmeshRPC.GetReplicationPolicy",
+		types.VolumeName{Namespace: namespace, Name: name},
+		&result,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func (dm *DotmeshAPI) SetPlacementPolicy(policy types.PlacementPolicy) error {
+	var result bool
+	return dm.CallRemote(
+		context.Background(), "DotmeshRPC.SetPlacementPolicy", policy, &result,
+	)
+}
+
+func (dm *DotmeshAPI) DeletePlacementPolicy(namespace, name string) error {
+	var result bool
+	return dm.CallRemote(
+		context.Background(), "DotmeshRPC.DeletePlacementPolicy",
+		types.VolumeName{Namespace: namespace, Name: name},
+		&result,
+	)
+}
+
+func (dm *DotmeshAPI) GetPlacementPolicy(volumeName string) (*types.PlacementPolicy, error) {
+	namespace, name, err := ParseNamespacedVolume(volumeName)
+	if err != nil {
+		return nil, err
+	}
+
+	var result types.PlacementPolicy
+	err = dm.CallRemote(
+		context.Background(), "DotmeshRPC.GetPlacementPolicy",
+		types.VolumeName{Namespace: namespace, Name: name},
+		&result,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func (dm *DotmeshAPI) SetEncryptionKey(key types.EncryptionKey) error {
+	var result bool
+	return dm.CallRemote(
+		context.Background(), "DotmeshRPC.SetEncryptionKey", key, &result,
+	)
+}
+
+func (dm *DotmeshAPI) SetSigningPolicy(policy types.SigningPolicy) error {
+	var result bool
+	return dm.CallRemote(
+		context.Background(), "DotmeshRPC.SetSigningPolicy", policy, &result,
+	)
+}
+
+func (dm *DotmeshAPI) GetSigningPolicy(namespace string) (*types.SigningPolicy, error) {
+	var result types.SigningPolicy
+	err := dm.CallRemote(
+		context.Background(), "DotmeshRPC.GetSigningPolicy",
+		struct{ Namespace string }{namespace}, &result,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func (dm *DotmeshAPI) AddSigningKey(name, publicKey string) (*types.SigningKey, error) {
+	var result types.SigningKey
+	err := dm.CallRemote(
+		context.Background(), "DotmeshRPC.AddSigningKey",
+		struct{ Name, PublicKey string }{name, publicKey}, &result,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func (dm *DotmeshAPI) CreateOrganization(name string) (*types.Organization, error) {
+	var result types.Organization
+	err := dm.CallRemote(
+		context.Background(), "DotmeshRPC.CreateOrganization",
+		struct{ Name string }{name}, &result,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// Organizations lists the organizations the current user is a member of
+func (dm *DotmeshAPI) Organizations() ([]types.Organization, error) {
+	var result []types.Organization
+	err := dm.CallRemote(context.Background(), "DotmeshRPC.Organizations", struct{}{}, &result)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (dm *DotmeshAPI) Organization(name string) (*types.Organization, error) {
+	var result types.Organization
+	err := dm.CallRemote(
+		context.Background(), "DotmeshRPC.Organization",
+		struct{ Name string }{name}, &result,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func (dm *DotmeshAPI) AddOrganizationMember(org, member string, role types.OrganizationRole) (*types.Organization, error) {
+	var result types.Organization
+	err := dm.CallRemote(
+		context.Background(), "DotmeshRPC.AddOrganizationMember",
+		struct {
+			Organization, Member string
+			Role                 types.OrganizationRole
+		}{org, member, role}, &result,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func (dm *DotmeshAPI) RemoveOrganizationMember(org, member string) (*types.Organization, error) {
+	var result types.Organization
+	err := dm.CallRemote(
+		context.Background(), "DotmeshRPC.RemoveOrganizationMember",
+		struct{ Organization, Member string }{org, member}, &result,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func (dm *DotmeshAPI) RemoveSigningKey(name string) error {
+	var result bool
+	return dm.CallRemote(
+		context.Background(), "DotmeshRPC.RemoveSigningKey",
+		struct{ Name string }{name}, &result,
+	)
+}
+
+// SigningKeys lists the keys a user signs commits with; an empty user means
+// the logged in one
+func (dm *DotmeshAPI) SigningKeys(user string) ([]types.SigningKey, error) {
+	var result []types.SigningKey
+	err := dm.CallRemote(
+		context.Background(), "DotmeshRPC.SigningKeys",
+		struct{ Name string }{user}, &result,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// SubscribeToCommits asks the current remote to pull from peer whenever peer
+// announces a new commit on the subscription's remote branch. The
+// credentials for peer are filled in from our configuration.
+func (dm *DotmeshAPI) SubscribeToCommits(peer string, subscription types.CommitSubscription) (string, error) {
+	remote, err := dm.Configuration.GetRemote(peer)
+	if err != nil {
+		return "", err
+	}
+	dmRemote, ok := remote.(*DMRemote)
+	if !ok {
+		return "", fmt.Errorf("Can only subscribe to commits on dotmesh remotes, %s isn't one", peer)
+	}
+
+	subscription.Peer = dmRemote.Hostname
+	subscription.Port = dmRemote.Port
+	subscription.User = dmRemote.User
+	subscription.ApiKey = dmRemote.ApiKey
+	subscription.LocalBranchName = deMasterify(subscription.LocalBranchName)
+	subscription.RemoteBranchName = deMasterify(subscription.RemoteBranchName)
+
+	var id string
+	err = dm.CallRemote(context.Background(), "DotmeshRPC.SubscribeToCommits", subscription, &id)
+	if err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+func (dm *DotmeshAPI) UnsubscribeFromCommits(id string) error {
+	var result bool
+	return dm.CallRemote(context.Background(), "DotmeshRPC.UnsubscribeFromCommits", id, &result)
+}
+
+func (dm *DotmeshAPI) ListCommitSubscriptions() ([]types.CommitSubscriptionInfo, error) {
+	var result []types.CommitSubscriptionInfo
+	err := dm.CallRemote(context.Background(), "DotmeshRPC.ListCommitSubscriptions", struct{}{}, &result)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
 func (dm *DotmeshAPI) SwitchVolume(volumeName string) error {
 	return dm.setCurrentVolume(volumeName)
 }
@@ -662,6 +965,156 @@ func (dm *DotmeshAPI) CommitWithStruct(args types.CommitArgs) (string, error) {
 	return result, err
 }
 
+// CommitSigned makes a commit signed with key. The server works out a
+// digest of the branch's contents to sign, so this takes as long as reading
+// the whole branch does.
+func (dm *DotmeshAPI) CommitSigned(activeVolumeName, activeBranch, commitMessage string, metadata map[string]string, key ed25519.PrivateKey) (string, error) {
+	info, err := dm.CommitSigningInfo(activeVolumeName, activeBranch)
+	if err != nil {
+		return "", err
+	}
+	signed := map[string]string{}
+	for k, v := range metadata {
+		signed[k] = v
+	}
+	signature := signing.Sign(key, signing.Commit{
+		DotId:         info.DotId,
+		ParentId:      info.ParentId,
+		Message:       commitMessage,
+		Metadata:      metadata,
+		ContentDigest: info.ContentDigest,
+	})
+	for k, v := range signature {
+		signed[k] = v
+	}
+	return dm.Commit(activeVolumeName, activeBranch, commitMessage, signed)
+}
+
+// SignatureStatus is what checking a commit's signature found
+type SignatureStatus string
+
+const (
+	SignatureGood SignatureStatus = "good"
+	// the signature doesn't match the commit
+	SignatureBad SignatureStatus = "bad"
+	// the signature matches, but not with a key the commit's author has
+	// registered on this cluster
+	SignatureUnknownKey SignatureStatus = "unknown-key"
+	SignatureUnsigned   SignatureStatus = "unsigned"
+)
+
+type CommitSignature struct {
+	Status SignatureStatus
+	// fingerprint of the key that signed the commit
+	Key    string `json:",omitempty"`
+	Reason string `json:",omitempty"`
+}
+
+// VerifyCommits checks the signatures of every commit on a branch against
+// the keys their authors have registered on this cluster, keyed by commit id
+func (dm *DotmeshAPI) VerifyCommits(activeVolumeName, activeBranch string) (map[string]CommitSignature, error) {
+	namespace, name, err := ParseNamespacedVolume(activeVolumeName)
+	if err != nil {
+		return nil, err
+	}
+	dotId, err := dm.GetFsId(namespace, name, deMasterify(activeBranch))
+	if err != nil {
+		return nil, err
+	}
+	commits, err := dm.ListCommits(activeVolumeName, activeBranch)
+	if err != nil {
+		return nil, err
+	}
+
+	// author -> their public keys
+	keys := map[string]map[string]bool{}
+	authorKeys := func(author string) map[string]bool {
+		if known, ok := keys[author]; ok {
+			return known
+		}
+		known := map[string]bool{}
+		// an author who isn't a user here has no keys we trust
+		registered, err := dm.SigningKeys(author)
+		if err == nil {
+			for _, key := range registered {
+				known[key.PublicKey] = true
+			}
+		}
+		keys[author] = known
+		return known
+	}
+
+	result := map[string]CommitSignature{}
+	parentId := ""
+	for _, commit := range commits {
+		publicKey, err := signing.Verify(signing.FromMetadata(dotId, parentId, commit.Metadata), commit.Metadata)
+		switch {
+		case err == signing.ErrUnsigned:
+			result[commit.Id] = CommitSignature{Status: SignatureUnsigned}
+		case err != nil:
+			result[commit.Id] = CommitSignature{Status: SignatureBad, Reason: err.Error()}
+		case !authorKeys(commit.Metadata["author"])[publicKey]:
+			result[commit.Id] = CommitSignature{
+				Status: SignatureUnknownKey,
+				Key:    signing.Fingerprint(publicKey),
+				Reason: fmt.Sprintf("not a key of %s", commit.Metadata["author"]),
+			}
+		default:
+			result[commit.Id] = CommitSignature{Status: SignatureGood, Key: signing.Fingerprint(publicKey)}
+		}
+		parentId = commit.Id
+	}
+	return result, nil
+}
+
+func (dm *DotmeshAPI) CommitSigningInfo(activeVolumeName, activeBranch string) (*types.CommitSigningInfo, error) {
+	activeNamespace, activeVolume, err := ParseNamespacedVolume(activeVolumeName)
+	if err != nil {
+		return nil, err
+	}
+	var result types.CommitSigningInfo
+	err = dm.CallRemote(
+		context.Background(),
+		"DotmeshRPC.CommitSigningInfo",
+		map[string]string{
+			"Namespace": activeNamespace,
+			"Name":      activeVolume,
+			"Branch":    deMasterify(activeBranch),
+		},
+		&result,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// Verify has every node holding a copy of a commit check its contents
+// against the digest recorded when it was made. An empty commitId means the
+// branch's latest commit.
+func (dm *DotmeshAPI) Verify(volumeName, branch, commitId string) (*types.VerifyResult, error) {
+	namespace, name, err := ParseNamespacedVolume(volumeName)
+	if err != nil {
+		return nil, err
+	}
+	var result types.VerifyResult
+	err = dm.CallRemote(
+		context.Background(),
+		"DotmeshRPC.Verify",
+		map[string]string{
+			"Namespace":  namespace,
+			"Name":       name,
+			"Branch":     deMasterify(branch),
+			"SnapshotId": commitId,
+		},
+		&result,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
 func (dm *DotmeshAPI) ListCommits(activeVolumeName, activeBranch string) ([]types.Snapshot, error) {
 	var result []types.Snapshot
 
@@ -689,6 +1142,18 @@ func (dm *DotmeshAPI) ListCommits(activeVolumeName, activeBranch string) ([]type
 	return result, nil
 }
 
+// FindCommits searches the commits of every dot the user can see by their
+// metadata, newest first. Set Namespace, Name and Branch in the query to
+// search just one dot or branch.
+func (dm *DotmeshAPI) FindCommits(query types.CommitQuery) ([]types.CommitMatch, error) {
+	var result []types.CommitMatch
+	err := dm.CallRemote(context.Background(), "DotmeshRPC.FindCommits", query, &result)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
 func (dm *DotmeshAPI) CommitsById(dotID string) ([]types.Snapshot, error) {
 	var commits []types.Snapshot
 
@@ -717,6 +1182,36 @@ func (dm *DotmeshAPI) findCommit(ref, volumeName, branchName string) (string, er
 	}
 }
 
+// Restore copies paths, as they were in commit (which may be a HEAD^ style
+// reference), into the working copy of a branch, and commits them if
+// commitAfter is set.
+func (dm *DotmeshAPI) Restore(volumeName, branch, commit string, paths []string, commitAfter bool, message string) (types.RestoreResult, error) {
+	var result types.RestoreResult
+	namespace, name, err := ParseNamespacedVolume(volumeName)
+	if err != nil {
+		return result, err
+	}
+	commitId, err := dm.findCommit(commit, volumeName, branch)
+	if err != nil {
+		return result, err
+	}
+	err = dm.CallRemote(
+		context.Background(),
+		"DotmeshRPC.Restore",
+		types.RestoreArgs{
+			Namespace:  namespace,
+			Name:       name,
+			Branch:     deMasterify(branch),
+			SnapshotId: commitId,
+			Paths:      paths,
+			Commit:     commitAfter,
+			Message:    message,
+		},
+		&result,
+	)
+	return result, err
+}
+
 func (dm *DotmeshAPI) ResetCurrentVolume(commit string) error {
 	activeVolume, err := dm.CurrentVolume()
 	if err != nil {
@@ -832,6 +1327,33 @@ func (dm *DotmeshAPI) GetTransferWithContext(ctx context.Context, transferId str
 	return result, err
 }
 
+// ListTransfers returns the transfers in progress, or with all, every
+// transfer the cluster remembers
+func (dm *DotmeshAPI) ListTransfers(all bool) ([]TransferPollResult, error) {
+	var result []TransferPollResult
+	err := dm.CallRemote(
+		context.Background(), "DotmeshRPC.ListTransfers", struct{ All bool }{all}, &result,
+	)
+	return result, err
+}
+
+// CancelTransfer stops a transfer in progress
+func (dm *DotmeshAPI) CancelTransfer(transferId string) error {
+	var result bool
+	return dm.CallRemote(context.Background(), "DotmeshRPC.CancelTransfer", transferId, &result)
+}
+
+// PauseTransfer stops a transfer in progress until ResumeTransfer is called
+func (dm *DotmeshAPI) PauseTransfer(transferId string) error {
+	var result bool
+	return dm.CallRemote(context.Background(), "DotmeshRPC.PauseTransfer", transferId, &result)
+}
+
+func (dm *DotmeshAPI) ResumeTransfer(transferId string) error {
+	var result bool
+	return dm.CallRemote(context.Background(), "DotmeshRPC.ResumeTransfer", transferId, &result)
+}
+
 type PollTransferInternalResult struct {
 	result TransferPollResult
 	err    error
@@ -856,7 +1378,7 @@ func (dm *DotmeshAPI) UpdateBar(result TransferPollResult, err error, started bo
 	} else {
 		dm.PB.Set64(result.Sent)
 	}
-	dm.PB.Prefix(result.Status)
+	dm.PB.Prefix(TransferStatus(result))
 	var speed string
 	if result.NanosecondsElapsed > 0 {
 		speed = fmt.Sprintf(" %.2f MiB/s",
@@ -880,9 +1402,23 @@ func (dm *DotmeshAPI) UpdateBar(result TransferPollResult, err error, started bo
 			dm.PB.FinishPrint(fmt.Sprintf("error: %s", result.Message))
 		}
 	}
+	if result.Status == "cancelled" {
+		if started {
+			dm.PB.FinishPrint("Cancelled.")
+		}
+	}
 	return started
 }
 
+// TransferStatus describes how a transfer is getting on, including its place
+// in the queue if it's waiting its turn to start
+func TransferStatus(result TransferPollResult) string {
+	if result.Status == "queued" {
+		return fmt.Sprintf("queued (%d ahead)", result.QueuePosition)
+	}
+	return result.Status
+}
+
 func (dm *DotmeshAPI) PollTransfer(transferId string, out io.Writer, callback func(result TransferPollResult, err error, started bool) bool) error {
 
 	logger := log.WithField("transferId", transferId)
@@ -940,6 +1476,9 @@ func (dm *DotmeshAPI) PollTransfer(transferId string, out io.Writer, callback fu
 			time.Sleep(time.Second)
 			return fmt.Errorf(result.result.Message)
 		}
+		if result.result.Status == "cancelled" {
+			return fmt.Errorf("Transfer %s was cancelled", transferId)
+		}
 	}
 }
 
@@ -972,6 +1511,7 @@ func (dm *DotmeshAPI) RequestTransfer(
 	remoteFilesystemName, remoteBranchName string,
 	prefixes []string,
 	stashDivergence bool,
+	priority int,
 ) (string, error) {
 	connectionInitiator := dm.Configuration.CurrentRemote
 
@@ -1107,6 +1647,7 @@ func (dm *DotmeshAPI) RequestTransfer(
 			RemoteName:       remoteVolume,
 			RemoteBranchName: deMasterify(remoteBranchName),
 			StashDivergence:  stashDivergence,
+			Priority:         priority,
 			// TODO add TargetSnapshot here, to support specifying "push to a given
 			// snapshot" rather than just "push all snapshots up to the latest"
 		}
@@ -1136,6 +1677,7 @@ func (dm *DotmeshAPI) RequestTransfer(
 				LocalName:       localVolume,
 				LocalBranchName: deMasterify(localBranchName),
 				RemoteName:      remoteVolume,
+				Priority:        priority,
 				// TODO add TargetSnapshot here, to support specifying "push to a given
 				// snapshot" rather than just "push all snapshots up to the latest"
 				// todo is stash divergence needed here?? (issue dotscience-agent#88)
@@ -1212,23 +1754,30 @@ func (dm *DotmeshAPI) Diff(namespace, name string) ([]types.ZFSFileDiff, error)
 	return dm.DiffFromCommit(namespace, name, "")
 }
 
-func (dm *DotmeshAPI) DiffFromCommit(namespace, name, commitID string) ([]types.ZFSFileDiff, error) {
+// currentRemoteURL returns the base URL of the current remote's HTTP API,
+// along with its credentials
+func (dm *DotmeshAPI) currentRemoteURL() (string, *DMRemote, error) {
 	remoteCreds, err := dm.Configuration.CredsForRemote(dm.Configuration.CurrentRemote)
 	if err != nil {
-		return nil, err
+		return "", nil, err
 	}
 
-	var url string
-
 	if remoteCreds.Port == 0 {
 		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer cancel()
-		url, err = DeduceUrl(ctx, []string{remoteCreds.Hostname}, "external", remoteCreds.User, remoteCreds.ApiKey)
+		url, err := DeduceUrl(ctx, []string{remoteCreds.Hostname}, "external", remoteCreds.User, remoteCreds.ApiKey)
 		if err != nil {
-			return nil, err
+			return "", nil, err
 		}
-	} else {
-		url = "http://" + remoteCreds.Hostname + ":" + strconv.Itoa(remoteCreds.Port)
+		return url, remoteCreds, nil
+	}
+	return "http://" + remoteCreds.Hostname + ":" + strconv.Itoa(remoteCreds.Port), remoteCreds, nil
+}
+
+func (dm *DotmeshAPI) DiffFromCommit(namespace, name, commitID string) ([]types.ZFSFileDiff, error) {
+	url, remoteCreds, err := dm.currentRemoteURL()
+	if err != nil {
+		return nil, err
 	}
 
 	// NB: commitID can be empty string, which means to diff from the latest
@@ -1270,6 +1819,355 @@ func (dm *DotmeshAPI) DiffFromCommit(namespace, name, commitID string) ([]types.
 	return res, nil
 }
 
+// DiffCommits compares two commits of a dot, calling cb with each file that
+// differs. An empty from means the latest commit on branch, and an empty to
+// means branch's working copy. Commits may be on any branch of the dot.
+func (dm *DotmeshAPI) DiffCommits(volumeName, branch, from, to, path string, content bool, cb func(*types.CommitFileDiff) error) error {
+	namespace, name, err := ParseNamespacedVolume(volumeName)
+	if err != nil {
+		return err
+	}
+	baseURL, remoteCreds, err := dm.currentRemoteURL()
+	if err != nil {
+		return err
+	}
+
+	query := url.Values{}
+	query.Set("branch", branch)
+	query.Set("from", from)
+	query.Set("to", to)
+	query.Set("path", path)
+	if content {
+		query.Set("content", "1")
+	}
+
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/commit-diff/%s:%s?%s", baseURL, namespace, name, query.Encode()), nil)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(remoteCreds.User, remoteCreds.ApiKey)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return fmt.Errorf("[%d]: failed to read resp body: %s", resp.StatusCode, err)
+		}
+		return fmt.Errorf("[%d]: %s", resp.StatusCode, string(body))
+	}
+
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var d types.CommitFileDiff
+		err = decoder.Decode(&d)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		err = cb(&d)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Export writes a bundle of a branch's commits, and those of the branches it
+// was made from, to w. With since, the commits up to and including it are
+// left out.
+func (dm *DotmeshAPI) Export(volumeName, branch, since string, w io.Writer) error {
+	namespace, name, err := ParseNamespacedVolume(volumeName)
+	if err != nil {
+		return err
+	}
+	baseURL, remoteCreds, err := dm.currentRemoteURL()
+	if err != nil {
+		return err
+	}
+
+	query := url.Values{}
+	query.Set("branch", branch)
+	if since != "" {
+		query.Set("since", since)
+	}
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/export/%s:%s?%s", baseURL, namespace, name, query.Encode()), nil)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(remoteCreds.User, remoteCreds.ApiKey)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return fmt.Errorf("[%d]: failed to read resp body: %s", resp.StatusCode, err)
+		}
+		return fmt.Errorf("[%d]: %s", resp.StatusCode, string(body))
+	}
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// Import applies the bundle read from r, as written by Export. asDot, if
+// given, is the name to import the dot as instead of the one it was
+// exported with.
+func (dm *DotmeshAPI) Import(r io.Reader, asDot string) (*types.BundleImport, error) {
+	baseURL, remoteCreds, err := dm.currentRemoteURL()
+	if err != nil {
+		return nil, err
+	}
+
+	query := url.Values{}
+	if asDot != "" {
+		namespace, name, err := ParseNamespacedVolume(asDot)
+		if err != nil {
+			return nil, err
+		}
+		query.Set("namespace", namespace)
+		query.Set("name", name)
+	}
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/import?%s", baseURL, query.Encode()), r)
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth(remoteCreds.User, remoteCreds.ApiKey)
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("[%d]: failed to read resp body: %s", resp.StatusCode, err)
+	}
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("[%d]: %s", resp.StatusCode, string(body))
+	}
+	var result types.BundleImport
+	err = json.Unmarshal(body, &result)
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// s3Request makes a request to the S3 compatible API for a dot, which sends
+// it on to the dot's master node, and returns the response if it succeeded.
+func (dm *DotmeshAPI) s3Request(method, volumeName, branch, path string, query url.Values, body io.Reader, header http.Header) (*http.Response, error) {
+	namespace, name, err := ParseNamespacedVolume(volumeName)
+	if err != nil {
+		return nil, err
+	}
+	baseURL, remoteCreds, err := dm.currentRemoteURL()
+	if err != nil {
+		return nil, err
+	}
+	if query == nil {
+		query = url.Values{}
+	}
+	if branch := deMasterify(branch); branch != "" {
+		query.Set("branch", branch)
+	}
+
+	u := fmt.Sprintf("%s/s3/%s:%s%s?%s", baseURL, namespace, name, path, query.Encode())
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.SetBasicAuth(remoteCreds.User, remoteCreds.ApiKey)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, fmt.Errorf("[%d]: failed to read resp body: %s", resp.StatusCode, err)
+		}
+		return nil, fmt.Errorf("[%d]: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return resp, nil
+}
+
+// snapshotPath is the part of an S3 API URL that picks a commit, given as a
+// commit id or HEAD^ style reference; an empty ref means the latest commit.
+func (dm *DotmeshAPI) snapshotPath(volumeName, branch, ref string) (string, error) {
+	if ref == "" {
+		return "/snapshot/latest", nil
+	}
+	commitId, err := dm.findCommit(ref, volumeName, branch)
+	if err != nil {
+		return "", err
+	}
+	return "/snapshot/" + url.PathEscape(commitId), nil
+}
+
+func escapeFilePath(filePath string) string {
+	parts := strings.Split(filePath, "/")
+	for i, part := range parts {
+		parts[i] = url.PathEscape(part)
+	}
+	return strings.Join(parts, "/")
+}
+
+// ListFiles lists what is at dirPath in a commit of a branch, or everything
+// under it if recursive is set.
+func (dm *DotmeshAPI) ListFiles(volumeName, branch, ref, dirPath string, recursive bool) ([]types.ListFileItem, error) {
+	snapshotPath, err := dm.snapshotPath(volumeName, branch, ref)
+	if err != nil {
+		return nil, err
+	}
+	query := url.Values{}
+	query.Set("Prefix", dirPath)
+	query.Set("MaxKeys", "0")
+	query.Set("IncludeDirectories", "1")
+	query.Set("Format", "json")
+	if !recursive {
+		query.Set("NonRecursive", "1")
+	}
+
+	resp, err := dm.s3Request(http.MethodGet, volumeName, branch, snapshotPath, query, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Contents []types.ListFileItem `json:"contents"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		return nil, err
+	}
+	return result.Contents, nil
+}
+
+// ReadFile opens a file in a commit of a branch. If the path is a directory,
+// isDir is set and the contents are a tar archive of it, with the
+// directory's own name as the top level.
+func (dm *DotmeshAPI) ReadFile(volumeName, branch, ref, filePath string) (contents io.ReadCloser, isDir bool, err error) {
+	snapshotPath, err := dm.snapshotPath(volumeName, branch, ref)
+	if err != nil {
+		return nil, false, err
+	}
+	filePath = strings.TrimPrefix(filePath, "/")
+	if filePath == "" {
+		return nil, false, fmt.Errorf("Please specify a path within the dot")
+	}
+
+	resp, err := dm.s3Request(http.MethodGet, volumeName, branch, snapshotPath+"/"+escapeFilePath(filePath), nil, nil, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	return resp.Body, resp.Header.Get("Content-Type") == "application/x-tar", nil
+}
+
+// WriteFile uploads contents to filePath in the working copy of a branch and
+// commits it, returning the new commit's id. With extract, contents is a tar
+// archive whose entries replace whatever is at filePath.
+func (dm *DotmeshAPI) WriteFile(volumeName, branch, filePath string, contents io.Reader, extract bool) (string, error) {
+	filePath = strings.TrimPrefix(filePath, "/")
+	if filePath == "" {
+		return "", fmt.Errorf("Please specify a path within the dot")
+	}
+	header := http.Header{}
+	if extract {
+		header.Set("Extract", "true")
+	}
+
+	resp, err := dm.s3Request(http.MethodPut, volumeName, branch, "/"+escapeFilePath(filePath), nil, contents, header)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	return resp.Header.Get("Snapshot"), nil
+}
+
+// WatchActivity streams activity on the dots visible to the current user,
+// calling cb for each event until ctx is cancelled, the stream ends or cb
+// returns an error. Empty namespace, name or branch match everything.
+func (dm *DotmeshAPI) WatchActivity(ctx context.Context, namespace, name, branch string, cb func(*types.ActivityEvent) error) error {
+	baseURL, remoteCreds, err := dm.currentRemoteURL()
+	if err != nil {
+		return err
+	}
+
+	query := url.Values{}
+	if namespace != "" {
+		query.Set("namespace", namespace)
+	}
+	if name != "" {
+		query.Set("name", name)
+	}
+	if branch != "" {
+		query.Set("branch", branch)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, baseURL+"/events?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.SetBasicAuth(remoteCreds.User, remoteCreds.ApiKey)
+	req.Header.Set("Accept", "text/event-stream")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return fmt.Errorf("[%d]: failed to read resp body: %s", resp.StatusCode, err)
+		}
+		return fmt.Errorf("[%d]: %s", resp.StatusCode, string(body))
+	}
+
+	// Only data lines matter to us, the event type is repeated in them
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "data: ") {
+			continue
+		}
+		var event types.ActivityEvent
+		err = json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event)
+		if err != nil {
+			return err
+		}
+		err = cb(&event)
+		if err != nil {
+			return err
+		}
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+	return scanner.Err()
+}
+
 func (dm *DotmeshAPI) LastModified(namespace, name string) (*types.LastModified, error) {
 	var lastModified types.LastModified
 	err := dm.CallRemote(context.Background(), "DotmeshRPC.LastModified", &types.VolumeName{Namespace: namespace, Name: name}, &lastModified)
@@ -0,0 +1,89 @@
+package client
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/dotmesh-oss/dotmesh/pkg/types"
+)
+
+// newFakeServer answers every RPC with result
+func newFakeServer(t *testing.T, result interface{}) *DotmeshAPI {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request struct {
+			Method string
+			ID     uint64
+		}
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil {
+			t.Errorf("bad request: %s", err)
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"jsonrpc": "2.0",
+			"result":  result,
+			"id":      request.ID,
+		})
+	}))
+	t.Cleanup(server.Close)
+	host, port, err := net.SplitHostPort(server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewDotmeshAPIFromClient(&JsonRpcClient{User: "admin", Hostname: host, Port: p}, false)
+}
+
+func TestReplicaCountsForBranch(t *testing.T) {
+	commits := []types.Snapshot{{Id: "c1"}, {Id: "c2"}}
+	for _, tc := range []struct {
+		name string
+		// commits each node is missing
+		latency  map[string][]string
+		expected map[string]int
+		servers  int
+	}{
+		{
+			name:     "replicated everywhere",
+			latency:  map[string][]string{"node-1": {}, "node-2": {}, "node-3": {}},
+			expected: map[string]int{"c1": 3, "c2": 3},
+			servers:  3,
+		},
+		{
+			name:     "a node is behind",
+			latency:  map[string][]string{"node-1": {}, "node-2": {}, "node-3": {"c2"}},
+			expected: map[string]int{"c1": 3, "c2": 2},
+			servers:  3,
+		},
+		{
+			name:     "only the master",
+			latency:  map[string][]string{"node-1": {}, "node-2": {"c1", "c2"}},
+			expected: map[string]int{"c1": 1, "c2": 1},
+			servers:  2,
+		},
+		{
+			name:     "a single node",
+			latency:  map[string][]string{"node-1": {}},
+			expected: map[string]int{"c1": 1, "c2": 1},
+			servers:  1,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dm := newFakeServer(t, tc.latency)
+			counts, servers, err := dm.ReplicaCountsForBranch("alice/data", "master", commits)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(counts, tc.expected) || servers != tc.servers {
+				t.Errorf("expected %v of %d servers, got %v of %d", tc.expected, tc.servers, counts, servers)
+			}
+		})
+	}
+}
@@ -2,6 +2,7 @@ package client
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -10,6 +11,8 @@ import (
 
 	"golang.org/x/net/context"
 
+	"github.com/dotmesh-oss/dotmesh/pkg/types"
+
 	"github.com/gorilla/rpc/v2/json2"
 	"github.com/opentracing/opentracing-go"
 
@@ -182,6 +185,46 @@ func DeduceUrl(ctx context.Context, hostnames []string, mode, user, apiKey strin
 
 }
 
+// GetAuthConfig asks a cluster how to get an ID token it accepts, which
+// needs no authentication. Without a port, the same addresses as DeduceUrl
+// are tried.
+func GetAuthConfig(ctx context.Context, hostname string, port int) (*types.AuthConfig, error) {
+	urlsToTry := []string{
+		fmt.Sprintf("https://%s:443", hostname),
+		fmt.Sprintf("http://%s:80", hostname),
+		fmt.Sprintf("http://%s:%s", hostname, SERVER_PORT),
+	}
+	if port != 0 {
+		urlsToTry = []string{fmt.Sprintf("http://%s:%d", hostname, port)}
+	}
+
+	var errs []error
+	for _, urlToTry := range urlsToTry {
+		req, err := http.NewRequest("GET", urlToTry+"/auth/config", nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		var config types.AuthConfig
+		if resp.StatusCode == http.StatusOK {
+			err = json.NewDecoder(resp.Body).Decode(&config)
+		} else {
+			err = fmt.Errorf("%s/auth/config: %s", urlToTry, resp.Status)
+		}
+		resp.Body.Close()
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		return &config, nil
+	}
+	return nil, fmt.Errorf("Unable to connect to any of the addresses attempted for %s, errs: %v", hostname, errs)
+}
+
 func (client *JsonRpcClient) Ping() (bool, error) {
 	var response bool
 	ctx, cancel := context.WithTimeout(context.Background(), RPCTimeout)
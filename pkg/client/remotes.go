@@ -23,14 +23,17 @@ matter?
 */
 
 import (
+	"crypto/ed25519"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"reflect"
 	"strings"
 	"sync"
 
+	"github.com/dotmesh-oss/dotmesh/pkg/signing"
 	"github.com/dotmesh-oss/dotmesh/pkg/types"
 )
 
@@ -161,10 +164,20 @@ func (remote DMRemote) String() string {
 
 type Configuration struct {
 	CurrentRemote string
+	// where the remotes' secrets are kept, one of the SecretStore*s
+	SecretStore string               `json:",omitempty"`
+	DMRemotes   map[string]*DMRemote `json:"Remotes"`
+	S3Remotes   map[string]*S3Remote
+	lock        sync.Mutex
+	configPath  string
+}
+
+// storedConfiguration is how a Configuration is saved
+type storedConfiguration struct {
+	CurrentRemote string
+	SecretStore   string               `json:",omitempty"`
 	DMRemotes     map[string]*DMRemote `json:"Remotes"`
 	S3Remotes     map[string]*S3Remote
-	lock          sync.Mutex
-	configPath    string
 }
 
 func NewConfiguration(configPath string) (*Configuration, error) {
@@ -193,6 +206,20 @@ func (c *Configuration) Load() error {
 	if err := json.Unmarshal(serialized, &c); err != nil {
 		return err
 	}
+	store, err := newSecretStore(c.SecretStore, c.configPath)
+	if err != nil || store == nil {
+		return err
+	}
+	secrets, err := store.load()
+	if err != nil {
+		return err
+	}
+	for name, remote := range c.DMRemotes {
+		remote.ApiKey = secrets[secretKeyForDMRemote(name)]
+	}
+	for name, remote := range c.S3Remotes {
+		remote.SecretKey = secrets[secretKeyForS3Remote(name)]
+	}
 	return nil
 }
 
@@ -203,7 +230,40 @@ func (c *Configuration) Save() error {
 }
 
 func (c *Configuration) save() error {
-	serialized, err := json.Marshal(c)
+	stored := storedConfiguration{
+		CurrentRemote: c.CurrentRemote,
+		SecretStore:   c.SecretStore,
+		DMRemotes:     c.DMRemotes,
+		S3Remotes:     c.S3Remotes,
+	}
+	store, err := newSecretStore(c.SecretStore, c.configPath)
+	if err != nil {
+		return err
+	}
+	if store != nil {
+		// keep the secrets in the store, and copies of the remotes without
+		// them in the file
+		secrets := map[string]string{}
+		stored.DMRemotes = map[string]*DMRemote{}
+		for name, remote := range c.DMRemotes {
+			secrets[secretKeyForDMRemote(name)] = remote.ApiKey
+			withoutSecret := *remote
+			withoutSecret.ApiKey = ""
+			stored.DMRemotes[name] = &withoutSecret
+		}
+		stored.S3Remotes = map[string]*S3Remote{}
+		for name, remote := range c.S3Remotes {
+			secrets[secretKeyForS3Remote(name)] = remote.SecretKey
+			withoutSecret := *remote
+			withoutSecret.SecretKey = ""
+			stored.S3Remotes[name] = &withoutSecret
+		}
+		err = store.save(secrets)
+		if err != nil {
+			return err
+		}
+	}
+	serialized, err := json.Marshal(&stored)
 	if err != nil {
 		return err
 	}
@@ -211,6 +271,45 @@ func (c *Configuration) save() error {
 	return nil
 }
 
+// SetSecretStore moves the remotes' secrets to where kind says, one of the
+// SecretStore*s
+func (c *Configuration) SetSecretStore(kind string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if kind == "plain" {
+		kind = SecretStorePlain
+	}
+	if kind == c.SecretStore {
+		return nil
+	}
+	old, err := newSecretStore(c.SecretStore, c.configPath)
+	if err != nil {
+		return err
+	}
+	if _, err = newSecretStore(kind, c.configPath); err != nil {
+		return err
+	}
+	c.SecretStore = kind
+	err = c.save()
+	if err != nil {
+		return err
+	}
+	if old != nil {
+		// they're not kept there any more
+		return old.save(map[string]string{})
+	}
+	return nil
+}
+
+func (c *Configuration) GetSecretStore() string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.SecretStore == SecretStorePlain {
+		return "plain"
+	}
+	return c.SecretStore
+}
+
 func (c *Configuration) getRemote(name string) (Remote, error) {
 	var r Remote
 	var ok bool
@@ -450,6 +549,18 @@ func (c *Configuration) AddRemote(remote, user, hostname string, port int, apiKe
 	return c.save()
 }
 
+// SetRemoteCredentials changes who a dotmesh remote is accessed as, e.g.
+// after logging in to it again
+func (c *Configuration) SetRemoteCredentials(remote, user, apiKey string) error {
+	r, ok := c.DMRemotes[remote]
+	if !ok {
+		return fmt.Errorf("No such dotmesh remote '%s'", remote)
+	}
+	r.User = user
+	r.ApiKey = apiKey
+	return c.save()
+}
+
 func (c *Configuration) RemoveRemote(remote string) error {
 	_, ok := c.DMRemotes[remote]
 	if !ok {
@@ -500,3 +611,39 @@ func (c *Configuration) ClusterFromRemote(remote string, verbose bool) (*JsonRpc
 func (c *Configuration) ClusterFromCurrentRemote(verbose bool) (*JsonRpcClient, error) {
 	return c.ClusterFromRemote(c.CurrentRemote, verbose)
 }
+
+// SigningKeyPath is where dm keeps the key it signs commits with, next to
+// its configuration. The same key can be registered with every cluster.
+func (c *Configuration) SigningKeyPath() string {
+	return filepath.Join(filepath.Dir(c.configPath), "signing_key")
+}
+
+// LoadSigningKey reads the key dm signs commits with
+func (c *Configuration) LoadSigningKey() (ed25519.PrivateKey, error) {
+	data, err := ioutil.ReadFile(c.SigningKeyPath())
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("No signing key at %s, try 'dm key generate'", c.SigningKeyPath())
+	}
+	if err != nil {
+		return nil, err
+	}
+	return signing.ParsePrivateKey(data)
+}
+
+// SaveSigningKey keeps key to sign commits with, readable only by the user.
+// It won't replace a key that's already there.
+func (c *Configuration) SaveSigningKey(key ed25519.PrivateKey) error {
+	data, err := signing.MarshalPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(c.SigningKeyPath(), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
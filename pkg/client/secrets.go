@@ -0,0 +1,198 @@
+package client
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/dotmesh-oss/dotmesh/pkg/crypto"
+)
+
+// Where the API keys of dotmesh remotes and the secret keys of S3 remotes
+// are kept
+const (
+	// in the configuration file, as they always were
+	SecretStorePlain = ""
+	// in the OS keyring: the macOS keychain, or the Secret Service (e.g.
+	// GNOME Keyring) via secret-tool on Linux
+	SecretStoreKeyring = "keyring"
+	// in a file next to the configuration, encrypted with a passphrase from
+	// ConfigPassphraseEnv
+	SecretStoreFile = "file"
+)
+
+// ConfigPassphraseEnv is where the passphrase for SecretStoreFile comes from
+const ConfigPassphraseEnv = "DOTMESH_CONFIG_PASSPHRASE"
+
+const keyringService = "dotmesh"
+
+// secretStore keeps the secrets of remotes, keyed by secretKeyFor*
+type secretStore interface {
+	load() (map[string]string, error)
+	save(secrets map[string]string) error
+}
+
+func secretKeyForDMRemote(name string) string {
+	return "remotes/" + name + "/ApiKey"
+}
+
+func secretKeyForS3Remote(name string) string {
+	return "s3remotes/" + name + "/SecretKey"
+}
+
+func newSecretStore(kind, configPath string) (secretStore, error) {
+	switch kind {
+	case SecretStorePlain:
+		return nil, nil
+	case SecretStoreKeyring:
+		return &keyringSecretStore{account: configPath, goos: runtime.GOOS}, nil
+	case SecretStoreFile:
+		return &fileSecretStore{path: filepath.Join(filepath.Dir(configPath), "secrets")}, nil
+	}
+	return nil, fmt.Errorf("Unknown secret store '%s', expected plain, keyring or file", kind)
+}
+
+// keyringSecretStore keeps the secrets as one item in the OS keyring, named
+// for the configuration file they're from
+type keyringSecretStore struct {
+	account string
+	// goos picks the keyring tool, it's runtime.GOOS other than in tests
+	goos string
+}
+
+func (k *keyringSecretStore) load() (map[string]string, error) {
+	var cmd *exec.Cmd
+	// notFound says whether the tool failed only because nothing has been
+	// kept there yet, anything else (a locked keyring, access being denied)
+	// has to be reported or the next save would lose what's there
+	var notFound func(exitCode int, stderr string) bool
+	switch k.goos {
+	case "darwin":
+		cmd = exec.Command("security", "find-generic-password", "-s", keyringService, "-a", k.account, "-w")
+		notFound = func(exitCode int, stderr string) bool {
+			// errSecItemNotFound
+			return exitCode == 44
+		}
+	case "linux", "freebsd", "openbsd":
+		cmd = exec.Command("secret-tool", "lookup", "service", keyringService, "account", k.account)
+		notFound = func(exitCode int, stderr string) bool {
+			// secret-tool fails silently when there's no such item, and
+			// says why otherwise
+			return exitCode == 1 && strings.TrimSpace(stderr) == ""
+		}
+	default:
+		return nil, fmt.Errorf("The OS keyring isn't supported on %s, try the 'file' secret store", k.goos)
+	}
+	stderr := bytes.Buffer{}
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	secrets := map[string]string{}
+	if exitErr, ok := err.(*exec.ExitError); ok && notFound(exitErr.ExitCode(), stderr.String()) {
+		return secrets, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read secrets from the OS keyring: %s %s", err, stderr.String())
+	}
+	err = json.Unmarshal(bytes.TrimSpace(output), &secrets)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to decode secrets from the OS keyring: %s", err)
+	}
+	return secrets, nil
+}
+
+func (k *keyringSecretStore) save(secrets map[string]string) error {
+	serialized, err := json.Marshal(secrets)
+	if err != nil {
+		return err
+	}
+	var cmd *exec.Cmd
+	switch k.goos {
+	case "darwin":
+		// security only takes the password as an argument, which anyone can
+		// see with ps, so give it the command on stdin instead
+		cmd = exec.Command("security", "-i")
+		cmd.Stdin = strings.NewReader(fmt.Sprintf(
+			"add-generic-password -U -s %s -a %s -X %s\n",
+			keyringService, securityQuote(k.account), hex.EncodeToString(serialized),
+		))
+	case "linux", "freebsd", "openbsd":
+		cmd = exec.Command("secret-tool", "store", "--label=dotmesh remotes", "service", keyringService, "account", k.account)
+		cmd.Stdin = bytes.NewReader(serialized)
+	default:
+		return fmt.Errorf("The OS keyring isn't supported on %s, try the 'file' secret store", k.goos)
+	}
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("Unable to save secrets to the OS keyring: %s %s", err, string(output))
+	}
+	return nil
+}
+
+// securityQuote quotes an argument to a command given to security -i
+func securityQuote(arg string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(arg) + `"`
+}
+
+// fileSecretStore keeps the secrets in a file encrypted with a passphrase
+type fileSecretStore struct {
+	path string
+}
+
+func (f *fileSecretStore) passphrase() (string, error) {
+	passphrase := os.Getenv(ConfigPassphraseEnv)
+	if passphrase == "" {
+		return "", fmt.Errorf("Please set %s to the passphrase that %s is encrypted with", ConfigPassphraseEnv, f.path)
+	}
+	return passphrase, nil
+}
+
+func (f *fileSecretStore) load() (map[string]string, error) {
+	secrets := map[string]string{}
+	encrypted, err := ioutil.ReadFile(f.path)
+	if os.IsNotExist(err) {
+		return secrets, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	passphrase, err := f.passphrase()
+	if err != nil {
+		return nil, err
+	}
+	serialized, err := crypto.DecryptWithPassphrase(passphrase, encrypted)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to decrypt %s: %s", f.path, err)
+	}
+	err = json.Unmarshal(serialized, &secrets)
+	if err != nil {
+		return nil, err
+	}
+	return secrets, nil
+}
+
+func (f *fileSecretStore) save(secrets map[string]string) error {
+	passphrase, err := f.passphrase()
+	if err != nil {
+		return err
+	}
+	serialized, err := json.Marshal(secrets)
+	if err != nil {
+		return err
+	}
+	encrypted, err := crypto.EncryptWithPassphrase(passphrase, serialized)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(f.path+".tmp", encrypted, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.path+".tmp", f.path)
+}
@@ -0,0 +1,293 @@
+package client
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// fakeKeyringEnv is the directory the fake keyring tools keep their item in
+const fakeKeyringEnv = "DOTMESH_TEST_FAKE_KEYRING"
+
+// TestMain runs the test binary as a fake of a keyring tool when it's run
+// by that name, see fakeKeyring
+func TestMain(m *testing.M) {
+	switch filepath.Base(os.Args[0]) {
+	case "security":
+		os.Exit(fakeSecurity(os.Getenv(fakeKeyringEnv), os.Args[1:]))
+	case "secret-tool":
+		os.Exit(fakeSecretTool(os.Getenv(fakeKeyringEnv), os.Args[1:]))
+	}
+	os.Exit(m.Run())
+}
+
+// fakeSecurity is enough of the macOS security tool for keyringSecretStore,
+// keeping the item in dir/item. It can't be read while dir/locked exists.
+func fakeSecurity(dir string, args []string) int {
+	ioutil.WriteFile(filepath.Join(dir, "argv"), []byte(strings.Join(args, " ")), 0600)
+	if len(args) > 0 && args[0] == "find-generic-password" {
+		if _, err := os.Stat(filepath.Join(dir, "locked")); err == nil {
+			fmt.Fprintln(os.Stderr, "security: SecKeychainSearchCopyNext: User interaction is not allowed.")
+			return 36
+		}
+		item, err := ioutil.ReadFile(filepath.Join(dir, "item"))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "security: SecKeychainSearchCopyNext: The specified item could not be found in the keychain.")
+			return 44
+		}
+		fmt.Println(string(item))
+		return 0
+	}
+	if len(args) == 1 && args[0] == "-i" {
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			for i := 0; i+1 < len(fields); i++ {
+				if fields[0] == "add-generic-password" && fields[i] == "-X" {
+					item, err := hex.DecodeString(fields[i+1])
+					if err != nil {
+						fmt.Fprintln(os.Stderr, err)
+						return 1
+					}
+					ioutil.WriteFile(filepath.Join(dir, "item"), item, 0600)
+				}
+			}
+		}
+		return 0
+	}
+	fmt.Fprintf(os.Stderr, "unexpected arguments %v\n", args)
+	return 2
+}
+
+// fakeSecretTool is fakeSecurity for secret-tool
+func fakeSecretTool(dir string, args []string) int {
+	ioutil.WriteFile(filepath.Join(dir, "argv"), []byte(strings.Join(args, " ")), 0600)
+	switch {
+	case len(args) > 0 && args[0] == "lookup":
+		if _, err := os.Stat(filepath.Join(dir, "locked")); err == nil {
+			fmt.Fprintln(os.Stderr, "secret-tool: Cannot prompt to unlock the collection")
+			return 1
+		}
+		item, err := ioutil.ReadFile(filepath.Join(dir, "item"))
+		if err != nil {
+			return 1
+		}
+		fmt.Print(string(item))
+		return 0
+	case len(args) > 0 && args[0] == "store":
+		item, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			return 1
+		}
+		ioutil.WriteFile(filepath.Join(dir, "item"), item, 0600)
+		return 0
+	}
+	fmt.Fprintf(os.Stderr, "unexpected arguments %v\n", args)
+	return 2
+}
+
+// setEnv sets an environment variable, returning a func that puts it back
+func setEnv(key, value string) func() {
+	previous, set := os.LookupEnv(key)
+	os.Setenv(key, value)
+	return func() {
+		if set {
+			os.Setenv(key, previous)
+		} else {
+			os.Unsetenv(key)
+		}
+	}
+}
+
+// fakeKeyring puts fakes of the keyring tools first on the PATH, returning
+// the directory they keep their item in
+func fakeKeyring(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "dotmesh-keyring")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	self, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bin := filepath.Join(dir, "bin")
+	if err = os.Mkdir(bin, 0700); err != nil {
+		t.Fatal(err)
+	}
+	for _, tool := range []string{"security", "secret-tool"} {
+		if err = os.Symlink(self, filepath.Join(bin, tool)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Cleanup(setEnv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH")))
+	t.Cleanup(setEnv(fakeKeyringEnv, dir))
+	return dir
+}
+
+func TestKeyringSecretStore(t *testing.T) {
+	secrets := map[string]string{
+		secretKeyForDMRemote("origin"): "api-key",
+		secretKeyForS3Remote("s3"):     `a "quoted" \ secret`,
+	}
+	for _, goos := range []string{"darwin", "linux"} {
+		t.Run(goos, func(t *testing.T) {
+			dir := fakeKeyring(t)
+			store := &keyringSecretStore{account: "/home/alice/.dotmesh/config", goos: goos}
+
+			loaded, err := store.load()
+			if err != nil {
+				t.Fatalf("expected nothing to be kept yet, got %s", err)
+			}
+			if len(loaded) != 0 {
+				t.Errorf("expected no secrets, got %v", loaded)
+			}
+
+			if err = store.save(secrets); err != nil {
+				t.Fatal(err)
+			}
+			argv, err := ioutil.ReadFile(filepath.Join(dir, "argv"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Contains(string(argv), "api-key") {
+				t.Errorf("expected the secrets not to be passed as arguments, got %s", argv)
+			}
+			loaded, err = store.load()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(loaded, secrets) {
+				t.Errorf("expected %v, got %v", secrets, loaded)
+			}
+
+			// a locked keyring isn't an empty one
+			if err = ioutil.WriteFile(filepath.Join(dir, "locked"), nil, 0600); err != nil {
+				t.Fatal(err)
+			}
+			_, err = store.load()
+			if err == nil {
+				t.Error("expected reading a locked keyring to fail")
+			}
+		})
+	}
+}
+
+func TestKeyringSecretStoreMissingTool(t *testing.T) {
+	defer setEnv("PATH", "")()
+	_, err := (&keyringSecretStore{account: "config", goos: "linux"}).load()
+	if err == nil {
+		t.Error("expected reading the keyring without secret-tool to fail")
+	}
+}
+
+func TestFileSecretStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dotmesh-secrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := &fileSecretStore{path: filepath.Join(dir, "secrets")}
+	secrets := map[string]string{secretKeyForDMRemote("origin"): "api-key"}
+
+	defer setEnv(ConfigPassphraseEnv, "correct horse")()
+	loaded, err := store.load()
+	if err != nil || len(loaded) != 0 {
+		t.Fatalf("expected no secrets before any are saved, got %v, %v", loaded, err)
+	}
+	if err = store.save(secrets); err != nil {
+		t.Fatal(err)
+	}
+	encrypted, err := ioutil.ReadFile(store.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(encrypted), "api-key") {
+		t.Error("expected the secrets to be encrypted")
+	}
+	loaded, err = store.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(loaded, secrets) {
+		t.Errorf("expected %v, got %v", secrets, loaded)
+	}
+
+	os.Setenv(ConfigPassphraseEnv, "battery staple")
+	if _, err = store.load(); err == nil {
+		t.Error("expected the wrong passphrase to fail")
+	}
+}
+
+func TestSetSecretStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dotmesh-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer setEnv(ConfigPassphraseEnv, "correct horse")()
+	configPath := filepath.Join(dir, "config")
+
+	c, err := NewConfiguration(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.DMRemotes["origin"] = &DMRemote{User: "alice", Hostname: "example.com", ApiKey: "api-key"}
+	c.S3Remotes["s3"] = &S3Remote{KeyID: "key-id", SecretKey: "s3-secret"}
+	if err = c.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// reads the configuration back, checking which secrets are in the file
+	reload := func(inFile bool) {
+		t.Helper()
+		serialized, err := ioutil.ReadFile(configPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, secret := range []string{"api-key", "s3-secret"} {
+			if strings.Contains(string(serialized), secret) != inFile {
+				t.Errorf("expected %s to be in the configuration file: %t", secret, inFile)
+			}
+		}
+		c, err = NewConfiguration(configPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.DMRemotes["origin"].ApiKey != "api-key" || c.S3Remotes["s3"].SecretKey != "s3-secret" {
+			t.Errorf("expected the secrets to be loaded, got %+v %+v", c.DMRemotes["origin"], c.S3Remotes["s3"])
+		}
+	}
+	reload(true)
+
+	if err = c.SetSecretStore(SecretStoreFile); err != nil {
+		t.Fatal(err)
+	}
+	reload(false)
+	if c.GetSecretStore() != SecretStoreFile {
+		t.Errorf("expected the file store, got %s", c.GetSecretStore())
+	}
+
+	if err = c.SetSecretStore("plain"); err != nil {
+		t.Fatal(err)
+	}
+	reload(true)
+	// and they're not left behind in the file store
+	left, err := (&fileSecretStore{path: filepath.Join(dir, "secrets")}).load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(left) != 0 {
+		t.Errorf("expected the file store to be emptied, got %v", left)
+	}
+
+	if err = c.SetSecretStore("vault"); err == nil {
+		t.Error("expected an unknown secret store to be refused")
+	}
+}
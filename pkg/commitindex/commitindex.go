@@ -0,0 +1,203 @@
+// Package commitindex keeps commits' metadata from every dot in memory, so
+// they can be searched without asking each dot's master for its commits.
+package commitindex
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/dotmesh-oss/dotmesh/pkg/types"
+)
+
+// Query picks commits out of the index. Empty fields don't narrow the
+// search.
+type Query struct {
+	// K8s style selector over commit metadata, e.g. "pipeline=42,env!=test",
+	// whose values can be anything but commas and parentheses
+	Selector string
+	Author   string
+	// matched case insensitively
+	MessageContains string
+	// unix nanoseconds, inclusive
+	Since int64
+	Until int64
+	// Include, if set, is asked about each filesystem with matching commits,
+	// for callers to scope the search and check access. It's called without
+	// the index locked, so it can take its time.
+	Include func(filesystemId string) bool
+	// the most results to return, newest first; 0 means all of them
+	Limit int
+}
+
+// Match is a commit that satisfied a Query
+type Match struct {
+	FilesystemId string
+	Commit       types.Snapshot
+}
+
+// entries are never changed once they're in the index, so they can be used
+// after the lock is released
+type entry struct {
+	filesystemId string
+	commit       types.Snapshot
+	// where it comes in its filesystem's history
+	position  int
+	timestamp int64
+	message   string
+}
+
+// Index is safe for concurrent use.
+type Index struct {
+	lock         sync.RWMutex
+	byFilesystem map[string][]*entry
+	// "key=value" of every metadata field to the commits that have it, so
+	// that selectors with an equality in them don't scan everything
+	byField map[string]map[*entry]bool
+}
+
+func New() *Index {
+	return &Index{
+		byFilesystem: map[string][]*entry{},
+		byField:      map[string]map[*entry]bool{},
+	}
+}
+
+func fieldKey(key, value string) string {
+	return key + "=" + value
+}
+
+// Update replaces what the index knows about a filesystem's commits
+func (i *Index) Update(filesystemId string, snapshots []*types.Snapshot) {
+	entries := make([]*entry, 0, len(snapshots))
+	for position, s := range snapshots {
+		c := s.DeepCopy()
+		// commits that predate timestamps sort first
+		timestamp, _ := strconv.ParseInt(c.Metadata["timestamp"], 10, 64)
+		entries = append(entries, &entry{
+			filesystemId: filesystemId,
+			commit:       *c,
+			position:     position,
+			timestamp:    timestamp,
+			message:      strings.ToLower(c.Metadata["message"]),
+		})
+	}
+
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	i.remove(filesystemId)
+	i.byFilesystem[filesystemId] = entries
+	for _, e := range entries {
+		for k, v := range e.commit.Metadata {
+			key := fieldKey(k, v)
+			if i.byField[key] == nil {
+				i.byField[key] = map[*entry]bool{}
+			}
+			i.byField[key][e] = true
+		}
+	}
+}
+
+// Remove forgets a filesystem, e.g. because it has been deleted
+func (i *Index) Remove(filesystemId string) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	i.remove(filesystemId)
+}
+
+func (i *Index) remove(filesystemId string) {
+	for _, e := range i.byFilesystem[filesystemId] {
+		for k, v := range e.commit.Metadata {
+			key := fieldKey(k, v)
+			delete(i.byField[key], e)
+			if len(i.byField[key]) == 0 {
+				delete(i.byField, key)
+			}
+		}
+	}
+	delete(i.byFilesystem, filesystemId)
+}
+
+// Search returns the commits matching q, newest first. It only fails if the
+// selector can't be parsed.
+func (i *Index) Search(q Query) ([]Match, error) {
+	selector, err := parseSelector(q.Selector)
+	if err != nil {
+		return nil, err
+	}
+	message := strings.ToLower(q.MessageContains)
+
+	i.lock.RLock()
+	candidates := []*entry{}
+	for _, e := range i.candidates(selector) {
+		if (q.Author != "" && e.commit.Metadata["author"] != q.Author) ||
+			(message != "" && !strings.Contains(e.message, message)) ||
+			(q.Since != 0 && e.timestamp < q.Since) ||
+			(q.Until != 0 && e.timestamp > q.Until) ||
+			!selector.matches(e.commit.Metadata) {
+			continue
+		}
+		candidates = append(candidates, e)
+	}
+	i.lock.RUnlock()
+
+	included := map[string]bool{}
+	matching := []*entry{}
+	for _, e := range candidates {
+		ok, seen := included[e.filesystemId]
+		if !seen {
+			ok = q.Include == nil || q.Include(e.filesystemId)
+			included[e.filesystemId] = ok
+		}
+		if ok {
+			matching = append(matching, e)
+		}
+	}
+
+	sort.Slice(matching, func(a, b int) bool {
+		ea, eb := matching[a], matching[b]
+		if ea.timestamp != eb.timestamp {
+			return ea.timestamp > eb.timestamp
+		}
+		if ea.filesystemId != eb.filesystemId {
+			return ea.filesystemId < eb.filesystemId
+		}
+		return ea.position > eb.position
+	})
+	if q.Limit > 0 && len(matching) > q.Limit {
+		matching = matching[:q.Limit]
+	}
+
+	result := make([]Match, 0, len(matching))
+	for _, e := range matching {
+		result = append(result, Match{
+			FilesystemId: e.filesystemId,
+			Commit:       *e.commit.DeepCopy(),
+		})
+	}
+	return result, nil
+}
+
+// candidates narrows the search down using the first requirement of the
+// selector that says what a field must equal, if there is one
+func (i *Index) candidates(s selector) []*entry {
+	for _, r := range s {
+		if r.operator != equals && r.operator != in {
+			continue
+		}
+		result := []*entry{}
+		for _, v := range r.values {
+			for e := range i.byField[fieldKey(r.key, v)] {
+				result = append(result, e)
+			}
+		}
+		return result
+	}
+
+	result := []*entry{}
+	for _, entries := range i.byFilesystem {
+		result = append(result, entries...)
+	}
+	return result
+}
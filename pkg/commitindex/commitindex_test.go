@@ -0,0 +1,166 @@
+package commitindex
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/dotmesh-oss/dotmesh/pkg/types"
+)
+
+func commit(id, timestamp, author, message string, extra ...string) *types.Snapshot {
+	metadata := map[string]string{
+		"timestamp": timestamp,
+		"author":    author,
+		"message":   message,
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		metadata[extra[i]] = extra[i+1]
+	}
+	return &types.Snapshot{Id: id, Metadata: metadata}
+}
+
+func ids(matches []Match) []string {
+	result := []string{}
+	for _, m := range matches {
+		result = append(result, m.FilesystemId+":"+m.Commit.Id)
+	}
+	return result
+}
+
+func testIndex() *Index {
+	i := New()
+	i.Update("fs1", []*types.Snapshot{
+		commit("a", "100", "alice", "Initial import", "pipeline", "41"),
+		commit("b", "300", "bob", "Nightly run", "pipeline", "42", "env", "prod"),
+		commit("c", "500", "alice", "nightly RUN again", "pipeline", "42", "env", "test"),
+	})
+	i.Update("fs2", []*types.Snapshot{
+		commit("d", "200", "alice", "Other dot", "pipeline", "42", "env", "staging"),
+		commit("e", "400", "carol", "No pipeline"),
+	})
+	return i
+}
+
+func TestSearch(t *testing.T) {
+	i := testIndex()
+	for _, tc := range []struct {
+		name     string
+		query    Query
+		expected []string
+	}{
+		{"everything, newest first", Query{}, []string{"fs1:c", "fs2:e", "fs1:b", "fs2:d", "fs1:a"}},
+		{"equality", Query{Selector: "pipeline=42"}, []string{"fs1:c", "fs1:b", "fs2:d"}},
+		{"set based", Query{Selector: "env in (prod,staging)"}, []string{"fs1:b", "fs2:d"}},
+		{"inequality", Query{Selector: "pipeline=42,env!=test"}, []string{"fs1:b", "fs2:d"}},
+		{"missing key", Query{Selector: "!pipeline"}, []string{"fs2:e"}},
+		{"author", Query{Author: "alice"}, []string{"fs1:c", "fs2:d", "fs1:a"}},
+		{"message ignores case", Query{MessageContains: "NIGHTLY"}, []string{"fs1:c", "fs1:b"}},
+		{"time range", Query{Since: 200, Until: 400}, []string{"fs2:e", "fs1:b", "fs2:d"}},
+		{"limit", Query{Selector: "pipeline", Limit: 2}, []string{"fs1:c", "fs1:b"}},
+		{
+			"include",
+			Query{Include: func(fs string) bool { return fs == "fs2" }},
+			[]string{"fs2:e", "fs2:d"},
+		},
+	} {
+		matches, err := i.Search(tc.query)
+		if err != nil {
+			t.Errorf("%s: %s", tc.name, err)
+			continue
+		}
+		if got := ids(matches); !reflect.DeepEqual(got, tc.expected) {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.expected, got)
+		}
+	}
+}
+
+func TestSearchBadSelector(t *testing.T) {
+	for _, selector := range []string{"pipeline in", "pipeline in (42", "=42", "pipeline=42,", "pipeline is 42"} {
+		_, err := testIndex().Search(Query{Selector: selector})
+		if err == nil {
+			t.Errorf("expected %q to be an error", selector)
+		}
+	}
+}
+
+func TestSearchAnyValue(t *testing.T) {
+	i := New()
+	i.Update("fs1", []*types.Snapshot{
+		commit("a", "100", "alice", "Build", "image", "registry.example.com/app:v1.2", "notes", "a=b c"),
+		commit("b", "200", "alice", "Build", "image", "registry.example.com/app:v1.3"),
+	})
+	for _, tc := range []struct {
+		selector string
+		expected []string
+	}{
+		{"image=registry.example.com/app:v1.2", []string{"fs1:a"}},
+		{"image == registry.example.com/app:v1.2", []string{"fs1:a"}},
+		{"image!=registry.example.com/app:v1.2", []string{"fs1:b"}},
+		{"image in (registry.example.com/app:v1.2, registry.example.com/app:v1.3)", []string{"fs1:b", "fs1:a"}},
+		{"image notin (registry.example.com/app:v1.3)", []string{"fs1:a"}},
+		{"notes=a=b c", []string{"fs1:a"}},
+		{"notes,!missing", []string{"fs1:a"}},
+	} {
+		matches, err := i.Search(Query{Selector: tc.selector})
+		if err != nil {
+			t.Errorf("%s: %s", tc.selector, err)
+			continue
+		}
+		if got := ids(matches); !reflect.DeepEqual(got, tc.expected) {
+			t.Errorf("%s: expected %v, got %v", tc.selector, tc.expected, got)
+		}
+	}
+}
+
+func TestIncludeIsCalledUnlocked(t *testing.T) {
+	i := testIndex()
+	// Include taking the write lock would deadlock if Search held the index
+	matches, err := i.Search(Query{Include: func(fs string) bool {
+		i.Update("fs3", nil)
+		return fs == "fs2"
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := ids(matches); !reflect.DeepEqual(got, []string{"fs2:e", "fs2:d"}) {
+		t.Errorf("expected only fs2's commits, got %v", got)
+	}
+}
+
+func TestUpdateAndRemove(t *testing.T) {
+	i := testIndex()
+
+	i.Update("fs1", []*types.Snapshot{
+		commit("a", "100", "alice", "Initial import", "pipeline", "41"),
+	})
+	matches, err := i.Search(Query{Selector: "pipeline=42"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := ids(matches); !reflect.DeepEqual(got, []string{"fs2:d"}) {
+		t.Errorf("expected fs1's dropped commits to be forgotten, got %v", got)
+	}
+
+	i.Remove("fs2")
+	matches, err = i.Search(Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := ids(matches); !reflect.DeepEqual(got, []string{"fs1:a"}) {
+		t.Errorf("expected only fs1:a to be left, got %v", got)
+	}
+	if len(i.byField) != 4 {
+		t.Errorf("expected only fs1:a's fields to be left in the index, got %v", i.byField)
+	}
+}
+
+func TestResultsAreCopies(t *testing.T) {
+	i := testIndex()
+	matches, _ := i.Search(Query{Selector: "env=prod"})
+	matches[0].Commit.Metadata["env"] = "changed"
+
+	matches, _ = i.Search(Query{Selector: "env=prod"})
+	if len(matches) != 1 {
+		t.Errorf("expected changing a result not to change the index")
+	}
+}
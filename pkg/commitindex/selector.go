@@ -0,0 +1,182 @@
+package commitindex
+
+import (
+	"fmt"
+	"strings"
+)
+
+type operator int
+
+const (
+	equals operator = iota
+	notEquals
+	in
+	notIn
+	exists
+	doesNotExist
+)
+
+// requirement is one comma separated part of a selector
+type requirement struct {
+	key      string
+	operator operator
+	values   []string
+}
+
+// selector is a Kubernetes style selector over commit metadata, but unlike
+// label selectors, values can be anything but a comma or a parenthesis, such
+// as versions like "v1.2/linux:amd64"
+type selector []requirement
+
+// parseSelector reads selectors like "pipeline=42,env in (prod,staging),!draft".
+// Each requirement is one of key=value (or key==value), key!=value,
+// key in (a,b), key notin (a,b), key to require the key is set, and !key to
+// require it isn't.
+func parseSelector(s string) (selector, error) {
+	result := selector{}
+	for _, part := range splitRequirements(s) {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			if strings.TrimSpace(s) == "" {
+				continue
+			}
+			return nil, fmt.Errorf("empty requirement in selector %q", s)
+		}
+		r, err := parseRequirement(part)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, r)
+	}
+	return result, nil
+}
+
+// splitRequirements splits s on the commas that aren't in a set of values
+func splitRequirements(s string) []string {
+	parts := []string{}
+	depth := 0
+	start := 0
+	for i, c := range s {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				parts = append(parts, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, s[start:])
+}
+
+func parseRequirement(part string) (requirement, error) {
+	if strings.HasPrefix(part, "!") {
+		key := strings.TrimSpace(part[1:])
+		if !validKey(key) {
+			return requirement{}, fmt.Errorf("invalid key in requirement %q", part)
+		}
+		return requirement{key: key, operator: doesNotExist}, nil
+	}
+
+	if i := strings.Index(part, "="); i >= 0 {
+		key, value := part[:i], part[i+1:]
+		op := equals
+		if strings.HasSuffix(key, "!") {
+			key = key[:len(key)-1]
+			op = notEquals
+		} else if strings.HasPrefix(value, "=") {
+			value = value[1:]
+		}
+		key = strings.TrimSpace(key)
+		value = strings.TrimSpace(value)
+		if !validKey(key) {
+			return requirement{}, fmt.Errorf("invalid key in requirement %q", part)
+		}
+		if !validValue(value) {
+			return requirement{}, fmt.Errorf("invalid value in requirement %q", part)
+		}
+		return requirement{key: key, operator: op, values: []string{value}}, nil
+	}
+
+	fields := strings.Fields(part)
+	if len(fields) == 1 {
+		if !validKey(fields[0]) {
+			return requirement{}, fmt.Errorf("invalid key in requirement %q", part)
+		}
+		return requirement{key: fields[0], operator: exists}, nil
+	}
+
+	// key in (a,b) or key notin (a,b), which may have no space before the (
+	key := fields[0]
+	rest := strings.TrimSpace(part[len(key):])
+	var op operator
+	switch {
+	case strings.HasPrefix(rest, "notin"):
+		op, rest = notIn, rest[len("notin"):]
+	case strings.HasPrefix(rest, "in"):
+		op, rest = in, rest[len("in"):]
+	default:
+		return requirement{}, fmt.Errorf("invalid requirement %q, expected in or notin after %s", part, key)
+	}
+	rest = strings.TrimSpace(rest)
+	if !validKey(key) || !strings.HasPrefix(rest, "(") || !strings.HasSuffix(rest, ")") {
+		return requirement{}, fmt.Errorf("invalid requirement %q, expected %s in (<values>)", part, key)
+	}
+	values := []string{}
+	for _, v := range strings.Split(rest[1:len(rest)-1], ",") {
+		v = strings.TrimSpace(v)
+		if !validValue(v) {
+			return requirement{}, fmt.Errorf("invalid value in requirement %q", part)
+		}
+		values = append(values, v)
+	}
+	return requirement{key: key, operator: op, values: values}, nil
+}
+
+func validKey(key string) bool {
+	return key != "" && !strings.ContainsAny(key, " \t\n!=(),")
+}
+
+func validValue(value string) bool {
+	return !strings.ContainsAny(value, "(),")
+}
+
+func (r requirement) matches(metadata map[string]string) bool {
+	value, ok := metadata[r.key]
+	switch r.operator {
+	case equals:
+		return ok && value == r.values[0]
+	case notEquals:
+		return !ok || value != r.values[0]
+	case in:
+		return ok && contains(r.values, value)
+	case notIn:
+		return !ok || !contains(r.values, value)
+	case exists:
+		return ok
+	case doesNotExist:
+		return !ok
+	}
+	return false
+}
+
+func (s selector) matches(metadata map[string]string) bool {
+	for _, r := range s {
+		if !r.matches(metadata) {
+			return false
+		}
+	}
+	return true
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
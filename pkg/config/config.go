@@ -1,7 +1,9 @@
 package config
 
 import (
+	"fmt"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -15,11 +17,80 @@ type (
 
 		DotmeshUpgradesURL string
 
+		// Scheduled backups of the KV store, to Dir or an S3 bucket, every
+		// IntervalSeconds, keeping the latest Retain of each node's. None
+		// are made unless Dir or S3Bucket is set.
+		Backups struct {
+			Dir             string     `envconfig:"DOTMESH_BACKUP_DIR"`
+			S3Bucket        string     `envconfig:"DOTMESH_BACKUP_S3_BUCKET"`
+			S3Prefix        string     `envconfig:"DOTMESH_BACKUP_S3_PREFIX"`
+			S3Endpoint      string     `envconfig:"DOTMESH_BACKUP_S3_ENDPOINT"`
+			S3KeyID         string     `envconfig:"DOTMESH_BACKUP_S3_KEY_ID"`
+			S3SecretKey     string     `envconfig:"DOTMESH_BACKUP_S3_SECRET_KEY"`
+			IntervalSeconds DefaultInt `default:"3600" envconfig:"DOTMESH_BACKUP_INTERVAL_SECONDS"`
+			Retain          DefaultInt `default:"24" envconfig:"DOTMESH_BACKUP_RETAIN"`
+		}
+
+		// Where keys for encrypted dots are read from, if they haven't been
+		// given to the server: <KeyDir>/<namespace>/<name>.key for a dot, or
+		// <KeyDir>/<namespace>.key for every dot in a namespace, each holding
+		// 64 hex digits
+		Encryption struct {
+			KeyDir string `envconfig:"DOTMESH_ENCRYPTION_KEY_DIR"`
+		}
+
+		// Where dots are kept: "zfs" for the pool, or "btrfs" or "directory"
+		// for subvolumes or plain directories under Dir
+		Filesystem struct {
+			Backend string `default:"zfs" envconfig:"DOTMESH_FILESYSTEM_BACKEND"`
+			Dir     string `envconfig:"DOTMESH_FILESYSTEM_DIR"`
+		}
+
+		// Identity providers users can log in with instead of a password
+		// dotmesh keeps, which make them a user on their first login: an
+		// LDAP directory they bind to as LDAPUserDN with %s replaced by their
+		// username, e.g. "uid=%s,ou=people,dc=example,dc=com", and an OpenID
+		// Connect issuer whose ID tokens for OIDCClientID they present.
+		// Members of the groups in GroupNamespaces administer the namespaces
+		// they're mapped to, e.g. DOTMESH_GROUP_NAMESPACES=data:datateam.
+		Identity struct {
+			LDAPURL            string            `envconfig:"DOTMESH_LDAP_URL"`
+			LDAPUserDN         string            `envconfig:"DOTMESH_LDAP_USER_DN"`
+			LDAPGroupAttribute string            `default:"memberOf" envconfig:"DOTMESH_LDAP_GROUP_ATTRIBUTE"`
+			OIDCIssuer         string            `envconfig:"DOTMESH_OIDC_ISSUER"`
+			OIDCClientID       string            `envconfig:"DOTMESH_OIDC_CLIENT_ID"`
+			OIDCUsernameClaim  string            `default:"preferred_username" envconfig:"DOTMESH_OIDC_USERNAME_CLAIM"`
+			OIDCGroupsClaim    string            `default:"groups" envconfig:"DOTMESH_OIDC_GROUPS_CLAIM"`
+			GroupNamespaces    map[string]string `envconfig:"DOTMESH_GROUP_NAMESPACES"`
+		}
+
+		// Labels for this node, matched by the node selectors of placement
+		// policies, e.g. DOTMESH_NODE_LABELS=zone=eu-1,disk=ssd
+		NodeLabels Labels `envconfig:"DOTMESH_NODE_LABELS"`
+
 		PollDirty struct {
 			SuccessTimeout DefaultDuration `default:"1s" envconfig:"POLL_DIRTY_SUCCESS_TIMEOUT"`
 			ErrorTimeout   DefaultDuration `default:"1s" envconfig:"POLL_DIRTY_ERROR_TIMEOUT"`
 		}
 
+		// Keys that secrets in the KV store are encrypted with, base64
+		// encoded and separated by commas or newlines, given directly or in a
+		// file. The first encrypts; the rest only decrypt, for while a key is
+		// being rotated. Secrets are kept in the clear without any.
+		Secrets struct {
+			Key     string `envconfig:"DOTMESH_SECRETS_KEY"`
+			KeyFile string `envconfig:"DOTMESH_SECRETS_KEY_FILE"`
+		}
+
+		// How many pushes and pulls may run at once, across the cluster and
+		// with any one other cluster or S3 bucket; more wait in a queue. 0,
+		// the default, means no limit. Every node should have the same
+		// limits.
+		Transfers struct {
+			MaxConcurrent        DefaultInt `default:"0" envconfig:"DOTMESH_MAX_CONCURRENT_TRANSFERS"`
+			MaxConcurrentPerPeer DefaultInt `default:"0" envconfig:"DOTMESH_MAX_CONCURRENT_TRANSFERS_PER_PEER"`
+		}
+
 		Upgrades struct {
 			URL             string     `envconfig:"DOTMESH_UPGRADES_URL"`
 			IntervalSeconds DefaultInt `default:"300" envconfig:"DOTMESH_UPGRADES_INTERVAL_SECONDS"`
@@ -82,3 +153,23 @@ func (b *DefaultInt) Decode(value string) error {
 	*b = DefaultInt(i)
 	return nil
 }
+
+// Labels are written as <label>=<value> pairs separated by commas, like the
+// node selectors of placement policies
+type Labels map[string]string
+
+func (l *Labels) Decode(value string) error {
+	labels := Labels{}
+	for _, pair := range strings.Split(value, ",") {
+		if pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return fmt.Errorf("invalid label %q, expected <label>=<value>", pair)
+		}
+		labels[parts[0]] = parts[1]
+	}
+	*l = labels
+	return nil
+}
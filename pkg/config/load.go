@@ -1,6 +1,7 @@
 package config
 
 import (
+	"fmt"
 	"time"
 
 	"github.com/joho/godotenv"
@@ -26,6 +27,24 @@ func Load() (Config, error) {
 	if config.PollDirty.ErrorTimeout < DefaultDuration(time.Second) {
 		config.PollDirty.ErrorTimeout = DefaultDuration(time.Second)
 	}
+	if config.Backups.Dir != "" && config.Backups.S3Bucket != "" {
+		return config, fmt.Errorf("DOTMESH_BACKUP_DIR and DOTMESH_BACKUP_S3_BUCKET can't both be set")
+	}
+	if config.Backups.IntervalSeconds < 60 {
+		config.Backups.IntervalSeconds = 60
+	}
+	if config.Backups.Retain < 1 {
+		config.Backups.Retain = 1
+	}
+	switch config.Filesystem.Backend {
+	case "zfs":
+	case "btrfs", "directory":
+		if config.Filesystem.Dir == "" {
+			return config, fmt.Errorf("DOTMESH_FILESYSTEM_DIR must be set for the %s backend", config.Filesystem.Backend)
+		}
+	default:
+		return config, fmt.Errorf("unknown DOTMESH_FILESYSTEM_BACKEND %q, expected zfs, btrfs or directory", config.Filesystem.Backend)
+	}
 	return config, err
 }
 
@@ -31,3 +31,56 @@ func TestLoadInterval(t *testing.T) {
 		t.Errorf("expected 0, got: %d", int(cfg.Upgrades.IntervalSeconds))
 	}
 }
+
+func TestLoadFilesystemBackend(t *testing.T) {
+	defer os.Unsetenv("DOTMESH_FILESYSTEM_BACKEND")
+	defer os.Unsetenv("DOTMESH_FILESYSTEM_DIR")
+
+	cfg, err := Load()
+	if err != nil {
+		t.Errorf("failed to load: %s", err)
+	}
+	if cfg.Filesystem.Backend != "zfs" {
+		t.Errorf("expected zfs by default, got: %s", cfg.Filesystem.Backend)
+	}
+
+	os.Setenv("DOTMESH_FILESYSTEM_BACKEND", "btrfs")
+	_, err = Load()
+	if err == nil {
+		t.Errorf("expected btrfs without a directory to be an error")
+	}
+
+	os.Setenv("DOTMESH_FILESYSTEM_DIR", "/var/lib/dotmesh")
+	cfg, err = Load()
+	if err != nil {
+		t.Errorf("failed to load: %s", err)
+	}
+	if cfg.Filesystem.Backend != "btrfs" || cfg.Filesystem.Dir != "/var/lib/dotmesh" {
+		t.Errorf("expected btrfs in /var/lib/dotmesh, got: %+v", cfg.Filesystem)
+	}
+
+	os.Setenv("DOTMESH_FILESYSTEM_BACKEND", "ext4")
+	_, err = Load()
+	if err == nil {
+		t.Errorf("expected an unknown backend to be an error")
+	}
+}
+
+func TestLoadNodeLabels(t *testing.T) {
+	defer os.Unsetenv("DOTMESH_NODE_LABELS")
+
+	os.Setenv("DOTMESH_NODE_LABELS", "zone=eu-1,disk=ssd")
+	cfg, err := Load()
+	if err != nil {
+		t.Errorf("failed to load: %s", err)
+	}
+	if len(cfg.NodeLabels) != 2 || cfg.NodeLabels["zone"] != "eu-1" || cfg.NodeLabels["disk"] != "ssd" {
+		t.Errorf("expected zone=eu-1 and disk=ssd, got: %v", cfg.NodeLabels)
+	}
+
+	os.Setenv("DOTMESH_NODE_LABELS", "zone:eu-1")
+	_, err = Load()
+	if err == nil {
+		t.Errorf("expected a label without = to be an error")
+	}
+}
@@ -2,6 +2,7 @@ package crypto
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
 	"crypto/subtle"
 	"encoding/base32"
 	"fmt"
@@ -86,3 +87,52 @@ func GenerateAPIKey() (string, error) {
 
 	return base32.StdEncoding.EncodeToString(apiKeyBytes), nil
 }
+
+// API keys are hashed for keeping like passwords are, but with a fast hash:
+// they're random and long enough not to need a slow one, and they're checked
+// on every request. The first apiKeyPrefixLength characters are kept in the
+// clear too, so that a key can be recognised, and most wrong keys turned
+// away, without hashing.
+const apiKeyPrefixLength = 8
+
+// HashAPIKey - hashes an API key, returning its lookup prefix and the salted
+// hash to keep instead of it
+func HashAPIKey(apiKey string) (string, []byte, error) {
+	if apiKey == "" {
+		return "", nil, fmt.Errorf("API key cannot be empty")
+	}
+	salt := make([]byte, saltBytes)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", nil, err
+	}
+	return APIKeyPrefix(apiKey), append(salt, hashAPIKey(salt, apiKey)...), nil
+}
+
+// APIKeyPrefix - the part of an API key that's kept in the clear
+func APIKeyPrefix(apiKey string) string {
+	if len(apiKey) < apiKeyPrefixLength {
+		return apiKey
+	}
+	return apiKey[:apiKeyPrefixLength]
+}
+
+// APIKeyMatches - checks whether the supplied API key is the one HashAPIKey
+// returned prefix and hashed for
+func APIKeyMatches(prefix string, hashed []byte, suppliedAPIKey string) bool {
+	if len(hashed) <= saltBytes || suppliedAPIKey == "" {
+		return false
+	}
+	if subtle.ConstantTimeCompare([]byte(prefix), []byte(APIKeyPrefix(suppliedAPIKey))) != 1 {
+		return false
+	}
+	salt := hashed[:saltBytes]
+	return subtle.ConstantTimeCompare(hashAPIKey(salt, suppliedAPIKey), hashed[saltBytes:]) == 1
+}
+
+func hashAPIKey(salt []byte, apiKey string) []byte {
+	h := sha256.New()
+	h.Write(salt)
+	h.Write([]byte(apiKey))
+	return h.Sum(nil)
+}
@@ -84,3 +84,35 @@ func TestGenerateAPIKey(t *testing.T) {
 		t.Errorf("key is empty")
 	}
 }
+
+func TestHashAPIKey(t *testing.T) {
+	k, err := GenerateAPIKey()
+	if err != nil {
+		t.Fatalf("failed to gen key: %s", err)
+	}
+	prefix, h, err := HashAPIKey(k)
+	if err != nil {
+		t.Fatalf("failed to hash key: %s", err)
+	}
+
+	if prefix != k[:8] {
+		t.Errorf("unexpected prefix %s of %s", prefix, k)
+	}
+	if !APIKeyMatches(prefix, h, k) {
+		t.Errorf("API key should have matched")
+	}
+
+	other, err := GenerateAPIKey()
+	if err != nil {
+		t.Fatalf("failed to gen key: %s", err)
+	}
+	if APIKeyMatches(prefix, h, other) {
+		t.Errorf("another API key should not match!")
+	}
+	if APIKeyMatches(prefix, h, prefix+other[8:]) {
+		t.Errorf("another API key with the same prefix should not match!")
+	}
+	if APIKeyMatches(prefix, h, "") {
+		t.Errorf("an empty API key should not match!")
+	}
+}
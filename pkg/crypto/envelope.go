@@ -0,0 +1,263 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// Envelope encrypted values look like
+// "enc:v1:<key id>:<wrapped data key>:<ciphertext>": each value is encrypted
+// with a data key of its own, which is encrypted ("wrapped") with one of the
+// keyring's keys. The key id says which.
+const (
+	envelopePrefix  = "enc:v1:"
+	keyringKeyBytes = 32
+)
+
+// Keyring holds the keys that secrets are encrypted with at rest. The first
+// key encrypts; all of them decrypt, so a key is rotated by putting a new one
+// first and rewrapping whatever was encrypted with the old one.
+//
+// A nil Keyring leaves secrets in the clear.
+type Keyring struct {
+	keys []keyringKey
+}
+
+type keyringKey struct {
+	id   string
+	aead cipher.AEAD
+}
+
+// NewKeyring makes a keyring of 32 byte keys, the first of which encrypts
+func NewKeyring(keys [][]byte) (*Keyring, error) {
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("a keyring needs at least one key")
+	}
+	k := &Keyring{}
+	for i, key := range keys {
+		if len(key) != keyringKeyBytes {
+			return nil, fmt.Errorf("key %d is %d bytes, keys must be %d", i+1, len(key), keyringKeyBytes)
+		}
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(key)
+		k.keys = append(k.keys, keyringKey{id: hex.EncodeToString(sum[:4]), aead: aead})
+	}
+	return k, nil
+}
+
+// LoadKeyring makes a keyring from base64 encoded keys, separated by commas
+// or newlines, given directly or in a file. It returns nil if there aren't
+// any.
+func LoadKeyring(keys, keyFile string) (*Keyring, error) {
+	if keyFile != "" {
+		data, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read secrets key file: %s", err)
+		}
+		keys = keys + "\n" + string(data)
+	}
+	decoded := [][]byte{}
+	for _, encoded := range strings.FieldsFunc(keys, func(r rune) bool { return r == ',' || r == '\n' }) {
+		encoded = strings.TrimSpace(encoded)
+		if encoded == "" {
+			continue
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("secrets keys must be base64 encoded: %s", err)
+		}
+		decoded = append(decoded, key)
+	}
+	if len(decoded) == 0 {
+		return nil, nil
+	}
+	return NewKeyring(decoded)
+}
+
+// GenerateKeyringKey makes a new random key, base64 encoded as LoadKeyring
+// expects
+func GenerateKeyringKey() (string, error) {
+	key := make([]byte, keyringKeyBytes)
+	_, err := rand.Read(key)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+// IsEncrypted says whether value was encrypted by a keyring
+func IsEncrypted(value string) bool {
+	return strings.HasPrefix(value, envelopePrefix)
+}
+
+// Encrypt encrypts value with the keyring's first key. Empty values, and any
+// value if there's no keyring, are left as they are.
+func (k *Keyring) Encrypt(value string) (string, error) {
+	if k == nil || value == "" {
+		return value, nil
+	}
+	if IsEncrypted(value) {
+		// encrypting twice would need decrypting twice
+		var err error
+		value, err = k.Decrypt(value)
+		if err != nil {
+			return "", err
+		}
+	}
+	key := k.keys[0]
+
+	dataKey := make([]byte, keyringKeyBytes)
+	_, err := rand.Read(dataKey)
+	if err != nil {
+		return "", err
+	}
+	wrapped, err := seal(key.aead, dataKey)
+	if err != nil {
+		return "", err
+	}
+	dataAEAD, err := newAEAD(dataKey)
+	if err != nil {
+		return "", err
+	}
+	ciphertext, err := seal(dataAEAD, []byte(value))
+	if err != nil {
+		return "", err
+	}
+	return envelopePrefix + key.id + ":" +
+		base64.RawURLEncoding.EncodeToString(wrapped) + ":" +
+		base64.RawURLEncoding.EncodeToString(ciphertext), nil
+}
+
+// Decrypt decrypts a value encrypted with any of the keyring's keys. Values
+// that aren't encrypted, from before there was a keyring, are returned as
+// they are.
+func (k *Keyring) Decrypt(value string) (string, error) {
+	if !IsEncrypted(value) {
+		return value, nil
+	}
+	if k == nil {
+		return "", fmt.Errorf("can't decrypt a secret without the secrets key, set DOTMESH_SECRETS_KEY or DOTMESH_SECRETS_KEY_FILE")
+	}
+	shrapnel := strings.Split(strings.TrimPrefix(value, envelopePrefix), ":")
+	if len(shrapnel) != 3 {
+		return "", fmt.Errorf("malformed encrypted secret")
+	}
+	var key *keyringKey
+	for i := range k.keys {
+		if k.keys[i].id == shrapnel[0] {
+			key = &k.keys[i]
+		}
+	}
+	if key == nil {
+		return "", fmt.Errorf("secret was encrypted with key %s, which isn't in the keyring", shrapnel[0])
+	}
+	wrapped, err := base64.RawURLEncoding.DecodeString(shrapnel[1])
+	if err != nil {
+		return "", fmt.Errorf("malformed encrypted secret: %s", err)
+	}
+	ciphertext, err := base64.RawURLEncoding.DecodeString(shrapnel[2])
+	if err != nil {
+		return "", fmt.Errorf("malformed encrypted secret: %s", err)
+	}
+	dataKey, err := open(key.aead, wrapped)
+	if err != nil {
+		return "", err
+	}
+	dataAEAD, err := newAEAD(dataKey)
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := open(dataAEAD, ciphertext)
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// NeedsRewrap says whether value should be encrypted again: because it's in
+// the clear, or encrypted with a key that isn't the keyring's first
+func (k *Keyring) NeedsRewrap(value string) bool {
+	if k == nil || value == "" {
+		return false
+	}
+	return !strings.HasPrefix(value, envelopePrefix+k.keys[0].id+":")
+}
+
+// EncryptWithPassphrase encrypts data with a key derived from passphrase,
+// for keeping secrets in files
+func EncryptWithPassphrase(passphrase string, data []byte) ([]byte, error) {
+	salt := make([]byte, saltBytes)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+	key, err := hash(salt, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := seal(aead, data)
+	if err != nil {
+		return nil, err
+	}
+	return append(salt, sealed...), nil
+}
+
+// DecryptWithPassphrase decrypts what EncryptWithPassphrase encrypted
+func DecryptWithPassphrase(passphrase string, data []byte) ([]byte, error) {
+	if len(data) < saltBytes {
+		return nil, fmt.Errorf("encrypted data is too short")
+	}
+	key, err := hash(data[:saltBytes], passphrase)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := open(aead, data[saltBytes:])
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt, is the passphrase right? %s", err)
+	}
+	return plaintext, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts plaintext with a random nonce, which it puts in front
+func seal(aead cipher.AEAD, plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func open(aead cipher.AEAD, sealed []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("encrypted data is too short")
+	}
+	nonce := sealed[:aead.NonceSize()]
+	return aead.Open(nil, nonce, sealed[aead.NonceSize():], nil)
+}
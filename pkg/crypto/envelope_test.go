@@ -0,0 +1,183 @@
+package crypto
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func mustKeyring(t *testing.T, keys ...string) *Keyring {
+	k, err := LoadKeyring(strings.Join(keys, ","), "")
+	if err != nil {
+		t.Fatalf("failed to load keyring: %s", err)
+	}
+	return k
+}
+
+func mustKey(t *testing.T) string {
+	key, err := GenerateKeyringKey()
+	if err != nil {
+		t.Fatalf("failed to gen key: %s", err)
+	}
+	return key
+}
+
+func TestKeyringEncrypt(t *testing.T) {
+	k := mustKeyring(t, mustKey(t))
+
+	encrypted, err := k.Encrypt("very secret")
+	if err != nil {
+		t.Fatalf("failed to encrypt: %s", err)
+	}
+	if !IsEncrypted(encrypted) || strings.Contains(encrypted, "very secret") {
+		t.Errorf("secret wasn't encrypted: %s", encrypted)
+	}
+	again, err := k.Encrypt("very secret")
+	if err != nil {
+		t.Fatalf("failed to encrypt: %s", err)
+	}
+	if again == encrypted {
+		t.Errorf("encrypting twice should give different ciphertexts")
+	}
+
+	decrypted, err := k.Decrypt(encrypted)
+	if err != nil {
+		t.Fatalf("failed to decrypt: %s", err)
+	}
+	if decrypted != "very secret" {
+		t.Errorf("decrypted %q, expected %q", decrypted, "very secret")
+	}
+
+	// encrypting what's encrypted shouldn't need decrypting twice
+	twice, err := k.Encrypt(encrypted)
+	if err != nil {
+		t.Fatalf("failed to encrypt: %s", err)
+	}
+	decrypted, err = k.Decrypt(twice)
+	if err != nil || decrypted != "very secret" {
+		t.Errorf("decrypted %q (%v), expected %q", decrypted, err, "very secret")
+	}
+
+	tampered := encrypted[:len(encrypted)-2] + "AA"
+	if tampered == encrypted {
+		tampered = encrypted[:len(encrypted)-2] + "BB"
+	}
+	if _, err = k.Decrypt(tampered); err == nil {
+		t.Errorf("expected a tampered secret not to decrypt")
+	}
+}
+
+func TestKeyringCleartext(t *testing.T) {
+	k := mustKeyring(t, mustKey(t))
+	// from before there was a keyring
+	decrypted, err := k.Decrypt("legacy")
+	if err != nil || decrypted != "legacy" {
+		t.Errorf("decrypted %q (%v), expected %q", decrypted, err, "legacy")
+	}
+	if !k.NeedsRewrap("legacy") {
+		t.Errorf("a secret in the clear should need rewrapping")
+	}
+
+	var none *Keyring
+	encrypted, err := none.Encrypt("secret")
+	if err != nil || encrypted != "secret" {
+		t.Errorf("without a keyring secrets should stay in the clear, got %q (%v)", encrypted, err)
+	}
+	if none.NeedsRewrap("secret") {
+		t.Errorf("without a keyring nothing needs rewrapping")
+	}
+	encrypted, err = k.Encrypt("secret")
+	if err != nil {
+		t.Fatalf("failed to encrypt: %s", err)
+	}
+	if _, err = none.Decrypt(encrypted); err == nil {
+		t.Errorf("expected an error decrypting without a keyring")
+	}
+}
+
+func TestKeyringRotation(t *testing.T) {
+	oldKey, newKey := mustKey(t), mustKey(t)
+	old := mustKeyring(t, oldKey)
+	rotated := mustKeyring(t, newKey, oldKey)
+
+	encrypted, err := old.Encrypt("secret")
+	if err != nil {
+		t.Fatalf("failed to encrypt: %s", err)
+	}
+	if old.NeedsRewrap(encrypted) {
+		t.Errorf("a secret encrypted with the current key shouldn't need rewrapping")
+	}
+	if !rotated.NeedsRewrap(encrypted) {
+		t.Errorf("a secret encrypted with an old key should need rewrapping")
+	}
+
+	decrypted, err := rotated.Decrypt(encrypted)
+	if err != nil || decrypted != "secret" {
+		t.Errorf("decrypted %q (%v) with the old key, expected %q", decrypted, err, "secret")
+	}
+	rewrapped, err := rotated.Encrypt(encrypted)
+	if err != nil {
+		t.Fatalf("failed to rewrap: %s", err)
+	}
+	if rotated.NeedsRewrap(rewrapped) {
+		t.Errorf("a rewrapped secret shouldn't need rewrapping")
+	}
+	if _, err = old.Decrypt(rewrapped); err == nil {
+		t.Errorf("expected the old keyring not to decrypt a secret rewrapped with the new key")
+	}
+}
+
+func TestLoadKeyring(t *testing.T) {
+	k, err := LoadKeyring("", "")
+	if err != nil || k != nil {
+		t.Errorf("expected no keyring without keys, got %v (%v)", k, err)
+	}
+
+	_, err = LoadKeyring(base64.StdEncoding.EncodeToString([]byte("too short")), "")
+	if err == nil {
+		t.Errorf("expected an error for a short key")
+	}
+	_, err = LoadKeyring("not base64!", "")
+	if err == nil {
+		t.Errorf("expected an error for a key that isn't base64")
+	}
+
+	f, err := ioutil.TempFile("", "secrets-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	first, second := mustKey(t), mustKey(t)
+	_, err = f.WriteString(first + "\n" + second + "\n")
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromFile, err := LoadKeyring("", f.Name())
+	if err != nil {
+		t.Fatalf("failed to load keyring from a file: %s", err)
+	}
+	encrypted, err := fromFile.Encrypt("secret")
+	if err != nil {
+		t.Fatalf("failed to encrypt: %s", err)
+	}
+	if mustKeyring(t, first).NeedsRewrap(encrypted) {
+		t.Errorf("the first key in the file should encrypt")
+	}
+}
+
+func TestEncryptWithPassphrase(t *testing.T) {
+	encrypted, err := EncryptWithPassphrase("correct horse", []byte("secret"))
+	if err != nil {
+		t.Fatalf("failed to encrypt: %s", err)
+	}
+	decrypted, err := DecryptWithPassphrase("correct horse", encrypted)
+	if err != nil || string(decrypted) != "secret" {
+		t.Errorf("decrypted %q (%v), expected %q", decrypted, err, "secret")
+	}
+	if _, err = DecryptWithPassphrase("battery staple", encrypted); err == nil {
+		t.Errorf("expected the wrong passphrase not to decrypt")
+	}
+}
@@ -0,0 +1,290 @@
+// Package diff compares two directory trees, such as a pair of mounted
+// commits, file by file.
+package diff
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dotmesh-oss/dotmesh/pkg/types"
+
+	securejoin "github.com/cyphar/filepath-securejoin"
+)
+
+// MaxTextBytes - files bigger than this are reported as changed without a
+// unified diff
+const MaxTextBytes = 1024 * 1024
+
+// how much of a file we look at to decide whether it's text
+const sniffBytes = 8000
+
+type Options struct {
+	// Only compare under this path, relative to the roots
+	Path string
+	// Include unified diffs of text files
+	Content bool
+}
+
+type entry struct {
+	size    int64
+	modTime time.Time
+	mode    os.FileMode
+}
+
+// scan lists the files (but not directories) under root/path, keyed on their
+// slash separated path relative to root
+func scan(root, path string) (map[string]entry, error) {
+	entries := map[string]entry{}
+	if root == "" {
+		return entries, nil
+	}
+	// don't let symlinks in path take us out of the tree
+	start, err := securejoin.SecureJoin(root, path)
+	if err != nil {
+		return nil, err
+	}
+	err = filepath.Walk(start, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && p == start {
+				// the path doesn't exist on this side
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		entries[filepath.ToSlash(rel)] = entry{
+			size:    info.Size(),
+			modTime: info.ModTime().UTC(),
+			mode:    info.Mode(),
+		}
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// sameContent says whether name has the same content on both sides, so that
+// a file that was only touched, or rewritten as it was, isn't reported
+func sameContent(fromRoot, toRoot, name string, from, to entry) (bool, error) {
+	if from == to {
+		return true, nil
+	}
+	if from.mode != to.mode || from.size != to.size {
+		return false, nil
+	}
+	fromPath := filepath.Join(fromRoot, filepath.FromSlash(name))
+	toPath := filepath.Join(toRoot, filepath.FromSlash(name))
+	switch {
+	case from.mode&os.ModeSymlink != 0:
+		fromTarget, err := os.Readlink(fromPath)
+		if err != nil {
+			return false, err
+		}
+		toTarget, err := os.Readlink(toPath)
+		if err != nil {
+			return false, err
+		}
+		return fromTarget == toTarget, nil
+	case !from.mode.IsRegular():
+		// devices, pipes and sockets have nothing more to compare
+		return true, nil
+	}
+
+	fromFile, err := os.Open(fromPath)
+	if err != nil {
+		return false, err
+	}
+	defer fromFile.Close()
+	toFile, err := os.Open(toPath)
+	if err != nil {
+		return false, err
+	}
+	defer toFile.Close()
+
+	fromBuf := make([]byte, 32*1024)
+	toBuf := make([]byte, len(fromBuf))
+	for {
+		n, fromErr := readChunk(fromFile, fromBuf)
+		if fromErr != nil {
+			return false, fromErr
+		}
+		m, toErr := readChunk(toFile, toBuf)
+		if toErr != nil {
+			return false, toErr
+		}
+		if n != m || !bytes.Equal(fromBuf[:n], toBuf[:m]) {
+			return false, nil
+		}
+		if n < len(fromBuf) {
+			return true, nil
+		}
+	}
+}
+
+// readChunk fills buf unless it gets to the end of r first
+func readChunk(r io.Reader, buf []byte) (int, error) {
+	n, err := io.ReadFull(r, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	return n, err
+}
+
+func isText(content []byte) bool {
+	if len(content) > sniffBytes {
+		content = content[:sniffBytes]
+	}
+	return bytes.IndexByte(content, 0) == -1
+}
+
+type contentKind int
+
+const (
+	kindText contentKind = iota
+	kindBinary
+	kindTooLarge
+)
+
+// readText returns the content of a file if it's text and small enough to
+// diff. Anything but a regular file counts as binary.
+func readText(root, name string, e entry) (string, contentKind, error) {
+	if !e.mode.IsRegular() {
+		return "", kindBinary, nil
+	}
+	if e.size > MaxTextBytes {
+		return "", kindTooLarge, nil
+	}
+	content, err := ioutil.ReadFile(filepath.Join(root, filepath.FromSlash(name)))
+	if err != nil {
+		return "", kindBinary, err
+	}
+	if !isText(content) {
+		return "", kindBinary, nil
+	}
+	return string(content), kindText, nil
+}
+
+// Trees compares the files under fromRoot with those under toRoot, calling
+// emit in filename order for each one that was added, removed or modified.
+// Either root may be "" to stand for an empty tree.
+func Trees(fromRoot, toRoot string, opts Options, emit func(*types.CommitFileDiff) error) error {
+	path := strings.TrimPrefix(filepath.Clean("/"+filepath.ToSlash(opts.Path)), "/")
+
+	fromEntries, err := scan(fromRoot, path)
+	if err != nil {
+		return err
+	}
+	toEntries, err := scan(toRoot, path)
+	if err != nil {
+		return err
+	}
+
+	names := []string{}
+	for name := range fromEntries {
+		names = append(names, name)
+	}
+	for name := range toEntries {
+		if _, ok := fromEntries[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		from, inFrom := fromEntries[name]
+		to, inTo := toEntries[name]
+
+		d := &types.CommitFileDiff{Filename: name}
+		switch {
+		case inFrom && inTo:
+			same, err := sameContent(fromRoot, toRoot, name, from, to)
+			if err != nil {
+				return err
+			}
+			if same {
+				continue
+			}
+			d.Change = types.FileChangeModified
+		case inTo:
+			d.Change = types.FileChangeAdded
+		default:
+			d.Change = types.FileChangeRemoved
+		}
+		if inFrom {
+			d.FromSize = from.size
+			d.FromModified = from.modTime
+		}
+		if inTo {
+			d.ToSize = to.size
+			d.ToModified = to.modTime
+		}
+
+		if opts.Content {
+			err = addContent(d, fromRoot, toRoot, from, inFrom, to, inTo)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = emit(d)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func addContent(d *types.CommitFileDiff, fromRoot, toRoot string, from entry, inFrom bool, to entry, inTo bool) error {
+	var fromText, toText string
+	fromKind, toKind := kindText, kindText
+	var err error
+	if inFrom {
+		fromText, fromKind, err = readText(fromRoot, d.Filename, from)
+		if err != nil {
+			return err
+		}
+	}
+	if inTo {
+		toText, toKind, err = readText(toRoot, d.Filename, to)
+		if err != nil {
+			return err
+		}
+	}
+	if fromKind == kindBinary || toKind == kindBinary {
+		d.Binary = true
+		return nil
+	}
+	if fromKind == kindTooLarge || toKind == kindTooLarge {
+		d.TooLarge = true
+		return nil
+	}
+
+	fromName, toName := "a/"+d.Filename, "b/"+d.Filename
+	if !inFrom {
+		fromName = "/dev/null"
+	}
+	if !inTo {
+		toName = "/dev/null"
+	}
+	unified, ok := Unified(fromName, toName, fromText, toText, DefaultContext)
+	if !ok {
+		d.TooLarge = true
+		return nil
+	}
+	d.Unified = unified
+	return nil
+}
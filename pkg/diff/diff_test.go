@@ -0,0 +1,157 @@
+package diff
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dotmesh-oss/dotmesh/pkg/types"
+)
+
+func writeTree(t *testing.T, files map[string]string) string {
+	root, err := ioutil.TempDir("", "diff-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		p := filepath.Join(root, name)
+		err = os.MkdirAll(filepath.Dir(p), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(p, []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+func collect(t *testing.T, from, to string, opts Options) []types.CommitFileDiff {
+	result := []types.CommitFileDiff{}
+	err := Trees(from, to, opts, func(d *types.CommitFileDiff) error {
+		result = append(result, *d)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to diff trees: %s", err)
+	}
+	return result
+}
+
+func TestTrees(t *testing.T) {
+	from := writeTree(t, map[string]string{
+		"same.txt":        "same\n",
+		"changed.txt":     "before\n",
+		"removed.txt":     "gone\n",
+		"data/binary.bin": "a\x00b",
+	})
+	defer os.RemoveAll(from)
+	to := writeTree(t, map[string]string{
+		"same.txt":        "same\n",
+		"changed.txt":     "after, and longer\n",
+		"added.txt":       "new\n",
+		"data/binary.bin": "a\x00bc",
+	})
+	defer os.RemoveAll(to)
+
+	// give unchanged files the same times on both sides
+	for _, name := range []string{"same.txt"} {
+		info, err := os.Stat(filepath.Join(from, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(filepath.Join(to, name), info.ModTime(), info.ModTime())
+	}
+
+	diffs := collect(t, from, to, Options{Content: true})
+	if len(diffs) != 4 {
+		t.Fatalf("expected 4 changes, got %#v", diffs)
+	}
+
+	expected := []struct {
+		name   string
+		change types.FileChange
+	}{
+		{"added.txt", types.FileChangeAdded},
+		{"changed.txt", types.FileChangeModified},
+		{"data/binary.bin", types.FileChangeModified},
+		{"removed.txt", types.FileChangeRemoved},
+	}
+	for i, e := range expected {
+		if diffs[i].Filename != e.name || diffs[i].Change != e.change {
+			t.Errorf("expected %s %s, got %s %s", e.change, e.name, diffs[i].Change, diffs[i].Filename)
+		}
+	}
+
+	changed := diffs[1]
+	if changed.SizeDelta() != 11 {
+		t.Errorf("expected changed.txt to grow by 11 bytes, got %d", changed.SizeDelta())
+	}
+	if changed.Unified == "" {
+		t.Errorf("expected a text diff for changed.txt")
+	}
+	if !diffs[2].Binary || diffs[2].Unified != "" {
+		t.Errorf("expected binary.bin to be binary without a text diff, got %#v", diffs[2])
+	}
+
+	// only under a path, and without content
+	diffs = collect(t, from, to, Options{Path: "/data/"})
+	if len(diffs) != 1 || diffs[0].Filename != "data/binary.bin" || diffs[0].Binary {
+		t.Errorf("unexpected diffs under data: %#v", diffs)
+	}
+
+	// paths can't escape the roots
+	diffs = collect(t, from, to, Options{Path: "../../.."})
+	if len(diffs) != 4 {
+		t.Errorf("expected ../../.. to mean the root, got %#v", diffs)
+	}
+
+	// a path missing on one side
+	diffs = collect(t, from, to, Options{Path: "added.txt"})
+	if len(diffs) != 1 || diffs[0].Change != types.FileChangeAdded {
+		t.Errorf("unexpected diffs for added.txt: %#v", diffs)
+	}
+}
+
+func TestTreesEmptySide(t *testing.T) {
+	to := writeTree(t, map[string]string{"a.txt": "a\n"})
+	defer os.RemoveAll(to)
+
+	diffs := collect(t, "", to, Options{Content: true})
+	if len(diffs) != 1 || diffs[0].Change != types.FileChangeAdded {
+		t.Fatalf("unexpected diffs: %#v", diffs)
+	}
+	if diffs[0].Unified == "" {
+		t.Errorf("expected a text diff for a new text file")
+	}
+}
+
+func TestTreesComparesContent(t *testing.T) {
+	from := writeTree(t, map[string]string{
+		"touched.txt":   "same\n",
+		"rewritten.txt": "abcd\n",
+	})
+	defer os.RemoveAll(from)
+	to := writeTree(t, map[string]string{
+		"touched.txt":   "same\n",
+		"rewritten.txt": "abce\n",
+	})
+	defer os.RemoveAll(to)
+
+	// only the modification times differ
+	later := time.Now().Add(time.Hour)
+	for _, name := range []string{"touched.txt", "rewritten.txt"} {
+		err := os.Chtimes(filepath.Join(to, name), later, later)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	diffs := collect(t, from, to, Options{})
+	if len(diffs) != 1 || diffs[0].Filename != "rewritten.txt" || diffs[0].Change != types.FileChangeModified {
+		t.Errorf("expected only rewritten.txt to have changed, got %#v", diffs)
+	}
+}
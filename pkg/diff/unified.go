@@ -0,0 +1,218 @@
+package diff
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// DefaultContext is how many unchanged lines surround each hunk, as with
+// diff -u
+const DefaultContext = 3
+
+type opKind int
+
+const (
+	opEqual opKind = iota
+	opDelete
+	opInsert
+)
+
+type op struct {
+	kind opKind
+	// line index in a (for opEqual and opDelete) and b (for opEqual and
+	// opInsert)
+	a, b int
+}
+
+// MaxEdits bounds the work (and memory, which grows with its square) spent
+// on a text diff; files further apart than this are reported without one.
+const MaxEdits = 2000
+
+// editScript finds a shortest edit script turning a into b, using Myers'
+// O((N+M)D) algorithm. It returns false if more than maxEdits lines would
+// have to change.
+func editScript(a, b []string, maxEdits int) ([]op, bool) {
+	n, m := len(a), len(b)
+	max := n + m
+	if max > maxEdits {
+		max = maxEdits
+	}
+	offset := max + 1
+	v := make([]int, 2*max+3)
+	// trace[d] holds v[-d-1..d+1] as it was before round d
+	trace := [][]int{}
+
+	done := false
+	for d := 0; d <= max && !done; d++ {
+		trace = append(trace, append([]int{}, v[offset-d-1:offset+d+2]...))
+
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				done = true
+				break
+			}
+		}
+	}
+	if !done {
+		return nil, false
+	}
+
+	// walk back through the trace to recover the path
+	ops := []op{}
+	x, y := n, m
+	for d := len(trace) - 1; d >= 0; d-- {
+		v := func(k int) int { return trace[d][k+d+1] }
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && v(k-1) < v(k+1)) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := v(prevK)
+		prevY := prevX - prevK
+
+		for x > prevX && y > prevY {
+			x--
+			y--
+			ops = append(ops, op{kind: opEqual, a: x, b: y})
+		}
+		if d > 0 {
+			if x == prevX {
+				y--
+				ops = append(ops, op{kind: opInsert, a: x, b: y})
+			} else {
+				x--
+				ops = append(ops, op{kind: opDelete, a: x, b: y})
+			}
+		}
+	}
+
+	for i, j := 0, len(ops)-1; i < j; i, j = i+1, j-1 {
+		ops[i], ops[j] = ops[j], ops[i]
+	}
+	return ops, true
+}
+
+// splitLines splits text into lines, keeping their newlines so that an
+// unterminated last line can be told apart
+func splitLines(text string) []string {
+	if text == "" {
+		return nil
+	}
+	lines := strings.SplitAfter(text, "\n")
+	if lines[len(lines)-1] == "" {
+		return lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// hunkRange formats one side of a hunk header; an empty range is given as
+// the line before it, as diff -u does
+func hunkRange(start, count int) string {
+	if count == 0 {
+		return fmt.Sprintf("%d,0", start)
+	}
+	if count == 1 {
+		return fmt.Sprintf("%d", start+1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, count)
+}
+
+// Unified returns the differences between from and to in unified diff
+// format, or "" if they're the same. It returns false if they're too
+// different for a text diff to be useful, see MaxEdits.
+func Unified(fromName, toName, from, to string, context int) (string, bool) {
+	a := splitLines(from)
+	b := splitLines(to)
+	ops, ok := editScript(a, b, MaxEdits)
+	if !ok {
+		return "", false
+	}
+
+	var out bytes.Buffer
+	writeLine := func(prefix, line string) {
+		out.WriteString(prefix)
+		out.WriteString(line)
+		if !strings.HasSuffix(line, "\n") {
+			out.WriteString("\n\\ No newline at end of file\n")
+		}
+	}
+
+	i := 0
+	for i < len(ops) {
+		// find the next change
+		for i < len(ops) && ops[i].kind == opEqual {
+			i++
+		}
+		if i == len(ops) {
+			break
+		}
+
+		start := i - context
+		if start < 0 {
+			start = 0
+		}
+		// extend the hunk until there's a long enough run of equal lines
+		end := i
+		for end < len(ops) {
+			if ops[end].kind != opEqual {
+				end++
+				continue
+			}
+			run := end
+			for run < len(ops) && ops[run].kind == opEqual {
+				run++
+			}
+			if run == len(ops) || run-end > 2*context {
+				end += context
+				if end > run {
+					end = run
+				}
+				break
+			}
+			end = run
+		}
+
+		aStart, bStart := ops[start].a, ops[start].b
+		aCount, bCount := 0, 0
+		for _, o := range ops[start:end] {
+			if o.kind != opInsert {
+				aCount++
+			}
+			if o.kind != opDelete {
+				bCount++
+			}
+		}
+
+		if out.Len() == 0 {
+			fmt.Fprintf(&out, "--- %s\n+++ %s\n", fromName, toName)
+		}
+		fmt.Fprintf(&out, "@@ -%s +%s @@\n", hunkRange(aStart, aCount), hunkRange(bStart, bCount))
+		for _, o := range ops[start:end] {
+			switch o.kind {
+			case opEqual:
+				writeLine(" ", a[o.a])
+			case opDelete:
+				writeLine("-", a[o.a])
+			case opInsert:
+				writeLine("+", b[o.b])
+			}
+		}
+		i = end
+	}
+	return out.String(), true
+}
@@ -0,0 +1,80 @@
+package diff
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestUnifiedSame(t *testing.T) {
+	out, ok := Unified("a/f", "b/f", "one\ntwo\n", "one\ntwo\n", DefaultContext)
+	if !ok || out != "" {
+		t.Errorf("expected no diff, got %q", out)
+	}
+}
+
+func TestUnifiedChange(t *testing.T) {
+	from := "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n"
+	to := "1\n2\n3\n4\nfive\n6\n7\n8\n9\n10\n"
+	out, ok := Unified("a/f", "b/f", from, to, DefaultContext)
+	if !ok {
+		t.Fatalf("expected a diff")
+	}
+	expected := `--- a/f
++++ b/f
+@@ -2,7 +2,7 @@
+ 2
+ 3
+ 4
+-5
++five
+ 6
+ 7
+ 8
+`
+	if out != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, out)
+	}
+}
+
+func TestUnifiedSeparateHunks(t *testing.T) {
+	lines := []string{}
+	for i := 0; i < 20; i++ {
+		lines = append(lines, fmt.Sprintf("line %d", i))
+	}
+	from := strings.Join(lines, "\n") + "\n"
+	lines[0] = "first"
+	lines[19] = "last"
+	to := strings.Join(lines, "\n") + "\n"
+
+	out, _ := Unified("a/f", "b/f", from, to, DefaultContext)
+	if strings.Count(out, "@@ -") != 2 {
+		t.Errorf("expected two hunks, got:\n%s", out)
+	}
+	if !strings.Contains(out, "@@ -1,4 +1,4 @@") || !strings.Contains(out, "@@ -17,4 +17,4 @@") {
+		t.Errorf("unexpected hunk headers:\n%s", out)
+	}
+}
+
+func TestUnifiedAddedFile(t *testing.T) {
+	out, _ := Unified("/dev/null", "b/f", "", "hello\nworld", DefaultContext)
+	expected := `--- /dev/null
++++ b/f
+@@ -0,0 +1,2 @@
++hello
++world
+\ No newline at end of file
+`
+	if out != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, out)
+	}
+}
+
+func TestUnifiedTooDifferent(t *testing.T) {
+	from := strings.Repeat("a\n", MaxEdits)
+	to := strings.Repeat("b\n", MaxEdits)
+	_, ok := Unified("a/f", "b/f", from, to, DefaultContext)
+	if ok {
+		t.Errorf("expected files with %d changed lines to be too different", 2*MaxEdits)
+	}
+}
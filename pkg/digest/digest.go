@@ -0,0 +1,113 @@
+// Package digest hashes the contents of a dot, so that the same tree of
+// files gives the same digest wherever it's checked out.
+package digest
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Prefix says which hash a digest was made with
+const Prefix = "sha256:"
+
+// MetadataKey is the commit metadata a commit's digest is kept in
+const MetadataKey = "content.digest"
+
+// Tree returns a Merkle style digest of everything under root: each file is
+// hashed with its permissions, each symlink with its target, and each
+// directory with the names and hashes of what's in it. Timestamps and
+// ownership don't count, nor does root itself, so a missing root digests the
+// same as an empty one. Devices, sockets and pipes are skipped, as they can't
+// be copied in or out of a dot anyway.
+func Tree(root string) (string, error) {
+	var sum []byte
+	_, err := os.Lstat(root)
+	if os.IsNotExist(err) {
+		sum, err = entries(root, nil)
+	} else if err == nil {
+		sum, err = directory(root)
+	}
+	if err != nil {
+		return "", err
+	}
+	return Prefix + hex.EncodeToString(sum), nil
+}
+
+func directory(path string) ([]byte, error) {
+	infos, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	return entries(path, infos)
+}
+
+// entries hashes a directory's contents, which ReadDir has already sorted by
+// name
+func entries(path string, infos []os.FileInfo) ([]byte, error) {
+	h := sha256.New()
+	for _, info := range infos {
+		sum, err := node(filepath.Join(path, info.Name()), info)
+		if err != nil {
+			return nil, err
+		}
+		if sum == nil {
+			continue
+		}
+		fmt.Fprintf(h, "%s\x00", info.Name())
+		h.Write(sum)
+	}
+	return h.Sum(nil), nil
+}
+
+func node(path string, info os.FileInfo) ([]byte, error) {
+	mode := info.Mode()
+	h := sha256.New()
+	switch {
+	case mode.IsDir():
+		sum, err := directory(path)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(h, "dir %o\x00", mode.Perm())
+		h.Write(sum)
+	case mode&os.ModeSymlink != 0:
+		target, err := os.Readlink(path)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(h, "link\x00%s", target)
+	case mode.IsRegular():
+		fmt.Fprintf(h, "file %o\x00", mode.Perm())
+		err := hashFile(h, path)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		log.WithField("path", path).Debugf("[digest] Skipping %s", mode.Type())
+		return nil, nil
+	}
+	return h.Sum(nil), nil
+}
+
+func hashFile(h hash.Hash, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	contents := sha256.New()
+	_, err = io.Copy(contents, f)
+	if err != nil {
+		return err
+	}
+	h.Write(contents.Sum(nil))
+	return nil
+}
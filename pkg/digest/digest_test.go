@@ -0,0 +1,86 @@
+package digest
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeTree(t *testing.T, root string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Join(root, "a", "b"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "a", "b", "c.txt"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "top.txt"), []byte("world"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("a/b/c.txt", filepath.Join(root, "link")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTree(t *testing.T) {
+	dir, err := ioutil.TempDir("", "digest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	one, two := filepath.Join(dir, "one"), filepath.Join(dir, "two")
+	writeTree(t, one)
+	writeTree(t, two)
+
+	d1, err := Tree(one)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d2, err := Tree(two)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d1 != d2 {
+		t.Errorf("expected identical trees to have the same digest, got %s and %s", d1, d2)
+	}
+
+	for _, change := range []func() error{
+		func() error { return ioutil.WriteFile(filepath.Join(two, "a", "b", "c.txt"), []byte("hellO"), 0644) },
+		func() error { return os.Chmod(filepath.Join(two, "top.txt"), 0644) },
+		func() error { return os.Rename(filepath.Join(two, "top.txt"), filepath.Join(two, "top2.txt")) },
+		func() error { return os.Mkdir(filepath.Join(two, "empty"), 0755) },
+	} {
+		if err := change(); err != nil {
+			t.Fatal(err)
+		}
+		d, err := Tree(two)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d == d2 {
+			t.Errorf("expected the digest to change")
+		}
+		d2 = d
+	}
+}
+
+func TestTreeMissingRoot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "digest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	empty, err := Tree(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	missing, err := Tree(filepath.Join(dir, "missing"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if empty != missing {
+		t.Errorf("expected a missing root to digest like an empty one, got %s and %s", empty, missing)
+	}
+}
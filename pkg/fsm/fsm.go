@@ -9,6 +9,7 @@ import (
 
 	"github.com/dotmesh-oss/dotmesh/pkg/config"
 	"github.com/dotmesh-oss/dotmesh/pkg/container"
+	"github.com/dotmesh-oss/dotmesh/pkg/digest"
 	"github.com/dotmesh-oss/dotmesh/pkg/metrics"
 	"github.com/dotmesh-oss/dotmesh/pkg/observer"
 	"github.com/dotmesh-oss/dotmesh/pkg/registry"
@@ -40,15 +41,10 @@ type FsConfig struct {
 
 	FilesystemMetadataTimeout int64
 
-	// zfs executable path
-	ZFSPath string
-	// zpool executable path
-	ZPoolPath string
-	// Previously known as main.MOUNT_ZFS
-	MountZFS string
-
-	// PoolName is a required
-	PoolName string
+	// ZFS is the storage backend, shared by every state machine so that
+	// what it keeps track of, such as when dots were last modified, is kept
+	// once
+	ZFS zfs.ZFS
 }
 
 type FSM interface {
@@ -96,16 +92,19 @@ type FSM interface {
 
 	// DumpState is used for diagnostics
 	DumpState() *FSMStateDump
+
+	// ControlTransfer cancels, pauses or resumes the transfer in progress
+	ControlTransfer(transferRequestId, action string) error
+
+	// RecordRegistryProperties keeps what the registry says about the
+	// filesystem with it on disk, if it's here
+	RecordRegistryProperties()
 }
 
 // NewFilesystemMachine - core functions used by files ending `state` which I couldn't think of a good place for.
 func NewFilesystemMachine(cfg *FsConfig) *FsMachine {
 	// initialize the FsMachine with a filesystem struct that has bare minimum
 	// information (just the filesystem id) required to get started
-	zfsInter, err := zfs.NewZFS(cfg.ZFSPath, cfg.ZPoolPath, cfg.PoolName, cfg.MountZFS)
-	if err != nil {
-		log.Fatalf("Failed initialising zfs interface, %s", err.Error())
-	}
 	return &FsMachine{
 		config: cfg.Config,
 		filesystem: &types.Filesystem{
@@ -158,7 +157,7 @@ func NewFilesystemMachine(cfg *FsConfig) *FsMachine {
 		transferUpdates: make(chan types.TransferUpdate),
 
 		filesystemMetadataTimeout: cfg.FilesystemMetadataTimeout,
-		zfs:                       zfsInter,
+		zfs:                       cfg.ZFS,
 	}
 }
 
@@ -475,8 +474,8 @@ func (f *FsMachine) updateEtcdAboutTransfers() error {
 			pollResult.Total = update.Changes.Total
 			pollResult.Size = update.Changes.Size
 		case types.TransferProgress:
-			// never update a transfer after it's finished
-			if pollResult.Status != "finished" {
+			// never update a transfer after it's finished or cancelled
+			if pollResult.Status != "finished" && pollResult.Status != "cancelled" {
 				pollResult.Sent = update.Changes.Sent
 				if pollResult.Sent > pollResult.Size {
 					// cap at 100%, so that all our clients don't have to
@@ -599,6 +598,14 @@ func (f *FsMachine) getCurrentState() string {
 	return f.currentState
 }
 
+// setKeyStatus records whether this node has the key of an encrypted
+// filesystem loaded, to be published with its next transition
+func (f *FsMachine) setKeyStatus(status string) {
+	f.snapshotsLock.Lock()
+	defer f.snapshotsLock.Unlock()
+	f.keyStatus = status
+}
+
 func (f *FsMachine) transitionedTo(state string, status string) {
 	// abusing snapshotsLock here, maybe we should have a separate lock over
 	// these fields
@@ -616,6 +623,9 @@ func (f *FsMachine) transitionedTo(state string, status string) {
 	update := map[string]string{
 		"state": state, "status": status,
 	}
+	if f.keyStatus != "" {
+		update["keystatus"] = f.keyStatus
+	}
 
 	err := f.serverStore.SetState(&types.ServerState{
 		ID:           f.state.NodeID(),
@@ -721,6 +731,8 @@ func (f *FsMachine) snapshot(e *types.Event) (responseEvent *types.Event, nextSt
 		meta = map[string]string{}
 	}
 	meta["timestamp"] = strconv.FormatInt(time.Now().UnixNano(), 10)
+	// only the digest worked out here can be trusted
+	delete(meta, digest.MetadataKey)
 	var snapshotId string
 	snapshotIdInter, ok := (*e.Args)["snapshotId"]
 	if !ok {
@@ -728,6 +740,21 @@ func (f *FsMachine) snapshot(e *types.Event) (responseEvent *types.Event, nextSt
 	} else {
 		snapshotId = snapshotIdInter.(string)
 	}
+	// A signed commit says which commit it follows; make sure no other
+	// commit got there first.
+	if parentId, ok := (*e.Args)["parentId"].(string); ok {
+		latest := ""
+		f.snapshotsLock.Lock()
+		if len(f.filesystem.Snapshots) > 0 {
+			latest = f.filesystem.Snapshots[len(f.filesystem.Snapshots)-1].Id
+		}
+		f.snapshotsLock.Unlock()
+		if latest != parentId {
+			return types.NewErrorEvent("parent-changed", fmt.Errorf(
+				"commit %s was made while this one was being signed, please try again", latest,
+			)), activeState
+		}
+	}
 	metadataEncoded := encodeMapValues(meta)
 	err = f.writeMetadata(metadataEncoded, f.filesystemId, snapshotId)
 	if err != nil {
@@ -744,6 +771,27 @@ func (f *FsMachine) snapshot(e *types.Event) (responseEvent *types.Event, nextSt
 		}, backoffState
 	}
 
+	// A signed commit is only made if its contents are what was signed,
+	// which the working copy may have stopped being since.
+	expected, _ := (*e.Args)["contentDigest"].(string)
+	if expected != "" {
+		actual, err := f.snapshotDigest(snapshotId)
+		if err == nil && actual != expected {
+			err = fmt.Errorf(
+				"the contents of the branch changed while the commit was being signed (signed %s, got %s), please try again",
+				expected, actual,
+			)
+		}
+		if err != nil {
+			if discardErr := f.discardSnapshot(snapshotId); discardErr != nil {
+				log.WithError(discardErr).WithField("snapshot_id", snapshotId).Error("[snapshot] Error discarding snapshot with the wrong contents")
+			}
+			return types.NewErrorEvent("content-changed", err), activeState
+		}
+		meta[digest.MetadataKey] = actual
+		f.recordSnapshotDigest(snapshotId, actual)
+	}
+
 	f.snapshotsLock.Lock()
 	f.filesystem.Snapshots = append(f.filesystem.Snapshots, &types.Snapshot{Id: snapshotId, Metadata: meta})
 	f.snapshotsLock.Unlock()
@@ -756,9 +804,33 @@ func (f *FsMachine) snapshot(e *types.Event) (responseEvent *types.Event, nextSt
 			Args: &types.EventArgs{"err": fmt.Sprintf("%v", err)},
 		}, backoffState
 	}
+	f.RecordRegistryProperties()
+	if expected == "" {
+		// reading all of a big dot takes a while, so other commits get
+		// their digests without holding everything else up
+		go f.digestSnapshot(snapshotId)
+	}
 	return &types.Event{Name: "snapshotted", Args: &types.EventArgs{"SnapshotId": snapshotId}}, activeState
 }
 
+func (f *FsMachine) RecordRegistryProperties() {
+	if !f.filesystem.Exists {
+		return
+	}
+	properties, err := f.registry.RegistryProperties(f.filesystemId)
+	if err != nil {
+		// not registered yet, it'll be recorded when it is
+		return
+	}
+	err = f.zfs.SetRegistryProperties(f.filesystemId, properties)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error":         err,
+			"filesystem_id": f.filesystemId,
+		}).Warn("[RecordRegistryProperties] failed to record registry properties")
+	}
+}
+
 // find the user-facing name of a given filesystem id. if we're a branch
 // (clone), return the name of our parent filesystem.
 func (f *FsMachine) name() (types.VolumeName, error) {
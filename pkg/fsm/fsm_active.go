@@ -178,6 +178,10 @@ func activeState(f *FsMachine) StateFn {
 			response, state := f.snapshot(e)
 			f.innerResponses <- response
 			return state
+		} else if e.Name == "restore" {
+			response, state := f.restore(e)
+			f.innerResponses <- response
+			return state
 		} else if e.Name == "mount-snapshot" {
 			snapId := (*e.Args)["snapId"].(string)
 			response, state := f.mountSnap(snapId, true)
@@ -191,36 +191,46 @@ func writeContents(l *log.Entry, file *types.InputFile, destinationPath string)
 	return bytes, nil
 }
 
+// writeAndExtractContents replaces destinationPath with what's in the
+// archive. It's unpacked next to it first, so that a broken or cut short
+// upload leaves what was there alone.
+//
 // TODO: calculate written bytes if we want it
 func writeAndExtractContents(l *log.Entry, file *types.InputFile, destinationPath string) error {
-	tDir, err := ioutil.TempDir(os.TempDir(), "s3_dir_upload")
+	parent, name := filepath.Split(filepath.Clean(destinationPath))
+	err := os.MkdirAll(parent, 0755)
 	if err != nil {
-		return fmt.Errorf("failed to create temporary dir for unarchiving: %s", err)
+		l.WithError(err).Error("failed to create parent dir")
+		return err
 	}
-	defer os.RemoveAll(tDir)
-
-	archiveFilepath := filepath.Join(tDir, "archive.tar")
-
-	archived, err := os.Create(archiveFilepath)
+	extractPath, err := ioutil.TempDir(parent, "."+name+".extract-")
 	if err != nil {
-		return fmt.Errorf("failed to create file, error: %s", err)
+		l.WithError(err).Error("failed to create extraction dir")
+		return err
 	}
-	_, err = io.Copy(archived, file.Contents)
+	defer os.RemoveAll(extractPath)
+	// TempDir only lets us in
+	err = os.Chmod(extractPath, 0755)
 	if err != nil {
-		l.WithError(err).Error("[saveFile] Error writing file")
-		return fmt.Errorf("cannot to create a file, error: %s", err)
+		l.WithError(err).Error("failed to set extraction dir permissions")
+		return err
+	}
+
+	err = archiver.ExtractFromStream(archiver.Format(file.ArchiveFormat), file.Contents, extractPath)
+	if err != nil {
+		l.WithError(err).Error("failed to unarchive")
+		return err
 	}
 
-	// cleaning up destination
+	// cleaning up destination, now there's something to replace it with
 	err = os.RemoveAll(destinationPath)
 	if err != nil {
 		l.WithError(err).Error("failed to clean dir")
 		return err
 	}
-
-	err = archiver.Unarchive(archiveFilepath, destinationPath)
+	err = os.Rename(extractPath, destinationPath)
 	if err != nil {
-		l.WithError(err).Error("failed to unarchive")
+		l.WithError(err).Error("failed to move extracted files into place")
 		return err
 	}
 	return nil
@@ -393,10 +403,14 @@ func (f *FsMachine) readDirectory(file *types.OutputFile) StateFn {
 		return backoffState
 	}
 
-	err = archiver.NewTar().ArchiveToStream(file.Contents, []string{dirPath})
+	format := archiver.FormatTar
+	if file.ArchiveFormat != "" {
+		format = archiver.Format(file.ArchiveFormat)
+	}
+	err = archiver.ArchiveToStream(format, file.Contents, []string{dirPath})
 	if err != nil {
-		file.Response <- types.NewErrorEvent(types.EventNameReadFailed, fmt.Errorf("path '%s' tar failed, error: %s ", file.Filename, err))
-		l.WithError(err).Error("[readDirectory] Cannot create tar stream")
+		file.Response <- types.NewErrorEvent(types.EventNameReadFailed, fmt.Errorf("path '%s' %s failed, error: %s ", file.Filename, format, err))
+		l.WithError(err).Error("[readDirectory] Cannot create archive stream")
 		return backoffState
 	}
 
@@ -1,7 +1,10 @@
 package fsm
 
 import (
+	"bytes"
 	"crypto/rand"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
@@ -359,6 +362,69 @@ func TestFsmActiveCleanDuringUploadDir(t *testing.T) {
 	}
 }
 
+type brokenReader struct{}
+
+func (brokenReader) Read([]byte) (int, error) {
+	return 0, fmt.Errorf("connection reset")
+}
+
+func TestFsmActiveFailedUploadDirKeepsContents(t *testing.T) {
+
+	outputDir, err := ioutil.TempDir("", "outputDir")
+	if err != nil {
+		t.Fatalf("Making temporary directory: %v", err)
+	}
+	defer os.RemoveAll(outputDir)
+
+	f, err := os.Open("./testdata/archived-test-file_tar")
+	if err != nil {
+		t.Fatalf("failed to open test file: %s", err)
+	}
+	defer f.Close()
+	file := &types.InputFile{
+		Contents: f,
+		Extract:  true,
+	}
+	l := log.WithFields(log.Fields{
+		"destPath": outputDir,
+	})
+
+	_, err = writeContents(l, file, outputDir+"/extracted")
+	if err != nil {
+		t.Fatalf("failed to write first archive contents: %s", err)
+	}
+
+	// an upload that's cut off part way through
+	archive, err := ioutil.ReadFile("./testdata/updated-file_tar")
+	if err != nil {
+		t.Fatalf("failed to read test file: %s", err)
+	}
+	brokenFile := &types.InputFile{
+		Contents:      io.MultiReader(bytes.NewReader(archive[:len(archive)/3]), brokenReader{}),
+		Extract:       true,
+		ArchiveFormat: string(archiver.FormatTar),
+	}
+	_, err = writeContents(l, brokenFile, outputDir+"/extracted")
+	if err == nil {
+		t.Fatalf("expected a truncated archive to fail")
+	}
+
+	contents, err := ioutil.ReadFile(outputDir + "/extracted/test-file.txt")
+	if err != nil {
+		t.Fatalf("expected the previous contents to be left alone: %s", err)
+	}
+	if strings.TrimSpace(string(contents)) != "some contents here" {
+		t.Errorf("expected 'some contents here', got: %s", strings.TrimSpace(string(contents)))
+	}
+	entries, err := ioutil.ReadDir(outputDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("expected only the extracted dir to be left, got %d entries", len(entries))
+	}
+}
+
 type cleanupFunc func()
 
 func ensureMountPrefix(mountPrefix string) cleanupFunc {
@@ -0,0 +1,121 @@
+package fsm
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/dotmesh-oss/dotmesh/pkg/digest"
+	"github.com/dotmesh-oss/dotmesh/pkg/types"
+	"github.com/dotmesh-oss/dotmesh/pkg/utils"
+	"github.com/dotmesh-oss/dotmesh/pkg/zfs"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// snapshotDigest is the content digest of one of the filesystem's
+// snapshots. It reads the snapshot at a mount of its own, rather than where
+// mountSnap puts it, so that it can run outside the state machine without
+// unmounting anything from under it.
+func (f *FsMachine) snapshotDigest(snapshotId string) (string, error) {
+	_, err := zfs.EnsureKeyLoaded(f.zfs, f.filesystemId, func() (string, error) {
+		return f.state.EncryptionKey(f.filesystemId)
+	})
+	if err != nil {
+		return "", err
+	}
+	mountPath, unmount, err := zfs.MountPrivately(f.zfs, f.filesystemId, snapshotId)
+	if err != nil {
+		return "", err
+	}
+	d, err := digest.Tree(filepath.Join(mountPath, "__default__"))
+	if unmountErr := unmount(); unmountErr != nil {
+		log.WithFields(log.Fields{
+			"filesystem": f.filesystemId,
+			"snapshot":   snapshotId,
+			"error":      unmountErr,
+		}).Warn("[snapshotDigest] Couldn't unmount snapshot after digesting it")
+	}
+	return d, err
+}
+
+// recordSnapshotDigest keeps a snapshot's content digest as a property of it.
+// The metadata file is already in the snapshot, so the digest is kept the
+// way metadata arriving with a pushed commit is.
+func (f *FsMachine) recordSnapshotDigest(snapshotId, d string) {
+	err := f.zfs.ApplyPrelude(types.Prelude{SnapshotProperties: []*types.Snapshot{
+		{Id: snapshotId, Metadata: map[string]string{digest.MetadataKey: d}},
+	}}, f.filesystemId)
+	if err != nil {
+		log.WithError(err).WithField("snapshot_id", snapshotId).Warn("[recordSnapshotDigest] Couldn't record the commit's digest")
+	}
+}
+
+// digestSnapshot works out and records the content digest of a snapshot
+// that has just been taken, so that copies of it can be checked against it
+// later. It runs outside the state machine, so the snapshot may be gone by
+// the time it's done.
+func (f *FsMachine) digestSnapshot(snapshotId string) {
+	d, err := f.snapshotDigest(snapshotId)
+	if err != nil {
+		log.WithError(err).WithField("snapshot_id", snapshotId).Warn("[digestSnapshot] Couldn't digest the new commit, it won't be verifiable")
+		return
+	}
+	f.recordSnapshotDigest(snapshotId, d)
+
+	found := false
+	var snaps []*types.Snapshot
+	f.snapshotsLock.Lock()
+	for _, s := range f.filesystem.Snapshots {
+		if s.Id == snapshotId {
+			s = s.DeepCopy()
+			s.Metadata[digest.MetadataKey] = d
+			found = true
+		}
+		snaps = append(snaps, s)
+	}
+	if found {
+		f.filesystem.Snapshots = snaps
+	}
+	f.snapshotsLock.Unlock()
+	if !found {
+		return
+	}
+
+	// as snapshotsChanged does, but the filesystem may have gone since
+	deathChan := make(chan interface{})
+	f.deathObserver.Subscribe(f.filesystemId, deathChan)
+	defer f.deathObserver.Unsubscribe(f.filesystemId, deathChan)
+	select {
+	case f.snapshotsModified <- true:
+	case <-deathChan:
+		return
+	}
+	copies := make([]*types.Snapshot, 0, len(snaps))
+	for _, s := range snaps {
+		copies = append(copies, s.DeepCopy())
+	}
+	err = f.state.UpdateSnapshotsFromKnownState(f.state.NodeID(), f.filesystemId, copies)
+	if err != nil {
+		log.WithError(err).WithField("snapshot_id", snapshotId).Warn("[digestSnapshot] Couldn't tell the cluster about the commit's digest")
+	}
+}
+
+// discardSnapshot undoes a snapshot that has only just been taken, before
+// anyone else has heard about it.
+func (f *FsMachine) discardSnapshot(snapshotId string) error {
+	response, _ := f.unmountSnap(snapshotId)
+	if response.Name != "unmounted" {
+		return fmt.Errorf("couldn't unmount snapshot %s: %s %v", snapshotId, response.Name, response.Args)
+	}
+	out, err := f.zfs.DestroySnapshot(f.filesystemId, snapshotId)
+	if err != nil {
+		return fmt.Errorf("couldn't destroy snapshot %s: %s: %s", snapshotId, err, out)
+	}
+	// the metadata written for it into the working copy
+	err = os.Remove(filepath.Join(utils.Mnt(f.filesystemId), "dotmesh.metadata", snapshotId+".json"))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
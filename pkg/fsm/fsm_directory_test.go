@@ -0,0 +1,204 @@
+package fsm
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/dotmesh-oss/dotmesh/pkg/digest"
+	"github.com/dotmesh-oss/dotmesh/pkg/observer"
+	"github.com/dotmesh-oss/dotmesh/pkg/registry"
+	"github.com/dotmesh-oss/dotmesh/pkg/types"
+	"github.com/dotmesh-oss/dotmesh/pkg/utils"
+	"github.com/dotmesh-oss/dotmesh/pkg/zfs"
+)
+
+// testState is the little of the server a state machine needs to commit
+type testState struct {
+	StateManager
+}
+
+func (s *testState) NodeID() string {
+	return "node"
+}
+
+func (s *testState) UpdateSnapshotsFromKnownState(server, filesystem string, snapshots []*types.Snapshot) error {
+	return nil
+}
+
+// unregistered is a registry that has never heard of the filesystem
+type unregistered struct {
+	registry.Registry
+}
+
+func (r *unregistered) RegistryProperties(filesystemId string) (types.RegistryProperties, error) {
+	return types.RegistryProperties{}, fmt.Errorf("no filesystem %s", filesystemId)
+}
+
+// newDirectoryMachine makes a state machine on the directory backend for a
+// filesystem that has just been created and mounted
+func newDirectoryMachine(t *testing.T) *FsMachine {
+	if os.Geteuid() != 0 {
+		t.Skip("bind mounts need root")
+	}
+	root, err := ioutil.TempDir("", "dotmesh-fsm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(root) })
+	t.Cleanup(ensureMountPrefix(filepath.Join(root, "mnt")))
+
+	f := NewFilesystemMachine(&FsConfig{
+		FilesystemID:  "fs",
+		StateManager:  &testState{},
+		Registry:      &unregistered{},
+		DeathObserver: observer.NewObserver("deathObserver"),
+		ZFS:           newDirectoryBackend(t, filepath.Join(root, "pool")),
+	})
+	// as updateEtcdAboutSnapshots would
+	go func() {
+		for range f.snapshotsModified {
+		}
+	}()
+
+	_, err = f.zfs.Create("fs")
+	if err != nil {
+		t.Fatalf("failed to create filesystem: %s", err)
+	}
+	response, _ := f.mount()
+	if response.Name != "mounted" {
+		t.Fatalf("failed to mount: %s %v", response.Name, response.Args)
+	}
+	t.Cleanup(func() {
+		filesystem, err := f.zfs.DiscoverSystem("fs")
+		if err == nil {
+			for _, s := range filesystem.Snapshots {
+				syscall.Unmount(utils.Mnt(zfs.FullIdWithSnapshot("fs", s.Id)), 0)
+			}
+		}
+		syscall.Unmount(utils.Mnt("fs"), 0)
+	})
+	return f
+}
+
+func writeWorkingCopy(t *testing.T, f *FsMachine, name, contents string) {
+	err := ioutil.WriteFile(filepath.Join(utils.Mnt(f.filesystemId), "__default__", name), []byte(contents), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func commit(t *testing.T, f *FsMachine, message string) string {
+	response, _ := f.snapshot(&types.Event{Name: "snapshot", Args: &types.EventArgs{
+		"metadata": map[string]string{"message": message},
+	}})
+	if response.Name != "snapshotted" {
+		t.Fatalf("failed to commit: %s %v", response.Name, response.Args)
+	}
+	return (*response.Args)["SnapshotId"].(string)
+}
+
+func TestDirectoryMachineCommit(t *testing.T) {
+	f := newDirectoryMachine(t)
+	err := os.MkdirAll(filepath.Join(utils.Mnt("fs"), "__default__"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeWorkingCopy(t, f, "file.txt", "hello")
+	snapshotId := commit(t, f, "first")
+
+	// the digest is worked out after the commit is made
+	var snapshot *types.Snapshot
+	for start := time.Now(); time.Since(start) < 10*time.Second; time.Sleep(50 * time.Millisecond) {
+		filesystem, err := f.zfs.DiscoverSystem("fs")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(filesystem.Snapshots) != 1 {
+			t.Fatalf("expected one commit, got %+v", filesystem.Snapshots)
+		}
+		snapshot = filesystem.Snapshots[0]
+		if snapshot.Metadata[digest.MetadataKey] != "" {
+			break
+		}
+	}
+	expected, err := digest.Tree(filepath.Join(utils.Mnt("fs"), "__default__"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snapshot.Id != snapshotId || snapshot.Metadata[digest.MetadataKey] != expected {
+		t.Errorf("expected commit %s with digest %s, got %+v", snapshotId, expected, snapshot)
+	}
+
+	// its metadata is read back from the commit, as it is when the state
+	// machine starts
+	f.snapshotsLock.Lock()
+	f.filesystem.Snapshots = nil
+	f.snapshotsLock.Unlock()
+	err = f.discover()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.snapshotsLock.Lock()
+	snapshots := f.filesystem.Snapshots
+	f.snapshotsLock.Unlock()
+	if len(snapshots) != 1 || snapshots[0].Metadata["message"] != "first" {
+		t.Errorf("expected to discover the commit with its message, got %+v", snapshots)
+	}
+
+	writeWorkingCopy(t, f, "file.txt", "changed")
+	writeWorkingCopy(t, f, "new.txt", "new")
+	response, _ := f.diff(&types.Event{Name: "diff", FilesystemID: "fs"})
+	if response.Name != "diffed" {
+		t.Fatalf("failed to diff: %s %v", response.Name, response.Args)
+	}
+	changes, err := types.DecodeZFSFileDiff((*response.Args)["files"].(string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedChanges := []types.ZFSFileDiff{
+		{Change: types.FileChangeModified, Filename: "file.txt"},
+		{Change: types.FileChangeAdded, Filename: "new.txt"},
+	}
+	if !reflect.DeepEqual(changes, expectedChanges) {
+		t.Errorf("expected changes %+v, got %+v", expectedChanges, changes)
+	}
+}
+
+func TestDirectoryMachineDigestLeavesMountsAlone(t *testing.T) {
+	f := newDirectoryMachine(t)
+	err := os.MkdirAll(filepath.Join(utils.Mnt("fs"), "__default__"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeWorkingCopy(t, f, "file.txt", "hello")
+	snapshotId := commit(t, f, "first")
+	fullId := zfs.FullIdWithSnapshot("fs", snapshotId)
+
+	// digesting neither mounts the commit where the state machine would...
+	_, err = f.snapshotDigest(snapshotId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mounted, _ := utils.IsFilesystemMounted(fullId); mounted {
+		t.Errorf("expected digesting not to mount %s for the state machine", fullId)
+	}
+
+	// ...nor unmounts it from under it
+	response, _ := f.mountSnap(snapshotId, true)
+	if response.Name != "mounted" {
+		t.Fatalf("failed to mount: %s %v", response.Name, response.Args)
+	}
+	_, err = f.snapshotDigest(snapshotId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mounted, _ := utils.IsFilesystemMounted(fullId); !mounted {
+		t.Errorf("expected %s to stay mounted", fullId)
+	}
+}
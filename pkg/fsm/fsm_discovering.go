@@ -32,6 +32,7 @@ func discoveringState(f *FsMachine) StateFn {
 	if !f.filesystem.Exists {
 		return missingState
 	} else {
+		f.RecordRegistryProperties()
 		err := f.state.AlignMountStateWithMasters(f.filesystemId)
 		if err != nil {
 			log.WithFields(log.Fields{
@@ -67,7 +67,10 @@ func inactiveState(f *FsMachine) StateFn {
 		// carry on
 	}
 
-	if f.attemptReceive() {
+	// Nodes which aren't designated replicas keep what they already have,
+	// but stop pulling new commits
+	designated := f.state.IsDesignatedReplica(f.filesystemId)
+	if designated && f.attemptReceive() {
 		f.transitionedTo("inactive", "found snapshots on master")
 		return receivingState
 	}
@@ -79,6 +82,10 @@ func inactiveState(f *FsMachine) StateFn {
 	f.transitionedTo("inactive", "waiting for requests or snapshots")
 	select {
 	case _ = <-newSnapsOnMaster:
+		if !f.state.IsDesignatedReplica(f.filesystemId) {
+			f.transitionedTo("inactive", "new snapshots found on master, but not a designated replica")
+			return inactiveState
+		}
 		return receivingState
 	case e := <-f.innerRequests:
 		doTransition, nextState := handleEvent(e)
@@ -46,7 +46,10 @@ func missingState(f *FsMachine) StateFn {
 		return nil
 	}
 
-	if f.attemptReceive() {
+	// Only pull a copy of the filesystem if its placement policy puts one
+	// here. We can still be created, or pulled into, explicitly.
+	designated := f.state.IsDesignatedReplica(f.filesystemId)
+	if designated && f.attemptReceive() {
 		f.transitionedTo("missing", "going to receiving because we found snapshots")
 		return receivingState
 	}
@@ -58,6 +61,10 @@ func missingState(f *FsMachine) StateFn {
 	f.transitionedTo("missing", "waiting for snapshots or requests")
 	select {
 	case _ = <-newSnapsOnMaster:
+		if !f.state.IsDesignatedReplica(f.filesystemId) {
+			f.transitionedTo("missing", "new snapshots found on master, but not a designated replica")
+			return missingState
+		}
 		f.transitionedTo("missing", "new snapshots found on master")
 		return receivingState
 	case e := <-f.innerRequests:
@@ -221,7 +228,21 @@ func missingState(f *FsMachine) StateFn {
 			f.transitionedTo("missing", "creating")
 			// ah - we are going to be created on this node, rather than
 			// received into from a master...
-			output, err := f.zfs.Create(f.filesystemId)
+			var output []byte
+			var err error
+			encrypted := false
+			if e.Args != nil {
+				encrypted, _ = (*e.Args)["encrypted"].(bool)
+			}
+			if encrypted {
+				var key string
+				key, err = f.state.EncryptionKey(f.filesystemId)
+				if err == nil {
+					output, err = f.zfs.CreateEncrypted(f.filesystemId, key)
+				}
+			} else {
+				output, err = f.zfs.Create(f.filesystemId)
+			}
 			if err != nil {
 				f.innerResponses <- &types.Event{
 					Name: "failed-create",
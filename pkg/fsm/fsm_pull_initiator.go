@@ -43,6 +43,8 @@ func pullInitiatorState(f *FsMachine) StateFn {
 
 	transferRequest := f.lastTransferRequest
 	transferRequestId := f.lastTransferRequestId
+	f.startTransferControl(transferRequestId)
+	defer f.stopTransferControl()
 
 	// TODO dedupe what follows wrt pushInitiatorState!
 	client := dmclient.NewJsonRpcClient(
@@ -181,9 +183,18 @@ func (f *FsMachine) pull(
 		toSnapshotId,
 	)
 	log.Printf("Pulling from %s", url)
+	transfer := f.currentTransfer()
 	req, err := http.NewRequest(
 		"GET", url, nil,
 	)
+	if err != nil {
+		return &types.Event{
+			Name: "get-failed-pull",
+			Args: &types.EventArgs{"err": err, "filesystemId": toFilesystemId},
+		}, backoffState
+	}
+	// cancelling the transfer aborts the request
+	req = req.WithContext(transfer.ctx)
 	req.SetBasicAuth(
 		transferRequest.User,
 		transferRequest.ApiKey,
@@ -222,12 +233,12 @@ func (f *FsMachine) pull(
 	defer pipeReader.Close()
 	defer pipeWriter.Close()
 	go utils.Pipe(
-		resp.Body, fmt.Sprintf("http response body for %s", toFilesystemId),
+		transfer.reader(resp.Body), fmt.Sprintf("http response body for %s", toFilesystemId),
 		pipeWriter, "stdin of zfs recv",
 		finished,
 
-		// Permanently empty cancellation channel, and noop cancellation callback
-		make(chan *types.Event),
+		// Cancelled by ControlTransfer, which has nothing more to do
+		transfer.canceller,
 		func(e *types.Event, c chan *types.Event) {},
 
 		func(bytes int64, t int64) {
@@ -283,7 +294,7 @@ func (f *FsMachine) pull(
 	}
 	log.Printf("[pull] Got prelude %v", prelude)
 	stdErrBuffer := &bytes.Buffer{}
-	err = f.zfs.Recv(pipeReader, toFilesystemId, stdErrBuffer)
+	err = f.zfs.Recv(transfer.ctx, pipeReader, toFilesystemId, stdErrBuffer)
 	pipeReader.Close()
 	pipeWriter.Close()
 	f.transitionedTo("receiving", "finished zfs recv")
@@ -457,6 +468,9 @@ func (f *FsMachine) retryPull(
 			log.Printf("[actualPull] Successful pull!")
 			return responseEvent, nextState
 		}
+		if f.currentTransfer().cancelled() {
+			return f.transferCancelled()
+		}
 		retry++
 		f.updateTransfer(
 			fmt.Sprintf("retry %d", retry),
@@ -26,6 +26,8 @@ func pushInitiatorState(f *FsMachine) StateFn {
 	// Set /filesystems/transfers/:transferId = TransferPollResult{...}
 	transferRequest := f.lastTransferRequest
 	transferRequestId := f.lastTransferRequestId
+	f.startTransferControl(transferRequestId)
+	defer f.stopTransferControl()
 	log.Printf(
 		"[pushInitiator] request: %v %+v",
 		transferRequestId,
@@ -78,7 +80,7 @@ func pushInitiatorState(f *FsMachine) StateFn {
 	// for "up to latest")
 
 	// TODO tidy up argument passing here.
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	ctx, cancel := context.WithTimeout(f.currentTransfer().ctx, 10*time.Minute)
 	defer cancel()
 	responseEvent, nextState := f.applyPath(path, func(f *FsMachine,
 		fromFilesystemId, fromSnapshotId, toFilesystemId, toSnapshotId string,
@@ -155,6 +157,9 @@ func (f *FsMachine) push(
 			Args: &types.EventArgs{"err": err},
 		}, backoffState
 	}
+	// cancelling the transfer aborts the request, and the zfs send
+	transfer := f.currentTransfer()
+	req = req.WithContext(transfer.ctx)
 
 	// https://github.com/zfsonlinux/zfs/pull/5189
 	//
@@ -209,16 +214,16 @@ func (f *FsMachine) push(
 		}, backoffState
 	}
 
-	pipeReader, errch := f.zfs.Send(fromFilesystemId, fromSnapshotId, toFilesystemId, toSnapshotId, preludeEncoded)
+	pipeReader, errch := f.zfs.Send(transfer.ctx, fromFilesystemId, fromSnapshotId, toFilesystemId, toSnapshotId, preludeEncoded)
 
 	finished := make(chan bool)
 	go utils.Pipe(
-		pipeReader, fmt.Sprintf("stdout of zfs send for %s", filesystemId),
+		transfer.reader(pipeReader), fmt.Sprintf("stdout of zfs send for %s", filesystemId),
 		postWriter, "http request body",
 		finished,
 
-		// Permanently empty cancellation channel, and noop cancellation callback
-		make(chan *types.Event),
+		// Cancelled by ControlTransfer, which has nothing more to do
+		transfer.canceller,
 		func(e *types.Event, c chan *types.Event) {},
 
 		func(bytes int64, t int64) {
@@ -529,6 +534,9 @@ func (f *FsMachine) retryPush(
 			log.Printf("[actualPush] Successful push!")
 			return responseEvent, nextState
 		}
+		if f.currentTransfer().cancelled() {
+			return f.transferCancelled()
+		}
 		retry++
 		f.updateTransfer(
 			fmt.Sprintf("retry %d", retry),
@@ -177,7 +177,7 @@ func receivingState(f *FsMachine) StateFn {
 	log.Printf("[pull] Got prelude %v", prelude)
 
 	stdErrBuffer := &bytes.Buffer{}
-	err = f.zfs.Recv(pipeReader, f.filesystemId, stdErrBuffer)
+	err = f.zfs.Recv(context.Background(), pipeReader, f.filesystemId, stdErrBuffer)
 	f.transitionedTo("receiving", "finished zfs recv")
 	pipeReader.Close()
 	pipeWriter.Close()
@@ -0,0 +1,178 @@
+package fsm
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/dotmesh-oss/dotmesh/pkg/types"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// restore copies paths out of a commit into the live working copy,
+// replacing whatever is at those paths now, and leaves the rest of the
+// working copy alone.
+func (f *FsMachine) restore(e *types.Event) (responseEvent *types.Event, nextState StateFn) {
+	snapshotId, _ := (*e.Args)["snapshotId"].(string)
+	if snapshotId == "" {
+		return types.NewErrorEvent("cannot-restore", fmt.Errorf("snapshotId not specified")), activeState
+	}
+	paths, err := castToStrings((*e.Args)["paths"])
+	if err != nil {
+		return types.NewErrorEvent("cannot-restore", fmt.Errorf("bad paths: %s", err)), activeState
+	}
+	if len(paths) == 0 {
+		return types.NewErrorEvent("cannot-restore", fmt.Errorf("no paths to restore")), activeState
+	}
+
+	response, state := f.mountSnap(snapshotId, true)
+	if response.Name != "mounted" {
+		return response, state
+	}
+	mountPath := (*response.Args)["mount-path"].(string)
+
+	files := 0
+	for _, p := range paths {
+		p = filepath.Clean("/" + p)
+		if p == "/" {
+			return types.NewErrorEvent(
+				"cannot-restore",
+				fmt.Errorf("refusing to restore the whole dot, use 'dm reset --hard' for that"),
+			), activeState
+		}
+		// Only the directory the path is in is resolved securely, so that a
+		// symlink being restored is copied as a link rather than followed.
+		srcDir, err := types.OutputFile{Filename: filepath.Dir(p), SnapshotMountPath: mountPath}.GetFilePath()
+		if err != nil {
+			return types.NewErrorEvent("cannot-restore", fmt.Errorf("insecure path %s: %s", p, err)), activeState
+		}
+		destDir, err := f.getPathInFilesystem(filepath.Dir(p))
+		if err != nil {
+			return types.NewErrorEvent("cannot-restore", fmt.Errorf("insecure path %s: %s", p, err)), activeState
+		}
+		srcPath := filepath.Join(srcDir, filepath.Base(p))
+		destPath := filepath.Join(destDir, filepath.Base(p))
+		if _, err := os.Lstat(srcPath); err != nil {
+			if os.IsNotExist(err) {
+				return types.NewErrorEvent(
+					"cannot-restore",
+					fmt.Errorf("%s does not exist in commit %s", p, snapshotId),
+				), activeState
+			}
+			return types.NewErrorEvent("cannot-restore", err), activeState
+		}
+
+		l := log.WithFields(log.Fields{
+			"filesystem": f.filesystemId,
+			"snapshot":   snapshotId,
+			"path":       p,
+		})
+		err = os.RemoveAll(destPath)
+		if err == nil {
+			err = os.MkdirAll(destDir, 0777)
+		}
+		if err != nil {
+			l.WithError(err).Error("[restore] Error clearing the way")
+			return types.NewErrorEvent("restore-failed", err), backoffState
+		}
+		n, err := copyTree(srcPath, destPath)
+		if err != nil {
+			l.WithError(err).Error("[restore] Error copying")
+			return types.NewErrorEvent("restore-failed", err), backoffState
+		}
+		l.WithField("files", n).Info("[restore] Restored")
+		files += n
+	}
+
+	return &types.Event{
+		Name: "restored",
+		Args: &types.EventArgs{"files": files},
+	}, activeState
+}
+
+// copyTree copies a file, symlink or directory from src to dest, which must
+// not exist yet, keeping permissions and copying symlinks as links rather
+// than following them. It returns how many non-directories it copied.
+func copyTree(src, dest string) (int, error) {
+	files := 0
+	// Directories are made writable while we fill them, and given their real
+	// modes afterwards, deepest first, so read-only ones still work.
+	type dirMode struct {
+		path string
+		mode os.FileMode
+	}
+	dirs := []dirMode{}
+
+	err := filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dest, rel)
+
+		mode := info.Mode()
+		switch {
+		case mode.IsDir():
+			if err := os.Mkdir(target, 0700); err != nil {
+				return err
+			}
+			dirs = append(dirs, dirMode{target, mode.Perm() | mode&(os.ModeSetuid|os.ModeSetgid|os.ModeSticky)})
+			return nil
+		case mode&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			if err := os.Symlink(link, target); err != nil {
+				return err
+			}
+		case mode.IsRegular():
+			if err := copyFile(path, target, mode); err != nil {
+				return err
+			}
+		default:
+			// devices, sockets and pipes don't belong in a dot
+			log.WithField("path", path).Warnf("[restore] Skipping %s", mode.Type())
+			return nil
+		}
+		files++
+		return nil
+	})
+	if err != nil {
+		return files, err
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := os.Chmod(dirs[i].path, dirs[i].mode); err != nil {
+			return files, err
+		}
+	}
+	return files, nil
+}
+
+func copyFile(src, dest string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	// chmod rather than relying on OpenFile, which the umask gets a say in
+	return os.Chmod(dest, mode.Perm()|mode&(os.ModeSetuid|os.ModeSetgid|os.ModeSticky))
+}
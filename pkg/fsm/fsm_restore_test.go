@@ -0,0 +1,63 @@
+package fsm
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCopyTree(t *testing.T) {
+	dir, err := ioutil.TempDir("", "restore")
+	if err != nil {
+		t.Fatalf("making temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	if err := os.MkdirAll(filepath.Join(src, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(src, "sub", "script.sh"), []byte("#!/bin/sh\n"), 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("sub/script.sh", filepath.Join(src, "link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(filepath.Join(src, "sub"), 0500); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(filepath.Join(src, "sub"), 0755)
+
+	dest := filepath.Join(dir, "dest")
+	files, err := copyTree(src, dest)
+	if err != nil {
+		t.Fatalf("copyTree() error = %v", err)
+	}
+	defer os.Chmod(filepath.Join(dest, "sub"), 0755)
+	if files != 2 {
+		t.Errorf("copyTree() copied %d files, want 2", files)
+	}
+
+	info, err := os.Stat(filepath.Join(dest, "sub"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0500 {
+		t.Errorf("sub has mode %v, want 0500", info.Mode().Perm())
+	}
+	info, err = os.Stat(filepath.Join(dest, "sub", "script.sh"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0750 {
+		t.Errorf("script.sh has mode %v, want 0750", info.Mode().Perm())
+	}
+	link, err := os.Readlink(filepath.Join(dest, "link"))
+	if err != nil {
+		t.Fatalf("link wasn't copied as a symlink: %v", err)
+	}
+	if link != "sub/script.sh" {
+		t.Errorf("link points at %s, want sub/script.sh", link)
+	}
+}
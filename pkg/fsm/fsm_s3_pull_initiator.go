@@ -13,6 +13,8 @@ func s3PullInitiatorState(f *FsMachine) StateFn {
 	f.transitionedTo("s3PullInitiatorState", "requesting")
 	transferRequest := f.lastS3TransferRequest
 	transferRequestId := f.lastTransferRequestId
+	f.startTransferControl(transferRequestId)
+	defer f.stopTransferControl()
 	containers, err := f.containersRunning()
 	if err != nil {
 		f.errorDuringTransfer("error-listing-containers-during-pull", err)
@@ -41,9 +43,15 @@ func s3PullInitiatorState(f *FsMachine) StateFn {
 		Changes: types.TransferPollResult{
 			TransferRequestId: transferRequestId,
 			Direction:         transferRequest.Direction,
+			LocalNamespace:    transferRequest.LocalNamespace,
+			LocalName:         transferRequest.LocalName,
+			LocalBranchName:   transferRequest.LocalBranchName,
+			RemoteName:        transferRequest.RemoteName,
+			FilesystemId:      f.filesystemId,
 			InitiatorNodeId:   f.state.NodeID(),
 			Index:             0,
 			Status:            "starting",
+			Priority:          transferRequest.Priority,
 		},
 	}
 
@@ -68,6 +76,13 @@ func s3PullInitiatorState(f *FsMachine) StateFn {
 	}
 	destPath := fmt.Sprintf("%s/%s", utils.Mnt(f.filesystemId), "__default__")
 	bucketChanged, keyVersions, err := downloadS3Bucket(f, svc, transferRequest.RemoteName, destPath, transferRequestId, transferRequest.Prefixes, latestMeta)
+	if err == errTransferCancelled || f.currentTransfer().cancelled() {
+		// whatever was downloaded is left as uncommitted changes, for the
+		// user to keep or reset
+		event, nextState := f.transferCancelled()
+		f.innerResponses <- event
+		return nextState
+	}
 	if err != nil {
 		f.errorDuringTransfer("cant-pull-from-s3", err)
 		return backoffState
@@ -13,15 +13,23 @@ func s3PushInitiatorState(f *FsMachine) StateFn {
 	f.transitionedTo("s3PushInitiatorState", "requesting")
 	transferRequest := f.lastS3TransferRequest
 	transferRequestId := f.lastTransferRequestId
+	f.startTransferControl(transferRequestId)
+	defer f.stopTransferControl()
 
 	f.transferUpdates <- types.TransferUpdate{
 		Kind: types.TransferStart,
 		Changes: types.TransferPollResult{
 			TransferRequestId: transferRequestId,
 			Direction:         transferRequest.Direction,
+			LocalNamespace:    transferRequest.LocalNamespace,
+			LocalName:         transferRequest.LocalName,
+			LocalBranchName:   transferRequest.LocalBranchName,
+			RemoteName:        transferRequest.RemoteName,
+			FilesystemId:      f.filesystemId,
 			InitiatorNodeId:   f.state.NodeID(),
 			Index:             0,
 			Status:            "starting",
+			Priority:          transferRequest.Priority,
 		},
 	}
 
@@ -99,6 +107,13 @@ func s3PushInitiatorState(f *FsMachine) StateFn {
 
 		keyToVersionIds := make(map[string]string)
 		keyToVersionIds, err = updateS3Files(f, keyToVersionIds, fileItemsResponse.Items, pathToMount, transferRequestId, transferRequest.RemoteName, transferRequest.Prefixes, svc)
+		if err == errTransferCancelled || f.currentTransfer().cancelled() {
+			// the objects already uploaded stay in the bucket, but no
+			// metadata commit is made, so the next push sends them again
+			event, nextState := f.transferCancelled()
+			f.innerResponses <- event
+			return nextState
+		}
 		if err != nil {
 			f.errorDuringTransfer("error-updating-s3-objects", err)
 			return backoffState
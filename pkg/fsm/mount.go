@@ -32,6 +32,16 @@ func (f *FsMachine) mountSnap(snapId string, readonly bool) (responseEvent *type
 		if readonly {
 			options += ",ro"
 		}
+		keyStatus, err := zfs.EnsureKeyLoaded(f.zfs, f.filesystemId, func() (string, error) {
+			return f.state.EncryptionKey(f.filesystemId)
+		})
+		f.setKeyStatus(keyStatus)
+		if err != nil {
+			return &types.Event{
+				Name: "failed-loading-key",
+				Args: &types.EventArgs{"err": err},
+			}, backoffState
+		}
 		if snapId == "" {
 			out, err := f.zfs.SetCanmount(f.filesystemId, snapId)
 			if err != nil {
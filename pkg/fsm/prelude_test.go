@@ -0,0 +1,89 @@
+package fsm
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/dotmesh-oss/dotmesh/pkg/types"
+	"github.com/dotmesh-oss/dotmesh/pkg/zfs"
+)
+
+// newDirectoryBackend makes a storage backend the way the server does,
+// picking the directory one so that it runs without zfs
+func newDirectoryBackend(t *testing.T, root string) zfs.ZFS {
+	z, err := zfs.NewBackend(types.FilesystemBackendDirectory, root, "", "", "pool", "")
+	if err != nil {
+		t.Fatalf("failed to init directory backend: %s", err)
+	}
+	return z
+}
+
+func TestPreludeSendRecv(t *testing.T) {
+	root, err := ioutil.TempDir("", "prelude")
+	if err != nil {
+		t.Fatalf("making temporary directory: %v", err)
+	}
+	defer os.RemoveAll(root)
+	defer ensureMountPrefix(filepath.Join(root, "mnt"))()
+
+	src := newDirectoryBackend(t, filepath.Join(root, "src"))
+	dst := newDirectoryBackend(t, filepath.Join(root, "dst"))
+	if src.GetPoolID() == dst.GetPoolID() {
+		t.Errorf("expected each backend to have its own pool id")
+	}
+
+	_, err = src.Create("fs")
+	if err != nil {
+		t.Fatalf("failed to create filesystem: %s", err)
+	}
+	_, err = src.Snapshot("fs", "snap", []string{})
+	if err != nil {
+		t.Fatalf("failed to snapshot: %s", err)
+	}
+
+	// metadata set through the prelude, as snapshot() does, has to survive
+	// the framing
+	metadata := map[string]string{"message": "hello", "author": "alice"}
+	prelude := types.Prelude{SnapshotProperties: []*types.Snapshot{
+		{Id: "snap", Metadata: metadata},
+	}}
+	preludeEncoded, err := EncodePrelude(prelude)
+	if err != nil {
+		t.Fatalf("failed to encode prelude: %s", err)
+	}
+
+	pipeReader, errch := src.Send(context.Background(), "", "", "fs", "snap", preludeEncoded)
+	received, err := ConsumePrelude(pipeReader)
+	if err != nil {
+		t.Fatalf("failed to consume prelude: %s", err)
+	}
+	errBuffer := bytes.Buffer{}
+	err = dst.Recv(context.Background(), pipeReader, "fs", &errBuffer)
+	if err != nil {
+		t.Fatalf("failed to receive: %s %s", err, errBuffer.String())
+	}
+	err = <-errch
+	if err != nil {
+		t.Fatalf("failed to send: %s", err)
+	}
+	err = dst.ApplyPrelude(received, "fs")
+	if err != nil {
+		t.Fatalf("failed to apply prelude: %s", err)
+	}
+
+	filesystem, err := dst.DiscoverSystem("fs")
+	if err != nil {
+		t.Fatalf("failed to discover received filesystem: %s", err)
+	}
+	if len(filesystem.Snapshots) != 1 || filesystem.Snapshots[0].Id != "snap" {
+		t.Fatalf("expected to receive snap, got %+v", filesystem.Snapshots)
+	}
+	if !reflect.DeepEqual(filesystem.Snapshots[0].Metadata, metadata) {
+		t.Errorf("expected metadata %v, got %v", metadata, filesystem.Snapshots[0].Metadata)
+	}
+}
@@ -302,8 +302,15 @@ func downloadPartialS3Bucket(f *FsMachine, svc *s3.S3, bucketName, destPath, tra
 	log.Debugf("[pkg/fsm/s3.go.downloadPartialS3Bucket] Ok, files deleted. Will download files now.")
 	completed := make(chan types.ItemData, len(filesToDownload))
 	sem := make(chan bool, 100)
+	transfer := f.currentTransfer()
 	// loop over the files marked for download
 	for _, item := range filesToDownload {
+		// a paused pull finishes the files it's started, and waits before
+		// starting any more
+		err := transfer.waitWhilePaused()
+		if err != nil {
+			return false, nil, err
+		}
 		sem <- true
 		f.transferUpdates <- types.TransferUpdate{
 			Kind: types.TransferNextS3File,
@@ -328,7 +335,7 @@ func downloadPartialS3Bucket(f *FsMachine, svc *s3.S3, bucketName, destPath, tra
 					<-sem
 					return
 				}
-				innerError = downloadS3Object(f.transferUpdates, downloader, sent, startTime, *item.Key, *item.VersionId, bucketName, destPath, *item.Size)
+				innerError = downloadS3Object(transfer.ctx, f.transferUpdates, downloader, sent, startTime, *item.Key, *item.VersionId, bucketName, destPath, *item.Size)
 				if innerError == nil {
 					f.transferUpdates <- types.TransferUpdate{
 						Kind: types.TransferFinishedS3File,
@@ -345,6 +352,16 @@ func downloadPartialS3Bucket(f *FsMachine, svc *s3.S3, bucketName, destPath, tra
 					<-sem
 					return
 				}
+				if transfer.cancelled() {
+					completed <- types.ItemData{
+						Name:      *item.Key,
+						VersionId: *item.VersionId,
+						Size:      *item.Size,
+						Err:       errTransferCancelled,
+					}
+					<-sem
+					return
+				}
 				f.transferUpdates <- types.TransferUpdate{
 					Kind: types.TransferS3Stuck,
 					Changes: types.TransferPollResult{
@@ -383,6 +400,8 @@ func downloadPartialS3Bucket(f *FsMachine, svc *s3.S3, bucketName, destPath, tra
 				log.Debugf("[pkg/fsm/s3.go.downloadPartialS3Bucket] Finished downloading!")
 				return len(filesToDelete) > 0 || fileCount > 0, currentKeyVersions, nil
 			}
+		case <-transfer.ctx.Done():
+			return false, nil, errTransferCancelled
 		case item := <-completed:
 			if item.Err != nil {
 				return false, nil, item.Err
@@ -418,7 +437,7 @@ func (pw *progressWriter) WriteAt(p []byte, off int64) (int, error) {
 	return pw.writer.WriteAt(p, off)
 }
 
-func downloadS3Object(updates chan types.TransferUpdate, downloader *s3manager.Downloader, startSent int64, startTime time.Time, key, versionId, bucket, destPath string, fileSize int64) error {
+func downloadS3Object(ctx context.Context, updates chan types.TransferUpdate, downloader *s3manager.Downloader, startSent int64, startTime time.Time, key, versionId, bucket, destPath string, fileSize int64) error {
 	fpath := fmt.Sprintf("%s/%s", destPath, key)
 	directoryPath := fpath[:strings.LastIndex(fpath, "/")]
 	err := os.MkdirAll(directoryPath, 0666)
@@ -437,10 +456,11 @@ func downloadS3Object(updates chan types.TransferUpdate, downloader *s3manager.D
 		startTime: startTime,
 	}
 	var size int64
-	context, cancel := context.WithCancel(context.Background())
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 	done := make(chan error)
 	go func() {
-		_, err := downloader.DownloadWithContext(context, writer, &s3.GetObjectInput{
+		_, err := downloader.DownloadWithContext(ctx, writer, &s3.GetObjectInput{
 			Bucket:    &bucket,
 			Key:       &key,
 			VersionId: &versionId,
@@ -546,9 +566,15 @@ func updateS3Files(f *FsMachine, keyToVersionIds map[string]string, files []type
 			}
 		}
 	}
+	transfer := f.currentTransfer()
 	for _, file := range filtered {
+		// a paused push finishes the file it's on, and waits before the next
+		err := transfer.waitWhilePaused()
+		if err != nil {
+			return nil, err
+		}
 		path := fmt.Sprintf("%s/%s", pathToMount, file.Key)
-		versionId, err := uploadFileToS3(path, file.Key, bucket, uploader)
+		versionId, err := uploadFileToS3(transfer.ctx, path, file.Key, bucket, uploader)
 		if err != nil {
 			return nil, err
 		}
@@ -564,14 +590,14 @@ func updateS3Files(f *FsMachine, keyToVersionIds map[string]string, files []type
 	return keyToVersionIds, nil
 }
 
-func uploadFileToS3(path, key, bucket string, uploader *s3manager.Uploader) (string, error) {
+func uploadFileToS3(ctx context.Context, path, key, bucket string, uploader *s3manager.Uploader) (string, error) {
 	file, err := os.Open(path)
 	if err != nil {
 		return "", err
 	}
 	defer file.Close()
 
-	output, err := uploader.Upload(&s3manager.UploadInput{
+	output, err := uploader.UploadWithContext(ctx, &s3manager.UploadInput{
 		Bucket: aws.String(bucket),
 		Key:    aws.String(key),
 		Body:   file,
@@ -147,6 +147,17 @@ func canApply(fromSnaps []*types.Snapshot, toSnaps []*types.Snapshot) (*snapshot
 
 }
 
+// CanApply is canApply for callers outside this package, such as importing
+// a bundle. It returns the latest snapshot the two have in common, which is
+// nil if toSnaps is empty.
+func CanApply(fromSnaps []*types.Snapshot, toSnaps []*types.Snapshot) (*types.Snapshot, error) {
+	snapRange, err := canApply(fromSnaps, toSnaps)
+	if err != nil {
+		return nil, err
+	}
+	return snapRange.fromSnap, nil
+}
+
 type snapshotRange struct {
 	fromSnap *types.Snapshot
 	toSnap   *types.Snapshot
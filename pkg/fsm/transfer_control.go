@@ -0,0 +1,225 @@
+package fsm
+
+import (
+	"fmt"
+	"io"
+	"sync"
+
+	"golang.org/x/net/context"
+
+	"github.com/dotmesh-oss/dotmesh/pkg/types"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrNoSuchTransfer is returned by ControlTransfer when the state machine
+// isn't running the transfer it's asked about
+var ErrNoSuchTransfer = fmt.Errorf("no such transfer in progress")
+
+// errTransferCancelled is what the parts of a transfer return once it's been
+// cancelled
+var errTransferCancelled = fmt.Errorf("transfer cancelled")
+
+// the actions ControlTransfer takes
+const (
+	TransferActionCancel = "cancel"
+	TransferActionPause  = "pause"
+	TransferActionResume = "resume"
+)
+
+// transferControl lets a push or pull that a state machine is running be
+// cancelled, paused or resumed from outside it. The state function running
+// the transfer passes ctx to whatever it starts (HTTP requests, zfs send and
+// recv, S3 downloads) so that cancelling stops them, gives canceller to
+// utils.Pipe, and reads streams through reader so that they can be paused.
+type transferControl struct {
+	transferRequestId string
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	// one "cancel-transfer" event is sent here when the transfer is
+	// cancelled, for the utils.Pipe copying the current stream
+	canceller chan *types.Event
+
+	mu     sync.Mutex
+	paused bool
+	// closed when a paused transfer is resumed
+	resumed chan struct{}
+	// what the transfer's status was before it was paused
+	statusBeforePause string
+}
+
+// startTransferControl is called by the state function running a transfer
+// once it starts, making it controllable by ControlTransfer until
+// stopTransferControl is called
+func (f *FsMachine) startTransferControl(transferRequestId string) *transferControl {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &transferControl{
+		transferRequestId: transferRequestId,
+		ctx:               ctx,
+		cancel:            cancel,
+		canceller:         make(chan *types.Event, 1),
+	}
+	f.transferControlMu.Lock()
+	defer f.transferControlMu.Unlock()
+	f.transferControl = c
+	return c
+}
+
+func (f *FsMachine) stopTransferControl() {
+	f.transferControlMu.Lock()
+	defer f.transferControlMu.Unlock()
+	if f.transferControl != nil {
+		// release anything still waiting on the context
+		f.transferControl.cancel()
+		f.transferControl = nil
+	}
+}
+
+// currentTransfer returns the control of the transfer in progress. It's
+// never nil, so that code shared with transfers that can't be controlled
+// can use it without checking.
+func (f *FsMachine) currentTransfer() *transferControl {
+	f.transferControlMu.Lock()
+	defer f.transferControlMu.Unlock()
+	if f.transferControl == nil {
+		return &transferControl{
+			ctx:       context.Background(),
+			cancel:    func() {},
+			canceller: make(chan *types.Event),
+		}
+	}
+	return f.transferControl
+}
+
+// ControlTransfer cancels, pauses or resumes the transfer with the given id,
+// if it's the one this state machine is running. It returns
+// ErrNoSuchTransfer if it isn't.
+//
+// A cancelled transfer stops as soon as whatever it's waiting on notices,
+// and the state machine goes back to the state it was in before; the commits
+// already transferred are kept. A paused transfer keeps its connections
+// open, but stops reading from them until it's resumed.
+func (f *FsMachine) ControlTransfer(transferRequestId, action string) error {
+	f.transferControlMu.Lock()
+	c := f.transferControl
+	f.transferControlMu.Unlock()
+	if c == nil || c.transferRequestId != transferRequestId {
+		return ErrNoSuchTransfer
+	}
+	if c.ctx.Err() != nil {
+		return fmt.Errorf("transfer %s has already been cancelled", transferRequestId)
+	}
+
+	log.WithFields(log.Fields{
+		"filesystem_id": f.filesystemId,
+		"transfer_id":   transferRequestId,
+		"action":        action,
+	}).Info("[ControlTransfer] controlling transfer")
+
+	switch action {
+	case TransferActionCancel:
+		c.cancel()
+		select {
+		case c.canceller <- &types.Event{Name: "cancel-transfer"}:
+		default:
+			// already told
+		}
+		// wake anything that's paused, so that it notices
+		c.resume()
+	case TransferActionPause:
+		status := f.getCurrentPollResult().Status
+		c.mu.Lock()
+		if c.paused {
+			c.mu.Unlock()
+			return fmt.Errorf("transfer %s is already paused", transferRequestId)
+		}
+		c.paused = true
+		c.resumed = make(chan struct{})
+		c.statusBeforePause = status
+		c.mu.Unlock()
+		f.updateTransfer("paused", "")
+	case TransferActionResume:
+		status, ok := c.resume()
+		if !ok {
+			return fmt.Errorf("transfer %s isn't paused", transferRequestId)
+		}
+		f.updateTransfer(status, "")
+	default:
+		return fmt.Errorf("unknown transfer action %q", action)
+	}
+	return nil
+}
+
+// resume unpauses the transfer, returning the status it had before it was
+// paused, and false if it wasn't
+func (c *transferControl) resume() (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.paused {
+		return "", false
+	}
+	c.paused = false
+	close(c.resumed)
+	return c.statusBeforePause, true
+}
+
+func (c *transferControl) cancelled() bool {
+	return c.ctx.Err() != nil
+}
+
+// waitWhilePaused blocks until the transfer isn't paused, returning
+// errTransferCancelled if it's cancelled
+func (c *transferControl) waitWhilePaused() error {
+	c.mu.Lock()
+	paused, resumed := c.paused, c.resumed
+	c.mu.Unlock()
+	if paused {
+		select {
+		case <-resumed:
+		case <-c.ctx.Done():
+		}
+	}
+	if c.cancelled() {
+		return errTransferCancelled
+	}
+	return nil
+}
+
+// reader wraps r so that reading from it waits while the transfer is paused
+func (c *transferControl) reader(r io.Reader) io.Reader {
+	return &pausableReader{r: r, c: c}
+}
+
+type pausableReader struct {
+	r io.Reader
+	c *transferControl
+}
+
+func (p *pausableReader) Read(b []byte) (int, error) {
+	err := p.c.waitWhilePaused()
+	if err != nil {
+		return 0, err
+	}
+	return p.r.Read(b)
+}
+
+// Close closes the underlying reader, if it can be, so that utils.Pipe can
+// close it
+func (p *pausableReader) Close() error {
+	if c, ok := p.r.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// transferCancelled is what a transfer's state function returns once the
+// transfer has been cancelled, leaving the state machine to discover what
+// it was left with and carry on as it was
+func (f *FsMachine) transferCancelled() (*types.Event, StateFn) {
+	log.WithField("filesystem_id", f.filesystemId).Info("[transferCancelled] transfer cancelled")
+	f.updateTransfer("cancelled", "Cancelled by request")
+	return &types.Event{
+		Name: "transfer-cancelled",
+	}, discoveringState
+}
@@ -0,0 +1,112 @@
+package fsm
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/dotmesh-oss/dotmesh/pkg/types"
+)
+
+// testTransferMachine returns a state machine with something answering its
+// transfer updates, as updateEtcdAboutTransfers would
+func testTransferMachine(t *testing.T) (*FsMachine, chan types.TransferUpdate) {
+	f := &FsMachine{filesystemId: "fs", transferUpdates: make(chan types.TransferUpdate)}
+	updates := make(chan types.TransferUpdate, 10)
+	go func() {
+		for update := range f.transferUpdates {
+			if update.Kind == types.TransferGetCurrentPollResult {
+				update.GetResult <- types.TransferPollResult{Status: "pushing"}
+				continue
+			}
+			updates <- update
+		}
+	}()
+	t.Cleanup(func() { close(f.transferUpdates) })
+	return f, updates
+}
+
+func TestControlTransferUnknown(t *testing.T) {
+	f, _ := testTransferMachine(t)
+	if err := f.ControlTransfer("t1", TransferActionCancel); err != ErrNoSuchTransfer {
+		t.Errorf("expected ErrNoSuchTransfer with no transfer running, got %v", err)
+	}
+	f.startTransferControl("t1")
+	defer f.stopTransferControl()
+	if err := f.ControlTransfer("t2", TransferActionCancel); err != ErrNoSuchTransfer {
+		t.Errorf("expected ErrNoSuchTransfer for another transfer, got %v", err)
+	}
+}
+
+func TestPauseAndResumeTransfer(t *testing.T) {
+	f, updates := testTransferMachine(t)
+	c := f.startTransferControl("t1")
+	defer f.stopTransferControl()
+
+	err := f.ControlTransfer("t1", TransferActionPause)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u := <-updates; u.Changes.Status != "paused" {
+		t.Errorf("expected the transfer to be marked paused, got %q", u.Changes.Status)
+	}
+
+	read := make(chan []byte)
+	go func() {
+		data, _ := ioutil.ReadAll(c.reader(bytes.NewReader([]byte("data"))))
+		read <- data
+	}()
+	select {
+	case <-read:
+		t.Fatal("read from a paused transfer")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	err = f.ControlTransfer("t1", TransferActionResume)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u := <-updates; u.Changes.Status != "pushing" {
+		t.Errorf("expected the transfer's status from before the pause back, got %q", u.Changes.Status)
+	}
+	if data := <-read; string(data) != "data" {
+		t.Errorf("expected to read the data once resumed, got %q", data)
+	}
+	if err := f.ControlTransfer("t1", TransferActionResume); err == nil {
+		t.Errorf("expected an error resuming a transfer that isn't paused")
+	}
+}
+
+func TestCancelPausedTransfer(t *testing.T) {
+	f, updates := testTransferMachine(t)
+	c := f.startTransferControl("t1")
+	defer f.stopTransferControl()
+
+	err := f.ControlTransfer("t1", TransferActionPause)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-updates
+	waited := make(chan error)
+	go func() { waited <- c.waitWhilePaused() }()
+
+	err = f.ControlTransfer("t1", TransferActionCancel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-waited; err != errTransferCancelled {
+		t.Errorf("expected a paused transfer to see it's been cancelled, got %v", err)
+	}
+	select {
+	case e := <-c.canceller:
+		if e.Name != "cancel-transfer" {
+			t.Errorf("unexpected event for utils.Pipe %v", e)
+		}
+	default:
+		t.Errorf("expected an event for utils.Pipe")
+	}
+	if err := f.ControlTransfer("t1", TransferActionCancel); err == nil {
+		t.Errorf("expected an error cancelling a transfer twice")
+	}
+}
@@ -174,6 +174,9 @@ func (f *FsMachine) applyPath(path types.PathToTopLevelFilesystem, transferFn tr
 		"", "", path.TopLevelFilesystemId, firstSnapshot,
 		transferRequestId, client, transferRequest,
 	)
+	if responseEvent.Name == "transfer-cancelled" {
+		return responseEvent, nextState
+	}
 	if !(responseEvent.Name == "finished-push" ||
 		responseEvent.Name == "finished-pull" || responseEvent.Name == "peer-up-to-date") {
 		msg := fmt.Sprintf(
@@ -221,6 +224,9 @@ func (f *FsMachine) applyPath(path types.PathToTopLevelFilesystem, transferFn tr
 			clone.Clone.FilesystemId, nextOrigin.SnapshotId,
 			transferRequestId, client, transferRequest,
 		)
+		if responseEvent.Name == "transfer-cancelled" {
+			return responseEvent, nextState
+		}
 		if !(responseEvent.Name == "finished-push" ||
 			responseEvent.Name == "finished-pull" || responseEvent.Name == "peer-up-to-date") {
 			msg := fmt.Sprintf(
@@ -284,5 +290,7 @@ func TransferPollResultFromTransferRequest(
 		Index:  index,
 		Total:  total,
 		Status: status,
+
+		Priority: transferRequest.Priority,
 	}
 }
@@ -35,6 +35,12 @@ type StateManager interface {
 	SnapshotsForCurrentMaster(filesystemId string) ([]types.Snapshot, error)
 
 	AddressesForServer(server string) []string
+	// IsDesignatedReplica says whether this node should hold a copy of the
+	// filesystem, according to its placement policy
+	IsDesignatedReplica(filesystemId string) bool
+	// EncryptionKey is the key of an encrypted filesystem's dot, as given to
+	// this node or found in its key directory
+	EncryptionKey(filesystemId string) (string, error)
 
 	RegisterNewFork(originFilesystemId, originSnapshotId, forkNamespace, forkName, forkFilesystemId string) error
 
@@ -107,8 +113,14 @@ type FsMachine struct {
 	dirtyDelta              int64
 	sizeBytes               int64
 	transferUpdates         chan types.TransferUpdate
+	// whether the key of an encrypted filesystem is loaded here, as ZFS
+	// reports it, "" if it isn't encrypted
+	keyStatus string
 	// only to be accessed via the updateEtcdAboutTransfers goroutine!
 	currentPollResult types.TransferPollResult
+	// the push or pull in progress, for ControlTransfer
+	transferControl   *transferControl
+	transferControlMu sync.Mutex
 
 	// state machine metadata
 	// Moved from InMemoryState:
@@ -154,6 +166,27 @@ func castToMetadata(val interface{}) (map[string]string, error) {
 	}
 }
 
+// castToStrings is castToMetadata for lists, which come back from a round
+// trip through JSON as []interface{}
+func castToStrings(val interface{}) ([]string, error) {
+	switch v := val.(type) {
+	case []string:
+		return v, nil
+	case []interface{}:
+		strs := []string{}
+		for _, item := range v {
+			str, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("not a string: %v", item)
+			}
+			strs = append(strs, str)
+		}
+		return strs, nil
+	default:
+		return nil, fmt.Errorf("unknown type: %v", val)
+	}
+}
+
 type transferFn func(
 	f *FsMachine,
 	fromFilesystemId, fromSnapshotId, toFilesystemId, toSnapshotId string,
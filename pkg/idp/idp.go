@@ -0,0 +1,64 @@
+// Package idp checks who someone is with an identity provider, rather than
+// a password or API key dotmesh keeps: an LDAP directory, which they give
+// their password to, or an OpenID Connect issuer, whose ID tokens they give.
+package idp
+
+import (
+	"errors"
+	"sort"
+	"strings"
+)
+
+// ErrNotSupported is returned by a Provider for a way of authenticating it
+// doesn't do, e.g. tokens given to an LDAP provider
+var ErrNotSupported = errors.New("not supported by this identity provider")
+
+// Identity is who a provider says someone is
+type Identity struct {
+	// Provider is the Name of the provider that vouched for them
+	Provider string
+	Username string
+	Email    string
+	// Groups are the groups they're in, as the provider names them
+	Groups []string
+}
+
+// Provider is an identity provider
+type Provider interface {
+	// Name is what users made on their first login with this provider are
+	// labelled with, e.g. "ldap"
+	Name() string
+	// AuthenticatePassword checks a username and password
+	AuthenticatePassword(username, password string) (*Identity, error)
+	// AuthenticateToken checks a token, and says whose it is
+	AuthenticateToken(token string) (*Identity, error)
+}
+
+// GroupName is what a group is called in group mappings: the value of the
+// first part of an LDAP distinguished name, so "cn=data,ou=groups,dc=example"
+// is "data", and anything else as it is.
+func GroupName(group string) string {
+	first := strings.SplitN(group, ",", 2)[0]
+	parts := strings.SplitN(first, "=", 2)
+	if len(parts) != 2 || strings.ContainsAny(parts[0], " \t") {
+		return group
+	}
+	return strings.TrimSpace(parts[1])
+}
+
+// Namespaces are the namespaces that members of groups administer, given
+// mappings from group names to namespaces
+func Namespaces(groups []string, mappings map[string]string) []string {
+	seen := map[string]bool{}
+	namespaces := []string{}
+	for _, group := range groups {
+		namespace, ok := mappings[GroupName(group)]
+		if !ok || seen[namespace] {
+			continue
+		}
+		seen[namespace] = true
+		namespaces = append(namespaces, namespace)
+	}
+	sort.Strings(namespaces)
+	return namespaces
+}
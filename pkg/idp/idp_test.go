@@ -0,0 +1,210 @@
+package idp_test
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dotmesh-oss/dotmesh/pkg/idp"
+	"github.com/dotmesh-oss/dotmesh/pkg/idp/idptest"
+)
+
+func TestGroupName(t *testing.T) {
+	for group, expected := range map[string]string{
+		"cn=data,ou=groups,dc=example,dc=com": "data",
+		"CN=Data Science,OU=Groups":           "Data Science",
+		"data":                                "data",
+		"/org/data":                           "/org/data",
+		"a group = b":                         "a group = b",
+	} {
+		if got := idp.GroupName(group); got != expected {
+			t.Errorf("GroupName(%q) = %q, expected %q", group, got, expected)
+		}
+	}
+}
+
+func TestNamespaces(t *testing.T) {
+	got := idp.Namespaces(
+		[]string{"cn=ml,ou=groups", "cn=data,ou=groups", "data", "other"},
+		map[string]string{"data": "datateam", "ml": "analytics"},
+	)
+	expected := []string{"analytics", "datateam"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("got %v, expected %v", got, expected)
+	}
+}
+
+func TestLDAP(t *testing.T) {
+	directory, err := idptest.NewLDAP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer directory.Close()
+	directory.AddUser("uid=alice,ou=people,dc=example,dc=com", "wonderland", map[string][]string{
+		"mail":     {"alice@example.com"},
+		"memberOf": {"cn=data,ou=groups,dc=example,dc=com", "cn=ops,ou=groups,dc=example,dc=com"},
+	})
+
+	provider := &idp.LDAP{
+		URL:            directory.URL,
+		UserDN:         "uid=%s,ou=people,dc=example,dc=com",
+		GroupAttribute: "memberOf",
+	}
+	identity, err := provider.AuthenticatePassword("alice", "wonderland")
+	if err != nil {
+		t.Fatalf("failed to authenticate: %s", err)
+	}
+	expected := &idp.Identity{
+		Provider: "ldap",
+		Username: "alice",
+		Email:    "alice@example.com",
+		Groups:   []string{"cn=data,ou=groups,dc=example,dc=com", "cn=ops,ou=groups,dc=example,dc=com"},
+	}
+	// values of an attribute are a set, so come in any order
+	sort.Strings(identity.Groups)
+	if !reflect.DeepEqual(identity, expected) {
+		t.Errorf("got %#v, expected %#v", identity, expected)
+	}
+
+	for _, creds := range [][2]string{{"alice", "wrong"}, {"alice", ""}, {"bob", "wonderland"}, {"", ""}} {
+		_, err = provider.AuthenticatePassword(creds[0], creds[1])
+		if err == nil {
+			t.Errorf("authenticated as %q with password %q", creds[0], creds[1])
+		}
+	}
+
+	_, err = provider.AuthenticateToken("a.b.c")
+	if err != idp.ErrNotSupported {
+		t.Errorf("expected tokens not to be supported, got %v", err)
+	}
+}
+
+func newOIDC(t *testing.T) (*idptest.OIDC, *idp.OIDC) {
+	issuer, err := idptest.NewOIDC("dotmesh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return issuer, &idp.OIDC{
+		Issuer:        issuer.Issuer(),
+		ClientID:      "dotmesh",
+		UsernameClaim: "preferred_username",
+		GroupsClaim:   "groups",
+	}
+}
+
+func TestOIDC(t *testing.T) {
+	issuer, provider := newOIDC(t)
+	defer issuer.Close()
+
+	token, err := issuer.Token(map[string]interface{}{
+		"preferred_username": "alice",
+		"email":              "alice@example.com",
+		"groups":             []string{"data"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	identity, err := provider.AuthenticateToken(token)
+	if err != nil {
+		t.Fatalf("failed to authenticate: %s", err)
+	}
+	expected := &idp.Identity{Provider: "oidc", Username: "alice", Email: "alice@example.com", Groups: []string{"data"}}
+	if !reflect.DeepEqual(identity, expected) {
+		t.Errorf("got %#v, expected %#v", identity, expected)
+	}
+
+	token, err = issuer.Token(map[string]interface{}{"preferred_username": "bob", "groups": "data"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	identity, err = provider.AuthenticateToken(token)
+	if err != nil {
+		t.Fatalf("failed to authenticate: %s", err)
+	}
+	if identity.Username != "bob" || len(identity.Groups) != 0 {
+		t.Errorf("expected bob in no groups, got %#v", identity)
+	}
+}
+
+func TestOIDCRejectsBadTokens(t *testing.T) {
+	issuer, provider := newOIDC(t)
+	defer issuer.Close()
+
+	for name, claims := range map[string]map[string]interface{}{
+		"expired":            {"preferred_username": "alice", "exp": time.Now().Add(-time.Minute).Unix()},
+		"no expiry":          {"preferred_username": "alice", "exp": nil},
+		"wrong issuer":       {"preferred_username": "alice", "iss": "https://elsewhere.example.com"},
+		"wrong client":       {"preferred_username": "alice", "aud": []string{"someone-else"}},
+		"no username":        {"email": "alice@example.com"},
+		"a numeric username": {"preferred_username": 42},
+	} {
+		token, err := issuer.Token(claims)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = provider.AuthenticateToken(token)
+		if err == nil {
+			t.Errorf("accepted a token with %s", name)
+		}
+	}
+
+	token, err := issuer.Token(map[string]interface{}{"preferred_username": "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(token, ".")
+	_, err = provider.AuthenticateToken(parts[0] + "." + parts[1] + ".AAAA")
+	if err == nil {
+		t.Errorf("accepted a token with a bad signature")
+	}
+	_, err = provider.AuthenticatePassword("alice", "wonderland")
+	if err != idp.ErrNotSupported {
+		t.Errorf("expected passwords not to be supported, got %v", err)
+	}
+}
+
+func TestDeviceLogin(t *testing.T) {
+	issuer, provider := newOIDC(t)
+	defer issuer.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	login, err := idp.StartDeviceLogin(ctx, nil, issuer.Issuer(), "dotmesh")
+	if err != nil {
+		t.Fatalf("failed to start logging in: %s", err)
+	}
+	if login.UserCode == "" || login.VerificationURI == "" {
+		t.Fatalf("no user code or verification URI in %#v", login)
+	}
+	err = issuer.Approve(login.UserCode, map[string]interface{}{"preferred_username": "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := login.Wait(ctx)
+	if err != nil {
+		t.Fatalf("failed to log in: %s", err)
+	}
+	identity, err := provider.AuthenticateToken(token)
+	if err != nil {
+		t.Fatalf("failed to authenticate: %s", err)
+	}
+	if identity.Username != "alice" {
+		t.Errorf("logged in as %s, expected alice", identity.Username)
+	}
+
+	login, err = idp.StartDeviceLogin(ctx, nil, issuer.Issuer(), "dotmesh")
+	if err != nil {
+		t.Fatalf("failed to start logging in: %s", err)
+	}
+	err = issuer.Deny(login.UserCode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = login.Wait(ctx)
+	if err == nil {
+		t.Errorf("logged in after being denied")
+	}
+}
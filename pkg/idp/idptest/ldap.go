@@ -0,0 +1,167 @@
+package idptest
+
+import (
+	"net"
+	"strings"
+	"sync"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+)
+
+// LDAP is a directory which people can bind to as themselves, with a
+// password, and read their own entry
+type LDAP struct {
+	// URL to connect to it at, ldap://127.0.0.1:<port>
+	URL string
+
+	listener net.Listener
+	mu       sync.Mutex
+	entries  map[string]*ldapEntry
+}
+
+type ldapEntry struct {
+	password   string
+	attributes map[string][]string
+}
+
+// NewLDAP starts a directory. Close it when done.
+func NewLDAP() (*LDAP, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	l := &LDAP{
+		URL:      "ldap://" + listener.Addr().String(),
+		listener: listener,
+		entries:  map[string]*ldapEntry{},
+	}
+	go l.serve()
+	return l, nil
+}
+
+// AddUser adds an entry for someone who can bind as dn with password
+func (l *LDAP) AddUser(dn, password string, attributes map[string][]string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries[strings.ToLower(dn)] = &ldapEntry{password: password, attributes: attributes}
+}
+
+// Close stops the directory
+func (l *LDAP) Close() error {
+	return l.listener.Close()
+}
+
+func (l *LDAP) serve() {
+	for {
+		conn, err := l.listener.Accept()
+		if err != nil {
+			return
+		}
+		go l.serveConn(conn)
+	}
+}
+
+// serveConn answers binds and searches until the client unbinds, or sends
+// anything else
+func (l *LDAP) serveConn(conn net.Conn) {
+	defer conn.Close()
+	bound := ""
+	for {
+		request, err := ber.ReadPacket(conn)
+		if err != nil || len(request.Children) < 2 {
+			return
+		}
+		id := request.Children[0].Value
+		op := request.Children[1]
+		var responses []*ber.Packet
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			var code uint16
+			bound, code = l.bind(op)
+			responses = append(responses, ldapResult(ldap.ApplicationBindResponse, code))
+		case ldap.ApplicationSearchRequest:
+			entry, code := l.search(bound, op)
+			if entry != nil {
+				responses = append(responses, entry)
+			}
+			responses = append(responses, ldapResult(ldap.ApplicationSearchResultDone, code))
+		default:
+			return
+		}
+		for _, response := range responses {
+			message := ber.NewSequence("LDAP Response")
+			message.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, "Message ID"))
+			message.AppendChild(response)
+			_, err = conn.Write(message.Bytes())
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+// bind checks a simple bind, returning who's bound after it
+func (l *LDAP) bind(request *ber.Packet) (string, uint16) {
+	if len(request.Children) != 3 || request.Children[2].ClassType != ber.ClassContext || request.Children[2].Tag != 0 {
+		return "", ldap.LDAPResultUnwillingToPerform
+	}
+	dn := strings.ToLower(ber.DecodeString(request.Children[1].Data.Bytes()))
+	password := request.Children[2].Data.String()
+	l.mu.Lock()
+	entry, ok := l.entries[dn]
+	l.mu.Unlock()
+	if !ok || password == "" || entry.password != password {
+		return "", ldap.LDAPResultInvalidCredentials
+	}
+	return dn, ldap.LDAPResultSuccess
+}
+
+// search reads the entry of whoever's bound, which is all they're allowed
+// to read
+func (l *LDAP) search(bound string, request *ber.Packet) (*ber.Packet, uint16) {
+	if len(request.Children) != 8 {
+		return nil, ldap.LDAPResultUnwillingToPerform
+	}
+	base := ber.DecodeString(request.Children[0].Data.Bytes())
+	dn := strings.ToLower(base)
+	if bound == "" || dn != bound {
+		return nil, ldap.LDAPResultInsufficientAccessRights
+	}
+	l.mu.Lock()
+	entry, ok := l.entries[dn]
+	l.mu.Unlock()
+	if !ok {
+		return nil, ldap.LDAPResultNoSuchObject
+	}
+
+	result := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "Search Result Entry")
+	result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, base, "Object Name"))
+	attributes := ber.NewSequence("Attributes")
+	for _, requested := range request.Children[7].Children {
+		for name, values := range entry.attributes {
+			if !strings.EqualFold(name, ber.DecodeString(requested.Data.Bytes())) {
+				continue
+			}
+			attribute := ber.NewSequence("Attribute")
+			attribute.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, "Type"))
+			set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "Values")
+			for _, v := range values {
+				set.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, v, "Value"))
+			}
+			attribute.AppendChild(set)
+			attributes.AppendChild(attribute)
+		}
+	}
+	result.AppendChild(attributes)
+	return result, ldap.LDAPResultSuccess
+}
+
+// ldapResult is a response of the given operation, with just a result code
+func ldapResult(op ber.Tag, code uint16) *ber.Packet {
+	result := ber.Encode(ber.ClassApplication, ber.TypeConstructed, op, nil, "Result")
+	result.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), "Result Code"))
+	result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Matched DN"))
+	result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Diagnostic Message"))
+	return result
+}
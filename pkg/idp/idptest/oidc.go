@@ -0,0 +1,217 @@
+// Package idptest has identity providers for tests: an OpenID Connect issuer
+// and an LDAP directory, which run in the test's process.
+package idptest
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+// OIDC is an OpenID Connect issuer which signs whatever ID tokens it's asked
+// to, and lets devices log in when told to
+type OIDC struct {
+	*httptest.Server
+	ClientID string
+
+	mu     sync.Mutex
+	key    *rsa.PrivateKey
+	kid    string
+	logins map[string]*deviceLogin
+}
+
+type deviceLogin struct {
+	userCode string
+	claims   map[string]interface{}
+	denied   bool
+}
+
+// NewOIDC starts an issuer of ID tokens for clientID. Close it when done.
+func NewOIDC(clientID string) (*OIDC, error) {
+	o := &OIDC{ClientID: clientID, logins: map[string]*deviceLogin{}}
+	err := o.newKey()
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", o.serveDiscovery)
+	mux.HandleFunc("/jwks", o.serveJWKS)
+	mux.HandleFunc("/device", o.serveDeviceAuthorization)
+	mux.HandleFunc("/token", o.serveToken)
+	o.Server = httptest.NewServer(mux)
+	return o, nil
+}
+
+// Issuer is what the ID tokens say they're from
+func (o *OIDC) Issuer() string {
+	return o.URL
+}
+
+func (o *OIDC) newKey() error {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return err
+	}
+	kid, err := randomString(4)
+	if err != nil {
+		return err
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.key = key
+	o.kid = kid
+	return nil
+}
+
+// Token signs an ID token with claims, filling in iss, aud, iat and exp
+// (an hour away) if they're not given
+func (o *OIDC) Token(claims map[string]interface{}) (string, error) {
+	full := jwt.MapClaims{
+		"iss": o.Issuer(),
+		"aud": o.ClientID,
+		"iat": time.Now().Unix(),
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}
+	for k, v := range claims {
+		full[k] = v
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, full)
+	token.Header["kid"] = o.kid
+	return token.SignedString(o.key)
+}
+
+// Approve lets the device that was given userCode log in, with an ID token
+// with claims
+func (o *OIDC) Approve(userCode string, claims map[string]interface{}) error {
+	return o.decide(userCode, claims, false)
+}
+
+// Deny refuses to let the device that was given userCode log in
+func (o *OIDC) Deny(userCode string) error {
+	return o.decide(userCode, nil, true)
+}
+
+func (o *OIDC) decide(userCode string, claims map[string]interface{}, denied bool) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for _, login := range o.logins {
+		if login.userCode == userCode {
+			login.claims = claims
+			login.denied = denied
+			return nil
+		}
+	}
+	return fmt.Errorf("no login with user code %s", userCode)
+}
+
+func (o *OIDC) serveDiscovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{
+		"issuer":                        o.Issuer(),
+		"jwks_uri":                      o.URL + "/jwks",
+		"token_endpoint":                o.URL + "/token",
+		"device_authorization_endpoint": o.URL + "/device",
+	})
+}
+
+func (o *OIDC) serveJWKS(w http.ResponseWriter, r *http.Request) {
+	o.mu.Lock()
+	key := o.key.PublicKey
+	kid := o.kid
+	o.mu.Unlock()
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": kid,
+			"use": "sig",
+			"alg": "RS256",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}},
+	})
+}
+
+func (o *OIDC) serveDeviceAuthorization(w http.ResponseWriter, r *http.Request) {
+	if r.FormValue("client_id") != o.ClientID {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_client"})
+		return
+	}
+	deviceCode, err := randomString(16)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	userCode, err := randomString(4)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	userCode = strings.ToUpper(userCode)
+	o.mu.Lock()
+	o.logins[deviceCode] = &deviceLogin{userCode: userCode}
+	o.mu.Unlock()
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"device_code":               deviceCode,
+		"user_code":                 userCode,
+		"verification_uri":          o.URL + "/activate",
+		"verification_uri_complete": o.URL + "/activate?user_code=" + userCode,
+		"expires_in":                60,
+		"interval":                  1,
+	})
+}
+
+func (o *OIDC) serveToken(w http.ResponseWriter, r *http.Request) {
+	if r.FormValue("grant_type") != "urn:ietf:params:oauth:grant-type:device_code" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "unsupported_grant_type"})
+		return
+	}
+	o.mu.Lock()
+	login, ok := o.logins[r.FormValue("device_code")]
+	o.mu.Unlock()
+	switch {
+	case !ok:
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "expired_token"})
+	case login.denied:
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "access_denied"})
+	case login.claims == nil:
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "authorization_pending"})
+	default:
+		token, err := o.Token(login.claims)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{
+			"id_token":     token,
+			"access_token": token,
+			"token_type":   "Bearer",
+		})
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
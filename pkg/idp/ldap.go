@@ -0,0 +1,140 @@
+package idp
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// LDAP authenticates users by binding to a directory as them, then reads
+// their groups and email address from their entry
+type LDAP struct {
+	// URL of the directory, ldap://host[:port] or ldaps://host[:port]
+	URL string
+	// UserDN is the distinguished name of a user's entry, with %s for their
+	// username, e.g. "uid=%s,ou=people,dc=example,dc=com"
+	UserDN string
+	// GroupAttribute of a user's entry lists the groups they're in, as
+	// distinguished names, e.g. "memberOf"
+	GroupAttribute string
+	// TLSConfig is used for ldaps:// URLs, nil for the defaults
+	TLSConfig *tls.Config
+	// Timeout for connecting, and for each request to the directory
+	Timeout time.Duration
+}
+
+var _ Provider = &LDAP{}
+
+const (
+	ldapDefaultTimeout = 10 * time.Second
+	ldapMailAttribute  = "mail"
+)
+
+func (l *LDAP) Name() string {
+	return "ldap"
+}
+
+func (l *LDAP) AuthenticateToken(token string) (*Identity, error) {
+	return nil, ErrNotSupported
+}
+
+func (l *LDAP) AuthenticatePassword(username, password string) (*Identity, error) {
+	if username == "" || password == "" {
+		// a bind without a password is anonymous, and always succeeds
+		return nil, fmt.Errorf("LDAP authentication needs a username and password")
+	}
+	conn, err := l.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	dn := fmt.Sprintf(l.UserDN, escapeDN(username))
+	err = conn.Bind(dn, password)
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+		return nil, fmt.Errorf("Username or password doesn't match")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Unable to bind to LDAP server %s as %s: %s", l.URL, dn, err)
+	}
+
+	attributes := []string{ldapMailAttribute}
+	if l.GroupAttribute != "" {
+		attributes = append(attributes, l.GroupAttribute)
+	}
+	result, err := conn.Search(ldap.NewSearchRequest(
+		dn, ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false,
+		"(objectClass=*)", attributes, nil,
+	))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read LDAP entry %s: %s", dn, err)
+	}
+	if len(result.Entries) != 1 {
+		return nil, fmt.Errorf("Unable to read LDAP entry %s: got %d entries", dn, len(result.Entries))
+	}
+	entry := result.Entries[0]
+
+	identity := &Identity{
+		Provider: l.Name(),
+		Username: username,
+		Email:    entry.GetAttributeValue(ldapMailAttribute),
+		Groups:   []string{},
+	}
+	if l.GroupAttribute != "" {
+		identity.Groups = append(identity.Groups, entry.GetAttributeValues(l.GroupAttribute)...)
+	}
+	return identity, nil
+}
+
+func (l *LDAP) dial() (*ldap.Conn, error) {
+	u, err := url.Parse(l.URL)
+	if err != nil {
+		return nil, fmt.Errorf("Bad LDAP URL %s: %s", l.URL, err)
+	}
+	timeout := l.Timeout
+	if timeout == 0 {
+		timeout = ldapDefaultTimeout
+	}
+	options := []ldap.DialOpt{ldap.DialWithDialer(&net.Dialer{Timeout: timeout})}
+	switch u.Scheme {
+	case "ldap":
+	case "ldaps":
+		config := l.TLSConfig
+		if config == nil {
+			config = &tls.Config{ServerName: u.Hostname()}
+		}
+		options = append(options, ldap.DialWithTLSConfig(config))
+	default:
+		return nil, fmt.Errorf("Bad LDAP URL %s, expected ldap:// or ldaps://", l.URL)
+	}
+	conn, err := ldap.DialURL(l.URL, options...)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to connect to LDAP server %s: %s", l.URL, err)
+	}
+	conn.SetTimeout(timeout)
+	return conn, nil
+}
+
+// escapeDN escapes a value for use in a distinguished name, as RFC 4514 says
+func escapeDN(value string) string {
+	var b strings.Builder
+	for i, c := range value {
+		switch {
+		case strings.ContainsRune(`,+"\<>;=`, c),
+			i == 0 && (c == ' ' || c == '#'),
+			i == len(value)-1 && c == ' ':
+			b.WriteRune('\\')
+			b.WriteRune(c)
+		case c == 0:
+			b.WriteString(`\00`)
+		default:
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
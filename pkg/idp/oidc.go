@@ -0,0 +1,406 @@
+package idp
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+// OIDC authenticates users by their ID tokens from an OpenID Connect issuer
+type OIDC struct {
+	// Issuer the ID tokens must be from, whose discovery document and keys
+	// are fetched to check them
+	Issuer string
+	// ClientID that ID tokens must have been issued to
+	ClientID string
+	// UsernameClaim of ID tokens is the username, e.g. "preferred_username"
+	UsernameClaim string
+	// GroupsClaim of ID tokens lists the groups the user is in, e.g.
+	// "groups"
+	GroupsClaim string
+	// HTTPClient to fetch the discovery document and keys with, nil for the
+	// default
+	HTTPClient *http.Client
+
+	mu          sync.Mutex
+	discovery   *Discovery
+	keys        map[string]interface{}
+	keysFetched time.Time
+}
+
+var _ Provider = &OIDC{}
+
+// the issuer's keys are fetched again for an ID token signed with one we
+// don't know, but no more often than this
+const jwksRefetchInterval = time.Minute
+
+// Discovery is the part of an issuer's discovery document we use
+type Discovery struct {
+	Issuer                      string `json:"issuer"`
+	JWKSURI                     string `json:"jwks_uri"`
+	TokenEndpoint               string `json:"token_endpoint"`
+	DeviceAuthorizationEndpoint string `json:"device_authorization_endpoint"`
+}
+
+// Discover fetches an issuer's discovery document
+func Discover(ctx context.Context, client *http.Client, issuer string) (*Discovery, error) {
+	var d Discovery
+	err := getJSON(ctx, client, strings.TrimSuffix(issuer, "/")+"/.well-known/openid-configuration", &d)
+	if err != nil {
+		return nil, err
+	}
+	if d.Issuer != issuer {
+		return nil, fmt.Errorf("Issuer %s says it's %s", issuer, d.Issuer)
+	}
+	return &d, nil
+}
+
+// LooksLikeToken says whether a password is really a JWT, as ID tokens are
+func LooksLikeToken(password string) bool {
+	return strings.Count(password, ".") == 2 && !strings.ContainsAny(password, " \t\n")
+}
+
+func (o *OIDC) Name() string {
+	return "oidc"
+}
+
+func (o *OIDC) AuthenticatePassword(username, password string) (*Identity, error) {
+	return nil, ErrNotSupported
+}
+
+func (o *OIDC) AuthenticateToken(token string) (*Identity, error) {
+	if !LooksLikeToken(token) {
+		return nil, ErrNotSupported
+	}
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(token, claims, func(t *jwt.Token) (interface{}, error) {
+		switch t.Method.(type) {
+		case *jwt.SigningMethodRSA, *jwt.SigningMethodECDSA:
+		default:
+			return nil, fmt.Errorf("unexpected signing method %v", t.Header["alg"])
+		}
+		kid, _ := t.Header["kid"].(string)
+		return o.key(kid)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Invalid ID token: %s", err)
+	}
+
+	if iss, _ := claims["iss"].(string); iss != o.Issuer {
+		return nil, fmt.Errorf("ID token is from %s, not %s", iss, o.Issuer)
+	}
+	if !audienceIncludes(claims["aud"], o.ClientID) {
+		return nil, fmt.Errorf("ID token wasn't issued to %s", o.ClientID)
+	}
+	if _, ok := claims["exp"].(float64); !ok {
+		return nil, fmt.Errorf("ID token doesn't expire")
+	}
+
+	username, _ := claims[o.UsernameClaim].(string)
+	if username == "" {
+		return nil, fmt.Errorf("ID token has no %s claim", o.UsernameClaim)
+	}
+	identity := &Identity{Provider: o.Name(), Username: username, Groups: []string{}}
+	identity.Email, _ = claims["email"].(string)
+	if groups, ok := claims[o.GroupsClaim].([]interface{}); ok {
+		for _, g := range groups {
+			if group, ok := g.(string); ok {
+				identity.Groups = append(identity.Groups, group)
+			}
+		}
+	}
+	return identity, nil
+}
+
+func audienceIncludes(aud interface{}, clientID string) bool {
+	switch a := aud.(type) {
+	case string:
+		return a == clientID
+	case []interface{}:
+		for _, each := range a {
+			if s, ok := each.(string); ok && s == clientID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// key returns the issuer's public key with id kid, fetching the issuer's
+// keys if it's one we haven't seen
+func (o *OIDC) key(kid string) (interface{}, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if key, ok := lookupKey(o.keys, kid); ok {
+		return key, nil
+	}
+	if o.keys != nil && time.Since(o.keysFetched) < jwksRefetchInterval {
+		return nil, fmt.Errorf("unknown key %q", kid)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if o.discovery == nil {
+		d, err := Discover(ctx, o.HTTPClient, o.Issuer)
+		if err != nil {
+			return nil, err
+		}
+		o.discovery = d
+	}
+	keys, err := fetchJWKS(ctx, o.HTTPClient, o.discovery.JWKSURI)
+	if err != nil {
+		return nil, err
+	}
+	o.keys = keys
+	o.keysFetched = time.Now()
+
+	if key, ok := lookupKey(o.keys, kid); ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown key %q", kid)
+}
+
+func lookupKey(keys map[string]interface{}, kid string) (interface{}, bool) {
+	if key, ok := keys[kid]; ok {
+		return key, true
+	}
+	if kid == "" && len(keys) == 1 {
+		// tokens needn't say which key they're signed with if there's
+		// only one
+		for _, key := range keys {
+			return key, true
+		}
+	}
+	return nil, false
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// fetchJWKS fetches the signing keys in a JSON Web Key Set, by key id
+func fetchJWKS(ctx context.Context, client *http.Client, uri string) (map[string]interface{}, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	err := getJSON(ctx, client, uri, &set)
+	if err != nil {
+		return nil, err
+	}
+	keys := map[string]interface{}{}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("Bad key %q from %s: %s", k.Kid, uri, err)
+		}
+		if key != nil {
+			keys[k.Kid] = key
+		}
+	}
+	return keys, nil
+}
+
+// publicKey is the key as crypto/rsa or crypto/ecdsa has it, or nil for a
+// type of key we don't use
+func (k jwk) publicKey() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, nil
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+func getJSON(ctx context.Context, client *http.Client, uri string, result interface{}) error {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	req, err := http.NewRequest("GET", uri, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Unable to fetch %s: %s", uri, resp.Status)
+	}
+	err = json.NewDecoder(resp.Body).Decode(result)
+	if err != nil {
+		return fmt.Errorf("Unable to decode %s: %s", uri, err)
+	}
+	return nil
+}
+
+// DeviceLogin is a login with the OAuth device authorization grant (RFC
+// 8628), for logging in on a device without a browser: the user visits
+// VerificationURI elsewhere and enters UserCode, while Wait waits for them.
+type DeviceLogin struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int    `json:"expires_in"`
+	Interval                int    `json:"interval"`
+
+	client        *http.Client
+	clientID      string
+	tokenEndpoint string
+}
+
+// StartDeviceLogin starts logging in to an issuer as clientID
+func StartDeviceLogin(ctx context.Context, client *http.Client, issuer, clientID string) (*DeviceLogin, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	d, err := Discover(ctx, client, issuer)
+	if err != nil {
+		return nil, err
+	}
+	if d.DeviceAuthorizationEndpoint == "" {
+		return nil, fmt.Errorf("Issuer %s doesn't support logging in with a device code", issuer)
+	}
+	login := &DeviceLogin{client: client, clientID: clientID, tokenEndpoint: d.TokenEndpoint}
+	status, err := postForm(ctx, client, d.DeviceAuthorizationEndpoint, url.Values{
+		"client_id": {clientID},
+		"scope":     {"openid profile email groups"},
+	}, login)
+	if err != nil {
+		return nil, err
+	}
+	if status != http.StatusOK || login.DeviceCode == "" {
+		return nil, fmt.Errorf("Issuer %s refused to start logging in: %d", issuer, status)
+	}
+	if login.VerificationURIComplete == "" {
+		login.VerificationURIComplete = login.VerificationURI
+	}
+	return login, nil
+}
+
+// Wait waits for the user to log in, returning their ID token
+func (d *DeviceLogin) Wait(ctx context.Context) (string, error) {
+	interval := time.Duration(d.Interval) * time.Second
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	if d.ExpiresIn > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(d.ExpiresIn)*time.Second)
+		defer cancel()
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return "", fmt.Errorf("Gave up waiting to be logged in: %s", ctx.Err())
+		case <-time.After(interval):
+		}
+
+		var result struct {
+			IDToken string `json:"id_token"`
+			Error   string `json:"error"`
+		}
+		status, err := postForm(ctx, d.client, d.tokenEndpoint, url.Values{
+			"grant_type":  {"urn:ietf:params:oauth:grant-type:device_code"},
+			"device_code": {d.DeviceCode},
+			"client_id":   {d.clientID},
+		}, &result)
+		if err != nil {
+			return "", err
+		}
+		switch {
+		case status == http.StatusOK && result.IDToken != "":
+			return result.IDToken, nil
+		case result.Error == "authorization_pending":
+		case result.Error == "slow_down":
+			interval += 5 * time.Second
+		case result.Error == "access_denied":
+			return "", fmt.Errorf("Logging in was refused")
+		case result.Error == "expired_token":
+			return "", fmt.Errorf("Took too long to log in, try again")
+		default:
+			return "", fmt.Errorf("Unexpected response to logging in: %d %s", status, result.Error)
+		}
+	}
+}
+
+// postForm posts a form, decoding the JSON response into result whatever its
+// status, which it returns
+func postForm(ctx context.Context, client *http.Client, uri string, form url.Values, result interface{}) (int, error) {
+	req, err := http.NewRequest("POST", uri, strings.NewReader(form.Encode()))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	err = json.NewDecoder(resp.Body).Decode(result)
+	if err != nil {
+		return resp.StatusCode, fmt.Errorf("Unable to decode response from %s: %s", uri, err)
+	}
+	return resp.StatusCode, nil
+}
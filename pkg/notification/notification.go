@@ -40,6 +40,10 @@ type Publisher interface {
 
 	// PublishCommit informs the existence of the specified notification.
 	PublishCommit(event *types.CommitNotification) error
+
+	// Publish informs of any other kind of event, such as branches being
+	// created or transfers finishing.
+	Publish(event *types.Notification) error
 }
 
 // RegisterPublisher makes a Sender available by the provided name.
@@ -114,8 +118,24 @@ func (p *DefaultNotificationPublisher) Publishers() map[string]Publisher {
 	return ret
 }
 
-// Send - send notifications through all configured publishers
+// PublishCommit - send commit notifications through all configured publishers
 func (p *DefaultNotificationPublisher) PublishCommit(event *types.CommitNotification) error {
+	return p.publish(event.Name, func(publisher Publisher) error {
+		return publisher.PublishCommit(event)
+	})
+}
+
+// Publish - send other notifications through all configured publishers
+func (p *DefaultNotificationPublisher) Publish(event *types.Notification) error {
+	if event.Timestamp == 0 {
+		event.Timestamp = timeutil.Now().UnixNano()
+	}
+	return p.publish(string(event.Type), func(publisher Publisher) error {
+		return publisher.Publish(event)
+	})
+}
+
+func (p *DefaultNotificationPublisher) publish(eventName string, send func(Publisher) error) error {
 
 	publishersM.RLock()
 	defer publishersM.RUnlock()
@@ -128,7 +148,7 @@ func (p *DefaultNotificationPublisher) PublishCommit(event *types.CommitNotifica
 			// Max attempts exceeded.
 			if attempts >= p.config.Attempts {
 				log.WithFields(log.Fields{
-					logNotiName:      event.Name,
+					logNotiName:      eventName,
 					logPublisherName: publisherName,
 					"max attempts":   p.config.Attempts,
 				}).Info("giving up on publishing notification : max attempts exceeded")
@@ -139,7 +159,7 @@ func (p *DefaultNotificationPublisher) PublishCommit(event *types.CommitNotifica
 			if backOff > 0 {
 				log.WithFields(log.Fields{
 					"duration":       backOff,
-					logNotiName:      event.Name,
+					logNotiName:      eventName,
 					logPublisherName: publisherName,
 					"attempts":       attempts + 1,
 					"max attempts":   p.config.Attempts,
@@ -149,9 +169,9 @@ func (p *DefaultNotificationPublisher) PublishCommit(event *types.CommitNotifica
 				}
 			}
 
-			if err := publisher.PublishCommit(event); err != nil {
+			if err := send(publisher); err != nil {
 				// Send failed; increase attempts/backoff and retry.
-				log.WithError(err).WithFields(log.Fields{logPublisherName: publisherName, logNotiName: event.Name}).Error("could not publish notification via notifier")
+				log.WithError(err).WithFields(log.Fields{logPublisherName: publisherName, logNotiName: eventName}).Error("could not publish notification via notifier")
 				backOff = timeutil.ExpBackoff(backOff, notifierMaxBackOff)
 				attempts++
 				continue
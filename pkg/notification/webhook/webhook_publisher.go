@@ -0,0 +1,320 @@
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dotmesh-oss/dotmesh/pkg/notification"
+	"github.com/dotmesh-oss/dotmesh/pkg/timeutil"
+	"github.com/dotmesh-oss/dotmesh/pkg/types"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// EnvWebhookURLs - comma separated list of URLs to POST notifications to
+	EnvWebhookURLs = "DOTMESH_WEBHOOK_URLS"
+	// EnvWebhookSecret - key used to sign request bodies, see SignatureHeader
+	EnvWebhookSecret = "DOTMESH_WEBHOOK_SECRET"
+	// EnvWebhookNamespaces - comma separated list of namespaces to send
+	// notifications about, all namespaces if empty
+	EnvWebhookNamespaces = "DOTMESH_WEBHOOK_NAMESPACES"
+	// EnvWebhookAttempts - how many times to try each URL before giving up
+	EnvWebhookAttempts = "DOTMESH_WEBHOOK_ATTEMPTS"
+	// EnvWebhookDeadLetterPath - file that notifications which couldn't be
+	// delivered are appended to, one JSON document per line
+	EnvWebhookDeadLetterPath = "DOTMESH_WEBHOOK_DEAD_LETTER_PATH"
+
+	// SignatureHeader carries "sha256=<hex HMAC-SHA256 of the body>"
+	SignatureHeader = "X-Dotmesh-Signature"
+	// EventHeader carries the notification type
+	EventHeader = "X-Dotmesh-Event"
+
+	defaultAttempts = 5
+	maxBackOff      = 5 * time.Minute
+	// how many notifications may wait for each URL while it's retrying;
+	// any more go straight to the dead-letter log
+	queueLength = 1000
+)
+
+type publisher struct {
+	client *http.Client
+	// guards settings and queues, which Configure replaces
+	lock        sync.RWMutex
+	settings    settings
+	deadLetterM sync.Mutex
+
+	// a queue per URL, each delivered from by its own goroutine
+	queues map[string]chan delivery
+	// notifications not yet delivered or given up on
+	pending sync.WaitGroup
+
+	// replaced in tests to avoid waiting for the backoff
+	sleep func(time.Duration)
+}
+
+// settings are what Configure reads from the environment
+type settings struct {
+	urls           []string
+	secret         []byte
+	namespaces     map[string]bool
+	attempts       int
+	deadLetterPath string
+}
+
+type delivery struct {
+	eventType types.NotificationType
+	body      []byte
+}
+
+func init() {
+	notification.RegisterPublisher("webhook", &publisher{})
+}
+
+func splitList(value string) []string {
+	result := []string{}
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+// readSettings reads the webhooks' settings from the environment
+func readSettings() (settings, error) {
+	s := settings{urls: splitList(os.Getenv(EnvWebhookURLs))}
+	if len(s.urls) == 0 {
+		return s, nil
+	}
+
+	if os.Getenv(EnvWebhookSecret) != "" {
+		s.secret = []byte(os.Getenv(EnvWebhookSecret))
+	} else {
+		log.Warnf("%s env variable not supplied for webhook publisher, requests will not be signed", EnvWebhookSecret)
+	}
+
+	s.namespaces = map[string]bool{}
+	for _, namespace := range splitList(os.Getenv(EnvWebhookNamespaces)) {
+		s.namespaces[namespace] = true
+	}
+
+	s.attempts = defaultAttempts
+	if os.Getenv(EnvWebhookAttempts) != "" {
+		attempts, err := strconv.Atoi(os.Getenv(EnvWebhookAttempts))
+		if err != nil || attempts < 1 {
+			return s, fmt.Errorf("invalid %s: %q", EnvWebhookAttempts, os.Getenv(EnvWebhookAttempts))
+		}
+		s.attempts = attempts
+	}
+
+	s.deadLetterPath = os.Getenv(EnvWebhookDeadLetterPath)
+	return s, nil
+}
+
+// Configure reads the webhooks from the environment. Called again, it keeps
+// the queues of URLs that are still configured, and stops delivering to the
+// rest once what's queued for them has been delivered.
+func (p *publisher) Configure(c *notification.Config) (bool, error) {
+	next, err := readSettings()
+	if err != nil {
+		return false, err
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.client == nil {
+		p.client = &http.Client{Timeout: 30 * time.Second}
+	}
+	if p.sleep == nil {
+		p.sleep = time.Sleep
+	}
+	p.settings = next
+
+	queues := map[string]chan delivery{}
+	for _, url := range next.urls {
+		queue, ok := p.queues[url]
+		if !ok {
+			queue = make(chan delivery, queueLength)
+			go p.deliverFrom(url, queue)
+		}
+		queues[url] = queue
+	}
+	for url, queue := range p.queues {
+		if _, ok := queues[url]; !ok {
+			close(queue)
+		}
+	}
+	p.queues = queues
+
+	return len(next.urls) > 0, nil
+}
+
+// current returns the settings to deliver with
+func (p *publisher) current() settings {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return p.settings
+}
+
+// PublishCommit - POST a commit notification to every webhook
+func (p *publisher) PublishCommit(event *types.CommitNotification) error {
+	return p.Publish(event.Notification())
+}
+
+// Publish - queue a notification to be POSTed to every webhook. Each URL has
+// its own queue and is retried on its own, so that one broken receiver
+// neither delays nor causes duplicate deliveries to the others;
+// notifications which can't be delivered go to the dead-letter log rather
+// than being returned as errors.
+func (p *publisher) Publish(event *types.Notification) error {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	if len(p.settings.namespaces) > 0 && !p.settings.namespaces[event.Namespace] {
+		return nil
+	}
+	if event.Timestamp == 0 {
+		event.Timestamp = timeutil.Now().UnixNano()
+	}
+
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	for _, url := range p.settings.urls {
+		p.pending.Add(1)
+		select {
+		case p.queues[url] <- delivery{eventType: event.Type, body: body}:
+		default:
+			p.deadLetter(p.settings, url, body, fmt.Errorf("%d notifications are already waiting to be delivered", queueLength))
+			p.pending.Done()
+		}
+	}
+	return nil
+}
+
+// deliverFrom delivers the notifications queued for url in order, until
+// Configure closes the queue
+func (p *publisher) deliverFrom(url string, queue chan delivery) {
+	for d := range queue {
+		current := p.current()
+		err := p.deliver(current, url, d.eventType, d.body)
+		if err != nil {
+			p.deadLetter(current, url, d.body, err)
+		}
+		p.pending.Done()
+	}
+}
+
+func sign(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (p *publisher) deliver(current settings, url string, eventType types.NotificationType, body []byte) error {
+	var backOff time.Duration
+	var err error
+	for attempt := 0; attempt < current.attempts; attempt++ {
+		if backOff > 0 {
+			p.sleep(backOff)
+		}
+		err = p.post(current, url, eventType, body)
+		if err == nil {
+			return nil
+		}
+		log.WithFields(log.Fields{
+			"error":    err,
+			"url":      url,
+			"event":    eventType,
+			"attempts": attempt + 1,
+		}).Warn("[webhook] failed to deliver notification")
+		backOff = timeutil.ExpBackoff(backOff, maxBackOff)
+	}
+	return err
+}
+
+func (p *publisher) post(current settings, url string, eventType types.NotificationType, body []byte) error {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventHeader, string(eventType))
+	if len(current.secret) > 0 {
+		req.Header.Set(SignatureHeader, sign(current.secret, body))
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+type deadLetter struct {
+	URL          string          `json:"url"`
+	Error        string          `json:"error"`
+	Timestamp    int64           `json:"timestamp"`
+	Notification json.RawMessage `json:"notification"`
+}
+
+func (p *publisher) deadLetter(current settings, url string, body []byte, deliveryErr error) {
+	log.WithFields(log.Fields{
+		"error":        deliveryErr,
+		"url":          url,
+		"notification": string(body),
+	}).Error("[webhook] giving up on delivering notification")
+
+	if current.deadLetterPath == "" {
+		return
+	}
+
+	line, err := json.Marshal(deadLetter{
+		URL:          url,
+		Error:        deliveryErr.Error(),
+		Timestamp:    timeutil.Now().UnixNano(),
+		Notification: body,
+	})
+	if err != nil {
+		return
+	}
+
+	p.deadLetterM.Lock()
+	defer p.deadLetterM.Unlock()
+
+	f, err := os.OpenFile(current.deadLetterPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+			"path":  current.deadLetterPath,
+		}).Error("[webhook] failed to open dead-letter log")
+		return
+	}
+	defer f.Close()
+
+	_, err = f.Write(append(line, '\n'))
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+			"path":  current.deadLetterPath,
+		}).Error("[webhook] failed to write to dead-letter log")
+	}
+}
@@ -0,0 +1,220 @@
+package webhook
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dotmesh-oss/dotmesh/pkg/notification"
+	"github.com/dotmesh-oss/dotmesh/pkg/types"
+)
+
+func configure(t *testing.T, env map[string]string) *publisher {
+	for _, k := range []string{EnvWebhookURLs, EnvWebhookSecret, EnvWebhookNamespaces, EnvWebhookAttempts, EnvWebhookDeadLetterPath} {
+		os.Setenv(k, env[k])
+	}
+
+	p := &publisher{}
+	configured, err := p.Configure(&notification.Config{})
+	if err != nil {
+		t.Fatalf("failed to configure: %s", err)
+	}
+	if !configured {
+		t.Fatalf("expected publisher to be configured")
+	}
+	p.sleep = func(time.Duration) {}
+	return p
+}
+
+func TestNotConfiguredWithoutURLs(t *testing.T) {
+	os.Setenv(EnvWebhookURLs, "")
+	configured, err := (&publisher{}).Configure(&notification.Config{})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if configured {
+		t.Errorf("expected publisher not to be configured")
+	}
+}
+
+func TestPublishSigned(t *testing.T) {
+	received := make(chan *http.Request, 1)
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ = ioutil.ReadAll(r.Body)
+		received <- r
+	}))
+	defer server.Close()
+
+	p := configure(t, map[string]string{
+		EnvWebhookURLs:   server.URL,
+		EnvWebhookSecret: "s3cret",
+	})
+
+	err := p.PublishCommit(&types.CommitNotification{
+		Namespace: "admin",
+		Name:      "dot",
+		CommitId:  "1234",
+	})
+	if err != nil {
+		t.Fatalf("failed to publish: %s", err)
+	}
+
+	r := <-received
+	if r.Header.Get(EventHeader) != string(types.NotificationCommit) {
+		t.Errorf("unexpected event header %q", r.Header.Get(EventHeader))
+	}
+	if r.Header.Get(SignatureHeader) != sign([]byte("s3cret"), body) {
+		t.Errorf("signature %q doesn't match body", r.Header.Get(SignatureHeader))
+	}
+
+	var n types.Notification
+	err = json.Unmarshal(body, &n)
+	if err != nil {
+		t.Fatalf("failed to decode body: %s", err)
+	}
+	if n.CommitId != "1234" || n.Timestamp == 0 {
+		t.Errorf("unexpected notification %#v", n)
+	}
+}
+
+func TestNamespaceFilter(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+	}))
+	defer server.Close()
+
+	p := configure(t, map[string]string{
+		EnvWebhookURLs:       server.URL,
+		EnvWebhookNamespaces: "alice, bob",
+	})
+
+	p.Publish(&types.Notification{Type: types.NotificationDotDeleted, Namespace: "eve"})
+	p.Publish(&types.Notification{Type: types.NotificationDotDeleted, Namespace: "bob"})
+	p.pending.Wait()
+
+	if atomic.LoadInt32(&calls) != 1 {
+		t.Errorf("expected 1 delivery, got %d", calls)
+	}
+}
+
+func TestRetryThenDeadLetter(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "webhook")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	deadLetterPath := filepath.Join(dir, "dead-letter.log")
+
+	p := configure(t, map[string]string{
+		EnvWebhookURLs:           server.URL,
+		EnvWebhookAttempts:       "3",
+		EnvWebhookDeadLetterPath: deadLetterPath,
+	})
+
+	err = p.Publish(&types.Notification{Type: types.NotificationTransferFailed, Namespace: "admin"})
+	if err != nil {
+		t.Errorf("expected undeliverable notification to be dead-lettered, got error: %s", err)
+	}
+	p.pending.Wait()
+	if atomic.LoadInt32(&calls) != 3 {
+		t.Errorf("expected 3 attempts, got %d", calls)
+	}
+
+	logged, err := ioutil.ReadFile(deadLetterPath)
+	if err != nil {
+		t.Fatalf("failed to read dead-letter log: %s", err)
+	}
+	if !strings.Contains(string(logged), string(types.NotificationTransferFailed)) {
+		t.Errorf("dead-letter log doesn't contain the notification: %s", logged)
+	}
+}
+
+func TestDeadURLDoesntDelayOthers(t *testing.T) {
+	unblock := make(chan struct{})
+	dead := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-unblock
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer dead.Close()
+	defer close(unblock)
+
+	received := make(chan struct{}, 2)
+	alive := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- struct{}{}
+	}))
+	defer alive.Close()
+
+	p := configure(t, map[string]string{
+		EnvWebhookURLs:     dead.URL + "," + alive.URL,
+		EnvWebhookAttempts: "1",
+	})
+
+	p.Publish(&types.Notification{Type: types.NotificationDotDeleted, Namespace: "admin"})
+	p.Publish(&types.Notification{Type: types.NotificationDotDeleted, Namespace: "admin"})
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-received:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("delivery %d to a working URL waited for a broken one", i+1)
+		}
+	}
+}
+
+func TestReconfigure(t *testing.T) {
+	received := make(chan string, 2)
+	newServer := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			received <- name
+		}))
+	}
+	kept, dropped := newServer("kept"), newServer("dropped")
+	defer kept.Close()
+	defer dropped.Close()
+
+	p := configure(t, map[string]string{EnvWebhookURLs: kept.URL + "," + dropped.URL})
+	keptQueue, droppedQueue := p.queues[kept.URL], p.queues[dropped.URL]
+
+	os.Setenv(EnvWebhookURLs, kept.URL)
+	configured, err := p.Configure(&notification.Config{})
+	if err != nil || !configured {
+		t.Fatalf("failed to configure again: %v", err)
+	}
+	if p.queues[kept.URL] != keptQueue {
+		t.Errorf("expected the queue of a URL that's still configured to be kept")
+	}
+	if _, open := <-droppedQueue; open {
+		t.Errorf("expected the queue of a URL that's no longer configured to be closed")
+	}
+
+	p.Publish(&types.Notification{Type: types.NotificationDotDeleted, Namespace: "admin"})
+	p.pending.Wait()
+	if got := <-received; got != "kept" || len(received) != 0 {
+		t.Errorf("expected just the configured URL to be posted to, got %s and %d more", got, len(received))
+	}
+
+	os.Setenv(EnvWebhookURLs, "")
+	configured, err = p.Configure(&notification.Config{})
+	if err != nil || configured {
+		t.Fatalf("expected no webhooks to be configured, got %t, %v", configured, err)
+	}
+	if _, open := <-keptQueue; open {
+		t.Errorf("expected every queue to be closed")
+	}
+}
@@ -0,0 +1,88 @@
+// Package placement decides which nodes in a cluster should hold replicas of
+// a dot, given its placement policy and the labels of each node.
+package placement
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"sort"
+
+	"github.com/dotmesh-oss/dotmesh/pkg/types"
+)
+
+// Matches reports whether a node's labels satisfy every key in the selector.
+func Matches(selector map[string]string, labels map[string]string) bool {
+	for k, v := range selector {
+		if labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// rank gives each (filesystem, server) pair a stable pseudo-random score, so
+// that dots are spread evenly over the candidate nodes but every node agrees
+// on the outcome without coordinating (rendezvous hashing).
+func rank(filesystemId, serverId string) string {
+	sum := sha1.Sum([]byte(filesystemId + "/" + serverId))
+	return hex.EncodeToString(sum[:])
+}
+
+// Replicas returns the IDs of the servers which should hold filesystemId.
+// The current master, if any, is always included because it holds the data
+// everyone else replicates from. A nil policy selects every server.
+func Replicas(policy *types.PlacementPolicy, filesystemId, master string, servers []*types.Server) []string {
+	candidates := []*types.Server{}
+	for _, server := range servers {
+		if server.Id == master {
+			continue
+		}
+		if policy == nil || Matches(policy.NodeSelector, server.Labels) {
+			candidates = append(candidates, server)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return rank(filesystemId, candidates[i].Id) < rank(filesystemId, candidates[j].Id)
+	})
+
+	result := []string{}
+	usedLabelValues := map[string]struct{}{}
+
+	if master != "" {
+		result = append(result, master)
+		if policy != nil && policy.AntiAffinityLabel != "" {
+			for _, server := range servers {
+				if server.Id == master {
+					usedLabelValues[server.Labels[policy.AntiAffinityLabel]] = struct{}{}
+				}
+			}
+		}
+	}
+
+	for _, server := range candidates {
+		if policy != nil && policy.Replicas > 0 && len(result) >= policy.Replicas {
+			break
+		}
+		if policy != nil && policy.AntiAffinityLabel != "" {
+			value := server.Labels[policy.AntiAffinityLabel]
+			if _, ok := usedLabelValues[value]; ok {
+				continue
+			}
+			usedLabelValues[value] = struct{}{}
+		}
+		result = append(result, server.Id)
+	}
+
+	sort.Strings(result)
+	return result
+}
+
+// IsReplica reports whether serverId is one of the Replicas.
+func IsReplica(policy *types.PlacementPolicy, filesystemId, master, serverId string, servers []*types.Server) bool {
+	for _, id := range Replicas(policy, filesystemId, master, servers) {
+		if id == serverId {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,77 @@
+package placement
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/dotmesh-oss/dotmesh/pkg/types"
+)
+
+func testServers() []*types.Server {
+	return []*types.Server{
+		{Id: "a", Labels: map[string]string{"zone": "1", "disk": "ssd"}},
+		{Id: "b", Labels: map[string]string{"zone": "1", "disk": "ssd"}},
+		{Id: "c", Labels: map[string]string{"zone": "2", "disk": "ssd"}},
+		{Id: "d", Labels: map[string]string{"zone": "2", "disk": "hdd"}},
+		{Id: "e", Labels: map[string]string{"zone": "3"}},
+	}
+}
+
+func TestNoPolicySelectsEveryServer(t *testing.T) {
+	replicas := Replicas(nil, "fs", "a", testServers())
+	expected := []string{"a", "b", "c", "d", "e"}
+	if !reflect.DeepEqual(replicas, expected) {
+		t.Errorf("expected %v, got %v", expected, replicas)
+	}
+}
+
+func TestReplicaCountIncludesMaster(t *testing.T) {
+	policy := &types.PlacementPolicy{Namespace: "admin", Replicas: 2}
+	replicas := Replicas(policy, "fs", "d", testServers())
+	if len(replicas) != 2 {
+		t.Fatalf("expected 2 replicas, got %v", replicas)
+	}
+	if !IsReplica(policy, "fs", "d", "d", testServers()) {
+		t.Errorf("expected master d to be a replica, got %v", replicas)
+	}
+	// Every node must come to the same decision
+	again := Replicas(policy, "fs", "d", testServers())
+	if !reflect.DeepEqual(replicas, again) {
+		t.Errorf("placement is not stable: %v then %v", replicas, again)
+	}
+}
+
+func TestNodeSelector(t *testing.T) {
+	policy := &types.PlacementPolicy{
+		Namespace:    "admin",
+		NodeSelector: map[string]string{"disk": "ssd"},
+	}
+	replicas := Replicas(policy, "fs", "a", testServers())
+	expected := []string{"a", "b", "c"}
+	if !reflect.DeepEqual(replicas, expected) {
+		t.Errorf("expected %v, got %v", expected, replicas)
+	}
+}
+
+func TestAntiAffinity(t *testing.T) {
+	policy := &types.PlacementPolicy{
+		Namespace:         "admin",
+		Replicas:          3,
+		AntiAffinityLabel: "zone",
+	}
+	replicas := Replicas(policy, "fs", "a", testServers())
+	if len(replicas) != 3 {
+		t.Fatalf("expected 3 replicas, got %v", replicas)
+	}
+	zones := map[string]string{}
+	for _, server := range testServers() {
+		zones[server.Id] = server.Labels["zone"]
+	}
+	seen := map[string]bool{}
+	for _, id := range replicas {
+		if seen[zones[id]] {
+			t.Errorf("two replicas in zone %s: %v", zones[id], replicas)
+		}
+		seen[zones[id]] = true
+	}
+}
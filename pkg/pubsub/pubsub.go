@@ -42,12 +42,21 @@ type subscriptionTarget struct {
 	subject  string
 }
 
+// commitListener is the receiving end of someone else's SubscribeForCommits
+type commitListener struct {
+	url          string
+	username     string
+	conn         *subscriptionConnection
+	subscription *nats.Subscription
+}
+
 type PubSubManager struct {
 	salt  []byte
 	mutex sync.Mutex
 	cache map[string]*subscriptionConnection
 
-	commitSubs []subscriptionTarget
+	commitSubs      []subscriptionTarget
+	commitListeners map[string]*commitListener
 }
 
 func subsConKey(url, username string) string {
@@ -69,6 +78,8 @@ func NewPubSubManager() *PubSubManager {
 		salt:  salt,
 		mutex: sync.Mutex{},
 		cache: map[string]*subscriptionConnection{},
+
+		commitListeners: map[string]*commitListener{},
 	}
 }
 
@@ -212,3 +223,65 @@ func (cc *PubSubManager) PublishCommit(fsId, namespace, name, branch, commitId s
 
 	return nil
 }
+
+// ListenForCommits calls handler with every commit notification published on
+// subject at url, until StopListeningForCommits is called with the same id.
+// Handlers are called from the NATS client's goroutine, one at a time.
+func (cc *PubSubManager) ListenForCommits(id, url, username, password, subject string, handler func(*CommitNotification)) error {
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+
+	_, ok := cc.commitListeners[id]
+	if ok {
+		return fmt.Errorf("Already listening for commits as %s", id)
+	}
+
+	conn, err := cc.claimConnection(url, username, password)
+	if err != nil {
+		return err
+	}
+
+	subscription, err := conn.encodedClient.Subscribe(subject, handler)
+	if err != nil {
+		cc.releaseConnection(url, username)
+		return err
+	}
+
+	cc.commitListeners[id] = &commitListener{
+		url:          url,
+		username:     username,
+		conn:         conn,
+		subscription: subscription,
+	}
+	return nil
+}
+
+func (cc *PubSubManager) StopListeningForCommits(id string) error {
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+
+	cl, ok := cc.commitListeners[id]
+	if !ok {
+		return fmt.Errorf("Not listening for commits as %s", id)
+	}
+	delete(cc.commitListeners, id)
+
+	err := cl.subscription.Unsubscribe()
+	if err != nil {
+		log.Printf("[pubsub.StopListeningForCommits] Error %#v unsubscribing %s from %s @ %s", err, id, cl.username, cl.url)
+	}
+	return cc.releaseConnection(cl.url, cl.username)
+}
+
+// ListeningForCommits reports whether there's a listener for id, and whether
+// it's currently connected to its server.
+func (cc *PubSubManager) ListeningForCommits(id string) (listening bool, connected bool) {
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+
+	cl, ok := cc.commitListeners[id]
+	if !ok {
+		return false, false
+	}
+	return true, cl.subscription.IsValid() && cl.conn.client.IsConnected()
+}
@@ -1,3 +1,84 @@
 package pubsub
 
-// No tests?
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/nats-io/gnatsd/server"
+	"github.com/nats-io/gnatsd/test"
+)
+
+var defaultNatsTestOptions = &server.Options{
+	Host:           "127.0.0.1",
+	Port:           server.RANDOM_PORT,
+	NoLog:          true,
+	NoSigs:         true,
+	MaxControlLine: 256,
+}
+
+// set once the server has picked a port
+var natsTestURL string
+
+func TestMain(m *testing.M) {
+	s := test.RunServer(defaultNatsTestOptions)
+	natsTestURL = fmt.Sprintf("nats://%s", s.Addr())
+	os.Exit(m.Run())
+}
+
+func TestListenForCommits(t *testing.T) {
+	publisher := NewPubSubManager()
+	listener := NewPubSubManager()
+
+	received := make(chan *CommitNotification, 1)
+	err := listener.ListenForCommits("sub-1", natsTestURL, "", "", "commits", func(cn *CommitNotification) {
+		received <- cn
+	})
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+
+	listening, connected := listener.ListeningForCommits("sub-1")
+	if !listening || !connected {
+		t.Errorf("expected to be listening and connected, got %t, %t", listening, connected)
+	}
+
+	err = listener.ListenForCommits("sub-1", natsTestURL, "", "", "commits", func(cn *CommitNotification) {})
+	if err == nil {
+		t.Errorf("expected an error listening twice with the same id")
+	}
+
+	err = publisher.SubscribeForCommits(natsTestURL, "", "", "commits")
+	if err != nil {
+		t.Fatalf("failed to subscribe: %s", err)
+	}
+	defer publisher.UnsubscribeForCommits(natsTestURL, "", "commits")
+
+	err = publisher.PublishCommit("fs-1", "admin", "dot", "master", "commit-1", map[string]string{"message": "hi"})
+	if err != nil {
+		t.Fatalf("failed to publish: %s", err)
+	}
+
+	select {
+	case cn := <-received:
+		if cn.CommitId != "commit-1" || cn.Name != "dot" || cn.Metadata["message"] != "hi" {
+			t.Errorf("unexpected notification: %#v", cn)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for notification")
+	}
+
+	err = listener.StopListeningForCommits("sub-1")
+	if err != nil {
+		t.Fatalf("failed to stop listening: %s", err)
+	}
+	listening, _ = listener.ListeningForCommits("sub-1")
+	if listening {
+		t.Errorf("expected to have stopped listening")
+	}
+	err = listener.StopListeningForCommits("sub-1")
+	if err == nil {
+		t.Errorf("expected an error stopping twice")
+	}
+}
@@ -40,7 +40,7 @@ type Registry interface {
 
 	UpdateCollaborators(ctx context.Context, tlf types.TopLevelFilesystem, newCollaborators []user.SafeUser) error
 	RegisterClone(name string, topLevelFilesystemId string, clone types.Clone) error
-	RegisterFork(originFilesystemId string, originSnapshotId string, forkName types.VolumeName, forkFilesystemId string) error
+	RegisterFork(originFilesystemId string, originSnapshotId string, forkName types.VolumeName, forkFilesystemId string, encryptionKeyOf *types.VolumeName) error
 
 	// TODO: why ..FromEtcd?
 	UpdateFilesystemFromEtcd(name types.VolumeName, rf types.RegistryFilesystem) error
@@ -53,6 +53,9 @@ type Registry interface {
 	LookupCloneById(filesystemId string) (types.Clone, error)
 	LookupCloneByIdWithName(filesystemId string) (types.Clone, string, error)
 	LookupFilesystemById(filesystemId string) (types.TopLevelFilesystem, string, error)
+	// RegistryProperties returns the registry's record of a filesystem, to be
+	// kept with it on disk
+	RegistryProperties(filesystemId string) (types.RegistryProperties, error)
 
 	Exists(name types.VolumeName, cloneName string) string
 
@@ -241,7 +244,7 @@ type registryFilesystem struct {
 	CollaboratorIds []string
 }
 
-func (r *DefaultRegistry) RegisterFork(originFilesystemId string, originSnapshotId string, forkName types.VolumeName, forkFilesystemId string) error {
+func (r *DefaultRegistry) RegisterFork(originFilesystemId string, originSnapshotId string, forkName types.VolumeName, forkFilesystemId string, encryptionKeyOf *types.VolumeName) error {
 	rf := types.RegistryFilesystem{
 		Id: forkFilesystemId,
 		// Owner is, for now, always the authenticated user at the time of
@@ -250,6 +253,7 @@ func (r *DefaultRegistry) RegisterFork(originFilesystemId string, originSnapshot
 		OwnerId:              forkName.Namespace,
 		ForkParentId:         originFilesystemId,
 		ForkParentSnapshotId: originSnapshotId,
+		EncryptionKeyOf:      encryptionKeyOf,
 	}
 	err := r.registryStore.SetFilesystem(&rf, &store.SetOptions{})
 	if err != nil {
@@ -388,6 +392,7 @@ func (r *DefaultRegistry) UpdateFilesystemFromEtcd(name types.VolumeName, rf typ
 		Collaborators:        collaborators,
 		ForkParentId:         rf.ForkParentId,
 		ForkParentSnapshotId: rf.ForkParentSnapshotId,
+		EncryptionKeyOf:      rf.EncryptionKeyOf,
 	}
 
 	return nil
@@ -487,6 +492,50 @@ func (r *DefaultRegistry) LookupFilesystemById(filesystemId string) (types.TopLe
 	)
 }
 
+func (r *DefaultRegistry) RegistryProperties(filesystemId string) (types.RegistryProperties, error) {
+	r.topLevelFilesystemsLock.RLock()
+	for name, tlf := range r.topLevelFilesystems {
+		if tlf.MasterBranch.Id == filesystemId {
+			collaboratorIds := []string{}
+			for _, c := range tlf.Collaborators {
+				collaboratorIds = append(collaboratorIds, c.Id)
+			}
+			r.topLevelFilesystemsLock.RUnlock()
+			return types.RegistryProperties{
+				Filesystem: &types.RegistryFilesystem{
+					Id:                   filesystemId,
+					OwnerId:              name.Namespace,
+					Name:                 name.Name,
+					ForkParentId:         tlf.ForkParentId,
+					ForkParentSnapshotId: tlf.ForkParentSnapshotId,
+					EncryptionKeyOf:      tlf.EncryptionKeyOf,
+					CollaboratorIds:      collaboratorIds,
+				},
+				Organization: tlf.Owner.Metadata[user.OrganizationLabel] != "",
+			}, nil
+		}
+	}
+	r.topLevelFilesystemsLock.RUnlock()
+
+	r.clonesLock.RLock()
+	defer r.clonesLock.RUnlock()
+	for topLevelFilesystemId, cloneMap := range r.clones {
+		for cloneName, clone := range cloneMap {
+			if clone.FilesystemId == filesystemId {
+				// clones registered on this node aren't given their top
+				// level filesystem id in our map, only in the KV store
+				if clone.TopLevelFilesystemId == "" {
+					clone.TopLevelFilesystemId = topLevelFilesystemId
+				}
+				clone.Name = cloneName
+				clone.Meta = nil
+				return types.RegistryProperties{Clone: &clone}, nil
+			}
+		}
+	}
+	return types.RegistryProperties{}, NoSuchClone{filesystemId}
+}
+
 // filesystem id if exists, else ""
 func (r *DefaultRegistry) Exists(name types.VolumeName, cloneName string) string {
 	r.topLevelFilesystemsLock.RLock()
@@ -236,3 +236,92 @@ func TestGetFilesystemByID(t *testing.T) {
 		t.Errorf("unexpected clone origin fs ID: %s", foundClone.Origin.FilesystemId)
 	}
 }
+
+func TestRegistryProperties(t *testing.T) {
+	client, err := store.NewKVDBClient(&store.KVDBConfig{
+		Type: store.KVTypeMem,
+	})
+	if err != nil {
+		t.Fatalf("failed to init kv store: %s", err)
+	}
+	idxStore := store.NewKVDBStoreWithIndex(client, "users")
+
+	um := user.NewInternal(idxStore)
+	kvClient := store.NewKVDBFilesystemStore(client)
+	registry := NewRegistry(um, kvClient)
+
+	_, err = um.New("foo", "foo@bar.pub", "verysecret")
+	if err != nil {
+		t.Fatalf("failed to create new user: %s", err)
+	}
+	userB, err := um.New("bar", "bar@bar.pub", "verysecret")
+	if err != nil {
+		t.Fatalf("failed to create new user: %s", err)
+	}
+
+	err = registry.UpdateFilesystemFromEtcd(types.VolumeName{Namespace: "foo", Name: "n"}, types.RegistryFilesystem{
+		Id:              "id-1",
+		OwnerId:         "foo",
+		Name:            "n",
+		CollaboratorIds: []string{userB.Id},
+	})
+	if err != nil {
+		t.Fatalf("failed to update filesystem from etcd: %s", err)
+	}
+	err = registry.RegisterClone("branch", "id-1", types.Clone{
+		FilesystemId: "clone-1",
+		Origin:       types.Origin{FilesystemId: "id-1", SnapshotId: "snapshot-id"},
+	})
+	if err != nil {
+		t.Fatalf("failed to create clone: %s", err)
+	}
+
+	properties, err := registry.RegistryProperties("id-1")
+	if err != nil {
+		t.Fatalf("failed to get registry properties: %s", err)
+	}
+	if properties.Clone != nil || properties.Filesystem == nil {
+		t.Fatalf("expected the master branch to have filesystem properties, got %+v", properties)
+	}
+	if properties.Filesystem.OwnerId != "foo" || properties.Filesystem.Name != "n" ||
+		len(properties.Filesystem.CollaboratorIds) != 1 || properties.Filesystem.CollaboratorIds[0] != userB.Id {
+		t.Errorf("unexpected filesystem properties: %+v", properties.Filesystem)
+	}
+	if properties.Organization {
+		t.Errorf("expected foo's dot not to be an organization's")
+	}
+
+	_, err = um.NewOrganization("acme", userB)
+	if err != nil {
+		t.Fatalf("failed to create organization: %s", err)
+	}
+	err = registry.UpdateFilesystemFromEtcd(types.VolumeName{Namespace: "acme", Name: "n"}, types.RegistryFilesystem{
+		Id:      "id-2",
+		OwnerId: "acme",
+		Name:    "n",
+	})
+	if err != nil {
+		t.Fatalf("failed to update filesystem from etcd: %s", err)
+	}
+	properties, err = registry.RegistryProperties("id-2")
+	if err != nil || !properties.Organization {
+		t.Errorf("expected acme's dot to be an organization's, got %+v: %v", properties, err)
+	}
+
+	properties, err = registry.RegistryProperties("clone-1")
+	if err != nil {
+		t.Fatalf("failed to get registry properties: %s", err)
+	}
+	if properties.Filesystem != nil || properties.Clone == nil {
+		t.Fatalf("expected the branch to have clone properties, got %+v", properties)
+	}
+	if properties.Clone.Name != "branch" || properties.Clone.TopLevelFilesystemId != "id-1" ||
+		properties.Clone.Origin.SnapshotId != "snapshot-id" {
+		t.Errorf("unexpected clone properties: %+v", properties.Clone)
+	}
+
+	_, err = registry.RegistryProperties("unknown")
+	if err == nil {
+		t.Errorf("expected an unregistered filesystem to be an error")
+	}
+}
@@ -0,0 +1,186 @@
+// Package signing signs commits on behalf of their authors and checks those
+// signatures. A signature covers the branch the commit was made on, the
+// commit before it, its message, its metadata and a digest of its contents,
+// and is kept in the commit's own metadata, so it travels with the commit
+// when it's pushed or pulled.
+package signing
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/dotmesh-oss/dotmesh/pkg/digest"
+)
+
+// Metadata keys a signed commit has, besides the ones it was made with
+const (
+	SignatureKey     = "signature"
+	PublicKeyKey     = "signature.key"
+	ContentDigestKey = digest.MetadataKey
+)
+
+// metadata that isn't signed: what the server adds to every commit, and the
+// signature itself. The content digest is signed, but on its own.
+var unsignedKeys = map[string]bool{
+	"author":         true,
+	"timestamp":      true,
+	"message":        true,
+	SignatureKey:     true,
+	PublicKeyKey:     true,
+	ContentDigestKey: true,
+}
+
+// ErrUnsigned is returned by Verify for a commit with no signature
+var ErrUnsigned = errors.New("commit is not signed")
+
+// Commit is what gets signed
+type Commit struct {
+	// the filesystem id of the branch the commit is on, which for master is
+	// the dot's id
+	DotId string
+	// the commit this one follows on the branch, "" for its first
+	ParentId      string
+	Message       string
+	Metadata      map[string]string
+	ContentDigest string
+}
+
+// FromMetadata makes the Commit that a commit with this metadata claims to
+// be, ignoring the metadata signing doesn't cover
+func FromMetadata(dotId, parentId string, metadata map[string]string) Commit {
+	signed := map[string]string{}
+	for k, v := range metadata {
+		if !unsignedKeys[k] {
+			signed[k] = v
+		}
+	}
+	return Commit{
+		DotId:         dotId,
+		ParentId:      parentId,
+		Message:       metadata["message"],
+		Metadata:      signed,
+		ContentDigest: metadata[ContentDigestKey],
+	}
+}
+
+// Canonical is the encoding of c that is signed. Every field is written with
+// its length, so no choice of values can make two different commits encode
+// the same, and metadata is written in key order.
+func (c Commit) Canonical() []byte {
+	var b bytes.Buffer
+	field := func(name, value string) {
+		fmt.Fprintf(&b, "%s %d\n%s\n", name, len(value), value)
+	}
+	b.WriteString("dotmesh-commit-v1\n")
+	field("dot", c.DotId)
+	field("parent", c.ParentId)
+	field("message", c.Message)
+	field("content", c.ContentDigest)
+
+	keys := make([]string, 0, len(c.Metadata))
+	for k := range c.Metadata {
+		if !unsignedKeys[k] {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		field("key", k)
+		field("value", c.Metadata[k])
+	}
+	return b.Bytes()
+}
+
+// Sign returns the metadata to add to c's metadata to sign it with key
+func Sign(key ed25519.PrivateKey, c Commit) map[string]string {
+	signature := ed25519.Sign(key, c.Canonical())
+	return map[string]string{
+		SignatureKey:     base64.StdEncoding.EncodeToString(signature),
+		PublicKeyKey:     EncodePublicKey(key.Public().(ed25519.PublicKey)),
+		ContentDigestKey: c.ContentDigest,
+	}
+}
+
+// Verify checks that metadata holds a good signature of c, and returns the
+// public key that made it. Whether that key belongs to the commit's author
+// is up to the caller.
+func Verify(c Commit, metadata map[string]string) (string, error) {
+	encoded, ok := metadata[SignatureKey]
+	if !ok {
+		return "", ErrUnsigned
+	}
+	signature, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", fmt.Errorf("malformed signature: %s", err)
+	}
+	publicKey, err := DecodePublicKey(metadata[PublicKeyKey])
+	if err != nil {
+		return "", err
+	}
+	if !ed25519.Verify(publicKey, c.Canonical(), signature) {
+		return "", fmt.Errorf("bad signature")
+	}
+	return metadata[PublicKeyKey], nil
+}
+
+// GenerateKey makes a new key to sign commits with
+func GenerateKey() (ed25519.PrivateKey, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	return key, err
+}
+
+// EncodePublicKey is how public keys are registered and stored in commits
+func EncodePublicKey(key ed25519.PublicKey) string {
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+func DecodePublicKey(s string) (ed25519.PublicKey, error) {
+	key, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("malformed public key: %s", err)
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("malformed public key: expected %d bytes, got %d", ed25519.PublicKeySize, len(key))
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// Fingerprint is a short, readable name for a public key, as shown by
+// 'dm key ls'
+func Fingerprint(publicKey string) string {
+	sum := sha256.Sum256([]byte(publicKey))
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+// MarshalPrivateKey encodes a private key as PEM, to be kept in a file
+func MarshalPrivateKey(key ed25519.PrivateKey) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+func ParsePrivateKey(data []byte) (ed25519.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, fmt.Errorf("not a PEM encoded private key")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	edKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("expected an ed25519 key, got %T", key)
+	}
+	return edKey, nil
+}
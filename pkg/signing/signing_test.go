@@ -0,0 +1,104 @@
+package signing
+
+import (
+	"bytes"
+	"testing"
+)
+
+func signedMetadata(t *testing.T) (map[string]string, Commit) {
+	t.Helper()
+	key, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := Commit{
+		DotId:         "fs1",
+		ParentId:      "snap1",
+		Message:       "Nightly run",
+		Metadata:      map[string]string{"pipeline": "42"},
+		ContentDigest: "sha256:abc",
+	}
+	metadata := map[string]string{
+		"message":   c.Message,
+		"author":    "alice",
+		"timestamp": "123",
+		"pipeline":  "42",
+	}
+	for k, v := range Sign(key, c) {
+		metadata[k] = v
+	}
+	return metadata, c
+}
+
+func TestSignAndVerify(t *testing.T) {
+	metadata, c := signedMetadata(t)
+
+	key, err := Verify(FromMetadata(c.DotId, c.ParentId, metadata), metadata)
+	if err != nil {
+		t.Fatalf("expected a good signature, got %s", err)
+	}
+	if key != metadata[PublicKeyKey] {
+		t.Errorf("expected the signing key back, got %s", key)
+	}
+}
+
+func TestVerifyRejectsChanges(t *testing.T) {
+	for name, change := range map[string]func(c *Commit, m map[string]string){
+		"dot":      func(c *Commit, m map[string]string) { c.DotId = "fs2" },
+		"parent":   func(c *Commit, m map[string]string) { c.ParentId = "" },
+		"message":  func(c *Commit, m map[string]string) { m["message"] = "Nightly run!" },
+		"metadata": func(c *Commit, m map[string]string) { m["pipeline"] = "43" },
+		"added":    func(c *Commit, m map[string]string) { m["env"] = "prod" },
+		"contents": func(c *Commit, m map[string]string) { m[ContentDigestKey] = "sha256:abd" },
+	} {
+		metadata, c := signedMetadata(t)
+		change(&c, metadata)
+		_, err := Verify(FromMetadata(c.DotId, c.ParentId, metadata), metadata)
+		if err == nil {
+			t.Errorf("%s: expected changing it to break the signature", name)
+		}
+	}
+}
+
+func TestVerifyIgnoresServerMetadata(t *testing.T) {
+	metadata, c := signedMetadata(t)
+	metadata["author"] = "bob"
+	metadata["timestamp"] = "456"
+	_, err := Verify(FromMetadata(c.DotId, c.ParentId, metadata), metadata)
+	if err != nil {
+		t.Errorf("expected a good signature, got %s", err)
+	}
+}
+
+func TestVerifyUnsigned(t *testing.T) {
+	_, err := Verify(Commit{}, map[string]string{"message": "hi"})
+	if err != ErrUnsigned {
+		t.Errorf("expected ErrUnsigned, got %v", err)
+	}
+}
+
+func TestCanonicalFieldsAreUnambiguous(t *testing.T) {
+	a := Commit{Metadata: map[string]string{"a": "b\nkey 1\nc"}}
+	b := Commit{Metadata: map[string]string{"a": "b", "c": ""}}
+	if string(a.Canonical()) == string(b.Canonical()) {
+		t.Errorf("expected different metadata to encode differently")
+	}
+}
+
+func TestPrivateKeyRoundTrip(t *testing.T) {
+	key, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := MarshalPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := ParsePrivateKey(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(key, parsed) {
+		t.Errorf("expected the same key back")
+	}
+}
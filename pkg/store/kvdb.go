@@ -5,6 +5,7 @@ package store
 import (
 	"fmt"
 
+	"github.com/dotmesh-oss/dotmesh/pkg/crypto"
 	"github.com/portworx/kvdb"
 	"github.com/portworx/kvdb/bolt"
 	etcdv3 "github.com/portworx/kvdb/etcd/v3"
@@ -14,6 +15,8 @@ import (
 
 type KVDBFilesystemStore struct {
 	client kvdb.Kvdb
+	// what secrets are encrypted with, nil to keep them in the clear
+	keyring *crypto.Keyring
 }
 
 type KVDBConfig struct {
@@ -70,3 +73,9 @@ func IsKeyNotFound(err error) bool {
 func IsKeyAlreadyExist(err error) bool {
 	return err == ErrExist
 }
+
+// IsModified is whether a compare-and-set failed because the value changed
+// since it was read; etcd and the in-memory store report it differently
+func IsModified(err error) bool {
+	return err == kvdb.ErrModified || err == kvdb.ErrValueMismatch
+}
@@ -725,7 +725,7 @@ func (s *KVDBFilesystemStore) ListTransfers() ([]*types.TransferPollResult, erro
 	for _, kvp := range pairs {
 		var val types.TransferPollResult
 
-		err = json.Unmarshal(kvp.Value, &val)
+		err = s.decode(kvp.Value, &val)
 		if err != nil {
 			log.WithFields(log.Fields{
 				"error": err,
@@ -742,3 +742,159 @@ func (s *KVDBFilesystemStore) ListTransfers() ([]*types.TransferPollResult, erro
 
 	return result, nil
 }
+
+// Replication policies
+
+func (s *KVDBFilesystemStore) SetReplicationPolicy(p *types.FilesystemReplicationPolicy, opts *SetOptions) error {
+	if p.FilesystemID == "" {
+		log.WithFields(log.Fields{
+			"error":  ErrIDNotSet,
+			"object": p,
+		}).Error("[SetReplicationPolicy] called without FilesystemID")
+		return ErrIDNotSet
+	}
+
+	bts, err := s.encode(p)
+	if err != nil {
+		return err
+	}
+	_, err = s.client.Put(FilesystemReplicationPrefix+p.FilesystemID, bts, 0)
+	return err
+}
+
+func (s *KVDBFilesystemStore) GetReplicationPolicy(id string) (*types.FilesystemReplicationPolicy, error) {
+	if id == "" {
+		return nil, ErrIDNotSet
+	}
+
+	node, err := s.client.Get(FilesystemReplicationPrefix + id)
+	if err != nil {
+		return nil, err
+	}
+	var p types.FilesystemReplicationPolicy
+	err = s.decode(node.Value, &p)
+
+	p.Meta = getMeta(node)
+
+	return &p, err
+}
+
+func (s *KVDBFilesystemStore) DeleteReplicationPolicy(id string) error {
+	if id == "" {
+		return ErrIDNotSet
+	}
+	_, err := s.client.Delete(FilesystemReplicationPrefix + id)
+	return err
+}
+
+// Commit subscriptions
+
+func (s *KVDBFilesystemStore) SetCommitSubscription(cs *types.CommitSubscription, opts *SetOptions) error {
+	if cs.Id == "" {
+		log.WithFields(log.Fields{
+			"error": ErrIDNotSet,
+		}).Error("[SetCommitSubscription] called without Id")
+		return ErrIDNotSet
+	}
+
+	bts, err := s.encode(cs)
+	if err != nil {
+		return err
+	}
+	_, err = s.client.Put(FilesystemSubscriptionsPrefix+cs.Id, bts, 0)
+	return err
+}
+
+func (s *KVDBFilesystemStore) GetCommitSubscription(id string) (*types.CommitSubscription, error) {
+	if id == "" {
+		return nil, ErrIDNotSet
+	}
+
+	node, err := s.client.Get(FilesystemSubscriptionsPrefix + id)
+	if err != nil {
+		return nil, err
+	}
+	var cs types.CommitSubscription
+	err = s.decode(node.Value, &cs)
+
+	cs.Meta = getMeta(node)
+
+	return &cs, err
+}
+
+func (s *KVDBFilesystemStore) DeleteCommitSubscription(id string) error {
+	if id == "" {
+		return ErrIDNotSet
+	}
+	_, err := s.client.Delete(FilesystemSubscriptionsPrefix + id)
+	return err
+}
+
+func (s *KVDBFilesystemStore) ListCommitSubscriptions() ([]*types.CommitSubscription, error) {
+	pairs, err := s.client.Enumerate(FilesystemSubscriptionsPrefix)
+	if err != nil {
+		return nil, err
+	}
+	var result []*types.CommitSubscription
+
+	for _, kvp := range pairs {
+		var val types.CommitSubscription
+
+		err = s.decode(kvp.Value, &val)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+				"key":   kvp.Key,
+			}).Error("failed to unmarshal value")
+			continue
+		}
+
+		val.Meta = getMeta(kvp)
+
+		result = append(result, &val)
+	}
+
+	return result, nil
+}
+
+func (s *KVDBFilesystemStore) SetCommitSubscriptionStatus(st *types.CommitSubscriptionStatus, opts *SetOptions) error {
+	if st.Id == "" {
+		log.WithFields(log.Fields{
+			"error":  ErrIDNotSet,
+			"object": st,
+		}).Error("[SetCommitSubscriptionStatus] called without Id")
+		return ErrIDNotSet
+	}
+
+	bts, err := s.encode(st)
+	if err != nil {
+		return err
+	}
+	_, err = s.client.Put(FilesystemSubscriptionStatusPrefix+st.Id, bts, 0)
+	return err
+}
+
+func (s *KVDBFilesystemStore) GetCommitSubscriptionStatus(id string) (*types.CommitSubscriptionStatus, error) {
+	if id == "" {
+		return nil, ErrIDNotSet
+	}
+
+	node, err := s.client.Get(FilesystemSubscriptionStatusPrefix + id)
+	if err != nil {
+		return nil, err
+	}
+	var st types.CommitSubscriptionStatus
+	err = s.decode(node.Value, &st)
+
+	st.Meta = getMeta(node)
+
+	return &st, err
+}
+
+func (s *KVDBFilesystemStore) DeleteCommitSubscriptionStatus(id string) error {
+	if id == "" {
+		return ErrIDNotSet
+	}
+	_, err := s.client.Delete(FilesystemSubscriptionStatusPrefix + id)
+	return err
+}
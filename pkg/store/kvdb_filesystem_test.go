@@ -9,6 +9,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/dotmesh-oss/dotmesh/pkg/crypto"
 	"github.com/dotmesh-oss/dotmesh/pkg/types"
 	"github.com/portworx/kvdb"
 	"github.com/portworx/kvdb/bolt"
@@ -271,3 +272,214 @@ func TestWatchTransfers(t *testing.T) {
 		}
 	}
 }
+
+func TestReplicationPolicy(t *testing.T) {
+
+	client, err := getKVDBClient(&KVDBConfig{
+		Type: KVTypeMem,
+	})
+	if err != nil {
+		t.Fatalf("failed to init kv store: %s", err)
+	}
+
+	kvdb := NewKVDBFilesystemStore(client)
+
+	_, err = kvdb.GetReplicationPolicy("123")
+	if !IsKeyNotFound(err) {
+		t.Errorf("expected key not found, got: %v", err)
+	}
+
+	err = kvdb.SetReplicationPolicy(&types.FilesystemReplicationPolicy{
+		FilesystemID:   "123",
+		MinReplicas:    2,
+		TimeoutSeconds: 10,
+	}, &SetOptions{})
+	if err != nil {
+		t.Fatalf("failed to set replication policy: %s", err)
+	}
+
+	p, err := kvdb.GetReplicationPolicy("123")
+	if err != nil {
+		t.Fatalf("failed to get replication policy: %s", err)
+	}
+	if p.MinReplicas != 2 {
+		t.Errorf("expected 2 replicas, got: %d", p.MinReplicas)
+	}
+	if p.Timeout() != 10*time.Second {
+		t.Errorf("expected 10s timeout, got: %s", p.Timeout())
+	}
+	if !p.Synchronous() {
+		t.Errorf("expected policy to be synchronous")
+	}
+
+	err = kvdb.DeleteReplicationPolicy("123")
+	if err != nil {
+		t.Fatalf("failed to delete replication policy: %s", err)
+	}
+
+	_, err = kvdb.GetReplicationPolicy("123")
+	if !IsKeyNotFound(err) {
+		t.Errorf("expected key not found after deletion, got: %v", err)
+	}
+}
+
+func TestCommitSubscriptions(t *testing.T) {
+
+	client, err := getKVDBClient(&KVDBConfig{
+		Type: KVTypeMem,
+	})
+	if err != nil {
+		t.Fatalf("failed to init kv store: %s", err)
+	}
+
+	kvdb := NewKVDBFilesystemStore(client)
+
+	err = kvdb.SetCommitSubscription(&types.CommitSubscription{
+		Id:         "sub-1",
+		NatsURL:    "nats://remote:4222",
+		RemoteName: "apples",
+		LocalName:  "apples",
+	}, &SetOptions{})
+	if err != nil {
+		t.Fatalf("failed to set commit subscription: %s", err)
+	}
+
+	err = kvdb.SetCommitSubscriptionStatus(&types.CommitSubscriptionStatus{
+		Id:           "sub-1",
+		Connected:    true,
+		LastCommitId: "commit-1",
+	}, &SetOptions{})
+	if err != nil {
+		t.Fatalf("failed to set commit subscription status: %s", err)
+	}
+
+	// statuses mustn't show up as subscriptions
+	subscriptions, err := kvdb.ListCommitSubscriptions()
+	if err != nil {
+		t.Fatalf("failed to list commit subscriptions: %s", err)
+	}
+	if len(subscriptions) != 1 || subscriptions[0].NatsURL != "nats://remote:4222" {
+		t.Errorf("unexpected subscriptions: %#v", subscriptions)
+	}
+
+	status, err := kvdb.GetCommitSubscriptionStatus("sub-1")
+	if err != nil {
+		t.Fatalf("failed to get commit subscription status: %s", err)
+	}
+	if !status.Connected || status.LastCommitId != "commit-1" {
+		t.Errorf("unexpected status: %#v", status)
+	}
+
+	err = kvdb.DeleteCommitSubscription("sub-1")
+	if err != nil {
+		t.Fatalf("failed to delete commit subscription: %s", err)
+	}
+
+	_, err = kvdb.GetCommitSubscription("sub-1")
+	if !IsKeyNotFound(err) {
+		t.Errorf("expected key not found after deletion, got: %v", err)
+	}
+}
+
+func TestSecretsEncrypted(t *testing.T) {
+	client, err := getKVDBClient(&KVDBConfig{
+		Type: KVTypeMem,
+	})
+	if err != nil {
+		t.Fatalf("failed to init kv store: %s", err)
+	}
+
+	oldKey, err := crypto.GenerateKeyringKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	newKey, err := crypto.GenerateKeyringKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldKeyring, err := crypto.LoadKeyring(oldKey, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotatedKeyring, err := crypto.LoadKeyring(newKey+","+oldKey, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// stored before there was a keyring
+	kvdb := NewKVDBFilesystemStore(client)
+	err = kvdb.SetTransfer(&types.TransferPollResult{TransferRequestId: "1", ApiKey: "legacy-key"}, &SetOptions{})
+	if err != nil {
+		t.Fatalf("failed to set transfer: %s", err)
+	}
+
+	kvdb.SetKeyring(oldKeyring)
+	transfer := &types.TransferPollResult{TransferRequestId: "2", ApiKey: "transfer-key"}
+	err = kvdb.SetTransfer(transfer, &SetOptions{})
+	if err != nil {
+		t.Fatalf("failed to set transfer: %s", err)
+	}
+	if transfer.ApiKey != "transfer-key" {
+		t.Errorf("storing a transfer shouldn't change it, API key is now %s", transfer.ApiKey)
+	}
+	err = kvdb.SetCommitSubscription(&types.CommitSubscription{Id: "sub", ApiKey: "sub-key", NatsPassword: "nats-password"}, &SetOptions{})
+	if err != nil {
+		t.Fatalf("failed to set subscription: %s", err)
+	}
+
+	for _, key := range []string{FilesystemTransfersPrefix + "2", FilesystemSubscriptionsPrefix + "sub"} {
+		kvp, err := client.Get(key)
+		if err != nil {
+			t.Fatalf("failed to get %s: %s", key, err)
+		}
+		if strings.Contains(string(kvp.Value), "-key") || strings.Contains(string(kvp.Value), "nats-password") {
+			t.Errorf("secrets stored in the clear: %s", string(kvp.Value))
+		}
+	}
+
+	transfers, err := kvdb.ListTransfers()
+	if err != nil {
+		t.Fatalf("failed to list transfers: %s", err)
+	}
+	apiKeys := map[string]string{}
+	for _, tr := range transfers {
+		apiKeys[tr.TransferRequestId] = tr.ApiKey
+	}
+	if apiKeys["1"] != "legacy-key" || apiKeys["2"] != "transfer-key" {
+		t.Errorf("unexpected API keys %v", apiKeys)
+	}
+	sub, err := kvdb.GetCommitSubscription("sub")
+	if err != nil {
+		t.Fatalf("failed to get subscription: %s", err)
+	}
+	if sub.ApiKey != "sub-key" || sub.NatsPassword != "nats-password" {
+		t.Errorf("unexpected subscription secrets %s, %s", sub.ApiKey, sub.NatsPassword)
+	}
+
+	// rotating the key rewraps everything not encrypted with the new one
+	kvdb.SetKeyring(rotatedKeyring)
+	rewrapped, err := kvdb.RewrapSecrets()
+	if err != nil {
+		t.Fatalf("failed to rewrap secrets: %s", err)
+	}
+	if rewrapped != 3 {
+		t.Errorf("expected 3 records rewrapped, got %d", rewrapped)
+	}
+	rewrapped, err = kvdb.RewrapSecrets()
+	if err != nil || rewrapped != 0 {
+		t.Errorf("expected nothing left to rewrap, got %d (%v)", rewrapped, err)
+	}
+
+	newKeyring, err := crypto.LoadKeyring(newKey, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	kvdb.SetKeyring(newKeyring)
+	sub, err = kvdb.GetCommitSubscription("sub")
+	if err != nil {
+		t.Fatalf("failed to get subscription with only the new key: %s", err)
+	}
+	if sub.ApiKey != "sub-key" || sub.NatsPassword != "nats-password" {
+		t.Errorf("unexpected subscription secrets %s, %s", sub.ApiKey, sub.NatsPassword)
+	}
+}
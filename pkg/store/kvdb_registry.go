@@ -343,3 +343,73 @@ func (s *KVDBFilesystemStore) ImportFilesystems(fs []*types.RegistryFilesystem,
 	}
 	return nil
 }
+
+// Placement policies
+
+func placementKey(namespace, filesystemName string) string {
+	if filesystemName == "" {
+		return RegistryPlacementPrefix + namespace
+	}
+	return RegistryPlacementPrefix + namespace + "/" + filesystemName
+}
+
+func (s *KVDBFilesystemStore) SetPlacementPolicy(p *types.PlacementPolicy, opts *SetOptions) error {
+	if p.Namespace == "" {
+		return fmt.Errorf("namespace not set")
+	}
+
+	bts, err := s.encode(p)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.client.Put(placementKey(p.Namespace, p.Name), bts, 0)
+	return err
+}
+
+func (s *KVDBFilesystemStore) GetPlacementPolicy(namespace, filesystemName string) (*types.PlacementPolicy, error) {
+	node, err := s.client.Get(placementKey(namespace, filesystemName))
+	if err != nil {
+		return nil, err
+	}
+	var p types.PlacementPolicy
+	err = s.decode(node.Value, &p)
+
+	p.Meta = getMeta(node)
+
+	return &p, err
+}
+
+func (s *KVDBFilesystemStore) DeletePlacementPolicy(namespace, filesystemName string) error {
+	_, err := s.client.Delete(placementKey(namespace, filesystemName))
+	return err
+}
+
+// Signing policies
+
+func (s *KVDBFilesystemStore) SetSigningPolicy(p *types.SigningPolicy, opts *SetOptions) error {
+	if p.Namespace == "" {
+		return fmt.Errorf("namespace not set")
+	}
+
+	bts, err := s.encode(p)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.client.Put(RegistrySigningPrefix+p.Namespace, bts, 0)
+	return err
+}
+
+func (s *KVDBFilesystemStore) GetSigningPolicy(namespace string) (*types.SigningPolicy, error) {
+	node, err := s.client.Get(RegistrySigningPrefix + namespace)
+	if err != nil {
+		return nil, err
+	}
+	var p types.SigningPolicy
+	err = s.decode(node.Value, &p)
+
+	p.Meta = getMeta(node)
+
+	return &p, err
+}
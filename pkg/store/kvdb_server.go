@@ -73,7 +73,7 @@ func (s *KVServerStore) WatchAddresses(idx uint64, cb WatchServerAddressesClones
 
 		var srv types.Server
 
-		if kvp.Action == kvdb.KVDelete {
+		if kvp.Action == kvdb.KVDelete || kvp.Action == kvdb.KVExpire {
 			serverID, err := extractID(kvp.Key)
 			if err != nil {
 				return nil
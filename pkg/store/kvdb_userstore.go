@@ -18,6 +18,9 @@ type KVStoreWithIndex interface {
 	AddToIndex(prefix, name, id string) error
 
 	Set(prefix, id string, val []byte) (*kvdb.KVPair, error)
+	// CompareAndSet sets a value only if it hasn't changed since it was
+	// read at modifiedIndex, see IsModified
+	CompareAndSet(prefix, id string, val []byte, modifiedIndex uint64) (*kvdb.KVPair, error)
 	Get(prefix, ref string) (*kvdb.KVPair, error)
 	Delete(prefix, id string) error
 }
@@ -82,6 +85,14 @@ func (s *KVDBStoreWithIndex) Set(prefix, id string, val []byte) (*kvdb.KVPair, e
 	return s.client.Put(s.namespace+"/"+prefix+"/"+id, val, 0)
 }
 
+func (s *KVDBStoreWithIndex) CompareAndSet(prefix, id string, val []byte, modifiedIndex uint64) (*kvdb.KVPair, error) {
+	return s.client.CompareAndSet(&kvdb.KVPair{
+		Key:           s.namespace + "/" + prefix + "/" + id,
+		Value:         val,
+		ModifiedIndex: modifiedIndex,
+	}, kvdb.KVModifiedIndex, nil)
+}
+
 func (s *KVDBStoreWithIndex) Get(prefix, ref string) (*kvdb.KVPair, error) {
 	if validator.IsUUID(ref) {
 		return s.get(prefix, ref)
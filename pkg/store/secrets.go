@@ -0,0 +1,126 @@
+package store
+
+import (
+	"encoding/json"
+
+	"github.com/dotmesh-oss/dotmesh/pkg/crypto"
+	"github.com/dotmesh-oss/dotmesh/pkg/types"
+	"github.com/portworx/kvdb"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// SetKeyring has secrets encrypted with keyring when they're stored. Secrets
+// stored before, in the clear or with a key since rotated, are still read;
+// RewrapSecrets encrypts them with the keyring's current key.
+func (s *KVDBFilesystemStore) SetKeyring(keyring *crypto.Keyring) {
+	s.keyring = keyring
+}
+
+// secretsOf returns the fields of object that are kept encrypted
+func secretsOf(object interface{}) []*string {
+	switch o := object.(type) {
+	case *types.TransferPollResult:
+		return []*string{&o.ApiKey}
+	case *types.CommitSubscription:
+		return []*string{&o.ApiKey, &o.NatsPassword}
+	}
+	return nil
+}
+
+// encryptSecrets returns a copy of object with its secrets encrypted, or
+// object itself if it hasn't got any
+func (s *KVDBFilesystemStore) encryptSecrets(object interface{}) (interface{}, error) {
+	switch o := object.(type) {
+	case *types.TransferPollResult:
+		c := *o
+		object = &c
+	case *types.CommitSubscription:
+		c := *o
+		object = &c
+	default:
+		return object, nil
+	}
+	for _, secret := range secretsOf(object) {
+		encrypted, err := s.keyring.Encrypt(*secret)
+		if err != nil {
+			return nil, err
+		}
+		*secret = encrypted
+	}
+	return object, nil
+}
+
+func (s *KVDBFilesystemStore) decryptSecrets(object interface{}) error {
+	for _, secret := range secretsOf(object) {
+		decrypted, err := s.keyring.Decrypt(*secret)
+		if err != nil {
+			return err
+		}
+		*secret = decrypted
+	}
+	return nil
+}
+
+// RewrapSecrets encrypts stored secrets that are in the clear, or encrypted
+// with a key that's no longer the keyring's first, with its first key. It
+// returns how many records it rewrote.
+func (s *KVDBFilesystemStore) RewrapSecrets() (int, error) {
+	if s.keyring == nil {
+		return 0, nil
+	}
+	rewrapped := 0
+	for _, kind := range []struct {
+		prefix string
+		new    func() interface{}
+	}{
+		{FilesystemTransfersPrefix, func() interface{} { return &types.TransferPollResult{} }},
+		{FilesystemSubscriptionsPrefix, func() interface{} { return &types.CommitSubscription{} }},
+	} {
+		pairs, err := s.client.Enumerate(kind.prefix)
+		if err != nil {
+			return rewrapped, err
+		}
+		for _, kvp := range pairs {
+			stored := kind.new()
+			err = json.Unmarshal(kvp.Value, stored)
+			if err != nil {
+				continue
+			}
+			needsRewrap := false
+			for _, secret := range secretsOf(stored) {
+				needsRewrap = needsRewrap || s.keyring.NeedsRewrap(*secret)
+			}
+			if !needsRewrap {
+				continue
+			}
+			err = s.decryptSecrets(stored)
+			if err != nil {
+				log.WithFields(log.Fields{
+					"error": err,
+					"key":   kvp.Key,
+				}).Error("[RewrapSecrets] failed to decrypt secrets")
+				continue
+			}
+			bts, err := s.encode(stored)
+			if err != nil {
+				return rewrapped, err
+			}
+			// transfers are updated often, don't overwrite a newer update
+			_, err = s.client.CompareAndSet(&kvdb.KVPair{
+				Key:           kvp.Key,
+				Value:         bts,
+				ModifiedIndex: kvp.ModifiedIndex,
+			}, kvdb.KVModifiedIndex, nil)
+			if err != nil {
+				log.WithFields(log.Fields{
+					"error": err,
+					"key":   kvp.Key,
+				}).Warn("[RewrapSecrets] record changed while rewrapping, it will be encrypted when it's next stored")
+				continue
+			}
+			rewrapped++
+		}
+	}
+	return rewrapped, nil
+}
@@ -49,6 +49,22 @@ type FilesystemStore interface {
 	SetTransfer(t *types.TransferPollResult, opts *SetOptions) error
 	WatchTransfers(idx uint64, cb WatchTransfersCB) error
 	ListTransfers() ([]*types.TransferPollResult, error)
+
+	// filesystems/replication/<id>
+	SetReplicationPolicy(p *types.FilesystemReplicationPolicy, opts *SetOptions) error
+	GetReplicationPolicy(id string) (*types.FilesystemReplicationPolicy, error)
+	DeleteReplicationPolicy(id string) error
+
+	// filesystems/subscriptions/<id>
+	SetCommitSubscription(cs *types.CommitSubscription, opts *SetOptions) error
+	GetCommitSubscription(id string) (*types.CommitSubscription, error)
+	DeleteCommitSubscription(id string) error
+	ListCommitSubscriptions() ([]*types.CommitSubscription, error)
+
+	// filesystems/subscriptionStatus/<id>
+	SetCommitSubscriptionStatus(st *types.CommitSubscriptionStatus, opts *SetOptions) error
+	GetCommitSubscriptionStatus(id string) (*types.CommitSubscriptionStatus, error)
+	DeleteCommitSubscriptionStatus(id string) error
 }
 
 // Callbacks for filesystem events
@@ -76,6 +92,15 @@ type RegistryStore interface {
 	WatchFilesystems(idx uint64, cb WatchRegistryFilesystemsCB) error
 	ListFilesystems() ([]*types.RegistryFilesystem, error)
 
+	// registry/placement/<namespace>[/<name>]
+	SetPlacementPolicy(p *types.PlacementPolicy, opts *SetOptions) error
+	GetPlacementPolicy(namespace, filesystemName string) (*types.PlacementPolicy, error)
+	DeletePlacementPolicy(namespace, filesystemName string) error
+
+	// registry/signing/<namespace>
+	SetSigningPolicy(p *types.SigningPolicy, opts *SetOptions) error
+	GetSigningPolicy(namespace string) (*types.SigningPolicy, error)
+
 	// Misc
 	ImportClones(clones []*types.Clone, opts *ImportOptions) error
 	ImportFilesystems(fs []*types.RegistryFilesystem, opts *ImportOptions) error
@@ -1,18 +1,23 @@
 package store
 
 const (
-	FilesystemMastersPrefix        = "filesystems/masters/"
-	FilesystemDeletedPrefix        = "filesystems/deleted/"
-	FilesystemCleanupPendingPrefix = "filesystems/cleanupPending/"
-	FilesystemLivePrefix           = "filesystems/live/"
-	FilesystemContainersPrefix     = "filesystems/containers/"
-	FilesystemDirtyPrefix          = "filesystems/dirty/"
-	FilesystemTransfersPrefix      = "filesystems/transfers/"
+	FilesystemMastersPrefix            = "filesystems/masters/"
+	FilesystemDeletedPrefix            = "filesystems/deleted/"
+	FilesystemCleanupPendingPrefix     = "filesystems/cleanupPending/"
+	FilesystemLivePrefix               = "filesystems/live/"
+	FilesystemContainersPrefix         = "filesystems/containers/"
+	FilesystemDirtyPrefix              = "filesystems/dirty/"
+	FilesystemTransfersPrefix          = "filesystems/transfers/"
+	FilesystemReplicationPrefix        = "filesystems/replication/"
+	FilesystemSubscriptionsPrefix      = "filesystems/subscriptions/"
+	FilesystemSubscriptionStatusPrefix = "filesystems/subscriptionStatus/"
 )
 
 const (
 	RegistryClonesPrefix      = "registry/clones/"
 	RegistryFilesystemsPrefix = "registry/filesystems/"
+	RegistryPlacementPrefix   = "registry/placement/"
+	RegistrySigningPrefix     = "registry/signing/"
 )
 
 type KVType string
@@ -10,11 +10,19 @@ import (
 )
 
 func (s *KVDBFilesystemStore) encode(object interface{}) ([]byte, error) {
+	object, err := s.encryptSecrets(object)
+	if err != nil {
+		return nil, err
+	}
 	return json.Marshal(object)
 }
 
 func (s *KVDBFilesystemStore) decode(data []byte, v interface{}) error {
-	return json.Unmarshal(data, v)
+	err := json.Unmarshal(data, v)
+	if err != nil {
+		return err
+	}
+	return s.decryptSecrets(v)
 }
 
 func (s *KVServerStore) encode(object interface{}) ([]byte, error) {
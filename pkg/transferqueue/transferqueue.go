@@ -0,0 +1,109 @@
+// Package transferqueue decides which queued pushes and pulls may start,
+// within a cluster's limits on how many transfers run at once.
+//
+// It keeps no state of its own: every node works out the same answer from
+// the transfers it knows about, which are replicated to all of them through
+// the KV store, so that the limits hold across the cluster without a node
+// in charge of the queue.
+package transferqueue
+
+import (
+	"sort"
+
+	"github.com/dotmesh-oss/dotmesh/pkg/types"
+)
+
+// Queued is the Status of a transfer waiting for its turn to start
+const Queued = "queued"
+
+// Limits are how many transfers may run at once; 0 means no limit
+type Limits struct {
+	// across the whole cluster
+	MaxConcurrent int
+	// with any one peer: another cluster, or an S3 bucket
+	MaxConcurrentPerPeer int
+}
+
+// Peer identifies the other end of a transfer for the per-peer limit
+func Peer(t types.TransferPollResult) string {
+	if t.Peer == "" {
+		// S3 transfers don't have a peer, just a bucket
+		return "s3:" + t.RemoteName
+	}
+	return t.Peer
+}
+
+// Running says whether a transfer counts towards the limits: it's started
+// and hasn't finished, failed or been cancelled. Paused transfers count,
+// since they're still holding their streams open.
+func Running(t types.TransferPollResult) bool {
+	switch t.Status {
+	case Queued, "finished", "error", "cancelled":
+		return false
+	}
+	return true
+}
+
+// Ordered returns the queued transfers among transfers in the order they
+// should start: highest priority first, then the ones queued longest
+func Ordered(transfers []types.TransferPollResult) []types.TransferPollResult {
+	queued := []types.TransferPollResult{}
+	for _, t := range transfers {
+		if t.Status == Queued {
+			queued = append(queued, t)
+		}
+	}
+	sort.SliceStable(queued, func(i, j int) bool {
+		a, b := queued[i], queued[j]
+		if a.Priority != b.Priority {
+			return a.Priority > b.Priority
+		}
+		if !a.QueuedAt.Equal(b.QueuedAt) {
+			return a.QueuedAt.Before(b.QueuedAt)
+		}
+		return a.TransferRequestId < b.TransferRequestId
+	})
+	return queued
+}
+
+// Position is where a queued transfer stands
+type Position struct {
+	// whether it may start now
+	Start bool
+	// how many transfers that can't start yet are ahead of it
+	Ahead int
+}
+
+// Positions works out, for every queued transfer among transfers (all the
+// transfers the cluster is running or has queued), whether it may start
+// now, keyed by transfer id.
+//
+// Transfers start in the order Ordered returns them, as long as the limits
+// allow; one that would take its peer over the per-peer limit doesn't hold
+// up the ones behind it that are for other peers.
+func Positions(transfers []types.TransferPollResult, limits Limits) map[string]Position {
+	running := 0
+	runningByPeer := map[string]int{}
+	for _, t := range transfers {
+		if Running(t) {
+			running++
+			runningByPeer[Peer(t)]++
+		}
+	}
+
+	positions := map[string]Position{}
+	waiting := 0
+	for _, t := range Ordered(transfers) {
+		peer := Peer(t)
+		if (limits.MaxConcurrent == 0 || running < limits.MaxConcurrent) &&
+			(limits.MaxConcurrentPerPeer == 0 || runningByPeer[peer] < limits.MaxConcurrentPerPeer) {
+			positions[t.TransferRequestId] = Position{Start: true}
+			running++
+			runningByPeer[peer]++
+			continue
+		}
+		positions[t.TransferRequestId] = Position{Ahead: waiting}
+		waiting++
+	}
+	return positions
+}
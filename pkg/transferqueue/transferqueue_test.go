@@ -0,0 +1,96 @@
+package transferqueue
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dotmesh-oss/dotmesh/pkg/types"
+)
+
+func queued(id, peer string, priority int, queuedAt time.Time) types.TransferPollResult {
+	return types.TransferPollResult{
+		TransferRequestId: id,
+		Peer:              peer,
+		Status:            Queued,
+		Priority:          priority,
+		QueuedAt:          queuedAt,
+	}
+}
+
+func TestOrdered(t *testing.T) {
+	now := time.Now()
+	ordered := Ordered([]types.TransferPollResult{
+		queued("late", "a", 0, now.Add(time.Minute)),
+		{TransferRequestId: "running", Status: "pushing"},
+		queued("early", "a", 0, now),
+		queued("urgent", "a", 10, now.Add(time.Hour)),
+	})
+	ids := []string{}
+	for _, t := range ordered {
+		ids = append(ids, t.TransferRequestId)
+	}
+	expected := []string{"urgent", "early", "late"}
+	if len(ids) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, ids)
+	}
+	for i := range expected {
+		if ids[i] != expected[i] {
+			t.Errorf("expected %v, got %v", expected, ids)
+			break
+		}
+	}
+}
+
+func TestPositionsGlobalLimit(t *testing.T) {
+	now := time.Now()
+	positions := Positions([]types.TransferPollResult{
+		{TransferRequestId: "r1", Peer: "a", Status: "pushing"},
+		{TransferRequestId: "done", Peer: "a", Status: "finished"},
+		queued("q1", "b", 0, now),
+		queued("q2", "c", 0, now.Add(time.Second)),
+		queued("q3", "d", 0, now.Add(2*time.Second)),
+	}, Limits{MaxConcurrent: 2})
+
+	expected := map[string]Position{
+		"q1": {Start: true},
+		"q2": {Ahead: 0},
+		"q3": {Ahead: 1},
+	}
+	for id, p := range expected {
+		if positions[id] != p {
+			t.Errorf("expected %s to be %+v, got %+v", id, p, positions[id])
+		}
+	}
+	if _, ok := positions["r1"]; ok {
+		t.Errorf("didn't expect a position for a running transfer")
+	}
+}
+
+func TestPositionsPerPeerLimit(t *testing.T) {
+	now := time.Now()
+	positions := Positions([]types.TransferPollResult{
+		{TransferRequestId: "r1", Peer: "busy", Status: "paused"},
+		queued("q1", "busy", 0, now),
+		queued("q2", "idle", 0, now.Add(time.Second)),
+		{TransferRequestId: "s3", RemoteName: "bucket", Status: Queued, QueuedAt: now.Add(2 * time.Second)},
+	}, Limits{MaxConcurrent: 10, MaxConcurrentPerPeer: 1})
+
+	if positions["q1"].Start {
+		t.Errorf("expected the transfer for a busy peer to wait")
+	}
+	if !positions["q2"].Start || !positions["s3"].Start {
+		t.Errorf("expected transfers for other peers to start, got %+v", positions)
+	}
+}
+
+func TestPositionsNoLimits(t *testing.T) {
+	transfers := []types.TransferPollResult{}
+	for _, id := range []string{"a", "b", "c"} {
+		transfers = append(transfers, queued(id, "peer", 0, time.Now()))
+	}
+	for id, p := range Positions(transfers, Limits{}) {
+		if !p.Start {
+			t.Errorf("expected %s to start with no limits", id)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package types
+
+// ActivityType - the kind of change an ActivityEvent describes
+type ActivityType string
+
+const (
+	// a filesystem machine on some server changed state
+	ActivityTransition ActivityType = "transition"
+	// the master of a branch has new commits
+	ActivityCommit ActivityType = "commit"
+	// a transfer made progress, finished or failed
+	ActivityTransfer ActivityType = "transfer"
+	// the amount of uncommitted data on a branch changed
+	ActivityDirty ActivityType = "dirty"
+)
+
+// ActivityEvent - an entry in the stream of dot activity served on /events
+// and consumed by 'dm watch'. Fields which don't apply to the Type are left
+// empty.
+type ActivityEvent struct {
+	Type      ActivityType
+	Timestamp int64 // unix nanoseconds
+
+	FilesystemId string
+	Namespace    string
+	Name         string
+	Branch       string
+
+	Server string `json:",omitempty"`
+
+	// ActivityTransition
+	State  string `json:",omitempty"`
+	Status string `json:",omitempty"`
+
+	// ActivityCommit
+	CommitId string            `json:",omitempty"`
+	Metadata map[string]string `json:",omitempty"`
+
+	// ActivityTransfer
+	Transfer *TransferPollResult `json:",omitempty"`
+
+	// ActivityDirty
+	DirtyBytes int64 `json:",omitempty"`
+	SizeBytes  int64 `json:",omitempty"`
+}
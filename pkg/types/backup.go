@@ -1,16 +1,189 @@
 package types
 
-import "time"
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"time"
+)
 
 type BackupV1 struct {
-	Version             string                `json:"version"`
+	Version string `json:"version"`
+	// version of the dotmesh-server that made the backup
+	ServerVersion       string                `json:"server_version,omitempty"`
 	Created             time.Time             `json:"created"`
 	Users               []*User               `json:"users"`
 	FilesystemMasters   []*FilesystemMaster   `json:"filesystem_masters"`
 	RegistryFilesystems []*RegistryFilesystem `json:"registry_filesystems"`
 	RegistryClones      []*Clone              `json:"registry_clones"`
+	// backups from before organizations were backed up don't have them
+	Organizations []*Organization `json:"organizations,omitempty"`
+	// Checksum is of the backup without it, "sha256:<hex>"; backups from
+	// before checksums were added don't have one
+	Checksum string `json:"checksum,omitempty"`
 }
 
 const BackupVersion string = "v1"
 
 var BackupSupportedVersions = []string{"v1"}
+
+// ComputeChecksum works out what the backup's Checksum should be
+func (b *BackupV1) ComputeChecksum() (string, error) {
+	unsummed := *b
+	unsummed.Checksum = ""
+	bts, err := json.Marshal(&unsummed)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(bts)
+	return "sha256:" + hex.EncodeToString(sum[:]), nil
+}
+
+// VerifyChecksum checks that the backup hasn't changed since its checksum
+// was computed, if it has one
+func (b *BackupV1) VerifyChecksum() error {
+	if b.Checksum == "" {
+		return nil
+	}
+	expected, err := b.ComputeChecksum()
+	if err != nil {
+		return err
+	}
+	if expected != b.Checksum {
+		return fmt.Errorf("backup checksum mismatch, expected %s but it's %s: the backup is damaged", b.Checksum, expected)
+	}
+	return nil
+}
+
+// BackupInfo describes a backup kept by scheduled backups
+type BackupInfo struct {
+	Name    string
+	Created time.Time
+	Size    int64
+}
+
+type RestoreBackupArgs struct {
+	// one of: a backup to restore, the name of a kept backup, or a time to
+	// restore the latest kept backup made at or before
+	Dump   string
+	Backup string
+	At     time.Time
+	// DryRun reports what would change without changing anything
+	DryRun bool
+}
+
+// BackupChanges is what restoring a backup would change in one kind of
+// record, by key
+type BackupChanges struct {
+	// in the backup but not the KV store
+	Added []string
+	// in the KV store but not the backup
+	Removed []string
+	// in both but different
+	Changed []string
+}
+
+// RestoreReport is what restoring a backup changes in the KV store
+type RestoreReport struct {
+	// the kept backup restored, if it was one
+	Backup        string
+	Created       time.Time
+	ServerVersion string
+
+	Users               BackupChanges
+	FilesystemMasters   BackupChanges
+	RegistryFilesystems BackupChanges
+	RegistryClones      BackupChanges
+	Organizations       BackupChanges
+}
+
+// CompareBackups works out what restoring backup would change from current
+func CompareBackups(current, backup *BackupV1) RestoreReport {
+	report := RestoreReport{
+		Created:       backup.Created,
+		ServerVersion: backup.ServerVersion,
+	}
+
+	usersOf := func(b *BackupV1) map[string]interface{} {
+		m := map[string]interface{}{}
+		for _, u := range b.Users {
+			m[u.Name] = u
+		}
+		return m
+	}
+	report.Users = compareRecords(usersOf(current), usersOf(backup))
+
+	mastersOf := func(b *BackupV1) map[string]interface{} {
+		m := map[string]interface{}{}
+		for _, fm := range b.FilesystemMasters {
+			m[fm.FilesystemID] = fm
+		}
+		return m
+	}
+	report.FilesystemMasters = compareRecords(mastersOf(current), mastersOf(backup))
+
+	filesystemsOf := func(b *BackupV1) map[string]interface{} {
+		m := map[string]interface{}{}
+		for _, rf := range b.RegistryFilesystems {
+			m[rf.OwnerId+"/"+rf.Name] = rf
+		}
+		return m
+	}
+	report.RegistryFilesystems = compareRecords(filesystemsOf(current), filesystemsOf(backup))
+
+	clonesOf := func(b *BackupV1) map[string]interface{} {
+		m := map[string]interface{}{}
+		for _, c := range b.RegistryClones {
+			m[c.TopLevelFilesystemId+"/"+c.Name] = c
+		}
+		return m
+	}
+	report.RegistryClones = compareRecords(clonesOf(current), clonesOf(backup))
+
+	organizationsOf := func(b *BackupV1) map[string]interface{} {
+		m := map[string]interface{}{}
+		for _, o := range b.Organizations {
+			m[o.Name] = o
+		}
+		return m
+	}
+	report.Organizations = compareRecords(organizationsOf(current), organizationsOf(backup))
+
+	return report
+}
+
+func compareRecords(current, backup map[string]interface{}) BackupChanges {
+	changes := BackupChanges{Added: []string{}, Removed: []string{}, Changed: []string{}}
+	for key, record := range backup {
+		currentRecord, ok := current[key]
+		if !ok {
+			changes.Added = append(changes.Added, key)
+		} else if !sameRecord(currentRecord, record) {
+			changes.Changed = append(changes.Changed, key)
+		}
+	}
+	for key := range current {
+		if _, ok := backup[key]; !ok {
+			changes.Removed = append(changes.Removed, key)
+		}
+	}
+	sort.Strings(changes.Added)
+	sort.Strings(changes.Removed)
+	sort.Strings(changes.Changed)
+	return changes
+}
+
+// sameRecord compares records as they're stored, ignoring what the KV store
+// adds to them
+func sameRecord(a, b interface{}) bool {
+	aJSON, aErr := json.Marshal(a)
+	bJSON, bErr := json.Marshal(b)
+	if aErr != nil || bErr != nil {
+		return reflect.DeepEqual(a, b)
+	}
+	return bytes.Equal(aJSON, bJSON)
+}
@@ -0,0 +1,120 @@
+package types
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testBackup() *BackupV1 {
+	return &BackupV1{
+		Version:       BackupVersion,
+		ServerVersion: "release-0.9.0",
+		Created:       time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC),
+		Users:         []*User{{Id: "1", Name: "admin"}, {Id: "2", Name: "alice"}},
+		FilesystemMasters: []*FilesystemMaster{
+			{FilesystemID: "fs-1", NodeID: "node-1"},
+			{FilesystemID: "fs-2", NodeID: "node-1"},
+		},
+		RegistryFilesystems: []*RegistryFilesystem{{Id: "fs-1", OwnerId: "alice", Name: "dot"}},
+		RegistryClones: []*Clone{{
+			TopLevelFilesystemId: "fs-1", FilesystemId: "fs-2", Name: "branch",
+			Origin: Origin{FilesystemId: "fs-1", SnapshotId: "snap"},
+		}},
+		Organizations: []*Organization{{
+			Id: "4", Name: "datateam",
+			Members: []OrganizationMember{{UserId: "2", Name: "alice", Role: OrganizationRoleOwner}},
+		}},
+	}
+}
+
+func TestBackupChecksum(t *testing.T) {
+	backup := testBackup()
+	err := backup.VerifyChecksum()
+	if err != nil {
+		t.Errorf("expected a backup without a checksum to verify, got %s", err)
+	}
+
+	checksum, err := backup.ComputeChecksum()
+	if err != nil {
+		t.Fatal(err)
+	}
+	backup.Checksum = checksum
+	again, _ := backup.ComputeChecksum()
+	if again != checksum {
+		t.Errorf("expected the checksum not to cover itself, got %s then %s", checksum, again)
+	}
+	err = backup.VerifyChecksum()
+	if err != nil {
+		t.Errorf("expected the checksum to verify, got %s", err)
+	}
+
+	backup.RegistryFilesystems[0].Name = "tampered"
+	err = backup.VerifyChecksum()
+	if err == nil {
+		t.Errorf("expected a changed backup not to verify")
+	}
+}
+
+func TestCompareBackups(t *testing.T) {
+	current := testBackup()
+	backup := testBackup()
+	backup.Users = append(backup.Users, &User{Id: "3", Name: "bob"})
+	backup.FilesystemMasters[1].NodeID = "node-2"
+	backup.RegistryClones = nil
+	backup.Organizations[0].Members = append(backup.Organizations[0].Members,
+		OrganizationMember{UserId: "3", Name: "bob", Role: OrganizationRoleMember})
+	// what the KV store adds doesn't count as a change
+	current.RegistryFilesystems[0].Meta = &KVMeta{ModifiedIndex: 42}
+
+	report := CompareBackups(current, backup)
+	if report.ServerVersion != "release-0.9.0" || !report.Created.Equal(backup.Created) {
+		t.Errorf("expected the report to describe the backup, got %+v", report)
+	}
+	expected := map[string]BackupChanges{
+		"users":    {Added: []string{"bob"}, Removed: []string{}, Changed: []string{}},
+		"masters":  {Added: []string{}, Removed: []string{}, Changed: []string{"fs-2"}},
+		"registry": {Added: []string{}, Removed: []string{}, Changed: []string{}},
+		"branches": {Added: []string{}, Removed: []string{"fs-1/branch"}, Changed: []string{}},
+		"orgs":     {Added: []string{}, Removed: []string{}, Changed: []string{"datateam"}},
+	}
+	got := map[string]BackupChanges{
+		"users":    report.Users,
+		"masters":  report.FilesystemMasters,
+		"registry": report.RegistryFilesystems,
+		"branches": report.RegistryClones,
+		"orgs":     report.Organizations,
+	}
+	if !reflect.DeepEqual(expected, got) {
+		t.Errorf("expected changes %+v, got %+v", expected, got)
+	}
+}
+
+func TestBackupChecksumWithoutOrganizations(t *testing.T) {
+	// backups from before organizations were backed up still verify
+	backup := testBackup()
+	backup.Organizations = nil
+	checksum, err := backup.ComputeChecksum()
+	if err != nil {
+		t.Fatal(err)
+	}
+	backup.Checksum = checksum
+	data, err := json.Marshal(backup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "organizations") {
+		t.Errorf("expected no organizations in %s", data)
+	}
+	var parsed BackupV1
+	err = json.Unmarshal(data, &parsed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = parsed.VerifyChecksum()
+	if err != nil {
+		t.Errorf("expected the checksum to verify, got %s", err)
+	}
+}
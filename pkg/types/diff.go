@@ -5,6 +5,7 @@ import (
 	"encoding/base64"
 	"encoding/gob"
 	"fmt"
+	"time"
 )
 
 type FileChange uint
@@ -66,3 +67,27 @@ type RPCDiffRequest struct {
 type RPCDiffResponse struct {
 	Files []ZFSFileDiff
 }
+
+// CommitFileDiff - how one file differs between two commits, or a commit and
+// the working copy
+type CommitFileDiff struct {
+	Change   FileChange `json:"change"`
+	Filename string     `json:"filename"`
+
+	// Zero on the side where the file doesn't exist
+	FromSize     int64     `json:"from_size"`
+	ToSize       int64     `json:"to_size"`
+	FromModified time.Time `json:"from_modified"`
+	ToModified   time.Time `json:"to_modified"`
+
+	// Only filled in when content was asked for. Unified is empty for
+	// binary files, and for text files too large or too different to diff.
+	Binary   bool   `json:"binary,omitempty"`
+	TooLarge bool   `json:"too_large,omitempty"`
+	Unified  string `json:"unified,omitempty"`
+}
+
+// SizeDelta - how many bytes bigger the file got
+func (d CommitFileDiff) SizeDelta() int64 {
+	return d.ToSize - d.FromSize
+}
@@ -69,6 +69,37 @@ type FilesystemContainers struct {
 	Containers   []container.DockerContainer `json:"containers"`
 }
 
+// FilesystemReplicationPolicy - per-dot guarantee on how many nodes must hold
+// a new commit before DotmeshRPC.Commit returns. Keyed on the top level
+// filesystem ID, so it applies to every branch of the dot.
+type FilesystemReplicationPolicy struct {
+	// Meta is populated by the KV store implementer
+	Meta *KVMeta `json:"-"`
+
+	FilesystemID string `json:"filesystem_id"`
+	// MinReplicas counts the master too, so 0 or 1 means asynchronous
+	// replication (the default)
+	MinReplicas int `json:"min_replicas"`
+	// TimeoutSeconds is how long Commit waits for MinReplicas nodes to
+	// acknowledge the snapshot, 0 means DefaultReplicationTimeoutSeconds
+	TimeoutSeconds int64 `json:"timeout_seconds"`
+}
+
+const DefaultReplicationTimeoutSeconds = 30
+
+// Synchronous - whether commits should wait for replicas
+func (p *FilesystemReplicationPolicy) Synchronous() bool {
+	return p != nil && p.MinReplicas > 1
+}
+
+// Timeout - how long to wait for replicas, applying the default
+func (p *FilesystemReplicationPolicy) Timeout() time.Duration {
+	if p.TimeoutSeconds <= 0 {
+		return DefaultReplicationTimeoutSeconds * time.Second
+	}
+	return time.Duration(p.TimeoutSeconds) * time.Second
+}
+
 // KVAction specifies the action on a KV pair. This is useful to make decisions
 // from the results of  a Watch.
 type KVAction int
@@ -106,3 +137,65 @@ func (kv KVAction) String() string {
 		return "not set"
 	}
 }
+
+// CommitSubscription - a standing request to pull a branch from a remote
+// cluster whenever that cluster announces a new commit on it over NATS.
+type CommitSubscription struct {
+	// Meta is populated by the KV store implementer
+	Meta *KVMeta `json:"-"`
+
+	Id string `json:"id"`
+
+	// Where the remote cluster publishes its commit notifications, Subject
+	// defaults to NATSPublishCommitsSubject
+	NatsURL      string `json:"nats_url"`
+	NatsUsername string `json:"nats_username"`
+	NatsPassword string `json:"nats_password"`
+	Subject      string `json:"subject"`
+
+	// How to pull from the remote cluster
+	Peer   string `json:"peer"`
+	Port   int    `json:"port"`
+	User   string `json:"user"`
+	ApiKey string `json:"api_key"`
+
+	RemoteNamespace  string `json:"remote_namespace"`
+	RemoteName       string `json:"remote_name"`
+	RemoteBranchName string `json:"remote_branch_name"`
+	LocalNamespace   string `json:"local_namespace"`
+	LocalName        string `json:"local_name"`
+	LocalBranchName  string `json:"local_branch_name"`
+}
+
+// Safe - a copy of the subscription without its credentials, for showing to
+// users
+func (s CommitSubscription) Safe() CommitSubscription {
+	s.Meta = nil
+	s.NatsPassword = ""
+	s.ApiKey = ""
+	return s
+}
+
+// CommitSubscriptionStatus - what the node handling a CommitSubscription last
+// saw and did about it
+type CommitSubscriptionStatus struct {
+	// Meta is populated by the KV store implementer
+	Meta *KVMeta `json:"-"`
+
+	Id        string `json:"id"`
+	NodeID    string `json:"node_id"`
+	Connected bool   `json:"connected"`
+	// Commit from the most recent matching notification
+	LastCommitId string    `json:"last_commit_id"`
+	LastNotified time.Time `json:"last_notified"`
+	// Pull started in response to it
+	LastTransferId string `json:"last_transfer_id"`
+	LastError      string `json:"last_error"`
+}
+
+// CommitSubscriptionInfo - a CommitSubscription as listed over RPC
+type CommitSubscriptionInfo struct {
+	Subscription CommitSubscription
+	// nil until a node has picked the subscription up
+	Status *CommitSubscriptionStatus
+}
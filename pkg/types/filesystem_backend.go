@@ -0,0 +1,13 @@
+package types
+
+// EnvFilesystemBackend chooses what dotmesh-server keeps dots on
+const EnvFilesystemBackend = "DOTMESH_FILESYSTEM_BACKEND"
+
+// EnvFilesystemDir is where the directory and btrfs backends keep dots
+const EnvFilesystemDir = "DOTMESH_FILESYSTEM_DIR"
+
+const (
+	FilesystemBackendZFS       = "zfs"
+	FilesystemBackendBtrfs     = "btrfs"
+	FilesystemBackendDirectory = "directory"
+)
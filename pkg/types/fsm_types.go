@@ -19,6 +19,9 @@ type InputFile struct {
 	User     string
 	Response chan *Event
 	Extract  bool
+	// With Extract, the archiver format Contents is in: tar, tar.gz, tar.zst
+	// or zip. Empty means work it out from the contents.
+	ArchiveFormat string
 }
 
 // OutputFile is used to read files from the disk on the local node
@@ -31,6 +34,8 @@ type OutputFile struct {
 	Contents          io.Writer
 	User              string
 	Response          chan *Event
+	// the archiver format a directory is sent in; empty means tar
+	ArchiveFormat string
 }
 
 // Return the path of the file on the host in a secure way.
@@ -133,6 +138,14 @@ type TransferPollResult struct {
 	Size               int64 // size of current segment in bytes
 	Sent               int64 // number of bytes of current segment sent so far
 	Message            string
+
+	// Transfers wait in a queue with Status "queued" until the cluster's
+	// transfer concurrency limits let them start, higher Priority first and
+	// otherwise in the order they were QueuedAt. QueuePosition is how many
+	// queued transfers are ahead of this one.
+	Priority      int
+	QueuedAt      time.Time
+	QueuePosition int
 }
 
 func (t TransferPollResult) String() string {
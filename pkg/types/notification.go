@@ -17,3 +17,63 @@ type CommitNotification struct {
 // NATSPublishCommitsSubject - default NATS subject when sending commit
 // notifications
 const NATSPublishCommitsSubject = "dotmesh.commits"
+
+// NATSPublishEventsSubject - default NATS subject when sending every other
+// kind of notification
+const NATSPublishEventsSubject = "dotmesh.events"
+
+// NotificationType - what happened to a dot
+type NotificationType string
+
+const (
+	NotificationCommit           NotificationType = "commit"
+	NotificationBranchCreated    NotificationType = "branch-created"
+	NotificationDotDeleted       NotificationType = "dot-deleted"
+	NotificationTransferFinished NotificationType = "transfer-finished"
+	NotificationTransferFailed   NotificationType = "transfer-failed"
+	NotificationMasterChanged    NotificationType = "master-changed"
+)
+
+// Notification - is used by dotmesh server to send notifications about
+// anything that happens to a dot. Fields which don't apply to the Type are
+// left empty.
+type Notification struct {
+	Type      NotificationType
+	Timestamp int64 // unix nanoseconds
+
+	FilesystemId string
+	Namespace    string
+	Name         string
+	Branch       string `json:",omitempty"`
+
+	// NotificationCommit
+	CommitId string            `json:",omitempty"`
+	Metadata map[string]string `json:",omitempty"`
+
+	// NotificationMasterChanged
+	Server string `json:",omitempty"`
+
+	// NotificationTransferFinished, NotificationTransferFailed
+	TransferId string `json:",omitempty"`
+	Direction  string `json:",omitempty"`
+	Peer       string `json:",omitempty"`
+	Message    string `json:",omitempty"`
+
+	OwnerID         string
+	CollaboratorIDs []string
+}
+
+// Notification - the general form of a commit notification
+func (c *CommitNotification) Notification() *Notification {
+	return &Notification{
+		Type:            NotificationCommit,
+		FilesystemId:    c.FilesystemId,
+		Namespace:       c.Namespace,
+		Name:            c.Name,
+		Branch:          c.Branch,
+		CommitId:        c.CommitId,
+		Metadata:        c.Metadata,
+		OwnerID:         c.OwnerID,
+		CollaboratorIDs: c.CollaboratorIDs,
+	}
+}
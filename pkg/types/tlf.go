@@ -11,4 +11,6 @@ type TopLevelFilesystem struct {
 	Collaborators        []SafeUser
 	ForkParentId         string
 	ForkParentSnapshotId string
+	// the dot whose key an encrypted fork uses, see RegistryFilesystem
+	EncryptionKeyOf *VolumeName
 }
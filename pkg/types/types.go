@@ -13,6 +13,52 @@ type CommitArgs struct {
 	Metadata  map[string]string
 }
 
+type RestoreArgs struct {
+	Namespace  string
+	Name       string
+	Branch     string
+	SnapshotId string
+	// paths within the dot, each a file, symlink or directory
+	Paths []string
+	// commit the working copy once the paths are restored
+	Commit  bool
+	Message string
+}
+
+type RestoreResult struct {
+	// how many files and symlinks were copied out of the commit
+	Files int
+	// the new commit, if one was asked for
+	CommitId string `json:",omitempty"`
+}
+
+// CommitQuery searches the commits of every dot the user can see. Empty
+// fields don't narrow the search.
+type CommitQuery struct {
+	// only search one dot, and optionally one of its branches
+	Namespace string
+	Name      string
+	Branch    string
+	// K8s style selector over commit metadata, e.g. "pipeline=42,env!=test"
+	Selector string
+	Author   string
+	// matched case insensitively
+	MessageContains string
+	// unix nanoseconds, inclusive
+	Since int64
+	Until int64
+	// the most commits to return, newest first; 0 means all of them
+	Limit int
+}
+
+// CommitMatch is a commit found by a CommitQuery
+type CommitMatch struct {
+	Namespace string
+	Name      string
+	Branch    string
+	Commit    Snapshot
+}
+
 type CloneWithName struct {
 	Name  string
 	Clone Clone
@@ -37,6 +83,9 @@ type Server struct {
 
 	Id        string
 	Addresses []string
+	// Labels are set from DOTMESH_NODE_LABELS and matched against the node
+	// selectors of placement policies
+	Labels map[string]string `json:",omitempty"`
 }
 
 type ServerSnapshots struct {
@@ -138,6 +187,8 @@ type S3TransferRequest struct {
 	LocalName       string
 	LocalBranchName string
 	RemoteName      string
+	// transfers with a higher priority start first when they have to queue
+	Priority int
 }
 
 func (transferRequest S3TransferRequest) String() string {
@@ -169,6 +220,8 @@ type TransferRequest struct {
 	// TODO could also include SourceSnapshot here
 	TargetCommit    string // optional, "" means "latest"
 	StashDivergence bool
+	// transfers with a higher priority start first when they have to queue
+	Priority int
 }
 
 func (transferRequest TransferRequest) String() string {
@@ -212,7 +265,133 @@ type RegistryFilesystem struct {
 	Name                 string // volume name
 	ForkParentId         string `json:",omitempty"`
 	ForkParentSnapshotId string `json:",omitempty"`
-	CollaboratorIds      []string
+	// EncryptionKeyOf is the dot whose key an encrypted fork is encrypted
+	// with, which is its origin's, as forks are raw sends
+	EncryptionKeyOf *VolumeName `json:",omitempty"`
+	CollaboratorIds []string
+}
+
+// RegistryPropertiesKey is the user property that a filesystem's
+// RegistryProperties are kept in
+const RegistryPropertiesKey = "io.dotmesh:registry"
+
+// RegistryProperties is what the registry says about a filesystem, kept with
+// it on disk so that the registry can be rebuilt from the pools if the KV
+// store is lost. Filesystem is set for a dot's master branch, Clone for any
+// other branch.
+type RegistryProperties struct {
+	Filesystem *RegistryFilesystem `json:",omitempty"`
+	Clone      *Clone              `json:",omitempty"`
+	// whether the dot's namespace is an organization's, not a user's
+	Organization bool `json:",omitempty"`
+}
+
+type RecoverRegistryArgs struct {
+	// DryRun reports what would be recovered without changing anything
+	DryRun bool
+}
+
+// RegistryRecovery is what RecoverRegistry found in a node's pool that was
+// missing from the registry
+type RegistryRecovery struct {
+	Filesystems []*RegistryFilesystem
+	Clones      []*Clone
+	Masters     []*FilesystemMaster
+	// filesystems without registry properties, which can't be recovered
+	Unrecorded []string
+	// filesystems without a master whose copies on different nodes have
+	// diverged, so that none of them could be made master
+	Diverged []string
+	// owners of recovered dots that aren't users or organizations; the dots
+	// won't be listed until they are
+	MissingUsers         []string
+	MissingOrganizations []string
+}
+
+// PlacementPolicy decides which nodes hold replicas of a dot. A policy with
+// an empty Name applies to every dot in the namespace which doesn't have a
+// policy of its own.
+type PlacementPolicy struct {
+	// Meta is populated by the KV store implementer
+	Meta *KVMeta `json:"-"`
+
+	Namespace string
+	Name      string `json:",omitempty"`
+	// Replicas is the number of nodes, including the master, that should
+	// hold the dot. 0 means every node matching the selector.
+	Replicas int
+	// NodeSelector must be matched by the labels of a node for it to be a
+	// replica
+	NodeSelector map[string]string `json:",omitempty"`
+	// AntiAffinityLabel spreads replicas so that no two of them have the same
+	// value for this node label (e.g. "zone" or "rack")
+	AntiAffinityLabel string `json:",omitempty"`
+}
+
+// SigningPolicy says whether commits to dots in a namespace must be signed
+type SigningPolicy struct {
+	// Meta is populated by the KV store implementer
+	Meta *KVMeta `json:"-"`
+
+	Namespace string
+	Required  bool
+}
+
+// EncryptionKey is the key of an encrypted dot, or of every encrypted dot in
+// a namespace if Name is empty: 64 hex digits, or "" to forget it. Keys set
+// this way are only held in memory, by every node of the cluster.
+type EncryptionKey struct {
+	Namespace string
+	Name      string `json:",omitempty"`
+	Key       string
+}
+
+// AuthConfig is how to get an ID token a server accepts, from the OpenID
+// Connect issuer it trusts; empty if it doesn't trust one
+type AuthConfig struct {
+	OIDCIssuer   string `json:",omitempty"`
+	OIDCClientID string `json:",omitempty"`
+}
+
+// CommitSigningInfo is what a client needs, besides the commit's message and
+// metadata, to sign a commit it's about to make on a branch
+type CommitSigningInfo struct {
+	// the filesystem id of the branch
+	DotId string
+	// the latest commit on the branch, which the new one will follow
+	ParentId string
+	// digest of the branch's working copy as it is now
+	ContentDigest string
+}
+
+// VerifyResult is what each node holding a copy of a commit found when it
+// worked out the commit's content digest again
+type VerifyResult struct {
+	SnapshotId string
+	// the digest recorded when the commit was made, or if it predates
+	// digests, the one the current master works out
+	Expected string
+	Recorded bool
+	Nodes    []NodeVerification
+	// how many nodes' copies don't match, or couldn't be checked
+	Mismatches int
+}
+
+type NodeVerification struct {
+	Node   string
+	Digest string
+	Match  bool
+	Error  string
+	// the pool's latest scrub, as zpool status reports it
+	Scrub string
+}
+
+// BundleImport is what importing a dot bundle did
+type BundleImport struct {
+	Dot    VolumeName
+	Branch string
+	// how many commits it brought, 0 if the dot already had them all
+	Commits int
 }
 
 const EtcdPrefix = "dotmesh.io/"
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 	"reflect"
+	"time"
 )
 
 type User struct {
@@ -13,16 +14,38 @@ type User struct {
 	Email    string
 	Salt     []byte
 	Password []byte
-	ApiKey   string
-	Metadata map[string]string
+	// ApiKey is only kept for the admin user, who nodes authenticate to each
+	// other as, and encrypted if there's a secrets key; other users' are
+	// hashed into ApiKeyHash, and the ApiKey of a user that's been read back
+	// is only set if they authenticated with it
+	ApiKey string
+	// ApiKeyPrefix is the start of the API key, kept to recognise it by
+	ApiKeyPrefix string `json:",omitempty"`
+	ApiKeyHash   []byte `json:",omitempty"`
+	Metadata     map[string]string
+	// public keys the user signs commits with
+	SigningKeys []SigningKey `json:",omitempty"`
+	// Namespaces the user administers besides their own, from the groups
+	// their identity provider says they're in when they log in
+	Namespaces []string `json:",omitempty"`
+}
+
+// SigningKey is a public key a user has registered to sign commits with
+type SigningKey struct {
+	Name string
+	// base64 encoded ed25519 public key, as in a signed commit's metadata
+	PublicKey string
+	Created   time.Time
 }
 
 type SafeUser struct {
-	Id        string
-	Name      string
-	Email     string
-	EmailHash string
-	Metadata  map[string]string
+	Id          string
+	Name        string
+	Email       string
+	EmailHash   string
+	Metadata    map[string]string
+	SigningKeys []SigningKey `json:",omitempty"`
+	Namespaces  []string     `json:",omitempty"`
 }
 
 // SafeUser - returns safe user by hashing email, removing password and APIKey fields
@@ -31,11 +54,13 @@ func (u User) SafeUser() SafeUser {
 	io.WriteString(h, u.Email)
 	emailHash := fmt.Sprintf("%x", h.Sum(nil))
 	return SafeUser{
-		Id:        u.Id,
-		Name:      u.Name,
-		Email:     u.Email,
-		EmailHash: emailHash,
-		Metadata:  u.Metadata,
+		Id:          u.Id,
+		Name:        u.Name,
+		Email:       u.Email,
+		EmailHash:   emailHash,
+		Metadata:    u.Metadata,
+		SigningKeys: u.SigningKeys,
+		Namespaces:  u.Namespaces,
 	}
 }
 
@@ -57,3 +82,40 @@ type Query struct {
 	Ref      string // ID, name, email
 	Selector string // K8s style selector to filter based on user metadata fields
 }
+
+// OrganizationRole is what a member of an organization may do
+type OrganizationRole string
+
+const (
+	// OrganizationRoleOwner members manage the organization's members, and
+	// own its dots
+	OrganizationRoleOwner OrganizationRole = "owner"
+	// OrganizationRoleMember members make dots in the organization's
+	// namespace, and collaborate on all of them
+	OrganizationRoleMember OrganizationRole = "member"
+)
+
+// Organization is a team of users sharing a namespace, named after it
+type Organization struct {
+	Id      string
+	Name    string
+	Members []OrganizationMember
+	Created time.Time
+}
+
+type OrganizationMember struct {
+	UserId string
+	// Name is the user's name when they joined
+	Name string
+	Role OrganizationRole
+}
+
+// Role is the role of a user in the organization, if they're a member
+func (o Organization) Role(userId string) (OrganizationRole, bool) {
+	for _, m := range o.Members {
+		if m.UserId == userId {
+			return m.Role, true
+		}
+	}
+	return "", false
+}
@@ -14,6 +14,14 @@ type DotmeshVolume struct {
 	ServerStatuses       map[string]string // serverId => status
 	ForkParentId         string
 	ForkParentSnapshotId string
+	// DesignatedReplicas are the servers the dot's placement policy assigns
+	// copies of this branch to
+	DesignatedReplicas []string
+	// Encrypted dots are encrypted at rest with ZFS native encryption, and
+	// KeyStatus says whether the master has their key loaded: "available"
+	// or "unavailable"
+	Encrypted bool   `json:",omitempty"`
+	KeyStatus string `json:",omitempty"`
 }
 
 type VolumeName struct {
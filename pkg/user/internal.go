@@ -1,12 +1,15 @@
 package user
 
 import (
+	"crypto/subtle"
 	"encoding/json"
 	"fmt"
+	"reflect"
 
 	"k8s.io/apimachinery/pkg/labels"
 
 	"github.com/dotmesh-oss/dotmesh/pkg/crypto"
+	"github.com/dotmesh-oss/dotmesh/pkg/idp"
 	"github.com/dotmesh-oss/dotmesh/pkg/store"
 	"github.com/dotmesh-oss/dotmesh/pkg/types"
 	"github.com/dotmesh-oss/dotmesh/pkg/uuid"
@@ -17,6 +20,14 @@ import (
 
 type InternalManager struct {
 	kv store.KVStoreWithIndex
+	// what the admin user's API key is encrypted with, nil to keep it in
+	// the clear
+	keyring *crypto.Keyring
+	// identity providers tried for users whose password or API key isn't
+	// one we keep, and which namespaces the groups they say users are in
+	// administer
+	providers       []idp.Provider
+	groupNamespaces map[string]string
 }
 
 func NewInternal(kv store.KVStoreWithIndex) *InternalManager {
@@ -25,6 +36,59 @@ func NewInternal(kv store.KVStoreWithIndex) *InternalManager {
 	}
 }
 
+// SetKeyring has the admin user's API key encrypted with keyring when it's
+// stored
+func (m *InternalManager) SetKeyring(keyring *crypto.Keyring) {
+	m.keyring = keyring
+}
+
+// SetIdentityProviders has users who aren't known, or were made by one of
+// providers, authenticated by providers in turn. Users are made on their first
+// login, and given the namespaces groupNamespaces maps their groups to.
+func (m *InternalManager) SetIdentityProviders(providers []idp.Provider, groupNamespaces map[string]string) {
+	m.providers = providers
+	m.groupNamespaces = groupNamespaces
+}
+
+// encode returns how user is stored: with their API key hashed, or for the
+// admin user, whose key nodes need to call each other with, encrypted
+func (m *InternalManager) encode(user *User) ([]byte, error) {
+	stored := *user
+	if stored.ApiKey != "" {
+		stored.ApiKeyPrefix = crypto.APIKeyPrefix(stored.ApiKey)
+		if stored.Id == ADMIN_USER_UUID {
+			apiKey, err := m.keyring.Encrypt(stored.ApiKey)
+			if err != nil {
+				return nil, err
+			}
+			stored.ApiKey = apiKey
+			stored.ApiKeyHash = nil
+		} else {
+			prefix, hashed, err := crypto.HashAPIKey(stored.ApiKey)
+			if err != nil {
+				return nil, err
+			}
+			stored.ApiKey = ""
+			stored.ApiKeyPrefix = prefix
+			stored.ApiKeyHash = hashed
+		}
+	}
+	return json.Marshal(&stored)
+}
+
+func (m *InternalManager) decode(data []byte) (*User, error) {
+	var user User
+	err := json.Unmarshal(data, &user)
+	if err != nil {
+		return nil, err
+	}
+	user.ApiKey, err = m.keyring.Decrypt(user.ApiKey)
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
 func (m *InternalManager) NewAdmin(user *User) error {
 
 	log.WithFields(log.Fields{
@@ -47,7 +111,7 @@ func (m *InternalManager) NewAdmin(user *User) error {
 		user.ApiKey = apiKey
 	}
 
-	bts, err := json.Marshal(&user)
+	bts, err := m.encode(user)
 	if err != nil {
 		return err
 	}
@@ -86,7 +150,7 @@ func (m *InternalManager) New(username, email, password string) (*User, error) {
 		Metadata: make(map[string]string),
 	}
 
-	bts, err := json.Marshal(&u)
+	bts, err := m.encode(&u)
 	if err != nil {
 		return nil, err
 	}
@@ -100,7 +164,7 @@ func (m *InternalManager) New(username, email, password string) (*User, error) {
 }
 
 func (m *InternalManager) Update(user *User) (*User, error) {
-	bts, err := json.Marshal(user)
+	bts, err := m.encode(user)
 	if err != nil {
 		return nil, err
 	}
@@ -122,15 +186,19 @@ func (m *InternalManager) Import(user *User) error {
 		return fmt.Errorf("user name not set")
 	}
 
-	if len(user.Password) == 0 {
-		return fmt.Errorf("user password not set")
-	}
+	// users made by identity providers are authenticated by them, and
+	// organizations' namespaces can't log in, so neither has a password
+	if user.Metadata[IdentityProviderLabel] == "" && user.Metadata[OrganizationLabel] == "" {
+		if len(user.Password) == 0 {
+			return fmt.Errorf("user password not set")
+		}
 
-	if len(user.Salt) == 0 {
-		return fmt.Errorf("user password salt not set")
+		if len(user.Salt) == 0 {
+			return fmt.Errorf("user password salt not set")
+		}
 	}
 
-	bts, err := json.Marshal(user)
+	bts, err := m.encode(user)
 	if err != nil {
 		return err
 	}
@@ -181,25 +249,152 @@ func (m *InternalManager) ResetAPIKey(username string) (*User, error) {
 func (m *InternalManager) Authenticate(username, password string) (*User, AuthenticationType, error) {
 	user, err := m.Get(&Query{Ref: username})
 	if err != nil {
+		if len(m.providers) > 0 {
+			return m.authenticateWithProviders(username, password)
+		}
 		return nil, AuthenticationTypeNone, err
 	}
 
-	if user.ApiKey == password {
+	if user.ApiKey != "" && subtle.ConstantTimeCompare([]byte(user.ApiKey), []byte(password)) == 1 {
 		return user, AuthenticationTypeAPIKey, nil
 	}
 
-	passwordMatch, err := crypto.PasswordMatches(user.Salt, password, string(user.Password))
-	if err != nil {
-		return nil, AuthenticationTypeNone, err
+	if crypto.APIKeyMatches(user.ApiKeyPrefix, user.ApiKeyHash, password) {
+		// the key isn't kept, but they've just told us it
+		user.ApiKey = password
+		return user, AuthenticationTypeAPIKey, nil
+	}
+
+	if len(user.Salt) > 0 {
+		passwordMatch, err := crypto.PasswordMatches(user.Salt, password, string(user.Password))
+		if err != nil {
+			return nil, AuthenticationTypeNone, err
+		}
+
+		if passwordMatch {
+			return user, AuthenticationTypePassword, nil
+		}
 	}
 
-	if passwordMatch {
-		return user, AuthenticationTypePassword, nil
+	if user.Metadata[IdentityProviderLabel] != "" {
+		return m.authenticateWithProviders(username, password)
 	}
 
 	return nil, AuthenticationTypeNone, fmt.Errorf("Username or password doesn't match")
 }
 
+// authenticateWithProviders asks each identity provider in turn who someone
+// is, given their password or an ID token, and makes or updates their user.
+// With a token, username may be empty.
+func (m *InternalManager) authenticateWithProviders(username, password string) (*User, AuthenticationType, error) {
+	for _, provider := range m.providers {
+		identity, at, err := authenticateWithProvider(provider, username, password)
+		if err == idp.ErrNotSupported {
+			continue
+		}
+		if err != nil {
+			log.WithFields(log.Fields{
+				"provider": provider.Name(),
+				"username": username,
+				"error":    err,
+			}).Info("user manager: identity provider didn't authenticate user")
+			continue
+		}
+		if username != "" && identity.Username != username {
+			log.WithFields(log.Fields{
+				"provider": provider.Name(),
+				"username": username,
+				"identity": identity.Username,
+			}).Warn("user manager: identity provider says user is someone else")
+			continue
+		}
+		user, err := m.provision(identity)
+		if err != nil {
+			return nil, AuthenticationTypeNone, err
+		}
+		return user, at, nil
+	}
+	return nil, AuthenticationTypeNone, fmt.Errorf("Username or password doesn't match")
+}
+
+func authenticateWithProvider(provider idp.Provider, username, password string) (*idp.Identity, AuthenticationType, error) {
+	if idp.LooksLikeToken(password) {
+		identity, err := provider.AuthenticateToken(password)
+		if err != idp.ErrNotSupported {
+			return identity, AuthenticationTypeIdentityToken, err
+		}
+	}
+	identity, err := provider.AuthenticatePassword(username, password)
+	return identity, AuthenticationTypePassword, err
+}
+
+// provision makes the user an identity provider vouched for if they're new,
+// or brings their email address and namespaces up to date. Local users
+// can't be taken over by someone with the same name at a provider.
+func (m *InternalManager) provision(identity *idp.Identity) (*User, error) {
+	namespaces := idp.Namespaces(identity.Groups, m.groupNamespaces)
+	if len(namespaces) == 0 {
+		namespaces = nil
+	}
+
+	user, err := m.Get(&Query{Ref: identity.Username})
+	if err == nil {
+		if user.Metadata[IdentityProviderLabel] != identity.Provider {
+			return nil, fmt.Errorf("User %s wasn't made by identity provider %s", identity.Username, identity.Provider)
+		}
+		if user.Email == identity.Email && reflect.DeepEqual(user.Namespaces, namespaces) {
+			return user, nil
+		}
+		user.Email = m.unusedEmail(identity.Email, user.Id)
+		user.Namespaces = namespaces
+		return m.Update(user)
+	}
+
+	err = validator.IsValidVolumeNamespace(identity.Username)
+	if err != nil {
+		return nil, fmt.Errorf("Can't make a user called %q: %s", identity.Username, err)
+	}
+	user = &User{
+		Id:         uuid.New().String(),
+		Name:       identity.Username,
+		Email:      m.unusedEmail(identity.Email, ""),
+		Metadata:   map[string]string{IdentityProviderLabel: identity.Provider},
+		Namespaces: namespaces,
+	}
+	log.WithFields(log.Fields{
+		"id":       user.Id,
+		"name":     user.Name,
+		"provider": identity.Provider,
+	}).Info("user manager: creating account on first login")
+
+	bts, err := m.encode(user)
+	if err != nil {
+		return nil, err
+	}
+	_, err = m.kv.CreateWithIndex(UsersPrefix, user.Id, user.Name, bts)
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// unusedEmail is email, unless another user than id has it, as users can be
+// looked up by email
+func (m *InternalManager) unusedEmail(email, id string) string {
+	if email == "" {
+		return ""
+	}
+	other, err := m.getByEmail(email)
+	if err == nil && other.Id != id {
+		log.WithFields(log.Fields{
+			"email": email,
+			"user":  other.Name,
+		}).Warn("user manager: email address from identity provider is already taken")
+		return ""
+	}
+	return email
+}
+
 func (m *InternalManager) Get(q *Query) (*User, error) {
 
 	if q.Selector != "" {
@@ -216,12 +411,7 @@ func (m *InternalManager) Get(q *Query) (*User, error) {
 		return m.fullSearch(q.Ref)
 	}
 
-	var user User
-	err = json.Unmarshal([]byte(u.Value), &user)
-	if err != nil {
-		return nil, err
-	}
-	return &user, nil
+	return m.decode(u.Value)
 }
 
 func (m *InternalManager) fullSearch(ref string) (*User, error) {
@@ -308,22 +498,76 @@ func (m *InternalManager) List(selector string) ([]*User, error) {
 		return users, nil
 	}
 	for _, n := range ns {
-		var user User
-		err := json.Unmarshal([]byte(n.Value), &user)
+		user, err := m.decode(n.Value)
 		if err != nil {
-			// log
-
+			log.WithFields(log.Fields{
+				"key":   n.Key,
+				"error": err,
+			}).Error("users manager: failed to decode user")
 			continue
 		}
 
 		if sel.Matches(labels.Set(user.Metadata)) {
-			users = append(users, &user)
+			users = append(users, user)
 		}
 	}
 
 	return users, nil
 }
 
+// ListStored lists every user as they're stored, with their API keys hashed
+// or, for the admin user, encrypted, for backups not to hold them in the clear
+func (m *InternalManager) ListStored() ([]*User, error) {
+	ns, err := m.kv.List(UsersPrefix)
+	if err != nil {
+		return nil, err
+	}
+	users := []*User{}
+	for _, n := range ns {
+		var stored User
+		err := json.Unmarshal(n.Value, &stored)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode user %s: %s", n.Key, err)
+		}
+		users = append(users, &stored)
+	}
+	return users, nil
+}
+
+// RewrapSecrets hashes API keys that are stored in the clear, and encrypts
+// the admin user's with the keyring's first key if it's in the clear or was
+// encrypted with another. It returns how many users it rewrote.
+func (m *InternalManager) RewrapSecrets() (int, error) {
+	ns, err := m.kv.List(UsersPrefix)
+	if err != nil {
+		return 0, err
+	}
+	rewrapped := 0
+	for _, n := range ns {
+		var stored User
+		err := json.Unmarshal(n.Value, &stored)
+		if err != nil {
+			continue
+		}
+		if stored.ApiKey == "" {
+			continue
+		}
+		if stored.Id == ADMIN_USER_UUID && !m.keyring.NeedsRewrap(stored.ApiKey) {
+			continue
+		}
+		user, err := m.decode(n.Value)
+		if err != nil {
+			return rewrapped, err
+		}
+		_, err = m.Update(user)
+		if err != nil {
+			return rewrapped, err
+		}
+		rewrapped++
+	}
+	return rewrapped, nil
+}
+
 func (m *InternalManager) Authorize(user *User, collabsAllowed bool, tlf *types.TopLevelFilesystem) (bool, error) {
 	// admin user is always authorized (e.g. docker daemon). users and auth are
 	// only really meaningful over the network for data synchronization, when a
@@ -334,6 +578,16 @@ func (m *InternalManager) Authorize(user *User, collabsAllowed bool, tlf *types.
 	if user.Id == tlf.Owner.Id {
 		return true, nil
 	}
+	if userHasNamespace(user, tlf.Owner.Name) {
+		return true, nil
+	}
+	// an organization's owners own its dots, and its members collaborate on
+	// them
+	if role, ok := m.organizationRole(tlf.Owner, user); ok {
+		if role == types.OrganizationRoleOwner || collabsAllowed {
+			return true, nil
+		}
+	}
 	if collabsAllowed {
 		for _, other := range tlf.Collaborators {
 			if user.Id == other.Id {
@@ -350,10 +604,26 @@ func (m *InternalManager) UserIsNamespaceAdministrator(user *User, namespace str
 		return true, nil
 	}
 
-	// ...and see if their name matches the namespace name.
-	if user.Name == namespace {
+	// ...and see if their name matches the namespace name, or one of the
+	// namespaces their groups give them.
+	if user.Name == namespace || userHasNamespace(user, namespace) {
 		return true, nil
-	} else {
+	}
+
+	// ...or whether it's an organization's they're a member of
+	owner, err := m.Get(&Query{Ref: namespace})
+	if err != nil {
 		return false, nil
 	}
+	_, ok := m.organizationRole(owner.SafeUser(), user)
+	return ok, nil
+}
+
+func userHasNamespace(user *User, namespace string) bool {
+	for _, n := range user.Namespaces {
+		if n == namespace {
+			return true
+		}
+	}
+	return false
 }
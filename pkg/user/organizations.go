@@ -0,0 +1,256 @@
+package user
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/dotmesh-oss/dotmesh/pkg/store"
+	"github.com/dotmesh-oss/dotmesh/pkg/types"
+	"github.com/dotmesh-oss/dotmesh/pkg/uuid"
+	"github.com/dotmesh-oss/dotmesh/pkg/validator"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var _ OrganizationManager = &InternalManager{}
+
+// An organization's namespace belongs to a user named after it, with the
+// same ID, so that its dots have an owner like any other; its members are
+// kept separately, under OrganizationsPrefix.
+
+func (m *InternalManager) NewOrganization(name string, owner *User) (*Organization, error) {
+	err := validator.IsValidVolumeNamespace(name)
+	if err != nil {
+		return nil, err
+	}
+	if owner.Id == ADMIN_USER_UUID || owner.Metadata[OrganizationLabel] != "" {
+		return nil, fmt.Errorf("%s can't own an organization", owner.Name)
+	}
+	_, err = m.Get(&Query{Ref: name})
+	if err == nil {
+		return nil, fmt.Errorf("Namespace %s is already taken", name)
+	}
+
+	org := &Organization{
+		Id:      uuid.New().String(),
+		Name:    name,
+		Members: []types.OrganizationMember{{UserId: owner.Id, Name: owner.Name, Role: types.OrganizationRoleOwner}},
+		Created: time.Now().UTC(),
+	}
+	namespace := User{
+		Id:       org.Id,
+		Name:     name,
+		Metadata: map[string]string{OrganizationLabel: "true"},
+	}
+
+	log.WithFields(log.Fields{
+		"id":    org.Id,
+		"name":  name,
+		"owner": owner.Name,
+	}).Info("user manager: creating organization")
+
+	err = m.saveOrganization(org)
+	if err != nil {
+		return nil, err
+	}
+	bts, err := m.encode(&namespace)
+	if err != nil {
+		return nil, err
+	}
+	_, err = m.kv.CreateWithIndex(UsersPrefix, namespace.Id, namespace.Name, bts)
+	if err != nil {
+		m.kv.Delete(OrganizationsPrefix, org.Id)
+		return nil, err
+	}
+	return org, nil
+}
+
+func (m *InternalManager) GetOrganization(name string) (*Organization, error) {
+	namespace, err := m.Get(&Query{Ref: name})
+	if err != nil || namespace.Metadata[OrganizationLabel] == "" {
+		return nil, fmt.Errorf("No organization called %s", name)
+	}
+	return m.organization(namespace.Id)
+}
+
+// organization gets an organization by ID
+func (m *InternalManager) organization(id string) (*Organization, error) {
+	kvp, err := m.kv.Get(OrganizationsPrefix, id)
+	if err != nil {
+		return nil, err
+	}
+	var org Organization
+	err = json.Unmarshal(kvp.Value, &org)
+	if err != nil {
+		return nil, err
+	}
+	return &org, nil
+}
+
+// ImportOrganization stores an organization as it was backed up; its
+// namespace is imported with the users
+func (m *InternalManager) ImportOrganization(org *Organization) error {
+	if org.Id == "" {
+		return fmt.Errorf("organization ID not set")
+	}
+	if org.Name == "" {
+		return fmt.Errorf("organization name not set")
+	}
+	return m.saveOrganization(org)
+}
+
+func (m *InternalManager) saveOrganization(org *Organization) error {
+	bts, err := json.Marshal(org)
+	if err != nil {
+		return err
+	}
+	_, err = m.kv.Set(OrganizationsPrefix, org.Id, bts)
+	return err
+}
+
+func (m *InternalManager) ListOrganizations(user *User) ([]*Organization, error) {
+	orgs := []*Organization{}
+	ns, err := m.kv.List(OrganizationsPrefix)
+	if err != nil {
+		return nil, err
+	}
+	for _, n := range ns {
+		var org Organization
+		err := json.Unmarshal(n.Value, &org)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"key":   n.Key,
+				"error": err,
+			}).Error("users manager: failed to decode organization")
+			continue
+		}
+		if _, ok := org.Role(user.Id); ok || user.Id == ADMIN_USER_UUID {
+			orgs = append(orgs, &org)
+		}
+	}
+	return orgs, nil
+}
+
+func (m *InternalManager) AddOrganizationMember(name, member string, role OrganizationRole) (*Organization, error) {
+	if role != types.OrganizationRoleOwner && role != types.OrganizationRoleMember {
+		return nil, fmt.Errorf("Unknown role %q, expected %s or %s", role, types.OrganizationRoleOwner, types.OrganizationRoleMember)
+	}
+	u, err := m.Get(&Query{Ref: member})
+	if err != nil {
+		return nil, err
+	}
+	if u.Id == ADMIN_USER_UUID || u.Metadata[OrganizationLabel] != "" {
+		return nil, fmt.Errorf("%s can't be a member of an organization", u.Name)
+	}
+
+	return m.updateOrganization(name, func(org *Organization) error {
+		found := false
+		for i, existing := range org.Members {
+			if existing.UserId == u.Id {
+				org.Members[i].Role = role
+				found = true
+			}
+		}
+		if !found {
+			org.Members = append(org.Members, types.OrganizationMember{UserId: u.Id, Name: u.Name, Role: role})
+		}
+		if !hasOwner(org) {
+			return fmt.Errorf("%s is the last owner of %s", u.Name, org.Name)
+		}
+		return nil
+	})
+}
+
+func (m *InternalManager) RemoveOrganizationMember(name, member string) (*Organization, error) {
+	u, err := m.Get(&Query{Ref: member})
+	if err != nil {
+		return nil, err
+	}
+
+	return m.updateOrganization(name, func(org *Organization) error {
+		members := []types.OrganizationMember{}
+		for _, existing := range org.Members {
+			if existing.UserId != u.Id {
+				members = append(members, existing)
+			}
+		}
+		if len(members) == len(org.Members) {
+			return fmt.Errorf("%s isn't a member of %s", u.Name, org.Name)
+		}
+		org.Members = members
+		if !hasOwner(org) {
+			return fmt.Errorf("%s is the last owner of %s", u.Name, org.Name)
+		}
+		return nil
+	})
+}
+
+// organizationUpdateAttempts is how many times updateOrganization reads an
+// organization again when someone else changed it first
+const organizationUpdateAttempts = 10
+
+// updateOrganization applies change to an organization and saves it, as
+// long as nobody else has saved it since it was read; if they have, change
+// is applied again to what they saved, so neither change is lost and checks
+// like there being an owner hold.
+func (m *InternalManager) updateOrganization(name string, change func(org *Organization) error) (*Organization, error) {
+	namespace, err := m.Get(&Query{Ref: name})
+	if err != nil || namespace.Metadata[OrganizationLabel] == "" {
+		return nil, fmt.Errorf("No organization called %s", name)
+	}
+	for attempt := 0; attempt < organizationUpdateAttempts; attempt++ {
+		kvp, err := m.kv.Get(OrganizationsPrefix, namespace.Id)
+		if err != nil {
+			return nil, err
+		}
+		var org Organization
+		err = json.Unmarshal(kvp.Value, &org)
+		if err != nil {
+			return nil, err
+		}
+		err = change(&org)
+		if err != nil {
+			return nil, err
+		}
+		bts, err := json.Marshal(&org)
+		if err != nil {
+			return nil, err
+		}
+		_, err = m.kv.CompareAndSet(OrganizationsPrefix, org.Id, bts, kvp.ModifiedIndex)
+		if store.IsModified(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &org, nil
+	}
+	return nil, fmt.Errorf("%s is being changed by someone else, try again", name)
+}
+
+func hasOwner(org *Organization) bool {
+	for _, m := range org.Members {
+		if m.Role == types.OrganizationRoleOwner {
+			return true
+		}
+	}
+	return false
+}
+
+// organizationRole is the role of a user in the organization a namespace's
+// user is for, if it's one and they're a member
+func (m *InternalManager) organizationRole(namespace types.SafeUser, user *User) (OrganizationRole, bool) {
+	if namespace.Metadata[OrganizationLabel] == "" {
+		return "", false
+	}
+	org, err := m.organization(namespace.Id)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"organization": namespace.Name,
+			"error":        err,
+		}).Error("users manager: failed to get organization")
+		return "", false
+	}
+	return org.Role(user.Id)
+}
@@ -12,10 +12,19 @@ const ADMIN_USER_UUID = "00000000-0000-0000-0000-000000000000"
 // UsersPrefix - KV store prefix for users
 const UsersPrefix = "users"
 
+// OrganizationsPrefix - KV store prefix for organizations' members
+const OrganizationsPrefix = "organizations"
+
+// OrganizationLabel is the metadata label of the users that organizations'
+// namespaces belong to, who can't log in
+const OrganizationLabel = "organization"
+
 // Alias
 type User = types.User
 type SafeUser = types.SafeUser
 type Query = types.Query
+type Organization = types.Organization
+type OrganizationRole = types.OrganizationRole
 
 type AuthenticationType int
 
@@ -23,7 +32,7 @@ type AuthenticationType int
 // certain API action
 func (at AuthenticationType) Privileged() bool {
 	switch at {
-	case AuthenticationTypePassword:
+	case AuthenticationTypePassword, AuthenticationTypeIdentityToken:
 		return true
 	}
 	return false
@@ -37,6 +46,8 @@ func (at AuthenticationType) String() string {
 		return "password"
 	case AuthenticationTypeAPIKey:
 		return "apikey"
+	case AuthenticationTypeIdentityToken:
+		return "token"
 	}
 	return "unknown"
 }
@@ -49,6 +60,8 @@ func AuthenticationTypeFromString(at string) (AuthenticationType, error) {
 		return AuthenticationTypePassword, nil
 	case "apikey":
 		return AuthenticationTypeAPIKey, nil
+	case "token":
+		return AuthenticationTypeIdentityToken, nil
 	default:
 		return AuthenticationTypeNone, fmt.Errorf("Unknown authentication type %q", at)
 	}
@@ -58,9 +71,15 @@ const (
 	AuthenticationTypeNone AuthenticationType = iota
 	AuthenticationTypePassword
 	AuthenticationTypeAPIKey
-	// AuthenticationTypeOAuth
+	// AuthenticationTypeIdentityToken is an ID token from an identity
+	// provider, which proves they've just logged in as much as a password
+	AuthenticationTypeIdentityToken
 )
 
+// IdentityProviderLabel is the metadata label of users made on their first
+// login with an identity provider, whose value is the provider's name
+const IdentityProviderLabel = "identity-provider"
+
 type UserManager interface {
 	NewAdmin(user *User) error
 
@@ -88,3 +107,23 @@ type UserManager interface {
 	// Is the user the administrator for this namespace?
 	UserIsNamespaceAdministrator(user *User, namespace string) (bool, error)
 }
+
+// OrganizationManager keeps organizations: teams of users who share a
+// namespace. Whether someone may change an organization is up to the caller.
+type OrganizationManager interface {
+	// NewOrganization makes an organization and its namespace, with owner
+	// as its first owner
+	NewOrganization(name string, owner *User) (*Organization, error)
+	GetOrganization(name string) (*Organization, error)
+	// ListOrganizations lists the organizations user is a member of, or
+	// every organization for the admin user
+	ListOrganizations(user *User) ([]*Organization, error)
+
+	// AddOrganizationMember adds a user to an organization, or changes their
+	// role if they're already a member
+	AddOrganizationMember(name, member string, role OrganizationRole) (*Organization, error)
+	RemoveOrganizationMember(name, member string) (*Organization, error)
+
+	// ImportOrganization stores an organization as it was backed up
+	ImportOrganization(org *Organization) error
+}
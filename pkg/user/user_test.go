@@ -2,11 +2,18 @@ package user
 
 import (
 	"bytes"
+	"encoding/json"
+	"strings"
 	"testing"
 
+	"github.com/dotmesh-oss/dotmesh/pkg/crypto"
+	"github.com/dotmesh-oss/dotmesh/pkg/idp"
+	"github.com/dotmesh-oss/dotmesh/pkg/idp/idptest"
 	"github.com/dotmesh-oss/dotmesh/pkg/store"
+	"github.com/dotmesh-oss/dotmesh/pkg/types"
 
 	uuid "github.com/nu7hatch/gouuid"
+	"github.com/portworx/kvdb"
 )
 
 func TestCreateUser(t *testing.T) {
@@ -80,9 +87,13 @@ func TestImportUser(t *testing.T) {
 	if stored.Id != immigrant.Id {
 		t.Errorf("unexpected id: %s", stored.Id)
 	}
-	if stored.ApiKey != immigrant.ApiKey {
+	// imported API keys are hashed like any other
+	if stored.ApiKey != "" {
 		t.Errorf("unexpected ApiKey: %s", stored.ApiKey)
 	}
+	if !crypto.APIKeyMatches(stored.ApiKeyPrefix, stored.ApiKeyHash, immigrant.ApiKey) {
+		t.Errorf("imported ApiKey doesn't match")
+	}
 
 	if !bytes.Equal(stored.Password, immigrant.Password) {
 		t.Errorf("password doesn't match")
@@ -237,3 +248,515 @@ func TestAuthenticateUserByAPIKey(t *testing.T) {
 		t.Errorf("unexpected authentication type: %s", at)
 	}
 }
+
+func TestAPIKeyHashed(t *testing.T) {
+	client, err := store.NewKVDBClient(&store.KVDBConfig{
+		Type: store.KVTypeMem,
+	})
+	if err != nil {
+		t.Fatalf("failed to init kv store: %s", err)
+	}
+	kvClient := store.NewKVDBStoreWithIndex(client, UsersPrefix)
+
+	um := NewInternal(kvClient)
+
+	created, err := um.New("joe", "joe@joe.com", "verysecret")
+	if err != nil {
+		t.Fatalf("failed to create new user: %s", err)
+	}
+
+	kvp, err := kvClient.Get(UsersPrefix, created.Id)
+	if err != nil {
+		t.Fatalf("failed to get stored user: %s", err)
+	}
+	if strings.Contains(string(kvp.Value), created.ApiKey) {
+		t.Errorf("API key stored in the clear: %s", string(kvp.Value))
+	}
+
+	stored, err := um.Get(&Query{Ref: "joe"})
+	if err != nil {
+		t.Fatalf("failed to get user: %s", err)
+	}
+	if stored.ApiKey != "" {
+		t.Errorf("API key shouldn't be readable, got %s", stored.ApiKey)
+	}
+	if stored.ApiKeyPrefix == "" || !strings.HasPrefix(created.ApiKey, stored.ApiKeyPrefix) {
+		t.Errorf("unexpected API key prefix %s of %s", stored.ApiKeyPrefix, created.ApiKey)
+	}
+
+	authenticated, at, err := um.Authenticate("joe", created.ApiKey)
+	if err != nil {
+		t.Fatalf("unexpected authentication failure: %s", err)
+	}
+	if at != AuthenticationTypeAPIKey || authenticated.ApiKey != created.ApiKey {
+		t.Errorf("unexpected authentication %s with API key %s", at, authenticated.ApiKey)
+	}
+
+	_, _, err = um.Authenticate("joe", "")
+	if err == nil {
+		t.Errorf("expected an empty API key not to authenticate")
+	}
+
+	reset, err := um.ResetAPIKey("joe")
+	if err != nil {
+		t.Fatalf("failed to reset API key: %s", err)
+	}
+	_, _, err = um.Authenticate("joe", created.ApiKey)
+	if err == nil {
+		t.Errorf("expected the old API key not to authenticate after a reset")
+	}
+	_, _, err = um.Authenticate("joe", reset.ApiKey)
+	if err != nil {
+		t.Errorf("unexpected authentication failure with the new API key: %s", err)
+	}
+}
+
+func TestAdminAPIKeyEncrypted(t *testing.T) {
+	client, err := store.NewKVDBClient(&store.KVDBConfig{
+		Type: store.KVTypeMem,
+	})
+	if err != nil {
+		t.Fatalf("failed to init kv store: %s", err)
+	}
+	kvClient := store.NewKVDBStoreWithIndex(client, UsersPrefix)
+
+	um := NewInternal(kvClient)
+
+	// stored before there was a secrets key, and before API keys were hashed
+	legacy := &User{
+		Id:       "10000000-0000-0000-0000-000000000001",
+		Name:     "legacy",
+		Salt:     []byte("salt"),
+		Password: []byte("password"),
+		ApiKey:   "LEGACYAPIKEY",
+	}
+	bts, err := json.Marshal(legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = kvClient.CreateWithIndex(UsersPrefix, legacy.Id, legacy.Name, bts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = um.NewAdmin(&User{
+		Id:       ADMIN_USER_UUID,
+		Name:     "admin",
+		Password: []byte("verysecret"),
+		ApiKey:   "ADMINAPIKEY",
+	})
+	if err != nil {
+		t.Fatalf("failed to create admin: %s", err)
+	}
+
+	key, err := crypto.GenerateKeyringKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring, err := crypto.LoadKeyring(key, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	um.SetKeyring(keyring)
+
+	rewrapped, err := um.RewrapSecrets()
+	if err != nil {
+		t.Fatalf("failed to rewrap secrets: %s", err)
+	}
+	if rewrapped != 2 {
+		t.Errorf("expected 2 users rewritten, got %d", rewrapped)
+	}
+	rewrapped, err = um.RewrapSecrets()
+	if err != nil || rewrapped != 0 {
+		t.Errorf("expected nothing left to rewrap, got %d (%v)", rewrapped, err)
+	}
+
+	for _, id := range []string{legacy.Id, ADMIN_USER_UUID} {
+		kvp, err := kvClient.Get(UsersPrefix, id)
+		if err != nil {
+			t.Fatalf("failed to get stored user: %s", err)
+		}
+		if strings.Contains(string(kvp.Value), "APIKEY") {
+			t.Errorf("API key stored in the clear: %s", string(kvp.Value))
+		}
+	}
+
+	// nodes need the admin API key to call each other
+	admin, err := um.Get(&Query{Ref: "admin"})
+	if err != nil {
+		t.Fatalf("failed to get admin: %s", err)
+	}
+	if admin.ApiKey != "ADMINAPIKEY" {
+		t.Errorf("unexpected admin API key %s", admin.ApiKey)
+	}
+	_, at, err := um.Authenticate("legacy", "LEGACYAPIKEY")
+	if err != nil || at != AuthenticationTypeAPIKey {
+		t.Errorf("unexpected authentication %s with a hashed legacy API key: %v", at, err)
+	}
+
+	// backups are of users as stored, and can be imported as they are
+	stored, err := um.ListStored()
+	if err != nil {
+		t.Fatalf("failed to list stored users: %s", err)
+	}
+	serialized, err := json.Marshal(stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(serialized), "APIKEY") {
+		t.Errorf("API key listed in the clear: %s", serialized)
+	}
+	restoredClient, err := store.NewKVDBClient(&store.KVDBConfig{
+		Type: store.KVTypeMem,
+	})
+	if err != nil {
+		t.Fatalf("failed to init kv store: %s", err)
+	}
+	restored := NewInternal(store.NewKVDBStoreWithIndex(restoredClient, UsersPrefix))
+	restored.SetKeyring(keyring)
+	for _, u := range stored {
+		err = restored.Import(u)
+		if err != nil {
+			t.Fatalf("failed to import %s: %s", u.Name, err)
+		}
+	}
+	admin, err = restored.Get(&Query{Ref: "admin"})
+	if err != nil || admin.ApiKey != "ADMINAPIKEY" {
+		t.Errorf("expected the admin API key to be restored, got %v (%v)", admin, err)
+	}
+	_, at, err = restored.Authenticate("legacy", "LEGACYAPIKEY")
+	if err != nil || at != AuthenticationTypeAPIKey {
+		t.Errorf("unexpected authentication %s with a restored API key: %v", at, err)
+	}
+}
+
+func newIdentityProviders(t *testing.T) (*InternalManager, *idptest.LDAP, *idptest.OIDC) {
+	client, err := store.NewKVDBClient(&store.KVDBConfig{
+		Type: store.KVTypeMem,
+	})
+	if err != nil {
+		t.Fatalf("failed to init kv store: %s", err)
+	}
+	um := NewInternal(store.NewKVDBStoreWithIndex(client, UsersPrefix))
+
+	directory, err := idptest.NewLDAP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer, err := idptest.NewOIDC("dotmesh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	um.SetIdentityProviders([]idp.Provider{
+		&idp.LDAP{
+			URL:            directory.URL,
+			UserDN:         "uid=%s,ou=people,dc=example,dc=com",
+			GroupAttribute: "memberOf",
+		},
+		&idp.OIDC{
+			Issuer:        issuer.Issuer(),
+			ClientID:      "dotmesh",
+			UsernameClaim: "preferred_username",
+			GroupsClaim:   "groups",
+		},
+	}, map[string]string{"data": "datateam"})
+	return um, directory, issuer
+}
+
+func TestAuthenticateWithLDAP(t *testing.T) {
+	um, directory, issuer := newIdentityProviders(t)
+	defer directory.Close()
+	defer issuer.Close()
+	directory.AddUser("uid=alice,ou=people,dc=example,dc=com", "wonderland", map[string][]string{
+		"mail":     {"alice@example.com"},
+		"memberOf": {"cn=data,ou=groups,dc=example,dc=com"},
+	})
+
+	authenticated, at, err := um.Authenticate("alice", "wonderland")
+	if err != nil {
+		t.Fatalf("failed to authenticate: %s", err)
+	}
+	if at != AuthenticationTypePassword {
+		t.Errorf("unexpected authentication type %s", at)
+	}
+	stored, err := um.Get(&Query{Ref: "alice"})
+	if err != nil {
+		t.Fatalf("user wasn't made on first login: %s", err)
+	}
+	if stored.Id != authenticated.Id || stored.Email != "alice@example.com" ||
+		stored.Metadata[IdentityProviderLabel] != "ldap" || len(stored.Namespaces) != 1 || stored.Namespaces[0] != "datateam" {
+		t.Errorf("unexpected user %s", stored)
+	}
+
+	// the directory's groups are kept up to date
+	directory.AddUser("uid=alice,ou=people,dc=example,dc=com", "wonderland", nil)
+	again, _, err := um.Authenticate("alice", "wonderland")
+	if err != nil {
+		t.Fatalf("failed to authenticate again: %s", err)
+	}
+	if again.Id != authenticated.Id || len(again.Namespaces) != 0 {
+		t.Errorf("unexpected user after second login %s", again)
+	}
+
+	_, _, err = um.Authenticate("alice", "wrong")
+	if err == nil {
+		t.Errorf("authenticated with the wrong password")
+	}
+}
+
+func TestIdentityProvidersCantTakeOverLocalUsers(t *testing.T) {
+	um, directory, issuer := newIdentityProviders(t)
+	defer directory.Close()
+	defer issuer.Close()
+	directory.AddUser("uid=bob,ou=people,dc=example,dc=com", "fromthedirectory", nil)
+
+	_, err := um.New("bob", "bob@example.com", "localpassword")
+	if err != nil {
+		t.Fatalf("failed to create user: %s", err)
+	}
+	_, _, err = um.Authenticate("bob", "fromthedirectory")
+	if err == nil {
+		t.Errorf("authenticated a local user with the directory")
+	}
+	_, at, err := um.Authenticate("bob", "localpassword")
+	if err != nil || at != AuthenticationTypePassword {
+		t.Errorf("failed to authenticate local user: %s %v", at, err)
+	}
+
+	token, err := issuer.Token(map[string]interface{}{"preferred_username": "bob"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = um.Authenticate("", token)
+	if err == nil {
+		t.Errorf("authenticated a local user with an ID token")
+	}
+}
+
+func TestAuthenticateWithIDToken(t *testing.T) {
+	um, directory, issuer := newIdentityProviders(t)
+	defer directory.Close()
+	defer issuer.Close()
+
+	token, err := issuer.Token(map[string]interface{}{
+		"preferred_username": "carol",
+		"email":              "carol@example.com",
+		"groups":             []string{"data"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	authenticated, at, err := um.Authenticate("", token)
+	if err != nil {
+		t.Fatalf("failed to authenticate: %s", err)
+	}
+	if at != AuthenticationTypeIdentityToken || !at.Privileged() {
+		t.Errorf("unexpected authentication type %s", at)
+	}
+	if authenticated.Name != "carol" || authenticated.Metadata[IdentityProviderLabel] != "oidc" {
+		t.Errorf("unexpected user %s", authenticated)
+	}
+
+	_, _, err = um.Authenticate("dave", token)
+	if err == nil {
+		t.Errorf("authenticated as someone else with an ID token")
+	}
+
+	// users made by a provider can have API keys like anyone else
+	withKey, err := um.ResetAPIKey("carol")
+	if err != nil {
+		t.Fatalf("failed to reset API key: %s", err)
+	}
+	_, at, err = um.Authenticate("carol", withKey.ApiKey)
+	if err != nil || at != AuthenticationTypeAPIKey {
+		t.Errorf("failed to authenticate with API key: %s %v", at, err)
+	}
+
+	namespaceAdmin, err := um.UserIsNamespaceAdministrator(authenticated, "datateam")
+	if err != nil || !namespaceAdmin {
+		t.Errorf("expected carol to administer datateam: %v", err)
+	}
+	namespaceAdmin, err = um.UserIsNamespaceAdministrator(authenticated, "other")
+	if err != nil || namespaceAdmin {
+		t.Errorf("expected carol not to administer other: %v", err)
+	}
+	authorized, err := um.Authorize(authenticated, false, &types.TopLevelFilesystem{
+		Owner: types.SafeUser{Id: "someone", Name: "datateam"},
+	})
+	if err != nil || !authorized {
+		t.Errorf("expected carol to be authorized on a dot in datateam: %v", err)
+	}
+}
+
+func TestOrganizations(t *testing.T) {
+	client, err := store.NewKVDBClient(&store.KVDBConfig{
+		Type: store.KVTypeMem,
+	})
+	if err != nil {
+		t.Fatalf("failed to init kv store: %s", err)
+	}
+	um := NewInternal(store.NewKVDBStoreWithIndex(client, UsersPrefix))
+
+	alice, err := um.New("alice", "alice@example.com", "alicepassword")
+	if err != nil {
+		t.Fatalf("failed to create user: %s", err)
+	}
+	bob, err := um.New("bob", "bob@example.com", "bobpassword")
+	if err != nil {
+		t.Fatalf("failed to create user: %s", err)
+	}
+
+	org, err := um.NewOrganization("datateam", alice)
+	if err != nil {
+		t.Fatalf("failed to create organization: %s", err)
+	}
+	_, err = um.NewOrganization("bob", alice)
+	if err == nil {
+		t.Errorf("created an organization with a user's name")
+	}
+	_, err = um.New("datateam", "datateam@example.com", "datateampassword")
+	if err == nil {
+		t.Errorf("created a user with an organization's name")
+	}
+	_, _, err = um.Authenticate("datateam", "")
+	if err == nil {
+		t.Errorf("authenticated as an organization")
+	}
+
+	// the organization's namespace has an owner for its dots
+	namespace, err := um.Get(&Query{Ref: "datateam"})
+	if err != nil {
+		t.Fatalf("failed to get organization's namespace: %s", err)
+	}
+	tlf := &types.TopLevelFilesystem{Owner: namespace.SafeUser()}
+
+	check := func(u *User, administrator, collaborator, owner bool) {
+		t.Helper()
+		got, err := um.UserIsNamespaceAdministrator(u, "datateam")
+		if err != nil || got != administrator {
+			t.Errorf("expected %s to administer datateam: %t, got %t (%v)", u.Name, administrator, got, err)
+		}
+		got, err = um.Authorize(u, true, tlf)
+		if err != nil || got != collaborator {
+			t.Errorf("expected %s to collaborate on datateam's dots: %t, got %t (%v)", u.Name, collaborator, got, err)
+		}
+		got, err = um.Authorize(u, false, tlf)
+		if err != nil || got != owner {
+			t.Errorf("expected %s to own datateam's dots: %t, got %t (%v)", u.Name, owner, got, err)
+		}
+	}
+	check(alice, true, true, true)
+	check(bob, false, false, false)
+
+	_, err = um.AddOrganizationMember("datateam", "bob", types.OrganizationRoleMember)
+	if err != nil {
+		t.Fatalf("failed to add member: %s", err)
+	}
+	check(bob, true, true, false)
+
+	orgs, err := um.ListOrganizations(bob)
+	if err != nil || len(orgs) != 1 || orgs[0].Id != org.Id {
+		t.Errorf("expected bob to be in datateam, got %v (%v)", orgs, err)
+	}
+
+	_, err = um.RemoveOrganizationMember("datateam", "alice")
+	if err == nil {
+		t.Errorf("removed the last owner")
+	}
+	_, err = um.AddOrganizationMember("datateam", "alice", types.OrganizationRoleMember)
+	if err == nil {
+		t.Errorf("demoted the last owner")
+	}
+
+	_, err = um.AddOrganizationMember("datateam", "bob", types.OrganizationRoleOwner)
+	if err != nil {
+		t.Fatalf("failed to change role: %s", err)
+	}
+	check(bob, true, true, true)
+	_, err = um.RemoveOrganizationMember("datateam", "alice")
+	if err != nil {
+		t.Fatalf("failed to remove member: %s", err)
+	}
+	check(alice, false, false, false)
+
+	orgs, err = um.ListOrganizations(alice)
+	if err != nil || len(orgs) != 0 {
+		t.Errorf("expected alice to be in no organizations, got %v (%v)", orgs, err)
+	}
+}
+
+// racingKV runs race the next time an organization is read, as if another
+// node changed it between being read and being written
+type racingKV struct {
+	store.KVStoreWithIndex
+	race func()
+}
+
+func (r *racingKV) Get(prefix, ref string) (*kvdb.KVPair, error) {
+	kvp, err := r.KVStoreWithIndex.Get(prefix, ref)
+	if prefix == OrganizationsPrefix && r.race != nil {
+		race := r.race
+		r.race = nil
+		race()
+	}
+	return kvp, err
+}
+
+func TestConcurrentOrganizationChanges(t *testing.T) {
+	client, err := store.NewKVDBClient(&store.KVDBConfig{
+		Type: store.KVTypeMem,
+	})
+	if err != nil {
+		t.Fatalf("failed to init kv store: %s", err)
+	}
+	kv := &racingKV{KVStoreWithIndex: store.NewKVDBStoreWithIndex(client, UsersPrefix)}
+	um := NewInternal(kv)
+	other := NewInternal(kv.KVStoreWithIndex)
+	alice, err := um.New("alice", "alice@example.com", "alicepassword")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"bob", "carol"} {
+		_, err = um.New(name, name+"@example.com", name+"password")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = um.NewOrganization("datateam", alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// members added at the same time are both kept
+	kv.race = func() {
+		_, err := other.AddOrganizationMember("datateam", "bob", types.OrganizationRoleOwner)
+		if err != nil {
+			t.Errorf("failed to add bob: %s", err)
+		}
+	}
+	org, err := um.AddOrganizationMember("datateam", "carol", types.OrganizationRoleMember)
+	if err != nil {
+		t.Fatalf("failed to add carol: %s", err)
+	}
+	if len(org.Members) != 3 {
+		t.Errorf("expected alice, bob and carol to be members, got %v", org.Members)
+	}
+
+	// and owners removed at the same time can't leave it without one
+	kv.race = func() {
+		_, err := other.RemoveOrganizationMember("datateam", "alice")
+		if err != nil {
+			t.Errorf("failed to remove alice: %s", err)
+		}
+	}
+	_, err = um.RemoveOrganizationMember("datateam", "bob")
+	if err == nil {
+		t.Errorf("removed the last owner")
+	}
+	org, err = um.GetOrganization("datateam")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if role, _ := org.Role(alice.Id); role != "" || len(org.Members) != 2 || !hasOwner(org) {
+		t.Errorf("expected bob to be left as the owner, got %v", org.Members)
+	}
+}
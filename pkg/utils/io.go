@@ -49,7 +49,9 @@ func GetLogfile(logfile string) *os.File {
 // loop, and aborts reading, closing both Reader and Writer in that case.
 // when cancellation happens, cancelFunc is run with the object that was read
 // from the canceller chan, in case it needs to be reused. we assume that
-// Events flow over the canceller chan.
+// Events flow over the canceller chan. the ends of io.Pipes are closed with
+// an error when the copy is cancelled or fails, so that whoever has the other
+// end can tell it didn't finish.
 //
 // if the writer implements http.Flusher, Flush() is called after each write.
 
@@ -92,21 +94,14 @@ func Pipe(
 	}
 
 	handleErr := func(message string, r io.Reader, w io.Writer, r2 io.Reader, w2 io.Writer) {
+		var pipeErr error
 		if message != "" {
 			log.Printf("[pipe:handleErr] " + message)
+			pipeErr = fmt.Errorf("%s", message)
 		}
-		// NB: c.Close returns unhandled err here, and below.
-		if c, ok := r.(io.Closer); ok {
-			c.Close()
-		}
-		if c, ok := w.(io.Closer); ok {
-			c.Close()
-		}
-		if c, ok := r2.(io.Closer); ok {
-			c.Close()
-		}
-		if c, ok := w2.(io.Closer); ok {
-			c.Close()
+		// NB: closing returns unhandled err here, and below.
+		for _, c := range []interface{}{r, w, r2, w2} {
+			closeWithError(c, pipeErr)
 		}
 		finished <- true
 	}
@@ -208,3 +203,22 @@ func Pipe(
 		}
 	}
 }
+
+// closeWithError closes c if it can be closed. When err isn't nil and c is
+// one end of an io.Pipe, the other end gets err rather than EOF, so that
+// whatever is reading from or writing to it sees that the copy didn't finish
+// (e.g. an HTTP request body is aborted rather than sent short).
+func closeWithError(c interface{}, err error) {
+	type errorCloser interface {
+		CloseWithError(error) error
+	}
+	if err != nil {
+		if ec, ok := c.(errorCloser); ok {
+			ec.CloseWithError(err)
+			return
+		}
+	}
+	if closer, ok := c.(io.Closer); ok {
+		closer.Close()
+	}
+}
@@ -0,0 +1,467 @@
+package zfs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/dotmesh-oss/dotmesh/pkg/chunked"
+	"github.com/dotmesh-oss/dotmesh/pkg/types"
+	"github.com/dotmesh-oss/dotmesh/pkg/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+// btrfs keeps dots on a btrfs filesystem, laid out as the directory backend
+// lays them out, but with working copies as subvolumes and snapshots as
+// read-only snapshots of them, so that snapshots and clones share their data
+// rather than copying it.
+//
+// Send streams are, after the same prelude as ZFS streams, a header for each
+// snapshot followed by a btrfs send stream of it, each framed by package
+// chunked, then an empty header.
+type btrfs struct {
+	*directory
+	btrfsPath string
+}
+
+var _ ZFS = &btrfs{}
+
+// btrfsStreamSnapshot starts each snapshot in a send stream
+type btrfsStreamSnapshot struct {
+	directorySnapshot
+	// what the snapshot was sent relative to: the snapshot before it, or
+	// "filesystem@snapshot" for the first snapshot of a clone, or "" if it
+	// was sent in full
+	Base string
+}
+
+// NewBtrfs returns a backend that keeps dots under root, which must be on a
+// btrfs filesystem, using the btrfs tool at btrfsPath
+func NewBtrfs(btrfsPath, root, poolName string) (ZFS, error) {
+	d, err := newDirectory(root, poolName, types.FilesystemBackendBtrfs, btrfsTrees{btrfsPath: btrfsPath})
+	if err != nil {
+		return nil, err
+	}
+	var stat unix.Statfs_t
+	err = unix.Statfs(root, &stat)
+	if err != nil {
+		return nil, err
+	}
+	if stat.Type != unix.BTRFS_SUPER_MAGIC {
+		return nil, fmt.Errorf("%s isn't on a btrfs filesystem", root)
+	}
+	return &btrfs{directory: d, btrfsPath: btrfsPath}, nil
+}
+
+// btrfsTrees keeps working copies as subvolumes, and snapshots as read-only
+// snapshots of them
+type btrfsTrees struct {
+	btrfsPath string
+}
+
+func (t btrfsTrees) create(path string) error {
+	return runBtrfs(t.btrfsPath, "subvolume", "create", path)
+}
+
+func (t btrfsTrees) snapshot(src, prev, dst string) error {
+	return runBtrfs(t.btrfsPath, "subvolume", "snapshot", "-r", src, dst)
+}
+
+func (t btrfsTrees) clone(src, dst string) error {
+	return runBtrfs(t.btrfsPath, "subvolume", "snapshot", src, dst)
+}
+
+func (t btrfsTrees) remove(path string) error {
+	if _, err := os.Lstat(path); os.IsNotExist(err) {
+		return nil
+	}
+	return runBtrfs(t.btrfsPath, "subvolume", "delete", path)
+}
+
+func runBtrfs(btrfsPath string, args ...string) error {
+	_, err := outputBtrfs(btrfsPath, args...)
+	return err
+}
+
+func outputBtrfs(btrfsPath string, args ...string) ([]byte, error) {
+	LogZFSCommand("", fmt.Sprintf("%s %s", btrfsPath, strings.Join(args, " ")))
+	cmd := exec.Command(btrfsPath, args...)
+	stderr := bytes.Buffer{}
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return output, fmt.Errorf("%s %s: %s, %s", btrfsPath, strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return output, nil
+}
+
+// findNewExtent is a file extent reported by btrfs subvolume find-new
+type findNewExtent struct {
+	path   string
+	length int64
+}
+
+var findNewLine = regexp.MustCompile(
+	`^inode \d+ file offset \d+ len (\d+) disk start \d+ offset \d+ gen \d+ flags \S+ (.*)$`,
+)
+var findNewMarker = regexp.MustCompile(`^transid marker was (\d+)$`)
+
+// parseFindNew reads the output of btrfs subvolume find-new: the file
+// extents written since the generation it was given, and the subvolume's
+// current generation
+func parseFindNew(output []byte) ([]findNewExtent, uint64, error) {
+	extents := []findNewExtent{}
+	var marker uint64
+	found := false
+	for _, line := range strings.Split(string(output), "\n") {
+		if line == "" {
+			continue
+		}
+		if m := findNewMarker.FindStringSubmatch(line); m != nil {
+			var err error
+			marker, err = strconv.ParseUint(m[1], 10, 64)
+			if err != nil {
+				return nil, 0, err
+			}
+			found = true
+			continue
+		}
+		m := findNewLine.FindStringSubmatch(line)
+		if m == nil {
+			return nil, 0, fmt.Errorf("unexpected find-new output %q", line)
+		}
+		length, err := strconv.ParseInt(m[1], 10, 64)
+		if err != nil {
+			return nil, 0, err
+		}
+		extents = append(extents, findNewExtent{path: strings.TrimPrefix(m[2], "/"), length: length})
+	}
+	if !found {
+		return nil, 0, fmt.Errorf("no transid marker in find-new output")
+	}
+	return extents, marker, nil
+}
+
+// findNew lists the file extents in the subvolume at path written after
+// generation gen
+func (b *btrfs) findNew(path string, gen uint64) ([]findNewExtent, error) {
+	output, err := outputBtrfs(b.btrfsPath, "subvolume", "find-new", path, strconv.FormatUint(gen+1, 10))
+	if err != nil {
+		return nil, err
+	}
+	extents, _, err := parseFindNew(output)
+	return extents, err
+}
+
+// generation is the generation of the subvolume at path: anything written
+// to a snapshot of it since has a later one
+func (b *btrfs) generation(path string) (uint64, error) {
+	// asking for what's newer than anything could be gets just the marker
+	output, err := outputBtrfs(b.btrfsPath, "subvolume", "find-new", path, strconv.FormatUint(1<<63, 10))
+	if err != nil {
+		return 0, err
+	}
+	_, marker, err := parseFindNew(output)
+	return marker, err
+}
+
+// writtenSince is how many bytes of file data in the subvolume at path were
+// written since the snapshot base, or all of them if base is ""
+func (b *btrfs) writtenSince(path, base string) (int64, error) {
+	if base == "" {
+		return treeSize(path)
+	}
+	gen, err := b.generation(base)
+	if err != nil {
+		return 0, err
+	}
+	extents, err := b.findNew(path, gen)
+	if err != nil {
+		return 0, err
+	}
+	var written int64
+	for _, extent := range extents {
+		written += extent.length
+	}
+	return written, nil
+}
+
+// GetDirtyDelta counts the bytes written to the working copy since the
+// latest snapshot, which btrfs keeps track of as the generations of extents
+func (b *btrfs) GetDirtyDelta(filesystemId, latestSnap string) (int64, int64, error) {
+	base := ""
+	if latestSnap != "" {
+		base = b.snapshotDataPath(filesystemId, latestSnap)
+	}
+	dirty, err := b.writtenSince(b.dataPath(filesystemId), base)
+	if err != nil {
+		return 0, 0, fmt.Errorf("[pollDirty] error comparing %s with %s: %s", filesystemId, latestSnap, err)
+	}
+	total, err := treeSize(b.dataPath(filesystemId))
+	if err != nil {
+		return 0, 0, fmt.Errorf("[pollDirty] error sizing %s: %s", filesystemId, err)
+	}
+	return dirty, total, nil
+}
+
+// PredictSize is the file data written in the snapshots Send would send,
+// give or take the metadata btrfs send adds
+func (b *btrfs) PredictSize(fromFilesystemId, fromSnapshotId, toFilesystemId, toSnapshotId string) (int64, error) {
+	base, snapshots, err := b.sendPlan(fromSnapshotId, toFilesystemId, toSnapshotId)
+	if err != nil {
+		return 0, err
+	}
+	var size int64
+	for _, snapshot := range snapshots {
+		basePath, err := b.baseDataPath(toFilesystemId, base)
+		if err != nil {
+			return 0, err
+		}
+		written, err := b.writtenSince(b.snapshotDataPath(toFilesystemId, snapshot.Id), basePath)
+		if err != nil {
+			return 0, err
+		}
+		size += written
+		base = snapshot.Id
+	}
+	return size, nil
+}
+
+// ScrubStatus is what btrfs scrub status says about the filesystem
+func (b *btrfs) ScrubStatus() (string, error) {
+	output, err := outputBtrfs(b.btrfsPath, "scrub", "status", b.root)
+	if err != nil {
+		return "", err
+	}
+	lines := []string{}
+	for _, line := range strings.Split(string(output), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, "; "), nil
+}
+
+// Send writes the prelude, then for each of toFilesystemId's snapshots from
+// fromSnapshotId to toSnapshotId, a header and a btrfs send stream of it
+// relative to the one before. Cancelling ctx stops it.
+func (b *btrfs) Send(ctx context.Context, fromFilesystemId, fromSnapshotId, toFilesystemId, toSnapshotId string, preludeEncoded []byte) (*io.PipeReader, chan error) {
+	log.WithFields(log.Fields{
+		"fromFilesystemId": fromFilesystemId,
+		"fromSnapshotId":   fromSnapshotId,
+		"toFilesystemId":   toFilesystemId,
+		"toSnapshotId":     toSnapshotId,
+	}).Debug("btrfs.Send() starting")
+	pipeReader, pipeWriter := io.Pipe()
+	errch := make(chan error)
+	go func() {
+		_, err := pipeWriter.Write(preludeEncoded)
+		if err == nil {
+			err = b.writeStream(ctx, pipeWriter, fromSnapshotId, toFilesystemId, toSnapshotId)
+		}
+		if err != nil {
+			log.Errorf("[btrfs.Send:%s] Error sending %s => %s: %s", toFilesystemId, fromSnapshotId, toSnapshotId, err)
+		}
+		pipeWriter.CloseWithError(err)
+		errch <- err
+	}()
+	return pipeReader, errch
+}
+
+func (b *btrfs) writeStream(ctx context.Context, w io.Writer, fromSnapshotId, toFilesystemId, toSnapshotId string) error {
+	base, snapshots, err := b.sendPlan(fromSnapshotId, toFilesystemId, toSnapshotId)
+	if err != nil {
+		return err
+	}
+	for _, snapshot := range snapshots {
+		basePath, err := b.baseDataPath(toFilesystemId, base)
+		if err != nil {
+			return err
+		}
+		header, err := json.Marshal(btrfsStreamSnapshot{directorySnapshot: snapshot, Base: base})
+		if err != nil {
+			return err
+		}
+		_, err = chunked.Copy(w, bytes.NewReader(header))
+		if err != nil {
+			return err
+		}
+
+		args := []string{"send"}
+		if basePath != "" {
+			args = append(args, "-p", basePath)
+		}
+		args = append(args, b.snapshotDataPath(toFilesystemId, snapshot.Id))
+		LogZFSCommand(toFilesystemId, fmt.Sprintf("%s %s", b.btrfsPath, strings.Join(args, " ")))
+		cmd := exec.CommandContext(ctx, b.btrfsPath, args...)
+		cmd.Stderr = utils.GetLogfile("zfs-send-errors")
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			return err
+		}
+		err = cmd.Start()
+		if err != nil {
+			return err
+		}
+		_, err = chunked.Copy(w, stdout)
+		if err != nil {
+			cmd.Process.Kill()
+			cmd.Wait()
+			return err
+		}
+		err = cmd.Wait()
+		if err != nil {
+			return fmt.Errorf("btrfs send of %s@%s failed, check zfs-send-errors.log: %s", toFilesystemId, snapshot.Id, err)
+		}
+		base = snapshot.Id
+	}
+	// an empty header ends the stream
+	_, err = chunked.Copy(w, bytes.NewReader(nil))
+	return err
+}
+
+// Recv receives a stream written by Send into toFilesystemId, creating it if
+// need be. Each snapshot is received alongside the others and only appears
+// once it's complete; the working copy is then reset to the latest snapshot
+// received. Cancelling ctx stops it, throwing away the snapshot it was
+// receiving.
+func (b *btrfs) Recv(ctx context.Context, pipeReader *io.PipeReader, toFilesystemId string, errBuffer *bytes.Buffer) error {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			pipeReader.CloseWithError(ctx.Err())
+		case <-done:
+		}
+	}()
+
+	latest := ""
+	err := func() error {
+		for {
+			header, err := ioutil.ReadAll(chunked.NewReader(pipeReader))
+			if err != nil {
+				return err
+			}
+			if len(header) == 0 {
+				return nil
+			}
+			var snapshot btrfsStreamSnapshot
+			err = json.Unmarshal(header, &snapshot)
+			if err != nil {
+				return err
+			}
+			err = b.receiveSnapshot(ctx, pipeReader, toFilesystemId, snapshot, latest == "", errBuffer)
+			if err != nil {
+				return err
+			}
+			latest = snapshot.Id
+		}
+	}()
+	if latest != "" {
+		resetErr := b.resetData(toFilesystemId, b.snapshotDataPath(toFilesystemId, latest))
+		if err == nil {
+			err = resetErr
+		}
+	}
+	if err != nil && errBuffer != nil {
+		fmt.Fprintf(errBuffer, "cannot receive %s: %s\n", toFilesystemId, err)
+	}
+	return err
+}
+
+func (b *btrfs) receiveSnapshot(ctx context.Context, r io.Reader, fs string, snapshot btrfsStreamSnapshot, first bool, errBuffer *bytes.Buffer) error {
+	err := b.prepareReceive(fs, snapshot.Id, snapshot.Base, first)
+	if err != nil {
+		return err
+	}
+	tmp := b.snapshotPath(fs, "."+snapshot.Id)
+	err = b.removeSnapshotDir(tmp)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(tmp, 0700)
+	if err != nil {
+		return err
+	}
+	err = func() error {
+		LogZFSCommand(fs, fmt.Sprintf("%s receive %s", b.btrfsPath, tmp))
+		cmd := exec.CommandContext(ctx, b.btrfsPath, "receive", tmp)
+		cmd.Stdin = chunked.NewReader(r)
+		cmd.Stdout = utils.GetLogfile("zfs-recv-stdout")
+		if errBuffer == nil {
+			cmd.Stderr = utils.GetLogfile("zfs-recv-stderr")
+		} else {
+			cmd.Stderr = errBuffer
+		}
+		err := cmd.Run()
+		if err != nil {
+			return err
+		}
+		// the received subvolume is named after the one that was sent
+		if _, err := os.Stat(filepath.Join(tmp, "data")); err != nil {
+			return fmt.Errorf("btrfs receive of %s@%s didn't make a snapshot: %s", fs, snapshot.Id, err)
+		}
+		err = writeSnapshot(tmp, snapshot.directorySnapshot)
+		if err != nil {
+			return err
+		}
+		return os.Rename(tmp, b.snapshotPath(fs, snapshot.Id))
+	}()
+	if err != nil {
+		b.removeSnapshotDir(tmp)
+	}
+	return err
+}
+
+// Diff lists what's changed in the default subdot of a filesystem since its
+// latest snapshot: what's been added, removed or looks different, and files
+// that btrfs says have been written to even if they look the same
+func (b *btrfs) Diff(filesystemID string) ([]types.ZFSFileDiff, error) {
+	result, err := b.directory.Diff(filesystemID)
+	if err != nil {
+		return nil, err
+	}
+	snapshots, err := b.snapshots(filesystemID)
+	if err != nil {
+		return nil, err
+	}
+	gen, err := b.generation(b.snapshotDataPath(filesystemID, snapshots[len(snapshots)-1].Id))
+	if err != nil {
+		log.WithError(err).Error("[diff] error getting latest snapshot generation")
+		return nil, err
+	}
+	extents, err := b.findNew(b.dataPath(filesystemID), gen)
+	if err != nil {
+		log.WithError(err).Error("[diff] error finding written files")
+		return nil, err
+	}
+	changed := map[string]bool{}
+	for _, change := range result {
+		changed[change.Filename] = true
+	}
+	for _, extent := range extents {
+		filename := strings.TrimPrefix(extent.path, "__default__/")
+		if filename == extent.path || changed[filename] {
+			continue
+		}
+		// anything new would already be listed as added, so it's in both
+		changed[filename] = true
+		result = append(result, types.ZFSFileDiff{Change: types.FileChangeModified, Filename: filename})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Filename < result[j].Filename })
+	return result, nil
+}
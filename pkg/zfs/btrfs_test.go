@@ -0,0 +1,180 @@
+package zfs
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/dotmesh-oss/dotmesh/pkg/types"
+)
+
+func TestParseFindNew(t *testing.T) {
+	output := []byte(`inode 257 file offset 0 len 8192 disk start 13631488 offset 0 gen 10 flags NONE __default__/changed.txt
+inode 257 file offset 8192 len 4096 disk start 13643776 offset 0 gen 11 flags COMPRESS __default__/changed.txt
+inode 258 file offset 0 len 3 disk start 0 offset 0 gen 11 flags INLINE __default__/with space.txt
+transid marker was 11
+`)
+	extents, marker, err := parseFindNew(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []findNewExtent{
+		{path: "__default__/changed.txt", length: 8192},
+		{path: "__default__/changed.txt", length: 4096},
+		{path: "__default__/with space.txt", length: 3},
+	}
+	if !reflect.DeepEqual(extents, expected) || marker != 11 {
+		t.Errorf("expected %+v and marker 11, got %+v and %d", expected, extents, marker)
+	}
+
+	_, marker, err = parseFindNew([]byte("transid marker was 42\n"))
+	if err != nil || marker != 42 {
+		t.Errorf("expected just a marker of 42, got %d: %v", marker, err)
+	}
+	_, _, err = parseFindNew([]byte("ERROR: not a btrfs subvolume\n"))
+	if err == nil {
+		t.Errorf("expected an error for unexpected output")
+	}
+}
+
+// newTestBtrfs makes a btrfs backend under DOTMESH_TEST_BTRFS_DIR, which
+// must be on a btrfs filesystem
+func newTestBtrfs(t *testing.T) (*btrfs, func()) {
+	dir := os.Getenv("DOTMESH_TEST_BTRFS_DIR")
+	if dir == "" {
+		t.Skip("DOTMESH_TEST_BTRFS_DIR isn't set to a directory on btrfs")
+	}
+	btrfsPath, err := exec.LookPath("btrfs")
+	if err != nil {
+		t.Skip("no btrfs tool")
+	}
+	root, err := ioutil.TempDir(dir, "dotmesh-btrfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	restore := setEnv("MOUNT_PREFIX", filepath.Join(root, "mnt"))
+	z, err := NewBtrfs(btrfsPath, filepath.Join(root, "pool"), "pool")
+	if err != nil {
+		t.Fatalf("Error creating btrfs backend: %s", err)
+	}
+	b := z.(*btrfs)
+	return b, func() {
+		restore()
+		for _, fs := range b.FindFilesystemIdsOnSystem() {
+			b.removeFilesystem(fs)
+		}
+		os.RemoveAll(root)
+	}
+}
+
+func TestBtrfsSnapshotsAndDiff(t *testing.T) {
+	b, cleanup := newTestBtrfs(t)
+	defer cleanup()
+
+	_, err := b.Create("fs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, filepath.Join(b.dataPath("fs"), "__default__", "same.txt"), "same")
+	writeTestFile(t, filepath.Join(b.dataPath("fs"), "__default__", "changed.txt"), "before")
+	mustSnapshot(t, b, "fs", "first", map[string]string{"message": "first"})
+
+	dirty, _, err := b.GetDirtyDelta("fs", "first")
+	if err != nil || dirty != 0 {
+		t.Errorf("expected nothing dirty straight after snapshotting, got %d: %v", dirty, err)
+	}
+	writeTestFile(t, filepath.Join(b.dataPath("fs"), "__default__", "changed.txt"), "after!")
+	writeTestFile(t, filepath.Join(b.dataPath("fs"), "__default__", "new.txt"), "new")
+	dirty, _, err = b.GetDirtyDelta("fs", "first")
+	if err != nil || dirty == 0 {
+		t.Errorf("expected writes to be dirty, got %d: %v", dirty, err)
+	}
+
+	changes, err := b.Diff("fs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedChanges := []types.ZFSFileDiff{
+		{Change: types.FileChangeModified, Filename: "changed.txt"},
+		{Change: types.FileChangeAdded, Filename: "new.txt"},
+	}
+	if !reflect.DeepEqual(changes, expectedChanges) {
+		t.Errorf("expected changes %+v, got %+v", expectedChanges, changes)
+	}
+
+	mustSnapshot(t, b, "fs", "second", map[string]string{"message": "second"})
+	_, err = b.Clone("fs", "first", "branch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree := readTree(t, b.dataPath("branch"))
+	if tree["__default__/changed.txt"] != "before" {
+		t.Errorf("expected the clone to have the first snapshot's files, got %v", tree)
+	}
+
+	_, err = b.Rollback("fs", "first")
+	if err != nil {
+		t.Fatal(err)
+	}
+	filesystem, err := b.DiscoverSystem("fs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(filesystem.Snapshots) != 1 || filesystem.Snapshots[0].Metadata["message"] != "first" {
+		t.Errorf("expected rolling back to leave the first snapshot, got %+v", filesystem.Snapshots)
+	}
+}
+
+func TestBtrfsSendRecv(t *testing.T) {
+	src, cleanupSrc := newTestBtrfs(t)
+	defer cleanupSrc()
+	dst, cleanupDst := newTestBtrfs(t)
+	defer cleanupDst()
+
+	_, err := src.Create("fs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, filepath.Join(src.dataPath("fs"), "__default__", "kept.txt"), "kept")
+	writeTestFile(t, filepath.Join(src.dataPath("fs"), "__default__", "deleted.txt"), "deleted")
+	mustSnapshot(t, src, "fs", "first", map[string]string{"message": "first"})
+	os.Remove(filepath.Join(src.dataPath("fs"), "__default__", "deleted.txt"))
+	writeTestFile(t, filepath.Join(src.dataPath("fs"), "__default__", "added.txt"), "added")
+	mustSnapshot(t, src, "fs", "second", map[string]string{"message": "second"})
+
+	transfer(t, src, dst, "", "fs", "first")
+	transfer(t, src, dst, "first", "fs", "second")
+
+	for _, snap := range []string{"first", "second"} {
+		expected := readTree(t, src.snapshotDataPath("fs", snap))
+		got := readTree(t, dst.snapshotDataPath("fs", snap))
+		if !reflect.DeepEqual(expected, got) {
+			t.Errorf("expected snapshot %s to be received as %v, got %v", snap, expected, got)
+		}
+	}
+	if !reflect.DeepEqual(readTree(t, dst.dataPath("fs")), readTree(t, src.snapshotDataPath("fs", "second"))) {
+		t.Errorf("expected the working copy to be the latest snapshot received")
+	}
+	filesystem, err := dst.DiscoverSystem("fs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(filesystem.Snapshots) != 2 || filesystem.Snapshots[1].Metadata["message"] != "second" {
+		t.Errorf("expected both snapshots with their metadata, got %+v", filesystem.Snapshots)
+	}
+
+	// clones are sent relative to their origin
+	_, err = src.Clone("fs", "first", "branch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, filepath.Join(src.dataPath("branch"), "__default__", "branch.txt"), "branch")
+	mustSnapshot(t, src, "branch", "third", map[string]string{"message": "third"})
+	transfer(t, src, dst, "fs@first", "branch", "third")
+	if readTree(t, dst.snapshotDataPath("branch", "third"))["__default__/branch.txt"] != "branch" {
+		t.Errorf("expected the clone's snapshot to be received")
+	}
+}
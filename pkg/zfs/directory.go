@@ -0,0 +1,1345 @@
+package zfs
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/dotmesh-oss/dotmesh/pkg/metrics"
+	"github.com/dotmesh-oss/dotmesh/pkg/types"
+	"github.com/dotmesh-oss/dotmesh/pkg/utils"
+	"github.com/dotmesh-oss/dotmesh/pkg/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// directory keeps dots in a plain directory tree on any Linux filesystem,
+// for when ZFS isn't available:
+//
+//	<root>/dotmesh_pool_id
+//	<root>/dmfs/<filesystem>/data                       the working copy
+//	<root>/dmfs/<filesystem>/origin                     clone origin, fs@snap
+//	<root>/dmfs/<filesystem>/registry.json              registry properties
+//	<root>/dmfs/<filesystem>/snapshots/<snapshot>/data
+//	<root>/dmfs/<filesystem>/snapshots/<snapshot>/meta.json
+//
+// Snapshots are copies of the working copy that share unchanged files with
+// the snapshot before them by hardlinking, and are never changed once made.
+// Working copies are made from snapshots with reflinks where the filesystem
+// supports them, and real copies where it doesn't. Clones are copies too,
+// so unlike on ZFS, they cost as much space as their origin.
+//
+// Mounts are bind mounts, and send streams are tar archives of what changed
+// in each snapshot, after the same prelude as ZFS streams.
+type directory struct {
+	root     string
+	poolName string
+	poolId   string
+	trees    directoryTrees
+
+	// when each filesystem's working copy last changed, as of its last Diff
+	lastModified   map[string]time.Time
+	lastModifiedMu sync.Mutex
+}
+
+var _ ZFS = &directory{}
+
+const (
+	directoryPoolIdFile   = "dotmesh_pool_id"
+	directoryStreamHeader = "snapshot.json"
+	directoryStreamData   = "data/"
+)
+
+// directorySnapshot is what's recorded about a snapshot, in its meta.json
+type directorySnapshot struct {
+	Id       string
+	Created  time.Time
+	Metadata map[string]string
+}
+
+// directoryStreamSnapshot starts each snapshot in a send stream, followed by
+// what's changed in it
+type directoryStreamSnapshot struct {
+	directorySnapshot
+	// what the snapshot was sent relative to: the snapshot before it, or
+	// "filesystem@snapshot" for the first snapshot of a clone, or "" if it
+	// was sent in full
+	Base string
+	// paths removed since Base
+	Deleted []string
+}
+
+// NewDirectory returns a backend that keeps dots under root, creating it if
+// need be. Its pool id is kept with the dots, so it follows them around.
+func NewDirectory(root, poolName string) (ZFS, error) {
+	return newDirectory(root, poolName, types.FilesystemBackendDirectory, plainTrees{})
+}
+
+func newDirectory(root, poolName, backend string, trees directoryTrees) (*directory, error) {
+	if root == "" {
+		return nil, fmt.Errorf("%s must be set to use the %s backend", types.EnvFilesystemDir, backend)
+	}
+	err := os.MkdirAll(filepath.Join(root, types.RootFS), 0700)
+	if err != nil {
+		return nil, err
+	}
+	poolIdFile := filepath.Join(root, directoryPoolIdFile)
+	poolId, err := ioutil.ReadFile(poolIdFile)
+	if os.IsNotExist(err) {
+		poolId = []byte(strings.Replace(uuid.New().String(), "-", "", -1))
+		log.Infof("[NewDirectory] No pool id in %s, writing new pool id %s", root, poolId)
+		err = ioutil.WriteFile(poolIdFile, poolId, 0600)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &directory{
+		root:         root,
+		poolName:     poolName,
+		poolId:       strings.TrimSpace(string(poolId)),
+		trees:        trees,
+		lastModified: map[string]time.Time{},
+	}, nil
+}
+
+func (d *directory) GetPoolID() string {
+	return d.poolId
+}
+
+func (d *directory) FQ(filesystemId string) string {
+	return filepath.Join(d.root, types.RootFS, filesystemId)
+}
+
+func (d *directory) dataPath(filesystemId string) string {
+	return filepath.Join(d.FQ(filesystemId), "data")
+}
+
+func (d *directory) snapshotPath(filesystemId, snapshotId string) string {
+	return filepath.Join(d.FQ(filesystemId), "snapshots", snapshotId)
+}
+
+func (d *directory) snapshotDataPath(filesystemId, snapshotId string) string {
+	return filepath.Join(d.snapshotPath(filesystemId, snapshotId), "data")
+}
+
+// originDataPath is the data of a snapshot given as "filesystem@snapshot"
+func (d *directory) originDataPath(origin string) (string, error) {
+	shrapnel := strings.SplitN(origin, "@", 2)
+	if len(shrapnel) != 2 {
+		return "", fmt.Errorf("%q isn't a filesystem@snapshot", origin)
+	}
+	return d.snapshotDataPath(shrapnel[0], shrapnel[1]), nil
+}
+
+// createFrom makes a new filesystem whose working copy is a copy of the
+// snapshot src
+func (d *directory) createFrom(filesystemId, src string) error {
+	err := os.MkdirAll(filepath.Join(d.FQ(filesystemId), "snapshots"), 0700)
+	if err != nil {
+		return err
+	}
+	return d.trees.clone(src, d.dataPath(filesystemId))
+}
+
+// removeSnapshotDir removes a snapshot's directory, or what's left of one
+// that was being made or received
+func (d *directory) removeSnapshotDir(dir string) error {
+	if _, err := os.Lstat(filepath.Join(dir, "data")); err == nil {
+		err = d.trees.remove(filepath.Join(dir, "data"))
+		if err != nil {
+			return err
+		}
+	}
+	return os.RemoveAll(dir)
+}
+
+func (d *directory) exists(filesystemId string) bool {
+	_, err := os.Stat(d.dataPath(filesystemId))
+	return err == nil
+}
+
+// snapshots lists a filesystem's snapshots, oldest first
+func (d *directory) snapshots(filesystemId string) ([]directorySnapshot, error) {
+	entries, err := ioutil.ReadDir(filepath.Join(d.FQ(filesystemId), "snapshots"))
+	if err != nil {
+		return nil, err
+	}
+	snapshots := []directorySnapshot{}
+	for _, entry := range entries {
+		// leftovers of snapshots that were being made or received
+		if strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		snapshot, err := d.readSnapshot(filesystemId, entry.Name())
+		if err != nil {
+			return nil, err
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+	sort.SliceStable(snapshots, func(i, j int) bool {
+		if !snapshots[i].Created.Equal(snapshots[j].Created) {
+			return snapshots[i].Created.Before(snapshots[j].Created)
+		}
+		return snapshots[i].Id < snapshots[j].Id
+	})
+	return snapshots, nil
+}
+
+func (d *directory) readSnapshot(filesystemId, snapshotId string) (directorySnapshot, error) {
+	var snapshot directorySnapshot
+	data, err := ioutil.ReadFile(filepath.Join(d.snapshotPath(filesystemId, snapshotId), "meta.json"))
+	if err != nil {
+		return snapshot, err
+	}
+	err = json.Unmarshal(data, &snapshot)
+	if snapshot.Metadata == nil {
+		snapshot.Metadata = map[string]string{}
+	}
+	return snapshot, err
+}
+
+// writeSnapshot records a snapshot's meta.json in dir
+func writeSnapshot(dir string, snapshot directorySnapshot) error {
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, "meta.json"), data, 0600)
+}
+
+// latestSnapshotData is the data of the snapshot a new snapshot of
+// filesystemId follows: its latest, or its origin if it's a clone that
+// hasn't any yet. It's "" if there isn't one.
+func (d *directory) latestSnapshotData(filesystemId string) (string, error) {
+	snapshots, err := d.snapshots(filesystemId)
+	if err != nil {
+		return "", err
+	}
+	if len(snapshots) > 0 {
+		return d.snapshotDataPath(filesystemId, snapshots[len(snapshots)-1].Id), nil
+	}
+	origin, err := ioutil.ReadFile(filepath.Join(d.FQ(filesystemId), "origin"))
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return d.originDataPath(string(origin))
+}
+
+// resetData makes the working copy of filesystemId a copy of src. The data
+// directory itself stays put, so bind mounts of it see the change.
+func (d *directory) resetData(filesystemId, src string) error {
+	err := clearDir(d.dataPath(filesystemId))
+	if err != nil {
+		return err
+	}
+	return copyTree(src, d.dataPath(filesystemId))
+}
+
+func (d *directory) Create(filesystemId string) ([]byte, error) {
+	if d.exists(filesystemId) {
+		return nil, fmt.Errorf("filesystem %s already exists", filesystemId)
+	}
+	err := os.MkdirAll(filepath.Join(d.FQ(filesystemId), "snapshots"), 0700)
+	if err != nil {
+		return nil, err
+	}
+	return nil, d.trees.create(d.dataPath(filesystemId))
+}
+
+// errNoEncryption is returned for encrypted dots, which only the zfs backend
+// can keep
+var errNoEncryption = fmt.Errorf("encrypted dots need the zfs filesystem backend")
+
+func (d *directory) CreateEncrypted(filesystemId, key string) ([]byte, error) {
+	return nil, errNoEncryption
+}
+
+func (d *directory) LoadKey(filesystemId, key string) ([]byte, error) {
+	return nil, errNoEncryption
+}
+
+// KeyStatus is always "", as nothing here is encrypted
+func (d *directory) KeyStatus(filesystemId string) (string, error) {
+	return "", nil
+}
+
+// Snapshot snapshots a filesystem, with metadata given as zfs snapshot
+// arguments, as utils.EncodeMetadata encodes it
+func (d *directory) Snapshot(filesystemId, snapshotId string, meta []string) ([]byte, error) {
+	metadata, err := decodeMetadataArgs(meta)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(d.snapshotPath(filesystemId, snapshotId)); err == nil {
+		return nil, fmt.Errorf("snapshot %s@%s already exists", filesystemId, snapshotId)
+	}
+	prev, err := d.latestSnapshotData(filesystemId)
+	if err != nil {
+		return nil, err
+	}
+
+	// made alongside and renamed into place, so that a half-made snapshot
+	// is never seen
+	tmp := d.snapshotPath(filesystemId, "."+snapshotId)
+	err = d.removeSnapshotDir(tmp)
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(tmp, 0700)
+	if err != nil {
+		return nil, err
+	}
+	err = func() error {
+		err := d.trees.snapshot(d.dataPath(filesystemId), prev, filepath.Join(tmp, "data"))
+		if err != nil {
+			return err
+		}
+		err = writeSnapshot(tmp, directorySnapshot{Id: snapshotId, Created: time.Now(), Metadata: metadata})
+		if err != nil {
+			return err
+		}
+		return os.Rename(tmp, d.snapshotPath(filesystemId, snapshotId))
+	}()
+	if err != nil {
+		d.removeSnapshotDir(tmp)
+		return nil, err
+	}
+	return nil, nil
+}
+
+// decodeMetadataArgs undoes utils.EncodeMetadata
+func decodeMetadataArgs(meta []string) (map[string]string, error) {
+	metadata := map[string]string{}
+	for _, arg := range meta {
+		if arg == "-o" {
+			continue
+		}
+		shrapnel := strings.SplitN(strings.TrimPrefix(arg, types.MetaKeyPrefix), "=", 2)
+		if len(shrapnel) != 2 {
+			return nil, fmt.Errorf("malformed metadata %q", arg)
+		}
+		if shrapnel[1] == "." {
+			// special case to denote empty string
+			metadata[shrapnel[0]] = ""
+			continue
+		}
+		value, err := base64.StdEncoding.DecodeString(shrapnel[1])
+		if err != nil {
+			return nil, err
+		}
+		metadata[shrapnel[0]] = string(value)
+	}
+	return metadata, nil
+}
+
+func (d *directory) DestroySnapshot(filesystemId, snapshotId string) ([]byte, error) {
+	if snapshotId == "" {
+		return nil, fmt.Errorf("refusing to destroy %s, no snapshot given", filesystemId)
+	}
+	mounted, err := utils.IsFilesystemMounted(FullIdWithSnapshot(filesystemId, snapshotId))
+	if err != nil {
+		return nil, err
+	}
+	if mounted {
+		return nil, fmt.Errorf("snapshot %s@%s is mounted", filesystemId, snapshotId)
+	}
+	if _, err := os.Stat(d.snapshotPath(filesystemId, snapshotId)); err != nil {
+		return nil, err
+	}
+	return nil, d.removeSnapshotDir(d.snapshotPath(filesystemId, snapshotId))
+}
+
+func (d *directory) List(filesystemId, snapshotId string) ([]byte, error) {
+	path := d.dataPath(filesystemId)
+	if snapshotId != "" {
+		path = d.snapshotPath(filesystemId, snapshotId)
+	}
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	return []byte(d.FQ(FullIdWithSnapshot(filesystemId, snapshotId)) + "\n"), nil
+}
+
+// Clone makes a new filesystem from a copy of a snapshot, with no snapshots
+// of its own
+func (d *directory) Clone(filesystemId, originSnapshotId, newCloneFilesystemId string) ([]byte, error) {
+	origin := d.snapshotDataPath(filesystemId, originSnapshotId)
+	if _, err := os.Stat(origin); err != nil {
+		return nil, err
+	}
+	if d.exists(newCloneFilesystemId) {
+		return nil, fmt.Errorf("filesystem %s already exists", newCloneFilesystemId)
+	}
+	err := func() error {
+		err := d.createFrom(newCloneFilesystemId, origin)
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(
+			filepath.Join(d.FQ(newCloneFilesystemId), "origin"),
+			[]byte(FullIdWithSnapshot(filesystemId, originSnapshotId)), 0600,
+		)
+	}()
+	if err != nil {
+		log.Printf(
+			"[Clone] %v while trying to clone filesystem %s, %s -> %s",
+			err, d.FQ(filesystemId), originSnapshotId, newCloneFilesystemId,
+		)
+		d.removeFilesystem(newCloneFilesystemId)
+	}
+	return nil, err
+}
+
+// Rollback throws away a filesystem's snapshots after snapshotId, and resets
+// its working copy to it
+func (d *directory) Rollback(filesystemId, snapshotId string) ([]byte, error) {
+	err := clearMounts("", filesystemId)
+	if err != nil {
+		return nil, err
+	}
+	snapshots, err := d.snapshots(filesystemId)
+	if err != nil {
+		return nil, err
+	}
+	found := false
+	for _, snapshot := range snapshots {
+		if found {
+			err = d.removeSnapshotDir(d.snapshotPath(filesystemId, snapshot.Id))
+			if err != nil {
+				return nil, err
+			}
+		}
+		if snapshot.Id == snapshotId {
+			found = true
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("no snapshot %s of %s to roll back to", snapshotId, filesystemId)
+	}
+	return nil, d.resetData(filesystemId, d.snapshotDataPath(filesystemId, snapshotId))
+}
+
+// SetCanmount has nothing to do, as directories don't get mounted unless
+// they're asked to be
+func (d *directory) SetCanmount(filesystemId, snapshotId string) ([]byte, error) {
+	return nil, nil
+}
+
+// Mount bind mounts a working copy, or snapshot, at mountPath. Snapshots
+// should be mounted read-only, as their files are shared with other
+// snapshots.
+func (d *directory) Mount(filesystemId, snapshotId, options, mountPath string) ([]byte, error) {
+	fullFilesystemId := FullIdWithSnapshot(filesystemId, snapshotId)
+	src := d.dataPath(filesystemId)
+	if snapshotId != "" {
+		src = d.snapshotDataPath(filesystemId, snapshotId)
+	}
+	err := os.MkdirAll(mountPath, 0777)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error":         err,
+			"filesystem_id": fullFilesystemId,
+			"mountpath":     mountPath,
+		}).Error("error while trying to create a directory")
+		return nil, err
+	}
+	LogZFSCommand(filesystemId, fmt.Sprintf("mount --bind %s %s", src, mountPath))
+	output, err := exec.Command("mount", "--bind", src, mountPath).CombinedOutput()
+	if err == nil && options != "" {
+		// bind mounts only take options when remounted
+		LogZFSCommand(filesystemId, fmt.Sprintf("mount -o remount,bind,%s %s", options, mountPath))
+		var remountOutput []byte
+		remountOutput, err = exec.Command("mount", "-o", "remount,bind,"+options, mountPath).CombinedOutput()
+		output = append(output, remountOutput...)
+		if err != nil {
+			exec.Command("umount", mountPath).Run()
+		}
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error":         err,
+			"filesystem_id": fullFilesystemId,
+			"mountpath":     mountPath,
+			"source":        src,
+			"options":       options,
+			"output":        string(output),
+		}).Error("error while trying to mount")
+		return output, err
+	}
+	return output, nil
+}
+
+func (d *directory) DiscoverSystem(fs string) (*types.Filesystem, error) {
+	if !d.exists(fs) {
+		return &types.Filesystem{
+			Id:     fs,
+			Exists: false,
+			// Important not to leave snapshots nil in the default case, we
+			// need to inform other nodes that we have no snapshots of a
+			// filesystem if we don't have the filesystem.
+			Snapshots: []*types.Snapshot{},
+		}, nil
+	}
+	mounted, err := utils.IsFilesystemMounted(fs)
+	if err != nil {
+		return nil, err
+	}
+	snapshots, err := d.snapshots(fs)
+	if err != nil {
+		return nil, err
+	}
+	result := []*types.Snapshot{}
+	for _, snapshot := range snapshots {
+		result = append(result, &types.Snapshot{Id: snapshot.Id, Metadata: snapshot.Metadata})
+	}
+	return &types.Filesystem{
+		Id:        fs,
+		Exists:    true,
+		Mounted:   mounted,
+		Snapshots: result,
+	}, nil
+}
+
+// GetZPoolCapacity is how full, as a percentage, the filesystem the
+// directory is on is
+func (d *directory) GetZPoolCapacity() (float64, error) {
+	var stat unix.Statfs_t
+	err := unix.Statfs(d.root, &stat)
+	if err != nil {
+		return 0, err
+	}
+	if stat.Blocks == 0 {
+		return 0, nil
+	}
+	used := stat.Blocks - stat.Bfree
+	return float64(used * 100 / stat.Blocks), nil
+}
+
+// ScrubStatus has nothing to report, as a plain filesystem can't check its
+// data against checksums the way a zpool does
+func (d *directory) ScrubStatus() (string, error) {
+	return "not supported by the " + types.FilesystemBackendDirectory + " backend", nil
+}
+
+func (d *directory) ReportZpoolCapacity() error {
+	capacity, err := d.GetZPoolCapacity()
+	if err != nil {
+		return err
+	}
+	metrics.ZPoolCapacity.WithLabelValues(d.poolId, d.poolName).Set(capacity)
+	return nil
+}
+
+func (d *directory) FindFilesystemIdsOnSystem() []string {
+	log.Print("Finding filesystem ids...")
+	entries, err := ioutil.ReadDir(filepath.Join(d.root, types.RootFS))
+	if err != nil {
+		log.Fatalf("%s, when listing %s", err, d.root)
+	}
+	ids := []string{}
+	for _, entry := range entries {
+		if entry.IsDir() && d.exists(entry.Name()) {
+			ids = append(ids, entry.Name())
+		}
+	}
+	return ids
+}
+
+func (d *directory) DeleteFilesystemInZFS(fs string) error {
+	mounted, err := utils.IsFilesystemMounted(fs)
+	if err != nil {
+		return err
+	}
+	if mounted {
+		return fmt.Errorf("can't delete filesystem %s, it's mounted", fs)
+	}
+	return d.removeFilesystem(fs)
+}
+
+// removeFilesystem removes a filesystem, with its snapshots
+func (d *directory) removeFilesystem(fs string) error {
+	entries, err := ioutil.ReadDir(filepath.Join(d.FQ(fs), "snapshots"))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, entry := range entries {
+		err = d.removeSnapshotDir(filepath.Join(d.FQ(fs), "snapshots", entry.Name()))
+		if err != nil {
+			return err
+		}
+	}
+	if _, err := os.Lstat(d.dataPath(fs)); err == nil {
+		err = d.trees.remove(d.dataPath(fs))
+		if err != nil {
+			return err
+		}
+	}
+	return os.RemoveAll(d.FQ(fs))
+}
+
+// GetDirtyDelta counts the bytes in files that are new or have changed
+// since latestSnap, rather than the bytes written, which a plain filesystem
+// doesn't keep track of. It's polled, so files are only compared by how they
+// look, and one rewritten keeping its modification time isn't counted.
+func (d *directory) GetDirtyDelta(filesystemId, latestSnap string) (int64, int64, error) {
+	snapshot := ""
+	if latestSnap != "" {
+		snapshot = d.snapshotDataPath(filesystemId, latestSnap)
+	}
+	var dirty, total int64
+	err := walkTree(d.dataPath(filesystemId), func(rel string, info os.FileInfo) error {
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		total += info.Size()
+		if snapshot != "" {
+			snapshotInfo, err := os.Lstat(filepath.Join(snapshot, rel))
+			if err == nil && unchanged(snapshotInfo, info) {
+				return nil
+			}
+		}
+		dirty += info.Size()
+		return nil
+	})
+	if err != nil {
+		return 0, 0, fmt.Errorf("[pollDirty] error comparing %s with %s: %s", filesystemId, latestSnap, err)
+	}
+	return dirty, total, nil
+}
+
+// StashBranch moves existingFs to newFs, then makes existingFs again from
+// newFs's snapshots up to rollbackTo, which it takes over, leaving newFs as
+// a clone of it with the later ones, as a ZFS rename, clone and promote
+// would.
+func (d *directory) StashBranch(existingFs string, newFs string, rollbackTo string) error {
+	log.WithFields(log.Fields{
+		"existing_fs": existingFs,
+		"new_fs":      newFs,
+		"rollback_to": rollbackTo,
+	}).Info("stashing branch")
+	err := clearMounts("", existingFs)
+	if err != nil {
+		return err
+	}
+	snapshots, err := d.snapshots(existingFs)
+	if err != nil {
+		return err
+	}
+	found := false
+	for _, snapshot := range snapshots {
+		if snapshot.Id == rollbackTo {
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("no snapshot %s of %s to stash from", rollbackTo, existingFs)
+	}
+
+	err = os.Rename(d.FQ(existingFs), d.FQ(newFs))
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Join(d.FQ(existingFs), "snapshots"), 0700)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(filepath.Join(d.FQ(newFs), "origin"), filepath.Join(d.FQ(existingFs), "origin"))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, snapshot := range snapshots {
+		err = os.Rename(d.snapshotPath(newFs, snapshot.Id), d.snapshotPath(existingFs, snapshot.Id))
+		if err != nil {
+			return err
+		}
+		if snapshot.Id == rollbackTo {
+			break
+		}
+	}
+	err = ioutil.WriteFile(
+		filepath.Join(d.FQ(newFs), "origin"), []byte(FullIdWithSnapshot(existingFs, rollbackTo)), 0600,
+	)
+	if err != nil {
+		return err
+	}
+	return d.trees.clone(d.snapshotDataPath(existingFs, rollbackTo), d.dataPath(existingFs))
+}
+
+// Fork copies a filesystem, with its snapshots up to latestSnapshot, to a
+// new filesystem that's no clone of it
+func (d *directory) Fork(filesystemId, latestSnapshot, forkFilesystemId string) error {
+	start := time.Now()
+	snapshots, err := d.snapshots(filesystemId)
+	if err != nil {
+		return err
+	}
+	if d.exists(forkFilesystemId) {
+		return fmt.Errorf("filesystem %s already exists", forkFilesystemId)
+	}
+	err = func() error {
+		for _, snapshot := range snapshots {
+			dst := d.snapshotPath(forkFilesystemId, snapshot.Id)
+			err := os.MkdirAll(dst, 0700)
+			if err != nil {
+				return err
+			}
+			// a snapshot of a snapshot shares everything with it
+			src := d.snapshotDataPath(filesystemId, snapshot.Id)
+			err = d.trees.snapshot(src, src, filepath.Join(dst, "data"))
+			if err != nil {
+				return err
+			}
+			err = writeSnapshot(dst, snapshot)
+			if err != nil {
+				return err
+			}
+			if snapshot.Id == latestSnapshot {
+				return d.createFrom(forkFilesystemId, d.snapshotDataPath(forkFilesystemId, snapshot.Id))
+			}
+		}
+		return fmt.Errorf("no snapshot %s of %s to fork", latestSnapshot, filesystemId)
+	}()
+	if err != nil {
+		d.removeFilesystem(forkFilesystemId)
+		return err
+	}
+	log.WithField("duration", fmt.Sprintf("%v", time.Since(start))).Info("Directory fork completed")
+	return nil
+}
+
+// ApplyPrelude adds the metadata in a prelude to the snapshots it's about
+func (d *directory) ApplyPrelude(prelude types.Prelude, fs string) error {
+	for _, s := range prelude.SnapshotProperties {
+		snapshot, err := d.readSnapshot(fs, s.Id)
+		if err != nil {
+			return fmt.Errorf("Error applying prelude to %s@%s: %s", fs, s.Id, err)
+		}
+		for k, v := range s.Metadata {
+			snapshot.Metadata[k] = v
+		}
+		err = writeSnapshot(d.snapshotPath(fs, s.Id), snapshot)
+		if err != nil {
+			return fmt.Errorf("Error applying prelude to %s@%s: %s", fs, s.Id, err)
+		}
+	}
+	return nil
+}
+
+func (d *directory) SetRegistryProperties(filesystemId string, properties types.RegistryProperties) error {
+	if !d.exists(filesystemId) {
+		return fmt.Errorf("filesystem %s doesn't exist", filesystemId)
+	}
+	data, err := json.Marshal(properties)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(d.FQ(filesystemId), "registry.json")
+	tmp := path + ".tmp"
+	err = ioutil.WriteFile(tmp, data, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (d *directory) GetRegistryProperties(filesystemId string) (*types.RegistryProperties, error) {
+	data, err := ioutil.ReadFile(filepath.Join(d.FQ(filesystemId), "registry.json"))
+	if os.IsNotExist(err) && d.exists(filesystemId) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	properties := &types.RegistryProperties{}
+	err = json.Unmarshal(data, properties)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to decode registry properties of %s: %s", filesystemId, err)
+	}
+	return properties, nil
+}
+
+// sendPlan works out which snapshots of toFilesystemId a send from
+// fromSnapshotId to toSnapshotId includes, and what the first of them is
+// sent relative to, as zfs send -I would: fromSnapshotId is "" for a full
+// send, a snapshot of toFilesystemId, or "filesystem@snapshot" for a clone's
+// origin.
+func (d *directory) sendPlan(fromSnapshotId, toFilesystemId, toSnapshotId string) (string, []directorySnapshot, error) {
+	snapshots, err := d.snapshots(toFilesystemId)
+	if err != nil {
+		return "", nil, err
+	}
+	end := -1
+	for i, snapshot := range snapshots {
+		if snapshot.Id == toSnapshotId {
+			end = i
+		}
+	}
+	if end == -1 {
+		return "", nil, fmt.Errorf("no snapshot %s of %s to send", toSnapshotId, toFilesystemId)
+	}
+	if fromSnapshotId == "" || strings.Contains(fromSnapshotId, "@") {
+		return fromSnapshotId, snapshots[:end+1], nil
+	}
+	for i, snapshot := range snapshots[:end+1] {
+		if snapshot.Id == fromSnapshotId {
+			return fromSnapshotId, snapshots[i+1 : end+1], nil
+		}
+	}
+	return "", nil, fmt.Errorf("no snapshot %s of %s before %s to send from", fromSnapshotId, toFilesystemId, toSnapshotId)
+}
+
+// baseDataPath is the data of what a snapshot of filesystemId is sent
+// relative to, "" for nothing
+func (d *directory) baseDataPath(filesystemId, base string) (string, error) {
+	if base == "" {
+		return "", nil
+	}
+	if strings.Contains(base, "@") {
+		return d.originDataPath(base)
+	}
+	return d.snapshotDataPath(filesystemId, base), nil
+}
+
+// deletedSince lists the paths in base that aren't in snapshot
+func deletedSince(base, snapshot string) ([]string, error) {
+	deleted := []string{}
+	if base == "" {
+		return deleted, nil
+	}
+	err := walkTree(base, func(rel string, info os.FileInfo) error {
+		_, err := os.Lstat(filepath.Join(snapshot, rel))
+		if os.IsNotExist(err) {
+			deleted = append(deleted, rel)
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		return err
+	})
+	return deleted, err
+}
+
+// changedSince calls changed for everything in snapshot that isn't in base,
+// or is different there. Files are only the same if they're the same file,
+// which hardlinking unchanged files into each snapshot makes them.
+func changedSince(base, snapshot string, changed func(rel string, info os.FileInfo) error) error {
+	return walkTree(snapshot, func(rel string, info os.FileInfo) error {
+		if base != "" {
+			baseInfo, err := os.Lstat(filepath.Join(base, rel))
+			if err == nil && sameEntry(filepath.Join(base, rel), baseInfo, filepath.Join(snapshot, rel), info) {
+				return nil
+			}
+		}
+		return changed(rel, info)
+	})
+}
+
+func sameEntry(aPath string, a os.FileInfo, bPath string, b os.FileInfo) bool {
+	switch {
+	case a.Mode().IsRegular() && b.Mode().IsRegular():
+		return os.SameFile(a, b)
+	case a.IsDir() && b.IsDir():
+		aUid, aGid := owner(a)
+		bUid, bGid := owner(b)
+		return a.Mode() == b.Mode() && a.ModTime().Equal(b.ModTime()) && aUid == bUid && aGid == bGid
+	case a.Mode()&os.ModeSymlink != 0 && b.Mode()&os.ModeSymlink != 0:
+		aLink, aErr := os.Readlink(aPath)
+		bLink, bErr := os.Readlink(bPath)
+		return aErr == nil && bErr == nil && aLink == bLink
+	}
+	return false
+}
+
+// PredictSize is the size of the tar stream Send would write, give or take
+// its snapshot headers
+func (d *directory) PredictSize(fromFilesystemId, fromSnapshotId, toFilesystemId, toSnapshotId string) (int64, error) {
+	base, snapshots, err := d.sendPlan(fromSnapshotId, toFilesystemId, toSnapshotId)
+	if err != nil {
+		return 0, err
+	}
+	var size int64
+	for _, snapshot := range snapshots {
+		basePath, err := d.baseDataPath(toFilesystemId, base)
+		if err != nil {
+			return 0, err
+		}
+		err = changedSince(basePath, d.snapshotDataPath(toFilesystemId, snapshot.Id), func(rel string, info os.FileInfo) error {
+			// a tar header, then the contents padded to a whole block
+			size += 512
+			if info.Mode().IsRegular() {
+				size += (info.Size() + 511) / 512 * 512
+			}
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+		base = snapshot.Id
+	}
+	return size, nil
+}
+
+// Send writes the prelude, then a tar stream of toFilesystemId's snapshots
+// from fromSnapshotId to toSnapshotId: for each snapshot, a snapshot.json
+// header followed by the directories, files and symlinks that changed in
+// it. Cancelling ctx stops it.
+func (d *directory) Send(ctx context.Context, fromFilesystemId, fromSnapshotId, toFilesystemId, toSnapshotId string, preludeEncoded []byte) (*io.PipeReader, chan error) {
+	log.WithFields(log.Fields{
+		"fromFilesystemId": fromFilesystemId,
+		"fromSnapshotId":   fromSnapshotId,
+		"toFilesystemId":   toFilesystemId,
+		"toSnapshotId":     toSnapshotId,
+	}).Debug("directory.Send() starting")
+	pipeReader, pipeWriter := io.Pipe()
+	errch := make(chan error)
+	go func() {
+		_, err := pipeWriter.Write(preludeEncoded)
+		if err == nil {
+			err = d.writeStream(ctx, pipeWriter, fromSnapshotId, toFilesystemId, toSnapshotId)
+		}
+		if err != nil {
+			log.Errorf("[directory.Send:%s] Error sending %s => %s: %s", toFilesystemId, fromSnapshotId, toSnapshotId, err)
+		}
+		pipeWriter.CloseWithError(err)
+		errch <- err
+	}()
+	return pipeReader, errch
+}
+
+func (d *directory) writeStream(ctx context.Context, w io.Writer, fromSnapshotId, toFilesystemId, toSnapshotId string) error {
+	base, snapshots, err := d.sendPlan(fromSnapshotId, toFilesystemId, toSnapshotId)
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(w)
+	for _, snapshot := range snapshots {
+		basePath, err := d.baseDataPath(toFilesystemId, base)
+		if err != nil {
+			return err
+		}
+		snapshotPath := d.snapshotDataPath(toFilesystemId, snapshot.Id)
+		deleted, err := deletedSince(basePath, snapshotPath)
+		if err != nil {
+			return err
+		}
+		header, err := json.Marshal(directoryStreamSnapshot{directorySnapshot: snapshot, Base: base, Deleted: deleted})
+		if err != nil {
+			return err
+		}
+		err = tw.WriteHeader(&tar.Header{
+			Name: directoryStreamHeader, Typeflag: tar.TypeReg, Mode: 0600,
+			Size: int64(len(header)), ModTime: snapshot.Created,
+		})
+		if err != nil {
+			return err
+		}
+		_, err = tw.Write(header)
+		if err != nil {
+			return err
+		}
+		err = changedSince(basePath, snapshotPath, func(rel string, info os.FileInfo) error {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return writeTarEntry(tw, snapshotPath, rel, info)
+		})
+		if err != nil {
+			return err
+		}
+		base = snapshot.Id
+	}
+	return tw.Close()
+}
+
+func writeTarEntry(tw *tar.Writer, root, rel string, info os.FileInfo) error {
+	path := filepath.Join(root, rel)
+	link := ""
+	switch {
+	case info.Mode()&os.ModeSymlink != 0:
+		var err error
+		link, err = os.Readlink(path)
+		if err != nil {
+			return err
+		}
+	case !info.IsDir() && !info.Mode().IsRegular():
+		// devices, sockets and pipes don't go in snapshots
+		return nil
+	}
+	header, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return err
+	}
+	header.Name = directoryStreamData + filepath.ToSlash(rel)
+	// for the nanoseconds of modification times
+	header.Format = tar.FormatPAX
+	header.AccessTime = time.Time{}
+	header.ChangeTime = time.Time{}
+	err = tw.WriteHeader(header)
+	if err != nil || !info.Mode().IsRegular() {
+		return err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// Recv receives a stream written by Send into toFilesystemId, creating it if
+// need be. Each snapshot is built alongside the others, starting from
+// hardlinks to what it was sent relative to, and only appears once it's
+// complete; the working copy is then reset to the latest snapshot received.
+// Cancelling ctx stops it, throwing away the snapshot it was receiving.
+func (d *directory) Recv(ctx context.Context, pipeReader *io.PipeReader, toFilesystemId string, errBuffer *bytes.Buffer) error {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			pipeReader.CloseWithError(ctx.Err())
+		case <-done:
+		}
+	}()
+
+	r := &directoryReceiver{d: d, filesystemId: toFilesystemId, dirs: map[string]*tar.Header{}}
+	err := r.receive(tar.NewReader(pipeReader))
+	if r.tmp != "" {
+		os.RemoveAll(r.tmp)
+	}
+	if r.latest != "" {
+		resetErr := d.resetData(toFilesystemId, d.snapshotDataPath(toFilesystemId, r.latest))
+		if err == nil {
+			err = resetErr
+		}
+	}
+	if err != nil && errBuffer != nil {
+		fmt.Fprintf(errBuffer, "cannot receive %s: %s\n", toFilesystemId, err)
+	}
+	return err
+}
+
+// prepareReceive checks that snapshotId, sent relative to base, can be
+// received into filesystemId, as zfs recv would check, creating the
+// filesystem if it's new. first says whether it's the first snapshot in the
+// stream, which has to follow on from the filesystem's latest.
+func (d *directory) prepareReceive(fs, snapshotId, base string, first bool) error {
+	if snapshotId == "" || strings.ContainsAny(snapshotId, "/@") || strings.HasPrefix(snapshotId, ".") {
+		return fmt.Errorf("invalid snapshot id %q", snapshotId)
+	}
+	if _, err := os.Stat(d.snapshotPath(fs, snapshotId)); err == nil {
+		return fmt.Errorf("destination %s@%s already exists", fs, snapshotId)
+	}
+	if !d.exists(fs) {
+		if base != "" && !strings.Contains(base, "@") {
+			return fmt.Errorf("destination %s does not exist, for an incremental stream", fs)
+		}
+		_, err := d.Create(fs)
+		if err != nil {
+			return err
+		}
+		if base != "" {
+			return ioutil.WriteFile(filepath.Join(d.FQ(fs), "origin"), []byte(base), 0600)
+		}
+		return nil
+	}
+	if !first {
+		return nil
+	}
+	// like zfs recv, only receive on top of the latest snapshot
+	existing, err := d.snapshots(fs)
+	if err != nil {
+		return err
+	}
+	latest := ""
+	if len(existing) > 0 {
+		latest = existing[len(existing)-1].Id
+	}
+	if base != latest && !(latest == "" && strings.Contains(base, "@")) {
+		return fmt.Errorf(
+			"destination %s has snapshots up to %q, but the stream starts from %q", fs, latest, base,
+		)
+	}
+	return nil
+}
+
+type directoryReceiver struct {
+	d            *directory
+	filesystemId string
+	// the snapshot being received, and where it's being built
+	snapshot *directoryStreamSnapshot
+	tmp      string
+	// directories received, whose attributes are set once the snapshot is
+	// complete
+	dirs map[string]*tar.Header
+	// the last complete snapshot received
+	latest string
+}
+
+func (r *directoryReceiver) receive(tr *tar.Reader) error {
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return r.finishSnapshot()
+		}
+		if err != nil {
+			return err
+		}
+		switch {
+		case header.Name == directoryStreamHeader:
+			err = r.finishSnapshot()
+			if err != nil {
+				return err
+			}
+			var snapshot directoryStreamSnapshot
+			err = json.NewDecoder(tr).Decode(&snapshot)
+			if err != nil {
+				return err
+			}
+			err = r.startSnapshot(&snapshot)
+		case strings.HasPrefix(header.Name, directoryStreamData) && r.snapshot != nil:
+			err = r.receiveEntry(strings.TrimPrefix(header.Name, directoryStreamData), header, tr)
+		default:
+			err = fmt.Errorf("unexpected %q in stream", header.Name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (r *directoryReceiver) startSnapshot(snapshot *directoryStreamSnapshot) error {
+	d, fs := r.d, r.filesystemId
+	err := d.prepareReceive(fs, snapshot.Id, snapshot.Base, r.latest == "")
+	if err != nil {
+		return err
+	}
+	base, err := d.baseDataPath(fs, snapshot.Base)
+	if err != nil {
+		return err
+	}
+
+	r.snapshot = snapshot
+	r.dirs = map[string]*tar.Header{}
+	r.tmp = d.snapshotPath(fs, "."+snapshot.Id)
+	err = os.RemoveAll(r.tmp)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Join(r.tmp, "data"), 0700)
+	if err != nil {
+		return err
+	}
+	if base != "" {
+		err = linkTree(base, filepath.Join(r.tmp, "data"))
+		if err != nil {
+			return err
+		}
+		info, err := os.Stat(base)
+		if err != nil {
+			return err
+		}
+		err = setAttributes(filepath.Join(r.tmp, "data"), info)
+		if err != nil {
+			return err
+		}
+	}
+	for _, rel := range snapshot.Deleted {
+		path, err := within(filepath.Join(r.tmp, "data"), rel)
+		if err != nil {
+			return err
+		}
+		err = os.RemoveAll(path)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *directoryReceiver) receiveEntry(rel string, header *tar.Header, tr *tar.Reader) error {
+	path, err := within(filepath.Join(r.tmp, "data"), rel)
+	if err != nil {
+		return err
+	}
+	info := header.FileInfo()
+	existing, err := os.Lstat(path)
+	if err == nil && !(info.IsDir() && existing.IsDir()) {
+		// never write into a file, it may be hardlinked to other snapshots
+		err = os.RemoveAll(path)
+		if err != nil {
+			return err
+		}
+	}
+	switch header.Typeflag {
+	case tar.TypeDir:
+		r.dirs[path] = header
+		if existing == nil || !existing.IsDir() {
+			return os.Mkdir(path, 0700)
+		}
+		return nil
+	case tar.TypeSymlink:
+		err = os.Symlink(header.Linkname, path)
+		if err != nil {
+			return err
+		}
+		err = os.Lchown(path, header.Uid, header.Gid)
+		if err != nil && !os.IsPermission(err) {
+			return err
+		}
+		return nil
+	case tar.TypeReg:
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(f, tr)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		err = f.Close()
+		if err != nil {
+			return err
+		}
+		return setHeaderAttributes(path, header)
+	}
+	return fmt.Errorf("unexpected type %q for %q in stream", header.Typeflag, header.Name)
+}
+
+func setHeaderAttributes(path string, header *tar.Header) error {
+	err := os.Lchown(path, header.Uid, header.Gid)
+	if err != nil && !os.IsPermission(err) {
+		return err
+	}
+	err = os.Chmod(path, header.FileInfo().Mode()&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky))
+	if err != nil {
+		return err
+	}
+	return os.Chtimes(path, time.Now(), header.ModTime)
+}
+
+func (r *directoryReceiver) finishSnapshot() error {
+	if r.snapshot == nil {
+		return nil
+	}
+	// deepest first, so setting a directory's times isn't undone by
+	// setting its children's
+	paths := []string{}
+	for path := range r.dirs {
+		paths = append(paths, path)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(paths)))
+	for _, path := range paths {
+		err := setHeaderAttributes(path, r.dirs[path])
+		if err != nil {
+			return err
+		}
+	}
+	err := writeSnapshot(r.tmp, r.snapshot.directorySnapshot)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(r.tmp, r.d.snapshotPath(r.filesystemId, r.snapshot.Id))
+	if err != nil {
+		return err
+	}
+	r.latest = r.snapshot.Id
+	r.snapshot = nil
+	r.tmp = ""
+	return nil
+}
+
+// diffSide lists the files under root for Diff, and when the newest of them
+// was last modified
+func diffSide(root string) (DiffSide, time.Time, error) {
+	ds := DiffSide{}
+	newest := time.Time{}
+	info, err := os.Stat(root)
+	if os.IsNotExist(err) {
+		return ds, newest, nil
+	}
+	if err != nil {
+		return nil, newest, err
+	}
+	newest = info.ModTime()
+	err = walkTree(root, func(rel string, info os.FileInfo) error {
+		ds[rel] = DiffResult{
+			mtime: strconv.FormatInt(info.ModTime().UnixNano(), 10),
+			size:  strconv.FormatInt(info.Size(), 10),
+		}
+		if info.ModTime().After(newest) {
+			newest = info.ModTime()
+		}
+		return nil
+	})
+	return ds, newest, err
+}
+
+// Diff lists what's changed in the default subdot of a filesystem since its
+// latest snapshot
+func (d *directory) Diff(filesystemID string) ([]types.ZFSFileDiff, error) {
+	snapshots, err := d.snapshots(filesystemID)
+	if err != nil {
+		log.WithError(err).Error("[diff] error listing snapshots to find latest snap")
+		return nil, err
+	}
+	if len(snapshots) == 0 {
+		return nil, fmt.Errorf("cannot diff against a filesystem with no snapshots")
+	}
+	latest := snapshots[len(snapshots)-1].Id
+
+	mapLatest, _, err := diffSide(filepath.Join(d.snapshotDataPath(filesystemID, latest), "__default__"))
+	if err != nil {
+		log.WithError(err).Error("[diff] getting latest files")
+		return nil, err
+	}
+	mapCurrent, newest, err := diffSide(filepath.Join(d.dataPath(filesystemID), "__default__"))
+	if err != nil {
+		log.WithError(err).Error("[diff] getting current files")
+		return nil, err
+	}
+
+	d.lastModifiedMu.Lock()
+	d.lastModified[filesystemID] = newest.UTC()
+	d.lastModifiedMu.Unlock()
+
+	return diffSides(mapLatest, mapCurrent), nil
+}
+
+// LastModified is when the newest file in the default subdot seen by the
+// last Diff was modified
+func (d *directory) LastModified(filesystemID string) (*types.LastModified, error) {
+	d.lastModifiedMu.Lock()
+	defer d.lastModifiedMu.Unlock()
+	t, ok := d.lastModified[filesystemID]
+	if !ok {
+		return nil, fmt.Errorf("filesystem %s hasn't been diffed", filesystemID)
+	}
+	return &types.LastModified{Time: t}, nil
+}
+
+// DestroyTmpSnapIfExists has nothing to do, as Diff doesn't need a
+// temporary snapshot here
+func (d *directory) DestroyTmpSnapIfExists(filesystemID string) error {
+	return nil
+}
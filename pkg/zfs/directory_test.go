@@ -0,0 +1,488 @@
+package zfs
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+
+	"github.com/dotmesh-oss/dotmesh/pkg/types"
+	"github.com/dotmesh-oss/dotmesh/pkg/utils"
+)
+
+func newTestDirectory(t *testing.T) (*directory, func()) {
+	root, err := ioutil.TempDir("", "dotmesh-directory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	restore := setEnv("MOUNT_PREFIX", filepath.Join(root, "mnt"))
+	z, err := NewDirectory(filepath.Join(root, "pool"), "pool")
+	if err != nil {
+		t.Fatalf("Error creating directory backend: %s", err)
+	}
+	return z.(*directory), func() {
+		restore()
+		os.RemoveAll(root)
+	}
+}
+
+// setEnv sets an environment variable, returning a function that puts it
+// back how it was
+func setEnv(key, value string) func() {
+	previous, set := os.LookupEnv(key)
+	os.Setenv(key, value)
+	return func() {
+		if set {
+			os.Setenv(key, previous)
+		} else {
+			os.Unsetenv(key)
+		}
+	}
+}
+
+func writeTestFile(t *testing.T, path, contents string) {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(path, []byte(contents), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func mustSnapshot(t *testing.T, z ZFS, fs, snap string, meta map[string]string) {
+	args, err := utils.EncodeMetadata(meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = z.Snapshot(fs, snap, args)
+	if err != nil {
+		t.Fatalf("Error snapshotting %s@%s: %s", fs, snap, err)
+	}
+}
+
+// readTree maps the paths of the files and symlinks under root to their
+// contents or targets
+func readTree(t *testing.T, root string) map[string]string {
+	tree := map[string]string{}
+	err := walkTree(root, func(rel string, info os.FileInfo) error {
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(filepath.Join(root, rel))
+			tree[rel] = "-> " + link
+			return err
+		case info.Mode().IsRegular():
+			data, err := ioutil.ReadFile(filepath.Join(root, rel))
+			tree[rel] = string(data)
+			return err
+		}
+		tree[rel+"/"] = ""
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tree
+}
+
+func sameFile(t *testing.T, a, b string) bool {
+	aInfo, err := os.Stat(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bInfo, err := os.Stat(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return os.SameFile(aInfo, bInfo)
+}
+
+func TestDirectorySnapshots(t *testing.T) {
+	z, cleanup := newTestDirectory(t)
+	defer cleanup()
+
+	_, err := z.Create("fs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, filepath.Join(z.dataPath("fs"), "__default__", "same.txt"), "same")
+	writeTestFile(t, filepath.Join(z.dataPath("fs"), "__default__", "changed.txt"), "before")
+	mustSnapshot(t, z, "fs", "first", map[string]string{"message": "first", "empty": ""})
+
+	writeTestFile(t, filepath.Join(z.dataPath("fs"), "__default__", "changed.txt"), "after!")
+	dirty, total, err := z.GetDirtyDelta("fs", "first")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dirty != 6 || total != 10 {
+		t.Errorf("expected 6 of 10 bytes dirty, got %d of %d", dirty, total)
+	}
+	mustSnapshot(t, z, "fs", "second", map[string]string{"message": "second"})
+
+	if !sameFile(t,
+		filepath.Join(z.snapshotDataPath("fs", "first"), "__default__", "same.txt"),
+		filepath.Join(z.snapshotDataPath("fs", "second"), "__default__", "same.txt"),
+	) {
+		t.Errorf("expected the unchanged file to be shared between snapshots")
+	}
+	if sameFile(t,
+		filepath.Join(z.dataPath("fs"), "__default__", "same.txt"),
+		filepath.Join(z.snapshotDataPath("fs", "second"), "__default__", "same.txt"),
+	) {
+		t.Errorf("expected the working copy not to share files with snapshots")
+	}
+
+	filesystem, err := z.DiscoverSystem("fs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []*types.Snapshot{
+		{Id: "first", Metadata: map[string]string{"message": "first", "empty": ""}},
+		{Id: "second", Metadata: map[string]string{"message": "second"}},
+	}
+	if !filesystem.Exists || !reflect.DeepEqual(filesystem.Snapshots, expected) {
+		t.Errorf("expected snapshots %+v, got %+v", expected, filesystem.Snapshots)
+	}
+
+	os.Remove(filepath.Join(z.dataPath("fs"), "__default__", "same.txt"))
+	writeTestFile(t, filepath.Join(z.dataPath("fs"), "__default__", "new.txt"), "new")
+	writeTestFile(t, filepath.Join(z.dataPath("fs"), "__default__", "changed.txt"), "again!!")
+	changes, err := z.Diff("fs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedChanges := []types.ZFSFileDiff{
+		{Change: types.FileChangeModified, Filename: "changed.txt"},
+		{Change: types.FileChangeAdded, Filename: "new.txt"},
+		{Change: types.FileChangeRemoved, Filename: "same.txt"},
+	}
+	if !reflect.DeepEqual(changes, expectedChanges) {
+		t.Errorf("expected changes %+v, got %+v", expectedChanges, changes)
+	}
+	if _, err := z.LastModified("fs"); err != nil {
+		t.Errorf("expected a last modified time after diffing: %s", err)
+	}
+
+	_, err = z.Rollback("fs", "first")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree := readTree(t, z.dataPath("fs"))
+	expectedTree := map[string]string{
+		"__default__/":            "",
+		"__default__/same.txt":    "same",
+		"__default__/changed.txt": "before",
+	}
+	if !reflect.DeepEqual(tree, expectedTree) {
+		t.Errorf("expected %v after rolling back, got %v", expectedTree, tree)
+	}
+	filesystem, err = z.DiscoverSystem("fs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(filesystem.Snapshots) != 1 {
+		t.Errorf("expected rolling back to remove the later snapshot, got %+v", filesystem.Snapshots)
+	}
+}
+
+func TestDirectorySnapshotRewrittenKeepingTimes(t *testing.T) {
+	z, cleanup := newTestDirectory(t)
+	defer cleanup()
+
+	_, err := z.Create("fs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(z.dataPath("fs"), "__default__", "file.txt")
+	writeTestFile(t, path, "before")
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustSnapshot(t, z, "fs", "first", map[string]string{})
+
+	// as cp -p would
+	writeTestFile(t, path, "after!")
+	err = os.Chtimes(path, info.ModTime(), info.ModTime())
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustSnapshot(t, z, "fs", "second", map[string]string{})
+
+	tree := readTree(t, z.snapshotDataPath("fs", "second"))
+	if tree["__default__/file.txt"] != "after!" {
+		t.Errorf("expected the rewritten file in the snapshot, got %q", tree["__default__/file.txt"])
+	}
+	tree = readTree(t, z.snapshotDataPath("fs", "first"))
+	if tree["__default__/file.txt"] != "before" {
+		t.Errorf("expected the earlier snapshot to keep the old file, got %q", tree["__default__/file.txt"])
+	}
+}
+
+// transfer sends from one backend to another, through the prelude framing
+// pushes and pulls use
+func transfer(t *testing.T, from, to ZFS, fromSnap, fs, toSnap string) {
+	prelude := append([]byte("prelude"), types.EndDotmeshPrelude...)
+	reader, errch := from.Send(context.Background(), fs, fromSnap, fs, toSnap, prelude)
+	got := make([]byte, len(prelude))
+	_, err := io.ReadFull(reader, got)
+	if err != nil || !bytes.Equal(got, prelude) {
+		t.Fatalf("expected the stream to start with the prelude, got %q: %v", got, err)
+	}
+	errBuffer := bytes.Buffer{}
+	err = to.Recv(context.Background(), reader, fs, &errBuffer)
+	if err != nil {
+		t.Fatalf("Error receiving %s from %q to %s: %s %s", fs, fromSnap, toSnap, err, errBuffer.String())
+	}
+	err = <-errch
+	if err != nil {
+		t.Fatalf("Error sending %s from %q to %s: %s", fs, fromSnap, toSnap, err)
+	}
+}
+
+func TestDirectorySendRecv(t *testing.T) {
+	src, cleanupSrc := newTestDirectory(t)
+	defer cleanupSrc()
+	dst, cleanupDst := newTestDirectory(t)
+	defer cleanupDst()
+
+	_, err := src.Create("fs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, filepath.Join(src.dataPath("fs"), "__default__", "kept.txt"), "kept")
+	writeTestFile(t, filepath.Join(src.dataPath("fs"), "__default__", "gone", "deleted.txt"), "deleted")
+	mustSnapshot(t, src, "fs", "first", map[string]string{"message": "first"})
+
+	os.RemoveAll(filepath.Join(src.dataPath("fs"), "__default__", "gone"))
+	writeTestFile(t, filepath.Join(src.dataPath("fs"), "__default__", "sub", "added.txt"), "added")
+	err = os.Symlink("sub/added.txt", filepath.Join(src.dataPath("fs"), "__default__", "link"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustSnapshot(t, src, "fs", "second", map[string]string{"message": "second"})
+
+	size, err := src.PredictSize("fs", "first", "fs", "second")
+	if err != nil || size == 0 {
+		t.Errorf("expected a size for the incremental send, got %d: %v", size, err)
+	}
+
+	transfer(t, src, dst, "", "fs", "first")
+	transfer(t, src, dst, "first", "fs", "second")
+
+	for _, snap := range []string{"first", "second"} {
+		expected := readTree(t, src.snapshotDataPath("fs", snap))
+		got := readTree(t, dst.snapshotDataPath("fs", snap))
+		if !reflect.DeepEqual(expected, got) {
+			t.Errorf("expected snapshot %s to be received as %v, got %v", snap, expected, got)
+		}
+	}
+	if !reflect.DeepEqual(readTree(t, src.snapshotDataPath("fs", "second")), readTree(t, dst.dataPath("fs"))) {
+		t.Errorf("expected the working copy to be the latest snapshot received")
+	}
+	if !sameFile(t,
+		filepath.Join(dst.snapshotDataPath("fs", "first"), "__default__", "kept.txt"),
+		filepath.Join(dst.snapshotDataPath("fs", "second"), "__default__", "kept.txt"),
+	) {
+		t.Errorf("expected received snapshots to share unchanged files")
+	}
+	filesystem, err := dst.DiscoverSystem("fs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(filesystem.Snapshots) != 2 || filesystem.Snapshots[1].Metadata["message"] != "second" {
+		t.Errorf("expected both snapshots with their metadata, got %+v", filesystem.Snapshots)
+	}
+
+	// a clone is sent relative to its origin
+	_, err = src.Clone("fs", "first", "branch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, filepath.Join(src.dataPath("branch"), "__default__", "branch.txt"), "branch")
+	mustSnapshot(t, src, "branch", "third", map[string]string{})
+	transfer(t, src, dst, "fs@first", "branch", "third")
+
+	expected := readTree(t, src.snapshotDataPath("branch", "third"))
+	got := readTree(t, dst.snapshotDataPath("branch", "third"))
+	if !reflect.DeepEqual(expected, got) {
+		t.Errorf("expected the clone to be received as %v, got %v", expected, got)
+	}
+
+	// receiving what's already there fails, as zfs recv would
+	prelude := append([]byte{}, types.EndDotmeshPrelude...)
+	reader, errch := src.Send(context.Background(), "fs", "", "fs", "second", prelude)
+	io.ReadFull(reader, make([]byte, len(prelude)))
+	err = dst.Recv(context.Background(), reader, "fs", nil)
+	reader.Close()
+	<-errch
+	if err == nil {
+		t.Errorf("expected receiving a full stream on top of existing snapshots to fail")
+	}
+}
+
+func TestDirectoryStashBranch(t *testing.T) {
+	z, cleanup := newTestDirectory(t)
+	defer cleanup()
+
+	_, err := z.Create("fs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, filepath.Join(z.dataPath("fs"), "__default__", "file.txt"), "one")
+	mustSnapshot(t, z, "fs", "first", map[string]string{})
+	writeTestFile(t, filepath.Join(z.dataPath("fs"), "__default__", "file.txt"), "two")
+	mustSnapshot(t, z, "fs", "second", map[string]string{})
+
+	err = z.StashBranch("fs", "stash", "first")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for fs, expected := range map[string]string{"fs": "first", "stash": "second"} {
+		filesystem, err := z.DiscoverSystem(fs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(filesystem.Snapshots) != 1 || filesystem.Snapshots[0].Id != expected {
+			t.Errorf("expected %s to have just %s, got %+v", fs, expected, filesystem.Snapshots)
+		}
+	}
+	data, err := ioutil.ReadFile(filepath.Join(z.dataPath("fs"), "__default__", "file.txt"))
+	if err != nil || string(data) != "one" {
+		t.Errorf("expected fs to be rolled back, got %q: %v", data, err)
+	}
+	data, err = ioutil.ReadFile(filepath.Join(z.dataPath("stash"), "__default__", "file.txt"))
+	if err != nil || string(data) != "two" {
+		t.Errorf("expected the stash to keep the diverged data, got %q: %v", data, err)
+	}
+}
+
+func TestDirectoryRegistryProperties(t *testing.T) {
+	z, cleanup := newTestDirectory(t)
+	defer cleanup()
+
+	_, err := z.Create("fs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	properties, err := z.GetRegistryProperties("fs")
+	if err != nil || properties != nil {
+		t.Errorf("expected no registry properties to start with, got %+v: %v", properties, err)
+	}
+
+	expected := types.RegistryProperties{Clone: &types.Clone{
+		TopLevelFilesystemId: "top",
+		FilesystemId:         "fs",
+		Name:                 "branch",
+		Origin:               types.Origin{FilesystemId: "top", SnapshotId: "snap"},
+	}}
+	err = z.SetRegistryProperties("fs", expected)
+	if err != nil {
+		t.Fatal(err)
+	}
+	properties, err = z.GetRegistryProperties("fs")
+	if err != nil || properties == nil || !reflect.DeepEqual(*properties, expected) {
+		t.Errorf("expected %+v, got %+v: %v", expected, properties, err)
+	}
+
+	err = z.SetRegistryProperties("missing", expected)
+	if err == nil {
+		t.Errorf("expected setting registry properties of a missing filesystem to fail")
+	}
+}
+
+func TestDirectoryMount(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("bind mounts need root")
+	}
+	// unmounting goes through nsenter, as it does for zfs
+	if exec.Command("nsenter", "-t", "1", "-a", "true").Run() != nil {
+		t.Skip("can't enter other mount namespaces")
+	}
+	z, cleanup := newTestDirectory(t)
+	defer cleanup()
+	defer func() {
+		syscall.Unmount(utils.Mnt("fs@snap"), 0)
+		syscall.Unmount(utils.Mnt("fs"), 0)
+	}()
+
+	_, err := z.Create("fs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, filepath.Join(z.dataPath("fs"), "file.txt"), "contents")
+	mustSnapshot(t, z, "fs", "snap", map[string]string{})
+
+	for _, snap := range []string{"", "snap"} {
+		fullId := FullIdWithSnapshot("fs", snap)
+		output, err := z.Mount("fs", snap, "noatime,ro", utils.Mnt(fullId))
+		if err != nil {
+			t.Fatalf("Error mounting %s: %s %s", fullId, err, output)
+		}
+		mounted, err := utils.IsFilesystemMounted(fullId)
+		if err != nil || !mounted {
+			t.Errorf("expected %s to be mounted: %v", fullId, err)
+		}
+		data, err := ioutil.ReadFile(filepath.Join(utils.Mnt(fullId), "file.txt"))
+		if err != nil || string(data) != "contents" {
+			t.Errorf("expected to read the file through the mount of %s, got %q: %v", fullId, data, err)
+		}
+		if ioutil.WriteFile(filepath.Join(utils.Mnt(fullId), "file.txt"), []byte("x"), 0644) == nil {
+			t.Errorf("expected %s to be mounted read-only", fullId)
+		}
+	}
+	// rolling back unmounts everything first
+	_, err = z.Rollback("fs", "snap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mounted, _ := utils.IsFilesystemMounted("fs"); mounted {
+		t.Errorf("expected rolling back to unmount the working copy")
+	}
+}
+
+func TestMountPrivately(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("bind mounts need root")
+	}
+	z, cleanup := newTestDirectory(t)
+	defer cleanup()
+
+	_, err := z.Create("fs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, filepath.Join(z.dataPath("fs"), "file.txt"), "contents")
+	mustSnapshot(t, z, "fs", "snap", map[string]string{})
+
+	mountPath, unmount, err := MountPrivately(z, "fs", "snap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Unmount(mountPath, 0)
+	if mountPath == utils.Mnt("fs@snap") {
+		t.Errorf("expected a mount of its own, got the state machine's %s", mountPath)
+	}
+	if mounted, _ := utils.IsFilesystemMounted("fs@snap"); mounted {
+		t.Errorf("expected the state machine's mount point to be left alone")
+	}
+	data, err := ioutil.ReadFile(filepath.Join(mountPath, "file.txt"))
+	if err != nil || string(data) != "contents" {
+		t.Errorf("expected to read the file through %s, got %q: %v", mountPath, data, err)
+	}
+
+	err = unmount()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(mountPath); !os.IsNotExist(err) {
+		t.Errorf("expected %s to be removed once unmounted: %v", mountPath, err)
+	}
+}
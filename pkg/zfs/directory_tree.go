@@ -0,0 +1,326 @@
+package zfs
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// FICLONE is the ioctl that makes a reflink copy of a file, sharing its
+// blocks until either copy is written to, on filesystems that can (btrfs,
+// xfs)
+const FICLONE = 0x40049409
+
+// walkTree calls fn for everything under root, parents before their
+// children, with paths relative to root. root itself isn't included.
+func walkTree(root string, fn func(rel string, info os.FileInfo) error) error {
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == root {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		return fn(rel, info)
+	})
+}
+
+// buildTree makes dst, which must exist, a copy of the tree at src. Each
+// file is made by makeFile; symlinks are recreated and directories made
+// afresh, with their permissions, owners and times copied over once
+// everything in them is there. Anything else (devices, sockets, pipes) is
+// left out.
+func buildTree(src, dst string, makeFile func(rel string, info os.FileInfo) error) error {
+	dirs := []string{}
+	err := walkTree(src, func(rel string, info os.FileInfo) error {
+		target := filepath.Join(dst, rel)
+		switch {
+		case info.IsDir():
+			dirs = append(dirs, rel)
+			return os.Mkdir(target, 0700)
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(filepath.Join(src, rel))
+			if err != nil {
+				return err
+			}
+			err = os.Symlink(link, target)
+			if err != nil {
+				return err
+			}
+			return setOwner(target, info)
+		case info.Mode().IsRegular():
+			return makeFile(rel, info)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// deepest first, so setting a directory's times isn't undone by
+	// setting its children's
+	for i := len(dirs) - 1; i >= 0; i-- {
+		info, err := os.Lstat(filepath.Join(src, dirs[i]))
+		if err != nil {
+			return err
+		}
+		err = setAttributes(filepath.Join(dst, dirs[i]), info)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyTree copies the tree at src into dst, which must exist, as files that
+// can be changed without changing src
+func copyTree(src, dst string) error {
+	return buildTree(src, dst, func(rel string, info os.FileInfo) error {
+		return copyFile(filepath.Join(src, rel), filepath.Join(dst, rel), info)
+	})
+}
+
+// linkTree copies the tree at src into dst, which must exist, hardlinking
+// its files. Neither copy's files may change afterwards, so it's only for
+// snapshots.
+func linkTree(src, dst string) error {
+	return buildTree(src, dst, func(rel string, info os.FileInfo) error {
+		return os.Link(filepath.Join(src, rel), filepath.Join(dst, rel))
+	})
+}
+
+// snapshotTree copies the tree at src into dst, which must exist, for a
+// snapshot. Files that are the same as in the previous snapshot prev ("" if
+// there isn't one) are hardlinked to it, so that only what's changed takes
+// up more space. Looking the same isn't enough for that, as cp -p, rsync -t
+// and tar all rewrite files keeping their modification times, so their
+// contents are compared too.
+func snapshotTree(src, prev, dst string) error {
+	return buildTree(src, dst, func(rel string, info os.FileInfo) error {
+		if prev != "" {
+			prevInfo, err := os.Lstat(filepath.Join(prev, rel))
+			if err == nil && unchanged(prevInfo, info) {
+				same, err := sameContents(filepath.Join(prev, rel), filepath.Join(src, rel))
+				if err != nil {
+					return err
+				}
+				if same {
+					return os.Link(filepath.Join(prev, rel), filepath.Join(dst, rel))
+				}
+			}
+		}
+		return copyFile(filepath.Join(src, rel), filepath.Join(dst, rel), info)
+	})
+}
+
+// unchanged says whether two regular files look the same, as rsync would
+// decide it: same size, modification time, permissions and owner. Their
+// contents can still differ.
+func unchanged(a, b os.FileInfo) bool {
+	if !a.Mode().IsRegular() || !b.Mode().IsRegular() {
+		return false
+	}
+	aUid, aGid := owner(a)
+	bUid, bGid := owner(b)
+	return a.Size() == b.Size() && a.ModTime().Equal(b.ModTime()) &&
+		a.Mode() == b.Mode() && aUid == bUid && aGid == bGid
+}
+
+// sameContents says whether the files at a and b hold the same bytes
+func sameContents(a, b string) (bool, error) {
+	aFile, err := os.Open(a)
+	if err != nil {
+		return false, err
+	}
+	defer aFile.Close()
+	bFile, err := os.Open(b)
+	if err != nil {
+		return false, err
+	}
+	defer bFile.Close()
+
+	aBuf := make([]byte, 64*1024)
+	bBuf := make([]byte, 64*1024)
+	for {
+		aN, aErr := io.ReadFull(aFile, aBuf)
+		bN, bErr := io.ReadFull(bFile, bBuf)
+		if !bytes.Equal(aBuf[:aN], bBuf[:bN]) {
+			return false, nil
+		}
+		aDone := aErr == io.EOF || aErr == io.ErrUnexpectedEOF
+		bDone := bErr == io.EOF || bErr == io.ErrUnexpectedEOF
+		if aErr != nil && !aDone {
+			return false, aErr
+		}
+		if bErr != nil && !bDone {
+			return false, bErr
+		}
+		if aDone || bDone {
+			return aDone && bDone, nil
+		}
+	}
+}
+
+// clearDir removes everything in dir, leaving it empty
+func clearDir(dir string) error {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		err = os.RemoveAll(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyFile copies the regular file src to dst, which mustn't exist, as a
+// reflink if the filesystem can, and otherwise byte by byte
+func copyFile(src, dst string, info os.FileInfo) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	err = unix.IoctlSetInt(int(out.Fd()), FICLONE, int(in.Fd()))
+	if err != nil {
+		_, err = io.Copy(out, in)
+	}
+	if err != nil {
+		out.Close()
+		return err
+	}
+	err = out.Close()
+	if err != nil {
+		return err
+	}
+	return setAttributes(dst, info)
+}
+
+// setAttributes gives path the permissions, owner and modification time in
+// info
+func setAttributes(path string, info os.FileInfo) error {
+	err := setOwner(path, info)
+	if err != nil {
+		return err
+	}
+	err = os.Chmod(path, info.Mode()&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky))
+	if err != nil {
+		return err
+	}
+	return os.Chtimes(path, time.Now(), info.ModTime())
+}
+
+// setOwner gives path the owner in info, if we're allowed to: only root can
+// give files away
+func setOwner(path string, info os.FileInfo) error {
+	uid, gid := owner(info)
+	err := os.Lchown(path, uid, gid)
+	if err != nil && !os.IsPermission(err) {
+		return err
+	}
+	return nil
+}
+
+func owner(info os.FileInfo) (int, int) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return os.Getuid(), os.Getgid()
+	}
+	return int(stat.Uid), int(stat.Gid)
+}
+
+// treeSize is the total size of the regular files under root
+func treeSize(root string) (int64, error) {
+	var size int64
+	err := walkTree(root, func(rel string, info os.FileInfo) error {
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+// within joins rel onto root, refusing paths that would end up outside it
+func within(root, rel string) (string, error) {
+	cleaned := filepath.Clean("/" + rel)
+	if cleaned == "/" || strings.Contains(rel, "\x00") {
+		return "", fmt.Errorf("invalid path %q", rel)
+	}
+	return filepath.Join(root, cleaned), nil
+}
+
+// directoryTrees makes and removes the trees that a directory backend keeps
+// working copies and snapshots in
+type directoryTrees interface {
+	// create makes an empty working copy at path
+	create(path string) error
+	// snapshot makes an unchanging copy at dst of the tree src, whose
+	// previous snapshot, if it has one, is prev
+	snapshot(src, prev, dst string) error
+	// clone makes a working copy at dst of the snapshot src
+	clone(src, dst string) error
+	// remove removes a working copy or snapshot, if it's there
+	remove(path string) error
+}
+
+// plainTrees keeps working copies and snapshots as ordinary directories
+type plainTrees struct{}
+
+func (plainTrees) create(path string) error {
+	return os.Mkdir(path, 0755)
+}
+
+func (plainTrees) snapshot(src, prev, dst string) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	err = os.Mkdir(dst, 0700)
+	if err != nil {
+		return err
+	}
+	err = snapshotTree(src, prev, dst)
+	if err != nil {
+		return err
+	}
+	return setAttributes(dst, info)
+}
+
+func (plainTrees) clone(src, dst string) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	err = os.Mkdir(dst, 0700)
+	if err != nil {
+		return err
+	}
+	err = copyTree(src, dst)
+	if err != nil {
+		return err
+	}
+	return setAttributes(dst, info)
+}
+
+func (plainTrees) remove(path string) error {
+	return os.RemoveAll(path)
+}
@@ -27,7 +27,9 @@ func FullIdWithSnapshot(filesystemId, snapshotId string) string {
 	return filesystemId
 }
 
-func filterMountpoints(mountPrefix string, filesystem string, r *bufio.Reader) ([]string, error) {
+// filterMountpoints picks the mounts of filesystem, and its snapshots, out of
+// mountinfo read from r. An empty fsType matches mounts of any type.
+func filterMountpoints(fsType, mountPrefix, filesystem string, r *bufio.Reader) ([]string, error) {
 
 	mountPrefix = filepath.Join(mountPrefix, "dmfs", filesystem)
 
@@ -37,10 +39,20 @@ func filterMountpoints(mountPrefix string, filesystem string, r *bufio.Reader) (
 
 		if line != "" {
 			parts := strings.Split(line, " ")
-			if len(parts) >= 11 {
-				fsType := parts[8]
+			// the optional fields before the "-" separator come and go (a
+			// mount only has "shared:N" if it's in a peer group), so the
+			// type is found after the separator
+			separator := -1
+			for i := 6; i < len(parts); i++ {
+				if parts[i] == "-" {
+					separator = i
+					break
+				}
+			}
+			if separator != -1 && separator+1 < len(parts) {
+				mountType := parts[separator+1]
 				mountpoint := parts[4]
-				if fsType == "zfs" && strings.HasPrefix(mountpoint, mountPrefix) {
+				if (fsType == "" || mountType == fsType) && strings.HasPrefix(mountpoint, mountPrefix) {
 					mountpoints = append(mountpoints, mountpoint)
 				}
 			}
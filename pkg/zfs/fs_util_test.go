@@ -45,7 +45,7 @@ func TestMountpointFilter(t *testing.T) {
 
 	reader := bufio.NewReader(buf)
 
-	filtered, err := filterMountpoints("/var/lib/dotmesh/mnt", "8709de2a-f4c0-4d38-9241-61ca16c6764f", reader)
+	filtered, err := filterMountpoints("zfs", "/var/lib/dotmesh/mnt", "8709de2a-f4c0-4d38-9241-61ca16c6764f", reader)
 	if err != nil {
 		t.Errorf("failed to filter: %s", err)
 	}
@@ -76,7 +76,7 @@ func TestMountpointFilterWithSnapshots(t *testing.T) {
 
 	reader := bufio.NewReader(buf)
 
-	filtered, err := filterMountpoints("/var/lib/dotmesh/mnt", "5887919c-c980-4d5f-983d-edd0f0d76be3", reader)
+	filtered, err := filterMountpoints("zfs", "/var/lib/dotmesh/mnt", "5887919c-c980-4d5f-983d-edd0f0d76be3", reader)
 	if err != nil {
 		t.Errorf("failed to filter: %s", err)
 	}
@@ -91,3 +91,27 @@ func TestMountpointFilterWithSnapshots(t *testing.T) {
 	}
 	t.Log(filtered)
 }
+
+// bind mounts, as the directory backend makes, of any type and without the
+// optional shared:N field
+var procMountInfoTestDataBindMounts = `43 28 254:0 /var/lib/dotmesh/dotmesh_directory/dmfs/0a5bb16f/data /var/lib/dotmesh/mnt/dmfs/0a5bb16f rw,noatime - ext4 /dev/vda rw,discard
+44 28 254:0 /var/lib/dotmesh/dotmesh_directory/dmfs/0a5bb16f/snapshots/1461c8df/data /var/lib/dotmesh/mnt/dmfs/0a5bb16f@1461c8df ro,noatime - ext4 /dev/vda rw,discard
+45 28 0:48 / /var/lib/dotmesh/mnt/dmfs/8709de2a rw,noatime shared:12 - xfs /dev/vdb rw`
+
+func TestMountpointFilterAnyType(t *testing.T) {
+	buf := bytes.NewBufferString(procMountInfoTestDataBindMounts)
+
+	reader := bufio.NewReader(buf)
+
+	filtered, err := filterMountpoints("", "/var/lib/dotmesh/mnt", "0a5bb16f", reader)
+	if err != nil {
+		t.Errorf("failed to filter: %s", err)
+	}
+	if len(filtered) != 2 {
+		t.Fatalf("expected 2 entries, got: %d", len(filtered))
+	}
+	if filtered[0] != "/var/lib/dotmesh/mnt/dmfs/0a5bb16f@1461c8df" {
+		t.Errorf("expected the snapshot first, got: %s", filtered[0])
+	}
+	t.Log(filtered)
+}
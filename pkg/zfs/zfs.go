@@ -15,6 +15,7 @@ import (
 	"time"
 
 	"encoding/base64"
+	"encoding/json"
 	"io"
 	"os"
 
@@ -30,6 +31,10 @@ import (
 type ZFS interface {
 	GetPoolID() string
 	GetZPoolCapacity() (float64, error)
+	// ScrubStatus is what zpool status says about the pool's latest scrub,
+	// e.g. "scrub repaired 0B in 0 days 00:00:01 with 0 errors on ...", or
+	// "none requested" if it's never been scrubbed
+	ScrubStatus() (string, error)
 	ReportZpoolCapacity() error
 	FindFilesystemIdsOnSystem() []string
 	DeleteFilesystemInZFS(fs string) error
@@ -41,6 +46,8 @@ type ZFS interface {
 	//    implementation detail.
 	GetDirtyDelta(filesystemId, latestSnap string) (dirtyBytes int64, usedBytes int64, err error)
 	Snapshot(filesystemId, snapshotId string, meta []string) ([]byte, error)
+	// DestroySnapshot removes one snapshot, which must be unmounted first
+	DestroySnapshot(filesystemId, snapshotId string) ([]byte, error)
 	List(filesystemId, snapshotId string) ([]byte, error)
 	FQ(filesystemId string) string
 	DiscoverSystem(fs string) (*types.Filesystem, error)
@@ -49,9 +56,19 @@ type ZFS interface {
 	Clone(filesystemId, originSnapshotId, newCloneFilesystemId string) ([]byte, error)
 	Rollback(filesystemId, snapshotId string) ([]byte, error)
 	Create(filesystemId string) ([]byte, error)
-	Recv(pipeReader *io.PipeReader, toFilesystemId string, errBuffer *bytes.Buffer) error
+	// CreateEncrypted creates a filesystem with native encryption, keyed with
+	// key, 64 hex digits
+	CreateEncrypted(filesystemId, key string) ([]byte, error)
+	// LoadKey loads the key of an encrypted filesystem, so that it can be
+	// mounted
+	LoadKey(filesystemId, key string) ([]byte, error)
+	// KeyStatus is "available" or "unavailable" for an encrypted filesystem,
+	// depending on whether its key is loaded, and "" for one that isn't
+	// encrypted
+	KeyStatus(filesystemId string) (string, error)
+	Recv(ctx context.Context, pipeReader *io.PipeReader, toFilesystemId string, errBuffer *bytes.Buffer) error
 	ApplyPrelude(prelude types.Prelude, fs string) error
-	Send(fromFilesystemId, fromSnapshotId, toFilesystemId, toSnapshotId string, preludeEncoded []byte) (*io.PipeReader, chan error)
+	Send(ctx context.Context, fromFilesystemId, fromSnapshotId, toFilesystemId, toSnapshotId string, preludeEncoded []byte) (*io.PipeReader, chan error)
 	SetCanmount(filesystemId, snapshotId string) ([]byte, error)
 	Mount(filesystemId, snapshotId string, options string, mountPath string) ([]byte, error)
 	Fork(filesystemId, latestSnapshot, forkFilesystemId string) error
@@ -59,12 +76,86 @@ type ZFS interface {
 	// LastModified returns last modified temp snapshot, must be called after Diff
 	LastModified(filesystemID string) (*types.LastModified, error)
 	DestroyTmpSnapIfExists(filesystemId string) error
+	// SetRegistryProperties keeps what the registry says about a filesystem
+	// with it, so that the registry can be rebuilt from the pool
+	SetRegistryProperties(filesystemId string, properties types.RegistryProperties) error
+	// GetRegistryProperties returns what SetRegistryProperties kept, or nil
+	// if nothing was
+	GetRegistryProperties(filesystemId string) (*types.RegistryProperties, error)
 }
 
 var _ ZFS = &zfs{}
 
 const dotmeshDiffSnapshotName = "dotmesh-fastdiff"
 
+// EncryptionAlgorithm is what encrypted dots are encrypted with
+const EncryptionAlgorithm = "aes-256-gcm"
+
+const encryptionKeyHexDigits = 64
+
+// NormalizeEncryptionKey checks that key is an encryption key as ZFS expects
+// it, 64 hex digits, and returns it trimmed and in lower case
+func NormalizeEncryptionKey(key string) (string, error) {
+	key = strings.ToLower(strings.TrimSpace(key))
+	if len(key) != encryptionKeyHexDigits {
+		return "", fmt.Errorf("encryption keys must be %d hex digits, got %d characters", encryptionKeyHexDigits, len(key))
+	}
+	for _, c := range key {
+		if !strings.ContainsRune("0123456789abcdef", c) {
+			return "", fmt.Errorf("encryption keys must be %d hex digits, got %q", encryptionKeyHexDigits, c)
+		}
+	}
+	return key, nil
+}
+
+// EnsureKeyLoaded loads the key of filesystemId, from key, if it's encrypted
+// and the key isn't loaded already. It returns the filesystem's key status.
+func EnsureKeyLoaded(z ZFS, filesystemId string, key func() (string, error)) (string, error) {
+	status, err := z.KeyStatus(filesystemId)
+	if err != nil || status != "unavailable" {
+		return status, err
+	}
+	k, err := key()
+	if err != nil {
+		return status, err
+	}
+	out, err := z.LoadKey(filesystemId, k)
+	if err != nil {
+		return status, fmt.Errorf("failed to load the key of %s: %s %s", filesystemId, err, string(out))
+	}
+	return z.KeyStatus(filesystemId)
+}
+
+// MountPrivately mounts a snapshot read-only at a directory of its own, next
+// to where the filesystem's state machine would mount it, so that it can be
+// read without racing the state machine's mounts and unmounts. Call unmount
+// once done with it.
+func MountPrivately(z ZFS, filesystemId, snapshotId string) (mountPath string, unmount func() error, err error) {
+	fullId := FullIdWithSnapshot(filesystemId, snapshotId)
+	parent := filepath.Dir(utils.Mnt(fullId))
+	err = os.MkdirAll(parent, 0777)
+	if err != nil {
+		return "", nil, err
+	}
+	mountPath, err = ioutil.TempDir(parent, fullId+".private-")
+	if err != nil {
+		return "", nil, err
+	}
+	out, err := z.Mount(filesystemId, snapshotId, "noatime,ro", mountPath)
+	if err != nil {
+		os.Remove(mountPath)
+		return "", nil, fmt.Errorf("failed to mount %s: %s %s", fullId, err, string(out))
+	}
+	return mountPath, func() error {
+		LogZFSCommand(fullId, fmt.Sprintf("umount %s", mountPath))
+		out, err := exec.Command("umount", mountPath).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("failed to unmount %s: %s %s", mountPath, err, string(out))
+		}
+		return os.Remove(mountPath)
+	}, nil
+}
+
 type zfs struct {
 	zfsPath   string
 	zpoolPath string
@@ -76,6 +167,20 @@ type zfs struct {
 	diffMu   sync.Mutex
 }
 
+// NewBackend returns the named storage backend: the ZFS pool poolName, or
+// btrfs subvolumes or a plain directory tree under dir.
+func NewBackend(backend, dir, zfsPath, zpoolPath, poolName, mountZFS string) (ZFS, error) {
+	switch backend {
+	case "", types.FilesystemBackendZFS:
+		return NewZFS(zfsPath, zpoolPath, poolName, mountZFS)
+	case types.FilesystemBackendBtrfs:
+		return NewBtrfs("btrfs", dir, poolName)
+	case types.FilesystemBackendDirectory:
+		return NewDirectory(dir, poolName)
+	}
+	return nil, fmt.Errorf("unknown filesystem backend %q", backend)
+}
+
 func NewZFS(zfsPath, zpoolPath, poolName, mountZFS string) (ZFS, error) {
 	zfsInter := &zfs{
 		zfsPath:   zfsPath,
@@ -143,6 +248,76 @@ func (z *zfs) Create(filesystemId string) ([]byte, error) {
 	return z.runOnFilesystem(filesystemId, "", []string{"create"})
 }
 
+func (z *zfs) CreateEncrypted(filesystemId, key string) ([]byte, error) {
+	fullName := z.FQ(filesystemId)
+	args := []string{
+		"create", "-o", "encryption=" + EncryptionAlgorithm,
+		"-o", "keyformat=hex", "-o", "keylocation=prompt", fullName,
+	}
+	LogZFSCommand(filesystemId, fmt.Sprintf("%s %s", z.zfsPath, strings.Join(args, " ")))
+	cmd := exec.Command(z.zfsPath, args...)
+	// the key is only ever given on stdin, so that it's never kept on disk
+	// or seen in the process list
+	cmd.Stdin = strings.NewReader(key + "\n")
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		log.Printf("%v while trying to create encrypted filesystem %s", err, fullName)
+	}
+	return output, err
+}
+
+func (z *zfs) LoadKey(filesystemId, key string) ([]byte, error) {
+	// branches are clones, which share the key of the dot they were cloned
+	// from, so it's loaded on whichever filesystem they inherit it from
+	out, err := exec.Command(
+		z.zfsPath, "get", "-H", "-o", "value", "encryptionroot", z.FQ(filesystemId),
+	).CombinedOutput()
+	if err != nil {
+		return out, err
+	}
+	root := strings.TrimSpace(string(out))
+	if root == "" || root == "-" {
+		return nil, fmt.Errorf("%s isn't encrypted", filesystemId)
+	}
+	LogZFSCommand(filesystemId, fmt.Sprintf("%s load-key %s", z.zfsPath, root))
+	cmd := exec.Command(z.zfsPath, "load-key", root)
+	cmd.Stdin = strings.NewReader(key + "\n")
+	return cmd.CombinedOutput()
+}
+
+func (z *zfs) KeyStatus(filesystemId string) (string, error) {
+	out, err := exec.Command(
+		z.zfsPath, "get", "-H", "-o", "value", "keystatus", z.FQ(filesystemId),
+	).CombinedOutput()
+	if err != nil {
+		if strings.Contains(string(out), "invalid property") {
+			// a version of zfs without native encryption
+			return "", nil
+		}
+		return "", fmt.Errorf("Error getting key status of %s: %v: %s", filesystemId, err, out)
+	}
+	return parseKeyStatus(string(out)), nil
+}
+
+func parseKeyStatus(output string) string {
+	status := strings.TrimSpace(output)
+	if status == "-" {
+		return ""
+	}
+	return status
+}
+
+// isEncrypted says whether filesystemId is encrypted, and so must be sent
+// raw. Not being able to tell is an error: sending an encrypted filesystem
+// that isn't raw would send it decrypted.
+func (z *zfs) isEncrypted(filesystemId string) (bool, error) {
+	status, err := z.KeyStatus(filesystemId)
+	if err != nil {
+		return false, err
+	}
+	return status != "", nil
+}
+
 func (z *zfs) Rollback(filesystemId, snapshotId string) ([]byte, error) {
 
 	err := z.clearMounts(filesystemId)
@@ -204,6 +379,13 @@ func (z *zfs) Snapshot(filesystemId string, snapshotId string, meta []string) ([
 	return z.runOnFilesystem(filesystemId, snapshotId, args)
 }
 
+func (z *zfs) DestroySnapshot(filesystemId, snapshotId string) ([]byte, error) {
+	if snapshotId == "" {
+		return nil, fmt.Errorf("refusing to destroy %s, no snapshot given", filesystemId)
+	}
+	return z.runOnFilesystem(filesystemId, snapshotId, []string{"destroy"})
+}
+
 func (z *zfs) List(filesystemId, snapshotId string) ([]byte, error) {
 	return z.runOnFilesystem(filesystemId, snapshotId, []string{"list"})
 }
@@ -351,6 +533,40 @@ func (z *zfs) GetZPoolCapacity() (float64, error) {
 	return capacityF, err
 }
 
+func (z *zfs) ScrubStatus() (string, error) {
+	output, err := exec.Command(z.zpoolPath, "status", z.poolName).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("%s, when running zpool status: %s", err, output)
+	}
+	return parseScanStatus(string(output)), nil
+}
+
+// parseScanStatus picks the "scan:" section out of zpool status output,
+// which runs over several lines while a scrub is in progress
+func parseScanStatus(status string) string {
+	lines := []string{}
+	for _, line := range strings.Split(status, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "scan:") {
+			lines = append(lines, strings.TrimSpace(strings.TrimPrefix(line, "scan:")))
+			continue
+		}
+		if len(lines) == 0 {
+			continue
+		}
+		// the next section, e.g. "config:", or the blank line before it
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasSuffix(fields[0], ":") {
+			break
+		}
+		lines = append(lines, line)
+	}
+	if len(lines) == 0 {
+		return "unknown"
+	}
+	return strings.Join(lines, "; ")
+}
+
 func (z *zfs) findLocalPoolId() (string, error) {
 	output, err := exec.Command(z.zfsPath, "get", "-H", "guid", z.poolName).CombinedOutput()
 	if err != nil {
@@ -533,7 +749,10 @@ func (z *zfs) StashBranch(existingFs string, newFs string, rollbackTo string) er
 		   package generated.
 */
 func (z *zfs) PredictSize(fromFilesystemId, fromSnapshotId, toFilesystemId, toSnapshotId string) (int64, error) {
-	sendArgs := z.calculateSendArgs(fromFilesystemId, fromSnapshotId, toFilesystemId, toSnapshotId)
+	sendArgs, err := z.calculateSendArgs(fromFilesystemId, fromSnapshotId, toFilesystemId, toSnapshotId)
+	if err != nil {
+		return 0, err
+	}
 	predictArgs := []string{"send", "-nP"}
 	predictArgs = append(predictArgs, sendArgs...)
 
@@ -564,7 +783,7 @@ func (z *zfs) PredictSize(fromFilesystemId, fromSnapshotId, toFilesystemId, toSn
 	return size, nil
 }
 
-func (z *zfs) calculateSendArgs(fromFilesystemId, fromSnapshotId, toFilesystemId, toSnapshotId string) []string {
+func (z *zfs) calculateSendArgs(fromFilesystemId, fromSnapshotId, toFilesystemId, toSnapshotId string) ([]string, error) {
 
 	// toFilesystemId
 	// snapRange.toSnap.Id
@@ -599,11 +818,22 @@ func (z *zfs) calculateSendArgs(fromFilesystemId, fromSnapshotId, toFilesystemId
 			"-p", "-I", fromSnap, z.FQ(toFilesystemId) + "@" + toSnapshotId,
 		}
 	}
-	return sendArgs
+	encrypted, err := z.isEncrypted(toFilesystemId)
+	if err != nil {
+		return nil, err
+	}
+	if encrypted {
+		// raw, so that what's received stays encrypted and the receiver
+		// doesn't need the key
+		sendArgs = append([]string{"-w"}, sendArgs...)
+	}
+	return sendArgs, nil
 }
 
-func (z *zfs) Recv(pipeReader *io.PipeReader, toFilesystemId string, errBuffer *bytes.Buffer) error {
-	cmd := exec.Command(z.zfsPath, "recv", z.FQ(toFilesystemId))
+// Recv receives a stream written by Send into toFilesystemId. Cancelling ctx
+// kills the zfs recv, which throws away what it's received so far.
+func (z *zfs) Recv(ctx context.Context, pipeReader *io.PipeReader, toFilesystemId string, errBuffer *bytes.Buffer) error {
+	cmd := exec.CommandContext(ctx, z.zfsPath, "recv", z.FQ(toFilesystemId))
 
 	cmd.Stdin = pipeReader
 	cmd.Stdout = utils.GetLogfile("zfs-recv-stdout")
@@ -642,24 +872,89 @@ func (z *zfs) ApplyPrelude(prelude types.Prelude, fs string) error {
 	return nil
 }
 
-func (z *zfs) Send(fromFilesystemId, fromSnapshotId, toFilesystemId, toSnapshotId string, preludeEncoded []byte) (*io.PipeReader, chan error) {
+func (z *zfs) SetRegistryProperties(filesystemId string, properties types.RegistryProperties) error {
+	encoded, err := json.Marshal(properties)
+	if err != nil {
+		return err
+	}
+	value := base64.StdEncoding.EncodeToString(encoded)
+	current, err := z.registryPropertiesValue(filesystemId)
+	if err != nil {
+		return err
+	}
+	if current == value {
+		return nil
+	}
+	out, err := exec.Command(
+		z.zfsPath, "set", types.RegistryPropertiesKey+"="+value, z.FQ(filesystemId),
+	).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("Error setting registry properties on %s: %v: %s", filesystemId, err, out)
+	}
+	return nil
+}
+
+func (z *zfs) GetRegistryProperties(filesystemId string) (*types.RegistryProperties, error) {
+	value, err := z.registryPropertiesValue(filesystemId)
+	if err != nil || value == "" {
+		return nil, err
+	}
+	decoded, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to base64 decode registry properties of %s: %s", filesystemId, err)
+	}
+	properties := &types.RegistryProperties{}
+	err = json.Unmarshal(decoded, properties)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to decode registry properties of %s: %s", filesystemId, err)
+	}
+	return properties, nil
+}
+
+// registryPropertiesValue is the encoded registry properties of a
+// filesystem, "" if they've never been set
+func (z *zfs) registryPropertiesValue(filesystemId string) (string, error) {
+	out, err := exec.Command(
+		z.zfsPath, "get", "-H", "-o", "value", types.RegistryPropertiesKey, z.FQ(filesystemId),
+	).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("Error getting registry properties of %s: %v: %s", filesystemId, err, out)
+	}
+	value := strings.TrimSpace(string(out))
+	if value == "-" {
+		return "", nil
+	}
+	return value, nil
+}
+
+// Send starts a zfs send of toFilesystemId's snapshots from fromSnapshotId to
+// toSnapshotId, returning a reader of the prelude followed by the stream, and
+// a channel that zfs send's result is sent on. Cancelling ctx kills it.
+func (z *zfs) Send(ctx context.Context, fromFilesystemId, fromSnapshotId, toFilesystemId, toSnapshotId string, preludeEncoded []byte) (*io.PipeReader, chan error) {
 	log.WithFields(log.Fields{
 		"fromFilesystemId": fromFilesystemId,
 		"fromSnapshotId":   fromSnapshotId,
 		"toFilesystemId":   toFilesystemId,
 		"toSnapshotId":     toSnapshotId,
 	}).Debug("zfs.Send() starting")
-	sendArgs := z.calculateSendArgs(
+	pipeReader, pipeWriter := io.Pipe()
+	errch := make(chan error)
+	sendArgs, err := z.calculateSendArgs(
 		fromFilesystemId, fromSnapshotId, toFilesystemId, toSnapshotId,
 	)
+	if err != nil {
+		go func() {
+			pipeWriter.CloseWithError(err)
+			errch <- err
+		}()
+		return pipeReader, errch
+	}
 	realArgs := []string{"send"}
 	realArgs = append(realArgs, sendArgs...)
 	LogZFSCommand(fromFilesystemId, fmt.Sprintf("%s %s", z.zfsPath, strings.Join(realArgs, " ")))
-	cmd := exec.Command(z.zfsPath, realArgs...)
-	pipeReader, pipeWriter := io.Pipe()
+	cmd := exec.CommandContext(ctx, z.zfsPath, realArgs...)
 	cmd.Stdout = pipeWriter
 	cmd.Stderr = utils.GetLogfile("zfs-send-errors")
-	errch := make(chan error)
 	go func() {
 		// This goroutine does all the writing to the HTTP POST
 		// log.Printf(
@@ -703,7 +998,15 @@ func (z *zfs) Send(fromFilesystemId, fromSnapshotId, toFilesystemId, toSnapshotI
 }
 
 func (z *zfs) Fork(filesystemId, latestSnapshot, forkFilesystemId string) error {
-	sendCommand := exec.Command(z.zfsPath, "send", "-R", z.fullZFSFilesystemPath(filesystemId, latestSnapshot))
+	sendArgs := []string{"send", "-R", z.fullZFSFilesystemPath(filesystemId, latestSnapshot)}
+	encrypted, err := z.isEncrypted(filesystemId)
+	if err != nil {
+		return err
+	}
+	if encrypted {
+		sendArgs = []string{"send", "-w", "-R", z.fullZFSFilesystemPath(filesystemId, latestSnapshot)}
+	}
+	sendCommand := exec.Command(z.zfsPath, sendArgs...)
 	recvCommand := exec.Command(z.zfsPath, "recv", z.fullZFSFilesystemPath(forkFilesystemId, ""))
 	in, out, err := os.Pipe()
 	if err != nil {
@@ -997,44 +1300,7 @@ func (z *zfs) Diff(filesystemID string) ([]types.ZFSFileDiff, error) {
 		return nil, err
 	}
 
-	result := map[string]types.ZFSFileDiff{}
-	resultFiles := []string{}
-
-	for filename, tmpProps := range mapTmp {
-		if latestProps, ok := mapLatest[filename]; ok {
-			// exists in previous snap, check if modified
-			if tmpProps != latestProps {
-				// modified!
-				resultFiles = append(resultFiles, filename)
-				result[filename] = types.ZFSFileDiff{
-					Change:   types.FileChangeModified,
-					Filename: filename,
-				}
-			}
-		} else {
-			// does not exist in previous snap, created
-			resultFiles = append(resultFiles, filename)
-			result[filename] = types.ZFSFileDiff{
-				Change:   types.FileChangeAdded,
-				Filename: filename,
-			}
-		}
-	}
-	for filename, _ := range mapLatest {
-		if _, ok := mapTmp[filename]; !ok {
-			// exists in latest but not tmp, must have been deleted
-			resultFiles = append(resultFiles, filename)
-			result[filename] = types.ZFSFileDiff{
-				Change:   types.FileChangeRemoved,
-				Filename: filename,
-			}
-		}
-	}
-	sort.Strings(resultFiles)
-	sortedResult := []types.ZFSFileDiff{}
-	for _, file := range resultFiles {
-		sortedResult = append(sortedResult, result[file])
-	}
+	sortedResult := diffSides(mapLatest, mapTmp)
 
 	// only try to clean up latest mount if we needed to mount it at all
 	if mountedLatest {
@@ -1077,7 +1343,57 @@ func (z *zfs) Diff(filesystemID string) ([]types.ZFSFileDiff, error) {
 	return sortedResult, nil
 }
 
+// diffSides lists the files added, modified and removed between the latest
+// commit and the current state of a filesystem, in filename order
+func diffSides(latest, current DiffSide) []types.ZFSFileDiff {
+	result := map[string]types.ZFSFileDiff{}
+	resultFiles := []string{}
+
+	for filename, currentProps := range current {
+		if latestProps, ok := latest[filename]; ok {
+			// exists in previous snap, check if modified
+			if currentProps != latestProps {
+				// modified!
+				resultFiles = append(resultFiles, filename)
+				result[filename] = types.ZFSFileDiff{
+					Change:   types.FileChangeModified,
+					Filename: filename,
+				}
+			}
+		} else {
+			// does not exist in previous snap, created
+			resultFiles = append(resultFiles, filename)
+			result[filename] = types.ZFSFileDiff{
+				Change:   types.FileChangeAdded,
+				Filename: filename,
+			}
+		}
+	}
+	for filename, _ := range latest {
+		if _, ok := current[filename]; !ok {
+			// exists in latest but not tmp, must have been deleted
+			resultFiles = append(resultFiles, filename)
+			result[filename] = types.ZFSFileDiff{
+				Change:   types.FileChangeRemoved,
+				Filename: filename,
+			}
+		}
+	}
+	sort.Strings(resultFiles)
+	sortedResult := []types.ZFSFileDiff{}
+	for _, file := range resultFiles {
+		sortedResult = append(sortedResult, result[file])
+	}
+	return sortedResult
+}
+
 func (z *zfs) clearMounts(filesystem string) error {
+	return clearMounts("zfs", filesystem)
+}
+
+// clearMounts unmounts filesystem and its snapshots, wherever they're
+// mounted, as long as they're mounts of type fsType ("" for any type)
+func clearMounts(fsType, filesystem string) error {
 
 	f, err := os.Open("/proc/self/mountinfo")
 	if err != nil {
@@ -1087,7 +1403,7 @@ func (z *zfs) clearMounts(filesystem string) error {
 	r := bufio.NewReader(f)
 	mountPrefix := os.Getenv("MOUNT_PREFIX")
 
-	mountpoints, err := filterMountpoints(mountPrefix, filesystem, r)
+	mountpoints, err := filterMountpoints(fsType, mountPrefix, filesystem, r)
 	if err != nil {
 		return fmt.Errorf("failed to get filesystem %s mountpoints, error: %s", filesystem, err)
 	}
@@ -1,6 +1,8 @@
 package zfs
 
 import (
+	"context"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"os/exec"
@@ -19,6 +21,126 @@ import (
 var out = `CREATION
 1575386313`
 
+func TestParseScanStatus(t *testing.T) {
+	for name, tc := range map[string]struct {
+		status   string
+		expected string
+	}{
+		"finished": {
+			status: `  pool: pool
+ state: ONLINE
+  scan: scrub repaired 0B in 0 days 00:00:01 with 0 errors on Sun Oct 11 00:24:02 2020
+config:
+
+	NAME        STATE     READ WRITE CKSUM
+	pool        ONLINE       0     0     0
+`,
+			expected: "scrub repaired 0B in 0 days 00:00:01 with 0 errors on Sun Oct 11 00:24:02 2020",
+		},
+		"in progress": {
+			status: `  pool: pool
+ state: ONLINE
+  scan: scrub in progress since Sun Oct 11 00:24:02 2020
+	1.23G scanned at 100M/s, 512M issued at 40M/s, 10.0G total
+	0B repaired, 5.00% done, 0 days 00:04:00 to go
+config:
+`,
+			expected: "scrub in progress since Sun Oct 11 00:24:02 2020; 1.23G scanned at 100M/s, 512M issued at 40M/s, 10.0G total; 0B repaired, 5.00% done, 0 days 00:04:00 to go",
+		},
+		"never": {
+			status: `  pool: pool
+ state: ONLINE
+  scan: none requested
+config:
+`,
+			expected: "none requested",
+		},
+		"missing": {
+			status:   "  pool: pool\n state: ONLINE\n",
+			expected: "unknown",
+		},
+	} {
+		if got := parseScanStatus(tc.status); got != tc.expected {
+			t.Errorf("%s: expected %q, got %q", name, tc.expected, got)
+		}
+	}
+}
+
+func TestNormalizeEncryptionKey(t *testing.T) {
+	key := "00112233445566778899AABBCCDDEEFF00112233445566778899aabbccddeeff"
+	got, err := NormalizeEncryptionKey(" " + key + "\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "00112233445566778899aabbccddeeff00112233445566778899aabbccddeeff" {
+		t.Errorf("unexpected key %q", got)
+	}
+	for _, bad := range []string{"", key[:63], key + "0", key[:63] + "g"} {
+		if _, err := NormalizeEncryptionKey(bad); err == nil {
+			t.Errorf("expected %q to be rejected", bad)
+		}
+	}
+}
+
+func TestParseKeyStatus(t *testing.T) {
+	for output, expected := range map[string]string{
+		"available\n":   "available",
+		"unavailable\n": "unavailable",
+		"-\n":           "",
+	} {
+		if got := parseKeyStatus(output); got != expected {
+			t.Errorf("%q: expected %q, got %q", output, expected, got)
+		}
+	}
+}
+
+// keyedZFS is a ZFS that only knows about keys
+type keyedZFS struct {
+	ZFS
+	status string
+	loaded []string
+}
+
+func (k *keyedZFS) KeyStatus(filesystemId string) (string, error) {
+	return k.status, nil
+}
+
+func (k *keyedZFS) LoadKey(filesystemId, key string) ([]byte, error) {
+	k.loaded = append(k.loaded, key)
+	k.status = "available"
+	return nil, nil
+}
+
+func TestEnsureKeyLoaded(t *testing.T) {
+	key := func() (string, error) { return "k", nil }
+
+	for _, status := range []string{"", "available"} {
+		z := &keyedZFS{status: status}
+		got, err := EnsureKeyLoaded(z, "fs", key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != status || len(z.loaded) != 0 {
+			t.Errorf("%q: expected the key to be left alone, got %q after loading %v", status, got, z.loaded)
+		}
+	}
+
+	z := &keyedZFS{status: "unavailable"}
+	got, err := EnsureKeyLoaded(z, "fs", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "available" || !reflect.DeepEqual(z.loaded, []string{"k"}) {
+		t.Errorf("expected the key to be loaded, got %q after loading %v", got, z.loaded)
+	}
+
+	z = &keyedZFS{status: "unavailable"}
+	_, err = EnsureKeyLoaded(z, "fs", func() (string, error) { return "", fmt.Errorf("no key") })
+	if err == nil || len(z.loaded) != 0 {
+		t.Errorf("expected an error without a key, got %v after loading %v", err, z.loaded)
+	}
+}
+
 func TestParseCreationOutput(t *testing.T) {
 	t1, err := parseSnapshotCreationTime(out)
 	if err != nil {
@@ -279,3 +401,41 @@ func TestZFSDiffFileModified(t *testing.T) {
 	expectChangesFromDiff(t, z, fsName, types.ZFSFileDiff{Change: types.FileChangeModified, Filename: "myfile.txt"})
 	checkDirtyDelta(t, z, fsName, "myfirstsnapshot", true, true)
 }
+
+// TestUnknownEncryptionFailsClosed checks that nothing is sent when it can't
+// be told whether a filesystem is encrypted, as sending an encrypted one that
+// isn't raw would send it decrypted
+func TestUnknownEncryptionFailsClosed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zfs-fails-closed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sent := filepath.Join(dir, "sent")
+	fakeZFS := filepath.Join(dir, "zfs")
+	err = ioutil.WriteFile(fakeZFS, []byte(`#!/bin/sh
+case "$1" in
+get) echo "cannot open 'pool/dmfs/fs': pool I/O is currently suspended"; exit 1 ;;
+send) touch `+sent+` ;;
+esac
+`), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	z := &zfs{zfsPath: fakeZFS, poolName: "pool"}
+
+	pipeReader, errch := z.Send(context.Background(), "", "", "fs", "snap", []byte("prelude"))
+	_, readErr := ioutil.ReadAll(pipeReader)
+	if err = <-errch; err == nil || readErr == nil {
+		t.Errorf("expected the send to fail, got %v reading %v", err, readErr)
+	}
+	if _, err = z.PredictSize("", "", "fs", "snap"); err == nil {
+		t.Error("expected predicting the size of the send to fail")
+	}
+	if err = z.Fork("fs", "snap", "fork"); err == nil {
+		t.Error("expected the fork to fail")
+	}
+	if _, err = os.Stat(sent); err == nil {
+		t.Error("expected nothing to be sent")
+	}
+}